@@ -0,0 +1,20 @@
+#!/bin/bash
+
+# Build script for the C shared library (libseektune)
+
+echo "Building shared library..."
+
+case "$(go env GOOS)" in
+    darwin) LIB_NAME="libseektune.dylib" ;;
+    windows) LIB_NAME="seektune.dll" ;;
+    *) LIB_NAME="libseektune.so" ;;
+esac
+
+CGO_ENABLED=1 go build -buildmode=c-shared -o "$LIB_NAME" clib_main.go
+
+if [ $? -eq 0 ]; then
+    echo "✓ Shared library build successful: $LIB_NAME (header: ${LIB_NAME%.*}.h)"
+else
+    echo "x Shared library build failed"
+    exit 1
+fi
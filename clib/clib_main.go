@@ -0,0 +1,150 @@
+package main
+
+/*
+#include <stdlib.h>
+*/
+import "C"
+
+import (
+	"encoding/json"
+	"song-recognition/models"
+	"song-recognition/shazam"
+	"unsafe"
+)
+
+// abiVersion is bumped whenever an exported signature or the shape of a
+// returned JSON document changes in a backwards incompatible way. Version 2
+// writes song IDs as UUID strings with SONG_ID_SCHEME=uuid.
+const abiVersion = 2
+
+// result is the JSON envelope returned by every exported function.
+// Error is 0 on success, in which case Data holds the payload; otherwise
+// Data holds an error message.
+type result struct {
+	Error int         `json:"error"`
+	Data  interface{} `json:"data"`
+}
+
+type fingerprintEntry struct {
+	Address    uint32 `json:"address"`
+	AnchorTime uint32 `json:"anchorTime"`
+}
+
+func respond(code int, data interface{}) *C.char {
+	out, err := json.Marshal(result{Error: code, Data: data})
+	if err != nil {
+		out, _ = json.Marshal(result{Error: 4, Data: "failed to encode result: " + err.Error()})
+	}
+	return C.CString(string(out))
+}
+
+func samplesFromC(samples *C.double, length C.int) []float64 {
+	if samples == nil || length <= 0 {
+		return nil
+	}
+	cSamples := unsafe.Slice((*float64)(unsafe.Pointer(samples)), int(length))
+
+	audio := make([]float64, len(cSamples))
+	copy(audio, cSamples)
+	return audio
+}
+
+func sampleFingerprint(samples *C.double, length, sampleRate, channels C.int) (map[uint32]uint32, *C.char) {
+	audio := samplesFromC(samples, length)
+	if len(audio) == 0 {
+		return nil, respond(1, "Expected a non-empty audio buffer")
+	}
+	if channels != 1 && channels != 2 {
+		return nil, respond(2, "Invalid number of channels; expected 1 or 2")
+	}
+
+	fingerprint, err := shazam.FingerprintSamples(audio, int(sampleRate), int(channels), models.NewSongID())
+	if err != nil {
+		return nil, respond(3, "Error generating fingerprint: "+err.Error())
+	}
+
+	sample := make(map[uint32]uint32, len(fingerprint))
+	for address, couple := range fingerprint {
+		sample[address] = couple.AnchorTimeMs
+	}
+	return sample, nil
+}
+
+// SeekTuneABIVersion returns the version of the exported C ABI.
+//
+//export SeekTuneABIVersion
+func SeekTuneABIVersion() C.int {
+	return abiVersion
+}
+
+// SeekTuneFingerprint fingerprints normalised PCM samples (interleaved when
+// stereo) and returns a JSON document whose data is an array of
+// {address, anchorTime} entries. The result must be released with SeekTuneFree.
+//
+//export SeekTuneFingerprint
+func SeekTuneFingerprint(samples *C.double, length, sampleRate, channels C.int) *C.char {
+	fingerprint, errResult := sampleFingerprint(samples, length, sampleRate, channels)
+	if errResult != nil {
+		return errResult
+	}
+
+	entries := make([]fingerprintEntry, 0, len(fingerprint))
+	for address, anchorTime := range fingerprint {
+		entries = append(entries, fingerprintEntry{address, anchorTime})
+	}
+	return respond(0, entries)
+}
+
+// SeekTuneRecognize fingerprints normalised PCM samples and matches them
+// against the database configured through the usual environment variables.
+// The result must be released with SeekTuneFree.
+//
+//export SeekTuneRecognize
+func SeekTuneRecognize(samples *C.double, length, sampleRate, channels C.int) *C.char {
+	fingerprint, errResult := sampleFingerprint(samples, length, sampleRate, channels)
+	if errResult != nil {
+		return errResult
+	}
+
+	matches, _, err := shazam.FindMatchesFGP(fingerprint)
+	if err != nil {
+		return respond(5, "Error finding matches: "+err.Error())
+	}
+	return respond(0, matches)
+}
+
+// SeekTuneRecognizeFingerprint matches a precomputed fingerprint, given as a
+// JSON array of {address, anchorTime} entries. The result must be released
+// with SeekTuneFree.
+//
+//export SeekTuneRecognizeFingerprint
+func SeekTuneRecognizeFingerprint(fingerprintJSON *C.char) *C.char {
+	if fingerprintJSON == nil {
+		return respond(1, "Expected a fingerprint")
+	}
+
+	var entries []fingerprintEntry
+	if err := json.Unmarshal([]byte(C.GoString(fingerprintJSON)), &entries); err != nil {
+		return respond(2, "Invalid fingerprint JSON: "+err.Error())
+	}
+
+	fingerprint := make(map[uint32]uint32, len(entries))
+	for _, entry := range entries {
+		fingerprint[entry.Address] = entry.AnchorTime
+	}
+
+	matches, _, err := shazam.FindMatchesFGP(fingerprint)
+	if err != nil {
+		return respond(5, "Error finding matches: "+err.Error())
+	}
+	return respond(0, matches)
+}
+
+// SeekTuneFree releases a string returned by one of the exported functions.
+//
+//export SeekTuneFree
+func SeekTuneFree(str *C.char) {
+	C.free(unsafe.Pointer(str))
+}
+
+func main() {}
@@ -62,6 +62,11 @@ function App() {
       cleanUp();
     });
 
+    socket.on("recognitionBusy", (msg) => {
+      toast.error(msg);
+      cleanUp();
+    });
+
     socket.on("downloadStatus", (msg) => {
       msg = JSON.parse(msg);
       const msgTypes = ["info", "success", "error"];
@@ -0,0 +1,178 @@
+// Package acl restricts which API clients can recognise and see songs, so a
+// shared deployment can host catalogs with different licensing.
+package acl
+
+import (
+	"encoding/json"
+	"fmt"
+	"song-recognition/auth"
+	"song-recognition/cached"
+	"song-recognition/db"
+	"song-recognition/models"
+	"strconv"
+	"time"
+)
+
+const (
+	songsCollection = "song_acl"
+	tagsCollection  = "tag_acl"
+	reloadInterval  = 30 * time.Second
+)
+
+// SongRule restricts a song to some clients and tags it, so that the rules
+// of its tags apply too.
+type SongRule struct {
+	SongID  models.SongID `json:"songId"`
+	Allowed []string      `json:"allowed,omitempty"` // client IDs or tenants, everyone if empty
+	Tags    []string      `json:"tags,omitempty"`
+}
+
+// TagRule restricts every song with the tag to some clients.
+type TagRule struct {
+	Tag     string   `json:"tag"`
+	Allowed []string `json:"allowed"` // client IDs or tenants
+}
+
+// Policy holds every rule. Songs without rules are visible to everyone.
+type Policy struct {
+	Songs map[models.SongID]SongRule `json:"songs"`
+	Tags  map[string]TagRule         `json:"tags"`
+}
+
+func allows(allowed []string, client auth.Client) bool {
+	for _, principal := range allowed {
+		if principal == client.ID || (client.Tenant != "" && principal == client.Tenant) {
+			return true
+		}
+	}
+	return false
+}
+
+// Visible reports whether a client may see a song. Unsigned requests come
+// from the zero client, which only sees unrestricted songs.
+func (p Policy) Visible(client auth.Client, songID models.SongID) bool {
+	rule, ok := p.Songs[songID]
+	if !ok {
+		return true
+	}
+	if len(rule.Allowed) > 0 && !allows(rule.Allowed, client) {
+		return false
+	}
+	for _, tag := range rule.Tags {
+		if tagRule, ok := p.Tags[tag]; ok && !allows(tagRule.Allowed, client) {
+			return false
+		}
+	}
+	return true
+}
+
+// Filter returns a function reporting whether the client may see a song, or
+// nil when no song is restricted.
+func Filter(client auth.Client) func(songID models.SongID) bool {
+	policy := Current()
+	if len(policy.Songs) == 0 {
+		return nil
+	}
+	return func(songID models.SongID) bool {
+		return policy.Visible(client, songID)
+	}
+}
+
+var cache = cached.New(reloadInterval, Load)
+
+// Current returns the policy, reloading it from the database at most every
+// 30 seconds so that rules set on other instances are picked up. If the
+// rules can't be loaded the previous policy is kept.
+func Current() Policy {
+	return cache.Get()
+}
+
+// Load reads every rule from the database.
+func Load() (Policy, error) {
+	policy := Policy{Songs: map[models.SongID]SongRule{}, Tags: map[string]TagRule{}}
+
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		return policy, err
+	}
+	defer dbClient.Close()
+
+	records, err := dbClient.ListRecords(songsCollection, db.RecordFilter{})
+	if err != nil {
+		return policy, err
+	}
+	for _, record := range records {
+		var rule SongRule
+		if err := json.Unmarshal(record.Data, &rule); err != nil {
+			return policy, fmt.Errorf("failed to unmarshal song rule %s: %v", record.ID, err)
+		}
+		policy.Songs[rule.SongID] = rule
+	}
+
+	records, err = dbClient.ListRecords(tagsCollection, db.RecordFilter{})
+	if err != nil {
+		return policy, err
+	}
+	for _, record := range records {
+		var rule TagRule
+		if err := json.Unmarshal(record.Data, &rule); err != nil {
+			return policy, fmt.Errorf("failed to unmarshal tag rule %s: %v", record.ID, err)
+		}
+		policy.Tags[rule.Tag] = rule
+	}
+
+	return policy, nil
+}
+
+func put(collection, id string, rule interface{}) error {
+	data, err := json.Marshal(rule)
+	if err != nil {
+		return fmt.Errorf("failed to marshal rule: %v", err)
+	}
+
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		return err
+	}
+	defer dbClient.Close()
+
+	if err := dbClient.PutRecord(collection, db.Record{ID: id, CreatedAt: time.Now().UTC(), Data: data}); err != nil {
+		return err
+	}
+	cache.Invalidate()
+	return nil
+}
+
+func remove(collection, id string) error {
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		return err
+	}
+	defer dbClient.Close()
+
+	if err := dbClient.DeleteRecord(collection, id); err != nil {
+		return err
+	}
+	cache.Invalidate()
+	return nil
+}
+
+// SetSongRule creates or replaces the rule of a song.
+func SetSongRule(rule SongRule) error {
+	return put(songsCollection, strconv.FormatUint(uint64(rule.SongID), 10), rule)
+}
+
+// DeleteSongRule makes a song unrestricted again.
+func DeleteSongRule(songID models.SongID) error {
+	return remove(songsCollection, strconv.FormatUint(uint64(songID), 10))
+}
+
+// SetTagRule creates or replaces the rule of a tag.
+func SetTagRule(rule TagRule) error {
+	return put(tagsCollection, rule.Tag, rule)
+}
+
+// DeleteTagRule lifts the restriction of a tag.
+func DeleteTagRule(tag string) error {
+	return remove(tagsCollection, tag)
+}
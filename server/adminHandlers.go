@@ -0,0 +1,702 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"song-recognition/acl"
+	"song-recognition/breaker"
+	"song-recognition/db"
+	"song-recognition/exclusions"
+	"song-recognition/feed"
+	"song-recognition/ingest"
+	"song-recognition/models"
+	"song-recognition/priority"
+	"song-recognition/shadow"
+	"song-recognition/shazam"
+	"song-recognition/spotify"
+	"song-recognition/utils"
+	"song-recognition/wav"
+	"strings"
+
+	"github.com/mdobak/go-xerrors"
+)
+
+func registerAdminHandlers(mux *http.ServeMux) {
+	mux.Handle("POST /api/admin/prune-orphans", requireAdmin(inBackground(handlePruneOrphans)))
+	mux.Handle("POST /api/admin/compact", requireAdmin(inBackground(handleCompact)))
+	mux.Handle("POST /api/admin/songs/{id}/reindex", requireAdmin(inBackground(handleReindexSong)))
+	mux.Handle("POST /api/admin/snapshot", requireAdmin(handleSnapshot))
+	mux.Handle("GET /api/admin/failures", requireAdmin(handleListFailures))
+	mux.Handle("POST /api/admin/failures/retry", requireAdmin(handleRetryFailures))
+	mux.Handle("POST /api/admin/feeds", requireAdmin(handleImportFeed))
+	mux.Handle("GET /api/admin/feeds", requireAdmin(handleListFeedImports))
+	mux.Handle("GET /api/admin/feeds/{id}", requireAdmin(handleGetFeedImport))
+	mux.Handle("POST /api/admin/calibration/fit", requireAdmin(handleFitCalibration))
+	mux.Handle("DELETE /api/admin/clients/{id}/history", requireAdmin(handleDeleteClientHistory))
+	mux.Handle("GET /api/admin/clients/settings", requireAdmin(handleListClientSettings))
+	mux.Handle("GET /api/admin/clients/{id}/settings", requireAdmin(handleGetClientSettings))
+	mux.Handle("PUT /api/admin/clients/{id}/settings", requireAdmin(handleSetClientSettings))
+	mux.Handle("DELETE /api/admin/clients/{id}/settings", requireAdmin(handleDeleteClientSettings))
+	mux.Handle("POST /api/admin/retention/purge", requireAdmin(handlePurgeExpired))
+	mux.Handle("GET /api/admin/acl", requireAdmin(handleListACL))
+	mux.Handle("PUT /api/admin/songs/{id}/acl", requireAdmin(handleSetSongACL))
+	mux.Handle("DELETE /api/admin/songs/{id}/acl", requireAdmin(handleDeleteSongACL))
+	mux.Handle("PUT /api/admin/tags/{tag}/acl", requireAdmin(handleSetTagACL))
+	mux.Handle("DELETE /api/admin/tags/{tag}/acl", requireAdmin(handleDeleteTagACL))
+	mux.Handle("GET /api/admin/exclusions", requireAdmin(handleListExclusions))
+	mux.Handle("PUT /api/admin/songs/{id}/exclusions", requireAdmin(handleSetExclusions))
+	mux.Handle("DELETE /api/admin/songs/{id}/exclusions", requireAdmin(handleDeleteExclusions))
+	mux.Handle("GET /api/admin/shared-audio", requireAdmin(handleGetSharedAudio))
+	mux.Handle("POST /api/admin/shared-audio/{id}/exclude", requireAdmin(handleExcludeSharedAudio))
+	mux.Handle("GET /api/admin/monitors", requireAdmin(handleListMonitors))
+	mux.Handle("POST /api/admin/monitors", requireAdmin(handleCreateMonitor))
+	mux.Handle("GET /api/admin/monitors/simulcasts", requireAdmin(handleListSimulcasts))
+	mux.Handle("GET /api/admin/monitors/{id}", requireAdmin(handleGetMonitor))
+	mux.Handle("PUT /api/admin/monitors/{id}", requireAdmin(handleUpdateMonitor))
+	mux.Handle("DELETE /api/admin/monitors/{id}", requireAdmin(handleDeleteMonitor))
+	mux.Handle("POST /api/admin/monitors/{id}/pause", requireAdmin(handlePauseMonitor(true)))
+	mux.Handle("POST /api/admin/monitors/{id}/resume", requireAdmin(handlePauseMonitor(false)))
+	mux.Handle("GET /api/admin/monitors/{id}/recordings", requireAdmin(handleListRecordings))
+	mux.Handle("GET /api/admin/monitors/{id}/recordings/{name}", requireAdmin(handleGetRecording))
+	mux.Handle("GET /api/admin/jobs", requireAdmin(handleListJobs))
+	mux.Handle("GET /api/admin/jobs/{name}/runs", requireAdmin(handleListJobRuns))
+	mux.Handle("POST /api/admin/jobs/{name}/run", requireAdmin(handleRunJob))
+	mux.Handle("GET /api/admin/hotness", requireAdmin(handleGetHotness))
+	mux.Handle("GET /api/admin/metadata/backfill", requireAdmin(handleGetMetadataBackfill))
+	mux.Handle("GET /api/admin/youtube-links", requireAdmin(handleListLinks))
+	mux.Handle("GET /api/admin/stats", requireAdmin(handleStats))
+	mux.Handle("GET /api/admin/catalog/stats", requireAdmin(handleGetCatalogStats))
+	mux.Handle("GET /api/admin/songs/{id}/stats", requireAdmin(handleGetSongStats))
+	mux.Handle("GET /api/admin/schema", requireAdmin(handleGetSchema))
+	mux.Handle("POST /api/admin/reload", requireAdmin(handleReload))
+	mux.Handle("GET /api/admin/dependencies", requireAdmin(handleListDependencies))
+	mux.Handle("GET /api/admin/disk-space", requireAdmin(handleGetDiskSpace))
+	mux.Handle("GET /api/admin/shadow", requireAdmin(handleGetShadow))
+}
+
+// requireAdmin only lets requests carrying ADMIN_TOKEN as a bearer token
+// through. The admin API is disabled when no token is configured.
+func requireAdmin(next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		adminToken := utils.GetEnv("ADMIN_TOKEN")
+		if adminToken == "" {
+			writeError(w, http.StatusForbidden, "admin API is disabled (ADMIN_TOKEN not set)")
+			return
+		}
+
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+			writeError(w, http.StatusUnauthorized, "invalid admin token")
+			return
+		}
+
+		next(w, r)
+	})
+}
+
+// inBackground runs maintenance handlers as background work, so they only use
+// the workers and database connections interactive recognitions leave.
+func inBackground(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		release, err := priority.Acquire(r.Context(), priority.Background)
+		if err != nil {
+			return
+		}
+		defer release()
+
+		next(w, r)
+	}
+}
+
+func handleAdminError(w http.ResponseWriter, r *http.Request, msg string, err error) {
+	logger := utils.GetLogger()
+	err = xerrors.New(err)
+	logger.ErrorContext(r.Context(), msg, slog.Any("error", err))
+	writeError(w, http.StatusInternalServerError, fmt.Sprintf("%s: %v", msg, err))
+}
+
+func handlePruneOrphans(w http.ResponseWriter, r *http.Request) {
+	orphans, err := pruneOrphans()
+	if err != nil {
+		handleAdminError(w, r, "failed to prune orphans", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"orphanSongIDs": orphans, "removed": len(orphans)})
+}
+
+func handleCompact(w http.ResponseWriter, r *http.Request) {
+	if err := compact(); err != nil {
+		handleAdminError(w, r, "failed to compact database", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "compacted"})
+}
+
+func handleReindexSong(w http.ResponseWriter, r *http.Request) {
+	songID, err := models.ParseSongID(r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid song ID")
+		return
+	}
+
+	total, err := reindexSong(songID)
+	if err != nil {
+		handleAdminError(w, r, "failed to reindex song", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"songID": songID, "fingerprints": total})
+}
+
+// handleGetCatalogStats serves the stats of the fingerprints of the catalog,
+// kept up to date as songs are ingested and deleted.
+func handleGetCatalogStats(w http.ResponseWriter, r *http.Request) {
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		handleAdminError(w, r, "error connecting to DB", err)
+		return
+	}
+	defer dbClient.Close()
+
+	stats, exists, err := db.ReadCatalogStats(dbClient)
+	if err != nil {
+		handleAdminError(w, r, "failed to read catalog stats", err)
+		return
+	}
+	if !exists {
+		writeError(w, http.StatusNotFound, "the catalog hasn't been counted yet, run the catalog-stats job")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"stats": stats, "couplesPerSong": stats.CouplesPerSong()})
+}
+
+func handleGetSongStats(w http.ResponseWriter, r *http.Request) {
+	songID, err := models.ParseSongID(r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid song ID")
+		return
+	}
+
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		handleAdminError(w, r, "error connecting to DB", err)
+		return
+	}
+	defer dbClient.Close()
+
+	couples, exists, err := db.ReadSongCouples(dbClient, songID)
+	if err != nil {
+		handleAdminError(w, r, "failed to read song stats", err)
+		return
+	}
+	if !exists {
+		writeError(w, http.StatusNotFound, "song has no counted fingerprints")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"songID": songID, "couples": couples})
+}
+
+func handleSnapshot(w http.ResponseWriter, r *http.Request) {
+	path, err := snapshot()
+	if err != nil {
+		handleAdminError(w, r, "failed to snapshot database", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"path": path})
+}
+
+func handleListFailures(w http.ResponseWriter, r *http.Request) {
+	failures, err := ingest.ListFailures()
+	if err != nil {
+		handleAdminError(w, r, "failed to list failures", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, failures)
+}
+
+func handleRetryFailures(w http.ResponseWriter, r *http.Request) {
+	retried, succeeded, skipped, err := retryFailures(r.URL.Query().Get("id"))
+	if err != nil {
+		handleAdminError(w, r, "failed to retry failures", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"retried": retried, "succeeded": succeeded, "skipped": skipped})
+}
+
+// compact reclaims space in the database.
+func compact() error {
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		return fmt.Errorf("error connecting to DB: %v", err)
+	}
+	defer dbClient.Close()
+
+	return dbClient.Compact()
+}
+
+// refreshChecksums records the fingerprint checksum of every song again, from
+// the fingerprints in the catalog, and returns the number recorded.
+func refreshChecksums() (int, error) {
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		return 0, fmt.Errorf("error connecting to DB: %v", err)
+	}
+	defer dbClient.Close()
+
+	return db.RefreshFingerprintChecksums(dbClient)
+}
+
+// countCatalogStats counts the stats of the catalog again from its
+// fingerprints.
+func countCatalogStats() (db.CatalogStats, error) {
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		return db.CatalogStats{}, fmt.Errorf("error connecting to DB: %v", err)
+	}
+	defer dbClient.Close()
+
+	return db.CountCatalogStats(dbClient)
+}
+
+// snapshot writes a snapshot of the database to SNAPSHOT_DIR and returns its
+// path.
+func snapshot() (string, error) {
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		return "", fmt.Errorf("error connecting to DB: %v", err)
+	}
+	defer dbClient.Close()
+
+	return dbClient.Snapshot(utils.GetEnv("SNAPSHOT_DIR", "snapshots"))
+}
+
+// pruneOrphans deletes the fingerprints of songs that no longer exist and
+// returns the IDs of those songs.
+func pruneOrphans() ([]models.SongID, error) {
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		return nil, err
+	}
+	defer dbClient.Close()
+
+	return db.PruneOrphanFingerprints(dbClient)
+}
+
+// findSongFile looks for the audio of a song in SONGS_DIR, first under the
+// "<title> - <artist>.wav" name used for downloads, then by the file tags.
+func findSongFile(song db.Song) (string, error) {
+	return findSongFileIn(SONGS_DIR, song)
+}
+
+// findSongFileIn looks for the audio of a song in dir, like findSongFile.
+func findSongFileIn(dir string, song db.Song) (string, error) {
+	title, artist := song.Title, song.Artist
+	if runtime.GOOS != "windows" {
+		title = strings.ReplaceAll(title, "/", "\\")
+		artist = strings.ReplaceAll(artist, "/", "\\")
+	}
+
+	downloadPath := filepath.Join(dir, fmt.Sprintf("%s - %s.wav", title, artist))
+	if _, err := os.Stat(downloadPath); err == nil {
+		return downloadPath, nil
+	}
+
+	var songPath string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || songPath != "" || info.IsDir() || filepath.Ext(path) != ".wav" {
+			return err
+		}
+
+		metadata, err := wav.GetMetadata(path)
+		if err != nil {
+			return nil
+		}
+		tags := metadata.Format.Tags
+		if tags["title"] == song.Title && tags["artist"] == song.Artist {
+			songPath = path
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if songPath == "" {
+		return "", fmt.Errorf("audio file for '%s' by '%s' not found in %s", song.Title, song.Artist, dir)
+	}
+
+	return songPath, nil
+}
+
+// reindexSong replaces the fingerprints of a song with freshly generated ones
+// and returns the number of fingerprints stored. Couples in the excluded
+// ranges of the song aren't stored.
+func reindexSong(songID models.SongID) (int, error) {
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		return 0, err
+	}
+	defer dbClient.Close()
+
+	song, songExists, err := dbClient.GetSongByID(songID)
+	if err != nil {
+		return 0, err
+	}
+	if !songExists {
+		return 0, fmt.Errorf("song with ID (%v) doesn't exist", songID)
+	}
+
+	songPath, err := findSongFile(song)
+	if err != nil {
+		return 0, err
+	}
+
+	fingerprint, err := shazam.FingerprintAudio(songPath, songID)
+	if err != nil {
+		return 0, err
+	}
+
+	rule, excluded, err := exclusions.Get(songID)
+	if err != nil {
+		return 0, err
+	}
+	if excluded {
+		rule.Strip(fingerprint)
+	}
+
+	if err := dbClient.DeleteFingerprintsBySongID(songID); err != nil {
+		return 0, err
+	}
+	if err := dbClient.StoreFingerprints(fingerprint); err != nil {
+		return 0, err
+	}
+	if err := shazam.RecordIndexConfig(dbClient, songID); err != nil {
+		return 0, err
+	}
+	if err := db.RecordFingerprintChecksum(dbClient, songID, db.ChecksumFingerprints(fingerprint)[songID]); err != nil {
+		return 0, err
+	}
+
+	return len(fingerprint), nil
+}
+
+// refreshIndex brings the songs indexed with other fingerprint parameters up
+// to date. Songs whose parameters the current ones extend only get the
+// couples they miss; the others are reindexed.
+func refreshIndex() (augmented, reindexed, failed int, err error) {
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	defer dbClient.Close()
+
+	var stale []shazam.IndexConfig
+	err = dbClient.ForEachSong(func(songID models.SongID, _ db.Song) error {
+		config, err := shazam.ReadIndexConfig(dbClient, songID)
+		if err != nil {
+			return err
+		}
+		if !config.Current() {
+			stale = append(stale, config)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	var firstErr error
+	for _, config := range stale {
+		if shazam.CurrentParams().Extends(config.Params) {
+			_, err = augmentSong(dbClient, config)
+			if err == nil {
+				augmented++
+			}
+		} else {
+			_, err = reindexSong(config.SongID)
+			if err == nil {
+				reindexed++
+			}
+		}
+		if err != nil {
+			failed++
+			if firstErr == nil {
+				firstErr = fmt.Errorf("song %d: %v", config.SongID, err)
+			}
+		}
+	}
+	if firstErr != nil {
+		return augmented, reindexed, failed, fmt.Errorf("failed to refresh %d songs, first %v", failed, firstErr)
+	}
+	return augmented, reindexed, failed, nil
+}
+
+// augmentSong stores the couples a song indexed with parameters the current
+// ones extend misses, and returns how many were stored.
+func augmentSong(dbClient db.DBClient, config shazam.IndexConfig) (int, error) {
+	song, songExists, err := dbClient.GetSongByID(config.SongID)
+	if err != nil {
+		return 0, err
+	}
+	if !songExists {
+		return 0, fmt.Errorf("song with ID (%v) doesn't exist", config.SongID)
+	}
+
+	songPath, err := findSongFile(song)
+	if err != nil {
+		return 0, err
+	}
+
+	fingerprint, err := shazam.AugmentAudio(songPath, config.SongID, config.Params)
+	if err != nil {
+		return 0, err
+	}
+
+	rule, excluded, err := exclusions.Get(config.SongID)
+	if err != nil {
+		return 0, err
+	}
+	if excluded {
+		rule.Strip(fingerprint)
+	}
+
+	// The checksum of songs indexed before checksums were recorded stays
+	// unknown until the checksums job runs
+	checksum, recorded, err := db.ReadFingerprintChecksum(dbClient, config.SongID)
+	if err != nil {
+		return 0, err
+	}
+	if err := dbClient.StoreFingerprints(fingerprint); err != nil {
+		return 0, err
+	}
+	if err := shazam.RecordIndexConfig(dbClient, config.SongID); err != nil {
+		return 0, err
+	}
+	if recorded {
+		checksum.Merge(db.ChecksumFingerprints(fingerprint)[config.SongID])
+		if err := db.RecordFingerprintChecksum(dbClient, config.SongID, checksum); err != nil {
+			return 0, err
+		}
+	}
+	return len(fingerprint), nil
+}
+
+// retryFailures retries recorded ingestion failures, or only the one with
+// the given ID if it isn't empty. Failures needing a dependency that is down
+// are skipped until it is back, and all of them while disk space is low.
+func retryFailures(id string) (retried, succeeded, skipped int, err error) {
+	failures, err := ingest.ListFailures()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	for _, failure := range failures {
+		if id != "" && failure.ID != id {
+			continue
+		}
+		if !retryable(failure) {
+			skipped++
+			continue
+		}
+		retried++
+
+		switch failure.Kind {
+		case ingest.KindFile:
+			if saveSongTracked(failure.Source, failure.Force) == nil {
+				succeeded++
+			}
+		case ingest.KindTrack:
+			track := spotify.Track{
+				Title:       failure.Title,
+				Artist:      failure.Artist,
+				Album:       failure.Album,
+				Duration:    failure.Duration,
+				CoverArtURL: failure.CoverArtURL,
+			}
+			downloaded, err := spotify.DlTracks([]spotify.Track{track}, SONGS_DIR)
+			if err == nil && downloaded == 1 {
+				succeeded++
+			}
+		case ingest.KindFeed:
+			track := feed.Track{
+				Title:       failure.Title,
+				Artist:      failure.Artist,
+				ISRC:        failure.ISRC,
+				AudioURL:    failure.Source,
+				Album:       failure.Album,
+				CoverArtURL: failure.CoverArtURL,
+			}
+			_, err := ingestFeedTrack(context.Background(), track, func(string) {})
+			if err == nil || errors.Is(err, errDuplicateSong) {
+				succeeded++
+			}
+		}
+	}
+
+	return retried, succeeded, skipped, nil
+}
+
+// retryable reports whether the dependencies needed to ingest a failure
+// again are available, and there is space to store it.
+func retryable(failure ingest.Failure) bool {
+	if ingest.CheckSpace(SONGS_DIR) != nil {
+		return false
+	}
+	switch failure.Kind {
+	case ingest.KindTrack:
+		return breaker.Available(breaker.YouTube) && breaker.Available(breaker.YtDlp) && breaker.Available(breaker.FFmpeg)
+	case ingest.KindFile, ingest.KindFeed:
+		return breaker.Available(breaker.FFmpeg)
+	}
+	return true
+}
+
+// handleListDependencies reports the state of the circuit breakers of the
+// external dependencies and the failures of each.
+func handleListDependencies(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, breaker.All())
+}
+
+// handleGetDiskSpace reports the space left for ingestion and whether it is
+// paused waiting for more.
+func handleGetDiskSpace(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, ingest.Status(SONGS_DIR))
+}
+
+// handleGetShadow reports the parameters of the shadow index and how the
+// queries mirrored to it compared with the live index.
+func handleGetShadow(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, shadow.CurrentStats())
+}
+
+func handleListACL(w http.ResponseWriter, r *http.Request) {
+	policy, err := acl.Load()
+	if err != nil {
+		handleAdminError(w, r, "failed to load access rules", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, policy)
+}
+
+// handleSetSongACL restricts a song to the clients or tenants in "allowed"
+// and tags it with "tags", replacing its previous rule.
+func handleSetSongACL(w http.ResponseWriter, r *http.Request) {
+	songID, err := models.ParseSongID(r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid song ID")
+		return
+	}
+
+	var rule acl.SongRule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body: "+err.Error())
+		return
+	}
+	if len(rule.Allowed) == 0 && len(rule.Tags) == 0 {
+		writeError(w, http.StatusBadRequest, "rule needs allowed clients or tags; DELETE it to lift the restriction")
+		return
+	}
+	rule.SongID = songID
+
+	if err := acl.SetSongRule(rule); err != nil {
+		handleAdminError(w, r, "failed to save song rule", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, rule)
+}
+
+func handleDeleteSongACL(w http.ResponseWriter, r *http.Request) {
+	songID, err := models.ParseSongID(r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid song ID")
+		return
+	}
+
+	if err := acl.DeleteSongRule(songID); err != nil {
+		handleAdminError(w, r, "failed to delete song rule", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"songID": songID, "status": "unrestricted"})
+}
+
+// handleSetTagACL restricts every song tagged with the tag to the clients or
+// tenants in "allowed". An empty list hides the songs from every client.
+func handleSetTagACL(w http.ResponseWriter, r *http.Request) {
+	var rule acl.TagRule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body: "+err.Error())
+		return
+	}
+	rule.Tag = r.PathValue("tag")
+
+	if err := acl.SetTagRule(rule); err != nil {
+		handleAdminError(w, r, "failed to save tag rule", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, rule)
+}
+
+func handleDeleteTagACL(w http.ResponseWriter, r *http.Request) {
+	tag := r.PathValue("tag")
+	if err := acl.DeleteTagRule(tag); err != nil {
+		handleAdminError(w, r, "failed to delete tag rule", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"tag": tag, "status": "unrestricted"})
+}
+
+func handleListExclusions(w http.ResponseWriter, r *http.Request) {
+	rules, err := exclusions.Load()
+	if err != nil {
+		handleAdminError(w, r, "failed to load exclusions", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, rules)
+}
+
+// handleSetExclusions keeps the "ranges" of a song out of matching,
+// replacing its previous ones. Reindexing the song drops them from the index.
+func handleSetExclusions(w http.ResponseWriter, r *http.Request) {
+	songID, err := models.ParseSongID(r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid song ID")
+		return
+	}
+
+	var rule exclusions.Rule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body: "+err.Error())
+		return
+	}
+	if err := rule.Validate(); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error()+"; DELETE the exclusions to match the whole song again")
+		return
+	}
+	rule.SongID = songID
+
+	if err := exclusions.SetRule(rule); err != nil {
+		handleAdminError(w, r, "failed to save exclusions", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, rule)
+}
+
+func handleDeleteExclusions(w http.ResponseWriter, r *http.Request) {
+	songID, err := models.ParseSongID(r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid song ID")
+		return
+	}
+
+	if err := exclusions.DeleteRule(songID); err != nil {
+		handleAdminError(w, r, "failed to delete exclusions", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"songID": songID, "status": "fully matched"})
+}
@@ -0,0 +1,208 @@
+// Package aiff decodes AIFF and AIFF-C files, as exported by Logic and found
+// in older Mac music libraries. Importing it registers the decoder with the
+// audio package.
+package aiff
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"song-recognition/audio"
+	"strings"
+)
+
+func init() {
+	audio.Register("aiff", Decoder{})
+}
+
+// Decoder implements audio.Decoder for AIFF and AIFF-C.
+type Decoder struct{}
+
+// CanDecode recognises the FORM header of AIFF and AIFF-C files.
+func (Decoder) CanDecode(header []byte) bool {
+	if len(header) < 12 || string(header[0:4]) != "FORM" {
+		return false
+	}
+	formType := string(header[8:12])
+	return formType == "AIFF" || formType == "AIFC"
+}
+
+// Decode reads a whole AIFF or AIFF-C file.
+func (Decoder) Decode(r io.Reader) (audio.Samples, audio.Info, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, audio.Info{}, err
+	}
+	return Decode(data)
+}
+
+type chunk struct {
+	ID   string
+	Data []byte
+}
+
+// chunks splits the body of a FORM file into its chunks.
+func chunks(data []byte) ([]chunk, error) {
+	if !(Decoder{}).CanDecode(data) {
+		return nil, errors.New("not an AIFF file")
+	}
+
+	var chunks []chunk
+	for offset := 12; offset+8 <= len(data); {
+		id := string(data[offset : offset+4])
+		size := int64(binary.BigEndian.Uint32(data[offset+4 : offset+8]))
+		start := offset + 8
+		end := int(min(int64(start)+size, int64(len(data))))
+		chunks = append(chunks, chunk{ID: id, Data: data[start:end]})
+		offset = end + int(size%2) // chunks are padded to an even size
+	}
+	return chunks, nil
+}
+
+// textChunks maps AIFF text chunk IDs to the tag names ffprobe reports.
+var textChunks = map[string]string{
+	"NAME": "title",
+	"AUTH": "artist",
+	"ANNO": "comment",
+	"(c) ": "copyright",
+}
+
+// extendedToFloat converts an 80-bit IEEE 754 extended precision number, the
+// encoding of the COMM chunk's sample rate.
+func extendedToFloat(b []byte) float64 {
+	exponent := int(binary.BigEndian.Uint16(b[0:2]) & 0x7FFF)
+	mantissa := binary.BigEndian.Uint64(b[2:10])
+	if exponent == 0 && mantissa == 0 {
+		return 0
+	}
+
+	value := math.Ldexp(float64(mantissa), exponent-16383-63)
+	if b[0]&0x80 != 0 {
+		value = -value
+	}
+	return value
+}
+
+// sampleDecoder returns the function converting one big- or little-endian
+// sample to [-1, 1] for a compression type and sample size.
+// Samples are left-justified in whole bytes, so e.g. 12-bit samples decode
+// as 16-bit ones.
+func sampleDecoder(compression string, bits int) (func([]byte) float64, int, error) {
+	width := (bits + 7) / 8 * 8
+	switch compression {
+	case "NONE", "twos":
+		switch width {
+		case 8:
+			return func(b []byte) float64 { return float64(int8(b[0])) / (1 << 7) }, 1, nil
+		case 16:
+			return func(b []byte) float64 { return float64(int16(binary.BigEndian.Uint16(b))) / (1 << 15) }, 2, nil
+		case 24:
+			return func(b []byte) float64 {
+				return float64(int32(uint32(b[0])<<24|uint32(b[1])<<16|uint32(b[2])<<8)>>8) / (1 << 23)
+			}, 3, nil
+		case 32:
+			return func(b []byte) float64 { return float64(int32(binary.BigEndian.Uint32(b))) / (1 << 31) }, 4, nil
+		}
+	case "sowt":
+		switch width {
+		case 16:
+			return func(b []byte) float64 { return float64(int16(binary.LittleEndian.Uint16(b))) / (1 << 15) }, 2, nil
+		case 24:
+			return func(b []byte) float64 {
+				return float64(int32(uint32(b[0])<<8|uint32(b[1])<<16|uint32(b[2])<<24)>>8) / (1 << 23)
+			}, 3, nil
+		case 32:
+			return func(b []byte) float64 { return float64(int32(binary.LittleEndian.Uint32(b))) / (1 << 31) }, 4, nil
+		}
+	case "fl32", "FL32":
+		return func(b []byte) float64 { return float64(math.Float32frombits(binary.BigEndian.Uint32(b))) }, 4, nil
+	case "fl64", "FL64":
+		return func(b []byte) float64 { return math.Float64frombits(binary.BigEndian.Uint64(b)) }, 8, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported AIFF encoding (compression %q, %d bits)", compression, bits)
+}
+
+// Decode decodes an AIFF file holding big-endian PCM (8 to 32 bits), or an
+// AIFF-C file holding uncompressed, little-endian ("sowt") or float samples.
+func Decode(data []byte) (audio.Samples, audio.Info, error) {
+	var info audio.Info
+
+	chunks, err := chunks(data)
+	if err != nil {
+		return nil, info, err
+	}
+
+	var comm, ssnd []byte
+	tags := make(map[string]string)
+	for _, chunk := range chunks {
+		switch chunk.ID {
+		case "COMM":
+			comm = chunk.Data
+		case "SSND":
+			ssnd = chunk.Data
+		default:
+			if name, ok := textChunks[chunk.ID]; ok {
+				tags[name] = strings.TrimRight(string(chunk.Data), "\x00")
+			}
+		}
+	}
+	if len(comm) < 18 {
+		return nil, info, errors.New("missing or invalid COMM chunk")
+	}
+	if len(ssnd) < 8 {
+		return nil, info, errors.New("missing SSND chunk")
+	}
+
+	channels := int(binary.BigEndian.Uint16(comm[0:2]))
+	frames := int(binary.BigEndian.Uint32(comm[2:6]))
+	bits := int(binary.BigEndian.Uint16(comm[6:8]))
+	rate := extendedToFloat(comm[8:18])
+	if channels == 0 || !(rate >= 1 && rate <= audio.MaxSampleRate) {
+		return nil, info, fmt.Errorf("invalid format: %d channels at %g Hz", channels, rate)
+	}
+	sampleRate := int(math.Round(rate))
+
+	compression := "NONE"
+	if string(data[8:12]) == "AIFC" {
+		if len(comm) < 22 {
+			return nil, info, errors.New("AIFF-C COMM chunk has no compression type")
+		}
+		compression = string(comm[18:22])
+	}
+
+	decode, bytesPerSample, err := sampleDecoder(compression, bits)
+	if err != nil {
+		return nil, info, err
+	}
+
+	// Sample data starts after the offset field and the padding it gives
+	offset := int64(binary.BigEndian.Uint32(ssnd[0:4]))
+	if offset > int64(len(ssnd)-8) {
+		return nil, info, errors.New("invalid SSND offset")
+	}
+	samples := ssnd[8+offset:]
+
+	frameSize := bytesPerSample * channels
+	frames = min(frames, len(samples)/frameSize)
+
+	out := make(audio.Samples, channels)
+	for c := range out {
+		out[c] = make([]float64, frames)
+	}
+	for i := 0; i < frames; i++ {
+		frame := samples[i*frameSize:]
+		for c := 0; c < channels; c++ {
+			out[c][i] = decode(frame[c*bytesPerSample:])
+		}
+	}
+
+	info = audio.Info{
+		Codec:    "aiff",
+		Format:   audio.Format{SampleRate: sampleRate, Channels: channels, BitDepth: bits},
+		Duration: audio.FramesToSeconds(frames, sampleRate),
+		Tags:     tags,
+	}
+	return out, info, nil
+}
@@ -0,0 +1,75 @@
+package aiff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+// aiffFile returns an AIFF (or AIFF-C with a compression type) file with a
+// NAME chunk.
+func aiffFile(compression string, channels, bits int, sampleRate float64, data []byte) []byte {
+	var b bytes.Buffer
+	chunk := func(id string, body []byte) {
+		b.WriteString(id)
+		binary.Write(&b, binary.BigEndian, uint32(len(body)))
+		b.Write(body)
+		if len(body)%2 == 1 {
+			b.WriteByte(0)
+		}
+	}
+
+	formType := "AIFF"
+	if compression != "" {
+		formType = "AIFC"
+	}
+	frameSize := max(channels*(bits+7)/8, 1)
+
+	comm := make([]byte, 18, 22)
+	binary.BigEndian.PutUint16(comm[0:], uint16(channels))
+	binary.BigEndian.PutUint32(comm[2:], uint32(len(data)/frameSize))
+	binary.BigEndian.PutUint16(comm[6:], uint16(bits))
+	// 80-bit extended sample rate
+	fraction, exponent := math.Frexp(sampleRate)
+	binary.BigEndian.PutUint16(comm[8:], uint16(exponent-1+16383))
+	binary.BigEndian.PutUint64(comm[10:], uint64(math.Ldexp(fraction, 64)))
+	comm = append(comm, compression...)
+
+	b.WriteString("FORM\x00\x00\x00\x00" + formType)
+	chunk("COMM", comm)
+	chunk("NAME", []byte("Title"))
+	chunk("SSND", append(make([]byte, 8), data...))
+
+	file := b.Bytes()
+	binary.BigEndian.PutUint32(file[4:], uint32(len(file)-8))
+	return file
+}
+
+func FuzzDecode(f *testing.F) {
+	f.Add(aiffFile("", 1, 16, 44100, []byte{0, 1, 0x80, 0, 0x7f, 0xff}))
+	f.Add(aiffFile("", 2, 24, 48000, make([]byte, 12)))
+	f.Add(aiffFile("", 1, 12, 22050, make([]byte, 8)))
+	f.Add(aiffFile("NONE", 1, 8, 8000, []byte{1, 2, 3}))
+	f.Add(aiffFile("sowt", 2, 16, 44100, make([]byte, 8)))
+	f.Add(aiffFile("fl32", 1, 32, 96000, make([]byte, 8)))
+	f.Add(aiffFile("fl64", 1, 64, 44100, make([]byte, 16)))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		samples, info, err := Decode(data)
+		if err != nil {
+			return
+		}
+		if len(samples) != info.Channels || info.Channels == 0 {
+			t.Fatalf("%d channels decoded, %d reported", len(samples), info.Channels)
+		}
+		if info.SampleRate <= 0 || info.Duration < 0 {
+			t.Fatalf("invalid format %+v", info)
+		}
+		for _, channel := range samples {
+			if len(channel) != len(samples[0]) {
+				t.Fatal("channels have different lengths")
+			}
+		}
+	})
+}
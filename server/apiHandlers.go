@@ -0,0 +1,706 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"song-recognition/acl"
+	"song-recognition/archive"
+	"song-recognition/audio"
+	"song-recognition/auth"
+	"song-recognition/db"
+	"song-recognition/loudness"
+	"song-recognition/playback"
+	"song-recognition/settings"
+	"song-recognition/shadow"
+	"song-recognition/shazam"
+	"song-recognition/timefmt"
+	"song-recognition/tracklist"
+	"song-recognition/utils"
+	"song-recognition/validate"
+	"song-recognition/wav"
+	"strconv"
+	"time"
+
+	"github.com/mdobak/go-xerrors"
+)
+
+const maxAPIMatches = 10
+
+type fingerprintEntry struct {
+	Address    uint32 `json:"address"`
+	AnchorTime uint32 `json:"anchorTime"`
+}
+
+// fingerprintRequest is the body of a fingerprint-only recognition request.
+// Params is optional; when present it must equal the server's parameters.
+type fingerprintRequest struct {
+	Version     int                       `json:"version"`
+	Params      *shazam.FingerprintParams `json:"params,omitempty"`
+	Fingerprint []fingerprintEntry        `json:"fingerprint"`
+	Thresholds  shazam.ThresholdOverrides `json:"thresholds"`
+	Stream      string                    `json:"stream,omitempty"` // publishes the outcome to /api/events subscribers
+	// MinCatalogVersion rejects the request when the catalog is older, e.g.
+	// on a replica that hasn't caught up with the primary yet.
+	MinCatalogVersion int64 `json:"minCatalogVersion,omitempty"`
+	// Formatted set to false leaves out the times formatted for people, which
+	// follow Locale, or the Accept-Language header.
+	Formatted *bool  `json:"formatted,omitempty"`
+	Locale    string `json:"locale,omitempty"`
+	// Debug adds the results of the shadow index to the response, when
+	// SHADOW_DEBUG_RESPONSES allows it.
+	Debug bool `json:"debug,omitempty"`
+}
+
+type recognitionResponse struct {
+	Matches          []shazam.Match    `json:"matches"`
+	Recognized       bool              `json:"recognized"`
+	Thresholds       shazam.Thresholds `json:"thresholds"`
+	SearchDurationMs int64             `json:"searchDurationMs"`
+	RecognitionID    string            `json:"recognitionId,omitempty"` // for labelling the outcome
+	Catalog          catalogInfo       `json:"catalog"`
+	// Shadow compares the results with those of the shadow index, in debug
+	// responses.
+	Shadow *shadow.Comparison `json:"shadow,omitempty"`
+}
+
+// catalogInfo tells which catalog a recognition was matched against, so
+// integrators can detect stale replicas.
+type catalogInfo struct {
+	Version            int64         `json:"version"`
+	Songs              int           `json:"songs"`
+	FingerprintVersion int           `json:"fingerprintVersion"`
+	Reads              *catalogReads `json:"reads,omitempty"` // when fingerprints aren't read from the primary
+}
+
+// catalogReads bounds how far behind the catalog version the fingerprints
+// matched against may be, when they are read from secondaries.
+type catalogReads struct {
+	ReadPreference string `json:"readPreference"`
+	// MaxStalenessSeconds is how far secondaries may lag behind the
+	// primary, 0 when it isn't bounded.
+	MaxStalenessSeconds int64 `json:"maxStalenessSeconds"`
+	SeparateEndpoint    bool  `json:"separateEndpoint,omitempty"`
+}
+
+// readCatalog returns the version and size of the catalog, and how stale
+// the fingerprints read from secondaries may be.
+func readCatalog() (catalogInfo, error) {
+	info := catalogInfo{FingerprintVersion: shazam.FingerprintVersion}
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		return info, err
+	}
+	defer dbClient.Close()
+
+	version, err := db.ReadCatalogVersion(dbClient)
+	if err != nil {
+		return info, err
+	}
+	info.Version = version.Version
+
+	routing, err := db.CouplesReadRouting()
+	if err != nil {
+		return info, err
+	}
+	if !routing.Primary() {
+		info.Reads = &catalogReads{
+			ReadPreference:      routing.Preference,
+			MaxStalenessSeconds: int64(routing.MaxStaleness / time.Second),
+			SeparateEndpoint:    routing.URI != "",
+		}
+	}
+
+	info.Songs, err = dbClient.TotalSongs()
+	return info, err
+}
+
+// checkCatalog reads the catalog a recognition is matched against, answering
+// the request itself and returning false when the catalog can't be read or
+// is older than minVersion.
+func checkCatalog(w http.ResponseWriter, r *http.Request, minVersion int64) (catalogInfo, bool) {
+	info, err := readCatalog()
+	if err != nil {
+		if db.Probe() != nil {
+			writeStorageUnavailable(w)
+			return info, false
+		}
+		logger := utils.GetLogger()
+		err := xerrors.New(err)
+		logger.ErrorContext(r.Context(), "failed to read catalog version.", slog.Any("error", err))
+		writeError(w, http.StatusInternalServerError, "failed to read catalog version")
+		return info, false
+	}
+	if info.Version < minVersion {
+		writeError(w, http.StatusPreconditionFailed, fmt.Sprintf("catalog version %d is older than the requested %d", info.Version, minVersion))
+		return info, false
+	}
+	return info, true
+}
+
+// timeFormatter returns how the times of the response to a request are
+// formatted for people: for locale, or the first language of the request's
+// Accept-Language header. It returns nil when they are left out. Signed
+// requests get the locale of their client's settings with clientLocale.
+func timeFormatter(header http.Header, formatted bool, locale string) *timefmt.Formatter {
+	if !formatted {
+		return nil
+	}
+	if locale == "" {
+		locale = timefmt.PreferredLocale(header.Get("Accept-Language"))
+	}
+	formatter := timefmt.ForLocale(locale)
+	return &formatter
+}
+
+// clientLocale returns the locale a request asked for, or else the one of
+// the settings of its API client.
+func clientLocale(client auth.Client, locale string) string {
+	if locale == "" {
+		return settings.For(client.ID).Locale
+	}
+	return locale
+}
+
+// formatMatchTimes sets the formatted positions of matches, unless formatter
+// is nil.
+func formatMatchTimes(formatter *timefmt.Formatter, matches []shazam.Match) {
+	if formatter == nil {
+		return
+	}
+	for i := range matches {
+		matches[i].Position = formatter.Format(int64(matches[i].Timestamp))
+	}
+}
+
+// addPlaybackLinks adds playback links to the matches of a response. They
+// are returned without links if that fails.
+func addPlaybackLinks(ctx context.Context, matches []shazam.Match) {
+	if err := playback.Enrich(matches); err != nil {
+		logger := utils.GetLogger()
+		err := xerrors.New(err)
+		logger.ErrorContext(ctx, "failed to add playback links.", slog.Any("error", err))
+	}
+}
+
+// audioRecognitionResponse reports the matches of the best segment of an
+// uploaded recording, and every segment in timeline mode.
+type audioRecognitionResponse struct {
+	recognitionResponse
+	Mode        string           `json:"mode"`
+	BestSegment shazam.Segment   `json:"bestSegment"`
+	Segments    []shazam.Segment `json:"segments,omitempty"`
+	Chapters    []shazam.Chapter `json:"chapters,omitempty"`
+	DurationMs  int64            `json:"durationMs"`
+	Duration    string           `json:"duration,omitempty"` // DurationMs formatted for people
+	// LoudnessLUFS is the integrated loudness of the recording, with
+	// loudness=true.
+	LoudnessLUFS *float64 `json:"loudnessLufs,omitempty"`
+	// Denoised tells that noise was reduced in the recording before it was
+	// matched, with NoiseReduction ("subtract" or "wiener") from the noise
+	// of NoiseSource ("profile" or "leading").
+	Denoised       bool   `json:"denoised,omitempty"`
+	NoiseReduction string `json:"noiseReduction,omitempty"`
+	NoiseSource    string `json:"noiseSource,omitempty"`
+}
+
+// resolveThresholds applies the overrides configured for the requesting API
+// client (API_CLIENT_THRESHOLDS, a JSON object keyed by client ID, then its
+// stored settings) and then the ones sent with the request, keeping the
+// result within admin bounds.
+func resolveThresholds(ctx context.Context, requested shazam.ThresholdOverrides) shazam.Thresholds {
+	thresholds := shazam.DefaultThresholds()
+
+	if client, ok := auth.ClientFromContext(ctx); ok {
+		thresholds = clientThresholds(ctx, client.ID)
+	}
+
+	return thresholds.Apply(requested).Clamp()
+}
+
+// clientThresholds returns the default thresholds with those of an API
+// client, from API_CLIENT_THRESHOLDS and its settings, applied.
+func clientThresholds(ctx context.Context, clientID string) shazam.Thresholds {
+	var overrides map[string]shazam.ThresholdOverrides
+	err := json.Unmarshal([]byte(utils.GetEnv("API_CLIENT_THRESHOLDS", "{}")), &overrides)
+	if err != nil {
+		logger := utils.GetLogger()
+		err := xerrors.New(err)
+		logger.ErrorContext(ctx, "invalid API_CLIENT_THRESHOLDS.", slog.Any("error", err))
+	}
+	return shazam.DefaultThresholds().Apply(overrides[clientID]).Apply(settings.For(clientID).Thresholds)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger := utils.GetLogger()
+		err := xerrors.New(err)
+		logger.ErrorContext(context.Background(), "failed to write response.", slog.Any("error", err))
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+func registerAPIHandlers(mux *http.ServeMux) {
+	verifier := auth.NewVerifier()
+
+	mux.HandleFunc("GET /api/fingerprint/params", handleFingerprintParams)
+	mux.HandleFunc("GET /metrics", handleMetrics)
+	mux.Handle("POST /api/recognize/fingerprint", verifier.Middleware(validateRequest(checkJSONRequest, requireStorage(limitRecognitions(http.HandlerFunc(handleRecognizeFingerprint))))))
+	mux.Handle("POST /api/recognize/audio", verifier.MiddlewareWithLimit(validateRequest(checkAudioUpload, requireStorage(limitRecognitions(http.HandlerFunc(handleRecognizeAudio)))), maxAudioUpload))
+	mux.Handle("PUT /api/noise-profile", verifier.MiddlewareWithLimit(requireStorage(http.HandlerFunc(handleSetNoiseProfile)), maxAudioUpload))
+	mux.Handle("GET /api/noise-profile", verifier.Middleware(http.HandlerFunc(handleGetNoiseProfile)))
+	mux.Handle("DELETE /api/noise-profile", verifier.Middleware(http.HandlerFunc(handleDeleteNoiseProfile)))
+	mux.Handle("POST /api/recognitions/{id}/label", verifier.Middleware(http.HandlerFunc(handleLabelRecognition)))
+	mux.Handle("GET /api/recognitions/{id}/explain", verifier.Middleware(http.HandlerFunc(handleExplainRecognition)))
+	mux.Handle("GET /api/charts", verifier.Middleware(http.HandlerFunc(handleCharts)))
+	mux.Handle("GET /api/songs", verifier.Middleware(http.HandlerFunc(handleListSongs)))
+	mux.Handle("GET /api/events", verifier.Middleware(http.HandlerFunc(handleEvents)))
+}
+
+func handleFingerprintParams(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, shazam.CurrentParams())
+}
+
+// handleRecognizeFingerprint matches a fingerprint computed by the client
+// (e.g. by the WASM module) instead of raw audio.
+func handleRecognizeFingerprint(w http.ResponseWriter, r *http.Request) {
+	logger := utils.GetLogger()
+	ctx := r.Context()
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "failed to read request body")
+		return
+	}
+	req, sampleFingerprint, errs := decodeFingerprintRequest(body)
+	if len(errs) > 0 {
+		writeValidationError(w, errs)
+		return
+	}
+
+	catalog, ok := checkCatalog(w, r, req.MinCatalogVersion)
+	if !ok {
+		return
+	}
+
+	client, _ := auth.ClientFromContext(ctx)
+	matches, searchDuration, err := shazam.FindVisibleMatchesFGP(ctx, sampleFingerprint, acl.Filter(client))
+	if err != nil && ctx.Err() != nil {
+		writeRecognitionAbandoned(w, ctx.Err())
+		return
+	}
+	if err != nil && db.Probe() != nil {
+		writeStorageUnavailable(w)
+		return
+	}
+	if err != nil {
+		err := xerrors.New(err)
+		logger.ErrorContext(ctx, "failed to get matches.", slog.Any("error", err))
+		writeError(w, http.StatusInternalServerError, "failed to find matches")
+		return
+	}
+
+	thresholds := resolveThresholds(ctx, req.Thresholds)
+	recognized := thresholds.Accepts(matches, shazam.QuerySeconds(sampleFingerprint))
+	shadowComparison := compareWithShadow(ctx, req.Debug, shadow.Query{
+		Source:      "api",
+		Fingerprint: sampleFingerprint,
+		Visible:     acl.Filter(client),
+		Thresholds:  thresholds,
+		Matches:     matches,
+		Duration:    searchDuration,
+	})
+
+	if !recognized && settings.For(client.ID).Archives() {
+		if _, err := archive.SaveUnmatched("api", client.ID, sampleFingerprint, ""); err != nil {
+			err := xerrors.New(err)
+			logger.ErrorContext(ctx, "failed to archive unmatched clip.", slog.Any("error", err))
+		}
+	}
+
+	recognitionID := recordRecognition(ctx, "api", matches, recognized, len(sampleFingerprint), sampleFingerprint)
+	publishMatches(ctx, streamTopics(req.Stream), client.ID, matches, recognized, recognitionID)
+
+	if matches == nil {
+		matches = []shazam.Match{}
+	}
+	if len(matches) > maxAPIMatches {
+		matches = matches[:maxAPIMatches]
+	}
+	addPlaybackLinks(ctx, matches)
+	formatMatchTimes(timeFormatter(r.Header, req.Formatted == nil || *req.Formatted, clientLocale(client, req.Locale)), matches)
+
+	writeJSON(w, http.StatusOK, recognitionResponse{
+		Matches:          matches,
+		Recognized:       recognized,
+		Thresholds:       thresholds,
+		SearchDurationMs: searchDuration.Milliseconds(),
+		RecognitionID:    recognitionID,
+		Catalog:          catalog,
+		Shadow:           shadowComparison,
+	})
+}
+
+// compareWithShadow compares a query with the shadow index right away when
+// the request asked for debug information and SHADOW_DEBUG_RESPONSES allows
+// it, and returns the comparison for the response. Other queries may be
+// mirrored in the background.
+func compareWithShadow(ctx context.Context, debug bool, query shadow.Query) *shadow.Comparison {
+	if !debug || !shadow.DebugResponses() {
+		shadow.Mirror(query)
+		return nil
+	}
+
+	comparison, err := shadow.Compare(query)
+	if err != nil {
+		err := xerrors.New(err)
+		utils.GetLogger().ErrorContext(ctx, "failed to compare with the shadow index.", slog.Any("error", err))
+		return nil
+	}
+	return &comparison
+}
+
+// decodeFingerprintRequest parses and validates the body of a fingerprint
+// recognition request, returning the fingerprint as address -> anchor time.
+func decodeFingerprintRequest(body []byte) (fingerprintRequest, map[uint32]uint32, validate.Errors) {
+	var req fingerprintRequest
+	var errs validate.Errors
+
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	if err := decoder.Decode(&req); err != nil {
+		errs.Add("body", "invalid JSON: %v", err)
+		return req, nil, errs
+	}
+	if decoder.More() {
+		errs.Add("body", "unexpected data after the request")
+		return req, nil, errs
+	}
+
+	if req.Version != shazam.FingerprintVersion {
+		errs.Add("version", "unsupported fingerprint version %d (expected %d)", req.Version, shazam.FingerprintVersion)
+	}
+	if current := shazam.CurrentParams(); req.Params != nil && *req.Params != current && !current.Extends(*req.Params) {
+		errs.Add("params", "incompatible with the server's; see /api/fingerprint/params")
+	}
+	if len(req.Fingerprint) == 0 {
+		errs.Add("fingerprint", "is required")
+	}
+	if len(req.Stream) > maxStreamName {
+		errs.Add("stream", "must be at most %d characters", maxStreamName)
+	}
+	if req.Locale != "" && !timefmt.ValidLocale(req.Locale) {
+		errs.Add("locale", "must be a language tag such as en-US, got %q", req.Locale)
+	}
+	if req.MinCatalogVersion < 0 {
+		errs.Add("minCatalogVersion", "must not be negative")
+	}
+
+	maxAnchorTime := validate.MaxClipSeconds() * 1000
+	for i, entry := range req.Fingerprint {
+		if float64(entry.AnchorTime) > maxAnchorTime {
+			errs.Add(fmt.Sprintf("fingerprint[%d].anchorTime", i), "%dms is past the longest accepted clip (%gs)", entry.AnchorTime, validate.MaxClipSeconds())
+			break
+		}
+	}
+	if len(errs) > 0 {
+		return req, nil, errs
+	}
+
+	sampleFingerprint := make(map[uint32]uint32, len(req.Fingerprint))
+	for _, entry := range req.Fingerprint {
+		sampleFingerprint[entry.Address] = entry.AnchorTime
+	}
+	return req, sampleFingerprint, nil
+}
+
+// maxAudioUpload returns the largest accepted audio upload in bytes, from
+// RECOGNIZE_MAX_UPLOAD_MB (default 50).
+func maxAudioUpload() int64 {
+	maxUpload, err := strconv.ParseInt(utils.GetEnv("RECOGNIZE_MAX_UPLOAD_MB", "50"), 10, 64)
+	if err != nil || maxUpload <= 0 {
+		maxUpload = 50
+	}
+	return maxUpload << 20
+}
+
+// handleRecognizeAudio matches an uploaded recording, sent as the "audio"
+// field of a multipart form. Long recordings are split into segments; with
+// mode=timeline every segment is returned, otherwise only the best one. With
+// loudness=true, the integrated loudness of the recording, of every segment
+// and of every chapter is measured too. With channels=dual, the channels of
+// stereo recordings are matched on their own and their matches fused.
+func handleRecognizeAudio(w http.ResponseWriter, r *http.Request) {
+	logger := utils.GetLogger()
+	ctx := r.Context()
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxAudioUpload())
+
+	mode := r.FormValue("mode") // normalised by checkAudioUpload
+	minCatalogVersion, _ := strconv.ParseInt(r.FormValue("minCatalogVersion"), 10, 64)
+	catalog, ok := checkCatalog(w, r, minCatalogVersion)
+	if !ok {
+		return
+	}
+
+	file, header, err := r.FormFile("audio")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "missing audio file: "+err.Error())
+		return
+	}
+	defer file.Close()
+
+	if err := utils.CreateFolder("tmp"); err != nil {
+		err := xerrors.New(err)
+		logger.ErrorContext(ctx, "failed to create tmp folder.", slog.Any("error", err))
+		writeError(w, http.StatusInternalServerError, "failed to store upload")
+		return
+	}
+	upload, err := os.CreateTemp("tmp", "upload_*"+filepath.Ext(header.Filename))
+	if err != nil {
+		err := xerrors.New(err)
+		logger.ErrorContext(ctx, "failed to store upload.", slog.Any("error", err))
+		writeError(w, http.StatusInternalServerError, "failed to store upload")
+		return
+	}
+	defer os.Remove(upload.Name())
+	_, err = io.Copy(upload, file)
+	upload.Close()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "failed to read upload: "+err.Error())
+		return
+	}
+
+	metadata, err := wav.GetMetadata(upload.Name())
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, "failed to decode audio: unrecognised format")
+		return
+	}
+	stream, ok := metadata.AudioStream()
+	if !ok {
+		message := "failed to decode audio: unrecognised format"
+		if metadata.HasVideo() {
+			message = "video has no audio track"
+		}
+		writeError(w, http.StatusUnprocessableEntity, message)
+		return
+	}
+	if errs := checkAudioFormat(stream.SampleRate, metadata.Format.Duration); len(errs) > 0 {
+		writeValidationError(w, errs)
+		return
+	}
+
+	// Stereo recordings keep both channels to be matched on their own
+	dualChannel := r.FormValue("channels") == "dual" && stream.Channels == 2
+	var wavFilePath string
+	if dualChannel {
+		wavFilePath, err = wav.ReformatWAV(upload.Name(), 2)
+	} else {
+		wavFilePath, err = wav.ConvertToWAV(upload.Name())
+	}
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, "failed to decode audio: "+err.Error())
+		return
+	}
+	defer os.Remove(wavFilePath)
+
+	wavInfo, err := wav.ReadWavInfo(wavFilePath)
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, "failed to decode audio: "+err.Error())
+		return
+	}
+
+	channels := [][]float64{wavInfo.LeftChannelSamples}
+	samples := wavInfo.LeftChannelSamples
+	if wavInfo.Channels == 2 {
+		channels = append(channels, wavInfo.RightChannelSamples)
+		samples = audio.Mix(channels)
+	}
+	if len(samples) == 0 {
+		writeError(w, http.StatusUnprocessableEntity, "audio is empty")
+		return
+	}
+	measure := func(startMs, endMs int64) *float64 { return nil }
+	if r.FormValue("loudness") == "true" {
+		measure = func(startMs, endMs int64) *float64 {
+			return measureLoudness(channels, wavInfo.SampleRate, startMs, endMs)
+		}
+	}
+
+	start := time.Now()
+	thresholds := resolveThresholds(ctx, shazam.ThresholdOverrides{})
+	client, _ := auth.ClientFromContext(ctx)
+	ctx, noiseMethod, noiseSource, err := noiseReduction(ctx, r, client.ID, samples, wavInfo.SampleRate)
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	var segments []shazam.Segment
+	if dualChannel && wavInfo.Channels == 2 {
+		segments, err = shazam.FindDualChannelSegmentMatches(ctx, wavInfo.LeftChannelSamples, wavInfo.RightChannelSamples, wavInfo.SampleRate, thresholds, acl.Filter(client))
+	} else {
+		segments, err = shazam.FindSegmentMatches(ctx, samples, wavInfo.SampleRate, thresholds, acl.Filter(client))
+	}
+	if err != nil && ctx.Err() != nil {
+		writeRecognitionAbandoned(w, ctx.Err())
+		return
+	}
+	if err != nil && db.Probe() != nil {
+		writeStorageUnavailable(w)
+		return
+	}
+	if err != nil {
+		err := xerrors.New(err)
+		logger.ErrorContext(ctx, "failed to get matches.", slog.Any("error", err))
+		writeError(w, http.StatusInternalServerError, "failed to find matches")
+		return
+	}
+
+	best := shazam.BestSegment(segments)
+	// The best segment is compared, as the shadow index would answer for it
+	shadowComparison := compareWithShadow(ctx, r.FormValue("debug") == "true", shadow.Query{
+		Source:     "audio",
+		Samples:    samples[audio.MsToFrames(best.StartMs, wavInfo.SampleRate):min(audio.MsToFrames(best.EndMs, wavInfo.SampleRate), int64(len(samples)))],
+		SampleRate: wavInfo.SampleRate,
+		Visible:    acl.Filter(client),
+		Thresholds: thresholds,
+		Matches:    best.Matches,
+		Duration:   time.Since(start),
+	})
+	// The best segment is the query kept as evidence, and archived when
+	// unmatched
+	archives := !best.Recognized && settings.For(client.ID).Archives()
+	var evidence map[uint32]uint32
+	if recordsEvidence() || archives {
+		evidence, err = bestSegmentFingerprint(ctx, best, wavInfo, samples)
+		if err != nil {
+			err := xerrors.New(err)
+			logger.ErrorContext(ctx, "failed to fingerprint best segment.", slog.Any("error", err))
+		}
+	}
+	if archives && evidence != nil {
+		if _, err := archive.SaveUnmatched("audio", client.ID, evidence, ""); err != nil {
+			err := xerrors.New(err)
+			logger.ErrorContext(ctx, "failed to archive unmatched clip.", slog.Any("error", err))
+		}
+	}
+	recognitionID := recordRecognition(ctx, "audio", best.Matches, best.Recognized, 0, evidence)
+	publishMatches(ctx, streamTopics(r.FormValue("stream")), client.ID, best.Matches, best.Recognized, recognitionID)
+
+	formatted, _ := strconv.ParseBool(r.FormValue("formatted"))
+	formatter := timeFormatter(r.Header, formatted, clientLocale(client, r.FormValue("locale")))
+	for i := range segments {
+		if segments[i].Matches == nil {
+			segments[i].Matches = []shazam.Match{}
+		}
+		if len(segments[i].Matches) > maxAPIMatches {
+			segments[i].Matches = segments[i].Matches[:maxAPIMatches]
+		}
+		addPlaybackLinks(ctx, segments[i].Matches)
+		formatMatchTimes(formatter, segments[i].Matches)
+		if formatter != nil {
+			segments[i].Start, segments[i].End = formatter.Format(segments[i].StartMs), formatter.Format(segments[i].EndMs)
+		}
+		segments[i].LoudnessLUFS = measure(segments[i].StartMs, segments[i].EndMs)
+	}
+	durationMs := audio.FramesToMs(int64(len(samples)), wavInfo.SampleRate)
+	best = shazam.BestSegment(segments)
+
+	response := audioRecognitionResponse{
+		recognitionResponse: recognitionResponse{
+			Matches:          best.Matches,
+			Recognized:       best.Recognized,
+			Thresholds:       thresholds,
+			SearchDurationMs: time.Since(start).Milliseconds(),
+			RecognitionID:    recognitionID,
+			Catalog:          catalog,
+			Shadow:           shadowComparison,
+		},
+		Mode:           mode,
+		BestSegment:    best,
+		DurationMs:     durationMs,
+		LoudnessLUFS:   measure(0, durationMs),
+		Denoised:       noiseMethod != "",
+		NoiseReduction: noiseMethod,
+		NoiseSource:    noiseSource,
+	}
+	if formatter != nil {
+		response.Duration = formatter.Format(durationMs)
+	}
+	if mode == "timeline" {
+		response.Segments = segments
+	}
+	if mode == "chapters" {
+		chapters := shazam.Chapters(segments, shazam.TrackChanges(samples, wavInfo.SampleRate), durationMs)
+		for i := range chapters {
+			chapters[i].LoudnessLUFS = measure(chapters[i].StartMs, chapters[i].EndMs)
+			if formatter != nil {
+				chapters[i].Start, chapters[i].End = formatter.Format(chapters[i].StartMs), formatter.Format(chapters[i].EndMs)
+			}
+		}
+		if format := r.FormValue("format"); format != "json" {
+			writeTracklist(w, format, tracklist.Tracklist{
+				File:       header.Filename,
+				DurationMs: durationMs,
+				Chapters:   chapters,
+			})
+			return
+		}
+		response.Chapters = chapters
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// measureLoudness returns the integrated loudness of a stretch of audio, or
+// nil if it is too short or quiet to be measured.
+func measureLoudness(channels [][]float64, sampleRate int, startMs, endMs int64) *float64 {
+	start := int(audio.MsToFrames(startMs, sampleRate))
+	end := int(audio.MsToFrames(endMs, sampleRate))
+	stretch := make([][]float64, len(channels))
+	for c, samples := range channels {
+		stretch[c] = samples[min(start, len(samples)):min(end, len(samples))]
+	}
+	lufs, ok := loudness.Measure(stretch, sampleRate)
+	if !ok {
+		return nil
+	}
+	return &lufs
+}
+
+// bestSegmentFingerprint returns the fingerprint the best segment of a
+// recording was matched from, on the channel it was found on.
+func bestSegmentFingerprint(ctx context.Context, best shazam.Segment, wavInfo *wav.WavInfo, mix []float64) (map[uint32]uint32, error) {
+	samples := mix
+	switch best.Channel {
+	case shazam.ChannelLeft:
+		samples = wavInfo.LeftChannelSamples
+	case shazam.ChannelRight:
+		samples = wavInfo.RightChannelSamples
+	}
+	start := min(audio.MsToFrames(best.StartMs, wavInfo.SampleRate), int64(len(samples)))
+	end := min(audio.MsToFrames(best.EndMs, wavInfo.SampleRate), int64(len(samples)))
+	return shazam.FingerprintQuery(ctx, samples[start:end], wavInfo.SampleRate)
+}
+
+// writeTracklist responds with a tracklist rendered in a format validated by
+// checkAudioUpload.
+func writeTracklist(w http.ResponseWriter, format string, list tracklist.Tracklist) {
+	exporter, err := tracklist.Lookup(format)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", exporter.ContentType)
+	w.WriteHeader(http.StatusOK)
+	exporter.Write(w, list)
+}
@@ -0,0 +1,215 @@
+package archive
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"song-recognition/utils"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Clip is a recognition query that didn't match anything in the catalog.
+// It is kept so it can be replayed once more songs have been ingested.
+type Clip struct {
+	ID          string            `json:"id"`
+	Source      string            `json:"source"`
+	ClientID    string            `json:"clientId,omitempty"` // API client that sent the query, if signed
+	CreatedAt   time.Time         `json:"createdAt"`
+	Fingerprint map[uint32]uint32 `json:"fingerprint"`
+	AudioFile   string            `json:"audioFile,omitempty"`
+}
+
+// Enabled reports whether unmatched clips should be archived.
+func Enabled() bool {
+	ok, _ := strconv.ParseBool(utils.GetEnv("ARCHIVE_UNMATCHED", "false"))
+	return ok
+}
+
+// Dir returns the root directory of the clip archive.
+func Dir() string {
+	return utils.GetEnv("ARCHIVE_DIR", "archive")
+}
+
+func unmatchedDir() string {
+	return filepath.Join(Dir(), "unmatched")
+}
+
+// SaveUnmatched archives the fingerprint of an unmatched query. If audioPath
+// is not empty, the audio file is copied next to the clip metadata.
+func SaveUnmatched(source, clientID string, fingerprint map[uint32]uint32, audioPath string) (Clip, error) {
+	err := utils.CreateFolder(unmatchedDir())
+	if err != nil {
+		return Clip{}, fmt.Errorf("failed to create archive dir: %v", err)
+	}
+
+	now := time.Now().UTC()
+	clip := Clip{
+		ID:          fmt.Sprintf("%s_%d", now.Format("20060102T150405"), utils.GenerateUniqueID()),
+		Source:      source,
+		ClientID:    clientID,
+		CreatedAt:   now,
+		Fingerprint: fingerprint,
+	}
+
+	if audioPath != "" {
+		data, err := os.ReadFile(audioPath)
+		if err != nil {
+			return Clip{}, fmt.Errorf("failed to read clip audio: %v", err)
+		}
+
+		clip.AudioFile = clip.ID + filepath.Ext(audioPath)
+		err = writeFile(filepath.Join(unmatchedDir(), clip.AudioFile), data)
+		if err != nil {
+			return Clip{}, fmt.Errorf("failed to write clip audio: %v", err)
+		}
+	}
+
+	data, err := json.Marshal(clip)
+	if err != nil {
+		return Clip{}, fmt.Errorf("failed to marshal clip: %v", err)
+	}
+
+	err = writeFile(filepath.Join(unmatchedDir(), clip.ID+".json"), data)
+	if err != nil {
+		return Clip{}, fmt.Errorf("failed to write clip: %v", err)
+	}
+
+	return clip, nil
+}
+
+// ListUnmatched returns all archived unmatched clips, oldest first.
+func ListUnmatched() ([]Clip, error) {
+	entries, err := os.ReadDir(unmatchedDir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read archive dir: %v", err)
+	}
+
+	var clips []Clip
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+
+		data, err := readFile(filepath.Join(unmatchedDir(), entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read clip %s: %v", entry.Name(), err)
+		}
+
+		var clip Clip
+		if err := json.Unmarshal(data, &clip); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal clip %s: %v", entry.Name(), err)
+		}
+		clips = append(clips, clip)
+	}
+
+	sort.Slice(clips, func(i, j int) bool {
+		return clips[i].CreatedAt.Before(clips[j].CreatedAt)
+	})
+
+	return clips, nil
+}
+
+// AudioPath returns the path of the archived audio of a clip, or an empty
+// string if only the fingerprint was archived. The file may be encrypted;
+// use OpenAudio to read it.
+func AudioPath(clip Clip) string {
+	if clip.AudioFile == "" {
+		return ""
+	}
+	return filepath.Join(unmatchedDir(), clip.AudioFile)
+}
+
+// OpenAudio returns the path of a plaintext copy of the archived audio of a
+// clip and a function removing it once the caller is done. Unencrypted
+// audio is returned in place. The path is empty if only the fingerprint was
+// archived.
+func OpenAudio(clip Clip) (string, func(), error) {
+	path := AudioPath(clip)
+	if path == "" {
+		return "", func() {}, nil
+	}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to read clip audio: %v", err)
+	}
+	if !encrypted(raw) {
+		return path, func() {}, nil
+	}
+	data, err := open(raw)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to decrypt clip audio: %v", err)
+	}
+
+	tmp, err := os.CreateTemp("", "clip-*"+filepath.Ext(path))
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create temp file: %v", err)
+	}
+	defer tmp.Close()
+	if _, err := tmp.Write(data); err != nil {
+		os.Remove(tmp.Name())
+		return "", nil, fmt.Errorf("failed to write decrypted clip audio: %v", err)
+	}
+	return tmp.Name(), func() { os.Remove(tmp.Name()) }, nil
+}
+
+// Remove deletes a clip and its audio from the archive.
+func Remove(clip Clip) error {
+	if clip.AudioFile != "" {
+		if err := utils.DeleteFile(AudioPath(clip)); err != nil {
+			return err
+		}
+	}
+	return utils.DeleteFile(filepath.Join(unmatchedDir(), clip.ID+".json"))
+}
+
+// RetentionPeriod returns how long clips are kept (ARCHIVE_RETENTION_DAYS),
+// or 0 if they are kept until replayed.
+func RetentionPeriod() time.Duration {
+	days, err := strconv.Atoi(utils.GetEnv("ARCHIVE_RETENTION_DAYS", "0"))
+	if err != nil || days <= 0 {
+		return 0
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// removeWhere deletes the clips for which match returns true and returns
+// how many were deleted.
+func removeWhere(match func(Clip) bool) (int, error) {
+	clips, err := ListUnmatched()
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, clip := range clips {
+		if !match(clip) {
+			continue
+		}
+		if err := Remove(clip); err != nil {
+			return removed, fmt.Errorf("failed to remove clip %s: %v", clip.ID, err)
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// RemoveClient deletes every clip sent by an API client.
+func RemoveClient(clientID string) (int, error) {
+	if clientID == "" {
+		return 0, fmt.Errorf("client ID is required")
+	}
+	return removeWhere(func(clip Clip) bool { return clip.ClientID == clientID })
+}
+
+// Purge deletes the clips archived before a time.
+func Purge(before time.Time) (int, error) {
+	return removeWhere(func(clip Clip) bool { return clip.CreatedAt.Before(before) })
+}
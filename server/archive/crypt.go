@@ -0,0 +1,116 @@
+package archive
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+	"song-recognition/keyring"
+)
+
+// encryptedMagic starts every encrypted archive file. It is followed by the
+// length of the key ID, the key ID, the nonce and the AES-GCM ciphertext.
+// Files without it are read as plaintext, so clips archived before
+// encryption was enabled can still be replayed.
+var encryptedMagic = []byte("STCLIP1\x00")
+
+// loadKeyring reads the archive keys from ARCHIVE_ENCRYPTION_KEYS or, if
+// unset, from the file named by ARCHIVE_ENCRYPTION_KEY_FILE, see package
+// keyring. It returns nil when encryption isn't configured.
+func loadKeyring() (*keyring.Keyring, error) {
+	return keyring.Load("archive", "ARCHIVE_ENCRYPTION_KEYS", "ARCHIVE_ENCRYPTION_KEY_FILE")
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts data with the active key, or returns it as is when
+// encryption isn't configured. The header is authenticated along with the
+// ciphertext.
+func seal(data []byte) ([]byte, error) {
+	ring, err := loadKeyring()
+	if err != nil || ring == nil {
+		return data, err
+	}
+
+	gcm, err := newGCM(ring.Keys[ring.Active])
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %v", err)
+	}
+
+	header := append(append([]byte{}, encryptedMagic...), byte(len(ring.Active)))
+	header = append(header, ring.Active...)
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %v", err)
+	}
+
+	out := append(header, nonce...)
+	return gcm.Seal(out, nonce, data, header), nil
+}
+
+func encrypted(data []byte) bool {
+	return bytes.HasPrefix(data, encryptedMagic)
+}
+
+// open decrypts data written by seal. Plaintext data is returned as is.
+func open(data []byte) ([]byte, error) {
+	if !encrypted(data) {
+		return data, nil
+	}
+
+	rest := data[len(encryptedMagic):]
+	if len(rest) < 1 || len(rest) < 1+int(rest[0]) {
+		return nil, errors.New("truncated encrypted file")
+	}
+	id := string(rest[1 : 1+int(rest[0])])
+	header := data[:len(encryptedMagic)+1+len(id)]
+	rest = rest[1+len(id):]
+
+	ring, err := loadKeyring()
+	if err != nil {
+		return nil, err
+	}
+	if ring == nil || ring.Keys[id] == nil {
+		return nil, fmt.Errorf("file is encrypted with unknown key %q", id)
+	}
+
+	gcm, err := newGCM(ring.Keys[id])
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %v", err)
+	}
+	if len(rest) < gcm.NonceSize() {
+		return nil, errors.New("truncated encrypted file")
+	}
+
+	plaintext, err := gcm.Open(nil, rest[:gcm.NonceSize()], rest[gcm.NonceSize():], header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt file: %v", err)
+	}
+	return plaintext, nil
+}
+
+func writeFile(path string, data []byte) error {
+	data, err := seal(data)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+func readFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return open(data)
+}
@@ -0,0 +1,147 @@
+package audio
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// HeaderSize is the number of leading bytes decoders are given to recognise
+// their format. Shorter files are passed in full.
+const HeaderSize = 64
+
+// MaxSampleRate is the highest sample rate decoders accept. Headers claiming
+// more are corrupt or adversarial.
+const MaxSampleRate = 768000
+
+// ErrUnknownFormat is returned when no registered decoder recognises audio.
+var ErrUnknownFormat = errors.New("no decoder for this audio format")
+
+// Samples is decoded audio in [-1, 1], one slice per channel.
+type Samples [][]float64
+
+// Info describes decoded audio. BitDepth is that of the source, or 0 for
+// lossy codecs.
+type Info struct {
+	Codec string `json:"codec"`
+	Format
+	Duration float64           `json:"duration"`       // seconds
+	Tags     map[string]string `json:"tags,omitempty"` // e.g. title and artist, named as by ffprobe
+}
+
+// Decoder decodes one audio format.
+type Decoder interface {
+	// CanDecode reports whether the data starting with header is in the
+	// decoder's format.
+	CanDecode(header []byte) bool
+	// Decode reads audio from the start of the data.
+	Decode(r io.Reader) (Samples, Info, error)
+}
+
+type registered struct {
+	name    string
+	decoder Decoder
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   []registered
+)
+
+// Register makes a decoder available to Decode under a name, replacing any
+// decoder registered with the same name. Decoders are tried in registration
+// order. Packages implementing formats register them in init.
+func Register(name string, decoder Decoder) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	for i, r := range registry {
+		if r.name == name {
+			registry[i].decoder = decoder
+			return
+		}
+	}
+	registry = append(registry, registered{name: name, decoder: decoder})
+}
+
+// Decoders returns the names of the registered decoders.
+func Decoders() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	names := make([]string, len(registry))
+	for i, r := range registry {
+		names[i] = r.name
+	}
+	return names
+}
+
+// Find returns the name of the first decoder recognising header.
+func Find(header []byte) (string, Decoder, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	for _, r := range registry {
+		if r.decoder.CanDecode(header) {
+			return r.name, r.decoder, true
+		}
+	}
+	return "", nil, false
+}
+
+// Sniff reports which registered decoder, if any, recognises a file.
+func Sniff(path string) (string, bool) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", false
+	}
+	defer file.Close()
+
+	header := make([]byte, HeaderSize)
+	n, _ := io.ReadFull(file, header)
+	name, _, ok := Find(header[:n])
+	return name, ok
+}
+
+// Decode decodes audio with the first registered decoder recognising it.
+func Decode(r io.Reader) (Samples, Info, error) {
+	buffered := bufio.NewReaderSize(r, max(HeaderSize, 4096))
+	header, err := buffered.Peek(HeaderSize)
+	if err != nil && err != io.EOF && !errors.Is(err, bufio.ErrBufferFull) {
+		return nil, Info{}, fmt.Errorf("failed to read audio header: %v", err)
+	}
+
+	name, decoder, ok := Find(header)
+	if !ok {
+		return nil, Info{}, ErrUnknownFormat
+	}
+
+	samples, info, err := decoder.Decode(buffered)
+	if err != nil {
+		return nil, info, fmt.Errorf("failed to decode %s: %v", name, err)
+	}
+	if info.Codec == "" {
+		info.Codec = name
+	}
+	if info.Channels == 0 {
+		info.Channels = len(samples)
+	}
+	if info.Duration == 0 && info.SampleRate > 0 && len(samples) > 0 {
+		info.Duration = FramesToSeconds(len(samples[0]), info.SampleRate)
+	}
+	return samples, info, nil
+}
+
+// DecodeFile decodes an audio file with the registered decoders.
+func DecodeFile(path string) (Samples, Info, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, Info{}, err
+	}
+	defer file.Close()
+
+	return Decode(file)
+}
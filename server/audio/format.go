@@ -0,0 +1,102 @@
+// Package audio holds the audio format used for analysis and the signal
+// processing shared by conversion, decoding and fingerprinting. It must stay
+// free of process execution so that it can be built for WASM.
+package audio
+
+import (
+	"log/slog"
+	"song-recognition/utils"
+	"strconv"
+)
+
+// Format describes PCM audio.
+type Format struct {
+	SampleRate int `json:"sampleRate"`
+	Channels   int `json:"channels"`
+	BitDepth   int `json:"bitDepth"`
+}
+
+// DefaultAnalysisFormat is 16-bit mono at 44.1 kHz.
+var DefaultAnalysisFormat = Format{SampleRate: 44100, Channels: 1, BitDepth: 16}
+
+// minAnalysisSampleRate keeps the spectrogram's 5 kHz band below the Nyquist
+// frequency after its 4x downsampling.
+const minAnalysisSampleRate = 40000
+
+// AnalysisFormat returns the format every stage converts audio to before it
+// is fingerprinted, read from ANALYSIS_SAMPLE_RATE, ANALYSIS_BIT_DEPTH and
+// FINGERPRINT_STEREO. Songs and queries only match when they are analysed
+// in the same format, so changing it requires re-indexing the catalog.
+// Invalid values fall back to the defaults.
+func AnalysisFormat() Format {
+	format := DefaultAnalysisFormat
+	logger := utils.GetLogger()
+
+	if v := utils.GetEnv("ANALYSIS_SAMPLE_RATE"); v != "" {
+		rate, err := strconv.Atoi(v)
+		if err != nil || rate < minAnalysisSampleRate {
+			logger.Warn("invalid ANALYSIS_SAMPLE_RATE, using the default", slog.String("value", v), slog.Int("min", minAnalysisSampleRate))
+		} else {
+			format.SampleRate = rate
+		}
+	}
+
+	if v := utils.GetEnv("ANALYSIS_BIT_DEPTH"); v != "" {
+		depth, err := strconv.Atoi(v)
+		if err != nil || (depth != 16 && depth != 24 && depth != 32) {
+			logger.Warn("invalid ANALYSIS_BIT_DEPTH, using the default", slog.String("value", v))
+		} else {
+			format.BitDepth = depth
+		}
+	}
+
+	if stereo, _ := strconv.ParseBool(utils.GetEnv("FINGERPRINT_STEREO", "false")); stereo {
+		format.Channels = 2
+	}
+
+	return format
+}
+
+// Conform converts channels of audio at the given sample rate to the
+// format's rate and channel count. Mono output averages all channels;
+// stereo output duplicates a mono input.
+func (f Format) Conform(channels [][]float64, sampleRate int) [][]float64 {
+	if len(channels) == 0 {
+		return channels
+	}
+
+	var out [][]float64
+	if f.Channels == 1 || len(channels) == 1 {
+		out = [][]float64{Mix(channels)}
+	} else {
+		out = [][]float64{channels[0], channels[1]}
+	}
+
+	for i := range out {
+		out[i] = Resample(out[i], sampleRate, f.SampleRate)
+	}
+
+	if f.Channels == 2 && len(out) == 1 {
+		out = append(out, out[0])
+	}
+	return out
+}
+
+// Mix averages channels into one.
+func Mix(channels [][]float64) []float64 {
+	if len(channels) == 1 {
+		return channels[0]
+	}
+
+	mono := make([]float64, len(channels[0]))
+	for _, channel := range channels {
+		for i := range mono {
+			mono[i] += channel[i]
+		}
+	}
+	scale := 1 / float64(len(channels))
+	for i := range mono {
+		mono[i] *= scale
+	}
+	return mono
+}
@@ -0,0 +1,76 @@
+package audio
+
+import "time"
+
+// Conversions between sample frames (one sample per channel), bytes of
+// interleaved PCM and time. They round down, so that converting a time to a
+// frame index and back never points past the audio it describes.
+
+// FramesToMs returns the time in milliseconds at which a frame starts.
+func FramesToMs(frames int64, sampleRate int) int64 {
+	if sampleRate <= 0 {
+		return 0
+	}
+	return frames * 1000 / int64(sampleRate)
+}
+
+// MsToFrames returns the index of the frame playing at a time.
+func MsToFrames(ms int64, sampleRate int) int64 {
+	return ms * int64(sampleRate) / 1000
+}
+
+// FramesToSeconds returns the duration of a number of frames in seconds.
+func FramesToSeconds(frames int, sampleRate int) float64 {
+	if sampleRate <= 0 {
+		return 0
+	}
+	return float64(frames) / float64(sampleRate)
+}
+
+// FramesToDuration returns the duration of a number of frames.
+func FramesToDuration(frames int64, sampleRate int) time.Duration {
+	if sampleRate <= 0 {
+		return 0
+	}
+	return time.Duration(frames) * time.Second / time.Duration(sampleRate)
+}
+
+// BytesPerSample returns the size of one sample of one channel.
+func (f Format) BytesPerSample() int {
+	return (f.BitDepth + 7) / 8
+}
+
+// FrameSize returns the size of one frame of interleaved PCM (the block
+// align of WAV headers).
+func (f Format) FrameSize() int {
+	return f.BytesPerSample() * f.Channels
+}
+
+// BytesToFrames returns the number of whole frames in n bytes of PCM.
+func (f Format) BytesToFrames(n int) int {
+	if f.FrameSize() == 0 {
+		return 0
+	}
+	return n / f.FrameSize()
+}
+
+// FramesToBytes returns the byte offset of a frame in PCM.
+func (f Format) FramesToBytes(frames int) int {
+	return frames * f.FrameSize()
+}
+
+// BytesToMs returns the time in milliseconds at which the frame at a byte
+// offset starts.
+func (f Format) BytesToMs(n int) int64 {
+	return FramesToMs(int64(f.BytesToFrames(n)), f.SampleRate)
+}
+
+// MsToBytes returns the byte offset of the frame playing at a time.
+func (f Format) MsToBytes(ms int64) int {
+	return f.FramesToBytes(int(MsToFrames(ms, f.SampleRate)))
+}
+
+// Duration returns the duration of n bytes of PCM.
+func (f Format) Duration(n int) time.Duration {
+	return FramesToDuration(int64(f.BytesToFrames(n)), f.SampleRate)
+}
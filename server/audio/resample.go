@@ -0,0 +1,47 @@
+package audio
+
+import "math"
+
+// resampleTaps is the number of source samples on each side of the output
+// position weighted by the interpolation kernel.
+const resampleTaps = 16
+
+// Resample converts samples between sample rates with windowed sinc
+// interpolation. When downsampling the kernel's cutoff is lowered to the
+// target Nyquist frequency so that higher frequencies don't alias.
+func Resample(samples []float64, fromRate, toRate int) []float64 {
+	if fromRate == toRate || len(samples) == 0 {
+		return samples
+	}
+
+	ratio := float64(toRate) / float64(fromRate)
+	cutoff := math.Min(1, ratio)
+	width := resampleTaps / cutoff // kernel half-width in source samples
+
+	out := make([]float64, int(float64(len(samples))*ratio))
+	for i := range out {
+		center := float64(i) / ratio
+		lo := max(0, int(math.Ceil(center-width)))
+		hi := min(len(samples)-1, int(math.Floor(center+width)))
+
+		var sum float64
+		for j := lo; j <= hi; j++ {
+			x := float64(j) - center
+			sum += samples[j] * cutoff * sinc(cutoff*x) * blackman(x/width)
+		}
+		out[i] = sum
+	}
+	return out
+}
+
+func sinc(x float64) float64 {
+	if x == 0 {
+		return 1
+	}
+	return math.Sin(math.Pi*x) / (math.Pi * x)
+}
+
+// blackman is the Blackman window over [-1, 1].
+func blackman(t float64) float64 {
+	return 0.42 + 0.5*math.Cos(math.Pi*t) + 0.08*math.Cos(2*math.Pi*t)
+}
@@ -0,0 +1,214 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"song-recognition/utils"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	HeaderClientID  = "X-Client-ID"
+	HeaderTimestamp = "X-Timestamp"
+	HeaderNonce     = "X-Nonce"
+	HeaderSignature = "X-Signature"
+
+	maxSignedBodySize = 10 << 20 // 10MB
+)
+
+var (
+	ErrUnknownClient    = errors.New("unknown client")
+	ErrBadSignature     = errors.New("invalid signature")
+	ErrStaleTimestamp   = errors.New("timestamp outside of the accepted window")
+	ErrReplayedNonce    = errors.New("nonce has already been used")
+	ErrMissingSignature = errors.New("request is not signed")
+)
+
+// Client is an API client allowed to call the server.
+type Client struct {
+	ID     string
+	Secret string
+	Tenant string // optional group of clients sharing access rights
+}
+
+// LoadClients parses API_CLIENTS, a comma separated list of id:secret pairs,
+// and API_CLIENT_TENANTS, a comma separated list of id:tenant pairs.
+func LoadClients() map[string]Client {
+	clients := make(map[string]Client)
+	for _, pair := range strings.Split(utils.GetEnv("API_CLIENTS"), ",") {
+		id, secret, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		if !ok || id == "" || secret == "" {
+			continue
+		}
+		clients[id] = Client{ID: id, Secret: secret}
+	}
+
+	for _, pair := range strings.Split(utils.GetEnv("API_CLIENT_TENANTS"), ",") {
+		id, tenant, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		if client, exists := clients[id]; ok && exists {
+			client.Tenant = tenant
+			clients[id] = client
+		}
+	}
+	return clients
+}
+
+// Sign returns the hex encoded HMAC-SHA256 signature of a payload.
+// The signed message is "<timestamp>\n<nonce>\n<body>".
+func Sign(secret string, timestamp int64, nonce string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d\n%s\n", timestamp, nonce)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// nonceCache remembers nonces until their timestamp falls out of the window,
+// after which the timestamp check alone rejects replays.
+type nonceCache struct {
+	mu     sync.Mutex
+	nonces map[string]time.Time
+}
+
+func (c *nonceCache) use(clientID, nonce string, expiresAt time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for key, expiry := range c.nonces {
+		if now.After(expiry) {
+			delete(c.nonces, key)
+		}
+	}
+
+	key := clientID + ":" + nonce
+	if _, seen := c.nonces[key]; seen {
+		return false
+	}
+	c.nonces[key] = expiresAt
+	return true
+}
+
+// Verifier checks signed requests against the configured clients.
+type Verifier struct {
+	Clients  map[string]Client
+	Window   time.Duration
+	Required bool
+
+	nonces nonceCache
+}
+
+// NewVerifier builds a Verifier from the environment. SIGNATURE_WINDOW is the
+// accepted clock skew in seconds and REQUIRE_SIGNED_FINGERPRINTS rejects
+// unsigned requests.
+func NewVerifier() *Verifier {
+	window, err := strconv.Atoi(utils.GetEnv("SIGNATURE_WINDOW", "300"))
+	if err != nil || window <= 0 {
+		window = 300
+	}
+	required, _ := strconv.ParseBool(utils.GetEnv("REQUIRE_SIGNED_FINGERPRINTS", "false"))
+
+	return &Verifier{
+		Clients:  LoadClients(),
+		Window:   time.Duration(window) * time.Second,
+		Required: required,
+		nonces:   nonceCache{nonces: make(map[string]time.Time)},
+	}
+}
+
+// Verify checks the signature headers of r against body. It returns the
+// client that signed the request, or an empty client for unsigned requests
+// when signatures aren't required.
+func (v *Verifier) Verify(r *http.Request, body []byte) (Client, error) {
+	signature := r.Header.Get(HeaderSignature)
+	if signature == "" {
+		if v.Required {
+			return Client{}, ErrMissingSignature
+		}
+		return Client{}, nil
+	}
+
+	client, ok := v.Clients[r.Header.Get(HeaderClientID)]
+	if !ok {
+		return Client{}, ErrUnknownClient
+	}
+
+	timestamp, err := strconv.ParseInt(r.Header.Get(HeaderTimestamp), 10, 64)
+	if err != nil {
+		return Client{}, ErrStaleTimestamp
+	}
+	signedAt := time.Unix(timestamp, 0)
+	if skew := time.Since(signedAt); skew > v.Window || skew < -v.Window {
+		return Client{}, ErrStaleTimestamp
+	}
+
+	nonce := r.Header.Get(HeaderNonce)
+	if nonce == "" {
+		return Client{}, ErrBadSignature
+	}
+
+	expected := Sign(client.Secret, timestamp, nonce, body)
+	if !hmac.Equal([]byte(expected), []byte(strings.ToLower(signature))) {
+		return Client{}, ErrBadSignature
+	}
+
+	// Only remember nonces of authentic requests so forged ones can't burn them
+	if !v.nonces.use(client.ID, nonce, signedAt.Add(v.Window)) {
+		return Client{}, ErrReplayedNonce
+	}
+
+	return client, nil
+}
+
+type clientKey struct{}
+
+// ClientFromContext returns the client that signed the current request.
+func ClientFromContext(ctx context.Context) (Client, bool) {
+	client, ok := ctx.Value(clientKey{}).(Client)
+	return client, ok && client.ID != ""
+}
+
+// Middleware verifies the signature of requests before passing them on.
+// The request body is buffered so next can read it again.
+func (v *Verifier) Middleware(next http.Handler) http.Handler {
+	return v.MiddlewareWithLimit(next, func() int64 { return maxSignedBodySize })
+}
+
+// MiddlewareWithLimit is Middleware for requests whose body may be up to
+// maxBodySize() bytes, such as audio uploads. maxBodySize is called for each
+// request, so a limit read from the environment follows reloads.
+func (v *Verifier) MiddlewareWithLimit(next http.Handler, maxBodySize func() int64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize()))
+		if err != nil {
+			writeError(w, http.StatusRequestEntityTooLarge, "failed to read request body")
+			return
+		}
+
+		client, err := v.Verify(r, body)
+		if err != nil {
+			writeError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+
+		r = r.WithContext(context.WithValue(r.Context(), clientKey{}, client))
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
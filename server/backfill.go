@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"song-recognition/db"
+	"song-recognition/models"
+	"song-recognition/songmeta"
+	"song-recognition/spotify"
+	"song-recognition/utils"
+	"sort"
+	"time"
+
+	"github.com/mdobak/go-xerrors"
+)
+
+// backfillSaveEvery is how many songs the metadata backfill handles between
+// saves of its progress.
+const backfillSaveEvery = 10
+
+// errNoMetadataSource is returned for songs whose audio isn't in SONGS_DIR
+// and that can't be looked up on YouTube.
+var errNoMetadataSource = errors.New("neither the audio nor YouTube details of the song were found")
+
+// backfillMetadata records the metadata of the songs ingested before it was
+// recorded, reading it from their audio or, failing that, looking their video
+// up on YouTube. A pass interrupted by a restart or a failure resumes after
+// the last song it handled; songs still without metadata at the end of a pass
+// are tried again by the next one.
+func backfillMetadata(ctx context.Context) (songmeta.Backfill, error) {
+	logger := utils.GetLogger()
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		return songmeta.Backfill{}, err
+	}
+	defer dbClient.Close()
+
+	state, err := songmeta.ReadBackfill(dbClient)
+	if err != nil {
+		return state, err
+	}
+	resuming := !state.StartedAt.IsZero() && !state.Finished()
+	if !resuming {
+		state = songmeta.Backfill{StartedAt: time.Now().UTC()}
+	}
+
+	songs := make(map[models.SongID]db.Song)
+	var missing []models.SongID
+	err = dbClient.ForEachSong(func(songID models.SongID, song db.Song) error {
+		if songID <= state.Cursor {
+			return nil
+		}
+		_, exists, err := songmeta.Get(dbClient, songID)
+		if err != nil || exists {
+			return err
+		}
+		songs[songID] = song
+		missing = append(missing, songID)
+		return nil
+	})
+	if err != nil {
+		return state, err
+	}
+	sort.Slice(missing, func(i, j int) bool { return missing[i] < missing[j] })
+	state.Total = state.Done + len(missing)
+
+	for _, songID := range missing {
+		if err := ctx.Err(); err != nil {
+			return state, errors.Join(err, songmeta.SaveBackfill(dbClient, state))
+		}
+
+		metadata, err := lookupMetadata(ctx, songID, songs[songID])
+		if err == nil {
+			err = songmeta.Put(dbClient, metadata)
+		}
+		switch {
+		case err == nil:
+			state.Updated++
+		case errors.Is(err, errNoMetadataSource):
+			state.Unavailable++
+		default:
+			state.Failed++
+			err := xerrors.New(err)
+			logger.ErrorContext(ctx, fmt.Sprintf("failed to backfill the metadata of song %d", songID), slog.Any("error", err))
+		}
+		state.Done++
+		state.Cursor = songID
+
+		if state.Done%backfillSaveEvery == 0 {
+			if err := songmeta.SaveBackfill(dbClient, state); err != nil {
+				return state, err
+			}
+			logger.Info(fmt.Sprintf("Backfilled the metadata of %d of %d songs", state.Done, state.Total))
+		}
+	}
+
+	state.FinishedAt = time.Now().UTC()
+	return state, songmeta.SaveBackfill(dbClient, state)
+}
+
+// lookupMetadata reads the metadata of a song from its audio, or looks its
+// video up on YouTube when the audio isn't in SONGS_DIR.
+func lookupMetadata(ctx context.Context, songID models.SongID, song db.Song) (songmeta.Metadata, error) {
+	if songPath, err := findSongFile(song); err == nil {
+		return songmeta.FromFile(songID, songPath)
+	}
+	if song.YouTubeID == "" {
+		return songmeta.Metadata{}, errNoMetadataSource
+	}
+
+	video, exists, err := spotify.GetVideo(ctx, song.YouTubeID)
+	if errors.Is(err, spotify.ErrNoYouTubeAPIKey) || err == nil && (!exists || video.Duration == 0) {
+		return songmeta.Metadata{}, errNoMetadataSource
+	}
+	if err != nil {
+		return songmeta.Metadata{}, err
+	}
+	return songmeta.Metadata{
+		SongID:      songID,
+		DurationMs:  video.Duration.Milliseconds(),
+		CoverArtURL: video.Thumbnail,
+		Source:      songmeta.SourceYouTube,
+	}, nil
+}
+
+func handleGetMetadataBackfill(w http.ResponseWriter, r *http.Request) {
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		handleAdminError(w, r, "failed to read metadata backfill", err)
+		return
+	}
+	defer dbClient.Close()
+
+	state, err := songmeta.ReadBackfill(dbClient)
+	if err != nil {
+		handleAdminError(w, r, "failed to read metadata backfill", err)
+		return
+	}
+	if state.StartedAt.IsZero() {
+		writeError(w, http.StatusNotFound, "metadata hasn't been backfilled yet, run the backfill-metadata job")
+		return
+	}
+	writeJSON(w, http.StatusOK, state)
+}
@@ -0,0 +1,275 @@
+// Package backup keeps encrypted copies of the catalog, in the archive
+// format of db.ExportAll, in S3-compatible storage and restores them.
+package backup
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"song-recognition/db"
+	"song-recognition/utils"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	namePrefix = "catalog-"
+	nameSuffix = ".tar.enc"
+	timeLayout = "20060102T150405Z"
+)
+
+// Location is a bucket and a prefix of the keys in it, parsed from a URL
+// like s3://bucket/path/.
+type Location struct {
+	Bucket string
+	Key    string
+}
+
+func (l Location) String() string {
+	return "s3://" + l.Bucket + "/" + l.Key
+}
+
+// ParseLocation parses an s3://bucket/key URL.
+func ParseLocation(rawURL string) (Location, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "s3" || u.Host == "" {
+		return Location{}, fmt.Errorf("invalid backup location %q, expected s3://bucket/path", rawURL)
+	}
+	return Location{Bucket: u.Host, Key: strings.TrimPrefix(u.Path, "/")}, nil
+}
+
+// Info describes a backup.
+type Info struct {
+	Location  string    `json:"location"`
+	Size      int64     `json:"size"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Result is the outcome of a backup.
+type Result struct {
+	Info
+	Manifest db.ExportManifest `json:"manifest"`
+	Deleted  []string          `json:"deleted,omitempty"` // older backups rotated out
+}
+
+// Destination returns where backups are written, from BACKUP_URL, always
+// as a folder.
+func Destination() (Location, error) {
+	rawURL := utils.GetEnv("BACKUP_URL")
+	if rawURL == "" {
+		return Location{}, errors.New("BACKUP_URL isn't set")
+	}
+	location, err := ParseLocation(rawURL)
+	if err != nil {
+		return location, err
+	}
+	if location.Key != "" && !strings.HasSuffix(location.Key, "/") {
+		location.Key += "/"
+	}
+	return location, nil
+}
+
+// retention returns how many backups are kept, from BACKUP_RETENTION
+// (default 7, 0 keeps them all).
+func retention() (int, error) {
+	value := utils.GetEnv("BACKUP_RETENTION", "7")
+	keep, err := strconv.Atoi(value)
+	if err != nil || keep < 0 {
+		return 0, fmt.Errorf("invalid BACKUP_RETENTION: %q", value)
+	}
+	return keep, nil
+}
+
+// openBucket returns a bucket configured from S3_ENDPOINT (default AWS in
+// S3_REGION), S3_REGION (default us-east-1), S3_ACCESS_KEY_ID and
+// S3_SECRET_ACCESS_KEY (or their AWS_ counterparts, with AWS_SESSION_TOKEN)
+// and S3_PATH_STYLE (default true for custom endpoints).
+func openBucket(name string) (*bucket, error) {
+	region := utils.GetEnv("S3_REGION", utils.GetEnv("AWS_REGION", "us-east-1"))
+	endpoint := utils.GetEnv("S3_ENDPOINT")
+	pathStyle := endpoint != ""
+	if endpoint == "" {
+		endpoint = "https://s3." + region + ".amazonaws.com"
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid S3_ENDPOINT: %q", endpoint)
+	}
+	if value := utils.GetEnv("S3_PATH_STYLE"); value != "" {
+		pathStyle, err = strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid S3_PATH_STYLE: %q", value)
+		}
+	}
+
+	b := &bucket{
+		name:         name,
+		endpoint:     u,
+		pathStyle:    pathStyle,
+		region:       region,
+		accessKey:    utils.GetEnv("S3_ACCESS_KEY_ID", utils.GetEnv("AWS_ACCESS_KEY_ID")),
+		secretKey:    utils.GetEnv("S3_SECRET_ACCESS_KEY", utils.GetEnv("AWS_SECRET_ACCESS_KEY")),
+		sessionToken: utils.GetEnv("AWS_SESSION_TOKEN"),
+		client:       &http.Client{},
+	}
+	if b.accessKey == "" || b.secretKey == "" {
+		return nil, errors.New("S3 credentials aren't set: set S3_ACCESS_KEY_ID and S3_SECRET_ACCESS_KEY")
+	}
+	return b, nil
+}
+
+// Run exports the catalog of client to a new encrypted backup in
+// BACKUP_URL, then deletes the oldest backups beyond BACKUP_RETENTION. The
+// archive is staged in a temporary file, in BACKUP_TMP_DIR if set, since
+// its size must be known to upload it.
+func Run(ctx context.Context, client db.DBClient) (Result, error) {
+	var result Result
+	destination, err := Destination()
+	if err != nil {
+		return result, err
+	}
+	keep, err := retention()
+	if err != nil {
+		return result, err
+	}
+	b, err := openBucket(destination.Bucket)
+	if err != nil {
+		return result, err
+	}
+
+	file, err := os.CreateTemp(utils.GetEnv("BACKUP_TMP_DIR"), "backup-*"+nameSuffix)
+	if err != nil {
+		return result, fmt.Errorf("failed to create temporary file: %v", err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	result.CreatedAt = time.Now().UTC()
+	hash := sha256.New()
+	writer := bufio.NewWriter(io.MultiWriter(file, hash))
+	encrypter, err := newEncrypter(writer)
+	if err != nil {
+		return result, err
+	}
+	result.Manifest, err = db.ExportAll(db.WithContext(ctx, client), encrypter)
+	if err == nil {
+		err = encrypter.Close()
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err != nil {
+		return result, fmt.Errorf("failed to export the catalog: %v", err)
+	}
+
+	result.Size, err = file.Seek(0, io.SeekCurrent)
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		return result, err
+	}
+	key := destination.Key + namePrefix + result.CreatedAt.Format(timeLayout) + nameSuffix
+	if err := b.put(ctx, key, file, result.Size, hex.EncodeToString(hash.Sum(nil))); err != nil {
+		return result, fmt.Errorf("failed to upload the backup: %v", err)
+	}
+	result.Location = Location{Bucket: b.name, Key: key}.String()
+
+	if keep == 0 {
+		return result, nil
+	}
+	backups, err := list(ctx, b, destination.Key)
+	if err != nil {
+		return result, err
+	}
+	for _, backup := range backups[min(keep, len(backups)):] {
+		location, _ := ParseLocation(backup.Location)
+		if err := b.delete(ctx, location.Key); err != nil {
+			return result, fmt.Errorf("failed to delete old backup: %v", err)
+		}
+		result.Deleted = append(result.Deleted, backup.Location)
+	}
+	return result, nil
+}
+
+// List returns the backups in a location, newest first.
+func List(ctx context.Context, location Location) ([]Info, error) {
+	b, err := openBucket(location.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	return list(ctx, b, location.Key)
+}
+
+func list(ctx context.Context, b *bucket, prefix string) ([]Info, error) {
+	objects, err := b.list(ctx, prefix+namePrefix)
+	if err != nil {
+		return nil, err
+	}
+	var backups []Info
+	for _, object := range objects {
+		name := strings.TrimPrefix(object.Key, prefix)
+		stamp, ok := strings.CutSuffix(strings.TrimPrefix(name, namePrefix), nameSuffix)
+		if !ok {
+			continue
+		}
+		createdAt, err := time.Parse(timeLayout, stamp)
+		if err != nil {
+			continue
+		}
+		backups = append(backups, Info{
+			Location:  Location{Bucket: b.name, Key: object.Key}.String(),
+			Size:      object.Size,
+			CreatedAt: createdAt,
+		})
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].CreatedAt.After(backups[j].CreatedAt) })
+	return backups, nil
+}
+
+// Restore loads a backup into the catalog of client with db.ImportAll,
+// which replaces the catalog once the whole backup was read and checked on
+// backends that can stage one. A location naming a folder rather than a
+// backup restores the newest backup in it. It returns the location of the
+// backup restored. The catalog takes the schema version of the backup.
+func Restore(ctx context.Context, client db.DBClient, location Location, allowInconsistent bool) (string, db.ExportManifest, error) {
+	b, err := openBucket(location.Bucket)
+	if err != nil {
+		return "", db.ExportManifest{}, err
+	}
+	if !strings.HasSuffix(location.Key, nameSuffix) {
+		prefix := location.Key
+		if prefix != "" && !strings.HasSuffix(prefix, "/") {
+			prefix += "/"
+		}
+		backups, err := list(ctx, b, prefix)
+		if err != nil {
+			return "", db.ExportManifest{}, err
+		}
+		if len(backups) == 0 {
+			return "", db.ExportManifest{}, fmt.Errorf("no backups in %s", location)
+		}
+		location, _ = ParseLocation(backups[0].Location)
+	}
+
+	body, err := b.get(ctx, location.Key)
+	if err != nil {
+		return location.String(), db.ExportManifest{}, err
+	}
+	defer body.Close()
+	decrypter, err := newDecrypter(body)
+	if err != nil {
+		return location.String(), db.ExportManifest{}, err
+	}
+	manifest, err := db.ImportAll(client, bufio.NewReader(decrypter), allowInconsistent)
+	return location.String(), manifest, err
+}
@@ -0,0 +1,224 @@
+package backup
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"song-recognition/keyring"
+)
+
+// encryptedMagic starts every backup. It is followed by the length of the
+// key ID, the key ID, a random salt and the segments of the archive. The
+// archive is encrypted with a key derived from the salt, so that segments
+// can be numbered from zero in every backup. Each segment is a flag byte,
+// set on the last one, the length of its AES-GCM ciphertext and the
+// ciphertext. The header, the index of the segment and its flag are
+// authenticated with it, so segments can't be reordered, and a backup cut
+// short is detected.
+var encryptedMagic = []byte("STBKUP1\x00")
+
+const (
+	segmentSize = 1 << 20 // bytes of plaintext per segment
+	saltSize    = 16
+	lastSegment = 1
+)
+
+// ErrNoKeys is returned when backups are made without an encryption key.
+var ErrNoKeys = errors.New("backups are encrypted: set BACKUP_ENCRYPTION_KEYS or BACKUP_ENCRYPTION_KEY_FILE")
+
+// loadKeyring reads the backup keys from BACKUP_ENCRYPTION_KEYS or, if unset,
+// from the file named by BACKUP_ENCRYPTION_KEY_FILE, in the format of
+// ARCHIVE_ENCRYPTION_KEYS, see package keyring.
+func loadKeyring() (*keyring.Keyring, error) {
+	ring, err := keyring.Load("backup", "BACKUP_ENCRYPTION_KEYS", "BACKUP_ENCRYPTION_KEY_FILE")
+	if err == nil && ring == nil {
+		return nil, ErrNoKeys
+	}
+	return ring, err
+}
+
+// newGCM returns the cipher of a backup, keyed with a key derived from key
+// and the salt of the backup.
+func newGCM(key, salt []byte) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(salt)
+	block, err := aes.NewCipher(mac.Sum(nil)[:len(key)])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// segmentNonce returns the nonce of a segment, its index.
+func segmentNonce(index uint64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], index)
+	return nonce
+}
+
+// segmentData returns the additional data authenticated with a segment.
+func segmentData(header []byte, index uint64, flag byte) []byte {
+	data := append([]byte{}, header...)
+	data = binary.BigEndian.AppendUint64(data, index)
+	return append(data, flag)
+}
+
+// encrypter encrypts what is written to it into w, a segment at a time.
+type encrypter struct {
+	w      io.Writer
+	gcm    cipher.AEAD
+	header []byte
+	index  uint64
+	buf    []byte
+}
+
+// newEncrypter writes the header of a backup encrypted with the active key
+// to w and returns a writer encrypting the archive into it. The backup is
+// only complete once the writer is closed.
+func newEncrypter(w io.Writer) (*encrypter, error) {
+	ring, err := loadKeyring()
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %v", err)
+	}
+	gcm, err := newGCM(ring.Keys[ring.Active], salt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %v", err)
+	}
+
+	header := append(append([]byte{}, encryptedMagic...), byte(len(ring.Active)))
+	header = append(header, ring.Active...)
+	header = append(header, salt...)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &encrypter{w: w, gcm: gcm, header: header, buf: make([]byte, 0, segmentSize)}, nil
+}
+
+func (e *encrypter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), segmentSize-len(e.buf))
+		e.buf = append(e.buf, p[:n]...)
+		p = p[n:]
+		written += n
+		if len(e.buf) == segmentSize {
+			if err := e.flush(0); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// flush encrypts the buffered plaintext into a segment.
+func (e *encrypter) flush(flag byte) error {
+	sealed := e.gcm.Seal(nil, segmentNonce(e.index), e.buf, segmentData(e.header, e.index, flag))
+	var head [5]byte
+	head[0] = flag
+	binary.BigEndian.PutUint32(head[1:], uint32(len(sealed)))
+	if _, err := e.w.Write(head[:]); err != nil {
+		return err
+	}
+	if _, err := e.w.Write(sealed); err != nil {
+		return err
+	}
+	e.index++
+	e.buf = e.buf[:0]
+	return nil
+}
+
+// Close writes the last segment.
+func (e *encrypter) Close() error {
+	return e.flush(lastSegment)
+}
+
+// decrypter reads the archive of a backup written by an encrypter.
+type decrypter struct {
+	r      *bufio.Reader
+	gcm    cipher.AEAD
+	header []byte
+	index  uint64
+	buf    []byte
+	done   bool
+}
+
+// newDecrypter reads the header of a backup from r and returns a reader of
+// its archive. Reading fails if the backup was altered or cut short.
+func newDecrypter(r io.Reader) (*decrypter, error) {
+	br := bufio.NewReader(r)
+	header := make([]byte, len(encryptedMagic)+1)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, fmt.Errorf("failed to read backup header: %v", err)
+	}
+	if string(header[:len(encryptedMagic)]) != string(encryptedMagic) {
+		return nil, errors.New("not an encrypted backup")
+	}
+	rest := make([]byte, int(header[len(encryptedMagic)])+saltSize)
+	if _, err := io.ReadFull(br, rest); err != nil {
+		return nil, fmt.Errorf("failed to read backup header: %v", err)
+	}
+	header = append(header, rest...)
+	id, salt := string(rest[:len(rest)-saltSize]), rest[len(rest)-saltSize:]
+
+	ring, err := loadKeyring()
+	if err != nil {
+		return nil, err
+	}
+	if ring.Keys[id] == nil {
+		return nil, fmt.Errorf("backup is encrypted with unknown key %q", id)
+	}
+	gcm, err := newGCM(ring.Keys[id], salt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %v", err)
+	}
+	return &decrypter{r: br, gcm: gcm, header: header}, nil
+}
+
+func (d *decrypter) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+// next decrypts the next segment.
+func (d *decrypter) next() error {
+	var head [5]byte
+	if _, err := io.ReadFull(d.r, head[:]); err != nil {
+		return fmt.Errorf("backup is truncated: %v", err)
+	}
+	flag, size := head[0], binary.BigEndian.Uint32(head[1:])
+	if size > segmentSize+uint32(d.gcm.Overhead()) {
+		return fmt.Errorf("backup segment %d is too large", d.index)
+	}
+	sealed := make([]byte, size)
+	if _, err := io.ReadFull(d.r, sealed); err != nil {
+		return fmt.Errorf("backup is truncated: %v", err)
+	}
+	plaintext, err := d.gcm.Open(sealed[:0], segmentNonce(d.index), sealed, segmentData(d.header, d.index, flag))
+	if err != nil {
+		return fmt.Errorf("failed to decrypt backup segment %d: %v", d.index, err)
+	}
+	d.index++
+	d.buf = plaintext
+	d.done = flag == lastSegment
+	return nil
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"song-recognition/backup"
+	"song-recognition/db"
+	"song-recognition/utils"
+	"strings"
+	"time"
+
+	"github.com/mdobak/go-xerrors"
+)
+
+// runBackup writes a backup of the catalog to BACKUP_URL and rotates the
+// older ones out.
+func runBackup(ctx context.Context) (backup.Result, error) {
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		return backup.Result{}, fmt.Errorf("error connecting to DB: %v", err)
+	}
+	defer dbClient.Close()
+
+	return backup.Run(ctx, dbClient)
+}
+
+// backupCatalog backs the catalog up to BACKUP_URL now, or lists the backups
+// there.
+func backupCatalog(args []string) {
+	backupCmd := flag.NewFlagSet("backup", flag.ExitOnError)
+	listOnly := backupCmd.Bool("list", false, "list the backups instead of making one")
+	asJSON := backupCmd.Bool("json", false, "print the outcome as JSON")
+	backupCmd.Parse(args)
+	ctx := context.Background()
+
+	var outcome interface{}
+	if *listOnly {
+		destination, err := backup.Destination()
+		if err != nil {
+			yellow.Println("Error:", err)
+			os.Exit(1)
+		}
+		backups, err := backup.List(ctx, destination)
+		if err != nil {
+			yellow.Println("Error listing backups:", err)
+			os.Exit(1)
+		}
+		outcome = backups
+		if !*asJSON {
+			for _, info := range backups {
+				fmt.Printf("%s  %s  %d bytes\n", info.CreatedAt.Format("2006-01-02 15:04:05"), info.Location, info.Size)
+			}
+		}
+	} else {
+		result, err := runBackup(ctx)
+		if err != nil {
+			yellow.Println("Error backing up the catalog:", err)
+			os.Exit(1)
+		}
+		outcome = result
+		if !*asJSON {
+			fmt.Printf("Backed up %d songs and %d fingerprints to %s (%d bytes).\n",
+				result.Manifest.Songs, result.Manifest.Fingerprints, result.Location, result.Size)
+			for _, deleted := range result.Deleted {
+				fmt.Println("Deleted old backup", deleted)
+			}
+		}
+	}
+
+	if *asJSON {
+		json.NewEncoder(os.Stdout).Encode(outcome)
+	}
+}
+
+// restoreCatalog replaces the catalog with a backup, the newest one when
+// --from names a folder of backups.
+func restoreCatalog(args []string) {
+	restoreCmd := flag.NewFlagSet("restore", flag.ExitOnError)
+	from := restoreCmd.String("from", "", "backup to restore, or folder of backups to restore the newest of, as s3://bucket/path")
+	allowInconsistent := restoreCmd.Bool("allow-inconsistent", false, "restore a backup the catalog changed during")
+	asJSON := restoreCmd.Bool("json", false, "print progress as JSON lines")
+	restoreCmd.Parse(args)
+
+	if *from == "" {
+		fmt.Println("Usage: main.go restore --from s3://<bucket>/<path> [--allow-inconsistent] [--json]")
+		os.Exit(1)
+	}
+	progress := newProgress("restore", *asJSON)
+	fail := func(message string, err error) {
+		yellow.Println(message, err)
+		progress.finish(err)
+		os.Exit(1)
+	}
+
+	location, err := backup.ParseLocation(*from)
+	if err != nil {
+		fail("Error:", err)
+	}
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		fail("Error connecting to DB:", err)
+	}
+	defer dbClient.Close()
+
+	progress.startStage("archive", 0)
+	restored, manifest, err := backup.Restore(context.Background(), dbClient, location, *allowInconsistent)
+	if errors.Is(err, db.ErrInconsistentArchive) {
+		err = fmt.Errorf("%v; use --allow-inconsistent to restore it anyway", err)
+	}
+	if err != nil {
+		fail("Error restoring the catalog:", err)
+	}
+
+	progress.startStage("checksums", 0)
+	if _, err := db.RefreshFingerprintChecksums(dbClient); err != nil {
+		fail("Error recording fingerprint checksums:", err)
+	}
+
+	songs, err := dbClient.TotalSongs()
+	if err != nil {
+		fail("Error counting songs:", err)
+	}
+	fmt.Printf("Restored %d songs and %d fingerprints from %s; the catalog has %d songs.\n", manifest.Songs, manifest.Fingerprints, restored, songs)
+	printPendingMigrations(dbClient)
+	progress.finish(nil)
+}
+
+// warmCatalog fills an empty catalog from WARM_FROM before serving, so that
+// a new replica recognizes songs as soon as it takes traffic. WARM_FROM is a
+// backup, or a folder of backups to restore the newest of, as
+// s3://bucket/path, or an archive written by export --archive. Catalogs
+// holding songs or fingerprints are left as they are. The warmed catalog is
+// at the schema version of the archive, which checkSchema then migrates. The
+// server doesn't start when the catalog can't be warmed.
+func warmCatalog() {
+	source := utils.GetEnv("WARM_FROM")
+	if source == "" {
+		return
+	}
+	logger := utils.GetLogger()
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		log.Fatalf("Failed to warm the catalog: error connecting to DB: %v", err)
+	}
+	defer dbClient.Close()
+
+	songs, err := dbClient.TotalSongs()
+	if err != nil {
+		log.Fatalf("Failed to warm the catalog: error counting songs: %v", err)
+	}
+	songIDs, err := dbClient.FingerprintSongIDs()
+	if err != nil {
+		log.Fatalf("Failed to warm the catalog: error listing fingerprints: %v", err)
+	}
+	if songs > 0 || len(songIDs) > 0 {
+		return
+	}
+
+	logger.Info(fmt.Sprintf("The catalog is empty, warming it from %s", source))
+	start := time.Now()
+	// An inconsistent archive still beats serving an empty catalog
+	var manifest db.ExportManifest
+	if strings.HasPrefix(source, "s3://") {
+		var location backup.Location
+		location, err = backup.ParseLocation(source)
+		if err == nil {
+			var restored string
+			restored, manifest, err = backup.Restore(context.Background(), dbClient, location, true)
+			if restored != "" {
+				source = restored
+			}
+		}
+	} else {
+		var file *os.File
+		file, err = os.Open(source)
+		if err == nil {
+			defer file.Close()
+			manifest, err = db.ImportAll(dbClient, bufio.NewReader(file), true)
+		}
+	}
+	if err != nil {
+		log.Fatalf("Failed to warm the catalog from %s: %v", source, err)
+	}
+	if !manifest.Consistent {
+		logger.Warn(fmt.Sprintf("The catalog changed while %s was made (version %d to %d); songs saved meanwhile may be missing",
+			source, manifest.CatalogVersion, manifest.EndCatalogVersion))
+	}
+	if _, err := db.RefreshFingerprintChecksums(dbClient); err != nil {
+		logger.Warn("Couldn't record fingerprint checksums", slog.Any("error", xerrors.New(err)))
+	}
+	logger.Info(fmt.Sprintf("Warmed the catalog with %d songs and %d fingerprints of schema version %d from %s in %s",
+		manifest.Songs, manifest.Fingerprints, manifest.SchemaVersion, source, time.Since(start).Round(time.Second)))
+}
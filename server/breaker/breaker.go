@@ -0,0 +1,243 @@
+// Package breaker stops calling external dependencies, such as yt-dlp, ffmpeg
+// or the YouTube and Spotify APIs, once they keep failing. While a dependency
+// is down, calls fail right away instead of piling up retries and holding
+// workers; after a cooldown a single call is let through to probe whether it
+// is back.
+package breaker
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"song-recognition/utils"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Dependencies guarded by breakers
+const (
+	YouTube = "youtube" // search, Data API and oEmbed
+	YtDlp   = "yt-dlp"
+	Spotify = "spotify"
+	FFmpeg  = "ffmpeg" // ffmpeg and ffprobe
+)
+
+// States of a breaker
+const (
+	StateClosed   = "closed"    // calls go through
+	StateOpen     = "open"      // calls are rejected until the cooldown ends
+	StateHalfOpen = "half-open" // one call probes whether the dependency is back
+)
+
+// ErrOpen is matched by the errors of calls rejected by an open breaker.
+var ErrOpen = errors.New("circuit breaker is open")
+
+// OpenError is returned instead of calling a dependency that is down.
+type OpenError struct {
+	Dependency string
+	RetryAt    time.Time
+}
+
+func (e *OpenError) Error() string {
+	return fmt.Sprintf("%s is unavailable after repeated failures, retrying after %s", e.Dependency, e.RetryAt.Format(time.RFC3339))
+}
+
+func (e *OpenError) Is(target error) bool {
+	return target == ErrOpen
+}
+
+// ignoredError is a failure that says nothing about the health of the
+// dependency, such as a video that doesn't exist.
+type ignoredError struct{ err error }
+
+func (e ignoredError) Error() string { return e.err.Error() }
+func (e ignoredError) Unwrap() error { return e.err }
+
+// Ignore marks an error returned to Do as an answer of the dependency rather
+// than a failure of it, so it doesn't count towards opening the breaker.
+func Ignore(err error) error {
+	if err == nil {
+		return nil
+	}
+	return ignoredError{err}
+}
+
+// IgnoreExitStatus ignores commands that ran and exited with an error
+// status, as tools do on invalid input. Commands that couldn't start or were
+// killed still count.
+func IgnoreExitStatus(err error) error {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() >= 0 {
+		return Ignore(err)
+	}
+	return err
+}
+
+// Stats describe the calls made to a dependency since the server started.
+type Stats struct {
+	Dependency          string    `json:"dependency"`
+	State               string    `json:"state"`
+	Calls               uint64    `json:"calls"`
+	Failures            uint64    `json:"failures"`
+	Rejected            uint64    `json:"rejected"` // while open
+	Opened              uint64    `json:"opened"`   // times the breaker opened
+	ConsecutiveFailures int       `json:"consecutiveFailures"`
+	LastError           string    `json:"lastError,omitempty"`
+	LastFailureAt       time.Time `json:"lastFailureAt,omitempty"`
+	OpenedAt            time.Time `json:"openedAt,omitempty"`
+}
+
+// Breaker guards the calls to a dependency.
+type Breaker struct {
+	mu      sync.Mutex
+	stats   Stats
+	probing bool
+}
+
+var registry = struct {
+	sync.Mutex
+	breakers map[string]*Breaker
+}{breakers: make(map[string]*Breaker)}
+
+// Get returns the breaker of a dependency.
+func Get(dependency string) *Breaker {
+	registry.Lock()
+	defer registry.Unlock()
+	b, ok := registry.breakers[dependency]
+	if !ok {
+		b = &Breaker{stats: Stats{Dependency: dependency, State: StateClosed}}
+		registry.breakers[dependency] = b
+	}
+	return b
+}
+
+// All returns the stats of every dependency called so far, by name.
+func All() []Stats {
+	registry.Lock()
+	breakers := make([]*Breaker, 0, len(registry.breakers))
+	for _, b := range registry.breakers {
+		breakers = append(breakers, b)
+	}
+	registry.Unlock()
+
+	all := make([]Stats, 0, len(breakers))
+	for _, b := range breakers {
+		all = append(all, b.Stats())
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Dependency < all[j].Dependency })
+	return all
+}
+
+// Do calls fn unless the breaker is open, in which case an *OpenError is
+// returned. Errors of fn count as failures of the dependency unless marked
+// with Ignore; they are returned unmarked.
+func Do(dependency string, fn func() error) error {
+	return Get(dependency).Do(fn)
+}
+
+// Available reports whether calls to a dependency would be let through.
+func Available(dependency string) bool {
+	return Get(dependency).Available()
+}
+
+// Do calls fn unless the breaker is open, see the Do function.
+func (b *Breaker) Do(fn func() error) error {
+	if err := b.allow(); err != nil {
+		return err
+	}
+
+	err := fn()
+	var ignored ignoredError
+	if errors.As(err, &ignored) {
+		b.record(nil)
+		return ignored.err
+	}
+	b.record(err)
+	return err
+}
+
+// Available reports whether a call would be let through now.
+func (b *Breaker) Available() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.stats.State {
+	case StateOpen:
+		return !time.Now().Before(b.retryAt())
+	case StateHalfOpen:
+		return !b.probing
+	}
+	return true
+}
+
+// Stats returns the stats of the dependency.
+func (b *Breaker) Stats() Stats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.stats
+}
+
+func (b *Breaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.stats.State == StateOpen && !time.Now().Before(b.retryAt()) {
+		b.stats.State = StateHalfOpen
+	}
+	if b.stats.State == StateOpen || b.stats.State == StateHalfOpen && b.probing {
+		b.stats.Rejected++
+		return &OpenError{Dependency: b.stats.Dependency, RetryAt: b.retryAt()}
+	}
+	if b.stats.State == StateHalfOpen {
+		b.probing = true
+	}
+	b.stats.Calls++
+	return nil
+}
+
+func (b *Breaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+
+	if err == nil {
+		b.stats.State, b.stats.ConsecutiveFailures = StateClosed, 0
+		return
+	}
+
+	b.stats.Failures++
+	b.stats.ConsecutiveFailures++
+	b.stats.LastError, b.stats.LastFailureAt = err.Error(), time.Now().UTC()
+	// Calls made before the breaker opened may still fail after it did
+	if b.stats.State != StateOpen && (b.stats.State == StateHalfOpen || b.stats.ConsecutiveFailures >= failureThreshold()) {
+		b.stats.Opened++
+		b.stats.State, b.stats.OpenedAt = StateOpen, b.stats.LastFailureAt
+	}
+}
+
+// retryAt returns when an open breaker lets a probe through. Callers hold
+// the lock.
+func (b *Breaker) retryAt() time.Time {
+	return b.stats.OpenedAt.Add(cooldown())
+}
+
+// failureThreshold returns how many failures in a row open a breaker, from
+// BREAKER_FAILURES (default 5).
+func failureThreshold() int {
+	threshold, err := strconv.Atoi(utils.GetEnv("BREAKER_FAILURES", "5"))
+	if err != nil || threshold < 1 {
+		return 5
+	}
+	return threshold
+}
+
+// cooldown returns how long an open breaker rejects calls before probing,
+// from BREAKER_COOLDOWN (default 1m).
+func cooldown() time.Duration {
+	cooldown, err := time.ParseDuration(utils.GetEnv("BREAKER_COOLDOWN", "1m"))
+	if err != nil || cooldown <= 0 {
+		return time.Minute
+	}
+	return cooldown
+}
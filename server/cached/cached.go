@@ -0,0 +1,82 @@
+// Package cached keeps values loaded from the database, such as the rules
+// and settings of API clients, reloading them every so often so that changes
+// made on other instances are picked up.
+package cached
+
+import (
+	"sync"
+	"time"
+)
+
+// Value is a value reloaded at most every interval. Loads run outside its
+// lock, one at a time, so requests reading it aren't held up by each other
+// nor by the database while it is fresh.
+type Value[T any] struct {
+	interval time.Duration
+	load     func() (T, error)
+
+	mu         sync.Mutex
+	value      T
+	loaded     time.Time     // zero until loaded and after Invalidate
+	loading    chan struct{} // closed when the running load is done, nil if none
+	generation uint64        // counts invalidations
+}
+
+// New returns a Value loaded by load at most every interval.
+func New[T any](interval time.Duration, load func() (T, error)) *Value[T] {
+	return &Value[T]{interval: interval, load: load}
+}
+
+// Get returns the value, loading it if it is older than the interval. While
+// another caller reloads it, the previous value is returned, unless it was
+// never loaded or was invalidated, in which case Get waits for the load. If
+// it can't be loaded the previous value is kept.
+func (v *Value[T]) Get() T {
+	v.mu.Lock()
+	for v.loading != nil {
+		if !v.loaded.IsZero() {
+			value := v.value
+			v.mu.Unlock()
+			return value
+		}
+		loading := v.loading
+		v.mu.Unlock()
+		<-loading
+		v.mu.Lock()
+	}
+	if !v.loaded.IsZero() && time.Since(v.loaded) < v.interval {
+		value := v.value
+		v.mu.Unlock()
+		return value
+	}
+
+	loading := make(chan struct{})
+	v.loading = loading
+	generation := v.generation
+	v.mu.Unlock()
+
+	value, err := v.load()
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if err == nil {
+		v.value = value
+	}
+	// A value invalidated while loading may predate the change, so the next
+	// caller loads it again
+	if v.generation == generation {
+		v.loaded = time.Now()
+	}
+	v.loading = nil
+	close(loading)
+	return v.value
+}
+
+// Invalidate makes the next Get reload the value, such as after it was
+// changed on this instance.
+func (v *Value[T]) Invalidate() {
+	v.mu.Lock()
+	v.loaded = time.Time{}
+	v.generation++
+	v.mu.Unlock()
+}
@@ -0,0 +1,264 @@
+// Package calibration maps raw match scores to the empirical probability that
+// the best match is correct, learnt from labelled recognition history. Raw
+// scores grow with the query length and the catalog size, so a fixed score
+// or margin means different things in different deployments; a calibrated
+// confidence doesn't.
+package calibration
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"song-recognition/db"
+	"song-recognition/history"
+	"sync"
+	"time"
+)
+
+const (
+	collection = "calibration"
+	modelID    = "model"
+
+	// minSamples is the number of labelled recognitions needed to fit a model.
+	minSamples = 30
+
+	fitIterations  = 50
+	regularization = 1e-3
+	reloadInterval = time.Minute
+)
+
+// Features describes the best match of a recognition.
+type Features struct {
+	Score       float64 // aligned couples of the best match
+	RunnerUp    float64 // aligned couples of the second best match
+	QuerySize   int     // addresses in the query
+	CatalogSize int     // songs in the catalog
+}
+
+// vector returns the inputs of the logistic model.
+func (f Features) vector() []float64 {
+	margin := 0.0
+	if f.Score > 0 {
+		margin = (f.Score - f.RunnerUp) / f.Score
+	}
+	return []float64{
+		1, // intercept
+		math.Log1p(f.Score),
+		math.Log1p(f.RunnerUp),
+		margin,
+		math.Log1p(float64(f.QuerySize)),
+		math.Log1p(float64(f.CatalogSize)),
+	}
+}
+
+// Model is a logistic regression of the probability that the best match is
+// correct.
+type Model struct {
+	Weights  []float64 `json:"weights"`
+	Samples  int       `json:"samples"`
+	Positive int       `json:"positive"`
+	LogLoss  float64   `json:"logLoss"` // mean log loss on the training samples
+	FittedAt time.Time `json:"fittedAt"`
+}
+
+// Probability returns the calibrated probability that the match is correct.
+func (m Model) Probability(f Features) float64 {
+	return sigmoid(dot(m.Weights, f.vector()))
+}
+
+func sigmoid(x float64) float64 {
+	return 1 / (1 + math.Exp(-x))
+}
+
+func dot(a, b []float64) float64 {
+	var sum float64
+	for i := range a {
+		sum += a[i] * b[i]
+	}
+	return sum
+}
+
+// Fit fits a model to the labelled recognitions that had a best match,
+// using Newton's method on the L2-regularised log loss.
+func Fit(recognitions []history.Recognition) (Model, error) {
+	var xs [][]float64
+	var ys []float64
+	positive := 0
+	for _, r := range recognitions {
+		if r.Correct == nil || r.SongID == 0 {
+			continue
+		}
+		features := Features{Score: r.Score, RunnerUp: r.RunnerUp, QuerySize: r.QuerySize, CatalogSize: r.CatalogSize}
+		xs = append(xs, features.vector())
+		if *r.Correct {
+			ys = append(ys, 1)
+			positive++
+		} else {
+			ys = append(ys, 0)
+		}
+	}
+
+	if len(xs) < minSamples {
+		return Model{}, fmt.Errorf("need at least %d labelled recognitions, have %d", minSamples, len(xs))
+	}
+	if positive == 0 || positive == len(xs) {
+		return Model{}, errors.New("labelled recognitions must include both correct and incorrect matches")
+	}
+
+	n := len(xs[0])
+	weights := make([]float64, n)
+	for iter := 0; iter < fitIterations; iter++ {
+		gradient := make([]float64, n)
+		hessian := make([][]float64, n)
+		for i := range hessian {
+			hessian[i] = make([]float64, n)
+			hessian[i][i] = regularization
+			gradient[i] = regularization * weights[i]
+		}
+
+		for k, x := range xs {
+			p := sigmoid(dot(weights, x))
+			for i := range x {
+				gradient[i] += (p - ys[k]) * x[i]
+				for j := range x {
+					hessian[i][j] += p * (1 - p) * x[i] * x[j]
+				}
+			}
+		}
+
+		step, err := solve(hessian, gradient)
+		if err != nil {
+			return Model{}, err
+		}
+		change := 0.0
+		for i := range weights {
+			weights[i] -= step[i]
+			change = math.Max(change, math.Abs(step[i]))
+		}
+		if change < 1e-8 {
+			break
+		}
+	}
+
+	var loss float64
+	for k, x := range xs {
+		p := math.Min(math.Max(sigmoid(dot(weights, x)), 1e-12), 1-1e-12)
+		loss -= ys[k]*math.Log(p) + (1-ys[k])*math.Log(1-p)
+	}
+
+	return Model{
+		Weights:  weights,
+		Samples:  len(xs),
+		Positive: positive,
+		LogLoss:  loss / float64(len(xs)),
+		FittedAt: time.Now().UTC(),
+	}, nil
+}
+
+// solve solves a·x = b by Gaussian elimination with partial pivoting.
+func solve(a [][]float64, b []float64) ([]float64, error) {
+	n := len(b)
+	m := make([][]float64, n)
+	for i := range a {
+		m[i] = append(append([]float64(nil), a[i]...), b[i])
+	}
+
+	for col := 0; col < n; col++ {
+		pivot := col
+		for row := col + 1; row < n; row++ {
+			if math.Abs(m[row][col]) > math.Abs(m[pivot][col]) {
+				pivot = row
+			}
+		}
+		if math.Abs(m[pivot][col]) < 1e-12 {
+			return nil, errors.New("singular system while fitting calibration")
+		}
+		m[col], m[pivot] = m[pivot], m[col]
+
+		for row := col + 1; row < n; row++ {
+			factor := m[row][col] / m[col][col]
+			for k := col; k <= n; k++ {
+				m[row][k] -= factor * m[col][k]
+			}
+		}
+	}
+
+	x := make([]float64, n)
+	for row := n - 1; row >= 0; row-- {
+		sum := m[row][n]
+		for k := row + 1; k < n; k++ {
+			sum -= m[row][k] * x[k]
+		}
+		x[row] = sum / m[row][row]
+	}
+	return x, nil
+}
+
+// Refit fits a model to the whole labelled history and stores it.
+func Refit() (Model, error) {
+	recognitions, err := history.List(db.RecordFilter{})
+	if err != nil {
+		return Model{}, err
+	}
+
+	model, err := Fit(recognitions)
+	if err != nil {
+		return Model{}, err
+	}
+
+	data, err := json.Marshal(model)
+	if err != nil {
+		return Model{}, fmt.Errorf("failed to marshal calibration model: %v", err)
+	}
+
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		return Model{}, err
+	}
+	defer dbClient.Close()
+
+	err = dbClient.PutRecord(collection, db.Record{ID: modelID, CreatedAt: model.FittedAt, Data: data})
+	if err != nil {
+		return Model{}, err
+	}
+
+	cache.Lock()
+	cache.model, cache.ok, cache.loaded = model, true, time.Now()
+	cache.Unlock()
+
+	return model, nil
+}
+
+var cache struct {
+	sync.Mutex
+	model  Model
+	ok     bool
+	loaded time.Time
+}
+
+// Current returns the stored model, reloading it at most once a minute so
+// that models fitted by other instances are picked up.
+func Current(dbClient db.DBClient) (Model, bool) {
+	cache.Lock()
+	defer cache.Unlock()
+
+	if time.Since(cache.loaded) < reloadInterval {
+		return cache.model, cache.ok
+	}
+	cache.loaded = time.Now()
+
+	record, exists, err := dbClient.GetRecord(collection, modelID)
+	if err != nil || !exists {
+		cache.model, cache.ok = Model{}, false
+		return cache.model, cache.ok
+	}
+
+	var model Model
+	if err := json.Unmarshal(record.Data, &model); err != nil || len(model.Weights) != len(Features{}.vector()) {
+		cache.model, cache.ok = Model{}, false
+		return cache.model, cache.ok
+	}
+	cache.model, cache.ok = model, true
+	return cache.model, cache.ok
+}
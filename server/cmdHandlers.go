@@ -1,23 +1,40 @@
 package main
 
 import (
+	"bytes"
 	"context"
-	"crypto/tls"
+	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"log/slog"
 	"math"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"runtime"
+	"song-recognition/acl"
+	"song-recognition/archive"
+	"song-recognition/audio"
+	"song-recognition/auth"
 	"song-recognition/db"
+	"song-recognition/exclusions"
+	"song-recognition/feed"
+	"song-recognition/ingest"
+	"song-recognition/models"
+	"song-recognition/priority"
+	"song-recognition/settings"
 	"song-recognition/shazam"
 	"song-recognition/spotify"
+	"song-recognition/tracklist"
 	"song-recognition/utils"
 	"song-recognition/wav"
+	"song-recognition/webhook"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/fatih/color"
 	socketio "github.com/googollee/go-socket.io"
@@ -41,7 +58,7 @@ func find(filePath string) {
 		return
 	}
 
-	fingerprint, err := shazam.FingerprintAudio(wavFilePath, utils.GenerateUniqueID())
+	fingerprint, err := shazam.FingerprintAudio(wavFilePath, models.NewSongID())
 	if err != nil {
 		yellow.Println("Error generating fingerprint for sample: ", err)
 		return
@@ -58,6 +75,12 @@ func find(filePath string) {
 		return
 	}
 
+	if !shazam.IsRecognized(matches, shazam.QuerySeconds(sampleFingerprint)) && archive.Enabled() {
+		if _, err := archive.SaveUnmatched("cli", "", sampleFingerprint, wavFilePath); err != nil {
+			yellow.Println("Error archiving unmatched clip:", err)
+		}
+	}
+
 	if len(matches) == 0 {
 		fmt.Println("\nNo match found.")
 		fmt.Printf("\nSearch took: %s\n", searchDuration)
@@ -79,8 +102,83 @@ func find(filePath string) {
 
 	fmt.Printf("\nSearch took: %s\n", searchDuration)
 	topMatch := topMatches[0]
-	fmt.Printf("\nFinal prediction: %s by %s , score: %.2f\n",
-		topMatch.SongTitle, topMatch.SongArtist, topMatch.Score)
+	fmt.Printf("\nFinal prediction: %s by %s , score: %.2f, confidence: %.2f\n",
+		topMatch.SongTitle, topMatch.SongArtist, topMatch.Score, topMatch.Confidence)
+}
+
+// printTracklist identifies the tracks played in a long recording, such as a
+// DJ set, and prints them as chapters in the given format.
+func printTracklist(filePath, format string) {
+	exporter, err := tracklist.Lookup(format)
+	if err != nil {
+		yellow.Println("Error:", err)
+		os.Exit(1)
+	}
+
+	// Conversion removes its input, so work on a copy of the recording
+	source, err := os.Open(filePath)
+	if err != nil {
+		yellow.Println("Error opening recording:", err)
+		os.Exit(1)
+	}
+	defer source.Close()
+	copied, err := os.CreateTemp("tmp", "tracklist_*"+filepath.Ext(filePath))
+	if err != nil {
+		yellow.Println("Error copying recording:", err)
+		os.Exit(1)
+	}
+	defer os.Remove(copied.Name())
+	_, err = io.Copy(copied, source)
+	copied.Close()
+	if err != nil {
+		yellow.Println("Error copying recording:", err)
+		os.Exit(1)
+	}
+
+	// With DUAL_CHANNEL_QUERIES, stereo recordings keep both channels
+	convert := wav.ConvertToWAV
+	if shazam.DualChannelQueries() {
+		convert = func(path string) (string, error) { return wav.ReformatWAV(path, 2) }
+	}
+	wavFilePath, err := convert(copied.Name())
+	if err != nil {
+		yellow.Println("Error converting to WAV:", err)
+		os.Exit(1)
+	}
+	defer os.Remove(wavFilePath)
+
+	wavInfo, err := wav.ReadWavInfo(wavFilePath)
+	if err != nil {
+		yellow.Println("Error reading WAV:", err)
+		os.Exit(1)
+	}
+	samples := wavInfo.LeftChannelSamples
+	if wavInfo.Channels == 2 {
+		samples = audio.Mix([][]float64{wavInfo.LeftChannelSamples, wavInfo.RightChannelSamples})
+	}
+
+	var segments []shazam.Segment
+	if shazam.DualChannelQueries() && wavInfo.Channels == 2 {
+		segments, err = shazam.FindDualChannelSegmentMatches(context.Background(), wavInfo.LeftChannelSamples, wavInfo.RightChannelSamples, wavInfo.SampleRate, shazam.DefaultThresholds(), nil)
+	} else {
+		segments, err = shazam.FindSegmentMatches(context.Background(), samples, wavInfo.SampleRate, shazam.DefaultThresholds(), nil)
+	}
+	if err != nil {
+		yellow.Println("Error finding matches:", err)
+		os.Exit(1)
+	}
+
+	durationMs := audio.FramesToMs(int64(len(samples)), wavInfo.SampleRate)
+	err = exporter.Write(os.Stdout, tracklist.Tracklist{
+		Title:      strings.TrimSuffix(filepath.Base(filePath), filepath.Ext(filePath)),
+		File:       filepath.Base(filePath),
+		DurationMs: durationMs,
+		Chapters:   shazam.Chapters(segments, shazam.TrackChanges(samples, wavInfo.SampleRate), durationMs),
+	})
+	if err != nil {
+		yellow.Println("Error writing tracklist:", err)
+		os.Exit(1)
+	}
 }
 
 func download(spotifyURL string) {
@@ -113,13 +211,16 @@ func download(spotifyURL string) {
 			yellow.Println("Error: ", err)
 		}
 	}
+
+	if archive.Enabled() {
+		replayUnmatched()
+	}
 }
 
-func serve(protocol, port string) {
+func serve(protocol, port, socketPath string) {
 	protocol = strings.ToLower(protocol)
-	var allowOriginFunc = func(r *http.Request) bool {
-		return true
-	}
+	// Requests reach the socket server through withForwardedHeaders
+	var allowOriginFunc = allowOrigin
 
 	server := socketio.NewServer(&engineio.Options{
 		Transports: []transport.Transport{
@@ -135,6 +236,8 @@ func serve(protocol, port string) {
 	server.OnConnect("/", func(socket socketio.Conn) error {
 		socket.SetContext("")
 		log.Println("CONNECTED: ", socket.ID())
+		// Lets clients follow their matches on /api/events?session=<id>
+		socket.Emit("sessionId", socket.ID())
 
 		return nil
 	})
@@ -149,6 +252,7 @@ func serve(protocol, port string) {
 	})
 
 	server.OnDisconnect("/", func(s socketio.Conn, reason string) {
+		liveSessions.end(s.ID())
 		log.Println("closed", reason)
 	})
 
@@ -159,43 +263,56 @@ func serve(protocol, port string) {
 	}()
 	defer server.Close()
 
+	if _, err := shazam.ScorerByName(utils.GetEnv("SCORER", "histogram")); err != nil {
+		log.Printf("invalid SCORER, using histogram: %v\n", err)
+	}
+
+	// Background work shares the recognition workers, interactive requests first
+	priority.SetDefault(getRecognitionLimiter().scheduler)
+
+	warmCatalog()
+	checkSchema()
+	startRetention()
+	startMaintenance()
+	startMonitors()
+	startFeeds()
+	reloadOnSignal()
+
 	serveHTTPS := protocol == "https"
 
-	serveHTTP(server, serveHTTPS, port)
+	serveHTTP(server, serveHTTPS, port, socketPath)
 }
 
-func serveHTTP(socketServer *socketio.Server, serveHTTPS bool, port string) {
+func serveHTTP(socketServer *socketio.Server, serveHTTPS bool, port, socketPath string) {
 	http.Handle("/socket.io/", socketServer)
 	http.Handle("/", http.FileServer(http.Dir("static")))
+	registerAPIHandlers(http.DefaultServeMux)
+	registerAdminHandlers(http.DefaultServeMux)
+	handler := withForwardedHeaders(withCORS(http.DefaultServeMux))
 
-	if serveHTTPS {
-		httpsAddr := ":" + port
-		httpsServer := &http.Server{
-			Addr: httpsAddr,
-			TLSConfig: &tls.Config{
-				MinVersion: tls.VersionTLS12,
-			},
-			Handler: socketServer,
-		}
-
-		cert_key_default := "/etc/letsencrypt/live/localport.online/privkey.pem"
-		cert_file_default := "/etc/letsencrypt/live/localport.online/fullchain.pem"
+	listener, err := listen(port, socketPath)
+	if err != nil {
+		log.Fatalf("Failed to listen: %v", err)
+	}
+	server := &http.Server{Handler: handler}
 
-		cert_key := utils.GetEnv("CERT_KEY", cert_key_default)
-		cert_file := utils.GetEnv("CERT_FILE", cert_file_default)
-		if cert_key == "" || cert_file == "" {
-			log.Fatal("Missing cert")
+	if serveHTTPS {
+		tlsConfig, redirects, err := serverTLS()
+		if err != nil {
+			log.Fatalf("Failed to configure TLS: %v", err)
 		}
+		serveHTTPRedirects(redirects)
+		server.TLSConfig = tlsConfig
 
-		log.Printf("Starting HTTPS server on %s\n", httpsAddr)
-		if err := httpsServer.ListenAndServeTLS(cert_file, cert_key); err != nil {
-			log.Fatalf("HTTPS server ListenAndServeTLS: %v", err)
+		log.Printf("Starting HTTPS server on %v\n", listener.Addr())
+		if err := server.ServeTLS(listener, "", ""); err != nil {
+			log.Fatalf("HTTPS server ServeTLS: %v", err)
 		}
 	}
 
-	log.Printf("Starting HTTP server on port %v", port)
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
-		log.Fatalf("HTTP server ListenAndServe: %v", err)
+	log.Printf("Starting HTTP server on %v", listener.Addr())
+	if err := server.Serve(listener); err != nil {
+		log.Fatalf("HTTP server Serve: %v", err)
 	}
 }
 
@@ -252,10 +369,11 @@ func erase(songsDir string, dbOnly bool, all bool) {
 	fmt.Println("Erase complete")
 }
 
-func save(path string, force bool) {
+func save(path string, force bool, progress *progress) {
 	fileInfo, err := os.Stat(path)
 	if err != nil {
 		fmt.Printf("Error stating path %v: %v\n", path, err)
+		progress.finish(err)
 		return
 	}
 
@@ -274,20 +392,30 @@ func save(path string, force bool) {
 		})
 		if err != nil {
 			fmt.Printf("Error walking the directory %v: %v\n", path, err)
+			progress.finish(err)
 			return
 		}
 
-		processFilesConCurrently(filePaths, force)
+		progress.startStage("ingest", int64(len(filePaths)))
+		processFilesConCurrently(filePaths, force, progress)
 	} else {
-		err := saveSong(path, force)
+		progress.startStage("ingest", 1)
+		err := saveSongTracked(path, force)
 		if err != nil {
 			fmt.Printf("Error saving song (%v): %v\n", path, err)
 		}
+		progress.item(path, err)
+	}
+
+	if archive.Enabled() {
+		progress.startStage("replay-unmatched", 0)
+		replayUnmatched()
 	}
+	progress.finish(nil)
 }
 
-func processFilesConCurrently(filePaths []string, force bool) {
-	maxWorkers := runtime.NumCPU() / 2
+func processFilesConCurrently(filePaths []string, force bool, progress *progress) {
+	maxWorkers := max(runtime.NumCPU()/2, 1)
 	numFiles := len(filePaths)
 
 	if numFiles == 0 {
@@ -304,7 +432,8 @@ func processFilesConCurrently(filePaths []string, force bool) {
 	for w := 0; w < maxWorkers; w++ {
 		go func(workerID int) {
 			for filePath := range jobs {
-				err := saveSong(filePath, force)
+				err := saveSongTracked(filePath, force)
+				progress.item(filePath, err)
 				results <- err
 			}
 		}(w + 1)
@@ -330,11 +459,43 @@ func processFilesConCurrently(filePaths []string, force bool) {
 	fmt.Printf("\n ->> Processed %d files: %d successful, %d failed\n", numFiles, successCount, errorCount)
 }
 
+// saveSongTracked saves a song and keeps the ingestion failure log in sync so
+// failed files can be listed and retried through the admin API.
+func saveSongTracked(filePath string, force bool) error {
+	logger := utils.GetLogger()
+	ctx := context.Background()
+	failureID := ingest.FailureID(ingest.KindFile, filePath)
+
+	err := saveSong(filePath, force)
+	if err != nil {
+		failure := ingest.Failure{Kind: ingest.KindFile, Source: filePath, Force: force, Error: err.Error()}
+		if err := ingest.RecordFailure(failure); err != nil {
+			err := xerrors.New(err)
+			logger.ErrorContext(ctx, "failed to record ingestion failure", slog.Any("error", err))
+		}
+		return err
+	}
+
+	if err := ingest.ResolveFailure(failureID); err != nil {
+		err := xerrors.New(err)
+		logger.ErrorContext(ctx, "failed to resolve ingestion failure", slog.Any("error", err))
+	}
+	return nil
+}
+
 func saveSong(filePath string, force bool) error {
+	// The song is converted next to the file, then moved to SONGS_DIR
+	if err := ingest.WaitForSpace(context.Background(), ingest.MaxPause(), filepath.Dir(filePath), SONGS_DIR); err != nil {
+		return err
+	}
+
 	metadata, err := wav.GetMetadata(filePath)
 	if err != nil {
 		return err
 	}
+	if _, ok := metadata.AudioStream(); !ok {
+		return fmt.Errorf("no audio track found in %s", filePath)
+	}
 
 	durationFloat, err := strconv.ParseFloat(metadata.Format.Duration, 64)
 	if err != nil {
@@ -380,3 +541,501 @@ func saveSong(filePath string, force bool) error {
 
 	return nil
 }
+
+// reindexAll regenerates the fingerprints of every song from its audio in
+// SONGS_DIR, as admin reindex does for a single song. Songs whose audio is
+// missing are reported and left as they are.
+func reindexAll(args []string) {
+	reindexCmd := flag.NewFlagSet("reindex-all", flag.ExitOnError)
+	asJSON := reindexCmd.Bool("json", false, "print progress as JSON lines")
+	reindexCmd.Parse(args)
+	progress := newProgress("reindex-all", *asJSON)
+
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		yellow.Println("Error connecting to DB:", err)
+		progress.finish(err)
+		os.Exit(1)
+	}
+	songIDs, err := sampleSongs(dbClient, 0)
+	dbClient.Close()
+	if err != nil {
+		yellow.Println("Error listing songs:", err)
+		progress.finish(err)
+		os.Exit(1)
+	}
+
+	progress.startStage("reindex", int64(len(songIDs)))
+	failed := 0
+	for i, songID := range songIDs {
+		fingerprints, err := reindexSong(songID)
+		progress.item(strconv.FormatUint(uint64(songID), 10), err)
+		if err != nil {
+			failed++
+			fmt.Printf("[%d/%d] song %d: %v\n", i+1, len(songIDs), songID, err)
+			continue
+		}
+		fmt.Printf("[%d/%d] song %d: %d fingerprints\n", i+1, len(songIDs), songID, fingerprints)
+	}
+
+	fmt.Printf("\nReindexed %d songs, %d failed.\n", len(songIDs)-failed, failed)
+	if failed > 0 {
+		err := fmt.Errorf("failed to reindex %d songs", failed)
+		progress.finish(err)
+		os.Exit(1)
+	}
+	progress.finish(nil)
+}
+
+var replayMu sync.Mutex
+
+// replayUnmatched re-runs recognition on archived unmatched clips. Clips that
+// now match are reported to REPLAY_WEBHOOK_URL, or to the webhook in the
+// settings of the API client that sent them, and removed from the archive.
+// A clip is matched as its client's query was: only against the songs the
+// client may see, with its thresholds. Replays run one at a time, so a clip
+// is never reported twice.
+func replayUnmatched() {
+	replayMu.Lock()
+	defer replayMu.Unlock()
+
+	logger := utils.GetLogger()
+	ctx := context.Background()
+
+	clips, err := archive.ListUnmatched()
+	if err != nil {
+		err := xerrors.New(err)
+		logger.ErrorContext(ctx, "failed to list unmatched clips", slog.Any("error", err))
+		return
+	}
+
+	webhookURL := utils.GetEnv("REPLAY_WEBHOOK_URL")
+	clients := auth.LoadClients()
+	resolved := 0
+
+	for _, clip := range clips {
+		sampleFingerprint := clip.Fingerprint
+
+		// Unsigned queries are replayed as the zero client. A client removed
+		// since keeps its ID, so the rules naming it still apply.
+		client, ok := clients[clip.ClientID]
+		if !ok {
+			client = auth.Client{ID: clip.ClientID}
+		}
+
+		// Replays yield to interactive recognitions
+		release, err := priority.Acquire(ctx, priority.Background)
+		if err != nil {
+			return
+		}
+
+		// Prefer the archived audio so clips benefit from fingerprinting changes
+		audioPath, closeAudio, err := archive.OpenAudio(clip)
+		if err != nil {
+			logger.Info(fmt.Sprintf("failed to open archived audio of clip %s: %v", clip.ID, err))
+		} else if audioPath != "" {
+			fingerprint, err := shazam.FingerprintWAV(audioPath, models.NewSongID())
+			closeAudio()
+			if err == nil {
+				sampleFingerprint = make(map[uint32]uint32)
+				for address, couple := range fingerprint {
+					sampleFingerprint[address] = couple.AnchorTimeMs
+				}
+			} else {
+				logger.Info(fmt.Sprintf("failed to fingerprint archived audio of clip %s: %v", clip.ID, err))
+			}
+		}
+
+		matches, _, err := shazam.FindVisibleMatchesFGP(ctx, sampleFingerprint, acl.Filter(client))
+		release()
+		if err != nil {
+			err := xerrors.New(err)
+			logger.ErrorContext(ctx, "failed to replay clip "+clip.ID, slog.Any("error", err))
+			continue
+		}
+
+		thresholds := shazam.DefaultThresholds()
+		if clip.ClientID != "" {
+			thresholds = clientThresholds(ctx, clip.ClientID)
+		}
+		if !thresholds.Clamp().Accepts(matches, shazam.QuerySeconds(sampleFingerprint)) {
+			continue
+		}
+
+		topMatch := matches[0]
+		logger.Info(fmt.Sprintf("unmatched clip %s now matches '%s' by '%s'", clip.ID, topMatch.SongTitle, topMatch.SongArtist))
+
+		url := webhookURL
+		if clip.ClientID != "" {
+			if clientURL := settings.For(clip.ClientID).WebhookURL; clientURL != "" {
+				url = clientURL
+			}
+		}
+		err = webhook.Send(url, "clip.matched", map[string]interface{}{
+			"clipID":    clip.ID,
+			"source":    clip.Source,
+			"createdAt": clip.CreatedAt,
+			"match":     topMatch,
+		})
+		if err != nil {
+			// Keep the clip so the notification is retried on the next replay
+			err := xerrors.New(err)
+			logger.ErrorContext(ctx, "failed to notify replay webhook", slog.Any("error", err))
+			continue
+		}
+
+		if err := archive.Remove(clip); err != nil {
+			err := xerrors.New(err)
+			logger.ErrorContext(ctx, "failed to remove resolved clip", slog.Any("error", err))
+		}
+		resolved++
+	}
+
+	logger.Info(fmt.Sprintf("Replayed %d unmatched clips: %d now match", len(clips), resolved))
+}
+
+// admin runs an admin subcommand against the admin API of a running server.
+func admin(args []string) {
+	adminCmd := flag.NewFlagSet("admin", flag.ExitOnError)
+	serverURL := adminCmd.String("server", utils.GetEnv("SEEKTUNE_SERVER", "http://localhost:5000"), "URL of the server")
+	token := adminCmd.String("token", utils.GetEnv("ADMIN_TOKEN"), "admin token (default: $ADMIN_TOKEN)")
+	adminCmd.Parse(args)
+
+	usage := func() {
+		fmt.Println("Usage: main.go admin [-server <url>] [-token <token>] <command>")
+		fmt.Println("  prune-orphans            : delete fingerprints of songs that no longer exist")
+		fmt.Println("  compact                  : reclaim space in the database")
+		fmt.Println("  reindex --song <id>      : regenerate the fingerprints of a song")
+		fmt.Println("  snapshot                 : write a snapshot of the database on the server")
+		fmt.Println("  failures list            : list failed ingestions")
+		fmt.Println("  failures retry [--id <id>] : retry failed ingestions")
+		fmt.Println("  calibrate                : fit confidence calibration to labelled history")
+		fmt.Println("  forget-client --id <id>  : delete the recognition history and clips of an API client")
+		fmt.Println("  purge                    : delete history and clips older than their retention periods")
+		fmt.Println("  jobs list                : list maintenance jobs with their schedules and last runs")
+		fmt.Println("  jobs runs <job>          : show the run history of a job")
+		fmt.Println("  jobs run <job>           : run a job now")
+		fmt.Println("  hotness                  : show how often songs were recognized recently")
+		fmt.Println("  metadata-backfill        : show the progress of the backfill-metadata job")
+		fmt.Println("  youtube-links [--status <available|dead|blocked>] : show the YouTube links checked by the youtube-links job")
+		fmt.Println("  stats [--from <day>] [--to <day>] : show daily recognition statistics")
+		fmt.Println("  catalog-stats [--song <id>] : show how many fingerprints the catalog, or a song, has")
+		fmt.Println("  schema                   : show the schema version of the catalog and its pending migrations")
+		fmt.Println("  reload                   : apply changes to .env without restarting the server")
+		fmt.Println("  dependencies             : show the failures and circuit breakers of external tools and APIs")
+		fmt.Println("  disk-space               : show the space left for ingestion and whether it is paused")
+		fmt.Println("  shadow                   : show how queries mirrored to the shadow index compared")
+		fmt.Println("  exclusions list          : list the song ranges excluded from matching")
+		fmt.Println("  exclusions set --song <id> --ranges <start-end,...> [--reason <text>] : exclude ranges (in seconds) of a song from matching")
+		fmt.Println("  exclusions delete --song <id> : match the whole song again")
+		fmt.Println("  shared-audio             : show audio shared by many songs, found by the shared-audio job")
+		fmt.Println("  shared-audio exclude <id> : exclude shared audio from matching in every song it is in")
+		fmt.Println("  monitors list            : list stream monitors with the health of running ones")
+		fmt.Println("  monitors add --url <url> [--id <id>] [--name <name>] [--stream <name>] [--alert-webhook <url>] [--loudness] [--record] : monitor a stream")
+		fmt.Println("  monitors recordings <id> : list the files a monitored stream was recorded to")
+		fmt.Println("  monitors simulcasts      : list monitors recognising the same songs at the same time")
+		fmt.Println("  monitors pause|resume|delete <id> : stop, restart or remove a monitor")
+		fmt.Println("  feeds import <file> [--format <csv|json>] : ingest the tracks of a feed")
+		fmt.Println("  feeds list               : list feed imports with the counts of their rows by status")
+		fmt.Println("  feeds status <id> [--status <status>] : show the status of every row of a feed import")
+		os.Exit(1)
+	}
+
+	if adminCmd.NArg() < 1 {
+		usage()
+	}
+
+	var method, endpoint string
+	var reqBody io.Reader
+	switch adminCmd.Arg(0) {
+	case "prune-orphans":
+		method, endpoint = http.MethodPost, "/api/admin/prune-orphans"
+	case "compact":
+		method, endpoint = http.MethodPost, "/api/admin/compact"
+	case "snapshot":
+		method, endpoint = http.MethodPost, "/api/admin/snapshot"
+	case "calibrate":
+		method, endpoint = http.MethodPost, "/api/admin/calibration/fit"
+	case "purge":
+		method, endpoint = http.MethodPost, "/api/admin/retention/purge"
+	case "hotness":
+		method, endpoint = http.MethodGet, "/api/admin/hotness"
+	case "metadata-backfill":
+		method, endpoint = http.MethodGet, "/api/admin/metadata/backfill"
+	case "reload":
+		method, endpoint = http.MethodPost, "/api/admin/reload"
+	case "dependencies":
+		method, endpoint = http.MethodGet, "/api/admin/dependencies"
+	case "disk-space":
+		method, endpoint = http.MethodGet, "/api/admin/disk-space"
+	case "shadow":
+		method, endpoint = http.MethodGet, "/api/admin/shadow"
+	case "schema":
+		method, endpoint = http.MethodGet, "/api/admin/schema"
+	case "youtube-links":
+		linksCmd := flag.NewFlagSet("youtube-links", flag.ExitOnError)
+		status := linksCmd.String("status", "", "only links with this status: available, dead or blocked")
+		linksCmd.Parse(adminCmd.Args()[1:])
+		method, endpoint = http.MethodGet, "/api/admin/youtube-links"
+		if *status != "" {
+			endpoint += "?status=" + url.QueryEscape(*status)
+		}
+	case "stats":
+		statsCmd := flag.NewFlagSet("stats", flag.ExitOnError)
+		from := statsCmd.String("from", "", "first day, as YYYY-MM-DD (default: 30 days ago)")
+		to := statsCmd.String("to", "", "last day, as YYYY-MM-DD (default: today)")
+		statsCmd.Parse(adminCmd.Args()[1:])
+		query := url.Values{}
+		if *from != "" {
+			query.Set("from", *from)
+		}
+		if *to != "" {
+			query.Set("to", *to)
+		}
+		method, endpoint = http.MethodGet, "/api/admin/stats"
+		if len(query) > 0 {
+			endpoint += "?" + query.Encode()
+		}
+	case "catalog-stats":
+		statsCmd := flag.NewFlagSet("catalog-stats", flag.ExitOnError)
+		song := statsCmd.String("song", "", "ID of a song")
+		statsCmd.Parse(adminCmd.Args()[1:])
+		method, endpoint = http.MethodGet, "/api/admin/catalog/stats"
+		if *song != "" {
+			endpoint = "/api/admin/songs/" + url.PathEscape(*song) + "/stats"
+		}
+	case "jobs":
+		if adminCmd.NArg() < 2 {
+			usage()
+		}
+		switch adminCmd.Arg(1) {
+		case "list":
+			method, endpoint = http.MethodGet, "/api/admin/jobs"
+		case "runs", "run":
+			if adminCmd.NArg() < 3 {
+				usage()
+			}
+			method, endpoint = http.MethodGet, "/api/admin/jobs/"+url.PathEscape(adminCmd.Arg(2))+"/runs"
+			if adminCmd.Arg(1) == "run" {
+				method, endpoint = http.MethodPost, "/api/admin/jobs/"+url.PathEscape(adminCmd.Arg(2))+"/run"
+			}
+		default:
+			usage()
+		}
+	case "shared-audio":
+		method, endpoint = http.MethodGet, "/api/admin/shared-audio"
+		if adminCmd.NArg() > 1 {
+			if adminCmd.Arg(1) != "exclude" || adminCmd.NArg() < 3 {
+				usage()
+			}
+			method, endpoint = http.MethodPost, "/api/admin/shared-audio/"+url.PathEscape(adminCmd.Arg(2))+"/exclude"
+		}
+	case "monitors":
+		if adminCmd.NArg() < 2 {
+			usage()
+		}
+		switch adminCmd.Arg(1) {
+		case "list":
+			method, endpoint = http.MethodGet, "/api/admin/monitors"
+		case "simulcasts":
+			method, endpoint = http.MethodGet, "/api/admin/monitors/simulcasts"
+		case "add":
+			addCmd := flag.NewFlagSet("add", flag.ExitOnError)
+			id := addCmd.String("id", "", "ID of the monitor (default: generated)")
+			name := addCmd.String("name", "", "name of the station")
+			streamURL := addCmd.String("url", "", "URL of the stream")
+			stream := addCmd.String("stream", "", "stream name matches are published under (default: the ID)")
+			alertWebhook := addCmd.String("alert-webhook", "", "URL notified of the alerts of the monitor")
+			measureLoudness := addCmd.Bool("loudness", false, "measure the loudness of the stream and of each track")
+			record := addCmd.Bool("record", false, "record the stream to rotating files")
+			addCmd.Parse(adminCmd.Args()[2:])
+			if *streamURL == "" {
+				usage()
+			}
+			data, _ := json.Marshal(map[string]interface{}{
+				"id": *id, "name": *name, "url": *streamURL, "stream": *stream,
+				"alertWebhookUrl": *alertWebhook, "loudness": *measureLoudness, "record": *record,
+			})
+			method, endpoint, reqBody = http.MethodPost, "/api/admin/monitors", bytes.NewReader(data)
+		case "recordings":
+			if adminCmd.NArg() < 3 {
+				usage()
+			}
+			method, endpoint = http.MethodGet, "/api/admin/monitors/"+url.PathEscape(adminCmd.Arg(2))+"/recordings"
+		case "pause", "resume", "delete":
+			if adminCmd.NArg() < 3 {
+				usage()
+			}
+			method, endpoint = http.MethodPost, "/api/admin/monitors/"+url.PathEscape(adminCmd.Arg(2))+"/"+adminCmd.Arg(1)
+			if adminCmd.Arg(1) == "delete" {
+				method, endpoint = http.MethodDelete, "/api/admin/monitors/"+url.PathEscape(adminCmd.Arg(2))
+			}
+		default:
+			usage()
+		}
+	case "exclusions":
+		if adminCmd.NArg() < 2 {
+			usage()
+		}
+		exclusionsCmd := flag.NewFlagSet("exclusions", flag.ExitOnError)
+		songID := exclusionsCmd.Uint64("song", 0, "ID of the song")
+		ranges := exclusionsCmd.String("ranges", "", "comma-separated ranges to exclude, as start-end in seconds")
+		reason := exclusionsCmd.String("reason", "", "why the ranges are excluded")
+		exclusionsCmd.Parse(adminCmd.Args()[2:])
+		switch adminCmd.Arg(1) {
+		case "list":
+			method, endpoint = http.MethodGet, "/api/admin/exclusions"
+		case "set":
+			if *songID == 0 {
+				usage()
+			}
+			rule, err := parseExclusionRanges(*ranges)
+			if err != nil {
+				yellow.Println("Error:", err)
+				os.Exit(1)
+			}
+			rule.Reason = *reason
+			data, _ := json.Marshal(rule)
+			method, endpoint, reqBody = http.MethodPut, fmt.Sprintf("/api/admin/songs/%d/exclusions", *songID), bytes.NewReader(data)
+		case "delete":
+			if *songID == 0 {
+				usage()
+			}
+			method, endpoint = http.MethodDelete, fmt.Sprintf("/api/admin/songs/%d/exclusions", *songID)
+		default:
+			usage()
+		}
+	case "feeds":
+		if adminCmd.NArg() < 2 {
+			usage()
+		}
+		feedsCmd := flag.NewFlagSet("feeds", flag.ExitOnError)
+		format := feedsCmd.String("format", "", "format of the feed, csv or json (default: from the file extension)")
+		status := feedsCmd.String("status", "", "only show rows with this status")
+		switch adminCmd.Arg(1) {
+		case "list":
+			method, endpoint = http.MethodGet, "/api/admin/feeds"
+		case "import":
+			if adminCmd.NArg() < 3 {
+				usage()
+			}
+			feedsCmd.Parse(adminCmd.Args()[3:])
+			filePath := adminCmd.Arg(2)
+			data, err := os.ReadFile(filePath)
+			if err != nil {
+				yellow.Println("Error reading feed:", err)
+				os.Exit(1)
+			}
+			if *format == "" {
+				*format = strings.TrimPrefix(strings.ToLower(filepath.Ext(filePath)), ".")
+			}
+			query := url.Values{"source": {filepath.Base(filePath)}}
+			if *format == feed.FormatCSV || *format == feed.FormatJSON {
+				query.Set("format", *format)
+			}
+			method, endpoint, reqBody = http.MethodPost, "/api/admin/feeds?"+query.Encode(), bytes.NewReader(data)
+		case "status":
+			if adminCmd.NArg() < 3 {
+				usage()
+			}
+			feedsCmd.Parse(adminCmd.Args()[3:])
+			method, endpoint = http.MethodGet, "/api/admin/feeds/"+url.PathEscape(adminCmd.Arg(2))
+			if *status != "" {
+				endpoint += "?status=" + url.QueryEscape(*status)
+			}
+		default:
+			usage()
+		}
+	case "forget-client":
+		forgetCmd := flag.NewFlagSet("forget-client", flag.ExitOnError)
+		clientID := forgetCmd.String("id", "", "ID of the API client")
+		forgetCmd.Parse(adminCmd.Args()[1:])
+		if *clientID == "" {
+			usage()
+		}
+		method, endpoint = http.MethodDelete, "/api/admin/clients/"+url.PathEscape(*clientID)+"/history"
+	case "reindex":
+		reindexCmd := flag.NewFlagSet("reindex", flag.ExitOnError)
+		songID := reindexCmd.Uint64("song", 0, "ID of the song to reindex")
+		reindexCmd.Parse(adminCmd.Args()[1:])
+		if *songID == 0 {
+			usage()
+		}
+		method, endpoint = http.MethodPost, fmt.Sprintf("/api/admin/songs/%d/reindex", *songID)
+	case "failures":
+		if adminCmd.NArg() < 2 {
+			usage()
+		}
+		switch adminCmd.Arg(1) {
+		case "list":
+			method, endpoint = http.MethodGet, "/api/admin/failures"
+		case "retry":
+			retryCmd := flag.NewFlagSet("retry", flag.ExitOnError)
+			id := retryCmd.String("id", "", "ID of the failure to retry (default: all)")
+			retryCmd.Parse(adminCmd.Args()[2:])
+			method, endpoint = http.MethodPost, "/api/admin/failures/retry"
+			if *id != "" {
+				endpoint += "?id=" + url.QueryEscape(*id)
+			}
+		default:
+			usage()
+		}
+	default:
+		usage()
+	}
+
+	req, err := http.NewRequest(method, strings.TrimRight(*serverURL, "/")+endpoint, reqBody)
+	if err != nil {
+		yellow.Println("Error creating request:", err)
+		os.Exit(1)
+	}
+	req.Header.Set("Authorization", "Bearer "+*token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		yellow.Println("Error calling admin API:", err)
+		os.Exit(1)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		yellow.Println("Error reading response:", err)
+		os.Exit(1)
+	}
+
+	var out interface{}
+	if err := json.Unmarshal(body, &out); err == nil {
+		body, _ = json.MarshalIndent(out, "", "  ")
+	}
+	fmt.Println(string(body))
+
+	if resp.StatusCode >= 300 {
+		os.Exit(1)
+	}
+}
+
+// parseExclusionRanges parses ranges written as "start-end" in seconds and
+// separated by commas, such as "0-4.5,180-185".
+func parseExclusionRanges(ranges string) (exclusions.Rule, error) {
+	var rule exclusions.Rule
+	for _, part := range strings.Split(ranges, ",") {
+		start, end, ok := strings.Cut(strings.TrimSpace(part), "-")
+		if !ok {
+			return rule, fmt.Errorf("invalid range %q, expected start-end", part)
+		}
+		startSeconds, err := strconv.ParseFloat(start, 64)
+		if err != nil || startSeconds < 0 {
+			return rule, fmt.Errorf("invalid range start %q", start)
+		}
+		endSeconds, err := strconv.ParseFloat(end, 64)
+		if err != nil || endSeconds < 0 {
+			return rule, fmt.Errorf("invalid range end %q", end)
+		}
+		rule.Ranges = append(rule.Ranges, exclusions.Range{
+			StartMs: uint32(startSeconds * 1000),
+			EndMs:   uint32(endSeconds * 1000),
+		})
+	}
+	return rule, rule.Validate()
+}
@@ -0,0 +1,187 @@
+package db
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// ErrInconsistentArchive is returned by ImportAll for archives of a catalog
+// that changed while it was exported, unless they are allowed.
+var ErrInconsistentArchive = errors.New("the catalog changed while it was exported")
+
+// ExportAll writes the catalog of client to w as a single archive, which
+// ImportAll loads into any backend with the same song IDs. The archive is a
+// tar of the folder ExportCatalog writes, its manifest first and then its
+// chunks in order, so that each chunk is checked before it is loaded. The
+// export is staged in a temporary folder meanwhile.
+func ExportAll(client DBClient, w io.Writer) (ExportManifest, error) {
+	dir, err := os.MkdirTemp("", "seektune-export-")
+	if err != nil {
+		return ExportManifest{}, fmt.Errorf("failed to create temporary folder: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	manifest, err := ExportCatalog(client, dir, ExportOptions{Workers: runtime.NumCPU()})
+	if err != nil {
+		return manifest, err
+	}
+
+	tw := tar.NewWriter(w)
+	files := []string{ExportManifestFile}
+	for _, chunk := range manifest.Chunks {
+		files = append(files, chunk.File)
+	}
+	for _, name := range files {
+		if err := addArchiveFile(tw, dir, name, manifest); err != nil {
+			return manifest, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return manifest, fmt.Errorf("failed to write archive: %v", err)
+	}
+	return manifest, nil
+}
+
+func addArchiveFile(tw *tar.Writer, dir, name string, manifest ExportManifest) error {
+	file, err := os.Open(filepath.Join(dir, name))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	err = tw.WriteHeader(&tar.Header{
+		Name:     name,
+		Mode:     0644,
+		Size:     info.Size(),
+		ModTime:  manifest.CreatedAt,
+		Typeflag: tar.TypeReg,
+	})
+	if err == nil {
+		_, err = io.Copy(tw, file)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write archive entry %s: %v", name, err)
+	}
+	return nil
+}
+
+// ImportAll loads an archive written by ExportAll into the catalog of
+// client. On backends supporting StageCatalog, the archive is loaded next to
+// the live catalog and replaces it once every chunk was checked against the
+// manifest, so a corrupt or truncated archive changes nothing. Other
+// backends, such as Cassandra, get the archive merged into their catalog as
+// it is read, and their stats counted again. Archives of a catalog that
+// changed during the export fail with ErrInconsistentArchive unless
+// allowInconsistent is set, and those of a newer schema with ErrSchemaNewer,
+// before anything is loaded. The catalog is then at the schema version of
+// the archive, or of the catalog it was merged into if that is older, so
+// that schema upgrades migrate what it holds.
+func ImportAll(client DBClient, r io.Reader, allowInconsistent bool) (ExportManifest, error) {
+	tr := tar.NewReader(r)
+	manifest, err := readArchiveManifest(tr)
+	if err != nil {
+		return manifest, err
+	}
+	if !manifest.Consistent && !allowInconsistent {
+		return manifest, fmt.Errorf("%w (version %d to %d)", ErrInconsistentArchive, manifest.CatalogVersion, manifest.EndCatalogVersion)
+	}
+
+	var target CatalogWriter = client
+	staged, err := StageCatalog(client)
+	switch {
+	case err == nil:
+		target = staged
+	case !errors.Is(err, ErrStagingUnsupported):
+		return manifest, err
+	}
+	var schemaVersion int
+	if staged == nil {
+		if schemaVersion, err = CurrentSchemaVersion(client); err != nil {
+			return manifest, err
+		}
+	}
+
+	if err := loadArchive(tr, manifest, target); err != nil {
+		if staged != nil {
+			if discardErr := staged.Discard(); discardErr != nil {
+				err = fmt.Errorf("%v (and failed to discard the staged catalog: %v)", err, discardErr)
+			}
+		}
+		return manifest, err
+	}
+
+	if staged != nil {
+		if err := staged.Promote(); err != nil {
+			return manifest, fmt.Errorf("failed to switch to the imported catalog: %v", err)
+		}
+		schemaVersion = manifest.SchemaVersion
+	} else {
+		// Couples the catalog already had were counted twice as they were
+		// merged
+		if _, err := CountCatalogStats(client); err != nil {
+			return manifest, fmt.Errorf("failed to count catalog stats: %v", err)
+		}
+		schemaVersion = min(schemaVersion, manifest.SchemaVersion)
+	}
+	if err := writeSchemaVersion(client, schemaVersion); err != nil {
+		return manifest, err
+	}
+	return manifest, nil
+}
+
+// readArchiveManifest reads the manifest an archive starts with.
+func readArchiveManifest(tr *tar.Reader) (ExportManifest, error) {
+	header, err := tr.Next()
+	if err != nil {
+		return ExportManifest{}, fmt.Errorf("not a catalog archive: %v", err)
+	}
+	if header.Name != ExportManifestFile {
+		return ExportManifest{}, fmt.Errorf("not a catalog archive: it doesn't start with %s", ExportManifestFile)
+	}
+	data, err := io.ReadAll(tr)
+	if err != nil {
+		return ExportManifest{}, fmt.Errorf("failed to read archive manifest: %v", err)
+	}
+	return parseExportManifest(data)
+}
+
+// loadArchive stores the chunks following the manifest of an archive into
+// target, checking each against the manifest first.
+func loadArchive(tr *tar.Reader, manifest ExportManifest, target CatalogWriter) error {
+	for _, chunk := range manifest.Chunks {
+		header, err := tr.Next()
+		if err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF) {
+			return fmt.Errorf("the archive is truncated: chunk %s is missing", chunk.File)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read archive: %v", err)
+		}
+		if header.Name != chunk.File {
+			return fmt.Errorf("invalid archive: found %s where the manifest lists %s", header.Name, chunk.File)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return fmt.Errorf("the archive is truncated: failed to read chunk %s: %v", chunk.File, err)
+		}
+		content, err := decompressChunk(chunk, data)
+		if err != nil {
+			return err
+		}
+		if err := loadChunk(chunk, content, manifest.Format, target); err != nil {
+			return err
+		}
+	}
+	if header, err := tr.Next(); err == nil {
+		return fmt.Errorf("invalid archive: %s isn't in the manifest", header.Name)
+	}
+	return nil
+}
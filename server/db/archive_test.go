@@ -0,0 +1,129 @@
+package db_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"song-recognition/db"
+	"song-recognition/models"
+	"testing"
+)
+
+func TestArchiveRoundTrip(t *testing.T) {
+	source := db.NewMemoryClient(t.Name())
+	defer source.Close()
+	songs := map[models.SongID]db.Song{
+		1:       {Title: "One", Artist: "Artist", YouTubeID: "ytid0000001"},
+		1 << 40: {Title: "Two", Artist: "Artist"},
+	}
+	for songID, song := range songs {
+		if err := source.StoreSong(songID, song); err != nil {
+			t.Fatalf("StoreSong: %v", err)
+		}
+	}
+	couple := models.Couple{AnchorTimeMs: 1500, SongID: 1 << 40}
+	couple.SetPeakCode(0x1234)
+	fingerprints := map[uint32]models.Couple{7: couple, 8: {AnchorTimeMs: 20, SongID: 1}}
+	if err := source.StoreFingerprints(fingerprints); err != nil {
+		t.Fatalf("StoreFingerprints: %v", err)
+	}
+
+	var archive bytes.Buffer
+	manifest, err := db.ExportAll(source, &archive)
+	if err != nil {
+		t.Fatalf("ExportAll: %v", err)
+	}
+	if manifest.Songs != 2 || manifest.Fingerprints != 2 || !manifest.Consistent {
+		t.Errorf("manifest = %+v; want 2 songs, 2 fingerprints, consistent", manifest)
+	}
+
+	// A truncated archive leaves the target as it was
+	target, err := db.NewSQLiteClient(filepath.Join(t.TempDir(), "db.sqlite3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	kept := db.Song{Title: "Kept", Artist: "Artist"}
+	if err := target.StoreSong(3, kept); err != nil {
+		t.Fatalf("StoreSong: %v", err)
+	}
+	// Past the 1024 bytes ending a tar, the last block of the last chunk
+	truncated := archive.Bytes()[:archive.Len()-1024-512]
+	if _, err := db.ImportAll(target, bytes.NewReader(truncated), false); err == nil {
+		t.Error("ImportAll of a truncated archive succeeded")
+	}
+	if got, exists, _ := target.GetSongByID(3); !exists || got != kept {
+		t.Errorf("GetSongByID = %+v, %v after a failed import; want %+v", got, exists, kept)
+	}
+
+	if _, err := db.ImportAll(target, &archive, false); err != nil {
+		t.Fatalf("ImportAll: %v", err)
+	}
+	if _, exists, _ := target.GetSongByID(3); exists {
+		t.Error("import kept the song of the replaced catalog")
+	}
+	for songID, song := range songs {
+		if got, exists, err := target.GetSongByID(songID); err != nil || !exists || got != song {
+			t.Errorf("GetSongByID(%d) = %+v, %v, %v; want %+v", songID, got, exists, err, song)
+		}
+	}
+	couples, err := target.GetCouples([]uint32{7, 8})
+	if err != nil {
+		t.Fatalf("GetCouples: %v", err)
+	}
+	for address, want := range fingerprints {
+		if len(couples[address]) != 1 || couples[address][0] != want {
+			t.Errorf("GetCouples(%d) = %v; want [%v]", address, couples[address], want)
+		}
+	}
+}
+
+func TestArchiveHoldsAnExport(t *testing.T) {
+	source := newMemory(t)
+	storeSongs(t, source, 1, 2)
+	if err := source.StoreFingerprints(map[uint32]models.Couple{7: {AnchorTimeMs: 10, SongID: 1}}); err != nil {
+		t.Fatalf("StoreFingerprints: %v", err)
+	}
+	var archive bytes.Buffer
+	if _, err := db.ExportAll(source, &archive); err != nil {
+		t.Fatalf("ExportAll: %v", err)
+	}
+
+	// Unpacked, the archive is an export folder
+	dir := t.TempDir()
+	tr := tar.NewReader(&archive)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("reading the archive: %v", err)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("reading %s: %v", header.Name, err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, header.Name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	manifest, err := db.ReadExportManifest(dir)
+	if err != nil {
+		t.Fatalf("ReadExportManifest: %v", err)
+	}
+	if manifest.Format != db.ExportFormat || manifest.Songs != 2 || manifest.Fingerprints != 1 || len(manifest.Chunks) != 2 {
+		t.Errorf("manifest = %+v; want format %d, 2 songs and 1 fingerprint in 2 chunks", manifest, db.ExportFormat)
+	}
+	target := newSQLite(t)
+	for _, chunk := range manifest.Chunks {
+		if err := db.LoadExportChunk(dir, chunk, manifest.Format, target); err != nil {
+			t.Errorf("LoadExportChunk(%s): %v", chunk.File, err)
+		}
+	}
+	if songs, err := target.TotalSongs(); err != nil || songs != 2 {
+		t.Errorf("TotalSongs = %d, %v after loading the chunks; want 2", songs, err)
+	}
+}
@@ -0,0 +1,985 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"song-recognition/models"
+	"song-recognition/utils"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// BoltClient stores the catalog in a single bbolt file, embedded in the
+// server, for deployments without a database server such as edge devices.
+//
+// Songs and fingerprints live in a catalog bucket, named after its
+// generation so that a staged catalog can replace it in a transaction. Every
+// address maps to its couples packed into one value (see packBoltCouple),
+// sorted by anchor time and song ID, and every song to the addresses it has
+// couples at, so that they can be deleted.
+type BoltClient struct {
+	handle *boltHandle
+	ctx    context.Context // see WithContext
+}
+
+// boltFile is a database file shared by the clients of the process, as
+// bbolt locks the file for the first one to open it.
+type boltFile struct {
+	sync.RWMutex // held exclusively while compacting
+	path         string
+	db           *bolt.DB
+	refs         int
+}
+
+// boltHandle releases the file of a client and of its context bound copies
+// once.
+type boltHandle struct {
+	file *boltFile
+	once sync.Once
+}
+
+var boltFiles struct {
+	sync.Mutex
+	files map[string]*boltFile
+}
+
+// Buckets and keys of a database file
+var (
+	boltMeta          = []byte("meta")
+	boltGenerationKey = []byte("catalog")
+	boltRecords       = []byte("records")
+
+	// Buckets of a catalog
+	boltSongs         = []byte("songs")          // song ID -> boltSong
+	boltSongKeys      = []byte("song_keys")      // song key -> song ID
+	boltSongYTIDs     = []byte("song_ytids")     // YouTube ID -> song ID
+	boltFingerprints  = []byte("fingerprints")   // address -> packed couples
+	boltSongAddresses = []byte("song_addresses") // song ID and address -> nothing
+)
+
+// boltCoupleSize is the size of a packed couple: its anchor time, song ID and
+// peak code.
+const boltCoupleSize = 14
+
+// boltBatchSize is the number of songs or addresses bulk reads visit per
+// transaction, so that callers can write to the database in between.
+const boltBatchSize = 1000
+
+type boltSong struct {
+	Title        string `json:"title"`
+	Artist       string `json:"artist"`
+	YouTubeID    string `json:"ytID"`
+	Key          string `json:"key"`
+	Album        string `json:"album,omitempty"`
+	DurationMs   int64  `json:"durationMs,omitempty"`
+	ReleaseYear  int    `json:"releaseYear,omitempty"`
+	Genre        string `json:"genre,omitempty"`
+	CoverArtURL  string `json:"coverArtUrl,omitempty"`
+	IngestedAtMs int64  `json:"ingestedAtMs,omitempty"`
+}
+
+func newBoltSong(song Song) boltSong {
+	return boltSong{
+		Title:        song.Title,
+		Artist:       song.Artist,
+		YouTubeID:    song.YouTubeID,
+		Key:          utils.GenerateSongKey(song.Title, song.Artist),
+		Album:        song.Album,
+		DurationMs:   song.DurationMs,
+		ReleaseYear:  song.ReleaseYear,
+		Genre:        song.Genre,
+		CoverArtURL:  song.CoverArtURL,
+		IngestedAtMs: song.IngestedAtMs,
+	}
+}
+
+func (b boltSong) song() Song {
+	return Song{
+		Title:     b.Title,
+		Artist:    b.Artist,
+		YouTubeID: b.YouTubeID,
+		SongDetails: SongDetails{
+			Album:       b.Album,
+			DurationMs:  b.DurationMs,
+			ReleaseYear: b.ReleaseYear,
+			Genre:       b.Genre,
+			CoverArtURL: b.CoverArtURL,
+		},
+		IngestedAtMs: b.IngestedAtMs,
+	}
+}
+
+type boltRecord struct {
+	ClientID  string          `json:"clientID"`
+	CreatedAt int64           `json:"createdAt"` // Unix nanoseconds
+	Data      json.RawMessage `json:"data"`
+}
+
+func NewBoltClient(path string) (*BoltClient, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to bbolt: %v", err)
+	}
+
+	boltFiles.Lock()
+	defer boltFiles.Unlock()
+
+	file, ok := boltFiles.files[path]
+	if !ok {
+		if err := utils.CreateFolder(filepath.Dir(path)); err != nil {
+			return nil, fmt.Errorf("error connecting to bbolt: %v", err)
+		}
+		db, err := openBolt(path)
+		if err != nil {
+			return nil, err
+		}
+		file = &boltFile{path: path, db: db}
+		if boltFiles.files == nil {
+			boltFiles.files = make(map[string]*boltFile)
+		}
+		boltFiles.files[path] = file
+	}
+	file.refs++
+
+	return &BoltClient{handle: &boltHandle{file: file}}, nil
+}
+
+// openBolt opens a database file, creating the buckets it lacks.
+func openBolt(path string) (*bolt.DB, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to bbolt: %v", err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(boltMeta)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists(boltRecords); err != nil {
+			return err
+		}
+		if meta.Get(boltGenerationKey) == nil {
+			if err := meta.Put(boltGenerationKey, boltUint64(1)); err != nil {
+				return err
+			}
+		}
+		_, err = createBoltCatalog(tx, boltGeneration(tx), false)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error creating buckets: %v", err)
+	}
+	return db, nil
+}
+
+func boltUint64(n uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, n)
+}
+
+func boltUint32(n uint32) []byte {
+	return binary.BigEndian.AppendUint32(nil, n)
+}
+
+// boltGeneration returns the generation of the live catalog.
+func boltGeneration(tx *bolt.Tx) uint64 {
+	return binary.BigEndian.Uint64(tx.Bucket(boltMeta).Get(boltGenerationKey))
+}
+
+func boltCatalogName(generation uint64) []byte {
+	return []byte("catalog_" + strconv.FormatUint(generation, 10))
+}
+
+// createBoltCatalog creates the buckets of a catalog generation, emptying
+// them first when reset is set.
+func createBoltCatalog(tx *bolt.Tx, generation uint64, reset bool) (*bolt.Bucket, error) {
+	name := boltCatalogName(generation)
+	if reset && tx.Bucket(name) != nil {
+		if err := tx.DeleteBucket(name); err != nil {
+			return nil, err
+		}
+	}
+	catalog, err := tx.CreateBucketIfNotExists(name)
+	if err != nil {
+		return nil, err
+	}
+	for _, bucket := range [][]byte{boltSongs, boltSongKeys, boltSongYTIDs, boltFingerprints, boltSongAddresses} {
+		if _, err := catalog.CreateBucketIfNotExists(bucket); err != nil {
+			return nil, err
+		}
+	}
+	return catalog, nil
+}
+
+// boltCatalog returns the bucket of the live catalog.
+func boltCatalog(tx *bolt.Tx) *bolt.Bucket {
+	return tx.Bucket(boltCatalogName(boltGeneration(tx)))
+}
+
+// view runs fn in a read transaction, unless ctx is done.
+func (db *BoltClient) view(ctx context.Context, fn func(tx *bolt.Tx) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	file := db.handle.file
+	file.RLock()
+	defer file.RUnlock()
+	return file.db.View(fn)
+}
+
+// update runs fn in a write transaction, unless ctx is done.
+func (db *BoltClient) update(ctx context.Context, fn func(tx *bolt.Tx) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	file := db.handle.file
+	file.RLock()
+	defer file.RUnlock()
+	return file.db.Update(fn)
+}
+
+func (db *BoltClient) withContext(ctx context.Context) DBClient {
+	bound := *db
+	bound.ctx = ctx
+	return &bound
+}
+
+// Close closes the file once no client of the process uses it.
+func (db *BoltClient) Close() error {
+	var err error
+	db.handle.once.Do(func() {
+		boltFiles.Lock()
+		defer boltFiles.Unlock()
+
+		file := db.handle.file
+		file.refs--
+		if file.refs == 0 {
+			delete(boltFiles.files, file.path)
+			err = file.db.Close()
+		}
+	})
+	return err
+}
+
+// packBoltCouple encodes a couple as its anchor time, song ID and peak code,
+// big endian, so that packed couples sort by anchor time and song ID.
+func packBoltCouple(couple models.Couple) []byte {
+	packed := make([]byte, 0, boltCoupleSize)
+	packed = binary.BigEndian.AppendUint32(packed, couple.AnchorTimeMs)
+	packed = binary.BigEndian.AppendUint64(packed, uint64(couple.SongID))
+	return binary.BigEndian.AppendUint16(packed, couple.PeakCode())
+}
+
+func unpackBoltCouples(packed []byte) []models.Couple {
+	couples := make([]models.Couple, 0, len(packed)/boltCoupleSize)
+	for i := 0; i+boltCoupleSize <= len(packed); i += boltCoupleSize {
+		couple := models.Couple{
+			AnchorTimeMs: binary.BigEndian.Uint32(packed[i:]),
+			SongID:       models.SongID(binary.BigEndian.Uint64(packed[i+4:])),
+		}
+		couple.SetPeakCode(binary.BigEndian.Uint16(packed[i+12:]))
+		couples = append(couples, couple)
+	}
+	return couples
+}
+
+// insertBoltCouple returns a copy of packed couples with couple added, or
+// replacing the couple of the same anchor time and song, and whether it was
+// added.
+func insertBoltCouple(packed []byte, couple models.Couple) ([]byte, bool) {
+	entry := packBoltCouple(couple)
+	n := len(packed) / boltCoupleSize
+	i := sort.Search(n, func(i int) bool {
+		return bytes.Compare(packed[i*boltCoupleSize:i*boltCoupleSize+12], entry[:12]) >= 0
+	})
+
+	inserted := make([]byte, 0, len(packed)+boltCoupleSize)
+	inserted = append(inserted, packed[:i*boltCoupleSize]...)
+	inserted = append(inserted, entry...)
+	replaced := i < n && bytes.Equal(packed[i*boltCoupleSize:i*boltCoupleSize+12], entry[:12])
+	if replaced {
+		i++
+	}
+	return append(inserted, packed[i*boltCoupleSize:]...), !replaced
+}
+
+func (db *BoltClient) StoreFingerprints(fingerprints map[uint32]models.Couple) error {
+	_, err := db.addFingerprints(fingerprints)
+	return err
+}
+
+func (db *BoltClient) addFingerprints(fingerprints map[uint32]models.Couple) (map[uint32]models.Couple, error) {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	var added map[uint32]models.Couple
+	err := db.update(ctx, func(tx *bolt.Tx) (err error) {
+		added, err = storeBoltFingerprints(boltCatalog(tx), fingerprints)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error inserting fingerprints: %v", err)
+	}
+	return added, nil
+}
+
+// storeBoltFingerprints stores couples in a catalog bucket, returning those
+// that weren't replaced.
+func storeBoltFingerprints(catalog *bolt.Bucket, fingerprints map[uint32]models.Couple) (map[uint32]models.Couple, error) {
+	bucket := catalog.Bucket(boltFingerprints)
+	songAddresses := catalog.Bucket(boltSongAddresses)
+
+	added := make(map[uint32]models.Couple, len(fingerprints))
+	for address, couple := range fingerprints {
+		key := boltUint32(address)
+		packed, isNew := insertBoltCouple(bucket.Get(key), couple)
+		if err := bucket.Put(key, packed); err != nil {
+			return nil, err
+		}
+		if err := songAddresses.Put(append(boltUint64(uint64(couple.SongID)), key...), nil); err != nil {
+			return nil, err
+		}
+		if isNew {
+			added[address] = couple
+		}
+	}
+	return added, nil
+}
+
+func (db *BoltClient) GetCouples(addresses []uint32) (map[uint32][]models.Couple, error) {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	couples := make(map[uint32][]models.Couple)
+
+	err := db.view(ctx, func(tx *bolt.Tx) error {
+		bucket := boltCatalog(tx).Bucket(boltFingerprints)
+		for _, address := range addresses {
+			if packed := bucket.Get(boltUint32(address)); packed != nil {
+				couples[address] = unpackBoltCouples(packed)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error querying database: %v", err)
+	}
+	return couples, nil
+}
+
+func (db *BoltClient) TotalSongs() (int, error) {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	var count int
+	err := db.view(ctx, func(tx *bolt.Tx) error {
+		count = boltCatalog(tx).Bucket(boltSongs).Stats().KeyN
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error counting songs: %v", err)
+	}
+	return count, nil
+}
+
+func (db *BoltClient) RegisterSong(songTitle, songArtist, ytID string) (models.SongID, error) {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+
+	songID := models.NewSongID()
+	song := newBoltSong(Song{Title: songTitle, Artist: songArtist, YouTubeID: ytID, IngestedAtMs: ingestionTime()})
+	err := db.update(ctx, func(tx *bolt.Tx) error {
+		catalog := boltCatalog(tx)
+		if catalog.Bucket(boltSongKeys).Get([]byte(song.Key)) != nil || catalog.Bucket(boltSongs).Get(boltUint64(uint64(songID))) != nil {
+			return fmt.Errorf("song with ytID or key already exists")
+		}
+		return putBoltSong(catalog, songID, song)
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to register song: %v", err)
+	}
+	return songID, nil
+}
+
+// putBoltSong stores a song under songID, replacing the song with that ID
+// and any other with the same key.
+func putBoltSong(catalog *bolt.Bucket, songID models.SongID, song boltSong) error {
+	if other := catalog.Bucket(boltSongKeys).Get([]byte(song.Key)); other != nil {
+		if err := deleteBoltSong(catalog, models.SongID(binary.BigEndian.Uint64(other))); err != nil {
+			return err
+		}
+	}
+	if err := deleteBoltSong(catalog, songID); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(song)
+	if err != nil {
+		return err
+	}
+	id := boltUint64(uint64(songID))
+	if err := catalog.Bucket(boltSongs).Put(id, data); err != nil {
+		return err
+	}
+	if err := catalog.Bucket(boltSongKeys).Put([]byte(song.Key), id); err != nil {
+		return err
+	}
+	if song.YouTubeID != "" {
+		return catalog.Bucket(boltSongYTIDs).Put([]byte(song.YouTubeID), id)
+	}
+	return nil
+}
+
+// deleteBoltSong deletes a song and the index entries pointing to it.
+func deleteBoltSong(catalog *bolt.Bucket, songID models.SongID) error {
+	id := boltUint64(uint64(songID))
+	data := catalog.Bucket(boltSongs).Get(id)
+	if data == nil {
+		return nil
+	}
+	var song boltSong
+	if err := json.Unmarshal(data, &song); err != nil {
+		return fmt.Errorf("failed to unmarshal song %d: %v", songID, err)
+	}
+
+	for _, index := range []struct {
+		bucket []byte
+		key    string
+	}{{boltSongKeys, song.Key}, {boltSongYTIDs, song.YouTubeID}} {
+		bucket := catalog.Bucket(index.bucket)
+		if bytes.Equal(bucket.Get([]byte(index.key)), id) {
+			if err := bucket.Delete([]byte(index.key)); err != nil {
+				return err
+			}
+		}
+	}
+	return catalog.Bucket(boltSongs).Delete(id)
+}
+
+// GetSong retrieves a song by filter key
+func (db *BoltClient) GetSong(filterKey string, value interface{}) (Song, bool, error) {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+
+	var index []byte
+	switch filterKey {
+	case "id":
+	case "ytID":
+		index = boltSongYTIDs
+	case "key":
+		index = boltSongKeys
+	default:
+		return Song{}, false, fmt.Errorf("invalid filter key")
+	}
+
+	var song Song
+	var found bool
+	err := db.view(ctx, func(tx *bolt.Tx) error {
+		catalog := boltCatalog(tx)
+		id := []byte(nil)
+		if index == nil {
+			songID, err := models.ParseSongID(fmt.Sprint(value))
+			if err != nil {
+				return err
+			}
+			id = boltUint64(uint64(songID))
+		} else if id = catalog.Bucket(index).Get([]byte(fmt.Sprint(value))); id == nil {
+			return nil
+		}
+
+		data := catalog.Bucket(boltSongs).Get(id)
+		if data == nil {
+			return nil
+		}
+		var stored boltSong
+		if err := json.Unmarshal(data, &stored); err != nil {
+			return err
+		}
+		song, found = stored.song(), true
+		return nil
+	})
+	if err != nil {
+		return Song{}, false, fmt.Errorf("failed to retrieve song: %v", err)
+	}
+	return song, found, nil
+}
+
+func (db *BoltClient) GetSongByID(songID models.SongID) (Song, bool, error) {
+	return db.GetSong("id", songID)
+}
+
+func (db *BoltClient) GetSongByYTID(ytID string) (Song, bool, error) {
+	return db.GetSong("ytID", ytID)
+}
+
+func (db *BoltClient) GetSongByKey(key string) (Song, bool, error) {
+	return db.GetSong("key", key)
+}
+
+// DeleteSongByID deletes a song by ID
+func (db *BoltClient) DeleteSongByID(songID models.SongID) error {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	err := db.update(ctx, func(tx *bolt.Tx) error {
+		return deleteBoltSong(boltCatalog(tx), songID)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete song: %v", err)
+	}
+	return nil
+}
+
+// DeleteCollection empties the songs or fingerprints of the catalog, or a
+// collection of records.
+func (db *BoltClient) DeleteCollection(collectionName string) error {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+
+	var buckets [][]byte
+	switch collectionName {
+	case "songs":
+		buckets = [][]byte{boltSongs, boltSongKeys, boltSongYTIDs}
+	case "fingerprints":
+		buckets = [][]byte{boltFingerprints, boltSongAddresses}
+	}
+
+	err := db.update(ctx, func(tx *bolt.Tx) error {
+		if buckets == nil {
+			err := tx.Bucket(boltRecords).DeleteBucket([]byte(collectionName))
+			if err == bolt.ErrBucketNotFound {
+				return nil
+			}
+			return err
+		}
+		catalog := boltCatalog(tx)
+		for _, bucket := range buckets {
+			if err := catalog.DeleteBucket(bucket); err != nil {
+				return err
+			}
+			if _, err := catalog.CreateBucket(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error deleting collection: %v", err)
+	}
+	return nil
+}
+
+// ForEachSong calls fn for every song, in ID order
+func (db *BoltClient) ForEachSong(fn func(songID models.SongID, song Song) error) error {
+	ctx := bulkContext(db.ctx)
+
+	type entry struct {
+		songID models.SongID
+		song   Song
+	}
+	var after []byte
+	for {
+		var batch []entry
+		err := db.view(ctx, func(tx *bolt.Tx) error {
+			cursor := boltCatalog(tx).Bucket(boltSongs).Cursor()
+			key, value := cursor.First()
+			if after != nil {
+				if key, value = cursor.Seek(after); bytes.Equal(key, after) {
+					key, value = cursor.Next()
+				}
+			}
+			for ; key != nil && len(batch) < boltBatchSize; key, value = cursor.Next() {
+				var song boltSong
+				if err := json.Unmarshal(value, &song); err != nil {
+					return err
+				}
+				batch = append(batch, entry{models.SongID(binary.BigEndian.Uint64(key)), song.song()})
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("error querying songs: %v", err)
+		}
+
+		for _, entry := range batch {
+			if err := fn(entry.songID, entry.song); err != nil {
+				return err
+			}
+		}
+		if len(batch) < boltBatchSize {
+			return nil
+		}
+		after = boltUint64(uint64(batch[len(batch)-1].songID))
+	}
+}
+
+func (db *BoltClient) ListSongs(offset, limit int, filter SongFilter) ([]ListedSong, error) {
+	return listSongs(db.ForEachSong, offset, limit, filter)
+}
+
+// ForEachFingerprint calls fn for every couple, in address, anchor time and
+// song ID order
+func (db *BoltClient) ForEachFingerprint(fn func(address uint32, couple models.Couple) error) error {
+	ctx := bulkContext(db.ctx)
+
+	type entry struct {
+		address uint32
+		couples []models.Couple
+	}
+	var after []byte
+	for {
+		var batch []entry
+		err := db.view(ctx, func(tx *bolt.Tx) error {
+			cursor := boltCatalog(tx).Bucket(boltFingerprints).Cursor()
+			key, value := cursor.First()
+			if after != nil {
+				if key, value = cursor.Seek(after); bytes.Equal(key, after) {
+					key, value = cursor.Next()
+				}
+			}
+			for ; key != nil && len(batch) < boltBatchSize; key, value = cursor.Next() {
+				batch = append(batch, entry{binary.BigEndian.Uint32(key), unpackBoltCouples(value)})
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("error querying fingerprints: %v", err)
+		}
+
+		for _, entry := range batch {
+			for _, couple := range entry.couples {
+				if err := fn(entry.address, couple); err != nil {
+					return err
+				}
+			}
+		}
+		if len(batch) < boltBatchSize {
+			return nil
+		}
+		after = boltUint32(batch[len(batch)-1].address)
+	}
+}
+
+// StoreSong stores a song under the given ID, replacing any song with that ID
+func (db *BoltClient) StoreSong(songID models.SongID, song Song) error {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	err := db.update(ctx, func(tx *bolt.Tx) error {
+		return putBoltSong(boltCatalog(tx), songID, newBoltSong(song))
+	})
+	if err != nil {
+		return fmt.Errorf("failed to store song: %v", err)
+	}
+	return nil
+}
+
+// FingerprintSongIDs returns the distinct song IDs referenced by fingerprints
+func (db *BoltClient) FingerprintSongIDs() ([]models.SongID, error) {
+	ctx := bulkContext(db.ctx)
+	var songIDs []models.SongID
+	err := db.view(ctx, func(tx *bolt.Tx) error {
+		cursor := boltCatalog(tx).Bucket(boltSongAddresses).Cursor()
+		// Addresses are keyed after their song, which is skipped past once seen
+		for key, _ := cursor.First(); key != nil; {
+			songID := binary.BigEndian.Uint64(key)
+			songIDs = append(songIDs, models.SongID(songID))
+			if songID == 1<<64-1 {
+				break
+			}
+			key, _ = cursor.Seek(boltUint64(songID + 1))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error querying song IDs: %v", err)
+	}
+	return songIDs, nil
+}
+
+// DeleteFingerprintsBySongID deletes all couples of a song
+func (db *BoltClient) DeleteFingerprintsBySongID(songID models.SongID) error {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	err := db.update(ctx, func(tx *bolt.Tx) error {
+		catalog := boltCatalog(tx)
+		bucket := catalog.Bucket(boltFingerprints)
+		songAddresses := catalog.Bucket(boltSongAddresses)
+
+		prefix := boltUint64(uint64(songID))
+		var keys [][]byte
+		cursor := songAddresses.Cursor()
+		for key, _ := cursor.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, _ = cursor.Next() {
+			keys = append(keys, bytes.Clone(key))
+		}
+
+		for _, key := range keys {
+			address := key[8:]
+			var kept []byte
+			packed := bucket.Get(address)
+			for i := 0; i+boltCoupleSize <= len(packed); i += boltCoupleSize {
+				if !bytes.Equal(packed[i+4:i+12], prefix) {
+					kept = append(kept, packed[i:i+boltCoupleSize]...)
+				}
+			}
+			if len(kept) == 0 {
+				if err := bucket.Delete(address); err != nil {
+					return err
+				}
+			} else if err := bucket.Put(address, kept); err != nil {
+				return err
+			}
+			if err := songAddresses.Delete(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete fingerprints: %v", err)
+	}
+	return nil
+}
+
+// Compact rewrites the database file to reclaim the pages left free by
+// deletions, which bbolt otherwise reuses but never returns. Other clients
+// of the process wait until it is done.
+func (db *BoltClient) Compact() error {
+	file := db.handle.file
+	file.Lock()
+	defer file.Unlock()
+
+	compacted := file.path + ".compact"
+	os.Remove(compacted)
+	dst, err := bolt.Open(compacted, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return fmt.Errorf("failed to compact database: %v", err)
+	}
+	err = bolt.Compact(dst, file.db, 64<<20)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(compacted)
+		return fmt.Errorf("failed to compact database: %v", err)
+	}
+
+	if err := file.db.Close(); err != nil {
+		os.Remove(compacted)
+		return fmt.Errorf("failed to compact database: %v", err)
+	}
+	renameErr := os.Rename(compacted, file.path)
+	// The file is reopened, compacted or not, for the clients sharing it
+	file.db, err = openBolt(file.path)
+	if err != nil {
+		return fmt.Errorf("failed to reopen compacted database: %v", err)
+	}
+	if renameErr != nil {
+		os.Remove(compacted)
+		return fmt.Errorf("failed to compact database: %v", renameErr)
+	}
+	return nil
+}
+
+// Snapshot writes a consistent copy of the database file into dir
+func (db *BoltClient) Snapshot(dir string) (string, error) {
+	ctx := bulkContext(db.ctx)
+	err := utils.CreateFolder(dir)
+	if err != nil {
+		return "", fmt.Errorf("failed to create snapshot dir: %v", err)
+	}
+
+	path := filepath.Join(dir, fmt.Sprintf("snapshot_%s.bolt", time.Now().UTC().Format("20060102T150405")))
+	err = db.view(ctx, func(tx *bolt.Tx) error {
+		return tx.CopyFile(path, 0600)
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to snapshot database: %v", err)
+	}
+	return path, nil
+}
+
+func (db *BoltClient) PutRecord(collection string, record Record) error {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	data, err := json.Marshal(boltRecord{ClientID: record.ClientID, CreatedAt: record.CreatedAt.UnixNano(), Data: record.Data})
+	if err != nil {
+		return fmt.Errorf("failed to store record: %v", err)
+	}
+	err = db.update(ctx, func(tx *bolt.Tx) error {
+		bucket, err := tx.Bucket(boltRecords).CreateBucketIfNotExists([]byte(collection))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(record.ID), data)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to store record: %v", err)
+	}
+	return nil
+}
+
+func (db *BoltClient) GetRecord(collection, id string) (Record, bool, error) {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	var record Record
+	var found bool
+	err := db.view(ctx, func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltRecords).Bucket([]byte(collection))
+		if bucket == nil {
+			return nil
+		}
+		data := bucket.Get([]byte(id))
+		if data == nil {
+			return nil
+		}
+		var err error
+		record, err = unmarshalBoltRecord(id, data)
+		found = err == nil
+		return err
+	})
+	if err != nil {
+		return Record{}, false, fmt.Errorf("failed to retrieve record: %v", err)
+	}
+	return record, found, nil
+}
+
+func (db *BoltClient) ListRecords(collection string, filter RecordFilter) ([]Record, error) {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	var records []Record
+	err := db.view(ctx, func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltRecords).Bucket([]byte(collection))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(key, data []byte) error {
+			record, err := unmarshalBoltRecord(string(key), data)
+			if err != nil {
+				return err
+			}
+			if filter.ClientID != "" && record.ClientID != filter.ClientID ||
+				!filter.Since.IsZero() && record.CreatedAt.Before(filter.Since) ||
+				!filter.Until.IsZero() && !record.CreatedAt.Before(filter.Until) {
+				return nil
+			}
+			records = append(records, record)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list records: %v", err)
+	}
+
+	sort.SliceStable(records, func(i, j int) bool { return records[i].CreatedAt.Before(records[j].CreatedAt) })
+	if filter.Limit > 0 && len(records) > filter.Limit {
+		records = records[:filter.Limit]
+	}
+	return records, nil
+}
+
+func (db *BoltClient) DeleteRecord(collection, id string) error {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	err := db.update(ctx, func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltRecords).Bucket([]byte(collection))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.Delete([]byte(id))
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete record: %v", err)
+	}
+	return nil
+}
+
+func unmarshalBoltRecord(id string, data []byte) (Record, error) {
+	var stored boltRecord
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return Record{}, fmt.Errorf("failed to unmarshal record %s: %v", id, err)
+	}
+	return Record{
+		ID:        id,
+		ClientID:  stored.ClientID,
+		CreatedAt: time.Unix(0, stored.CreatedAt).UTC(),
+		Data:      stored.Data,
+	}, nil
+}
+
+// boltStaging loads a catalog into the next generation of the catalog bucket.
+type boltStaging struct {
+	client     *BoltClient
+	generation uint64
+}
+
+func (db *BoltClient) stageCatalog() (StagedCatalog, error) {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	var generation uint64
+	err := db.update(ctx, func(tx *bolt.Tx) error {
+		generation = boltGeneration(tx) + 1
+		_, err := createBoltCatalog(tx, generation, true)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error creating staging buckets: %v", err)
+	}
+	return &boltStaging{client: db, generation: generation}, nil
+}
+
+func (s *boltStaging) StoreSong(songID models.SongID, song Song) error {
+	err := s.client.update(context.Background(), func(tx *bolt.Tx) error {
+		return putBoltSong(tx.Bucket(boltCatalogName(s.generation)), songID, newBoltSong(song))
+	})
+	if err != nil {
+		return fmt.Errorf("failed to store song: %v", err)
+	}
+	return nil
+}
+
+func (s *boltStaging) StoreFingerprints(fingerprints map[uint32]models.Couple) error {
+	err := s.client.update(context.Background(), func(tx *bolt.Tx) error {
+		_, err := storeBoltFingerprints(tx.Bucket(boltCatalogName(s.generation)), fingerprints)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("error inserting fingerprints: %v", err)
+	}
+	return nil
+}
+
+// Promote makes the staged generation the live catalog and drops the old one
+// in a transaction, so readers see the old catalog until it commits.
+func (s *boltStaging) Promote() error {
+	err := s.client.update(context.Background(), func(tx *bolt.Tx) error {
+		live := boltGeneration(tx)
+		if err := tx.Bucket(boltMeta).Put(boltGenerationKey, boltUint64(s.generation)); err != nil {
+			return err
+		}
+		return tx.DeleteBucket(boltCatalogName(live))
+	})
+	if err != nil {
+		return fmt.Errorf("error promoting staged catalog: %v", err)
+	}
+	return nil
+}
+
+func (s *boltStaging) Discard() error {
+	err := s.client.update(context.Background(), func(tx *bolt.Tx) error {
+		err := tx.DeleteBucket(boltCatalogName(s.generation))
+		if err == bolt.ErrBucketNotFound {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("error dropping staging buckets: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package db_test
+
+import (
+	"path/filepath"
+	"song-recognition/db"
+	"song-recognition/db/storagetest"
+	"song-recognition/models"
+	"testing"
+)
+
+func TestBoltConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) db.DBClient {
+		client, err := db.NewBoltClient(filepath.Join(t.TempDir(), "db.bolt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return client
+	})
+}
+
+func TestBoltStagingAndCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.bolt")
+	client, err := db.NewBoltClient(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	// Clients of the same file share it rather than wait for its lock
+	other, err := db.NewBoltClient(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	live := db.Song{Title: "Live", Artist: "Artist", YouTubeID: "ytid0000001"}
+	if err := client.StoreSong(1, live); err != nil {
+		t.Fatalf("StoreSong: %v", err)
+	}
+
+	staged, err := db.StageCatalog(client)
+	if err != nil {
+		t.Fatalf("StageCatalog: %v", err)
+	}
+	song := db.Song{Title: "Staged", Artist: "Artist", YouTubeID: "ytid0000002"}
+	couple := models.Couple{AnchorTimeMs: 1500, SongID: 2}
+	if err := staged.StoreSong(2, song); err != nil {
+		t.Fatalf("StoreSong: %v", err)
+	}
+	if err := staged.StoreFingerprints(map[uint32]models.Couple{7: couple}); err != nil {
+		t.Fatalf("StoreFingerprints: %v", err)
+	}
+	if _, exists, _ := other.GetSongByID(2); exists {
+		t.Error("staged song is live before promotion")
+	}
+	if err := staged.Promote(); err != nil {
+		t.Fatalf("Promote: %v", err)
+	}
+
+	if err := client.Compact(); err != nil {
+		t.Fatalf("Compact: %v", err)
+	}
+	if _, exists, _ := other.GetSongByID(1); exists {
+		t.Error("promotion kept the song of the replaced catalog")
+	}
+	if got, exists, err := other.GetSongByID(2); err != nil || !exists || got != song {
+		t.Errorf("GetSongByID = %+v, %v, %v; want %+v", got, exists, err, song)
+	}
+	couples, err := other.GetCouples([]uint32{7})
+	if err != nil || len(couples[7]) != 1 || couples[7][0] != couple {
+		t.Errorf("GetCouples = %v, %v; want [%v]", couples[7], err, couple)
+	}
+}
@@ -0,0 +1,68 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"song-recognition/models"
+)
+
+// cascadingClient wraps a DBClient so that deleting a song also deletes its
+// fingerprints, which would otherwise keep matching the song, and deleting
+// fingerprints the checksum recorded for them.
+type cascadingClient struct {
+	DBClient
+}
+
+// withCascade wraps a client so that DeleteSongByID cascades to the
+// fingerprints of the song. Backends don't cascade themselves, since some
+// of them delete a song to replace it in StoreSong.
+func withCascade(client DBClient) DBClient {
+	return &cascadingClient{DBClient: client}
+}
+
+func (c *cascadingClient) withContext(ctx context.Context) DBClient {
+	return &cascadingClient{DBClient: WithContext(ctx, c.DBClient)}
+}
+
+// DeleteSongByID deletes the fingerprints of a song before the song, so
+// that a failure leaves the song in place to delete again.
+func (c *cascadingClient) DeleteSongByID(songID models.SongID) error {
+	if err := c.DeleteFingerprintsBySongID(songID); err != nil {
+		return fmt.Errorf("failed to delete fingerprints of song %d: %v", songID, err)
+	}
+	return c.DBClient.DeleteSongByID(songID)
+}
+
+func (c *cascadingClient) DeleteFingerprintsBySongID(songID models.SongID) error {
+	if err := c.DBClient.DeleteRecord(checksumsCollection, fmt.Sprint(songID)); err != nil {
+		return err
+	}
+	return c.DBClient.DeleteFingerprintsBySongID(songID)
+}
+
+// PruneOrphanFingerprints deletes the fingerprints of songs that no longer
+// exist, such as songs deleted before deletions cascaded, and returns the
+// IDs of those songs.
+func PruneOrphanFingerprints(client DBClient) ([]models.SongID, error) {
+	songIDs, err := client.FingerprintSongIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	orphans := []models.SongID{}
+	for _, songID := range songIDs {
+		_, songExists, err := client.GetSongByID(songID)
+		if err != nil {
+			return orphans, err
+		}
+		if songExists {
+			continue
+		}
+
+		if err := client.DeleteFingerprintsBySongID(songID); err != nil {
+			return orphans, err
+		}
+		orphans = append(orphans, songID)
+	}
+	return orphans, nil
+}
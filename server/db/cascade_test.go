@@ -0,0 +1,39 @@
+package db_test
+
+import (
+	"song-recognition/models"
+	"testing"
+)
+
+func TestDeleteSongCascadesToFingerprints(t *testing.T) {
+	client := newMemory(t)
+	storeSongs(t, client, 1, 2)
+	kept := models.Couple{AnchorTimeMs: 10, SongID: 2}
+	if err := client.StoreFingerprints(map[uint32]models.Couple{7: {AnchorTimeMs: 10, SongID: 1}, 8: kept}); err != nil {
+		t.Fatalf("StoreFingerprints: %v", err)
+	}
+	if err := client.StoreFingerprints(map[uint32]models.Couple{8: {AnchorTimeMs: 20, SongID: 1}}); err != nil {
+		t.Fatalf("StoreFingerprints: %v", err)
+	}
+
+	if err := client.DeleteSongByID(1); err != nil {
+		t.Fatalf("DeleteSongByID: %v", err)
+	}
+	couples, err := client.GetCouples([]uint32{7, 8})
+	if err != nil {
+		t.Fatalf("GetCouples: %v", err)
+	}
+	if len(couples[7]) != 0 {
+		t.Errorf("GetCouples(7) = %v after deleting its song; want none", couples[7])
+	}
+	if len(couples[8]) != 1 || couples[8][0] != kept {
+		t.Errorf("GetCouples(8) = %v; want [%v]", couples[8], kept)
+	}
+	songIDs, err := client.FingerprintSongIDs()
+	if err != nil {
+		t.Fatalf("FingerprintSongIDs: %v", err)
+	}
+	if len(songIDs) != 1 || songIDs[0] != 2 {
+		t.Errorf("FingerprintSongIDs = %v; want [2]", songIDs)
+	}
+}
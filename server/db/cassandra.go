@@ -0,0 +1,623 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"song-recognition/models"
+	"song-recognition/utils"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+// cassandraWriters is the number of concurrent writes per StoreFingerprints
+// call. Single-partition writes spread over the cluster scale better than
+// multi-partition batches.
+const cassandraWriters = 32
+
+// CassandraClient stores the catalog in Cassandra or ScyllaDB. Fingerprints
+// are wide rows partitioned by address and clustered by song and anchor
+// time; song_fingerprints indexes the same couples by song so a song's
+// fingerprints can be found and deleted.
+type CassandraClient struct {
+	session *gocql.Session
+	ctx     context.Context // see WithContext
+}
+
+func NewCassandraClient(hosts []string, port int, keyspace, username, password string) (*CassandraClient, error) {
+	cluster := gocql.NewCluster(hosts...)
+	cluster.Port = port
+	cluster.Timeout = 10 * time.Second
+	cluster.Consistency = gocql.LocalQuorum
+	if username != "" {
+		cluster.Authenticator = gocql.PasswordAuthenticator{Username: username, Password: password}
+	}
+
+	session, err := cluster.CreateSession()
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to Cassandra: %s", err)
+	}
+
+	replication := utils.GetEnv("CASSANDRA_REPLICATION", "{'class': 'SimpleStrategy', 'replication_factor': 1}")
+	err = session.Query(fmt.Sprintf("CREATE KEYSPACE IF NOT EXISTS %s WITH replication = %s", keyspace, replication)).Exec()
+	session.Close()
+	if err != nil {
+		return nil, fmt.Errorf("error creating keyspace: %s", err)
+	}
+
+	cluster.Keyspace = keyspace
+	session, err = cluster.CreateSession()
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to Cassandra: %s", err)
+	}
+
+	err = createCassandraTables(session, keyspace)
+	if err != nil {
+		session.Close()
+		return nil, fmt.Errorf("error creating tables: %s", err)
+	}
+
+	return &CassandraClient{session: session}, nil
+}
+
+func createCassandraTables(session *gocql.Session, keyspace string) error {
+	tables := map[string]string{
+		"songs": `CREATE TABLE IF NOT EXISTS songs (
+            id bigint PRIMARY KEY, title text, artist text, ytID text, key text,
+            album text, durationMs bigint, releaseYear int, genre text, coverArtURL text,
+            ingestedAtMs bigint)`,
+		"songs_by_key": `CREATE TABLE IF NOT EXISTS songs_by_key (
+            key text PRIMARY KEY, id bigint)`,
+		"songs_by_ytid": `CREATE TABLE IF NOT EXISTS songs_by_ytid (
+            ytID text PRIMARY KEY, id bigint)`,
+		"fingerprints": `CREATE TABLE IF NOT EXISTS fingerprints (
+            address bigint, songID bigint, anchorTimeMs bigint, peak int,
+            PRIMARY KEY ((address), songID, anchorTimeMs))`,
+		"song_fingerprints": `CREATE TABLE IF NOT EXISTS song_fingerprints (
+            songID bigint, address bigint, anchorTimeMs bigint,
+            PRIMARY KEY ((songID), address, anchorTimeMs))`,
+		"records": `CREATE TABLE IF NOT EXISTS records (
+            collection text, id text, clientID text, createdAt bigint, data text,
+            PRIMARY KEY ((collection), id))`,
+	}
+
+	for table, query := range tables {
+		if err := session.Query(query).Exec(); err != nil {
+			return fmt.Errorf("error creating %s table: %s", table, err)
+		}
+	}
+
+	// Catalogs created before couples carried peak details lack the column
+	metadata, err := session.KeyspaceMetadata(keyspace)
+	if err != nil {
+		return fmt.Errorf("error reading keyspace metadata: %s", err)
+	}
+	if table, ok := metadata.Tables["fingerprints"]; ok {
+		if _, ok := table.Columns["peak"]; !ok {
+			if err := session.Query("ALTER TABLE fingerprints ADD peak int").Exec(); err != nil {
+				return fmt.Errorf("error upgrading fingerprints table: %s", err)
+			}
+		}
+	}
+	// Or, before songs carried their details, the columns holding them
+	if table, ok := metadata.Tables["songs"]; ok {
+		for _, column := range []struct{ name, definition string }{
+			{"album", "text"},
+			{"durationMs", "bigint"},
+			{"releaseYear", "int"},
+			{"genre", "text"},
+			{"coverArtURL", "text"},
+			{"ingestedAtMs", "bigint"},
+		} {
+			if _, ok := table.Columns[strings.ToLower(column.name)]; ok {
+				continue
+			}
+			if err := session.Query("ALTER TABLE songs ADD " + column.name + " " + column.definition).Exec(); err != nil {
+				return fmt.Errorf("error upgrading songs table: %s", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (db *CassandraClient) withContext(ctx context.Context) DBClient {
+	bound := *db
+	bound.ctx = ctx
+	return &bound
+}
+
+// query prepares a statement to run under ctx.
+func (db *CassandraClient) query(ctx context.Context, stmt string, values ...interface{}) *gocql.Query {
+	return db.session.Query(stmt, values...).WithContext(ctx)
+}
+
+func (db *CassandraClient) Close() error {
+	if db.session != nil {
+		db.session.Close()
+	}
+	return nil
+}
+
+// StoreFingerprints writes couples concurrently. Writes are idempotent, so a
+// failed call can simply be retried.
+func (db *CassandraClient) StoreFingerprints(fingerprints map[uint32]models.Couple) error {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	type row struct {
+		address uint32
+		couple  models.Couple
+	}
+
+	rows := make(chan row)
+	errs := make(chan error, cassandraWriters)
+	var wg sync.WaitGroup
+
+	for w := 0; w < cassandraWriters; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for r := range rows {
+				address, songID, anchorTime := int64(r.address), int64(r.couple.SongID), int64(r.couple.AnchorTimeMs)
+				peak := int(r.couple.PeakCode())
+
+				err := db.query(ctx,
+					"INSERT INTO fingerprints (address, songID, anchorTimeMs, peak) VALUES (?, ?, ?, ?)",
+					address, songID, anchorTime, peak,
+				).Exec()
+				if err == nil {
+					err = db.query(ctx,
+						"INSERT INTO song_fingerprints (songID, address, anchorTimeMs) VALUES (?, ?, ?)",
+						songID, address, anchorTime,
+					).Exec()
+				}
+				if err != nil {
+					errs <- err
+					// Keep draining so the producer doesn't block
+					for range rows {
+					}
+					return
+				}
+			}
+		}()
+	}
+
+	for address, couple := range fingerprints {
+		rows <- row{address, couple}
+	}
+	close(rows)
+	wg.Wait()
+	close(errs)
+
+	if err := <-errs; err != nil {
+		return fmt.Errorf("error inserting fingerprints: %w", err)
+	}
+	return nil
+}
+
+func (db *CassandraClient) GetCouples(addresses []uint32) (map[uint32][]models.Couple, error) {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	couples := make(map[uint32][]models.Couple)
+
+	for _, address := range addresses {
+		iter := db.query(ctx, "SELECT songID, anchorTimeMs, peak FROM fingerprints WHERE address = ?", int64(address)).Iter()
+
+		var songID, anchorTime int64
+		var peak int
+		for iter.Scan(&songID, &anchorTime, &peak) {
+			couple := models.Couple{AnchorTimeMs: uint32(anchorTime), SongID: models.SongID(songID)}
+			couple.SetPeakCode(uint16(peak))
+			couples[address] = append(couples[address], couple)
+		}
+		if err := iter.Close(); err != nil {
+			return nil, fmt.Errorf("error querying database: %w", err)
+		}
+	}
+
+	return couples, nil
+}
+
+func (db *CassandraClient) TotalSongs() (int, error) {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	var count int64
+	err := db.query(ctx, "SELECT COUNT(*) FROM songs").Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("error counting songs: %s", err)
+	}
+	return int(count), nil
+}
+
+// RegisterSong claims the song's key (and YouTube ID) with lightweight
+// transactions, which stand in for unique constraints.
+func (db *CassandraClient) RegisterSong(songTitle, songArtist, ytID string) (models.SongID, error) {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	songID := models.NewSongID()
+	songKey := utils.GenerateSongKey(songTitle, songArtist)
+
+	applied, err := db.query(ctx,
+		"INSERT INTO songs_by_key (key, id) VALUES (?, ?) IF NOT EXISTS", songKey, int64(songID),
+	).MapScanCAS(map[string]interface{}{})
+	if err != nil {
+		return 0, fmt.Errorf("failed to register song: %v", err)
+	}
+	if !applied {
+		return 0, fmt.Errorf("song with ytID or key already exists: %s", songKey)
+	}
+
+	if ytID != "" {
+		applied, err = db.query(ctx,
+			"INSERT INTO songs_by_ytid (ytID, id) VALUES (?, ?) IF NOT EXISTS", ytID, int64(songID),
+		).MapScanCAS(map[string]interface{}{})
+		if err != nil || !applied {
+			db.query(ctx, "DELETE FROM songs_by_key WHERE key = ?", songKey).Exec()
+			if err != nil {
+				return 0, fmt.Errorf("failed to register song: %v", err)
+			}
+			return 0, fmt.Errorf("song with ytID or key already exists: %s", ytID)
+		}
+	}
+
+	err = db.query(ctx,
+		"INSERT INTO songs (id, title, artist, ytID, key, ingestedAtMs) VALUES (?, ?, ?, ?, ?, ?)",
+		int64(songID), songTitle, songArtist, ytID, songKey, ingestionTime(),
+	).Exec()
+	if err != nil {
+		return 0, fmt.Errorf("failed to register song: %v", err)
+	}
+
+	return songID, nil
+}
+
+func (db *CassandraClient) GetSong(filterKey string, value interface{}) (Song, bool, error) {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	var lookup string
+	switch filterKey {
+	case "id":
+		if id, ok := value.(models.SongID); ok {
+			value = int64(id)
+		}
+	case "key":
+		lookup = "SELECT id FROM songs_by_key WHERE key = ?"
+	case "ytID":
+		lookup = "SELECT id FROM songs_by_ytid WHERE ytID = ?"
+	default:
+		return Song{}, false, fmt.Errorf("invalid filter key")
+	}
+
+	if lookup != "" {
+		var id int64
+		if err := db.query(ctx, lookup, value).Scan(&id); err != nil {
+			if err == gocql.ErrNotFound {
+				return Song{}, false, nil
+			}
+			return Song{}, false, fmt.Errorf("failed to retrieve song: %s", err)
+		}
+		value = id
+	}
+
+	var song Song
+	err := db.query(ctx, "SELECT title, artist, ytID, "+songDetailColumns+" FROM songs WHERE id = ?", value).
+		Scan(append([]interface{}{&song.Title, &song.Artist, &song.YouTubeID}, songDetailsDest(&song)...)...)
+	if err != nil {
+		if err == gocql.ErrNotFound {
+			return Song{}, false, nil
+		}
+		return Song{}, false, fmt.Errorf("failed to retrieve song: %s", err)
+	}
+
+	return song, true, nil
+}
+
+func (db *CassandraClient) GetSongByID(songID models.SongID) (Song, bool, error) {
+	return db.GetSong("id", songID)
+}
+
+func (db *CassandraClient) GetSongByYTID(ytID string) (Song, bool, error) {
+	return db.GetSong("ytID", ytID)
+}
+
+func (db *CassandraClient) GetSongByKey(key string) (Song, bool, error) {
+	return db.GetSong("key", key)
+}
+
+func (db *CassandraClient) DeleteSongByID(songID models.SongID) error {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	var ytID, key string
+	err := db.query(ctx, "SELECT ytID, key FROM songs WHERE id = ?", int64(songID)).Scan(&ytID, &key)
+	if err != nil {
+		if err == gocql.ErrNotFound {
+			return nil
+		}
+		return fmt.Errorf("failed to delete song: %v", err)
+	}
+
+	queries := []*gocql.Query{
+		db.query(ctx, "DELETE FROM songs WHERE id = ?", int64(songID)),
+		db.query(ctx, "DELETE FROM songs_by_key WHERE key = ?", key),
+	}
+	if ytID != "" {
+		queries = append(queries, db.query(ctx, "DELETE FROM songs_by_ytid WHERE ytID = ?", ytID))
+	}
+	for _, query := range queries {
+		if err := query.Exec(); err != nil {
+			return fmt.Errorf("failed to delete song: %v", err)
+		}
+	}
+
+	return nil
+}
+
+func (db *CassandraClient) DeleteCollection(collectionName string) error {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	tables := []string{collectionName}
+	switch collectionName {
+	case "songs":
+		tables = append(tables, "songs_by_key", "songs_by_ytid")
+	case "fingerprints":
+		tables = append(tables, "song_fingerprints")
+	}
+
+	for _, table := range tables {
+		err := db.query(ctx, "DROP TABLE IF EXISTS "+strings.ReplaceAll(table, `"`, "")).Exec()
+		if err != nil {
+			return fmt.Errorf("error deleting collection: %v", err)
+		}
+	}
+	return nil
+}
+
+// ForEachSong calls fn for every song, in token order
+func (db *CassandraClient) ForEachSong(fn func(songID models.SongID, song Song) error) error {
+	ctx := bulkContext(db.ctx)
+	iter := db.query(ctx, "SELECT id, title, artist, ytID, "+songDetailColumns+" FROM songs").Iter()
+
+	var songID int64
+	var song Song
+	for iter.Scan(append([]interface{}{&songID, &song.Title, &song.Artist, &song.YouTubeID}, songDetailsDest(&song)...)...) {
+		if err := fn(models.SongID(songID), song); err != nil {
+			iter.Close()
+			return err
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return fmt.Errorf("error querying songs: %s", err)
+	}
+	return nil
+}
+
+// ListSongs reads every song, since Cassandra can neither match parts of
+// artists nor order a table by other columns than its clustering ones.
+func (db *CassandraClient) ListSongs(offset, limit int, filter SongFilter) ([]ListedSong, error) {
+	return listSongs(db.ForEachSong, offset, limit, filter)
+}
+
+// ForEachFingerprint calls fn for every couple, in token order, which is
+// stable as long as the cluster's topology doesn't change.
+func (db *CassandraClient) ForEachFingerprint(fn func(address uint32, couple models.Couple) error) error {
+	ctx := bulkContext(db.ctx)
+	iter := db.query(ctx, "SELECT address, songID, anchorTimeMs, peak FROM fingerprints").Iter()
+
+	var address, songID, anchorTime int64
+	var peak int
+	for iter.Scan(&address, &songID, &anchorTime, &peak) {
+		couple := models.Couple{AnchorTimeMs: uint32(anchorTime), SongID: models.SongID(songID)}
+		couple.SetPeakCode(uint16(peak))
+		if err := fn(uint32(address), couple); err != nil {
+			iter.Close()
+			return err
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return fmt.Errorf("error querying fingerprints: %s", err)
+	}
+	return nil
+}
+
+func (db *CassandraClient) StoreSong(songID models.SongID, song Song) error {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	if err := db.DeleteSongByID(songID); err != nil {
+		return fmt.Errorf("failed to store song: %v", err)
+	}
+
+	songKey := utils.GenerateSongKey(song.Title, song.Artist)
+	queries := []*gocql.Query{
+		db.query(ctx, "INSERT INTO songs_by_key (key, id) VALUES (?, ?)", songKey, int64(songID)),
+		db.query(ctx,
+			"INSERT INTO songs (id, title, artist, ytID, key, "+songDetailColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			append([]interface{}{int64(songID), song.Title, song.Artist, song.YouTubeID, songKey}, songDetails(song)...)...,
+		),
+	}
+	if song.YouTubeID != "" {
+		queries = append(queries, db.query(ctx, "INSERT INTO songs_by_ytid (ytID, id) VALUES (?, ?)", song.YouTubeID, int64(songID)))
+	}
+	for _, query := range queries {
+		if err := query.Exec(); err != nil {
+			return fmt.Errorf("failed to store song: %v", err)
+		}
+	}
+	return nil
+}
+
+func (db *CassandraClient) FingerprintSongIDs() ([]models.SongID, error) {
+	ctx := bulkContext(db.ctx)
+	iter := db.query(ctx, "SELECT DISTINCT songID FROM song_fingerprints").Iter()
+
+	var songIDs []models.SongID
+	var songID int64
+	for iter.Scan(&songID) {
+		songIDs = append(songIDs, models.SongID(songID))
+	}
+	if err := iter.Close(); err != nil {
+		return nil, fmt.Errorf("error querying song IDs: %s", err)
+	}
+
+	return songIDs, nil
+}
+
+func (db *CassandraClient) DeleteFingerprintsBySongID(songID models.SongID) error {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	iter := db.query(ctx, "SELECT address, anchorTimeMs FROM song_fingerprints WHERE songID = ?", int64(songID)).Iter()
+
+	var address, anchorTime int64
+	for iter.Scan(&address, &anchorTime) {
+		err := db.query(ctx,
+			"DELETE FROM fingerprints WHERE address = ? AND songID = ? AND anchorTimeMs = ?",
+			address, int64(songID), anchorTime,
+		).Exec()
+		if err != nil {
+			iter.Close()
+			return fmt.Errorf("failed to delete fingerprints: %v", err)
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return fmt.Errorf("failed to delete fingerprints: %v", err)
+	}
+
+	err := db.query(ctx, "DELETE FROM song_fingerprints WHERE songID = ?", int64(songID)).Exec()
+	if err != nil {
+		return fmt.Errorf("failed to delete fingerprints: %v", err)
+	}
+	return nil
+}
+
+// Compact is a no-op: Cassandra compacts SSTables in the background and
+// manual compactions are run with nodetool.
+func (db *CassandraClient) Compact() error {
+	return nil
+}
+
+// Snapshot dumps the songs and fingerprints tables into a gzipped file of
+// JSON lines, one row per line.
+func (db *CassandraClient) Snapshot(dir string) (string, error) {
+	ctx := bulkContext(db.ctx)
+	return writeJSONSnapshot(dir, func(emit func(table string, row interface{}) error) error {
+		iter := db.query(ctx, "SELECT id, title, artist, ytID, key, "+songDetailColumns+" FROM songs").Iter()
+		var id int64
+		var song Song
+		var key string
+		for iter.Scan(append([]interface{}{&id, &song.Title, &song.Artist, &song.YouTubeID, &key}, songDetailsDest(&song)...)...) {
+			if err := emit("songs", snapshotSong(id, song, key)); err != nil {
+				iter.Close()
+				return err
+			}
+		}
+		if err := iter.Close(); err != nil {
+			return fmt.Errorf("failed to read songs: %v", err)
+		}
+
+		iter = db.query(ctx, "SELECT address, songID, anchorTimeMs, peak FROM fingerprints").Iter()
+		var address, songID, anchorTime int64
+		var peak int
+		for iter.Scan(&address, &songID, &anchorTime, &peak) {
+			row := map[string]interface{}{"address": address, "anchorTimeMs": anchorTime, "songID": songID, "peak": peak}
+			if err := emit("fingerprints", row); err != nil {
+				iter.Close()
+				return err
+			}
+		}
+		if err := iter.Close(); err != nil {
+			return fmt.Errorf("failed to read fingerprints: %v", err)
+		}
+		return nil
+	})
+}
+
+func (db *CassandraClient) PutRecord(collection string, record Record) error {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	err := db.query(ctx,
+		"INSERT INTO records (collection, id, clientID, createdAt, data) VALUES (?, ?, ?, ?, ?)",
+		collection, record.ID, record.ClientID, record.CreatedAt.UnixNano(), string(record.Data),
+	).Exec()
+	if err != nil {
+		return fmt.Errorf("failed to store record: %v", err)
+	}
+	return nil
+}
+
+func (db *CassandraClient) GetRecord(collection, id string) (Record, bool, error) {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	record, err := scanRecord(cassandraRow{db.query(ctx,
+		"SELECT id, clientID, createdAt, data FROM records WHERE collection = ? AND id = ?",
+		collection, id,
+	)})
+	if err != nil {
+		if err == gocql.ErrNotFound {
+			return Record{}, false, nil
+		}
+		return Record{}, false, fmt.Errorf("failed to retrieve record: %v", err)
+	}
+
+	return record, true, nil
+}
+
+// ListRecords reads the collection's partition and filters and sorts it
+// client side, since records are only clustered by ID.
+func (db *CassandraClient) ListRecords(collection string, filter RecordFilter) ([]Record, error) {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	iter := db.query(ctx, "SELECT id, clientID, createdAt, data FROM records WHERE collection = ?", collection).Iter()
+
+	var records []Record
+	var record Record
+	var createdAt int64
+	var data string
+	for iter.Scan(&record.ID, &record.ClientID, &createdAt, &data) {
+		record.CreatedAt = time.Unix(0, createdAt).UTC()
+		record.Data = []byte(data)
+
+		if filter.ClientID != "" && record.ClientID != filter.ClientID {
+			continue
+		}
+		if !filter.Since.IsZero() && record.CreatedAt.Before(filter.Since) {
+			continue
+		}
+		if !filter.Until.IsZero() && !record.CreatedAt.Before(filter.Until) {
+			continue
+		}
+		records = append(records, record)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, fmt.Errorf("failed to list records: %v", err)
+	}
+
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].CreatedAt.Before(records[j].CreatedAt)
+	})
+	if filter.Limit > 0 && len(records) > filter.Limit {
+		records = records[:filter.Limit]
+	}
+
+	return records, nil
+}
+
+func (db *CassandraClient) DeleteRecord(collection, id string) error {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	err := db.query(ctx, "DELETE FROM records WHERE collection = ? AND id = ?", collection, id).Exec()
+	if err != nil {
+		return fmt.Errorf("failed to delete record: %v", err)
+	}
+	return nil
+}
+
+// cassandraRow adapts a query to the Scan signature used by scanRecord.
+type cassandraRow struct {
+	query *gocql.Query
+}
+
+func (r cassandraRow) Scan(dest ...interface{}) error {
+	return r.query.Scan(dest...)
+}
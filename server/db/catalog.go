@@ -0,0 +1,122 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"song-recognition/models"
+	"time"
+)
+
+const (
+	catalogCollection = "catalog"
+	catalogVersionID  = "version"
+)
+
+// CatalogVersion counts the changes made to the songs and fingerprints of a
+// catalog. It is stored with the catalog, so replicas report the version
+// they have caught up to.
+type CatalogVersion struct {
+	Version   int64     `json:"version"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// ReadCatalogVersion returns the version of the catalog of a client, zero
+// for catalogs never changed since versions were introduced.
+func ReadCatalogVersion(client DBClient) (CatalogVersion, error) {
+	var version CatalogVersion
+	record, exists, err := client.GetRecord(catalogCollection, catalogVersionID)
+	if err != nil || !exists {
+		return version, err
+	}
+	if err := json.Unmarshal(record.Data, &version); err != nil {
+		return version, fmt.Errorf("failed to unmarshal catalog version: %v", err)
+	}
+	return version, nil
+}
+
+// versionedClient wraps a DBClient, bumping the catalog version after every
+// change to songs or fingerprints.
+type versionedClient struct {
+	DBClient
+}
+
+// withCatalogVersion wraps a client so that it keeps the catalog version.
+func withCatalogVersion(client DBClient) DBClient {
+	return &versionedClient{DBClient: client}
+}
+
+func (v *versionedClient) withContext(ctx context.Context) DBClient {
+	return &versionedClient{DBClient: WithContext(ctx, v.DBClient)}
+}
+
+// bump increments the catalog version. Concurrent changes may be counted
+// once, but the version always moves on after a change is stored.
+func (v *versionedClient) bump() error {
+	version, err := ReadCatalogVersion(v.DBClient)
+	if err != nil {
+		return err
+	}
+	version.Version++
+	version.UpdatedAt = time.Now().UTC()
+
+	data, err := json.Marshal(version)
+	if err != nil {
+		return fmt.Errorf("failed to marshal catalog version: %v", err)
+	}
+	err = v.DBClient.PutRecord(catalogCollection, Record{
+		ID:        catalogVersionID,
+		CreatedAt: version.UpdatedAt,
+		Data:      data,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update catalog version: %v", err)
+	}
+	return nil
+}
+
+func (v *versionedClient) StoreFingerprints(fingerprints map[uint32]models.Couple) error {
+	if err := v.DBClient.StoreFingerprints(fingerprints); err != nil {
+		return err
+	}
+	return v.bump()
+}
+
+func (v *versionedClient) RegisterSong(songTitle, songArtist, ytID string) (models.SongID, error) {
+	songID, err := v.DBClient.RegisterSong(songTitle, songArtist, ytID)
+	if err != nil {
+		return songID, err
+	}
+	return songID, v.bump()
+}
+
+func (v *versionedClient) DeleteSongByID(songID models.SongID) error {
+	if err := v.DBClient.DeleteSongByID(songID); err != nil {
+		return err
+	}
+	return v.bump()
+}
+
+func (v *versionedClient) DeleteCollection(collectionName string) error {
+	if err := v.DBClient.DeleteCollection(collectionName); err != nil {
+		return err
+	}
+	if collectionName == catalogCollection {
+		return nil
+	}
+	return v.bump()
+}
+
+func (v *versionedClient) StoreSong(songID models.SongID, song Song) error {
+	if err := v.DBClient.StoreSong(songID, song); err != nil {
+		return err
+	}
+	return v.bump()
+}
+
+func (v *versionedClient) DeleteFingerprintsBySongID(songID models.SongID) error {
+	if err := v.DBClient.DeleteFingerprintsBySongID(songID); err != nil {
+		return err
+	}
+	return v.bump()
+}
@@ -0,0 +1,156 @@
+package db
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"song-recognition/models"
+	"time"
+)
+
+const checksumsCollection = "fingerprint_checksums"
+
+// FingerprintChecksum sums up the couples of a song, so that two catalogs
+// can be checked to hold the same fingerprints for it without reading them.
+// It doesn't depend on the order couples are stored or read in.
+type FingerprintChecksum struct {
+	Couples int64 `json:"couples"`
+	// Sum is the wrapping sum of a 64-bit hash of the address, anchor time
+	// and peak details of every couple.
+	Sum uint64 `json:"sum,string"`
+}
+
+// Add counts a couple of the song stored at address.
+func (c *FingerprintChecksum) Add(address uint32, couple models.Couple) {
+	var buf [10]byte
+	binary.BigEndian.PutUint32(buf[0:], address)
+	binary.BigEndian.PutUint32(buf[4:], couple.AnchorTimeMs)
+	binary.BigEndian.PutUint16(buf[8:], couple.PeakCode())
+	h := fnv.New64a()
+	h.Write(buf[:])
+	c.Couples++
+	c.Sum += h.Sum64()
+}
+
+// Merge counts the couples of other too.
+func (c *FingerprintChecksum) Merge(other FingerprintChecksum) {
+	c.Couples += other.Couples
+	c.Sum += other.Sum
+}
+
+func (c FingerprintChecksum) String() string {
+	return fmt.Sprintf("%d:%016x", c.Couples, c.Sum)
+}
+
+// ChecksumFingerprints returns the checksums of the couples of each song in
+// fingerprints.
+func ChecksumFingerprints(fingerprints map[uint32]models.Couple) map[models.SongID]FingerprintChecksum {
+	checksums := make(map[models.SongID]FingerprintChecksum)
+	for address, couple := range fingerprints {
+		checksum := checksums[couple.SongID]
+		checksum.Add(address, couple)
+		checksums[couple.SongID] = checksum
+	}
+	return checksums
+}
+
+// ScanFingerprintChecksums reads every fingerprint of a catalog and returns
+// the checksums of the couples of each song, including songs the catalog
+// doesn't have.
+func ScanFingerprintChecksums(client DBClient) (map[models.SongID]FingerprintChecksum, error) {
+	checksums := make(map[models.SongID]FingerprintChecksum)
+	err := client.ForEachFingerprint(func(address uint32, couple models.Couple) error {
+		checksum := checksums[couple.SongID]
+		checksum.Add(address, couple)
+		checksums[couple.SongID] = checksum
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read fingerprints: %v", err)
+	}
+	return checksums, nil
+}
+
+// RecordFingerprintChecksum records the checksum of the couples a song has
+// in the catalog, once they are all stored.
+func RecordFingerprintChecksum(client DBClient, songID models.SongID, checksum FingerprintChecksum) error {
+	data, err := json.Marshal(checksum)
+	if err != nil {
+		return fmt.Errorf("failed to marshal fingerprint checksum: %v", err)
+	}
+	return client.PutRecord(checksumsCollection, Record{
+		ID:        fmt.Sprint(songID),
+		CreatedAt: time.Now().UTC(),
+		Data:      data,
+	})
+}
+
+// ReadFingerprintChecksum returns the checksum recorded for a song. Songs
+// indexed before checksums were recorded, or whose fingerprints were
+// changed without recording it again, have none.
+func ReadFingerprintChecksum(client DBClient, songID models.SongID) (FingerprintChecksum, bool, error) {
+	var checksum FingerprintChecksum
+	record, exists, err := client.GetRecord(checksumsCollection, fmt.Sprint(songID))
+	if err != nil || !exists {
+		return checksum, false, err
+	}
+	if err := json.Unmarshal(record.Data, &checksum); err != nil {
+		return checksum, false, fmt.Errorf("failed to unmarshal fingerprint checksum of song %d: %v", songID, err)
+	}
+	return checksum, true, nil
+}
+
+// ReadFingerprintChecksums returns every checksum recorded in a catalog,
+// keyed by song ID.
+func ReadFingerprintChecksums(client DBClient) (map[models.SongID]FingerprintChecksum, error) {
+	records, err := client.ListRecords(checksumsCollection, RecordFilter{})
+	if err != nil {
+		return nil, err
+	}
+	checksums := make(map[models.SongID]FingerprintChecksum, len(records))
+	for _, record := range records {
+		var songID models.SongID
+		if _, err := fmt.Sscan(record.ID, &songID); err != nil {
+			return nil, fmt.Errorf("invalid fingerprint checksum ID %q", record.ID)
+		}
+		var checksum FingerprintChecksum
+		if err := json.Unmarshal(record.Data, &checksum); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal fingerprint checksum of song %d: %v", songID, err)
+		}
+		checksums[songID] = checksum
+	}
+	return checksums, nil
+}
+
+// RecordFingerprintChecksums records the checksums of every song of a
+// catalog, taken from checksums, such as those ScanFingerprintChecksums
+// returns. Songs missing from checksums have no fingerprints. It returns the
+// number of checksums recorded.
+func RecordFingerprintChecksums(client DBClient, checksums map[models.SongID]FingerprintChecksum) (int, error) {
+	var songIDs []models.SongID
+	err := client.ForEachSong(func(songID models.SongID, _ Song) error {
+		songIDs = append(songIDs, songID)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for i, songID := range songIDs {
+		if err := RecordFingerprintChecksum(client, songID, checksums[songID]); err != nil {
+			return i, err
+		}
+	}
+	return len(songIDs), nil
+}
+
+// RefreshFingerprintChecksums reads every fingerprint of a catalog to record
+// the checksums of all its songs again, such as after a catalog was
+// imported. It returns the number of checksums recorded.
+func RefreshFingerprintChecksums(client DBClient) (int, error) {
+	checksums, err := ScanFingerprintChecksums(client)
+	if err != nil {
+		return 0, err
+	}
+	return RecordFingerprintChecksums(client, checksums)
+}
@@ -0,0 +1,58 @@
+package db_test
+
+import (
+	"song-recognition/db"
+	"song-recognition/models"
+	"testing"
+)
+
+func TestFingerprintChecksums(t *testing.T) {
+	memory := newMemory(t)
+	sqlite := newSQLite(t)
+
+	first := map[uint32]models.Couple{1: {AnchorTimeMs: 10, SongID: 1}, 2: {AnchorTimeMs: 20, SongID: 1}}
+	second := map[uint32]models.Couple{3: {AnchorTimeMs: 30, SongID: 1, Band: 2, Magnitude: 9}, 4: {AnchorTimeMs: 5, SongID: 2}}
+	for _, client := range []db.DBClient{memory, sqlite} {
+		storeSongs(t, client, 1, 2)
+		for _, fingerprints := range []map[uint32]models.Couple{first, second} {
+			if err := client.StoreFingerprints(fingerprints); err != nil {
+				t.Fatalf("StoreFingerprints: %v", err)
+			}
+		}
+	}
+
+	// Checksums don't depend on the backend or on how couples were stored
+	want := db.ChecksumFingerprints(first)[1]
+	want.Merge(db.ChecksumFingerprints(second)[1])
+	for _, client := range []db.DBClient{memory, sqlite} {
+		checksums, err := db.ScanFingerprintChecksums(client)
+		if err != nil {
+			t.Fatalf("ScanFingerprintChecksums: %v", err)
+		}
+		if checksums[1] != want || checksums[1].Couples != 3 {
+			t.Errorf("checksum of song 1 = %v; want %v over 3 couples", checksums[1], want)
+		}
+	}
+	other := db.ChecksumFingerprints(map[uint32]models.Couple{3: {AnchorTimeMs: 30, SongID: 1}})[1]
+	if other == db.ChecksumFingerprints(map[uint32]models.Couple{3: second[3]})[1] {
+		t.Error("checksums ignore the peak details of couples")
+	}
+
+	if recorded, err := db.RefreshFingerprintChecksums(memory); err != nil || recorded != 2 {
+		t.Fatalf("RefreshFingerprintChecksums = %d, %v; want 2 songs", recorded, err)
+	}
+	if got, ok, err := db.ReadFingerprintChecksum(memory, 1); err != nil || !ok || got != want {
+		t.Errorf("ReadFingerprintChecksum = %v, %v, %v; want %v", got, ok, err, want)
+	}
+	// Deleting fingerprints forgets their checksum
+	if err := memory.DeleteFingerprintsBySongID(1); err != nil {
+		t.Fatalf("DeleteFingerprintsBySongID: %v", err)
+	}
+	checksums, err := db.ReadFingerprintChecksums(memory)
+	if err != nil {
+		t.Fatalf("ReadFingerprintChecksums: %v", err)
+	}
+	if _, ok := checksums[1]; ok || len(checksums) != 1 {
+		t.Errorf("ReadFingerprintChecksums = %v after deleting the fingerprints of song 1; want song 2 only", checksums)
+	}
+}
@@ -0,0 +1,601 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"song-recognition/models"
+	"song-recognition/utils"
+	"strings"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+)
+
+// clickhouseLookupBatch is the number of addresses per IN lookup. ClickHouse
+// handles large IN sets well, so lookups are few and vectorised.
+const clickhouseLookupBatch = 10000
+
+// ClickHouseClient stores the catalog in ClickHouse. Fingerprints are append
+// only and sorted by address, so lookups scan contiguous address ranges.
+// Couples stored twice are merged away eventually and skipped by lookups.
+// ClickHouse has no unique constraints; RegisterSong checks for existing
+// songs first and concurrent registrations of the same song can race.
+type ClickHouseClient struct {
+	db  *sql.DB
+	ctx context.Context // see WithContext
+}
+
+func NewClickHouseClient(addr, database, username, password string) (*ClickHouseClient, error) {
+	db := clickhouse.OpenDB(&clickhouse.Options{
+		Addr: []string{addr},
+		Auth: clickhouse.Auth{
+			Database: database,
+			Username: username,
+			Password: password,
+		},
+	})
+
+	err := createClickHouseTables(db)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error creating tables: %s", err)
+	}
+
+	return &ClickHouseClient{db: db}, nil
+}
+
+func createClickHouseTables(db *sql.DB) error {
+	createSongsTable := `
+    CREATE TABLE IF NOT EXISTS songs (
+        id UInt32,
+        title String,
+        artist String,
+        ytID String,
+        key String,
+        album String DEFAULT '',
+        durationMs Int64 DEFAULT 0,
+        releaseYear UInt16 DEFAULT 0,
+        genre String DEFAULT '',
+        coverArtURL String DEFAULT '',
+        ingestedAtMs Int64 DEFAULT 0
+    ) ENGINE = MergeTree ORDER BY id
+    `
+
+	createFingerprintsTable := `
+    CREATE TABLE IF NOT EXISTS fingerprints (
+        address UInt32,
+        songID UInt32,
+        anchorTimeMs UInt32,
+        peak UInt16 DEFAULT 0
+    ) ENGINE = ReplacingMergeTree ORDER BY (address, songID, anchorTimeMs)
+    `
+
+	// Records are replaced by inserting a newer version
+	createRecordsTable := `
+    CREATE TABLE IF NOT EXISTS records (
+        collection String,
+        id String,
+        clientID String,
+        createdAt Int64,
+        data String,
+        version Int64
+    ) ENGINE = ReplacingMergeTree(version) ORDER BY (collection, id)
+    `
+
+	for table, query := range map[string]string{
+		"songs":        createSongsTable,
+		"fingerprints": createFingerprintsTable,
+		"records":      createRecordsTable,
+	} {
+		if _, err := db.Exec(query); err != nil {
+			return fmt.Errorf("error creating %s table: %s", table, err)
+		}
+	}
+
+	// Catalogs created before couples carried peak details lack the column
+	if _, err := db.Exec("ALTER TABLE fingerprints ADD COLUMN IF NOT EXISTS peak UInt16 DEFAULT 0"); err != nil {
+		return fmt.Errorf("error upgrading fingerprints table: %s", err)
+	}
+
+	// Catalogs created before songs carried their details lack the columns
+	_, err := db.Exec("ALTER TABLE songs" +
+		" ADD COLUMN IF NOT EXISTS album String DEFAULT ''," +
+		" ADD COLUMN IF NOT EXISTS durationMs Int64 DEFAULT 0," +
+		" ADD COLUMN IF NOT EXISTS releaseYear UInt16 DEFAULT 0," +
+		" ADD COLUMN IF NOT EXISTS genre String DEFAULT ''," +
+		" ADD COLUMN IF NOT EXISTS coverArtURL String DEFAULT ''," +
+		" ADD COLUMN IF NOT EXISTS ingestedAtMs Int64 DEFAULT 0")
+	if err != nil {
+		return fmt.Errorf("error upgrading songs table: %s", err)
+	}
+
+	return nil
+}
+
+func (db *ClickHouseClient) withContext(ctx context.Context) DBClient {
+	bound := *db
+	bound.ctx = ctx
+	return &bound
+}
+
+func (db *ClickHouseClient) Close() error {
+	if db.db != nil {
+		return db.db.Close()
+	}
+	return nil
+}
+
+// StoreFingerprints sends all couples in a single block insert.
+func (db *ClickHouseClient) StoreFingerprints(fingerprints map[uint32]models.Couple) error {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	return storeClickHouseFingerprints(ctx, db.db, "fingerprints", fingerprints)
+}
+
+func storeClickHouseFingerprints(ctx context.Context, db *sql.DB, table string, fingerprints map[uint32]models.Couple) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error starting batch: %w", err)
+	}
+
+	stmt, err := tx.PrepareContext(ctx, "INSERT INTO "+table+" (address, songID, anchorTimeMs, peak)")
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("error preparing statement: %w", err)
+	}
+	defer stmt.Close()
+
+	for address, couple := range fingerprints {
+		if err := checkNarrowSongID(couple.SongID); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("error appending to batch: %w", err)
+		}
+		if _, err := stmt.ExecContext(ctx, address, uint32(couple.SongID), couple.AnchorTimeMs, couple.PeakCode()); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("error appending to batch: %w", err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (db *ClickHouseClient) GetCouples(addresses []uint32) (map[uint32][]models.Couple, error) {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	couples := make(map[uint32][]models.Couple)
+
+	for start := 0; start < len(addresses); start += clickhouseLookupBatch {
+		batch := addresses[start:min(start+clickhouseLookupBatch, len(addresses))]
+
+		// Until merged, a reindexed couple may have rows of both versions
+		rows, err := db.db.QueryContext(ctx, "SELECT address, songID, anchorTimeMs, max(peak) FROM fingerprints WHERE address IN (?) GROUP BY address, songID, anchorTimeMs", batch)
+		if err != nil {
+			return nil, fmt.Errorf("error querying database: %w", err)
+		}
+
+		for rows.Next() {
+			var address uint32
+			var couple models.Couple
+			var peak uint16
+			if err := rows.Scan(&address, &couple.SongID, &couple.AnchorTimeMs, &peak); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("error scanning row: %w", err)
+			}
+			couple.SetPeakCode(peak)
+			couples[address] = append(couples[address], couple)
+		}
+
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error reading rows: %w", err)
+		}
+	}
+
+	return couples, nil
+}
+
+func (db *ClickHouseClient) TotalSongs() (int, error) {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	var count uint64
+	err := db.db.QueryRowContext(ctx, "SELECT count() FROM songs").Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("error counting songs: %s", err)
+	}
+	return int(count), nil
+}
+
+func (db *ClickHouseClient) RegisterSong(songTitle, songArtist, ytID string) (models.SongID, error) {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	songKey := utils.GenerateSongKey(songTitle, songArtist)
+
+	var existing uint64
+	err := db.db.QueryRowContext(ctx, "SELECT count() FROM songs WHERE key = ? OR (ytID != '' AND ytID = ?)", songKey, ytID).Scan(&existing)
+	if err != nil {
+		return 0, fmt.Errorf("failed to register song: %v", err)
+	}
+	if existing > 0 {
+		return 0, fmt.Errorf("song with ytID or key already exists: %s", songKey)
+	}
+
+	songID := models.NewSongID()
+	_, err = db.db.ExecContext(ctx,
+		"INSERT INTO songs (id, title, artist, ytID, key, ingestedAtMs) VALUES (?, ?, ?, ?, ?, ?)",
+		uint32(songID), songTitle, songArtist, ytID, songKey, ingestionTime(),
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to register song: %v", err)
+	}
+
+	return songID, nil
+}
+
+var clickhouseFilterKeys = "id | ytID | key"
+
+func (db *ClickHouseClient) GetSong(filterKey string, value interface{}) (Song, bool, error) {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	if !strings.Contains(clickhouseFilterKeys, filterKey) {
+		return Song{}, false, fmt.Errorf("invalid filter key")
+	}
+
+	query := fmt.Sprintf("SELECT title, artist, ytID, %s FROM songs WHERE %s = ? LIMIT 1", songDetailColumns, filterKey)
+
+	var song Song
+	err := db.db.QueryRowContext(ctx, query, value).Scan(append([]interface{}{&song.Title, &song.Artist, &song.YouTubeID}, songDetailsDest(&song)...)...)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return Song{}, false, nil
+		}
+		return Song{}, false, fmt.Errorf("failed to retrieve song: %s", err)
+	}
+
+	return song, true, nil
+}
+
+func (db *ClickHouseClient) GetSongByID(songID models.SongID) (Song, bool, error) {
+	return db.GetSong("id", uint64(songID))
+}
+
+func (db *ClickHouseClient) GetSongByYTID(ytID string) (Song, bool, error) {
+	return db.GetSong("ytID", ytID)
+}
+
+func (db *ClickHouseClient) GetSongByKey(key string) (Song, bool, error) {
+	return db.GetSong("key", key)
+}
+
+// DeleteSongByID uses a lightweight delete, which hides the rows right away
+// and removes them on the next merge.
+func (db *ClickHouseClient) DeleteSongByID(songID models.SongID) error {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	_, err := db.db.ExecContext(ctx, "DELETE FROM songs WHERE id = ?", uint64(songID))
+	if err != nil {
+		return fmt.Errorf("failed to delete song: %v", err)
+	}
+	return nil
+}
+
+func (db *ClickHouseClient) DeleteCollection(collectionName string) error {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	_, err := db.db.ExecContext(ctx, fmt.Sprintf("DROP TABLE IF EXISTS `%s`", strings.ReplaceAll(collectionName, "`", "")))
+	if err != nil {
+		return fmt.Errorf("error deleting collection: %v", err)
+	}
+	return nil
+}
+
+func (db *ClickHouseClient) ForEachSong(fn func(songID models.SongID, song Song) error) error {
+	ctx := bulkContext(db.ctx)
+	rows, err := db.db.QueryContext(ctx, "SELECT id, title, artist, ytID, "+songDetailColumns+" FROM songs ORDER BY id")
+	if err != nil {
+		return fmt.Errorf("error querying songs: %s", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var songID models.SongID
+		var song Song
+		if err := rows.Scan(append([]interface{}{&songID, &song.Title, &song.Artist, &song.YouTubeID}, songDetailsDest(&song)...)...); err != nil {
+			return fmt.Errorf("error scanning row: %s", err)
+		}
+		if err := fn(songID, song); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+func (db *ClickHouseClient) ListSongs(offset, limit int, filter SongFilter) ([]ListedSong, error) {
+	if err := checkSongList(offset, limit, filter); err != nil {
+		return nil, err
+	}
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	query := "SELECT id, title, artist, ytID, " + songDetailColumns + " FROM songs"
+	var args []interface{}
+	if filter.Artist != "" {
+		query += " WHERE positionCaseInsensitiveUTF8(artist, ?) > 0"
+		args = append(args, filter.Artist)
+	}
+	query += songListOrder(offset, limit, filter, "lowerUTF8", "ingestedAtMs")
+	return listSQLSongs(ctx, db.db, query, args...)
+}
+
+func (db *ClickHouseClient) ForEachFingerprint(fn func(address uint32, couple models.Couple) error) error {
+	ctx := bulkContext(db.ctx)
+	rows, err := db.db.QueryContext(ctx, "SELECT address, songID, anchorTimeMs, max(peak) FROM fingerprints GROUP BY address, songID, anchorTimeMs ORDER BY address, songID, anchorTimeMs")
+	if err != nil {
+		return fmt.Errorf("error querying fingerprints: %s", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var address uint32
+		var couple models.Couple
+		var peak uint16
+		if err := rows.Scan(&address, &couple.SongID, &couple.AnchorTimeMs, &peak); err != nil {
+			return fmt.Errorf("error scanning row: %s", err)
+		}
+		couple.SetPeakCode(peak)
+		if err := fn(address, couple); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+func (db *ClickHouseClient) StoreSong(songID models.SongID, song Song) error {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	if err := db.DeleteSongByID(songID); err != nil {
+		return fmt.Errorf("failed to store song: %v", err)
+	}
+
+	return insertClickHouseSong(ctx, db.db, "songs", songID, song)
+}
+
+func insertClickHouseSong(ctx context.Context, db *sql.DB, table string, songID models.SongID, song Song) error {
+	if err := checkNarrowSongID(songID); err != nil {
+		return fmt.Errorf("failed to store song: %v", err)
+	}
+	_, err := db.ExecContext(ctx,
+		"INSERT INTO "+table+" (id, title, artist, ytID, key, "+songDetailColumns+") VALUES "+placeholders(1, 11),
+		append([]interface{}{uint32(songID), song.Title, song.Artist, song.YouTubeID, utils.GenerateSongKey(song.Title, song.Artist)}, songDetails(song)...)...,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to store song: %v", err)
+	}
+	return nil
+}
+
+func (db *ClickHouseClient) FingerprintSongIDs() ([]models.SongID, error) {
+	ctx := bulkContext(db.ctx)
+	rows, err := db.db.QueryContext(ctx, "SELECT DISTINCT songID FROM fingerprints")
+	if err != nil {
+		return nil, fmt.Errorf("error querying song IDs: %s", err)
+	}
+	defer rows.Close()
+
+	var songIDs []models.SongID
+	for rows.Next() {
+		var songID models.SongID
+		if err := rows.Scan(&songID); err != nil {
+			return nil, fmt.Errorf("error scanning row: %s", err)
+		}
+		songIDs = append(songIDs, songID)
+	}
+
+	return songIDs, rows.Err()
+}
+
+func (db *ClickHouseClient) DeleteFingerprintsBySongID(songID models.SongID) error {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	_, err := db.db.ExecContext(ctx, "DELETE FROM fingerprints WHERE songID = ?", uint64(songID))
+	if err != nil {
+		return fmt.Errorf("failed to delete fingerprints: %v", err)
+	}
+	return nil
+}
+
+// Compact merges all parts, purging deleted rows and replaced records
+func (db *ClickHouseClient) Compact() error {
+	ctx := bulkContext(db.ctx)
+	for _, table := range []string{"songs", "fingerprints", "records"} {
+		if _, err := db.db.ExecContext(ctx, "OPTIMIZE TABLE "+table+" FINAL"); err != nil {
+			return fmt.Errorf("failed to optimize %s: %v", table, err)
+		}
+	}
+	return nil
+}
+
+// Snapshot dumps the songs and fingerprints tables into a gzipped file of
+// JSON lines, one row per line.
+func (db *ClickHouseClient) Snapshot(dir string) (string, error) {
+	ctx := bulkContext(db.ctx)
+	return writeJSONSnapshot(dir, func(emit func(table string, row interface{}) error) error {
+		rows, err := db.db.QueryContext(ctx, "SELECT id, title, artist, ytID, key, "+songDetailColumns+" FROM songs")
+		if err != nil {
+			return fmt.Errorf("failed to read songs: %v", err)
+		}
+		for rows.Next() {
+			var id uint32
+			var song Song
+			var key string
+			if err := rows.Scan(append([]interface{}{&id, &song.Title, &song.Artist, &song.YouTubeID, &key}, songDetailsDest(&song)...)...); err != nil {
+				rows.Close()
+				return fmt.Errorf("error scanning row: %s", err)
+			}
+			if err := emit("songs", snapshotSong(id, song, key)); err != nil {
+				rows.Close()
+				return err
+			}
+		}
+		rows.Close()
+
+		rows, err = db.db.QueryContext(ctx, "SELECT address, songID, anchorTimeMs, peak FROM fingerprints")
+		if err != nil {
+			return fmt.Errorf("failed to read fingerprints: %v", err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var address, songID, anchorTimeMs uint32
+			var peak uint16
+			if err := rows.Scan(&address, &songID, &anchorTimeMs, &peak); err != nil {
+				return fmt.Errorf("error scanning row: %s", err)
+			}
+			row := map[string]interface{}{"address": address, "anchorTimeMs": anchorTimeMs, "songID": songID, "peak": peak}
+			if err := emit("fingerprints", row); err != nil {
+				return err
+			}
+		}
+		return rows.Err()
+	})
+}
+
+func (db *ClickHouseClient) PutRecord(collection string, record Record) error {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	_, err := db.db.ExecContext(ctx,
+		"INSERT INTO records (collection, id, clientID, createdAt, data, version) VALUES (?, ?, ?, ?, ?, ?)",
+		collection, record.ID, record.ClientID, record.CreatedAt.UnixNano(), string(record.Data), time.Now().UnixNano(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to store record: %v", err)
+	}
+	return nil
+}
+
+func (db *ClickHouseClient) GetRecord(collection, id string) (Record, bool, error) {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	row := db.db.QueryRowContext(ctx,
+		"SELECT id, clientID, createdAt, data FROM records FINAL WHERE collection = ? AND id = ?",
+		collection, id,
+	)
+
+	record, err := scanRecord(row)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return Record{}, false, nil
+		}
+		return Record{}, false, fmt.Errorf("failed to retrieve record: %v", err)
+	}
+
+	return record, true, nil
+}
+
+func (db *ClickHouseClient) ListRecords(collection string, filter RecordFilter) ([]Record, error) {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	query := "SELECT id, clientID, createdAt, data FROM records FINAL WHERE collection = ?"
+	args := []interface{}{collection}
+
+	if filter.ClientID != "" {
+		query += " AND clientID = ?"
+		args = append(args, filter.ClientID)
+	}
+	if !filter.Since.IsZero() {
+		query += " AND createdAt >= ?"
+		args = append(args, filter.Since.UnixNano())
+	}
+	if !filter.Until.IsZero() {
+		query += " AND createdAt < ?"
+		args = append(args, filter.Until.UnixNano())
+	}
+	query += " ORDER BY createdAt"
+	if filter.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, filter.Limit)
+	}
+
+	rows, err := db.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list records: %v", err)
+	}
+	defer rows.Close()
+
+	var records []Record
+	for rows.Next() {
+		record, err := scanRecord(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning row: %s", err)
+		}
+		records = append(records, record)
+	}
+
+	return records, rows.Err()
+}
+
+func (db *ClickHouseClient) DeleteRecord(collection, id string) error {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	_, err := db.db.ExecContext(ctx, "DELETE FROM records WHERE collection = ? AND id = ?", collection, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete record: %v", err)
+	}
+	return nil
+}
+
+// clickhouseStaging loads a catalog into shadow tables of the same database.
+type clickhouseStaging struct {
+	db *sql.DB
+}
+
+func (db *ClickHouseClient) stageCatalog() (StagedCatalog, error) {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	for _, query := range []string{
+		"DROP TABLE IF EXISTS " + stagedSongs,
+		"DROP TABLE IF EXISTS " + stagedFingerprints,
+		"CREATE TABLE " + stagedSongs + " AS songs",
+		"CREATE TABLE " + stagedFingerprints + " AS fingerprints",
+	} {
+		if _, err := db.db.ExecContext(ctx, query); err != nil {
+			return nil, fmt.Errorf("error creating staging tables: %v", err)
+		}
+	}
+	return &clickhouseStaging{db: db.db}, nil
+}
+
+// StoreSong inserts the song; the staged table starts empty, so there is no
+// previous version of it to delete.
+func (s *clickhouseStaging) StoreSong(songID models.SongID, song Song) error {
+	return insertClickHouseSong(context.Background(), s.db, stagedSongs, songID, song)
+}
+
+func (s *clickhouseStaging) StoreFingerprints(fingerprints map[uint32]models.Couple) error {
+	return storeClickHouseFingerprints(context.Background(), s.db, stagedFingerprints, fingerprints)
+}
+
+// Promote exchanges each live table with its staged one, which needs the
+// Atomic database engine, the default. The staged tables are left holding the
+// previous catalog and dropped.
+func (s *clickhouseStaging) Promote() error {
+	for _, query := range []string{
+		"EXCHANGE TABLES " + stagedSongs + " AND songs",
+		"EXCHANGE TABLES " + stagedFingerprints + " AND fingerprints",
+	} {
+		if _, err := s.db.Exec(query); err != nil {
+			return fmt.Errorf("error promoting staged catalog: %v", err)
+		}
+	}
+	return s.Discard()
+}
+
+func (s *clickhouseStaging) Discard() error {
+	for _, table := range []string{stagedSongs, stagedFingerprints} {
+		if _, err := s.db.Exec("DROP TABLE IF EXISTS " + table); err != nil {
+			return fmt.Errorf("error dropping staging tables: %v", err)
+		}
+	}
+	return nil
+}
@@ -1,9 +1,16 @@
 package db
 
 import (
+	"encoding/json"
 	"fmt"
+	"net/url"
 	"song-recognition/models"
 	"song-recognition/utils"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
 )
 
 type DBClient interface {
@@ -11,44 +18,221 @@ type DBClient interface {
 	StoreFingerprints(fingerprints map[uint32]models.Couple) error
 	GetCouples(addresses []uint32) (map[uint32][]models.Couple, error)
 	TotalSongs() (int, error)
-	RegisterSong(songTitle, songArtist, ytID string) (uint32, error)
+	RegisterSong(songTitle, songArtist, ytID string) (models.SongID, error)
 	GetSong(filterKey string, value interface{}) (Song, bool, error)
-	GetSongByID(songID uint32) (Song, bool, error)
+	GetSongByID(songID models.SongID) (Song, bool, error)
 	GetSongByYTID(ytID string) (Song, bool, error)
 	GetSongByKey(key string) (Song, bool, error)
-	DeleteSongByID(songID uint32) error
+	DeleteSongByID(songID models.SongID) error
 	DeleteCollection(collectionName string) error
+
+	// Bulk access, used to move catalogs between backends. ForEachFingerprint
+	// visits couples in an order that is stable between calls.
+	ForEachSong(fn func(songID models.SongID, song Song) error) error
+	ForEachFingerprint(fn func(address uint32, couple models.Couple) error) error
+	StoreSong(songID models.SongID, song Song) error
+
+	// Browsing the library, a page of the songs matching filter at a time
+	ListSongs(offset, limit int, filter SongFilter) ([]ListedSong, error)
+
+	// Index maintenance
+	FingerprintSongIDs() ([]models.SongID, error)
+	DeleteFingerprintsBySongID(songID models.SongID) error
+	Compact() error
+	Snapshot(dir string) (string, error)
+
+	// Operational records (ingestion failures, ...)
+	PutRecord(collection string, record Record) error
+	GetRecord(collection, id string) (Record, bool, error)
+	ListRecords(collection string, filter RecordFilter) ([]Record, error)
+	DeleteRecord(collection, id string) error
 }
 
 type Song struct {
 	Title     string
 	Artist    string
 	YouTubeID string
+	SongDetails
+	// IngestedAtMs is the Unix time in milliseconds the song was registered
+	// at, or 0 for songs registered before it was recorded.
+	IngestedAtMs int64
+}
+
+// Record is a schemaless JSON document stored alongside the catalog. It holds
+// operational data that doesn't belong to songs or fingerprints.
+type Record struct {
+	ID        string
+	ClientID  string
+	CreatedAt time.Time
+	Data      json.RawMessage
+}
+
+// RecordFilter selects records of a collection. Zero values match everything.
+type RecordFilter struct {
+	ClientID string
+	Since    time.Time
+	Until    time.Time
+	Limit    int
 }
 
-var DBtype = utils.GetEnv("DB_TYPE", "sqlite") // Can be "sqlite" or "mongo"
+var DBtype = utils.GetEnv("DB_TYPE", "sqlite") // Can be "sqlite", "bolt", "memory", "mongo", "mysql", "postgres", "clickhouse" or "cassandra"
 
 func NewDBClient() (DBClient, error) {
-	switch DBtype {
+	return NewDBClientFor(DBtype, "")
+}
+
+// NewDBClientFor connects to a backend of the given type. Settings are read
+// from the environment, preferring variables with the given prefix (e.g.
+// FROM_DB_HOST over DB_HOST) so that two backends can be configured at once.
+// When DB_FAULTS is set, the client injects the faults it describes (see
+// ParseFaultConfig). It fails when SONG_ID_SCHEME draws song IDs the
+// backend can't store. With FINGERPRINT_STORE, fingerprints are kept apart
+// from songs (see withFingerprintStore). Deleting a song deletes its
+// fingerprints too, changes to songs and fingerprints bump the catalog
+// version (see ReadCatalogVersion) and storing or deleting fingerprints
+// updates the catalog stats (see ReadCatalogStats). Fingerprint operations
+// failing with transient errors, including injected ones, are retried (see
+// retryConfig).
+func NewDBClientFor(dbType, prefix string) (DBClient, error) {
+	getEnv := func(key string, fallback ...string) string {
+		if value := utils.GetEnv(prefix + key); prefix != "" && value != "" {
+			return value
+		}
+		return utils.GetEnv(key, fallback...)
+	}
+
+	scheme, err := models.SongIDScheme()
+	if err != nil {
+		return nil, err
+	}
+	if scheme != models.SongIDsUint32 && narrowSongIDs(dbType) {
+		return nil, fmt.Errorf("SONG_ID_SCHEME=%s isn't supported by %s, whose schema stores 32-bit song IDs", scheme, dbType)
+	}
+
+	client, err := newBackend(dbType, getEnv)
+	if err != nil {
+		return nil, err
+	}
+	if store := getEnv("FINGERPRINT_STORE"); store != "" {
+		client, err = withFingerprintStore(client, store, getEnv)
+		if err != nil {
+			return nil, err
+		}
+	}
+	client = withCatalogVersion(withCascade(withStats(client)))
+
+	if spec := getEnv("DB_FAULTS"); spec != "" {
+		config, err := ParseFaultConfig(spec)
+		if err != nil {
+			client.Close()
+			return nil, fmt.Errorf("invalid DB_FAULTS: %v", err)
+		}
+		client = WithFaults(client, config)
+	}
+
+	retries, err := retryConfig(getEnv)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	if retries.MaxAttempts > 1 {
+		client = WithRetries(client, retries)
+	}
+	return client, nil
+}
+
+// narrowSongIDs reports whether the schema of a backend stores 32-bit song
+// IDs: MySQL packs them with anchor times in a 64-bit column and ClickHouse
+// declares UInt32 columns.
+func narrowSongIDs(dbType string) bool {
+	return dbType == "mysql" || dbType == "clickhouse"
+}
+
+// checkNarrowSongID fails for song IDs the backends with narrowSongIDs can't
+// store, e.g. when migrating a catalog with 64-bit IDs to them.
+func checkNarrowSongID(songID models.SongID) error {
+	if songID > models.MaxSongID32 {
+		return fmt.Errorf("song ID %d doesn't fit the 32-bit song IDs of this backend", songID)
+	}
+	return nil
+}
+
+func newBackend(dbType string, getEnv func(key string, fallback ...string) string) (DBClient, error) {
+	switch dbType {
 	case "mongo":
 		var (
-			dbUsername = utils.GetEnv("DB_USER")
-			dbPassword = utils.GetEnv("DB_PASS")
-			dbName     = utils.GetEnv("DB_NAME")
-			dbHost     = utils.GetEnv("DB_HOST")
-			dbPort     = utils.GetEnv("DB_PORT")
+			dbUsername = getEnv("DB_USER")
+			dbPassword = getEnv("DB_PASS")
+			dbName     = getEnv("DB_NAME")
+			dbHost     = getEnv("DB_HOST")
+			dbPort     = getEnv("DB_PORT")
 
 			dbUri = "mongodb://" + dbUsername + ":" + dbPassword + "@" + dbHost + ":" + dbPort + "/" + dbName
 		)
 		if dbUsername == "" || dbPassword == "" {
 			dbUri = "mongodb://localhost:27017"
 		}
-		return NewMongoClient(dbUri)
+		routing, err := mongoReadRouting(getEnv)
+		if err != nil {
+			return nil, err
+		}
+		batchSize, err := strconv.Atoi(getEnv("MONGO_BATCH_SIZE", strconv.Itoa(mongoBatchSize)))
+		if err != nil || batchSize < 1 {
+			return nil, fmt.Errorf("invalid MONGO_BATCH_SIZE: %q", getEnv("MONGO_BATCH_SIZE"))
+		}
+		opts, err := mongoOptions(getEnv)
+		if err != nil {
+			return nil, err
+		}
+		client, err := NewMongoClient(dbUri, routing, opts)
+		if err != nil {
+			return nil, err
+		}
+		client.batchSize = batchSize
+		return client, nil
+
+	case "mysql":
+		dbPort := getEnv("DB_PORT", "3306")
+		cfg := mysql.NewConfig()
+		cfg.User = getEnv("DB_USER")
+		cfg.Passwd = getEnv("DB_PASS")
+		cfg.Net = "tcp"
+		cfg.Addr = getEnv("DB_HOST", "localhost") + ":" + dbPort
+		cfg.DBName = getEnv("DB_NAME")
+		return NewMySQLClient(cfg.FormatDSN())
+
+	case "postgres":
+		dsn := url.URL{
+			Scheme:   "postgres",
+			User:     url.UserPassword(getEnv("DB_USER"), getEnv("DB_PASS")),
+			Host:     getEnv("DB_HOST", "localhost") + ":" + getEnv("DB_PORT", "5432"),
+			Path:     "/" + getEnv("DB_NAME"),
+			RawQuery: url.Values{"sslmode": {getEnv("POSTGRES_SSLMODE", "disable")}}.Encode(),
+		}
+		return NewPostgresClient(dsn.String())
+
+	case "clickhouse":
+		addr := getEnv("DB_HOST", "localhost") + ":" + getEnv("DB_PORT", "9000")
+		return NewClickHouseClient(addr, getEnv("DB_NAME", "default"), getEnv("DB_USER", "default"), getEnv("DB_PASS"))
+
+	case "cassandra":
+		port, err := strconv.Atoi(getEnv("DB_PORT", "9042"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid DB_PORT: %v", err)
+		}
+		hosts := strings.Split(getEnv("DB_HOST", "localhost"), ",")
+		return NewCassandraClient(hosts, port, getEnv("DB_NAME", "seektune"), getEnv("DB_USER"), getEnv("DB_PASS"))
 
 	case "sqlite":
-		return NewSQLiteClient("db/db.sqlite3")
+		return NewSQLiteClient(getEnv("SQLITE_PATH", "db/db.sqlite3"))
+
+	case "bolt":
+		return NewBoltClient(getEnv("BOLT_PATH", "db/db.bolt"))
+
+	case "memory":
+		return NewMemoryClient(getEnv("MEMORY_DB_NAME", "default")), nil
 
 	default:
-		return nil, fmt.Errorf("unsupported database type: %s", DBtype)
+		return nil, fmt.Errorf("unsupported database type: %s", dbType)
 	}
 }
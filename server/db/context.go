@@ -0,0 +1,55 @@
+package db
+
+import (
+	"context"
+	"song-recognition/utils"
+	"time"
+)
+
+// contextual is implemented by clients whose operations can be bound to a
+// context, see WithContext.
+type contextual interface {
+	withContext(ctx context.Context) DBClient
+}
+
+// WithContext returns a client sharing the connection of client whose
+// operations run under ctx: they are abandoned once ctx is done, so that
+// callers can cancel long matches and enforce deadlines. Each operation is
+// also bounded by DB_TIMEOUT. Closing either client closes both.
+func WithContext(ctx context.Context, client DBClient) DBClient {
+	if c, ok := client.(contextual); ok {
+		return c.withContext(ctx)
+	}
+	return client
+}
+
+// operationTimeout returns how long a single operation may take, from
+// DB_TIMEOUT (default 0, no limit). Bulk operations that visit the whole
+// catalog (ForEachSong, ForEachFingerprint, Compact, Snapshot...) aren't
+// bounded by it.
+func operationTimeout() time.Duration {
+	timeout, err := time.ParseDuration(utils.GetEnv("DB_TIMEOUT", "0"))
+	if err != nil || timeout < 0 {
+		return 0
+	}
+	return timeout
+}
+
+// opContext returns the context of an operation of a client bound to ctx,
+// nil for unbound clients, limited to DB_TIMEOUT.
+func opContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx = bulkContext(ctx)
+	if timeout := operationTimeout(); timeout > 0 {
+		return context.WithTimeout(ctx, timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// bulkContext returns the context of a bulk operation of a client bound to
+// ctx, nil for unbound clients.
+func bulkContext(ctx context.Context) context.Context {
+	if ctx == nil {
+		return context.Background()
+	}
+	return ctx
+}
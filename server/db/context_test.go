@@ -0,0 +1,43 @@
+package db_test
+
+import (
+	"context"
+	"errors"
+	"song-recognition/db"
+	"song-recognition/db/storagetest"
+	"testing"
+	"time"
+)
+
+func TestWithContextConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) db.DBClient {
+		return db.WithContext(context.Background(), newSQLite(t))
+	})
+}
+
+func TestWithContextCanceled(t *testing.T) {
+	client := newSQLite(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := db.WithContext(ctx, client).TotalSongs(); err == nil {
+		t.Error("TotalSongs succeeded with a canceled context")
+	}
+	if _, err := client.TotalSongs(); err != nil {
+		t.Errorf("the unbound client failed: %v", err)
+	}
+}
+
+func TestWithContextTimeout(t *testing.T) {
+	t.Setenv("DB_TIMEOUT", "20ms")
+	client := db.WithFaults(newSQLite(t), db.FaultConfig{Latency: time.Second})
+
+	start := time.Now()
+	_, err := db.WithContext(context.Background(), client).GetCouples([]uint32{1})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("GetCouples returned %v, want a deadline error", err)
+	}
+	if time.Since(start) > 500*time.Millisecond {
+		t.Error("the operation wasn't abandoned at DB_TIMEOUT")
+	}
+}
@@ -0,0 +1,91 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"song-recognition/models"
+	"time"
+)
+
+// SongDetails describe a song beyond its title and artist. They are read
+// from its audio or given by its source when it is ingested, and are empty
+// when unknown.
+type SongDetails struct {
+	Album       string
+	DurationMs  int64
+	ReleaseYear int
+	Genre       string
+	CoverArtURL string
+}
+
+// songDetailColumns are the columns SQL backends store the details of a
+// song and the time it was ingested at in, in the order of songDetails.
+const songDetailColumns = "album, durationMs, releaseYear, genre, coverArtURL, ingestedAtMs"
+
+// songDetails returns the details of a song and the time it was ingested
+// at, to store in songDetailColumns.
+func songDetails(song Song) []interface{} {
+	return []interface{}{song.Album, song.DurationMs, song.ReleaseYear, song.Genre, song.CoverArtURL, song.IngestedAtMs}
+}
+
+// songDetailsDest returns the destinations to scan the details of a song
+// and the time it was ingested at into, in the order of songDetails.
+func songDetailsDest(song *Song) []interface{} {
+	return []interface{}{&song.Album, &song.DurationMs, &song.ReleaseYear, &song.Genre, &song.CoverArtURL, &song.IngestedAtMs}
+}
+
+// ingestionTime returns the time to record for a song registered now.
+func ingestionTime() int64 {
+	return time.Now().UnixMilli()
+}
+
+// SetSongDetails replaces the details of a song, keeping its title, artist
+// and YouTube ID. It reports whether the song exists and had other details.
+func SetSongDetails(client DBClient, songID models.SongID, details SongDetails) (bool, error) {
+	song, exists, err := client.GetSongByID(songID)
+	if err != nil || !exists || song.SongDetails == details {
+		return false, err
+	}
+	song.SongDetails = details
+	if err := client.StoreSong(songID, song); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// songMetadataCollection holds the metadata package songmeta records for
+// songs, which their details were only kept in before songs carried them.
+const songMetadataCollection = "song_metadata"
+
+// copySongMetadata sets the details of every song with recorded metadata
+// from it.
+func copySongMetadata(client DBClient) error {
+	records, err := client.ListRecords(songMetadataCollection, RecordFilter{})
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		var metadata struct {
+			SongID      models.SongID `json:"songId"`
+			DurationMs  int64         `json:"durationMs"`
+			Album       string        `json:"album"`
+			Genre       string        `json:"genre"`
+			Year        int           `json:"year"`
+			CoverArtURL string        `json:"coverArtUrl"`
+		}
+		if err := json.Unmarshal(record.Data, &metadata); err != nil {
+			return fmt.Errorf("failed to unmarshal metadata of song %s: %v", record.ID, err)
+		}
+		_, err := SetSongDetails(client, metadata.SongID, SongDetails{
+			Album:       metadata.Album,
+			DurationMs:  metadata.DurationMs,
+			ReleaseYear: metadata.Year,
+			Genre:       metadata.Genre,
+			CoverArtURL: metadata.CoverArtURL,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
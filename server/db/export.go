@@ -0,0 +1,497 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"song-recognition/models"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ExportFormat is the format of the exports written by ExportCatalog, and of
+// the archives of ExportAll, which hold one. Couples of format 1 exports have
+// 32-bit song IDs, format 3 adds their peak codes and format 4 records the
+// schema version of the catalog.
+const ExportFormat = 4
+
+const (
+	ExportManifestFile    = "manifest.json"
+	ExportCouplesPerChunk = 1000000 // default
+	exportSongsPerChunk   = 50000
+	exportCoupleSize      = 18 // address, anchor time, 64-bit song ID and peak code, little endian
+	exportBatchSize       = 5000
+)
+
+// Kinds of export chunks, in the order they are imported
+const (
+	ChunkSongs        = "songs"
+	ChunkFingerprints = "fingerprints"
+)
+
+// ExportManifest describes an export. It is written last, so a folder with
+// a manifest holds a complete export, and lists the chunks in order with
+// their checksums.
+type ExportManifest struct {
+	Format    int       `json:"format"`
+	CreatedAt time.Time `json:"createdAt"`
+	Backend   string    `json:"backend"`
+	// Versions of the catalog when the export started and ended. An export
+	// is consistent if nothing changed in between.
+	CatalogVersion    int64 `json:"catalogVersion"`
+	EndCatalogVersion int64 `json:"endCatalogVersion"`
+	Consistent        bool  `json:"consistent"`
+	// SchemaVersion is the schema version of the exported catalog, 0 in
+	// exports of formats before 4.
+	SchemaVersion int           `json:"schemaVersion,omitempty"`
+	Songs         int64         `json:"songs"`
+	Fingerprints  int64         `json:"fingerprints"`
+	Chunks        []ExportChunk `json:"chunks"`
+}
+
+// ExportChunk is a gzipped file of songs, as JSON lines, or of couples.
+type ExportChunk struct {
+	Kind   string `json:"kind"`
+	Index  int    `json:"index"` // among the chunks of its kind
+	File   string `json:"file"`
+	Rows   int64  `json:"rows"`
+	Bytes  int64  `json:"bytes"`
+	SHA256 string `json:"sha256"` // of the file
+}
+
+type exportedSong struct {
+	ID           models.SongID `json:"id"`
+	Title        string        `json:"title"`
+	Artist       string        `json:"artist"`
+	YouTubeID    string        `json:"ytID,omitempty"`
+	Album        string        `json:"album,omitempty"`
+	DurationMs   int64         `json:"durationMs,omitempty"`
+	ReleaseYear  int           `json:"releaseYear,omitempty"`
+	Genre        string        `json:"genre,omitempty"`
+	CoverArtURL  string        `json:"coverArtUrl,omitempty"`
+	IngestedAtMs int64         `json:"ingestedAtMs,omitempty"`
+}
+
+func newExportedSong(songID models.SongID, song Song) exportedSong {
+	return exportedSong{
+		ID:           songID,
+		Title:        song.Title,
+		Artist:       song.Artist,
+		YouTubeID:    song.YouTubeID,
+		Album:        song.Album,
+		DurationMs:   song.DurationMs,
+		ReleaseYear:  song.ReleaseYear,
+		Genre:        song.Genre,
+		CoverArtURL:  song.CoverArtURL,
+		IngestedAtMs: song.IngestedAtMs,
+	}
+}
+
+func (e exportedSong) song() Song {
+	return Song{
+		Title:     e.Title,
+		Artist:    e.Artist,
+		YouTubeID: e.YouTubeID,
+		SongDetails: SongDetails{
+			Album:       e.Album,
+			DurationMs:  e.DurationMs,
+			ReleaseYear: e.ReleaseYear,
+			Genre:       e.Genre,
+			CoverArtURL: e.CoverArtURL,
+		},
+		IngestedAtMs: e.IngestedAtMs,
+	}
+}
+
+// CatalogWriter is where imported songs and fingerprints are stored, the
+// live catalog or a staged one.
+type CatalogWriter interface {
+	StoreSong(songID models.SongID, song Song) error
+	StoreFingerprints(fingerprints map[uint32]models.Couple) error
+}
+
+// ExportOptions tune ExportCatalog.
+type ExportOptions struct {
+	Workers   int // chunks compressed at once, at least 1
+	ChunkSize int // couples per chunk, ExportCouplesPerChunk when 0
+	// Stage, when set, is called as the songs and then the fingerprints
+	// start being read, with their number when known and 0 otherwise.
+	Stage func(stage string, total int64)
+	// Written, when set, is called for every chunk written, one at a time.
+	Written func(chunk ExportChunk)
+}
+
+// chunkWriter compresses, checksums and writes chunks in parallel.
+type chunkWriter struct {
+	dir     string
+	pending chan pendingChunk
+	wg      sync.WaitGroup
+	written func(chunk ExportChunk)
+	indexes map[string]int
+
+	mu     sync.Mutex
+	chunks []ExportChunk
+	err    error
+}
+
+type pendingChunk struct {
+	ExportChunk
+	data []byte
+}
+
+func newChunkWriter(dir string, workers int, written func(chunk ExportChunk)) *chunkWriter {
+	w := &chunkWriter{
+		dir:     dir,
+		pending: make(chan pendingChunk, workers),
+		written: written,
+		indexes: make(map[string]int),
+	}
+	for range workers {
+		w.wg.Add(1)
+		go func() {
+			defer w.wg.Done()
+			for chunk := range w.pending {
+				w.write(chunk)
+			}
+		}()
+	}
+	return w
+}
+
+// submit queues the data of a chunk to be written, waiting while every
+// worker is busy. It returns the error of a previous chunk, if any.
+func (w *chunkWriter) submit(kind string, rows int64, data []byte) error {
+	w.mu.Lock()
+	err := w.err
+	w.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	index := w.indexes[kind]
+	w.indexes[kind]++
+	w.pending <- pendingChunk{
+		ExportChunk: ExportChunk{Kind: kind, Index: index, File: fmt.Sprintf("%s-%06d.gz", kind, index), Rows: rows},
+		data:        data,
+	}
+	return nil
+}
+
+func (w *chunkWriter) write(chunk pendingChunk) {
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	_, err := gz.Write(chunk.data)
+	if err == nil {
+		err = gz.Close()
+	}
+	if err == nil {
+		err = os.WriteFile(filepath.Join(w.dir, chunk.File), compressed.Bytes(), 0644)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err != nil {
+		if w.err == nil {
+			w.err = fmt.Errorf("failed to write chunk %s: %v", chunk.File, err)
+		}
+		return
+	}
+	sum := sha256.Sum256(compressed.Bytes())
+	chunk.SHA256, chunk.Bytes = hex.EncodeToString(sum[:]), int64(compressed.Len())
+	w.chunks = append(w.chunks, chunk.ExportChunk)
+	if w.written != nil {
+		w.written(chunk.ExportChunk)
+	}
+}
+
+// close waits for the chunks to be written and returns them in order.
+func (w *chunkWriter) close() ([]ExportChunk, error) {
+	close(w.pending)
+	w.wg.Wait()
+	sortChunks(w.chunks)
+	return w.chunks, w.err
+}
+
+func sortChunks(chunks []ExportChunk) {
+	sort.Slice(chunks, func(i, j int) bool {
+		if chunks[i].Kind != chunks[j].Kind {
+			return chunks[i].Kind == ChunkSongs
+		}
+		return chunks[i].Index < chunks[j].Index
+	})
+}
+
+// ExportCatalog writes the songs and fingerprints of the catalog of client
+// to a folder of checksummed chunks, compressed by parallel workers, and a
+// manifest. The catalog keeps serving meanwhile; the manifest tells whether
+// it changed.
+func ExportCatalog(client DBClient, dir string, options ExportOptions) (ExportManifest, error) {
+	stage := options.Stage
+	if stage == nil {
+		stage = func(string, int64) {}
+	}
+	chunkSize := options.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = ExportCouplesPerChunk
+	}
+
+	start, err := ReadCatalogVersion(client)
+	if err != nil {
+		return ExportManifest{}, err
+	}
+	schemaVersion, err := CurrentSchemaVersion(client)
+	if err != nil {
+		return ExportManifest{}, err
+	}
+	manifest := ExportManifest{
+		Format:         ExportFormat,
+		CreatedAt:      time.Now().UTC(),
+		Backend:        DBtype,
+		CatalogVersion: start.Version,
+		SchemaVersion:  schemaVersion,
+	}
+
+	total, err := client.TotalSongs()
+	if err != nil {
+		return manifest, err
+	}
+	stage(ChunkSongs, int64(total))
+	writer := newChunkWriter(dir, max(options.Workers, 1), options.Written)
+
+	var songs bytes.Buffer
+	var rows int64
+	encoder := json.NewEncoder(&songs)
+	err = client.ForEachSong(func(songID models.SongID, song Song) error {
+		if err := encoder.Encode(newExportedSong(songID, song)); err != nil {
+			return err
+		}
+		manifest.Songs++
+		if rows++; rows == exportSongsPerChunk {
+			data := bytes.Clone(songs.Bytes())
+			songs.Reset()
+			rows = 0
+			return writer.submit(ChunkSongs, exportSongsPerChunk, data)
+		}
+		return nil
+	})
+	if err == nil && rows > 0 {
+		err = writer.submit(ChunkSongs, rows, songs.Bytes())
+	}
+	if err != nil {
+		writer.close()
+		return manifest, err
+	}
+
+	// The songs still being written count towards the next stage, whose
+	// total isn't known
+	stage(ChunkFingerprints, 0)
+	couples := make([]byte, 0, chunkSize*exportCoupleSize)
+	err = client.ForEachFingerprint(func(address uint32, couple models.Couple) error {
+		couples = binary.LittleEndian.AppendUint32(couples, address)
+		couples = binary.LittleEndian.AppendUint32(couples, couple.AnchorTimeMs)
+		couples = binary.LittleEndian.AppendUint64(couples, uint64(couple.SongID))
+		couples = binary.LittleEndian.AppendUint16(couples, couple.PeakCode())
+		manifest.Fingerprints++
+		if len(couples) == chunkSize*exportCoupleSize {
+			data := couples
+			couples = make([]byte, 0, chunkSize*exportCoupleSize)
+			return writer.submit(ChunkFingerprints, int64(chunkSize), data)
+		}
+		return nil
+	})
+	if err == nil && len(couples) > 0 {
+		err = writer.submit(ChunkFingerprints, int64(len(couples)/exportCoupleSize), couples)
+	}
+	chunks, writeErr := writer.close()
+	if err == nil {
+		err = writeErr
+	}
+	if err != nil {
+		return manifest, err
+	}
+	manifest.Chunks = chunks
+
+	end, err := ReadCatalogVersion(client)
+	if err != nil {
+		return manifest, err
+	}
+	manifest.EndCatalogVersion = end.Version
+	manifest.Consistent = end.Version == start.Version
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return manifest, err
+	}
+	tmp := filepath.Join(dir, ExportManifestFile+".tmp")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return manifest, err
+	}
+	return manifest, os.Rename(tmp, filepath.Join(dir, ExportManifestFile))
+}
+
+// ReadExportManifest reads the manifest of an export and checks that it
+// lists every chunk of it once. Exports of a newer schema than this server
+// supports fail with ErrSchemaNewer.
+func ReadExportManifest(dir string) (ExportManifest, error) {
+	data, err := os.ReadFile(filepath.Join(dir, ExportManifestFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return ExportManifest{}, fmt.Errorf("%s has no %s, the export is missing or didn't complete", dir, ExportManifestFile)
+	}
+	if err != nil {
+		return ExportManifest{}, err
+	}
+	return parseExportManifest(data)
+}
+
+func parseExportManifest(data []byte) (ExportManifest, error) {
+	var manifest ExportManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return manifest, fmt.Errorf("invalid manifest: %v", err)
+	}
+	if manifest.Format < 1 || manifest.Format > ExportFormat {
+		return manifest, fmt.Errorf("unsupported export format %d", manifest.Format)
+	}
+	if manifest.SchemaVersion > LatestSchemaVersion() {
+		return manifest, fmt.Errorf("%w: export of version %d, this server supports %d", ErrSchemaNewer, manifest.SchemaVersion, LatestSchemaVersion())
+	}
+
+	sortChunks(manifest.Chunks)
+	next := map[string]int{}
+	rows := map[string]int64{}
+	for _, chunk := range manifest.Chunks {
+		if chunk.Kind != ChunkSongs && chunk.Kind != ChunkFingerprints {
+			return manifest, fmt.Errorf("invalid manifest: unknown chunk kind %q", chunk.Kind)
+		}
+		if chunk.Index != next[chunk.Kind] {
+			return manifest, fmt.Errorf("invalid manifest: %s chunk %d is missing", chunk.Kind, next[chunk.Kind])
+		}
+		if filepath.Base(chunk.File) != chunk.File {
+			return manifest, fmt.Errorf("invalid manifest: chunk file %q isn't in the export folder", chunk.File)
+		}
+		next[chunk.Kind]++
+		rows[chunk.Kind] += chunk.Rows
+	}
+	if rows[ChunkSongs] != manifest.Songs || rows[ChunkFingerprints] != manifest.Fingerprints {
+		return manifest, fmt.Errorf("invalid manifest: chunks hold %d songs and %d fingerprints, expected %d and %d",
+			rows[ChunkSongs], rows[ChunkFingerprints], manifest.Songs, manifest.Fingerprints)
+	}
+	return manifest, nil
+}
+
+// ReadExportChunk returns the decompressed content of a chunk of the export
+// in dir after checking it against the manifest.
+func ReadExportChunk(dir string, chunk ExportChunk) ([]byte, error) {
+	data, err := os.ReadFile(filepath.Join(dir, chunk.File))
+	if err != nil {
+		return nil, err
+	}
+	return decompressChunk(chunk, data)
+}
+
+// decompressChunk checks the file of a chunk against the manifest and
+// returns its content.
+func decompressChunk(chunk ExportChunk, data []byte) ([]byte, error) {
+	sum := sha256.Sum256(data)
+	if int64(len(data)) != chunk.Bytes || hex.EncodeToString(sum[:]) != chunk.SHA256 {
+		return nil, fmt.Errorf("chunk %s is corrupt: its checksum doesn't match the manifest", chunk.File)
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("chunk %s is corrupt: %v", chunk.File, err)
+	}
+	content, err := io.ReadAll(gz)
+	if err != nil {
+		return nil, fmt.Errorf("chunk %s is corrupt: %v", chunk.File, err)
+	}
+	return content, nil
+}
+
+// LoadExportChunk stores the songs or couples of a chunk of the export in
+// dir, of the given format, into target.
+func LoadExportChunk(dir string, chunk ExportChunk, format int, target CatalogWriter) error {
+	content, err := ReadExportChunk(dir, chunk)
+	if err != nil {
+		return err
+	}
+	return loadChunk(chunk, content, format, target)
+}
+
+// loadChunk stores the decompressed songs or couples of a chunk.
+func loadChunk(chunk ExportChunk, content []byte, format int, target CatalogWriter) error {
+	var rows int64
+	switch chunk.Kind {
+	case ChunkSongs:
+		scanner := bufio.NewScanner(bytes.NewReader(content))
+		scanner.Buffer(nil, 1<<20)
+		for scanner.Scan() {
+			var song exportedSong
+			if err := json.Unmarshal(scanner.Bytes(), &song); err != nil {
+				return fmt.Errorf("chunk %s: invalid song: %v", chunk.File, err)
+			}
+			if err := target.StoreSong(song.ID, song.song()); err != nil {
+				return err
+			}
+			rows++
+		}
+		if err := scanner.Err(); err != nil {
+			return fmt.Errorf("chunk %s: %v", chunk.File, err)
+		}
+
+	case ChunkFingerprints:
+		coupleSize := exportCoupleSize
+		switch format {
+		case 1:
+			coupleSize = 12
+		case 2:
+			coupleSize = 16
+		}
+		if len(content)%coupleSize != 0 {
+			return fmt.Errorf("chunk %s is truncated", chunk.File)
+		}
+		// A batch holds a single couple per address
+		batch := make(map[uint32]models.Couple, exportBatchSize)
+		for offset := 0; offset < len(content); offset += coupleSize {
+			address := binary.LittleEndian.Uint32(content[offset:])
+			if _, exists := batch[address]; exists || len(batch) >= exportBatchSize {
+				if err := target.StoreFingerprints(batch); err != nil {
+					return err
+				}
+				clear(batch)
+			}
+			songID := models.SongID(binary.LittleEndian.Uint32(content[offset+8:]))
+			if format != 1 {
+				songID = models.SongID(binary.LittleEndian.Uint64(content[offset+8:]))
+			}
+			couple := models.Couple{
+				AnchorTimeMs: binary.LittleEndian.Uint32(content[offset+4:]),
+				SongID:       songID,
+			}
+			if format >= 3 {
+				couple.SetPeakCode(binary.LittleEndian.Uint16(content[offset+16:]))
+			}
+			batch[address] = couple
+			rows++
+		}
+		if len(batch) > 0 {
+			if err := target.StoreFingerprints(batch); err != nil {
+				return err
+			}
+		}
+	}
+
+	if rows != chunk.Rows {
+		return fmt.Errorf("chunk %s holds %d rows, the manifest lists %d", chunk.File, rows, chunk.Rows)
+	}
+	return nil
+}
@@ -0,0 +1,330 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"song-recognition/models"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrInjectedFault is returned by operations that were failed on purpose.
+var ErrInjectedFault = errors.New("injected fault")
+
+// FaultConfig describes the faults injected by WithFaults.
+type FaultConfig struct {
+	ErrorRate   float64         // probability that an operation fails
+	PartialRate float64         // probability that a bulk operation fails halfway through
+	Latency     time.Duration   // delay added to every operation
+	Jitter      time.Duration   // random extra delay, up to this much
+	Operations  map[string]bool // names of the DBClient methods affected, all if empty
+	Seed        int64           // seed of the random source, random if 0
+}
+
+// ParseFaultConfig parses a comma-separated list of settings, e.g.
+// "error_rate=0.05,partial_rate=0.1,latency=20ms,jitter=50ms,ops=StoreFingerprints+GetCouples,seed=42".
+func ParseFaultConfig(spec string) (FaultConfig, error) {
+	var config FaultConfig
+	for _, setting := range strings.Split(spec, ",") {
+		setting = strings.TrimSpace(setting)
+		if setting == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(setting, "=")
+		if !ok {
+			return config, fmt.Errorf("invalid fault setting %q", setting)
+		}
+
+		var err error
+		switch key {
+		case "error_rate":
+			config.ErrorRate, err = strconv.ParseFloat(value, 64)
+		case "partial_rate":
+			config.PartialRate, err = strconv.ParseFloat(value, 64)
+		case "latency":
+			config.Latency, err = time.ParseDuration(value)
+		case "jitter":
+			config.Jitter, err = time.ParseDuration(value)
+		case "seed":
+			config.Seed, err = strconv.ParseInt(value, 10, 64)
+		case "ops":
+			config.Operations = make(map[string]bool)
+			for _, op := range strings.Split(value, "+") {
+				config.Operations[op] = true
+			}
+		default:
+			return config, fmt.Errorf("unknown fault setting %q", key)
+		}
+		if err != nil {
+			return config, fmt.Errorf("invalid value for %s: %v", key, err)
+		}
+	}
+	return config, nil
+}
+
+// faultyClient wraps a DBClient, delaying and failing its operations.
+type faultyClient struct {
+	DBClient
+	config FaultConfig
+	ctx    context.Context // see WithContext
+
+	// Shared with the clients bound to contexts
+	mu   *sync.Mutex
+	rand *rand.Rand
+}
+
+// WithFaults wraps a client so that its operations are delayed and fail
+// according to config, to exercise retries and fallbacks in tests and
+// staging. Failed operations return errors wrapping ErrInjectedFault;
+// partial failures of bulk writes store part of the data before failing.
+func WithFaults(client DBClient, config FaultConfig) DBClient {
+	seed := config.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return &faultyClient{DBClient: client, config: config, mu: &sync.Mutex{}, rand: rand.New(rand.NewSource(seed))}
+}
+
+func (f *faultyClient) withContext(ctx context.Context) DBClient {
+	bound := *f
+	bound.DBClient = WithContext(ctx, f.DBClient)
+	bound.ctx = ctx
+	return &bound
+}
+
+func (f *faultyClient) float() float64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.rand.Float64()
+}
+
+func (f *faultyClient) affects(op string) bool {
+	return len(f.config.Operations) == 0 || f.config.Operations[op]
+}
+
+// inject delays an operation and returns the error it should fail with, if any.
+func (f *faultyClient) inject(op string) error {
+	if !f.affects(op) {
+		return nil
+	}
+
+	if delay := f.config.Latency + time.Duration(f.float()*float64(f.config.Jitter)); delay > 0 {
+		ctx, cancel := opContext(f.ctx)
+		defer cancel()
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return fmt.Errorf("%s: %w", op, ctx.Err())
+		}
+	}
+	if f.float() < f.config.ErrorRate {
+		return fmt.Errorf("%s: %w", op, ErrInjectedFault)
+	}
+	return nil
+}
+
+// partial reports whether a bulk operation should fail halfway through.
+func (f *faultyClient) partial(op string) bool {
+	return f.affects(op) && f.float() < f.config.PartialRate
+}
+
+func (f *faultyClient) StoreFingerprints(fingerprints map[uint32]models.Couple) error {
+	if err := f.inject("StoreFingerprints"); err != nil {
+		return err
+	}
+	if !f.partial("StoreFingerprints") {
+		return f.DBClient.StoreFingerprints(fingerprints)
+	}
+
+	stored := make(map[uint32]models.Couple, len(fingerprints)/2)
+	for address, couple := range fingerprints {
+		if len(stored) >= len(fingerprints)/2 {
+			break
+		}
+		stored[address] = couple
+	}
+	if err := f.DBClient.StoreFingerprints(stored); err != nil {
+		return err
+	}
+	return fmt.Errorf("StoreFingerprints: stored %d of %d fingerprints: %w", len(stored), len(fingerprints), ErrInjectedFault)
+}
+
+func (f *faultyClient) GetCouples(addresses []uint32) (map[uint32][]models.Couple, error) {
+	if err := f.inject("GetCouples"); err != nil {
+		return nil, err
+	}
+	return f.DBClient.GetCouples(addresses)
+}
+
+func (f *faultyClient) TotalSongs() (int, error) {
+	if err := f.inject("TotalSongs"); err != nil {
+		return 0, err
+	}
+	return f.DBClient.TotalSongs()
+}
+
+func (f *faultyClient) RegisterSong(songTitle, songArtist, ytID string) (models.SongID, error) {
+	if err := f.inject("RegisterSong"); err != nil {
+		return 0, err
+	}
+	return f.DBClient.RegisterSong(songTitle, songArtist, ytID)
+}
+
+func (f *faultyClient) GetSong(filterKey string, value interface{}) (Song, bool, error) {
+	if err := f.inject("GetSong"); err != nil {
+		return Song{}, false, err
+	}
+	return f.DBClient.GetSong(filterKey, value)
+}
+
+func (f *faultyClient) GetSongByID(songID models.SongID) (Song, bool, error) {
+	if err := f.inject("GetSongByID"); err != nil {
+		return Song{}, false, err
+	}
+	return f.DBClient.GetSongByID(songID)
+}
+
+func (f *faultyClient) GetSongByYTID(ytID string) (Song, bool, error) {
+	if err := f.inject("GetSongByYTID"); err != nil {
+		return Song{}, false, err
+	}
+	return f.DBClient.GetSongByYTID(ytID)
+}
+
+func (f *faultyClient) GetSongByKey(key string) (Song, bool, error) {
+	if err := f.inject("GetSongByKey"); err != nil {
+		return Song{}, false, err
+	}
+	return f.DBClient.GetSongByKey(key)
+}
+
+func (f *faultyClient) DeleteSongByID(songID models.SongID) error {
+	if err := f.inject("DeleteSongByID"); err != nil {
+		return err
+	}
+	return f.DBClient.DeleteSongByID(songID)
+}
+
+func (f *faultyClient) DeleteCollection(collectionName string) error {
+	if err := f.inject("DeleteCollection"); err != nil {
+		return err
+	}
+	return f.DBClient.DeleteCollection(collectionName)
+}
+
+// failHalfway wraps a ForEach callback so that it fails after a random
+// number of items when a partial failure is drawn.
+func (f *faultyClient) failHalfway(op string) func() error {
+	if !f.partial(op) {
+		return func() error { return nil }
+	}
+
+	remaining := int(f.float() * 1000)
+	return func() error {
+		remaining--
+		if remaining < 0 {
+			return fmt.Errorf("%s: %w", op, ErrInjectedFault)
+		}
+		return nil
+	}
+}
+
+func (f *faultyClient) ForEachSong(fn func(songID models.SongID, song Song) error) error {
+	if err := f.inject("ForEachSong"); err != nil {
+		return err
+	}
+	fail := f.failHalfway("ForEachSong")
+	return f.DBClient.ForEachSong(func(songID models.SongID, song Song) error {
+		if err := fail(); err != nil {
+			return err
+		}
+		return fn(songID, song)
+	})
+}
+
+func (f *faultyClient) ForEachFingerprint(fn func(address uint32, couple models.Couple) error) error {
+	if err := f.inject("ForEachFingerprint"); err != nil {
+		return err
+	}
+	fail := f.failHalfway("ForEachFingerprint")
+	return f.DBClient.ForEachFingerprint(func(address uint32, couple models.Couple) error {
+		if err := fail(); err != nil {
+			return err
+		}
+		return fn(address, couple)
+	})
+}
+
+func (f *faultyClient) StoreSong(songID models.SongID, song Song) error {
+	if err := f.inject("StoreSong"); err != nil {
+		return err
+	}
+	return f.DBClient.StoreSong(songID, song)
+}
+
+func (f *faultyClient) FingerprintSongIDs() ([]models.SongID, error) {
+	if err := f.inject("FingerprintSongIDs"); err != nil {
+		return nil, err
+	}
+	return f.DBClient.FingerprintSongIDs()
+}
+
+func (f *faultyClient) DeleteFingerprintsBySongID(songID models.SongID) error {
+	if err := f.inject("DeleteFingerprintsBySongID"); err != nil {
+		return err
+	}
+	return f.DBClient.DeleteFingerprintsBySongID(songID)
+}
+
+func (f *faultyClient) Compact() error {
+	if err := f.inject("Compact"); err != nil {
+		return err
+	}
+	return f.DBClient.Compact()
+}
+
+func (f *faultyClient) Snapshot(dir string) (string, error) {
+	if err := f.inject("Snapshot"); err != nil {
+		return "", err
+	}
+	return f.DBClient.Snapshot(dir)
+}
+
+func (f *faultyClient) ListSongs(offset, limit int, filter SongFilter) ([]ListedSong, error) {
+	if err := f.inject("ListSongs"); err != nil {
+		return nil, err
+	}
+	return f.DBClient.ListSongs(offset, limit, filter)
+}
+
+func (f *faultyClient) PutRecord(collection string, record Record) error {
+	if err := f.inject("PutRecord"); err != nil {
+		return err
+	}
+	return f.DBClient.PutRecord(collection, record)
+}
+
+func (f *faultyClient) GetRecord(collection, id string) (Record, bool, error) {
+	if err := f.inject("GetRecord"); err != nil {
+		return Record{}, false, err
+	}
+	return f.DBClient.GetRecord(collection, id)
+}
+
+func (f *faultyClient) ListRecords(collection string, filter RecordFilter) ([]Record, error) {
+	if err := f.inject("ListRecords"); err != nil {
+		return nil, err
+	}
+	return f.DBClient.ListRecords(collection, filter)
+}
+
+func (f *faultyClient) DeleteRecord(collection, id string) error {
+	if err := f.inject("DeleteRecord"); err != nil {
+		return err
+	}
+	return f.DBClient.DeleteRecord(collection, id)
+}
@@ -0,0 +1,101 @@
+package db_test
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"song-recognition/db"
+	"song-recognition/db/storagetest"
+	"song-recognition/models"
+	"testing"
+	"time"
+)
+
+func newSQLite(t *testing.T) db.DBClient {
+	client, err := db.NewSQLiteClient(filepath.Join(t.TempDir(), "db.sqlite3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// newMemory returns an in-memory catalog of the test's own, wrapped the way
+// NewDBClient wraps backends.
+func newMemory(t *testing.T) db.DBClient {
+	t.Setenv("MEMORY_DB_NAME", t.Name())
+	client, err := db.NewDBClientFor("memory", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// storeSongs stores a song for each of songIDs.
+func storeSongs(t *testing.T, client db.DBClient, songIDs ...models.SongID) {
+	t.Helper()
+	for _, songID := range songIDs {
+		if err := client.StoreSong(songID, db.Song{Title: fmt.Sprint("Song ", songID), Artist: "Artist"}); err != nil {
+			t.Fatalf("StoreSong: %v", err)
+		}
+	}
+}
+
+func TestFaultsDisabledConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) db.DBClient {
+		return db.WithFaults(newSQLite(t), db.FaultConfig{})
+	})
+}
+
+func TestFaultsErrorRate(t *testing.T) {
+	config, err := db.ParseFaultConfig("error_rate=1,ops=GetCouples,latency=10ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := db.WithFaults(newSQLite(t), config)
+
+	start := time.Now()
+	if _, err := client.GetCouples([]uint32{1}); !errors.Is(err, db.ErrInjectedFault) {
+		t.Fatalf("GetCouples returned %v, want an injected fault", err)
+	}
+	if time.Since(start) < 10*time.Millisecond {
+		t.Error("latency was not injected")
+	}
+	if _, err := client.TotalSongs(); err != nil {
+		t.Errorf("TotalSongs isn't in ops but failed: %v", err)
+	}
+}
+
+func TestFaultsPartialWrite(t *testing.T) {
+	client := db.WithFaults(newSQLite(t), db.FaultConfig{PartialRate: 1, Operations: map[string]bool{"StoreFingerprints": true}})
+
+	fingerprints := make(map[uint32]models.Couple)
+	addresses := make([]uint32, 0, 100)
+	for address := uint32(1); address <= 100; address++ {
+		fingerprints[address] = models.Couple{AnchorTimeMs: address, SongID: 1}
+		addresses = append(addresses, address)
+	}
+
+	if err := client.StoreFingerprints(fingerprints); !errors.Is(err, db.ErrInjectedFault) {
+		t.Fatalf("StoreFingerprints returned %v, want an injected fault", err)
+	}
+
+	couples, err := client.GetCouples(addresses)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored := 0
+	for _, c := range couples {
+		stored += len(c)
+	}
+	if stored == 0 || stored == len(fingerprints) {
+		t.Errorf("partial write stored %d of %d fingerprints", stored, len(fingerprints))
+	}
+}
+
+func TestParseFaultConfigRejectsUnknownSettings(t *testing.T) {
+	if _, err := db.ParseFaultConfig("error_rate=0.1,explode=1"); err == nil {
+		t.Error("unknown setting was accepted")
+	}
+}
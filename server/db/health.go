@@ -0,0 +1,96 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"song-recognition/utils"
+	"sync"
+	"time"
+)
+
+// healthTTL is how long the result of a probe is reused by Available.
+const healthTTL = 5 * time.Second
+
+var errProbeTimeout = errors.New("timed out")
+
+var health struct {
+	sync.Mutex
+	checked   time.Time
+	available bool
+}
+
+// probeTimeout returns how long a probe waits for the backend to answer, from
+// DB_PROBE_TIMEOUT (default 5s).
+func probeTimeout() time.Duration {
+	timeout, err := time.ParseDuration(utils.GetEnv("DB_PROBE_TIMEOUT", "5s"))
+	if err != nil || timeout <= 0 {
+		return 5 * time.Second
+	}
+	return timeout
+}
+
+// Available reports whether the configured backend answers. The result of the
+// last probe is reused for a few seconds, so it is cheap enough to check on
+// every request.
+func Available() bool {
+	health.Lock()
+	if !health.checked.IsZero() && time.Since(health.checked) < healthTTL {
+		available := health.available
+		health.Unlock()
+		return available
+	}
+	health.Unlock()
+
+	return Probe() == nil
+}
+
+// Probe checks now that the configured backend answers a trivial query,
+// returning why it doesn't. The result is reused by Available.
+func Probe() error {
+	result := make(chan error, 1)
+	go func() {
+		client, err := NewDBClient()
+		if err != nil {
+			result <- err
+			return
+		}
+		defer client.Close()
+		_, err = client.TotalSongs()
+		result <- err
+	}()
+
+	var err error
+	select {
+	case err = <-result:
+	case <-time.After(probeTimeout()):
+		err = errProbeTimeout
+	}
+
+	health.Lock()
+	health.checked = time.Now()
+	health.available = err == nil
+	health.Unlock()
+
+	if err != nil {
+		return fmt.Errorf("database unavailable: %v", err)
+	}
+	return nil
+}
+
+// WaitAvailable blocks until the backend answers, probing with a backoff from
+// one second up to a minute. It gives up after maxWait, unless maxWait is 0,
+// and reports whether the backend is available.
+func WaitAvailable(maxWait time.Duration) bool {
+	start := time.Now()
+	delay := time.Second
+	for {
+		if Probe() == nil {
+			return true
+		}
+		if maxWait > 0 && time.Since(start)+delay > maxWait {
+			return false
+		}
+		time.Sleep(delay)
+		delay = min(2*delay, time.Minute)
+	}
+}
@@ -0,0 +1,622 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"song-recognition/models"
+	"song-recognition/utils"
+	"sort"
+	"sync"
+)
+
+// MemoryClient keeps the catalog and records in the memory of the process,
+// for unit tests and demos that shouldn't need a database. Nothing is
+// written to disk but snapshots.
+//
+// Clients opened with the same name share their data, which outlives them
+// until the process exits, as the server opens a client per request.
+type MemoryClient struct {
+	store *memoryStore
+	ctx   context.Context // see WithContext
+}
+
+// memoryStore is the data of the clients of a name. Its lock guards the
+// catalog pointer and everything reachable from it.
+type memoryStore struct {
+	sync.RWMutex
+	catalog *memoryCatalog
+	records map[string]map[string]Record // collection -> ID -> record
+}
+
+// memoryCatalog indexes songs and fingerprints as the other backends do:
+// every address maps to its couples, sorted by anchor time and song ID, and
+// every song to the addresses it has couples at, so that they can be
+// deleted.
+type memoryCatalog struct {
+	songs         map[models.SongID]memorySong
+	songKeys      map[string]models.SongID
+	songYTIDs     map[string]models.SongID
+	fingerprints  map[uint32][]models.Couple
+	songAddresses map[models.SongID]map[uint32]struct{}
+}
+
+type memorySong struct {
+	Song
+	Key string
+}
+
+var memoryStores struct {
+	sync.Mutex
+	stores map[string]*memoryStore
+}
+
+// NewMemoryClient returns a client of the data kept under name, empty the
+// first time the name is used.
+func NewMemoryClient(name string) *MemoryClient {
+	memoryStores.Lock()
+	defer memoryStores.Unlock()
+
+	store, ok := memoryStores.stores[name]
+	if !ok {
+		store = &memoryStore{catalog: newMemoryCatalog(), records: make(map[string]map[string]Record)}
+		if memoryStores.stores == nil {
+			memoryStores.stores = make(map[string]*memoryStore)
+		}
+		memoryStores.stores[name] = store
+	}
+	return &MemoryClient{store: store}
+}
+
+func newMemoryCatalog() *memoryCatalog {
+	return &memoryCatalog{
+		songs:         make(map[models.SongID]memorySong),
+		songKeys:      make(map[string]models.SongID),
+		songYTIDs:     make(map[string]models.SongID),
+		fingerprints:  make(map[uint32][]models.Couple),
+		songAddresses: make(map[models.SongID]map[uint32]struct{}),
+	}
+}
+
+// view runs fn under the read lock of the store, unless ctx is done.
+func (db *MemoryClient) view(ctx context.Context, fn func(store *memoryStore) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	db.store.RLock()
+	defer db.store.RUnlock()
+	return fn(db.store)
+}
+
+// update runs fn under the write lock of the store, unless ctx is done.
+func (db *MemoryClient) update(ctx context.Context, fn func(store *memoryStore) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	db.store.Lock()
+	defer db.store.Unlock()
+	return fn(db.store)
+}
+
+func (db *MemoryClient) withContext(ctx context.Context) DBClient {
+	bound := *db
+	bound.ctx = ctx
+	return &bound
+}
+
+// Close does nothing: the data is kept for the other clients of its name.
+func (db *MemoryClient) Close() error {
+	return nil
+}
+
+func (db *MemoryClient) StoreFingerprints(fingerprints map[uint32]models.Couple) error {
+	_, err := db.addFingerprints(fingerprints)
+	return err
+}
+
+func (db *MemoryClient) addFingerprints(fingerprints map[uint32]models.Couple) (map[uint32]models.Couple, error) {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	var added map[uint32]models.Couple
+	err := db.update(ctx, func(store *memoryStore) error {
+		added = store.catalog.storeFingerprints(fingerprints)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error inserting fingerprints: %v", err)
+	}
+	return added, nil
+}
+
+// storeFingerprints adds couples to the catalog, replacing those of the same
+// address, anchor time and song. It returns the couples that weren't
+// replaced.
+func (c *memoryCatalog) storeFingerprints(fingerprints map[uint32]models.Couple) map[uint32]models.Couple {
+	added := make(map[uint32]models.Couple, len(fingerprints))
+	for address, couple := range fingerprints {
+		couples := c.fingerprints[address]
+		i := sort.Search(len(couples), func(i int) bool { return !coupleBefore(couples[i], couple) })
+		if i < len(couples) && couples[i].AnchorTimeMs == couple.AnchorTimeMs && couples[i].SongID == couple.SongID {
+			couples[i] = couple
+		} else {
+			couples = append(couples, models.Couple{})
+			copy(couples[i+1:], couples[i:])
+			couples[i] = couple
+			added[address] = couple
+		}
+		c.fingerprints[address] = couples
+
+		addresses, ok := c.songAddresses[couple.SongID]
+		if !ok {
+			addresses = make(map[uint32]struct{})
+			c.songAddresses[couple.SongID] = addresses
+		}
+		addresses[address] = struct{}{}
+	}
+	return added
+}
+
+// coupleBefore orders the couples of an address by anchor time and song ID.
+func coupleBefore(a, b models.Couple) bool {
+	return a.AnchorTimeMs < b.AnchorTimeMs || a.AnchorTimeMs == b.AnchorTimeMs && a.SongID < b.SongID
+}
+
+func (db *MemoryClient) GetCouples(addresses []uint32) (map[uint32][]models.Couple, error) {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	couples := make(map[uint32][]models.Couple)
+
+	err := db.view(ctx, func(store *memoryStore) error {
+		for _, address := range addresses {
+			if stored, ok := store.catalog.fingerprints[address]; ok {
+				couples[address] = append([]models.Couple(nil), stored...)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error querying database: %v", err)
+	}
+	return couples, nil
+}
+
+func (db *MemoryClient) TotalSongs() (int, error) {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	var count int
+	err := db.view(ctx, func(store *memoryStore) error {
+		count = len(store.catalog.songs)
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error counting songs: %v", err)
+	}
+	return count, nil
+}
+
+func (db *MemoryClient) RegisterSong(songTitle, songArtist, ytID string) (models.SongID, error) {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+
+	songID := models.NewSongID()
+	song := memorySong{Song: Song{Title: songTitle, Artist: songArtist, YouTubeID: ytID, IngestedAtMs: ingestionTime()}, Key: utils.GenerateSongKey(songTitle, songArtist)}
+	err := db.update(ctx, func(store *memoryStore) error {
+		catalog := store.catalog
+		if _, exists := catalog.songKeys[song.Key]; exists {
+			return fmt.Errorf("song with ytID or key already exists")
+		}
+		if _, exists := catalog.songs[songID]; exists {
+			return fmt.Errorf("song with ytID or key already exists")
+		}
+		catalog.putSong(songID, song)
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to register song: %v", err)
+	}
+	return songID, nil
+}
+
+// putSong stores a song under songID, replacing the song with that ID and
+// any other with the same key.
+func (c *memoryCatalog) putSong(songID models.SongID, song memorySong) {
+	if other, exists := c.songKeys[song.Key]; exists {
+		c.deleteSong(other)
+	}
+	c.deleteSong(songID)
+
+	c.songs[songID] = song
+	c.songKeys[song.Key] = songID
+	if song.YouTubeID != "" {
+		c.songYTIDs[song.YouTubeID] = songID
+	}
+}
+
+// deleteSong deletes a song and the index entries pointing to it.
+func (c *memoryCatalog) deleteSong(songID models.SongID) {
+	song, exists := c.songs[songID]
+	if !exists {
+		return
+	}
+	if c.songKeys[song.Key] == songID {
+		delete(c.songKeys, song.Key)
+	}
+	if id, ok := c.songYTIDs[song.YouTubeID]; ok && id == songID {
+		delete(c.songYTIDs, song.YouTubeID)
+	}
+	delete(c.songs, songID)
+}
+
+// GetSong retrieves a song by filter key
+func (db *MemoryClient) GetSong(filterKey string, value interface{}) (Song, bool, error) {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+
+	if filterKey != "id" && filterKey != "ytID" && filterKey != "key" {
+		return Song{}, false, fmt.Errorf("invalid filter key")
+	}
+
+	var song Song
+	var found bool
+	err := db.view(ctx, func(store *memoryStore) error {
+		catalog := store.catalog
+		var songID models.SongID
+		switch filterKey {
+		case "id":
+			id, err := models.ParseSongID(fmt.Sprint(value))
+			if err != nil {
+				return err
+			}
+			songID = id
+		case "ytID":
+			if songID, found = catalog.songYTIDs[fmt.Sprint(value)]; !found {
+				return nil
+			}
+		case "key":
+			if songID, found = catalog.songKeys[fmt.Sprint(value)]; !found {
+				return nil
+			}
+		}
+
+		stored, exists := catalog.songs[songID]
+		song, found = stored.Song, exists
+		return nil
+	})
+	if err != nil {
+		return Song{}, false, fmt.Errorf("failed to retrieve song: %v", err)
+	}
+	return song, found, nil
+}
+
+func (db *MemoryClient) GetSongByID(songID models.SongID) (Song, bool, error) {
+	return db.GetSong("id", songID)
+}
+
+func (db *MemoryClient) GetSongByYTID(ytID string) (Song, bool, error) {
+	return db.GetSong("ytID", ytID)
+}
+
+func (db *MemoryClient) GetSongByKey(key string) (Song, bool, error) {
+	return db.GetSong("key", key)
+}
+
+// DeleteSongByID deletes a song by ID
+func (db *MemoryClient) DeleteSongByID(songID models.SongID) error {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	err := db.update(ctx, func(store *memoryStore) error {
+		store.catalog.deleteSong(songID)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete song: %v", err)
+	}
+	return nil
+}
+
+// DeleteCollection empties the songs or fingerprints of the catalog, or a
+// collection of records.
+func (db *MemoryClient) DeleteCollection(collectionName string) error {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	err := db.update(ctx, func(store *memoryStore) error {
+		catalog := store.catalog
+		switch collectionName {
+		case "songs":
+			catalog.songs = make(map[models.SongID]memorySong)
+			catalog.songKeys = make(map[string]models.SongID)
+			catalog.songYTIDs = make(map[string]models.SongID)
+		case "fingerprints":
+			catalog.fingerprints = make(map[uint32][]models.Couple)
+			catalog.songAddresses = make(map[models.SongID]map[uint32]struct{})
+		default:
+			delete(store.records, collectionName)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error deleting collection: %v", err)
+	}
+	return nil
+}
+
+// ForEachSong calls fn for every song, in ID order. Songs stored meanwhile
+// may or may not be visited.
+func (db *MemoryClient) ForEachSong(fn func(songID models.SongID, song Song) error) error {
+	ctx := bulkContext(db.ctx)
+
+	var songIDs []models.SongID
+	err := db.view(ctx, func(store *memoryStore) error {
+		songIDs = make([]models.SongID, 0, len(store.catalog.songs))
+		for songID := range store.catalog.songs {
+			songIDs = append(songIDs, songID)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error querying songs: %v", err)
+	}
+	sort.Slice(songIDs, func(i, j int) bool { return songIDs[i] < songIDs[j] })
+
+	// fn is called without the lock, so that it can write to the store
+	for _, songID := range songIDs {
+		var song memorySong
+		var exists bool
+		err := db.view(ctx, func(store *memoryStore) error {
+			song, exists = store.catalog.songs[songID]
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("error querying songs: %v", err)
+		}
+		if !exists {
+			continue
+		}
+		if err := fn(songID, song.Song); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *MemoryClient) ListSongs(offset, limit int, filter SongFilter) ([]ListedSong, error) {
+	return listSongs(db.ForEachSong, offset, limit, filter)
+}
+
+// ForEachFingerprint calls fn for every couple, in address, anchor time and
+// song ID order
+func (db *MemoryClient) ForEachFingerprint(fn func(address uint32, couple models.Couple) error) error {
+	ctx := bulkContext(db.ctx)
+
+	var addresses []uint32
+	err := db.view(ctx, func(store *memoryStore) error {
+		addresses = make([]uint32, 0, len(store.catalog.fingerprints))
+		for address := range store.catalog.fingerprints {
+			addresses = append(addresses, address)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error querying fingerprints: %v", err)
+	}
+	sort.Slice(addresses, func(i, j int) bool { return addresses[i] < addresses[j] })
+
+	for _, address := range addresses {
+		var couples []models.Couple
+		err := db.view(ctx, func(store *memoryStore) error {
+			couples = append(couples[:0], store.catalog.fingerprints[address]...)
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("error querying fingerprints: %v", err)
+		}
+		for _, couple := range couples {
+			if err := fn(address, couple); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// StoreSong stores a song under the given ID, replacing any song with that ID
+func (db *MemoryClient) StoreSong(songID models.SongID, song Song) error {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	err := db.update(ctx, func(store *memoryStore) error {
+		store.catalog.putSong(songID, memorySong{Song: song, Key: utils.GenerateSongKey(song.Title, song.Artist)})
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to store song: %v", err)
+	}
+	return nil
+}
+
+// FingerprintSongIDs returns the distinct song IDs referenced by fingerprints
+func (db *MemoryClient) FingerprintSongIDs() ([]models.SongID, error) {
+	ctx := bulkContext(db.ctx)
+	var songIDs []models.SongID
+	err := db.view(ctx, func(store *memoryStore) error {
+		for songID := range store.catalog.songAddresses {
+			songIDs = append(songIDs, songID)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error querying song IDs: %v", err)
+	}
+	sort.Slice(songIDs, func(i, j int) bool { return songIDs[i] < songIDs[j] })
+	return songIDs, nil
+}
+
+// DeleteFingerprintsBySongID deletes all couples of a song
+func (db *MemoryClient) DeleteFingerprintsBySongID(songID models.SongID) error {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	err := db.update(ctx, func(store *memoryStore) error {
+		catalog := store.catalog
+		for address := range catalog.songAddresses[songID] {
+			var kept []models.Couple
+			for _, couple := range catalog.fingerprints[address] {
+				if couple.SongID != songID {
+					kept = append(kept, couple)
+				}
+			}
+			if len(kept) == 0 {
+				delete(catalog.fingerprints, address)
+			} else {
+				catalog.fingerprints[address] = kept
+			}
+		}
+		delete(catalog.songAddresses, songID)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete fingerprints: %v", err)
+	}
+	return nil
+}
+
+// Compact does nothing, as deleted data is left to the garbage collector.
+func (db *MemoryClient) Compact() error {
+	return nil
+}
+
+// Snapshot dumps the songs and fingerprints into a gzipped file of JSON
+// lines, one row per line, which is the only way to keep them past the
+// process. Songs and fingerprints stored meanwhile may or may not be
+// included.
+func (db *MemoryClient) Snapshot(dir string) (string, error) {
+	return writeJSONSnapshot(dir, func(emit func(table string, row interface{}) error) error {
+		err := db.ForEachSong(func(songID models.SongID, song Song) error {
+			return emit("songs", snapshotSong(songID, song, utils.GenerateSongKey(song.Title, song.Artist)))
+		})
+		if err != nil {
+			return fmt.Errorf("failed to read songs: %v", err)
+		}
+		return db.ForEachFingerprint(func(address uint32, couple models.Couple) error {
+			return emit("fingerprints", map[string]interface{}{
+				"address": address, "anchorTimeMs": couple.AnchorTimeMs, "songID": couple.SongID, "peak": couple.PeakCode(),
+			})
+		})
+	})
+}
+
+func (db *MemoryClient) PutRecord(collection string, record Record) error {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	record.CreatedAt = record.CreatedAt.UTC()
+	record.Data = bytes.Clone(record.Data)
+	err := db.update(ctx, func(store *memoryStore) error {
+		records, ok := store.records[collection]
+		if !ok {
+			records = make(map[string]Record)
+			store.records[collection] = records
+		}
+		records[record.ID] = record
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to store record: %v", err)
+	}
+	return nil
+}
+
+func (db *MemoryClient) GetRecord(collection, id string) (Record, bool, error) {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	var record Record
+	var found bool
+	err := db.view(ctx, func(store *memoryStore) error {
+		record, found = store.records[collection][id]
+		record.Data = bytes.Clone(record.Data)
+		return nil
+	})
+	if err != nil {
+		return Record{}, false, fmt.Errorf("failed to retrieve record: %v", err)
+	}
+	return record, found, nil
+}
+
+func (db *MemoryClient) ListRecords(collection string, filter RecordFilter) ([]Record, error) {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	var records []Record
+	err := db.view(ctx, func(store *memoryStore) error {
+		for _, record := range store.records[collection] {
+			if filter.ClientID != "" && record.ClientID != filter.ClientID ||
+				!filter.Since.IsZero() && record.CreatedAt.Before(filter.Since) ||
+				!filter.Until.IsZero() && !record.CreatedAt.Before(filter.Until) {
+				continue
+			}
+			record.Data = bytes.Clone(record.Data)
+			records = append(records, record)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list records: %v", err)
+	}
+
+	// Records of the same time are listed in ID order, as map order is random
+	sort.Slice(records, func(i, j int) bool {
+		a, b := records[i], records[j]
+		return a.CreatedAt.Before(b.CreatedAt) || a.CreatedAt.Equal(b.CreatedAt) && a.ID < b.ID
+	})
+	if filter.Limit > 0 && len(records) > filter.Limit {
+		records = records[:filter.Limit]
+	}
+	return records, nil
+}
+
+func (db *MemoryClient) DeleteRecord(collection, id string) error {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	err := db.update(ctx, func(store *memoryStore) error {
+		delete(store.records[collection], id)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete record: %v", err)
+	}
+	return nil
+}
+
+// memoryStaging loads a catalog beside the live one of a store.
+type memoryStaging struct {
+	store   *memoryStore
+	catalog *memoryCatalog
+}
+
+func (db *MemoryClient) stageCatalog() (StagedCatalog, error) {
+	return &memoryStaging{store: db.store, catalog: newMemoryCatalog()}, nil
+}
+
+// Staged catalogs are written under the lock of their store, as staged
+// writes may be concurrent.
+func (s *memoryStaging) StoreSong(songID models.SongID, song Song) error {
+	s.store.Lock()
+	defer s.store.Unlock()
+	s.catalog.putSong(songID, memorySong{Song: song, Key: utils.GenerateSongKey(song.Title, song.Artist)})
+	return nil
+}
+
+func (s *memoryStaging) StoreFingerprints(fingerprints map[uint32]models.Couple) error {
+	s.store.Lock()
+	defer s.store.Unlock()
+	s.catalog.storeFingerprints(fingerprints)
+	return nil
+}
+
+// Promote makes the staged catalog the live one at once.
+func (s *memoryStaging) Promote() error {
+	s.store.Lock()
+	defer s.store.Unlock()
+	s.store.catalog = s.catalog
+	return nil
+}
+
+func (s *memoryStaging) Discard() error {
+	return nil
+}
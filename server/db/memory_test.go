@@ -0,0 +1,64 @@
+package db_test
+
+import (
+	"song-recognition/db"
+	"song-recognition/db/storagetest"
+	"song-recognition/models"
+	"testing"
+)
+
+func TestMemoryConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) db.DBClient {
+		return db.NewMemoryClient(t.Name())
+	})
+}
+
+func TestMemorySharedAndStaged(t *testing.T) {
+	client := db.NewMemoryClient(t.Name())
+	defer client.Close()
+	live := db.Song{Title: "Live", Artist: "Artist", YouTubeID: "ytid0000001"}
+	if err := client.StoreSong(1, live); err != nil {
+		t.Fatalf("StoreSong: %v", err)
+	}
+	client.Close()
+
+	// Clients of the same name share their data, even once others are closed
+	other := db.NewMemoryClient(t.Name())
+	defer other.Close()
+	if got, exists, err := other.GetSongByID(1); err != nil || !exists || got != live {
+		t.Errorf("GetSongByID = %+v, %v, %v; want %+v", got, exists, err, live)
+	}
+	if _, exists, _ := db.NewMemoryClient(t.Name() + "/other").GetSongByID(1); exists {
+		t.Error("clients of another name share the song")
+	}
+
+	staged, err := db.StageCatalog(other)
+	if err != nil {
+		t.Fatalf("StageCatalog: %v", err)
+	}
+	song := db.Song{Title: "Staged", Artist: "Artist", YouTubeID: "ytid0000002"}
+	couple := models.Couple{AnchorTimeMs: 1500, SongID: 2}
+	if err := staged.StoreSong(2, song); err != nil {
+		t.Fatalf("StoreSong: %v", err)
+	}
+	if err := staged.StoreFingerprints(map[uint32]models.Couple{7: couple}); err != nil {
+		t.Fatalf("StoreFingerprints: %v", err)
+	}
+	if _, exists, _ := other.GetSongByID(2); exists {
+		t.Error("staged song is live before promotion")
+	}
+	if err := staged.Promote(); err != nil {
+		t.Fatalf("Promote: %v", err)
+	}
+
+	if _, exists, _ := other.GetSongByID(1); exists {
+		t.Error("promotion kept the song of the replaced catalog")
+	}
+	if got, exists, err := other.GetSongByID(2); err != nil || !exists || got != song {
+		t.Errorf("GetSongByID = %+v, %v, %v; want %+v", got, exists, err, song)
+	}
+	couples, err := other.GetCouples([]uint32{7})
+	if err != nil || len(couples[7]) != 1 || couples[7][0] != couple {
+		t.Errorf("GetCouples = %v, %v; want [%v]", couples[7], err, couple)
+	}
+}
@@ -1,107 +1,253 @@
 package db
 
 import (
+	"compress/gzip"
 	"context"
 	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
 	"song-recognition/models"
 	"song-recognition/utils"
 	"strings"
+	"sync"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+// mongoBatchSize is the default number of addresses upserted per bulk
+// write by StoreFingerprints.
+const mongoBatchSize = 1000
+
+// mongoLookupBatch is the number of addresses GetCouples looks up per $in
+// query.
+const mongoLookupBatch = 1000
+
 type MongoClient struct {
 	client *mongo.Client
+	caps   mongoCapabilities
+	// batchSize is the number of addresses per bulk write, mongoBatchSize
+	// if zero.
+	batchSize int
+	// ctx is the context operations run under, see WithContext.
+	ctx context.Context
+
+	// reads is the database GetCouples reads from, with the read preference
+	// of the routing.
+	reads *mongo.Database
+}
+
+var mongoConnections struct {
+	sync.Mutex
+	clients map[string]*mongo.Client
 }
 
-func NewMongoClient(uri string) (*MongoClient, error) {
+// mongoConnection returns the connection to uri, shared by every client of
+// the process so that its pool bounds the connections of the whole process.
+// It is made with opts the first time the process connects to uri; later
+// options are ignored.
+func mongoConnection(uri string, opts MongoOptions) (*mongo.Client, error) {
+	mongoConnections.Lock()
+	defer mongoConnections.Unlock()
+
+	if client, ok := mongoConnections.clients[uri]; ok {
+		return client, nil
+	}
 	clientOptions := options.Client().ApplyURI(uri)
+	opts.apply(clientOptions)
 	client, err := mongo.Connect(context.Background(), clientOptions)
+	if err != nil {
+		return nil, err
+	}
+	if mongoConnections.clients == nil {
+		mongoConnections.clients = make(map[string]*mongo.Client)
+	}
+	mongoConnections.clients[uri] = client
+	return client, nil
+}
+
+// NewMongoClient connects to uri with opts, reading fingerprints as routing
+// says. The connections are those of the process, see mongoConnection.
+func NewMongoClient(uri string, routing ReadRouting, opts MongoOptions) (*MongoClient, error) {
+	flavor := mongoFlavorFromURI(uri)
+	if flavor == FlavorDocumentDB {
+		if opts.RetryWrites != nil && *opts.RetryWrites {
+			return nil, fmt.Errorf("MONGO_RETRY_WRITES isn't supported by DocumentDB")
+		}
+		retryWrites := false
+		opts.RetryWrites = &retryWrites
+	}
+
+	client, err := mongoConnection(uri, opts)
 	if err != nil {
 		return nil, fmt.Errorf("error connecting to MongoDB: %s", err)
 	}
-	return &MongoClient{client: client}, nil
+
+	db := &MongoClient{client: client}
+	if caps, ok := detectedCapabilities.Load(uri); ok {
+		db.caps = caps.(mongoCapabilities)
+	} else {
+		db.caps, err = detectCapabilities(client, flavor)
+		if err == nil {
+			err = ensureIndexes(client)
+		}
+		if err != nil {
+			return nil, err
+		}
+		detectedCapabilities.Store(uri, db.caps)
+	}
+
+	if err := db.connectReads(routing, opts); err != nil {
+		return nil, err
+	}
+	return db, nil
 }
 
+func (db *MongoClient) withContext(ctx context.Context) DBClient {
+	bound := *db
+	bound.ctx = ctx
+	return &bound
+}
+
+// Close leaves the connections open for the other clients of the process.
 func (db *MongoClient) Close() error {
-	if db.client != nil {
-		return db.client.Disconnect(context.Background())
-	}
 	return nil
 }
 
 func (db *MongoClient) StoreFingerprints(fingerprints map[uint32]models.Couple) error {
-	collection := db.client.Database("song-recognition").Collection("fingerprints")
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	return storeMongoFingerprints(ctx, db.client.Database("song-recognition").Collection("fingerprints"), fingerprints, db.batchSize)
+}
+
+// storeMongoFingerprints upserts the couples with unordered bulk writes of
+// batchSize addresses. A failed batch doesn't stop the others; the error
+// reports every batch that failed. Retrying is safe since upserts are
+// idempotent.
+func storeMongoFingerprints(ctx context.Context, collection *mongo.Collection, fingerprints map[uint32]models.Couple, batchSize int) error {
+	if batchSize <= 0 {
+		batchSize = mongoBatchSize
+	}
+	batches := (len(fingerprints) + batchSize - 1) / batchSize
+	writes := make([]mongo.WriteModel, 0, min(batchSize, len(fingerprints)))
+	opts := options.BulkWrite().SetOrdered(false)
+
+	var errs []error
+	batch := 0
+	flush := func() {
+		batch++
+		if _, err := collection.BulkWrite(ctx, writes, opts); err != nil {
+			errs = append(errs, fmt.Errorf("batch %d of %d: %w", batch, batches, describeBulkWriteError(err, len(writes))))
+		}
+		writes = writes[:0]
+	}
 
 	for address, couple := range fingerprints {
-		filter := bson.M{"_id": address}
-		update := bson.M{
-			"$push": bson.M{
-				"couples": bson.M{
-					"anchorTimeMs": couple.AnchorTimeMs,
-					"songID":       couple.SongID,
-				},
-			},
-		}
-		opts := options.Update().SetUpsert(true)
-
-		_, err := collection.UpdateOne(context.Background(), filter, update, opts)
-		if err != nil {
-			return fmt.Errorf("error upserting document: %s", err)
+		// An ordered document, since $addToSet only matches embedded
+		// documents with their fields in the same order and maps are
+		// encoded in random order
+		entry := bson.D{
+			{Key: "anchorTimeMs", Value: couple.AnchorTimeMs},
+			{Key: "songID", Value: couple.SongID},
+		}
+		// Version 1 couples keep the documents they always had
+		if peak := couple.PeakCode(); peak != 0 {
+			entry = append(entry, bson.E{Key: "peak", Value: int64(peak)})
 		}
+		// $addToSet keeps re-ingesting the same fingerprints idempotent
+		update := bson.M{"$addToSet": bson.M{"couples": entry}}
+		writes = append(writes, mongo.NewUpdateOneModel().SetFilter(bson.M{"_id": address}).SetUpdate(update).SetUpsert(true))
+		if len(writes) == batchSize {
+			flush()
+		}
+	}
+	if len(writes) > 0 {
+		flush()
 	}
 
+	if len(errs) > 0 {
+		return fmt.Errorf("error upserting fingerprints, %d of %d batches failed: %w", len(errs), batches, errors.Join(errs...))
+	}
 	return nil
 }
 
+// describeBulkWriteError summarizes the failure of a bulk write of n
+// upserts: how many failed and the first reason, or the error itself when
+// the whole write failed.
+func describeBulkWriteError(err error, n int) error {
+	var bulkErr mongo.BulkWriteException
+	if !errors.As(err, &bulkErr) || len(bulkErr.WriteErrors) == 0 {
+		return err
+	}
+	return fmt.Errorf("%d of %d upserts failed, first: %s", len(bulkErr.WriteErrors), n, bulkErr.WriteErrors[0].Message)
+}
+
 func (db *MongoClient) GetCouples(addresses []uint32) (map[uint32][]models.Couple, error) {
-	collection := db.client.Database("song-recognition").Collection("fingerprints")
+	collection := db.reads.Collection("fingerprints")
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
 
 	couples := make(map[uint32][]models.Couple)
 
-	for _, address := range addresses {
-		// Find the document corresponding to the address
-		var result bson.M
-		err := collection.FindOne(context.Background(), bson.M{"_id": address}).Decode(&result)
-		if err != nil {
-			if err == mongo.ErrNoDocuments {
-				continue
-			}
-			return nil, fmt.Errorf("error retrieving document for address %d: %s", address, err)
-		}
+	// Look the addresses up by chunks rather than one round trip each
+	for start := 0; start < len(addresses); start += mongoLookupBatch {
+		batch := addresses[start:min(start+mongoLookupBatch, len(addresses))]
 
-		// Extract couples from the document and append them to the couples map
-		var docCouples []models.Couple
-		couplesList, ok := result["couples"].(primitive.A)
-		if !ok {
-			return nil, fmt.Errorf("couples field in document for address %d is not valid", address)
+		cursor, err := collection.Find(ctx, bson.M{"_id": bson.M{"$in": batch}})
+		if err != nil {
+			return nil, fmt.Errorf("error retrieving documents: %w", err)
 		}
-
-		for _, item := range couplesList {
-			itemMap, ok := item.(primitive.M)
-			if !ok {
-				return nil, fmt.Errorf("invalid couple format in document for address %d", address)
+		for cursor.Next(ctx) {
+			var doc mongoFingerprint
+			if err := cursor.Decode(&doc); err != nil {
+				cursor.Close(ctx)
+				return nil, fmt.Errorf("error decoding fingerprint: %w", err)
 			}
-
-			couple := models.Couple{
-				AnchorTimeMs: uint32(itemMap["anchorTimeMs"].(int64)),
-				SongID:       uint32(itemMap["songID"].(int64)),
+			address := uint32(doc.Address)
+			for _, couple := range doc.Couples {
+				couples[address] = append(couples[address], couple.couple())
 			}
-			docCouples = append(docCouples, couple)
 		}
-		couples[address] = docCouples
+		err = cursor.Err()
+		cursor.Close(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("error retrieving documents: %w", err)
+		}
 	}
 
 	return couples, nil
 }
 
+// mongoFingerprint is the document of an address of the fingerprints
+// collection.
+type mongoFingerprint struct {
+	Address int64         `bson:"_id"`
+	Couples []mongoCouple `bson:"couples"`
+}
+
+// mongoCouple is a couple of a fingerprint document. Peak is only stored for
+// version 2 couples.
+type mongoCouple struct {
+	AnchorTimeMs int64 `bson:"anchorTimeMs"`
+	SongID       int64 `bson:"songID"`
+	Peak         int64 `bson:"peak"`
+}
+
+func (c mongoCouple) couple() models.Couple {
+	couple := models.Couple{AnchorTimeMs: uint32(c.AnchorTimeMs), SongID: models.SongID(c.SongID)}
+	couple.SetPeakCode(uint16(c.Peak))
+	return couple
+}
+
 func (db *MongoClient) TotalSongs() (int, error) {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
 	existingSongsCollection := db.client.Database("song-recognition").Collection("songs")
-	total, err := existingSongsCollection.CountDocuments(context.Background(), bson.D{})
+	total, err := existingSongsCollection.CountDocuments(ctx, bson.D{})
 	if err != nil {
 		return 0, err
 	}
@@ -109,25 +255,20 @@ func (db *MongoClient) TotalSongs() (int, error) {
 	return int(total), nil
 }
 
-func (db *MongoClient) RegisterSong(songTitle, songArtist, ytID string) (uint32, error) {
+func (db *MongoClient) RegisterSong(songTitle, songArtist, ytID string) (models.SongID, error) {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
 	existingSongsCollection := db.client.Database("song-recognition").Collection("songs")
 
-	// Create a compound unique index on ytID and key, if it doesn't already exist
-	indexModel := mongo.IndexModel{
-		Keys:    bson.D{{"ytID", 1}, {"key", 1}},
-		Options: options.Index().SetUnique(true),
-	}
-	_, err := existingSongsCollection.Indexes().CreateOne(context.Background(), indexModel)
-	if err != nil {
-		return 0, fmt.Errorf("failed to create unique index: %v", err)
-	}
-
 	// Attempt to insert the song with ytID and key
-	songID := utils.GenerateUniqueID()
+	songID := models.NewSongID()
 	key := utils.GenerateSongKey(songTitle, songArtist)
-	_, err = existingSongsCollection.InsertOne(context.Background(), bson.M{"_id": songID, "key": key, "ytID": ytID})
+	_, err := existingSongsCollection.InsertOne(ctx, bson.M{
+		"_id": songID, "key": key, "ytID": ytID, "ingestedAtMs": ingestionTime(),
+		"titleSort": strings.ToLower(songTitle), "artistSort": strings.ToLower(songArtist),
+	})
 	if err != nil {
-		if mongo.IsDuplicateKeyError(err) {
+		if isDuplicateKeyError(err) {
 			return 0, fmt.Errorf("song with ytID or key already exists: %v", err)
 		} else {
 			return 0, fmt.Errorf("failed to register song: %v", err)
@@ -139,17 +280,53 @@ func (db *MongoClient) RegisterSong(songTitle, songArtist, ytID string) (uint32,
 
 var mongofilterKeys = "_id | ytID | key"
 
+// mongoSong is a document of the songs collection. Its title and artist are
+// kept in its key, and lowercased in TitleSort and ArtistSort to list songs
+// by, since not every MongoDB compatible server supports collations.
+type mongoSong struct {
+	ID           int64  `bson:"_id"`
+	Key          string `bson:"key"`
+	YtID         string `bson:"ytID"`
+	Album        string `bson:"album,omitempty"`
+	DurationMs   int64  `bson:"durationMs,omitempty"`
+	ReleaseYear  int    `bson:"releaseYear,omitempty"`
+	Genre        string `bson:"genre,omitempty"`
+	CoverArtURL  string `bson:"coverArtUrl,omitempty"`
+	IngestedAtMs int64  `bson:"ingestedAtMs,omitempty"`
+	TitleSort    string `bson:"titleSort"`
+	ArtistSort   string `bson:"artistSort"`
+}
+
+func (doc mongoSong) song() Song {
+	title, artist, _ := strings.Cut(doc.Key, "---")
+	return Song{
+		Title:     title,
+		Artist:    artist,
+		YouTubeID: doc.YtID,
+		SongDetails: SongDetails{
+			Album:       doc.Album,
+			DurationMs:  doc.DurationMs,
+			ReleaseYear: doc.ReleaseYear,
+			Genre:       doc.Genre,
+			CoverArtURL: doc.CoverArtURL,
+		},
+		IngestedAtMs: doc.IngestedAtMs,
+	}
+}
+
 func (db *MongoClient) GetSong(filterKey string, value interface{}) (s Song, songExists bool, e error) {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
 	if !strings.Contains(mongofilterKeys, filterKey) {
 		return Song{}, false, errors.New("invalid filter key")
 	}
 
 	songsCollection := db.client.Database("song-recognition").Collection("songs")
-	var song bson.M
+	var song mongoSong
 
 	filter := bson.M{filterKey: value}
 
-	err := songsCollection.FindOne(context.Background(), filter).Decode(&song)
+	err := songsCollection.FindOne(ctx, filter).Decode(&song)
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
 			return Song{}, false, nil
@@ -157,16 +334,10 @@ func (db *MongoClient) GetSong(filterKey string, value interface{}) (s Song, son
 		return Song{}, false, fmt.Errorf("failed to retrieve song: %v", err)
 	}
 
-	ytID := song["ytID"].(string)
-	title := strings.Split(song["key"].(string), "---")[0]
-	artist := strings.Split(song["key"].(string), "---")[1]
-
-	songInstance := Song{title, artist, ytID}
-
-	return songInstance, true, nil
+	return song.song(), true, nil
 }
 
-func (db *MongoClient) GetSongByID(songID uint32) (Song, bool, error) {
+func (db *MongoClient) GetSongByID(songID models.SongID) (Song, bool, error) {
 	return db.GetSong("_id", songID)
 }
 
@@ -178,12 +349,14 @@ func (db *MongoClient) GetSongByKey(key string) (Song, bool, error) {
 	return db.GetSong("key", key)
 }
 
-func (db *MongoClient) DeleteSongByID(songID uint32) error {
+func (db *MongoClient) DeleteSongByID(songID models.SongID) error {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
 	songsCollection := db.client.Database("song-recognition").Collection("songs")
 
 	filter := bson.M{"_id": songID}
 
-	_, err := songsCollection.DeleteOne(context.Background(), filter)
+	_, err := songsCollection.DeleteOne(ctx, filter)
 	if err != nil {
 		return fmt.Errorf("failed to delete song: %v", err)
 	}
@@ -192,10 +365,407 @@ func (db *MongoClient) DeleteSongByID(songID uint32) error {
 }
 
 func (db *MongoClient) DeleteCollection(collectionName string) error {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
 	collection := db.client.Database("song-recognition").Collection(collectionName)
-	err := collection.Drop(context.Background())
+	err := collection.Drop(ctx)
 	if err != nil {
 		return fmt.Errorf("error deleting collection: %v", err)
 	}
+	// The indexes are only ensured once per URI, so they go with the
+	// collection unless created again
+	if collectionName == "songs" {
+		return ensureSongIndexes(collection)
+	}
+	return nil
+}
+
+func (db *MongoClient) ForEachSong(fn func(songID models.SongID, song Song) error) error {
+	collection := db.client.Database("song-recognition").Collection("songs")
+	ctx := bulkContext(db.ctx)
+
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}})
+	cursor, err := collection.Find(ctx, bson.D{}, opts)
+	if err != nil {
+		return fmt.Errorf("error querying songs: %v", err)
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var doc mongoSong
+		if err := cursor.Decode(&doc); err != nil {
+			return fmt.Errorf("error decoding song: %v", err)
+		}
+		if err := fn(models.SongID(doc.ID), doc.song()); err != nil {
+			return err
+		}
+	}
+
+	return cursor.Err()
+}
+
+func (db *MongoClient) ListSongs(offset, limit int, filter SongFilter) ([]ListedSong, error) {
+	if err := checkSongList(offset, limit, filter); err != nil {
+		return nil, err
+	}
+	collection := db.client.Database("song-recognition").Collection("songs")
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+
+	query := bson.M{}
+	if filter.Artist != "" {
+		query["artistSort"] = bson.M{"$regex": regexp.QuoteMeta(strings.ToLower(filter.Artist))}
+	}
+	order := 1
+	if filter.Descending {
+		order = -1
+	}
+	sortBy := bson.D{{Key: "titleSort", Value: order}, {Key: "artistSort", Value: order}, {Key: "_id", Value: order}}
+	if filter.OrderBy == SongsByIngestion {
+		sortBy = bson.D{{Key: "ingestedAtMs", Value: order}, {Key: "_id", Value: order}}
+	}
+	opts := options.Find().SetSort(sortBy).SetSkip(int64(offset))
+	if limit > 0 {
+		opts.SetLimit(int64(limit))
+	}
+
+	cursor, err := collection.Find(ctx, query, opts)
+	if err != nil {
+		return nil, fmt.Errorf("error listing songs: %v", err)
+	}
+	defer cursor.Close(ctx)
+
+	var songs []ListedSong
+	for cursor.Next(ctx) {
+		var doc mongoSong
+		if err := cursor.Decode(&doc); err != nil {
+			return nil, fmt.Errorf("error decoding song: %v", err)
+		}
+		songs = append(songs, ListedSong{ID: models.SongID(doc.ID), Song: doc.song()})
+	}
+
+	return songs, cursor.Err()
+}
+
+func (db *MongoClient) ForEachFingerprint(fn func(address uint32, couple models.Couple) error) error {
+	collection := db.client.Database("song-recognition").Collection("fingerprints")
+	ctx := bulkContext(db.ctx)
+
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}})
+	cursor, err := collection.Find(ctx, bson.D{}, opts)
+	if err != nil {
+		return fmt.Errorf("error querying fingerprints: %v", err)
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var doc mongoFingerprint
+		if err := cursor.Decode(&doc); err != nil {
+			return fmt.Errorf("error decoding fingerprint: %v", err)
+		}
+		for _, couple := range doc.Couples {
+			if err := fn(uint32(doc.Address), couple.couple()); err != nil {
+				return err
+			}
+		}
+	}
+
+	return cursor.Err()
+}
+
+func (db *MongoClient) StoreSong(songID models.SongID, song Song) error {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	return storeMongoSong(ctx, db.client.Database("song-recognition").Collection("songs"), songID, song)
+}
+
+func storeMongoSong(ctx context.Context, collection *mongo.Collection, songID models.SongID, song Song) error {
+	doc := mongoSong{
+		ID:           int64(songID),
+		Key:          utils.GenerateSongKey(song.Title, song.Artist),
+		YtID:         song.YouTubeID,
+		Album:        song.Album,
+		DurationMs:   song.DurationMs,
+		ReleaseYear:  song.ReleaseYear,
+		Genre:        song.Genre,
+		CoverArtURL:  song.CoverArtURL,
+		IngestedAtMs: song.IngestedAtMs,
+		TitleSort:    strings.ToLower(song.Title),
+		ArtistSort:   strings.ToLower(song.Artist),
+	}
+	opts := options.Replace().SetUpsert(true)
+	_, err := collection.ReplaceOne(ctx, bson.M{"_id": songID}, doc, opts)
+	if err != nil {
+		return fmt.Errorf("failed to store song: %v", err)
+	}
+	return nil
+}
+
+func (db *MongoClient) FingerprintSongIDs() ([]models.SongID, error) {
+	ctx := bulkContext(db.ctx)
+	collection := db.client.Database("song-recognition").Collection("fingerprints")
+
+	values, err := collection.Distinct(ctx, "couples.songID", bson.D{})
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving song IDs: %v", err)
+	}
+
+	songIDs := make([]models.SongID, 0, len(values))
+	for _, value := range values {
+		switch v := value.(type) {
+		case int64:
+			songIDs = append(songIDs, models.SongID(v))
+		case int32:
+			songIDs = append(songIDs, models.SongID(v))
+		}
+	}
+
+	return songIDs, nil
+}
+
+// DeleteFingerprintsBySongID pulls the song's couples from every address
+// document and removes the documents left without couples.
+func (db *MongoClient) DeleteFingerprintsBySongID(songID models.SongID) error {
+	collection := db.client.Database("song-recognition").Collection("fingerprints")
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+
+	return db.withTransaction(ctx, func(ctx context.Context) error {
+		filter := bson.M{"couples.songID": songID}
+		update := bson.M{"$pull": bson.M{"couples": bson.M{"songID": songID}}}
+		_, err := collection.UpdateMany(ctx, filter, update)
+		if err != nil {
+			return fmt.Errorf("failed to delete fingerprints: %v", err)
+		}
+
+		_, err = collection.DeleteMany(ctx, bson.M{"couples": bson.M{"$size": 0}})
+		if err != nil {
+			return fmt.Errorf("failed to delete empty fingerprint documents: %v", err)
+		}
+
+		return nil
+	})
+}
+
+// Compact is a no-op on managed services, which reclaim space themselves and
+// don't support the compact command.
+func (db *MongoClient) Compact() error {
+	ctx := bulkContext(db.ctx)
+	if !db.caps.Compact {
+		return nil
+	}
+
+	database := db.client.Database("song-recognition")
+
+	for _, collectionName := range []string{"fingerprints", "songs"} {
+		err := database.RunCommand(ctx, bson.D{{Key: "compact", Value: collectionName}}).Err()
+		if err != nil {
+			return fmt.Errorf("failed to compact %s: %v", collectionName, err)
+		}
+	}
+
+	return nil
+}
+
+// Snapshot dumps the songs and fingerprints collections into a gzipped file
+// of extended JSON lines, one document per line.
+func (db *MongoClient) Snapshot(dir string) (string, error) {
+	err := utils.CreateFolder(dir)
+	if err != nil {
+		return "", fmt.Errorf("failed to create snapshot dir: %v", err)
+	}
+
+	path := filepath.Join(dir, fmt.Sprintf("snapshot_%s.jsonl.gz", time.Now().UTC().Format("20060102T150405")))
+	file, err := os.Create(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to create snapshot file: %v", err)
+	}
+	defer file.Close()
+
+	gz := gzip.NewWriter(file)
+	database := db.client.Database("song-recognition")
+	ctx := bulkContext(db.ctx)
+
+	for _, collectionName := range []string{"songs", "fingerprints"} {
+		cursor, err := database.Collection(collectionName).Find(ctx, bson.D{})
+		if err != nil {
+			return "", fmt.Errorf("failed to read %s: %v", collectionName, err)
+		}
+
+		for cursor.Next(ctx) {
+			line, err := bson.MarshalExtJSON(bson.M{"collection": collectionName, "doc": cursor.Current}, true, false)
+			if err != nil {
+				cursor.Close(ctx)
+				return "", fmt.Errorf("failed to encode document: %v", err)
+			}
+			if _, err := gz.Write(append(line, '\n')); err != nil {
+				cursor.Close(ctx)
+				return "", fmt.Errorf("failed to write snapshot: %v", err)
+			}
+		}
+		err = cursor.Err()
+		cursor.Close(ctx)
+		if err != nil {
+			return "", fmt.Errorf("failed to read %s: %v", collectionName, err)
+		}
+	}
+
+	if err := gz.Close(); err != nil {
+		return "", fmt.Errorf("failed to write snapshot: %v", err)
+	}
+
+	return path, nil
+}
+
+type mongoRecord struct {
+	ID        string    `bson:"_id"`
+	ClientID  string    `bson:"clientID"`
+	CreatedAt time.Time `bson:"createdAt"`
+	Data      string    `bson:"data"`
+}
+
+func (r mongoRecord) toRecord() Record {
+	return Record{ID: r.ID, ClientID: r.ClientID, CreatedAt: r.CreatedAt.UTC(), Data: []byte(r.Data)}
+}
+
+func (db *MongoClient) PutRecord(collection string, record Record) error {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	coll := db.client.Database("song-recognition").Collection(collection)
+
+	doc := mongoRecord{record.ID, record.ClientID, record.CreatedAt, string(record.Data)}
+	opts := options.Replace().SetUpsert(true)
+	_, err := coll.ReplaceOne(ctx, bson.M{"_id": record.ID}, doc, opts)
+	if err != nil {
+		return fmt.Errorf("failed to store record: %v", err)
+	}
+	return nil
+}
+
+func (db *MongoClient) GetRecord(collection, id string) (Record, bool, error) {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	coll := db.client.Database("song-recognition").Collection(collection)
+
+	var doc mongoRecord
+	err := coll.FindOne(ctx, bson.M{"_id": id}).Decode(&doc)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return Record{}, false, nil
+		}
+		return Record{}, false, fmt.Errorf("failed to retrieve record: %v", err)
+	}
+
+	return doc.toRecord(), true, nil
+}
+
+func (db *MongoClient) ListRecords(collection string, filter RecordFilter) ([]Record, error) {
+	coll := db.client.Database("song-recognition").Collection(collection)
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+
+	query := bson.M{}
+	if filter.ClientID != "" {
+		query["clientID"] = filter.ClientID
+	}
+	createdAt := bson.M{}
+	if !filter.Since.IsZero() {
+		createdAt["$gte"] = filter.Since
+	}
+	if !filter.Until.IsZero() {
+		createdAt["$lt"] = filter.Until
+	}
+	if len(createdAt) > 0 {
+		query["createdAt"] = createdAt
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "createdAt", Value: 1}})
+	if filter.Limit > 0 {
+		opts.SetLimit(int64(filter.Limit))
+	}
+
+	cursor, err := coll.Find(ctx, query, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list records: %v", err)
+	}
+	defer cursor.Close(ctx)
+
+	var records []Record
+	for cursor.Next(ctx) {
+		var doc mongoRecord
+		if err := cursor.Decode(&doc); err != nil {
+			return nil, fmt.Errorf("failed to decode record: %v", err)
+		}
+		records = append(records, doc.toRecord())
+	}
+
+	return records, cursor.Err()
+}
+
+func (db *MongoClient) DeleteRecord(collection, id string) error {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	coll := db.client.Database("song-recognition").Collection(collection)
+
+	_, err := coll.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return fmt.Errorf("failed to delete record: %v", err)
+	}
+	return nil
+}
+
+// mongoStaging loads a catalog into shadow collections of the same database.
+type mongoStaging struct {
+	client    *mongo.Client
+	batchSize int
+}
+
+func (db *MongoClient) stageCatalog() (StagedCatalog, error) {
+	staging := &mongoStaging{client: db.client, batchSize: db.batchSize}
+	if err := staging.Discard(); err != nil {
+		return nil, err
+	}
+	if err := ensureSongIndexes(staging.collection(stagedSongs)); err != nil {
+		return nil, err
+	}
+	return staging, nil
+}
+
+func (s *mongoStaging) collection(name string) *mongo.Collection {
+	return s.client.Database("song-recognition").Collection(name)
+}
+
+func (s *mongoStaging) StoreSong(songID models.SongID, song Song) error {
+	return storeMongoSong(context.Background(), s.collection(stagedSongs), songID, song)
+}
+
+func (s *mongoStaging) StoreFingerprints(fingerprints map[uint32]models.Couple) error {
+	return storeMongoFingerprints(context.Background(), s.collection(stagedFingerprints), fingerprints, s.batchSize)
+}
+
+// Promote renames each staged collection over its live one. Each rename is
+// atomic, but renames can't be grouped in a transaction, so songs are
+// swapped just before fingerprints.
+func (s *mongoStaging) Promote() error {
+	admin := s.client.Database("admin")
+	for _, names := range [][2]string{{stagedSongs, "songs"}, {stagedFingerprints, "fingerprints"}} {
+		command := bson.D{
+			{Key: "renameCollection", Value: "song-recognition." + names[0]},
+			{Key: "to", Value: "song-recognition." + names[1]},
+			{Key: "dropTarget", Value: true},
+		}
+		if err := admin.RunCommand(context.Background(), command).Err(); err != nil {
+			return fmt.Errorf("error promoting staged catalog: %v", err)
+		}
+	}
+	return nil
+}
+
+func (s *mongoStaging) Discard() error {
+	for _, name := range []string{stagedSongs, stagedFingerprints} {
+		if err := s.collection(name).Drop(context.Background()); err != nil {
+			return fmt.Errorf("error dropping staging collections: %v", err)
+		}
+	}
 	return nil
 }
@@ -0,0 +1,200 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"song-recognition/utils"
+	"strings"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Flavors of MongoDB compatible servers
+const (
+	FlavorMongoDB         = "mongodb"
+	FlavorAtlasServerless = "atlas-serverless"
+	FlavorDocumentDB      = "documentdb"
+)
+
+// mongoCapabilities describes what the connected server supports, so the
+// storage layer can work around managed services that only implement part
+// of MongoDB.
+type mongoCapabilities struct {
+	Flavor       string
+	Transactions bool // multi-document transactions
+	Compact      bool // the compact command
+}
+
+// detectedCapabilities caches capabilities per URI since a client is created
+// for most operations.
+var detectedCapabilities sync.Map // uri -> mongoCapabilities
+
+// mongoFlavorFromURI guesses the flavor from MONGO_FLAVOR, when set to
+// something other than "auto", or from the host name. It must be known before
+// connecting because DocumentDB rejects retryable writes.
+func mongoFlavorFromURI(uri string) string {
+	switch flavor := utils.GetEnv("MONGO_FLAVOR", "auto"); flavor {
+	case FlavorMongoDB, FlavorAtlasServerless, FlavorDocumentDB:
+		return flavor
+	}
+
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		return ""
+	}
+	host := strings.ToLower(parsed.Host)
+	switch {
+	case strings.Contains(host, ".docdb.amazonaws.com"), strings.Contains(host, ".docdb-elastic.amazonaws.com"):
+		return FlavorDocumentDB
+	case strings.Contains(host, "serverless"):
+		return FlavorAtlasServerless
+	}
+	return ""
+}
+
+// detectCapabilities asks the server for its topology with the hello command.
+// Serverless instances sit behind a load balancer and report a serviceId.
+func detectCapabilities(client *mongo.Client, flavor string) (mongoCapabilities, error) {
+	var hello bson.M
+	err := client.Database("admin").RunCommand(context.Background(), bson.D{{Key: "hello", Value: 1}}).Decode(&hello)
+	if err != nil {
+		return mongoCapabilities{}, fmt.Errorf("failed to detect server capabilities: %v", err)
+	}
+
+	if flavor == "" {
+		flavor = FlavorMongoDB
+		if _, ok := hello["serviceId"]; ok {
+			flavor = FlavorAtlasServerless
+		}
+	}
+
+	_, replicaSet := hello["setName"]
+	sharded := hello["msg"] == "isdbgrid"
+
+	return mongoCapabilities{
+		Flavor:       flavor,
+		Transactions: flavor == FlavorMongoDB && (replicaSet || sharded),
+		Compact:      flavor == FlavorMongoDB,
+	}, nil
+}
+
+// ensureIndexes creates the indexes the client relies on, and stores the
+// sort keys of songs saved before they were kept. Only plain (compound,
+// unique) indexes are used since managed services don't support options such
+// as collations or partial filters.
+func ensureIndexes(client *mongo.Client) error {
+	songs := client.Database("song-recognition").Collection("songs")
+	if err := ensureSongIndexes(songs); err != nil {
+		return err
+	}
+	return backfillSongSortKeys(songs)
+}
+
+func ensureSongIndexes(songs *mongo.Collection) error {
+	indexModel := mongo.IndexModel{
+		Keys:    bson.D{{Key: "ytID", Value: 1}, {Key: "key", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	}
+	if _, err := songs.Indexes().CreateOne(context.Background(), indexModel); err != nil {
+		return fmt.Errorf("failed to create unique index: %v", err)
+	}
+
+	// A title and artist are registered once, as in the other backends.
+	// Catalogs that already hold duplicates keep working without it.
+	keyModel := mongo.IndexModel{
+		Keys:    bson.D{{Key: "key", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	}
+	if _, err := songs.Indexes().CreateOne(context.Background(), keyModel); err != nil && !isDuplicateKeyError(err) {
+		return fmt.Errorf("failed to create unique index: %v", err)
+	}
+
+	sortModel := mongo.IndexModel{
+		Keys: bson.D{{Key: "titleSort", Value: 1}, {Key: "artistSort", Value: 1}, {Key: "_id", Value: 1}},
+	}
+	if _, err := songs.Indexes().CreateOne(context.Background(), sortModel); err != nil {
+		return fmt.Errorf("failed to create sort index: %v", err)
+	}
+
+	return nil
+}
+
+// backfillSongSortKeys stores the lowercased title and artist of the songs
+// without them, which ListSongs orders by.
+func backfillSongSortKeys(songs *mongo.Collection) error {
+	ctx := context.Background()
+	cursor, err := songs.Find(ctx, bson.M{"titleSort": bson.M{"$exists": false}}, options.Find().SetProjection(bson.M{"key": 1}))
+	if err != nil {
+		return fmt.Errorf("failed to find songs without sort keys: %v", err)
+	}
+	defer cursor.Close(ctx)
+
+	var writes []mongo.WriteModel
+	flush := func() error {
+		if len(writes) == 0 {
+			return nil
+		}
+		_, err := songs.BulkWrite(ctx, writes, options.BulkWrite().SetOrdered(false))
+		writes = writes[:0]
+		if err != nil {
+			return fmt.Errorf("failed to store song sort keys: %v", err)
+		}
+		return nil
+	}
+	for cursor.Next(ctx) {
+		var doc mongoSong
+		if err := cursor.Decode(&doc); err != nil {
+			return fmt.Errorf("error decoding song: %v", err)
+		}
+		title, artist, _ := strings.Cut(doc.Key, "---")
+		update := bson.M{"$set": bson.M{"titleSort": strings.ToLower(title), "artistSort": strings.ToLower(artist)}}
+		writes = append(writes, mongo.NewUpdateOneModel().SetFilter(bson.M{"_id": doc.ID}).SetUpdate(update))
+		if len(writes) == 1000 {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return fmt.Errorf("failed to find songs without sort keys: %v", err)
+	}
+	return flush()
+}
+
+// isDuplicateKeyError also recognises the duplicate key errors of servers
+// that don't use MongoDB's error codes.
+func isDuplicateKeyError(err error) bool {
+	if mongo.IsDuplicateKeyError(err) {
+		return true
+	}
+
+	var serverErr mongo.ServerError
+	if errors.As(err, &serverErr) {
+		return strings.Contains(strings.ToLower(serverErr.Error()), "duplicate key")
+	}
+	return false
+}
+
+// withTransaction runs fn in a transaction when the server supports them and
+// directly otherwise, in which case fn must tolerate being interrupted.
+func (db *MongoClient) withTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	if !db.caps.Transactions {
+		return fn(ctx)
+	}
+
+	session, err := db.client.StartSession()
+	if err != nil {
+		return fmt.Errorf("failed to start session: %v", err)
+	}
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(sessCtx mongo.SessionContext) (interface{}, error) {
+		return nil, fn(sessCtx)
+	})
+	return err
+}
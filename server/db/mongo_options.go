@@ -0,0 +1,114 @@
+package db
+
+import (
+	"fmt"
+	"log/slog"
+	"song-recognition/utils"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"go.mongodb.org/mongo-driver/event"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// poolWarningInterval is how often at most a MongoDB client warns that
+	// it ran out of connections.
+	poolWarningInterval = 10 * time.Second
+	// defaultMongoPoolSize is the pool size of the driver.
+	defaultMongoPoolSize = 100
+)
+
+// MongoOptions tune the connections of a MongoDB client. Zero values keep
+// the settings of the URI, or the defaults of the driver.
+type MongoOptions struct {
+	MaxPoolSize            uint64 // connections per server
+	ConnectTimeout         time.Duration
+	SocketTimeout          time.Duration // of a single read or write on a connection
+	ServerSelectionTimeout time.Duration // of finding a server for an operation
+	RetryWrites            *bool
+}
+
+// mongoOptions reads MongoOptions from MONGO_MAX_POOL_SIZE,
+// MONGO_CONNECT_TIMEOUT, MONGO_SOCKET_TIMEOUT,
+// MONGO_SERVER_SELECTION_TIMEOUT and MONGO_RETRY_WRITES.
+func mongoOptions(getEnv func(key string, fallback ...string) string) (MongoOptions, error) {
+	var opts MongoOptions
+	if value := getEnv("MONGO_MAX_POOL_SIZE"); value != "" {
+		size, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return opts, fmt.Errorf("invalid MONGO_MAX_POOL_SIZE: %q", value)
+		}
+		opts.MaxPoolSize = size
+	}
+	for key, timeout := range map[string]*time.Duration{
+		"MONGO_CONNECT_TIMEOUT":          &opts.ConnectTimeout,
+		"MONGO_SOCKET_TIMEOUT":           &opts.SocketTimeout,
+		"MONGO_SERVER_SELECTION_TIMEOUT": &opts.ServerSelectionTimeout,
+	} {
+		value := getEnv(key)
+		if value == "" {
+			continue
+		}
+		duration, err := time.ParseDuration(value)
+		if err != nil || duration <= 0 {
+			return opts, fmt.Errorf("invalid %s: %q", key, value)
+		}
+		*timeout = duration
+	}
+	if value := getEnv("MONGO_RETRY_WRITES"); value != "" {
+		retry, err := strconv.ParseBool(value)
+		if err != nil {
+			return opts, fmt.Errorf("invalid MONGO_RETRY_WRITES: %q", value)
+		}
+		opts.RetryWrites = &retry
+	}
+	return opts, nil
+}
+
+// apply sets the options on the options of a client, with a pool monitor
+// warning when operations time out waiting for a connection.
+func (o MongoOptions) apply(clientOptions *options.ClientOptions) {
+	if o.MaxPoolSize > 0 {
+		clientOptions.SetMaxPoolSize(o.MaxPoolSize)
+	}
+	if o.ConnectTimeout > 0 {
+		clientOptions.SetConnectTimeout(o.ConnectTimeout)
+	}
+	if o.SocketTimeout > 0 {
+		clientOptions.SetSocketTimeout(o.SocketTimeout)
+	}
+	if o.ServerSelectionTimeout > 0 {
+		clientOptions.SetServerSelectionTimeout(o.ServerSelectionTimeout)
+	}
+	if o.RetryWrites != nil {
+		clientOptions.SetRetryWrites(*o.RetryWrites)
+	}
+	maxPoolSize := uint64(defaultMongoPoolSize)
+	if clientOptions.MaxPoolSize != nil {
+		maxPoolSize = *clientOptions.MaxPoolSize
+	}
+	clientOptions.SetPoolMonitor(exhaustionMonitor(maxPoolSize))
+}
+
+// exhaustionMonitor warns, at most every poolWarningInterval, when an
+// operation couldn't get a connection from the pool in time, so that an
+// undersized MONGO_MAX_POOL_SIZE shows in the logs.
+func exhaustionMonitor(maxPoolSize uint64) *event.PoolMonitor {
+	var lastWarning atomic.Int64
+	return &event.PoolMonitor{
+		Event: func(e *event.PoolEvent) {
+			if e.Type != event.GetFailed || e.Reason != event.ReasonTimedOut {
+				return
+			}
+			now := time.Now().UnixNano()
+			last := lastWarning.Load()
+			if now-last < int64(poolWarningInterval) || !lastWarning.CompareAndSwap(last, now) {
+				return
+			}
+			utils.GetLogger().Warn("MongoDB connection pool exhausted, raise MONGO_MAX_POOL_SIZE",
+				slog.String("address", e.Address), slog.Uint64("maxPoolSize", maxPoolSize))
+		},
+	}
+}
@@ -0,0 +1,93 @@
+package db
+
+import (
+	"fmt"
+	"song-recognition/utils"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+// minMaxStaleness is the smallest staleness bound servers accept.
+const minMaxStaleness = 90 * time.Second
+
+// ReadRouting describes where GetCouples reads the fingerprints from, so
+// recognition load can be served by secondaries while ingestion writes go
+// to the primary.
+type ReadRouting struct {
+	Preference   string
+	MaxStaleness time.Duration // 0 when the lag of secondaries isn't bounded
+	URI          string        // separate endpoint for reads, "" for the main one
+}
+
+// Primary reports whether reads are served by the primary, in which case
+// they are never stale.
+func (r ReadRouting) Primary() bool {
+	return r.URI == "" && (r.Preference == "" || r.Preference == readpref.PrimaryMode.String())
+}
+
+// CouplesReadRouting returns how fingerprint reads are routed with the
+// current settings: MONGO_READ_PREFERENCE, MONGO_MAX_STALENESS and
+// MONGO_READ_URI. Other backends always read from the database written to.
+func CouplesReadRouting() (ReadRouting, error) {
+	if DBtype != "mongo" {
+		return ReadRouting{}, nil
+	}
+	return mongoReadRouting(utils.GetEnv)
+}
+
+func mongoReadRouting(getEnv func(key string, fallback ...string) string) (ReadRouting, error) {
+	routing := ReadRouting{
+		Preference: getEnv("MONGO_READ_PREFERENCE", readpref.PrimaryMode.String()),
+		URI:        getEnv("MONGO_READ_URI"),
+	}
+	if value := getEnv("MONGO_MAX_STALENESS"); value != "" {
+		maxStaleness, err := time.ParseDuration(value)
+		if err != nil {
+			return routing, fmt.Errorf("invalid MONGO_MAX_STALENESS: %v", err)
+		}
+		routing.MaxStaleness = maxStaleness
+	}
+	if _, err := routing.readPref(); err != nil {
+		return routing, err
+	}
+	return routing, nil
+}
+
+func (r ReadRouting) readPref() (*readpref.ReadPref, error) {
+	mode, err := readpref.ModeFromString(r.Preference)
+	if err != nil {
+		return nil, fmt.Errorf("invalid MONGO_READ_PREFERENCE: %v", err)
+	}
+	if r.MaxStaleness == 0 {
+		return readpref.New(mode)
+	}
+	if mode == readpref.PrimaryMode {
+		return nil, fmt.Errorf("MONGO_MAX_STALENESS requires a MONGO_READ_PREFERENCE other than primary")
+	}
+	if r.MaxStaleness < minMaxStaleness {
+		return nil, fmt.Errorf("MONGO_MAX_STALENESS must be at least %v", minMaxStaleness)
+	}
+	return readpref.New(mode, readpref.WithMaxStaleness(r.MaxStaleness))
+}
+
+// connectReads prepares the database fingerprints are read from, connecting
+// to the read endpoint with opts when there is one. Like the main one, that
+// connection is shared by the process.
+func (db *MongoClient) connectReads(routing ReadRouting, opts MongoOptions) error {
+	readPref, err := routing.readPref()
+	if err != nil {
+		return err
+	}
+
+	client := db.client
+	if routing.URI != "" {
+		client, err = mongoConnection(routing.URI, opts)
+		if err != nil {
+			return fmt.Errorf("error connecting to the MongoDB read endpoint: %s", err)
+		}
+	}
+	db.reads = client.Database("song-recognition", options.Database().SetReadPreference(readPref))
+	return nil
+}
@@ -0,0 +1,643 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"song-recognition/models"
+	"song-recognition/utils"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// mysqlBatchSize is the number of rows per multi-row insert and the number of
+// addresses per lookup, well below MySQL's placeholder limit.
+const mysqlBatchSize = 1000
+
+// mysqlDuplicateEntry is the error number of unique constraint violations
+const mysqlDuplicateEntry = 1062
+
+// MySQLClient stores the catalog in MySQL or MariaDB. Fingerprints are kept
+// in a table of addresses and packed couples, see packCouple, with the peak
+// code of version 2 couples alongside.
+type MySQLClient struct {
+	db  *sql.DB
+	ctx context.Context // see WithContext
+}
+
+func NewMySQLClient(dataSourceName string) (*MySQLClient, error) {
+	db, err := sql.Open("mysql", dataSourceName)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to MySQL: %s", err)
+	}
+
+	err = createMySQLTables(db)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error creating tables: %s", err)
+	}
+
+	return &MySQLClient{db: db}, nil
+}
+
+func createMySQLTables(db *sql.DB) error {
+	createSongsTable := `
+    CREATE TABLE IF NOT EXISTS songs (
+        id INT UNSIGNED NOT NULL PRIMARY KEY,
+        title VARCHAR(255) NOT NULL,
+        artist VARCHAR(255) NOT NULL,
+        ytID VARCHAR(32),
+        ` + "`key`" + ` VARCHAR(512) NOT NULL UNIQUE,
+        album VARCHAR(255) NOT NULL DEFAULT '',
+        durationMs BIGINT NOT NULL DEFAULT 0,
+        releaseYear INT NOT NULL DEFAULT 0,
+        genre VARCHAR(255) NOT NULL DEFAULT '',
+        coverArtURL VARCHAR(2048) NOT NULL DEFAULT '',
+        ingestedAtMs BIGINT NOT NULL DEFAULT 0
+    ) CHARACTER SET utf8mb4;
+    `
+
+	createFingerprintsTable := `
+    CREATE TABLE IF NOT EXISTS fingerprints (
+        address INT UNSIGNED NOT NULL,
+        couple BIGINT UNSIGNED NOT NULL,
+        peak SMALLINT UNSIGNED NOT NULL DEFAULT 0,
+        PRIMARY KEY (address, couple)
+    );
+    `
+
+	createRecordsTable := `
+    CREATE TABLE IF NOT EXISTS records (
+        collection VARCHAR(64) NOT NULL,
+        id VARCHAR(255) NOT NULL,
+        clientID VARCHAR(255) NOT NULL DEFAULT '',
+        createdAt BIGINT NOT NULL,
+        data LONGTEXT NOT NULL,
+        PRIMARY KEY (collection, id),
+        INDEX (collection, createdAt)
+    ) CHARACTER SET utf8mb4;
+    `
+
+	for table, query := range map[string]string{
+		"songs":        createSongsTable,
+		"fingerprints": createFingerprintsTable,
+		"records":      createRecordsTable,
+	} {
+		if _, err := db.Exec(query); err != nil {
+			return fmt.Errorf("error creating %s table: %s", table, err)
+		}
+	}
+
+	// Catalogs created before couples carried peak details lack the column
+	if err := addMySQLColumn(db, "fingerprints", "peak", "SMALLINT UNSIGNED NOT NULL DEFAULT 0"); err != nil {
+		return fmt.Errorf("error upgrading fingerprints table: %s", err)
+	}
+
+	// Catalogs created before songs carried their details lack the columns
+	for _, column := range []struct{ name, definition string }{
+		{"album", "VARCHAR(255) NOT NULL DEFAULT ''"},
+		{"durationMs", "BIGINT NOT NULL DEFAULT 0"},
+		{"releaseYear", "INT NOT NULL DEFAULT 0"},
+		{"genre", "VARCHAR(255) NOT NULL DEFAULT ''"},
+		{"coverArtURL", "VARCHAR(2048) NOT NULL DEFAULT ''"},
+		{"ingestedAtMs", "BIGINT NOT NULL DEFAULT 0"},
+	} {
+		if err := addMySQLColumn(db, "songs", column.name, column.definition); err != nil {
+			return fmt.Errorf("error upgrading songs table: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// addMySQLColumn adds a column to a table unless it already has it.
+func addMySQLColumn(db *sql.DB, table, column, definition string) error {
+	var count int
+	err := db.QueryRow(
+		"SELECT COUNT(*) FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND COLUMN_NAME = ?",
+		table, column,
+	).Scan(&count)
+	if err != nil || count > 0 {
+		return err
+	}
+	_, err = db.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition)
+	return err
+}
+
+// packCouple packs a couple into a single integer, the anchor time in the
+// high 32 bits and the song ID in the low 32 bits.
+func packCouple(couple models.Couple) uint64 {
+	return uint64(couple.AnchorTimeMs)<<32 | uint64(couple.SongID)
+}
+
+func unpackCouple(packed uint64, peak uint16) models.Couple {
+	couple := models.Couple{AnchorTimeMs: uint32(packed >> 32), SongID: models.SongID(uint32(packed))}
+	couple.SetPeakCode(peak)
+	return couple
+}
+
+// placeholders returns "(?, ?), (?, ?), ..." for n rows of size columns.
+func placeholders(n, size int) string {
+	row := "(" + strings.TrimSuffix(strings.Repeat("?, ", size), ", ") + ")"
+	return strings.TrimSuffix(strings.Repeat(row+", ", n), ", ")
+}
+
+func (db *MySQLClient) withContext(ctx context.Context) DBClient {
+	bound := *db
+	bound.ctx = ctx
+	return &bound
+}
+
+func (db *MySQLClient) Close() error {
+	if db.db != nil {
+		return db.db.Close()
+	}
+	return nil
+}
+
+func (db *MySQLClient) StoreFingerprints(fingerprints map[uint32]models.Couple) error {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	return storeMySQLFingerprints(ctx, db.db, "fingerprints", fingerprints)
+}
+
+func storeMySQLFingerprints(ctx context.Context, db *sql.DB, table string, fingerprints map[uint32]models.Couple) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+
+	args := make([]interface{}, 0, 3*mysqlBatchSize)
+	flush := func() error {
+		if len(args) == 0 {
+			return nil
+		}
+		query := "INSERT INTO " + table + " (address, couple, peak) VALUES " + placeholders(len(args)/3, 3) +
+			" ON DUPLICATE KEY UPDATE peak = VALUES(peak)"
+		_, err := tx.ExecContext(ctx, query, args...)
+		args = args[:0]
+		return err
+	}
+
+	for address, couple := range fingerprints {
+		if err := checkNarrowSongID(couple.SongID); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("error inserting fingerprints: %w", err)
+		}
+		args = append(args, address, packCouple(couple), couple.PeakCode())
+		if len(args) == 3*mysqlBatchSize {
+			if err := flush(); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("error inserting fingerprints: %w", err)
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("error inserting fingerprints: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+func (db *MySQLClient) GetCouples(addresses []uint32) (map[uint32][]models.Couple, error) {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	couples := make(map[uint32][]models.Couple)
+
+	for start := 0; start < len(addresses); start += mysqlBatchSize {
+		batch := addresses[start:min(start+mysqlBatchSize, len(addresses))]
+
+		args := make([]interface{}, len(batch))
+		for i, address := range batch {
+			args[i] = address
+		}
+		query := "SELECT address, couple, peak FROM fingerprints WHERE address IN (" +
+			strings.TrimSuffix(strings.Repeat("?, ", len(batch)), ", ") + ")"
+
+		rows, err := db.db.QueryContext(ctx, query, args...)
+		if err != nil {
+			return nil, fmt.Errorf("error querying database: %w", err)
+		}
+
+		for rows.Next() {
+			var address uint32
+			var packed uint64
+			var peak uint16
+			if err := rows.Scan(&address, &packed, &peak); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("error scanning row: %w", err)
+			}
+			couples[address] = append(couples[address], unpackCouple(packed, peak))
+		}
+
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error reading rows: %w", err)
+		}
+	}
+
+	return couples, nil
+}
+
+func (db *MySQLClient) TotalSongs() (int, error) {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	var count int
+	err := db.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM songs").Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("error counting songs: %s", err)
+	}
+	return count, nil
+}
+
+func (db *MySQLClient) RegisterSong(songTitle, songArtist, ytID string) (models.SongID, error) {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	songID := models.NewSongID()
+	songKey := utils.GenerateSongKey(songTitle, songArtist)
+
+	_, err := db.db.ExecContext(ctx,
+		"INSERT INTO songs (id, title, artist, ytID, `key`, ingestedAtMs) VALUES (?, ?, ?, ?, ?, ?)",
+		songID, songTitle, songArtist, ytID, songKey, ingestionTime(),
+	)
+	if err != nil {
+		var mysqlErr *mysql.MySQLError
+		if errors.As(err, &mysqlErr) && mysqlErr.Number == mysqlDuplicateEntry {
+			return 0, fmt.Errorf("song with ytID or key already exists: %v", err)
+		}
+		return 0, fmt.Errorf("failed to register song: %v", err)
+	}
+
+	return songID, nil
+}
+
+var mysqlFilterColumns = map[string]string{"id": "id", "ytID": "ytID", "key": "`key`"}
+
+func (db *MySQLClient) GetSong(filterKey string, value interface{}) (Song, bool, error) {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	column, ok := mysqlFilterColumns[filterKey]
+	if !ok {
+		return Song{}, false, fmt.Errorf("invalid filter key")
+	}
+
+	row := db.db.QueryRowContext(ctx, fmt.Sprintf("SELECT title, artist, ytID, %s FROM songs WHERE %s = ?", songDetailColumns, column), value)
+
+	var song Song
+	var ytID sql.NullString
+	err := row.Scan(append([]interface{}{&song.Title, &song.Artist, &ytID}, songDetailsDest(&song)...)...)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return Song{}, false, nil
+		}
+		return Song{}, false, fmt.Errorf("failed to retrieve song: %s", err)
+	}
+	song.YouTubeID = ytID.String
+
+	return song, true, nil
+}
+
+func (db *MySQLClient) GetSongByID(songID models.SongID) (Song, bool, error) {
+	return db.GetSong("id", songID)
+}
+
+func (db *MySQLClient) GetSongByYTID(ytID string) (Song, bool, error) {
+	return db.GetSong("ytID", ytID)
+}
+
+func (db *MySQLClient) GetSongByKey(key string) (Song, bool, error) {
+	return db.GetSong("key", key)
+}
+
+func (db *MySQLClient) DeleteSongByID(songID models.SongID) error {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	_, err := db.db.ExecContext(ctx, "DELETE FROM songs WHERE id = ?", songID)
+	if err != nil {
+		return fmt.Errorf("failed to delete song: %v", err)
+	}
+	return nil
+}
+
+func (db *MySQLClient) DeleteCollection(collectionName string) error {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	_, err := db.db.ExecContext(ctx, fmt.Sprintf("DROP TABLE IF EXISTS `%s`", strings.ReplaceAll(collectionName, "`", "")))
+	if err != nil {
+		return fmt.Errorf("error deleting collection: %v", err)
+	}
+	return nil
+}
+
+func (db *MySQLClient) ForEachSong(fn func(songID models.SongID, song Song) error) error {
+	ctx := bulkContext(db.ctx)
+	rows, err := db.db.QueryContext(ctx, "SELECT id, title, artist, ytID, "+songDetailColumns+" FROM songs ORDER BY id")
+	if err != nil {
+		return fmt.Errorf("error querying songs: %s", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var songID models.SongID
+		var song Song
+		var ytID sql.NullString
+		if err := rows.Scan(append([]interface{}{&songID, &song.Title, &song.Artist, &ytID}, songDetailsDest(&song)...)...); err != nil {
+			return fmt.Errorf("error scanning row: %s", err)
+		}
+		song.YouTubeID = ytID.String
+		if err := fn(songID, song); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+func (db *MySQLClient) ListSongs(offset, limit int, filter SongFilter) ([]ListedSong, error) {
+	if err := checkSongList(offset, limit, filter); err != nil {
+		return nil, err
+	}
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	query := "SELECT id, title, artist, ytID, " + songDetailColumns + " FROM songs"
+	var args []interface{}
+	if filter.Artist != "" {
+		query += " WHERE LOWER(artist) LIKE ? ESCAPE '!'"
+		args = append(args, likeSubstring(filter.Artist))
+	}
+	query += songListOrder(offset, limit, filter, "LOWER", "ingestedAtMs")
+	return listSQLSongs(ctx, db.db, query, args...)
+}
+
+func (db *MySQLClient) ForEachFingerprint(fn func(address uint32, couple models.Couple) error) error {
+	ctx := bulkContext(db.ctx)
+	rows, err := db.db.QueryContext(ctx, "SELECT address, couple, peak FROM fingerprints ORDER BY address, couple")
+	if err != nil {
+		return fmt.Errorf("error querying fingerprints: %s", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var address uint32
+		var packed uint64
+		var peak uint16
+		if err := rows.Scan(&address, &packed, &peak); err != nil {
+			return fmt.Errorf("error scanning row: %s", err)
+		}
+		if err := fn(address, unpackCouple(packed, peak)); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+func (db *MySQLClient) StoreSong(songID models.SongID, song Song) error {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	return storeMySQLSong(ctx, db.db, "songs", songID, song)
+}
+
+func storeMySQLSong(ctx context.Context, db *sql.DB, table string, songID models.SongID, song Song) error {
+	if err := checkNarrowSongID(songID); err != nil {
+		return fmt.Errorf("failed to store song: %v", err)
+	}
+	_, err := db.ExecContext(ctx,
+		"REPLACE INTO "+table+" (id, title, artist, ytID, `key`, "+songDetailColumns+") VALUES "+placeholders(1, 11),
+		append([]interface{}{songID, song.Title, song.Artist, song.YouTubeID, utils.GenerateSongKey(song.Title, song.Artist)}, songDetails(song)...)...,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to store song: %v", err)
+	}
+	return nil
+}
+
+func (db *MySQLClient) FingerprintSongIDs() ([]models.SongID, error) {
+	ctx := bulkContext(db.ctx)
+	rows, err := db.db.QueryContext(ctx, "SELECT DISTINCT couple & 0xFFFFFFFF FROM fingerprints")
+	if err != nil {
+		return nil, fmt.Errorf("error querying song IDs: %s", err)
+	}
+	defer rows.Close()
+
+	var songIDs []models.SongID
+	for rows.Next() {
+		var songID models.SongID
+		if err := rows.Scan(&songID); err != nil {
+			return nil, fmt.Errorf("error scanning row: %s", err)
+		}
+		songIDs = append(songIDs, songID)
+	}
+
+	return songIDs, rows.Err()
+}
+
+func (db *MySQLClient) DeleteFingerprintsBySongID(songID models.SongID) error {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	_, err := db.db.ExecContext(ctx, "DELETE FROM fingerprints WHERE couple & 0xFFFFFFFF = ?", songID)
+	if err != nil {
+		return fmt.Errorf("failed to delete fingerprints: %v", err)
+	}
+	return nil
+}
+
+// Compact rebuilds the tables to reclaim space left by deletions
+func (db *MySQLClient) Compact() error {
+	ctx := bulkContext(db.ctx)
+	rows, err := db.db.QueryContext(ctx, "OPTIMIZE TABLE songs, fingerprints, records")
+	if err != nil {
+		return fmt.Errorf("failed to optimize tables: %v", err)
+	}
+	return rows.Close()
+}
+
+// Snapshot dumps the songs and fingerprints tables into a gzipped file of
+// JSON lines, one row per line.
+func (db *MySQLClient) Snapshot(dir string) (string, error) {
+	ctx := bulkContext(db.ctx)
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", fmt.Errorf("error starting transaction: %s", err)
+	}
+	defer tx.Rollback()
+
+	return writeJSONSnapshot(dir, func(emit func(table string, row interface{}) error) error {
+		rows, err := tx.QueryContext(ctx, "SELECT id, title, artist, ytID, `key`, "+songDetailColumns+" FROM songs")
+		if err != nil {
+			return fmt.Errorf("failed to read songs: %v", err)
+		}
+		for rows.Next() {
+			var id uint32
+			var song Song
+			var key string
+			var ytID sql.NullString
+			if err := rows.Scan(append([]interface{}{&id, &song.Title, &song.Artist, &ytID, &key}, songDetailsDest(&song)...)...); err != nil {
+				rows.Close()
+				return fmt.Errorf("error scanning row: %s", err)
+			}
+			song.YouTubeID = ytID.String
+			if err := emit("songs", snapshotSong(id, song, key)); err != nil {
+				rows.Close()
+				return err
+			}
+		}
+		rows.Close()
+
+		rows, err = tx.QueryContext(ctx, "SELECT address, couple, peak FROM fingerprints")
+		if err != nil {
+			return fmt.Errorf("failed to read fingerprints: %v", err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var address uint32
+			var packed uint64
+			var peak uint16
+			if err := rows.Scan(&address, &packed, &peak); err != nil {
+				return fmt.Errorf("error scanning row: %s", err)
+			}
+			couple := unpackCouple(packed, peak)
+			row := map[string]interface{}{"address": address, "anchorTimeMs": couple.AnchorTimeMs, "songID": couple.SongID, "peak": peak}
+			if err := emit("fingerprints", row); err != nil {
+				return err
+			}
+		}
+		return rows.Err()
+	})
+}
+
+func (db *MySQLClient) PutRecord(collection string, record Record) error {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	_, err := db.db.ExecContext(ctx,
+		"REPLACE INTO records (collection, id, clientID, createdAt, data) VALUES (?, ?, ?, ?, ?)",
+		collection, record.ID, record.ClientID, record.CreatedAt.UnixNano(), string(record.Data),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to store record: %v", err)
+	}
+	return nil
+}
+
+func (db *MySQLClient) GetRecord(collection, id string) (Record, bool, error) {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	row := db.db.QueryRowContext(ctx,
+		"SELECT id, clientID, createdAt, data FROM records WHERE collection = ? AND id = ?",
+		collection, id,
+	)
+
+	record, err := scanRecord(row)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return Record{}, false, nil
+		}
+		return Record{}, false, fmt.Errorf("failed to retrieve record: %v", err)
+	}
+
+	return record, true, nil
+}
+
+func (db *MySQLClient) ListRecords(collection string, filter RecordFilter) ([]Record, error) {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	query := "SELECT id, clientID, createdAt, data FROM records WHERE collection = ?"
+	args := []interface{}{collection}
+
+	if filter.ClientID != "" {
+		query += " AND clientID = ?"
+		args = append(args, filter.ClientID)
+	}
+	if !filter.Since.IsZero() {
+		query += " AND createdAt >= ?"
+		args = append(args, filter.Since.UnixNano())
+	}
+	if !filter.Until.IsZero() {
+		query += " AND createdAt < ?"
+		args = append(args, filter.Until.UnixNano())
+	}
+	query += " ORDER BY createdAt"
+	if filter.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, filter.Limit)
+	}
+
+	rows, err := db.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list records: %v", err)
+	}
+	defer rows.Close()
+
+	var records []Record
+	for rows.Next() {
+		record, err := scanRecord(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning row: %s", err)
+		}
+		records = append(records, record)
+	}
+
+	return records, rows.Err()
+}
+
+func (db *MySQLClient) DeleteRecord(collection, id string) error {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	_, err := db.db.ExecContext(ctx, "DELETE FROM records WHERE collection = ? AND id = ?", collection, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete record: %v", err)
+	}
+	return nil
+}
+
+// mysqlStaging loads a catalog into shadow tables of the same database.
+type mysqlStaging struct {
+	db *sql.DB
+}
+
+func (db *MySQLClient) stageCatalog() (StagedCatalog, error) {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	for _, query := range []string{
+		"DROP TABLE IF EXISTS " + stagedSongs + ", " + stagedFingerprints + ", songs_retired, fingerprints_retired",
+		"CREATE TABLE " + stagedSongs + " LIKE songs",
+		"CREATE TABLE " + stagedFingerprints + " LIKE fingerprints",
+	} {
+		if _, err := db.db.ExecContext(ctx, query); err != nil {
+			return nil, fmt.Errorf("error creating staging tables: %v", err)
+		}
+	}
+	return &mysqlStaging{db: db.db}, nil
+}
+
+func (s *mysqlStaging) StoreSong(songID models.SongID, song Song) error {
+	return storeMySQLSong(context.Background(), s.db, stagedSongs, songID, song)
+}
+
+func (s *mysqlStaging) StoreFingerprints(fingerprints map[uint32]models.Couple) error {
+	return storeMySQLFingerprints(context.Background(), s.db, stagedFingerprints, fingerprints)
+}
+
+// Promote swaps the tables with a single RENAME TABLE, which is atomic.
+func (s *mysqlStaging) Promote() error {
+	_, err := s.db.Exec("RENAME TABLE songs TO songs_retired, " + stagedSongs + " TO songs, " +
+		"fingerprints TO fingerprints_retired, " + stagedFingerprints + " TO fingerprints")
+	if err != nil {
+		return fmt.Errorf("error promoting staged catalog: %v", err)
+	}
+	if _, err := s.db.Exec("DROP TABLE songs_retired, fingerprints_retired"); err != nil {
+		return fmt.Errorf("error dropping the previous catalog: %v", err)
+	}
+	return nil
+}
+
+func (s *mysqlStaging) Discard() error {
+	if _, err := s.db.Exec("DROP TABLE IF EXISTS " + stagedSongs + ", " + stagedFingerprints); err != nil {
+		return fmt.Errorf("error dropping staging tables: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,646 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"song-recognition/models"
+	"song-recognition/utils"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// postgresBatchSize is the number of rows per multi-row insert and the number
+// of addresses per lookup, well below PostgreSQL's limit of 65535 parameters.
+const postgresBatchSize = 1000
+
+// postgresUniqueViolation is the SQLSTATE of unique constraint violations
+const postgresUniqueViolation = "23505"
+
+// PostgresClient stores the catalog in PostgreSQL. Fingerprints are kept in a
+// table of addresses, anchor times and song IDs, looked up through the btree
+// of its primary key, with the peak code of version 2 couples alongside.
+type PostgresClient struct {
+	db  *sql.DB
+	ctx context.Context // see WithContext
+}
+
+func NewPostgresClient(dataSourceName string) (*PostgresClient, error) {
+	db, err := sql.Open("postgres", dataSourceName)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to PostgreSQL: %s", err)
+	}
+
+	err = createPostgresTables(context.Background(), db, "songs", "fingerprints")
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error creating tables: %s", err)
+	}
+
+	createRecordsTable := `
+    CREATE TABLE IF NOT EXISTS records (
+        collection TEXT NOT NULL,
+        id TEXT NOT NULL,
+        client_id TEXT NOT NULL DEFAULT '',
+        created_at BIGINT NOT NULL,
+        data TEXT NOT NULL,
+        PRIMARY KEY (collection, id)
+    );
+    CREATE INDEX IF NOT EXISTS records_created_at ON records USING btree (collection, created_at);
+    `
+	if _, err := db.Exec(createRecordsTable); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error creating tables: error creating records table: %s", err)
+	}
+
+	return &PostgresClient{db: db}, nil
+}
+
+// createPostgresTables creates a songs and a fingerprints table under the
+// given names, unless they exist. Couples are deleted by song through an
+// index named after the fingerprints table.
+func createPostgresTables(ctx context.Context, db *sql.DB, songs, fingerprints string) error {
+	createSongsTable := `
+    CREATE TABLE IF NOT EXISTS ` + songs + ` (
+        id BIGINT NOT NULL PRIMARY KEY,
+        title TEXT NOT NULL,
+        artist TEXT NOT NULL,
+        yt_id TEXT,
+        key TEXT NOT NULL UNIQUE,
+        album TEXT NOT NULL DEFAULT '',
+        duration_ms BIGINT NOT NULL DEFAULT 0,
+        release_year INTEGER NOT NULL DEFAULT 0,
+        genre TEXT NOT NULL DEFAULT '',
+        cover_art_url TEXT NOT NULL DEFAULT '',
+        ingested_at_ms BIGINT NOT NULL DEFAULT 0
+    );
+    -- Catalogs created before songs carried their details lack the columns
+    ALTER TABLE ` + songs + `
+        ADD COLUMN IF NOT EXISTS album TEXT NOT NULL DEFAULT '',
+        ADD COLUMN IF NOT EXISTS duration_ms BIGINT NOT NULL DEFAULT 0,
+        ADD COLUMN IF NOT EXISTS release_year INTEGER NOT NULL DEFAULT 0,
+        ADD COLUMN IF NOT EXISTS genre TEXT NOT NULL DEFAULT '',
+        ADD COLUMN IF NOT EXISTS cover_art_url TEXT NOT NULL DEFAULT '',
+        ADD COLUMN IF NOT EXISTS ingested_at_ms BIGINT NOT NULL DEFAULT 0;
+    `
+
+	createFingerprintsTable := `
+    CREATE TABLE IF NOT EXISTS ` + fingerprints + ` (
+        address BIGINT NOT NULL,
+        anchor_time_ms BIGINT NOT NULL,
+        song_id BIGINT NOT NULL,
+        peak INTEGER NOT NULL DEFAULT 0,
+        PRIMARY KEY (address, anchor_time_ms, song_id)
+    );
+    CREATE INDEX IF NOT EXISTS ` + fingerprints + `_song_id ON ` + fingerprints + ` USING btree (song_id);
+    `
+
+	for _, table := range []struct{ name, query string }{
+		{songs, createSongsTable},
+		{fingerprints, createFingerprintsTable},
+	} {
+		if _, err := db.ExecContext(ctx, table.query); err != nil {
+			return fmt.Errorf("error creating %s table: %s", table.name, err)
+		}
+	}
+	return nil
+}
+
+// postgresPlaceholders returns "($1, $2), ($3, $4), ..." for n rows of size
+// columns.
+func postgresPlaceholders(n, size int) string {
+	var b strings.Builder
+	for row := 0; row < n; row++ {
+		if row > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString("(")
+		for column := 0; column < size; column++ {
+			if column > 0 {
+				b.WriteString(", ")
+			}
+			b.WriteString("$" + strconv.Itoa(row*size+column+1))
+		}
+		b.WriteString(")")
+	}
+	return b.String()
+}
+
+func scanPostgresCouple(row interface{ Scan(...interface{}) error }) (uint32, models.Couple, error) {
+	var address uint32
+	var couple models.Couple
+	var peak uint16
+	if err := row.Scan(&address, &couple.AnchorTimeMs, &couple.SongID, &peak); err != nil {
+		return 0, models.Couple{}, err
+	}
+	couple.SetPeakCode(peak)
+	return address, couple, nil
+}
+
+func (db *PostgresClient) withContext(ctx context.Context) DBClient {
+	bound := *db
+	bound.ctx = ctx
+	return &bound
+}
+
+func (db *PostgresClient) Close() error {
+	if db.db != nil {
+		return db.db.Close()
+	}
+	return nil
+}
+
+func (db *PostgresClient) StoreFingerprints(fingerprints map[uint32]models.Couple) error {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	return storePostgresFingerprints(ctx, db.db, "fingerprints", fingerprints)
+}
+
+func storePostgresFingerprints(ctx context.Context, db *sql.DB, table string, fingerprints map[uint32]models.Couple) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+
+	args := make([]interface{}, 0, 4*postgresBatchSize)
+	flush := func() error {
+		if len(args) == 0 {
+			return nil
+		}
+		query := "INSERT INTO " + table + " (address, anchor_time_ms, song_id, peak) VALUES " + postgresPlaceholders(len(args)/4, 4) +
+			" ON CONFLICT (address, anchor_time_ms, song_id) DO UPDATE SET peak = EXCLUDED.peak"
+		_, err := tx.ExecContext(ctx, query, args...)
+		args = args[:0]
+		return err
+	}
+
+	for address, couple := range fingerprints {
+		args = append(args, int64(address), int64(couple.AnchorTimeMs), int64(couple.SongID), int(couple.PeakCode()))
+		if len(args) == 4*postgresBatchSize {
+			if err := flush(); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("error inserting fingerprints: %w", err)
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("error inserting fingerprints: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+func (db *PostgresClient) GetCouples(addresses []uint32) (map[uint32][]models.Couple, error) {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	couples := make(map[uint32][]models.Couple)
+
+	for start := 0; start < len(addresses); start += postgresBatchSize {
+		batch := addresses[start:min(start+postgresBatchSize, len(addresses))]
+
+		values := make([]int64, len(batch))
+		for i, address := range batch {
+			values[i] = int64(address)
+		}
+		rows, err := db.db.QueryContext(ctx,
+			"SELECT address, anchor_time_ms, song_id, peak FROM fingerprints WHERE address = ANY($1)",
+			pq.Array(values),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("error querying database: %w", err)
+		}
+
+		for rows.Next() {
+			address, couple, err := scanPostgresCouple(rows)
+			if err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("error scanning row: %w", err)
+			}
+			couples[address] = append(couples[address], couple)
+		}
+
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error reading rows: %w", err)
+		}
+	}
+
+	return couples, nil
+}
+
+func (db *PostgresClient) TotalSongs() (int, error) {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	var count int
+	err := db.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM songs").Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("error counting songs: %s", err)
+	}
+	return count, nil
+}
+
+func (db *PostgresClient) RegisterSong(songTitle, songArtist, ytID string) (models.SongID, error) {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	songID := models.NewSongID()
+	songKey := utils.GenerateSongKey(songTitle, songArtist)
+
+	_, err := db.db.ExecContext(ctx,
+		"INSERT INTO songs (id, title, artist, yt_id, key, ingested_at_ms) VALUES ($1, $2, $3, $4, $5, $6)",
+		int64(songID), songTitle, songArtist, ytID, songKey, ingestionTime(),
+	)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == postgresUniqueViolation {
+			return 0, fmt.Errorf("song with ytID or key already exists: %v", err)
+		}
+		return 0, fmt.Errorf("failed to register song: %v", err)
+	}
+
+	return songID, nil
+}
+
+var postgresFilterColumns = map[string]string{"id": "id", "ytID": "yt_id", "key": "key"}
+
+// postgresSongDetailColumns are the columns of the details of a song and the
+// time it was ingested at, in the order of songDetails.
+const postgresSongDetailColumns = "album, duration_ms, release_year, genre, cover_art_url, ingested_at_ms"
+
+func (db *PostgresClient) GetSong(filterKey string, value interface{}) (Song, bool, error) {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	column, ok := postgresFilterColumns[filterKey]
+	if !ok {
+		return Song{}, false, fmt.Errorf("invalid filter key")
+	}
+	if songID, ok := value.(models.SongID); ok {
+		value = int64(songID)
+	}
+
+	row := db.db.QueryRowContext(ctx, fmt.Sprintf("SELECT title, artist, yt_id, %s FROM songs WHERE %s = $1", postgresSongDetailColumns, column), value)
+
+	var song Song
+	var ytID sql.NullString
+	err := row.Scan(append([]interface{}{&song.Title, &song.Artist, &ytID}, songDetailsDest(&song)...)...)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return Song{}, false, nil
+		}
+		return Song{}, false, fmt.Errorf("failed to retrieve song: %s", err)
+	}
+	song.YouTubeID = ytID.String
+
+	return song, true, nil
+}
+
+func (db *PostgresClient) GetSongByID(songID models.SongID) (Song, bool, error) {
+	return db.GetSong("id", songID)
+}
+
+func (db *PostgresClient) GetSongByYTID(ytID string) (Song, bool, error) {
+	return db.GetSong("ytID", ytID)
+}
+
+func (db *PostgresClient) GetSongByKey(key string) (Song, bool, error) {
+	return db.GetSong("key", key)
+}
+
+func (db *PostgresClient) DeleteSongByID(songID models.SongID) error {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	_, err := db.db.ExecContext(ctx, "DELETE FROM songs WHERE id = $1", int64(songID))
+	if err != nil {
+		return fmt.Errorf("failed to delete song: %v", err)
+	}
+	return nil
+}
+
+func (db *PostgresClient) DeleteCollection(collectionName string) error {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	_, err := db.db.ExecContext(ctx, "DROP TABLE IF EXISTS "+pq.QuoteIdentifier(collectionName))
+	if err != nil {
+		return fmt.Errorf("error deleting collection: %v", err)
+	}
+	return nil
+}
+
+func (db *PostgresClient) ForEachSong(fn func(songID models.SongID, song Song) error) error {
+	ctx := bulkContext(db.ctx)
+	rows, err := db.db.QueryContext(ctx, "SELECT id, title, artist, yt_id, "+postgresSongDetailColumns+" FROM songs ORDER BY id")
+	if err != nil {
+		return fmt.Errorf("error querying songs: %s", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var songID models.SongID
+		var song Song
+		var ytID sql.NullString
+		if err := rows.Scan(append([]interface{}{&songID, &song.Title, &song.Artist, &ytID}, songDetailsDest(&song)...)...); err != nil {
+			return fmt.Errorf("error scanning row: %s", err)
+		}
+		song.YouTubeID = ytID.String
+		if err := fn(songID, song); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+func (db *PostgresClient) ListSongs(offset, limit int, filter SongFilter) ([]ListedSong, error) {
+	if err := checkSongList(offset, limit, filter); err != nil {
+		return nil, err
+	}
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	query := "SELECT id, title, artist, yt_id, " + postgresSongDetailColumns + " FROM songs"
+	var args []interface{}
+	if filter.Artist != "" {
+		query += " WHERE LOWER(artist) LIKE $1 ESCAPE '!'"
+		args = append(args, likeSubstring(filter.Artist))
+	}
+	query += songListOrder(offset, limit, filter, "LOWER", "ingested_at_ms")
+	return listSQLSongs(ctx, db.db, query, args...)
+}
+
+func (db *PostgresClient) ForEachFingerprint(fn func(address uint32, couple models.Couple) error) error {
+	ctx := bulkContext(db.ctx)
+	rows, err := db.db.QueryContext(ctx, "SELECT address, anchor_time_ms, song_id, peak FROM fingerprints ORDER BY address, anchor_time_ms, song_id")
+	if err != nil {
+		return fmt.Errorf("error querying fingerprints: %s", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		address, couple, err := scanPostgresCouple(rows)
+		if err != nil {
+			return fmt.Errorf("error scanning row: %s", err)
+		}
+		if err := fn(address, couple); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+func (db *PostgresClient) StoreSong(songID models.SongID, song Song) error {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	return storePostgresSong(ctx, db.db, "songs", songID, song)
+}
+
+func storePostgresSong(ctx context.Context, db *sql.DB, table string, songID models.SongID, song Song) error {
+	_, err := db.ExecContext(ctx,
+		"INSERT INTO "+table+" (id, title, artist, yt_id, key, "+postgresSongDetailColumns+") VALUES "+postgresPlaceholders(1, 11)+
+			" ON CONFLICT (id) DO UPDATE SET title = EXCLUDED.title, artist = EXCLUDED.artist, yt_id = EXCLUDED.yt_id, key = EXCLUDED.key,"+
+			" album = EXCLUDED.album, duration_ms = EXCLUDED.duration_ms, release_year = EXCLUDED.release_year,"+
+			" genre = EXCLUDED.genre, cover_art_url = EXCLUDED.cover_art_url, ingested_at_ms = EXCLUDED.ingested_at_ms",
+		append([]interface{}{int64(songID), song.Title, song.Artist, song.YouTubeID, utils.GenerateSongKey(song.Title, song.Artist)}, songDetails(song)...)...,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to store song: %v", err)
+	}
+	return nil
+}
+
+func (db *PostgresClient) FingerprintSongIDs() ([]models.SongID, error) {
+	ctx := bulkContext(db.ctx)
+	rows, err := db.db.QueryContext(ctx, "SELECT DISTINCT song_id FROM fingerprints")
+	if err != nil {
+		return nil, fmt.Errorf("error querying song IDs: %s", err)
+	}
+	defer rows.Close()
+
+	var songIDs []models.SongID
+	for rows.Next() {
+		var songID models.SongID
+		if err := rows.Scan(&songID); err != nil {
+			return nil, fmt.Errorf("error scanning row: %s", err)
+		}
+		songIDs = append(songIDs, songID)
+	}
+
+	return songIDs, rows.Err()
+}
+
+func (db *PostgresClient) DeleteFingerprintsBySongID(songID models.SongID) error {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	_, err := db.db.ExecContext(ctx, "DELETE FROM fingerprints WHERE song_id = $1", int64(songID))
+	if err != nil {
+		return fmt.Errorf("failed to delete fingerprints: %v", err)
+	}
+	return nil
+}
+
+// Compact rewrites the tables to return the space left by deletions to the
+// operating system. The tables are locked while they are rewritten.
+func (db *PostgresClient) Compact() error {
+	ctx := bulkContext(db.ctx)
+	if _, err := db.db.ExecContext(ctx, "VACUUM (FULL, ANALYZE) songs, fingerprints, records"); err != nil {
+		return fmt.Errorf("failed to vacuum tables: %v", err)
+	}
+	return nil
+}
+
+// Snapshot dumps the songs and fingerprints tables into a gzipped file of
+// JSON lines, one row per line, as of a single point in time.
+func (db *PostgresClient) Snapshot(dir string) (string, error) {
+	ctx := bulkContext(db.ctx)
+	tx, err := db.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return "", fmt.Errorf("error starting transaction: %s", err)
+	}
+	defer tx.Rollback()
+
+	return writeJSONSnapshot(dir, func(emit func(table string, row interface{}) error) error {
+		rows, err := tx.QueryContext(ctx, "SELECT id, title, artist, yt_id, key, "+postgresSongDetailColumns+" FROM songs")
+		if err != nil {
+			return fmt.Errorf("failed to read songs: %v", err)
+		}
+		for rows.Next() {
+			var id models.SongID
+			var song Song
+			var key string
+			var ytID sql.NullString
+			if err := rows.Scan(append([]interface{}{&id, &song.Title, &song.Artist, &ytID, &key}, songDetailsDest(&song)...)...); err != nil {
+				rows.Close()
+				return fmt.Errorf("error scanning row: %s", err)
+			}
+			song.YouTubeID = ytID.String
+			if err := emit("songs", snapshotSong(id, song, key)); err != nil {
+				rows.Close()
+				return err
+			}
+		}
+		rows.Close()
+
+		rows, err = tx.QueryContext(ctx, "SELECT address, anchor_time_ms, song_id, peak FROM fingerprints")
+		if err != nil {
+			return fmt.Errorf("failed to read fingerprints: %v", err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			address, couple, err := scanPostgresCouple(rows)
+			if err != nil {
+				return fmt.Errorf("error scanning row: %s", err)
+			}
+			row := map[string]interface{}{"address": address, "anchorTimeMs": couple.AnchorTimeMs, "songID": couple.SongID, "peak": couple.PeakCode()}
+			if err := emit("fingerprints", row); err != nil {
+				return err
+			}
+		}
+		return rows.Err()
+	})
+}
+
+func (db *PostgresClient) PutRecord(collection string, record Record) error {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	_, err := db.db.ExecContext(ctx,
+		"INSERT INTO records (collection, id, client_id, created_at, data) VALUES ($1, $2, $3, $4, $5)"+
+			" ON CONFLICT (collection, id) DO UPDATE SET client_id = EXCLUDED.client_id, created_at = EXCLUDED.created_at, data = EXCLUDED.data",
+		collection, record.ID, record.ClientID, record.CreatedAt.UnixNano(), string(record.Data),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to store record: %v", err)
+	}
+	return nil
+}
+
+func (db *PostgresClient) GetRecord(collection, id string) (Record, bool, error) {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	row := db.db.QueryRowContext(ctx,
+		"SELECT id, client_id, created_at, data FROM records WHERE collection = $1 AND id = $2",
+		collection, id,
+	)
+
+	record, err := scanRecord(row)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return Record{}, false, nil
+		}
+		return Record{}, false, fmt.Errorf("failed to retrieve record: %v", err)
+	}
+
+	return record, true, nil
+}
+
+func (db *PostgresClient) ListRecords(collection string, filter RecordFilter) ([]Record, error) {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	query := "SELECT id, client_id, created_at, data FROM records WHERE collection = $1"
+	args := []interface{}{collection}
+	arg := func(value interface{}) string {
+		args = append(args, value)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	if filter.ClientID != "" {
+		query += " AND client_id = " + arg(filter.ClientID)
+	}
+	if !filter.Since.IsZero() {
+		query += " AND created_at >= " + arg(filter.Since.UnixNano())
+	}
+	if !filter.Until.IsZero() {
+		query += " AND created_at < " + arg(filter.Until.UnixNano())
+	}
+	query += " ORDER BY created_at"
+	if filter.Limit > 0 {
+		query += " LIMIT " + arg(filter.Limit)
+	}
+
+	rows, err := db.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list records: %v", err)
+	}
+	defer rows.Close()
+
+	var records []Record
+	for rows.Next() {
+		record, err := scanRecord(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning row: %s", err)
+		}
+		records = append(records, record)
+	}
+
+	return records, rows.Err()
+}
+
+func (db *PostgresClient) DeleteRecord(collection, id string) error {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	_, err := db.db.ExecContext(ctx, "DELETE FROM records WHERE collection = $1 AND id = $2", collection, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete record: %v", err)
+	}
+	return nil
+}
+
+// postgresStaging loads a catalog into shadow tables of the same database.
+type postgresStaging struct {
+	db *sql.DB
+}
+
+func (db *PostgresClient) stageCatalog() (StagedCatalog, error) {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	_, err := db.db.ExecContext(ctx, "DROP TABLE IF EXISTS "+stagedSongs+", "+stagedFingerprints+", songs_retired, fingerprints_retired")
+	if err != nil {
+		return nil, fmt.Errorf("error creating staging tables: %v", err)
+	}
+	if err := createPostgresTables(ctx, db.db, stagedSongs, stagedFingerprints); err != nil {
+		return nil, fmt.Errorf("error creating staging tables: %v", err)
+	}
+	return &postgresStaging{db: db.db}, nil
+}
+
+func (s *postgresStaging) StoreSong(songID models.SongID, song Song) error {
+	return storePostgresSong(context.Background(), s.db, stagedSongs, songID, song)
+}
+
+func (s *postgresStaging) StoreFingerprints(fingerprints map[uint32]models.Couple) error {
+	return storePostgresFingerprints(context.Background(), s.db, stagedFingerprints, fingerprints)
+}
+
+// Promote swaps the tables in a transaction, as PostgreSQL's DDL is
+// transactional, and gives the song index of the staged fingerprints the
+// name of the live one.
+func (s *postgresStaging) Promote() error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %s", err)
+	}
+	defer tx.Rollback()
+
+	for _, query := range []string{
+		"ALTER TABLE songs RENAME TO songs_retired",
+		"ALTER TABLE " + stagedSongs + " RENAME TO songs",
+		"ALTER TABLE fingerprints RENAME TO fingerprints_retired",
+		"ALTER TABLE " + stagedFingerprints + " RENAME TO fingerprints",
+		"DROP TABLE songs_retired, fingerprints_retired",
+		"ALTER INDEX " + stagedFingerprints + "_song_id RENAME TO fingerprints_song_id",
+	} {
+		if _, err := tx.Exec(query); err != nil {
+			return fmt.Errorf("error promoting staged catalog: %v", err)
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *postgresStaging) Discard() error {
+	if _, err := s.db.Exec("DROP TABLE IF EXISTS " + stagedSongs + ", " + stagedFingerprints); err != nil {
+		return fmt.Errorf("error dropping staging tables: %v", err)
+	}
+	return nil
+}
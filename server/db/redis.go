@@ -0,0 +1,442 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"song-recognition/models"
+	"song-recognition/utils"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// redisBatchSize is the number of commands sent per pipeline round trip.
+const redisBatchSize = 1000
+
+// redisIndex keeps the fingerprints of a catalog in Redis, for low latency
+// lookups, while songs and records stay in the backend it wraps. Every
+// address is a hash of its couples, the 12 bytes of their anchor time and
+// song ID (big endian, so that fields sort by anchor time) mapped to their
+// peak code, and every song a set of the addresses it has couples at, so
+// that they can be deleted.
+type redisIndex struct {
+	DBClient
+	pool   *redis.Pool
+	prefix string
+	ctx    context.Context // see WithContext
+}
+
+var redisPools struct {
+	sync.Mutex
+	pools map[string]*redis.Pool
+}
+
+// redisPool returns the connection pool of a Redis server, shared by every
+// client of the process.
+func redisPool(url string) *redis.Pool {
+	redisPools.Lock()
+	defer redisPools.Unlock()
+
+	if pool, ok := redisPools.pools[url]; ok {
+		return pool
+	}
+	pool := &redis.Pool{
+		MaxIdle:     16,
+		IdleTimeout: 4 * time.Minute,
+		Dial: func() (redis.Conn, error) {
+			return redis.DialURL(url, redis.DialConnectTimeout(5*time.Second))
+		},
+		TestOnBorrow: func(conn redis.Conn, idleSince time.Time) error {
+			if time.Since(idleSince) < time.Minute {
+				return nil
+			}
+			_, err := conn.Do("PING")
+			return err
+		},
+	}
+	if redisPools.pools == nil {
+		redisPools.pools = make(map[string]*redis.Pool)
+	}
+	redisPools.pools[url] = pool
+	return pool
+}
+
+// withFingerprintStore moves the fingerprints of client to the store named
+// by FINGERPRINT_STORE. Only "redis" is supported, configured with REDIS_URL
+// (default redis://localhost:6379) and REDIS_KEY_PREFIX (default
+// "seektune:"). client is closed if the store can't be reached.
+func withFingerprintStore(client DBClient, store string, getEnv func(key string, fallback ...string) string) (DBClient, error) {
+	if store != "redis" {
+		client.Close()
+		return nil, fmt.Errorf("unsupported fingerprint store: %s", store)
+	}
+
+	index := &redisIndex{
+		DBClient: client,
+		pool:     redisPool(getEnv("REDIS_URL", "redis://localhost:6379")),
+		prefix:   getEnv("REDIS_KEY_PREFIX", "seektune:"),
+	}
+	conn := index.pool.Get()
+	defer conn.Close()
+	if _, err := conn.Do("PING"); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("error connecting to Redis: %v", err)
+	}
+	return index, nil
+}
+
+func (c *redisIndex) withContext(ctx context.Context) DBClient {
+	bound := *c
+	bound.DBClient = WithContext(ctx, c.DBClient)
+	bound.ctx = ctx
+	return &bound
+}
+
+func (c *redisIndex) addressKey(address uint32) string {
+	return c.prefix + "fp:" + strconv.FormatUint(uint64(address), 10)
+}
+
+func (c *redisIndex) songKey(songID models.SongID) string {
+	return c.prefix + "song:" + strconv.FormatUint(uint64(songID), 10)
+}
+
+func redisCoupleField(couple models.Couple) string {
+	field := make([]byte, 12)
+	binary.BigEndian.PutUint32(field, couple.AnchorTimeMs)
+	binary.BigEndian.PutUint64(field[4:], uint64(couple.SongID))
+	return string(field)
+}
+
+// redisCouples decodes the reply of HGETALL on an address.
+func redisCouples(reply interface{}, err error) ([]models.Couple, error) {
+	fields, err := redis.StringMap(reply, err)
+	if err != nil {
+		return nil, err
+	}
+
+	couples := make([]models.Couple, 0, len(fields))
+	for field, value := range fields {
+		if len(field) != 12 {
+			return nil, fmt.Errorf("invalid couple field %q", field)
+		}
+		peak, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid peak code %q", value)
+		}
+		couple := models.Couple{
+			AnchorTimeMs: binary.BigEndian.Uint32([]byte(field[:4])),
+			SongID:       models.SongID(binary.BigEndian.Uint64([]byte(field[4:]))),
+		}
+		couple.SetPeakCode(uint16(peak))
+		couples = append(couples, couple)
+	}
+	return couples, nil
+}
+
+// conn returns a connection for an operation under ctx, and how long its
+// replies may be waited for (0 for as long as it takes).
+func (c *redisIndex) conn(ctx context.Context) (redis.Conn, time.Duration, error) {
+	conn, err := c.pool.GetContext(ctx)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error connecting to Redis: %v", err)
+	}
+	var timeout time.Duration
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = max(time.Until(deadline), time.Millisecond)
+	}
+	return conn, timeout, nil
+}
+
+// pipeline sends commands in batches of redisBatchSize, handing the reply
+// of each to receive in order. It stops at the first error, or once ctx is
+// done.
+func (c *redisIndex) pipeline(ctx context.Context, commands int, send func(conn redis.Conn, i int) error, receive func(i int, reply interface{}, err error) error) error {
+	conn, timeout, err := c.conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	for start := 0; start < commands; start += redisBatchSize {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		end := min(start+redisBatchSize, commands)
+		for i := start; i < end; i++ {
+			if err := send(conn, i); err != nil {
+				return err
+			}
+		}
+		if err := conn.Flush(); err != nil {
+			return err
+		}
+		for i := start; i < end; i++ {
+			reply, err := redis.ReceiveWithTimeout(conn, timeout)
+			if err := receive(i, reply, err); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// scan returns the keys matching a pattern under the prefix.
+func (c *redisIndex) scan(ctx context.Context, pattern string) ([]string, error) {
+	conn, timeout, err := c.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	var keys []string
+	cursor := "0"
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		reply, err := redis.Values(redis.DoWithTimeout(conn, timeout, "SCAN", cursor, "MATCH", c.prefix+pattern, "COUNT", redisBatchSize))
+		if err != nil {
+			return nil, err
+		}
+		var batch []string
+		if _, err := redis.Scan(reply, &cursor, &batch); err != nil {
+			return nil, err
+		}
+		keys = append(keys, batch...)
+		if cursor == "0" {
+			return keys, nil
+		}
+	}
+}
+
+func (c *redisIndex) StoreFingerprints(fingerprints map[uint32]models.Couple) error {
+	_, err := c.addFingerprints(fingerprints)
+	return err
+}
+
+// addFingerprints stores couples, returning those that weren't replaced as
+// told by the replies of HSET.
+func (c *redisIndex) addFingerprints(fingerprints map[uint32]models.Couple) (map[uint32]models.Couple, error) {
+	ctx, cancel := opContext(c.ctx)
+	defer cancel()
+
+	addresses := make([]uint32, 0, len(fingerprints))
+	songs := make(map[models.SongID][]interface{})
+	for address, couple := range fingerprints {
+		addresses = append(addresses, address)
+		songs[couple.SongID] = append(songs[couple.SongID], address)
+	}
+
+	added := make(map[uint32]models.Couple, len(fingerprints))
+	err := c.pipeline(ctx, len(addresses), func(conn redis.Conn, i int) error {
+		couple := fingerprints[addresses[i]]
+		return conn.Send("HSET", c.addressKey(addresses[i]), redisCoupleField(couple), couple.PeakCode())
+	}, func(i int, reply interface{}, err error) error {
+		fields, err := redis.Int(reply, err)
+		if fields > 0 {
+			added[addresses[i]] = fingerprints[addresses[i]]
+		}
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error inserting fingerprints: %w", err)
+	}
+
+	for songID, songAddresses := range songs {
+		err := c.pipeline(ctx, (len(songAddresses)+redisBatchSize-1)/redisBatchSize, func(conn redis.Conn, i int) error {
+			batch := songAddresses[i*redisBatchSize : min((i+1)*redisBatchSize, len(songAddresses))]
+			return conn.Send("SADD", append([]interface{}{c.songKey(songID)}, batch...)...)
+		}, func(i int, reply interface{}, err error) error {
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error indexing fingerprints of song %d: %w", songID, err)
+		}
+	}
+	return added, nil
+}
+
+// GetCouples looks the addresses up in pipelined round trips.
+func (c *redisIndex) GetCouples(addresses []uint32) (map[uint32][]models.Couple, error) {
+	ctx, cancel := opContext(c.ctx)
+	defer cancel()
+
+	result := make(map[uint32][]models.Couple)
+	err := c.pipeline(ctx, len(addresses), func(conn redis.Conn, i int) error {
+		return conn.Send("HGETALL", c.addressKey(addresses[i]))
+	}, func(i int, reply interface{}, err error) error {
+		couples, err := redisCouples(reply, err)
+		if err != nil {
+			return err
+		}
+		if len(couples) > 0 {
+			result[addresses[i]] = append(result[addresses[i]], couples...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error querying Redis: %w", err)
+	}
+	return result, nil
+}
+
+func (c *redisIndex) ForEachFingerprint(fn func(address uint32, couple models.Couple) error) error {
+	ctx := bulkContext(c.ctx)
+
+	keys, err := c.scan(ctx, "fp:*")
+	if err != nil {
+		return fmt.Errorf("error listing fingerprints: %v", err)
+	}
+	addresses := make([]uint32, 0, len(keys))
+	for _, key := range keys {
+		address, err := strconv.ParseUint(strings.TrimPrefix(key, c.prefix+"fp:"), 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid fingerprint key %q", key)
+		}
+		addresses = append(addresses, uint32(address))
+	}
+	slices.Sort(addresses)
+
+	// Addresses are fetched a batch at a time, as they are visited
+	bound := c.withContext(ctx)
+	for start := 0; start < len(addresses); start += redisBatchSize {
+		batch := addresses[start:min(start+redisBatchSize, len(addresses))]
+		couples, err := bound.GetCouples(batch)
+		if err != nil {
+			return err
+		}
+		for _, address := range batch {
+			slices.SortFunc(couples[address], func(a, b models.Couple) int {
+				return bytes.Compare([]byte(redisCoupleField(a)), []byte(redisCoupleField(b)))
+			})
+			for _, couple := range couples[address] {
+				if err := fn(address, couple); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (c *redisIndex) FingerprintSongIDs() ([]models.SongID, error) {
+	keys, err := c.scan(bulkContext(c.ctx), "song:*")
+	if err != nil {
+		return nil, fmt.Errorf("error querying song IDs: %v", err)
+	}
+
+	songIDs := make([]models.SongID, 0, len(keys))
+	for _, key := range keys {
+		songID, err := models.ParseSongID(strings.TrimPrefix(key, c.prefix+"song:"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid song key %q", key)
+		}
+		songIDs = append(songIDs, songID)
+	}
+	return songIDs, nil
+}
+
+func (c *redisIndex) DeleteFingerprintsBySongID(songID models.SongID) error {
+	ctx, cancel := opContext(c.ctx)
+	defer cancel()
+	conn, timeout, err := c.conn(ctx)
+	if err != nil {
+		return err
+	}
+	addresses, err := redis.Strings(redis.DoWithTimeout(conn, timeout, "SMEMBERS", c.songKey(songID)))
+	conn.Close()
+	if err != nil {
+		return fmt.Errorf("failed to delete fingerprints: %v", err)
+	}
+
+	// The fields of the song's couples are found first, then deleted
+	var deletions [][]interface{}
+	err = c.pipeline(ctx, len(addresses), func(conn redis.Conn, i int) error {
+		return conn.Send("HKEYS", c.prefix+"fp:"+addresses[i])
+	}, func(i int, reply interface{}, err error) error {
+		fields, err := redis.Strings(reply, err)
+		if err != nil {
+			return err
+		}
+		args := []interface{}{c.prefix + "fp:" + addresses[i]}
+		for _, field := range fields {
+			if len(field) == 12 && models.SongID(binary.BigEndian.Uint64([]byte(field[4:]))) == songID {
+				args = append(args, field)
+			}
+		}
+		if len(args) > 1 {
+			deletions = append(deletions, args)
+		}
+		return nil
+	})
+	if err == nil {
+		err = c.pipeline(ctx, len(deletions), func(conn redis.Conn, i int) error {
+			return conn.Send("HDEL", deletions[i]...)
+		}, func(i int, reply interface{}, err error) error {
+			return err
+		})
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete fingerprints: %v", err)
+	}
+
+	conn, timeout, err = c.conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := redis.DoWithTimeout(conn, timeout, "DEL", c.songKey(songID)); err != nil {
+		return fmt.Errorf("failed to delete fingerprints: %v", err)
+	}
+	return nil
+}
+
+// DeleteCollection deletes every key of the index along with the
+// fingerprints collection of the wrapped backend.
+func (c *redisIndex) DeleteCollection(collectionName string) error {
+	if collectionName == "fingerprints" {
+		ctx := bulkContext(c.ctx)
+		var keys []string
+		for _, pattern := range []string{"fp:*", "song:*"} {
+			matched, err := c.scan(ctx, pattern)
+			if err != nil {
+				return fmt.Errorf("error deleting collection: %v", err)
+			}
+			keys = append(keys, matched...)
+		}
+		err := c.pipeline(ctx, len(keys), func(conn redis.Conn, i int) error {
+			return conn.Send("DEL", keys[i])
+		}, func(i int, reply interface{}, err error) error {
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("error deleting collection: %v", err)
+		}
+	}
+	return c.DBClient.DeleteCollection(collectionName)
+}
+
+// Snapshot dumps the songs of the wrapped backend and the fingerprints of the
+// index into a gzipped file of JSON lines, one row per line. Songs and
+// fingerprints stored meanwhile may or may not be included.
+func (c *redisIndex) Snapshot(dir string) (string, error) {
+	return writeJSONSnapshot(dir, func(emit func(table string, row interface{}) error) error {
+		err := c.ForEachSong(func(songID models.SongID, song Song) error {
+			return emit("songs", snapshotSong(songID, song, utils.GenerateSongKey(song.Title, song.Artist)))
+		})
+		if err != nil {
+			return fmt.Errorf("failed to read songs: %v", err)
+		}
+		return c.ForEachFingerprint(func(address uint32, couple models.Couple) error {
+			return emit("fingerprints", map[string]interface{}{
+				"address": address, "anchorTimeMs": couple.AnchorTimeMs, "songID": couple.SongID, "peak": couple.PeakCode(),
+			})
+		})
+	})
+}
@@ -0,0 +1,227 @@
+package db
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net"
+	"song-recognition/models"
+	"song-recognition/utils"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/gocql/gocql"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// RetryConfig describes how WithRetries retries operations failing with
+// transient errors.
+type RetryConfig struct {
+	MaxAttempts int           // attempts per operation, including the first one
+	BaseDelay   time.Duration // delay before the first retry, doubled for each next one
+	MaxDelay    time.Duration // longest delay between two attempts
+}
+
+// retryConfig reads a RetryConfig from DB_RETRY_ATTEMPTS (default 8, 1
+// disables retries), DB_RETRY_BASE_DELAY (default 250ms) and
+// DB_RETRY_MAX_DELAY (default 10s).
+func retryConfig(getEnv func(key string, fallback ...string) string) (RetryConfig, error) {
+	config := RetryConfig{MaxAttempts: 8, BaseDelay: 250 * time.Millisecond, MaxDelay: 10 * time.Second}
+	if value := getEnv("DB_RETRY_ATTEMPTS"); value != "" {
+		attempts, err := strconv.Atoi(value)
+		if err != nil || attempts < 1 {
+			return config, fmt.Errorf("invalid DB_RETRY_ATTEMPTS: %q", value)
+		}
+		config.MaxAttempts = attempts
+	}
+	for key, delay := range map[string]*time.Duration{
+		"DB_RETRY_BASE_DELAY": &config.BaseDelay,
+		"DB_RETRY_MAX_DELAY":  &config.MaxDelay,
+	} {
+		value := getEnv(key)
+		if value == "" {
+			continue
+		}
+		duration, err := time.ParseDuration(value)
+		if err != nil || duration < 0 {
+			return config, fmt.Errorf("invalid %s: %q", key, value)
+		}
+		*delay = duration
+	}
+	return config, nil
+}
+
+// delay returns how long to wait before the given retry, counted from 1:
+// half of the exponential delay, plus a random share of the other half so
+// that clients failing together don't retry together.
+func (c RetryConfig) delay(retry int) time.Duration {
+	delay := c.MaxDelay
+	if shift := retry - 1; shift < 32 && c.BaseDelay<<shift < c.MaxDelay {
+		delay = c.BaseDelay << shift
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// retryingClient wraps a DBClient, retrying the fingerprint operations that
+// fail with transient errors. Storing fingerprints is idempotent on every
+// backend, so a write that failed halfway through can be replayed whole.
+type retryingClient struct {
+	DBClient
+	config RetryConfig
+	ctx    context.Context // see WithContext
+}
+
+// WithRetries wraps a client so that StoreFingerprints and GetCouples are
+// retried with exponential backoff when they fail with errors IsTransient
+// reports, such as dropped connections or a failover of the primary, instead
+// of aborting a long ingestion run.
+func WithRetries(client DBClient, config RetryConfig) DBClient {
+	return &retryingClient{DBClient: client, config: config}
+}
+
+func (r *retryingClient) withContext(ctx context.Context) DBClient {
+	return &retryingClient{DBClient: WithContext(ctx, r.DBClient), config: r.config, ctx: ctx}
+}
+
+// retry runs op until it succeeds, fails with an error that isn't
+// transient, runs out of attempts or the context of the client is done.
+func (r *retryingClient) retry(name string, op func() error) error {
+	ctx := bulkContext(r.ctx)
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil || attempt >= r.config.MaxAttempts || !IsTransient(err) || ctx.Err() != nil {
+			return err
+		}
+
+		delay := r.config.delay(attempt)
+		utils.GetLogger().Warn("Retrying database operation after transient error",
+			slog.String("operation", name), slog.Int("attempt", attempt),
+			slog.Duration("delay", delay), slog.Any("error", err))
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+func (r *retryingClient) StoreFingerprints(fingerprints map[uint32]models.Couple) error {
+	return r.retry("StoreFingerprints", func() error {
+		return r.DBClient.StoreFingerprints(fingerprints)
+	})
+}
+
+func (r *retryingClient) GetCouples(addresses []uint32) (map[uint32][]models.Couple, error) {
+	var couples map[uint32][]models.Couple
+	err := r.retry("GetCouples", func() error {
+		var err error
+		couples, err = r.DBClient.GetCouples(addresses)
+		return err
+	})
+	return couples, err
+}
+
+// Server error codes of MongoDB raised while a replica set elects a new
+// primary or a node shuts down.
+var mongoFailoverCodes = []int{
+	6,     // HostUnreachable
+	7,     // HostNotFound
+	89,    // NetworkTimeout
+	91,    // ShutdownInProgress
+	189,   // PrimarySteppedDown
+	9001,  // SocketException
+	10107, // NotWritablePrimary
+	11600, // InterruptedAtShutdown
+	13435, // NotPrimaryNoSecondaryOk
+}
+
+// IsTransient reports whether err is worth retrying: a dropped or refused
+// connection, a timeout, a failover of the primary, a deadlock or lock
+// timeout, or a fault injected with DB_FAULTS. Canceled operations aren't.
+func IsTransient(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	if errors.Is(err, ErrInjectedFault) || errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	// MongoDB
+	if mongo.IsNetworkError(err) || mongo.IsTimeout(err) {
+		return true
+	}
+	var serverErr mongo.ServerError
+	if errors.As(err, &serverErr) {
+		if serverErr.HasErrorLabel("RetryableWriteError") || serverErr.HasErrorLabel("TransientTransactionError") {
+			return true
+		}
+		for _, code := range mongoFailoverCodes {
+			if serverErr.HasErrorCode(code) {
+				return true
+			}
+		}
+	}
+
+	// MySQL: lock wait timeout, deadlock, read-only server (a demoted
+	// primary) and read-only session
+	if errors.Is(err, mysql.ErrInvalidConn) {
+		return true
+	}
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		switch mysqlErr.Number {
+		case 1205, 1213, 1290, 1836:
+			return true
+		}
+	}
+
+	// PostgreSQL: connection exceptions, serialization failures, deadlocks,
+	// shutdowns and read-only transactions (a standby being promoted)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		if pqErr.Code.Class() == "08" {
+			return true
+		}
+		switch pqErr.Code {
+		case "40001", "40P01", "57P01", "57P02", "57P03", "25006":
+			return true
+		}
+	}
+
+	// SQLite: the database is locked by another connection
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked
+	}
+
+	// Cassandra: unavailable replicas, write and read timeouts, overloaded
+	// or bootstrapping nodes
+	if errors.Is(err, gocql.ErrTimeoutNoResponse) || errors.Is(err, gocql.ErrConnectionClosed) || errors.Is(err, gocql.ErrNoConnections) {
+		return true
+	}
+	var cassandraErr gocql.RequestError
+	if errors.As(err, &cassandraErr) {
+		switch cassandraErr.Code() {
+		case 0x1000, 0x1001, 0x1002, 0x1100, 0x1200:
+			return true
+		}
+	}
+	return false
+}
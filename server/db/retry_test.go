@@ -0,0 +1,78 @@
+package db_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"song-recognition/db"
+	"song-recognition/models"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// flakyClient fails the first calls to StoreFingerprints with err.
+type flakyClient struct {
+	db.DBClient
+	failures int
+	err      error
+	calls    int
+}
+
+func (f *flakyClient) StoreFingerprints(fingerprints map[uint32]models.Couple) error {
+	f.calls++
+	if f.calls <= f.failures {
+		return fmt.Errorf("failed to store fingerprints: %w", f.err)
+	}
+	return f.DBClient.StoreFingerprints(fingerprints)
+}
+
+func TestRetries(t *testing.T) {
+	config := db.RetryConfig{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond}
+	fingerprints := map[uint32]models.Couple{1: {AnchorTimeMs: 10, SongID: 1}}
+
+	for _, test := range []struct {
+		name      string
+		failures  int
+		err       error
+		wantCalls int
+		wantErr   bool
+	}{
+		{"transient", 2, syscall.ECONNRESET, 3, false},
+		{"exhausted", 3, io.ErrUnexpectedEOF, 3, true},
+		{"permanent", 1, errors.New("duplicate key"), 1, true},
+		{"canceled", 1, context.Canceled, 1, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			flaky := &flakyClient{DBClient: newSQLite(t), failures: test.failures, err: test.err}
+			err := db.WithRetries(flaky, config).StoreFingerprints(fingerprints)
+			if (err != nil) != test.wantErr {
+				t.Errorf("StoreFingerprints returned %v", err)
+			}
+			if flaky.calls != test.wantCalls {
+				t.Errorf("StoreFingerprints was called %d times, want %d", flaky.calls, test.wantCalls)
+			}
+		})
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	for _, test := range []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{errors.New("syntax error"), false},
+		{fmt.Errorf("GetCouples: %w", db.ErrInjectedFault), true},
+		{fmt.Errorf("failed to query: %w", &pq.Error{Code: "57P01"}), true},
+		{&pq.Error{Code: "08006"}, true},
+		{&pq.Error{Code: "23505"}, false},
+	} {
+		if got := db.IsTransient(test.err); got != test.want {
+			t.Errorf("IsTransient(%v) = %v, want %v", test.err, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const schemaVersionID = "schema_version" // in catalogCollection
+
+// ErrSchemaNewer is returned for catalogs upgraded by a newer version of the
+// server, whose songs, fingerprints or records this one may not understand.
+var ErrSchemaNewer = errors.New("the catalog schema is newer than this server supports")
+
+// Migration brings the catalogs of the previous schema version to Version,
+// such as by reshaping the songs, fingerprints or records they hold.
+type Migration struct {
+	Version     int    `json:"version"`
+	Description string `json:"description"`
+	// Apply migrates a catalog. An interrupted upgrade applies the
+	// migration it was in again, so it must be safe to repeat.
+	Apply func(client DBClient) error `json:"-"`
+}
+
+// migrations are the changes made to the schema, in order. A change to the
+// shape of stored data appends a migration converting existing catalogs;
+// catalogs created afterwards start at the latest version.
+var migrations = []Migration{
+	{
+		Version:     1,
+		Description: "delete the fingerprints of songs deleted before deletions cascaded",
+		Apply: func(client DBClient) error {
+			_, err := PruneOrphanFingerprints(client)
+			return err
+		},
+	},
+	{
+		Version:     2,
+		Description: "record the fingerprint checksums of songs saved before checksums were",
+		Apply: func(client DBClient) error {
+			_, err := RefreshFingerprintChecksums(client)
+			return err
+		},
+	},
+	{
+		Version:     3,
+		Description: "count the catalog stats",
+		Apply: func(client DBClient) error {
+			_, err := CountCatalogStats(client)
+			return err
+		},
+	},
+	{
+		Version:     4,
+		Description: "copy the album, duration, release year and genre recorded for songs into them",
+		Apply:       copySongMetadata,
+	},
+}
+
+// LatestSchemaVersion returns the schema version of catalogs created or
+// upgraded by this server.
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// SchemaVersion is the version of the schema of a catalog.
+type SchemaVersion struct {
+	Version   int       `json:"version"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// ReadSchemaVersion returns the schema version of a catalog, and false for
+// catalogs created before schemas were versioned, or not created yet.
+func ReadSchemaVersion(client DBClient) (SchemaVersion, bool, error) {
+	var version SchemaVersion
+	record, exists, err := client.GetRecord(catalogCollection, schemaVersionID)
+	if err != nil || !exists {
+		return version, false, err
+	}
+	if err := json.Unmarshal(record.Data, &version); err != nil {
+		return version, false, fmt.Errorf("failed to unmarshal schema version: %v", err)
+	}
+	return version, true, nil
+}
+
+func writeSchemaVersion(client DBClient, version int) error {
+	schema := SchemaVersion{Version: version, UpdatedAt: time.Now().UTC()}
+	data, err := json.Marshal(schema)
+	if err != nil {
+		return fmt.Errorf("failed to marshal schema version: %v", err)
+	}
+	err = client.PutRecord(catalogCollection, Record{ID: schemaVersionID, CreatedAt: schema.UpdatedAt, Data: data})
+	if err != nil {
+		return fmt.Errorf("failed to store schema version: %v", err)
+	}
+	return nil
+}
+
+// CurrentSchemaVersion returns the schema version of a catalog. Catalogs
+// without one are at version 0, unless they are empty: those are new
+// catalogs, at the latest version.
+func CurrentSchemaVersion(client DBClient) (int, error) {
+	schema, exists, err := ReadSchemaVersion(client)
+	if err != nil || exists {
+		return schema.Version, err
+	}
+	songs, err := client.TotalSongs()
+	if err != nil || songs > 0 {
+		return 0, err
+	}
+	songIDs, err := client.FingerprintSongIDs()
+	if err != nil || len(songIDs) > 0 {
+		return 0, err
+	}
+	return LatestSchemaVersion(), nil
+}
+
+// PendingMigrations returns the migrations a catalog needs to reach the
+// latest schema version. It fails with ErrSchemaNewer for catalogs of a
+// later version.
+func PendingMigrations(client DBClient) ([]Migration, error) {
+	version, err := CurrentSchemaVersion(client)
+	if err != nil {
+		return nil, err
+	}
+	if version > LatestSchemaVersion() {
+		return nil, fmt.Errorf("%w: version %d, this server supports %d", ErrSchemaNewer, version, LatestSchemaVersion())
+	}
+	var pending []Migration
+	for _, migration := range migrations {
+		if migration.Version > version {
+			pending = append(pending, migration)
+		}
+	}
+	return pending, nil
+}
+
+// UpgradeSchema applies the pending migrations of a catalog in order,
+// recording the schema version after each one so that an interrupted
+// upgrade resumes where it stopped. started is called before each
+// migration. It returns the migrations applied. Only one process should
+// upgrade a catalog at a time.
+func UpgradeSchema(client DBClient, started func(Migration)) ([]Migration, error) {
+	pending, err := PendingMigrations(client)
+	if err != nil {
+		return nil, err
+	}
+	var applied []Migration
+	for _, migration := range pending {
+		if started != nil {
+			started(migration)
+		}
+		if err := migration.Apply(client); err != nil {
+			return applied, fmt.Errorf("schema migration %d (%s) failed: %v", migration.Version, migration.Description, err)
+		}
+		if err := writeSchemaVersion(client, migration.Version); err != nil {
+			return applied, err
+		}
+		applied = append(applied, migration)
+	}
+	if len(pending) == 0 {
+		// Stamp new catalogs, so that they aren't taken for old ones once
+		// songs are added
+		if _, exists, err := ReadSchemaVersion(client); err != nil || !exists {
+			if err == nil {
+				err = writeSchemaVersion(client, LatestSchemaVersion())
+			}
+			return applied, err
+		}
+	}
+	return applied, nil
+}
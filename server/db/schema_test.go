@@ -0,0 +1,133 @@
+package db_test
+
+import (
+	"bytes"
+	"errors"
+	"song-recognition/db"
+	"song-recognition/models"
+	"testing"
+	"time"
+)
+
+func TestUpgradeSchema(t *testing.T) {
+	client := newMemory(t)
+
+	// A new catalog is at the latest version, and stamped with it
+	applied, err := db.UpgradeSchema(client, nil)
+	if err != nil {
+		t.Fatalf("UpgradeSchema: %v", err)
+	}
+	if len(applied) != 0 {
+		t.Errorf("UpgradeSchema applied %d migrations to a new catalog; want none", len(applied))
+	}
+	schema, exists, err := db.ReadSchemaVersion(client)
+	if err != nil || !exists || schema.Version != db.LatestSchemaVersion() {
+		t.Fatalf("ReadSchemaVersion = %v, %v, %v; want version %d", schema, exists, err, db.LatestSchemaVersion())
+	}
+
+	// A catalog from before schemas were versioned needs every migration
+	if err := client.DeleteCollection("catalog"); err != nil {
+		t.Fatalf("DeleteCollection: %v", err)
+	}
+	storeSongs(t, client, 1)
+	metadata := db.Record{ID: "1", CreatedAt: time.Now(), Data: []byte(`{"songId":1,"album":"Album","year":2001,"durationMs":1000}`)}
+	if err := client.PutRecord("song_metadata", metadata); err != nil {
+		t.Fatalf("PutRecord: %v", err)
+	}
+	orphan := models.Couple{AnchorTimeMs: 20, SongID: 2}
+	if err := client.StoreFingerprints(map[uint32]models.Couple{7: {AnchorTimeMs: 10, SongID: 1}, 8: orphan}); err != nil {
+		t.Fatalf("StoreFingerprints: %v", err)
+	}
+	pending, err := db.PendingMigrations(client)
+	if err != nil {
+		t.Fatalf("PendingMigrations: %v", err)
+	}
+	if len(pending) != db.LatestSchemaVersion() {
+		t.Fatalf("PendingMigrations = %d migrations; want %d", len(pending), db.LatestSchemaVersion())
+	}
+
+	var started []int
+	applied, err = db.UpgradeSchema(client, func(migration db.Migration) {
+		started = append(started, migration.Version)
+	})
+	if err != nil {
+		t.Fatalf("UpgradeSchema: %v", err)
+	}
+	if len(applied) != len(pending) || len(started) != len(pending) || started[0] != 1 {
+		t.Errorf("UpgradeSchema applied %v, started %v; want %d migrations from 1", applied, started, len(pending))
+	}
+	if version, err := db.CurrentSchemaVersion(client); err != nil || version != db.LatestSchemaVersion() {
+		t.Errorf("CurrentSchemaVersion = %d, %v; want %d", version, err, db.LatestSchemaVersion())
+	}
+	couples, err := client.GetCouples([]uint32{7, 8})
+	if err != nil {
+		t.Fatalf("GetCouples: %v", err)
+	}
+	if len(couples[7]) != 1 || len(couples[8]) != 0 {
+		t.Errorf("GetCouples = %v; want the fingerprints of song 2, which doesn't exist, pruned", couples)
+	}
+	if _, counted, err := db.ReadCatalogStats(client); err != nil || !counted {
+		t.Errorf("ReadCatalogStats = %v, %v; want the stats counted", counted, err)
+	}
+	song, _, err := client.GetSongByID(1)
+	if want := (db.SongDetails{Album: "Album", DurationMs: 1000, ReleaseYear: 2001}); err != nil || song.SongDetails != want {
+		t.Errorf("GetSongByID = %+v, %v; want the details of its metadata, %+v", song, err, want)
+	}
+
+	// A catalog upgraded by a newer server is refused
+	newer := db.Record{ID: "schema_version", CreatedAt: time.Now(), Data: []byte(`{"version":99}`)}
+	if err := client.PutRecord("catalog", newer); err != nil {
+		t.Fatalf("PutRecord: %v", err)
+	}
+	if _, err := db.UpgradeSchema(client, nil); !errors.Is(err, db.ErrSchemaNewer) {
+		t.Errorf("UpgradeSchema on version 99 = %v; want ErrSchemaNewer", err)
+	}
+}
+
+func TestImportAllRecordsSchemaVersion(t *testing.T) {
+	source := newMemory(t)
+	storeSongs(t, source, 1)
+	older := db.Record{ID: "schema_version", CreatedAt: time.Now(), Data: []byte(`{"version":2}`)}
+	if err := source.PutRecord("catalog", older); err != nil {
+		t.Fatalf("PutRecord: %v", err)
+	}
+	var archive bytes.Buffer
+	manifest, err := db.ExportAll(source, &archive)
+	if err != nil {
+		t.Fatalf("ExportAll: %v", err)
+	}
+	if manifest.SchemaVersion != 2 {
+		t.Errorf("manifest schema version = %d; want 2", manifest.SchemaVersion)
+	}
+
+	// The catalog takes the schema of the archive, and migrates from there
+	target := newSQLite(t)
+	if _, err := db.UpgradeSchema(target, nil); err != nil {
+		t.Fatalf("UpgradeSchema: %v", err)
+	}
+	if _, err := db.ImportAll(target, &archive, false); err != nil {
+		t.Fatalf("ImportAll: %v", err)
+	}
+	if version, err := db.CurrentSchemaVersion(target); err != nil || version != 2 {
+		t.Errorf("CurrentSchemaVersion = %d, %v after importing an archive of version 2; want 2", version, err)
+	}
+	if pending, err := db.PendingMigrations(target); err != nil || len(pending) != db.LatestSchemaVersion()-2 {
+		t.Errorf("PendingMigrations = %d migrations, %v; want %d", len(pending), err, db.LatestSchemaVersion()-2)
+	}
+
+	// Archives of a newer schema are refused
+	newer := db.Record{ID: "schema_version", CreatedAt: time.Now(), Data: []byte(`{"version":99}`)}
+	if err := source.PutRecord("catalog", newer); err != nil {
+		t.Fatalf("PutRecord: %v", err)
+	}
+	archive.Reset()
+	if _, err := db.ExportAll(source, &archive); err != nil {
+		t.Fatalf("ExportAll: %v", err)
+	}
+	if _, err := db.ImportAll(target, &archive, false); !errors.Is(err, db.ErrSchemaNewer) {
+		t.Errorf("ImportAll of an archive of version 99 = %v; want ErrSchemaNewer", err)
+	}
+	if version, err := db.CurrentSchemaVersion(target); err != nil || version != 2 {
+		t.Errorf("CurrentSchemaVersion = %d, %v after a refused import; want 2", version, err)
+	}
+}
@@ -0,0 +1,55 @@
+package db
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"song-recognition/utils"
+	"time"
+)
+
+// writeJSONSnapshot creates a gzipped file of JSON lines in dir and lets dump
+// fill it through emit, which writes one {"table": ..., "row": ...} line.
+func writeJSONSnapshot(dir string, dump func(emit func(table string, row interface{}) error) error) (string, error) {
+	err := utils.CreateFolder(dir)
+	if err != nil {
+		return "", fmt.Errorf("failed to create snapshot dir: %v", err)
+	}
+
+	path := filepath.Join(dir, fmt.Sprintf("snapshot_%s.jsonl.gz", time.Now().UTC().Format("20060102T150405")))
+	file, err := os.Create(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to create snapshot file: %v", err)
+	}
+	defer file.Close()
+
+	gz := gzip.NewWriter(file)
+	encoder := json.NewEncoder(gz)
+
+	err = dump(func(table string, row interface{}) error {
+		if err := encoder.Encode(map[string]interface{}{"table": table, "row": row}); err != nil {
+			return fmt.Errorf("failed to write snapshot: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if err := gz.Close(); err != nil {
+		return "", fmt.Errorf("failed to write snapshot: %v", err)
+	}
+
+	return path, nil
+}
+
+// snapshotSong returns the row of a song in a JSON snapshot.
+func snapshotSong(songID interface{}, song Song, key string) map[string]interface{} {
+	return map[string]interface{}{
+		"id": songID, "title": song.Title, "artist": song.Artist, "ytID": song.YouTubeID, "key": key,
+		"album": song.Album, "durationMs": song.DurationMs, "releaseYear": song.ReleaseYear,
+		"genre": song.Genre, "coverArtURL": song.CoverArtURL, "ingestedAtMs": song.IngestedAtMs,
+	}
+}
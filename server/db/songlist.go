@@ -0,0 +1,144 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"song-recognition/models"
+	"sort"
+	"strings"
+)
+
+// SongOrder is the order ListSongs lists songs in.
+type SongOrder string
+
+const (
+	// SongsByTitle orders songs by title, then artist, ignoring case.
+	SongsByTitle SongOrder = "title"
+	// SongsByIngestion orders songs by the time they were ingested at,
+	// songs ingested before it was recorded first.
+	SongsByIngestion SongOrder = "ingested"
+)
+
+// SongFilter selects the songs listed by ListSongs and orders them. Zero
+// values match every song, by title.
+type SongFilter struct {
+	Artist     string // part of the artist, ignoring case
+	OrderBy    SongOrder
+	Descending bool
+}
+
+// ListedSong is a song listed by ListSongs.
+type ListedSong struct {
+	ID models.SongID
+	Song
+}
+
+// checkSongList fails for the arguments of ListSongs no backend accepts.
+func checkSongList(offset, limit int, filter SongFilter) error {
+	if offset < 0 || limit < 0 {
+		return fmt.Errorf("invalid song list offset %d or limit %d", offset, limit)
+	}
+	switch filter.OrderBy {
+	case "", SongsByTitle, SongsByIngestion:
+		return nil
+	}
+	return fmt.Errorf("invalid song order %q, expected %q or %q", filter.OrderBy, SongsByTitle, SongsByIngestion)
+}
+
+// listSongs lists the songs visited by forEach the way ListSongs does, for
+// backends that can't filter and order songs themselves.
+func listSongs(forEach func(fn func(songID models.SongID, song Song) error) error, offset, limit int, filter SongFilter) ([]ListedSong, error) {
+	if err := checkSongList(offset, limit, filter); err != nil {
+		return nil, err
+	}
+	artist := strings.ToLower(filter.Artist)
+	var songs []ListedSong
+	err := forEach(func(songID models.SongID, song Song) error {
+		if strings.Contains(strings.ToLower(song.Artist), artist) {
+			songs = append(songs, ListedSong{ID: songID, Song: song})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(songs, func(i, j int) bool {
+		a, b := songs[i], songs[j]
+		if filter.Descending {
+			a, b = b, a
+		}
+		if filter.OrderBy == SongsByIngestion {
+			if a.IngestedAtMs != b.IngestedAtMs {
+				return a.IngestedAtMs < b.IngestedAtMs
+			}
+		} else {
+			if titleA, titleB := strings.ToLower(a.Title), strings.ToLower(b.Title); titleA != titleB {
+				return titleA < titleB
+			}
+			if artistA, artistB := strings.ToLower(a.Artist), strings.ToLower(b.Artist); artistA != artistB {
+				return artistA < artistB
+			}
+		}
+		return a.ID < b.ID
+	})
+
+	if offset >= len(songs) {
+		return nil, nil
+	}
+	songs = songs[offset:]
+	if limit > 0 && limit < len(songs) {
+		songs = songs[:limit]
+	}
+	return songs, nil
+}
+
+// likeSubstring returns the pattern of a LIKE ... ESCAPE '!' condition
+// matching the lowercase strings containing s, ignoring case.
+func likeSubstring(s string) string {
+	escaped := strings.NewReplacer("!", "!!", "%", "!%", "_", "!_").Replace(strings.ToLower(s))
+	return "%" + escaped + "%"
+}
+
+// songListOrder returns the ORDER BY, LIMIT and OFFSET clauses of a
+// ListSongs query on a SQL backend, whose function lowering the case of a
+// string is lower and whose column of the ingestion time is ingestedAt.
+func songListOrder(offset, limit int, filter SongFilter, lower, ingestedAt string) string {
+	columns := []string{lower + "(title)", lower + "(artist)", "id"}
+	if filter.OrderBy == SongsByIngestion {
+		columns = []string{ingestedAt, "id"}
+	}
+	if filter.Descending {
+		for i := range columns {
+			columns[i] += " DESC"
+		}
+	}
+	if limit == 0 {
+		limit = math.MaxInt64
+	}
+	return fmt.Sprintf(" ORDER BY %s LIMIT %d OFFSET %d", strings.Join(columns, ", "), limit, offset)
+}
+
+// listSQLSongs runs a ListSongs query selecting the ID, title, artist and
+// YouTube ID of songs, then their songDetailColumns.
+func listSQLSongs(ctx context.Context, db *sql.DB, query string, args ...interface{}) ([]ListedSong, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error listing songs: %s", err)
+	}
+	defer rows.Close()
+
+	var songs []ListedSong
+	for rows.Next() {
+		var song ListedSong
+		var ytID sql.NullString
+		if err := rows.Scan(append([]interface{}{&song.ID, &song.Title, &song.Artist, &ytID}, songDetailsDest(&song.Song)...)...); err != nil {
+			return nil, fmt.Errorf("error scanning row: %s", err)
+		}
+		song.YouTubeID = ytID.String
+		songs = append(songs, song)
+	}
+	return songs, rows.Err()
+}
@@ -1,17 +1,21 @@
 package db
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"path/filepath"
 	"song-recognition/models"
 	"song-recognition/utils"
 	"strings"
+	"time"
 
 	"github.com/mattn/go-sqlite3"
 )
 
 type SQLiteClient struct {
-	db *sql.DB
+	db  *sql.DB
+	ctx context.Context // see WithContext
 }
 
 func NewSQLiteClient(dataSourceName string) (*SQLiteClient, error) {
@@ -37,26 +41,49 @@ func NewSQLiteClient(dataSourceName string) (*SQLiteClient, error) {
 	return &SQLiteClient{db: db}, nil
 }
 
-
-// createTables creates the required tables if they don't exist
-func createTables(db *sql.DB) error {
-	createSongsTable := `
-    CREATE TABLE IF NOT EXISTS songs (
+// Schemas of the songs and fingerprints tables, formatted with the name of
+// the table so catalogs can be staged next to them
+const (
+	sqliteSongsTable = `
+    CREATE TABLE IF NOT EXISTS %s (
         id INTEGER PRIMARY KEY AUTOINCREMENT,
         title TEXT NOT NULL,
         artist TEXT NOT NULL,
         ytID TEXT,
-        key TEXT NOT NULL UNIQUE
+        key TEXT NOT NULL UNIQUE,
+        album TEXT NOT NULL DEFAULT '',
+        durationMs INTEGER NOT NULL DEFAULT 0,
+        releaseYear INTEGER NOT NULL DEFAULT 0,
+        genre TEXT NOT NULL DEFAULT '',
+        coverArtURL TEXT NOT NULL DEFAULT '',
+        ingestedAtMs INTEGER NOT NULL DEFAULT 0
     );
     `
-
-	createFingerprintsTable := `
-    CREATE TABLE IF NOT EXISTS fingerprints (
+	sqliteFingerprintsTable = `
+    CREATE TABLE IF NOT EXISTS %s (
         address INTEGER NOT NULL,
         anchorTimeMs INTEGER NOT NULL,
         songID INTEGER NOT NULL,
+        peak INTEGER NOT NULL DEFAULT 0,
         PRIMARY KEY (address, anchorTimeMs, songID)
     );
+    `
+)
+
+// createTables creates the required tables if they don't exist
+func createTables(db *sql.DB) error {
+	createSongsTable := fmt.Sprintf(sqliteSongsTable, "songs")
+	createFingerprintsTable := fmt.Sprintf(sqliteFingerprintsTable, "fingerprints")
+
+	createRecordsTable := `
+    CREATE TABLE IF NOT EXISTS records (
+        collection TEXT NOT NULL,
+        id TEXT NOT NULL,
+        clientID TEXT NOT NULL DEFAULT '',
+        createdAt INTEGER NOT NULL,
+        data TEXT NOT NULL,
+        PRIMARY KEY (collection, id)
+    );
     `
 
 	_, err := db.Exec(createSongsTable)
@@ -69,9 +96,51 @@ func createTables(db *sql.DB) error {
 		return fmt.Errorf("error creating fingerprints table: %s", err)
 	}
 
+	// Catalogs created before couples carried peak details lack the column
+	err = addSQLiteColumn(db, "fingerprints", "peak", "INTEGER NOT NULL DEFAULT 0")
+	if err != nil {
+		return fmt.Errorf("error upgrading fingerprints table: %s", err)
+	}
+
+	// Catalogs created before songs carried their details lack the columns
+	for _, column := range []struct{ name, definition string }{
+		{"album", "TEXT NOT NULL DEFAULT ''"},
+		{"durationMs", "INTEGER NOT NULL DEFAULT 0"},
+		{"releaseYear", "INTEGER NOT NULL DEFAULT 0"},
+		{"genre", "TEXT NOT NULL DEFAULT ''"},
+		{"coverArtURL", "TEXT NOT NULL DEFAULT ''"},
+		{"ingestedAtMs", "INTEGER NOT NULL DEFAULT 0"},
+	} {
+		if err := addSQLiteColumn(db, "songs", column.name, column.definition); err != nil {
+			return fmt.Errorf("error upgrading songs table: %s", err)
+		}
+	}
+
+	_, err = db.Exec(createRecordsTable)
+	if err != nil {
+		return fmt.Errorf("error creating records table: %s", err)
+	}
+
 	return nil
 }
 
+// addSQLiteColumn adds a column to a table unless it already has it.
+func addSQLiteColumn(db *sql.DB, table, column, definition string) error {
+	var exists bool
+	err := db.QueryRow("SELECT COUNT(*) > 0 FROM pragma_table_info(?) WHERE name = ?", table, column).Scan(&exists)
+	if err != nil || exists {
+		return err
+	}
+	_, err = db.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition)
+	return err
+}
+
+func (db *SQLiteClient) withContext(ctx context.Context) DBClient {
+	bound := *db
+	bound.ctx = ctx
+	return &bound
+}
+
 func (db *SQLiteClient) Close() error {
 	if db.db != nil {
 		return db.db.Close()
@@ -80,44 +149,81 @@ func (db *SQLiteClient) Close() error {
 }
 
 func (db *SQLiteClient) StoreFingerprints(fingerprints map[uint32]models.Couple) error {
-	tx, err := db.db.Begin()
+	_, err := db.addFingerprints(fingerprints)
+	return err
+}
+
+func (db *SQLiteClient) addFingerprints(fingerprints map[uint32]models.Couple) (map[uint32]models.Couple, error) {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	return storeSQLiteFingerprints(ctx, db.db, "fingerprints", fingerprints)
+}
+
+// storeSQLiteFingerprints stores couples in a table, returning those that
+// weren't replaced.
+func storeSQLiteFingerprints(ctx context.Context, db *sql.DB, table string, fingerprints map[uint32]models.Couple) (map[uint32]models.Couple, error) {
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
-		return fmt.Errorf("error starting transaction: %s", err)
+		return nil, fmt.Errorf("error starting transaction: %w", err)
 	}
 
-	stmt, err := tx.Prepare("INSERT OR REPLACE INTO fingerprints (address, anchorTimeMs, songID) VALUES (?, ?, ?)")
+	insert, err := tx.PrepareContext(ctx, "INSERT OR IGNORE INTO "+table+" (address, anchorTimeMs, songID, peak) VALUES (?, ?, ?, ?)")
 	if err != nil {
 		tx.Rollback()
-		return fmt.Errorf("error preparing statement: %s", err)
+		return nil, fmt.Errorf("error preparing statement: %w", err)
 	}
-	defer stmt.Close()
+	defer insert.Close()
+	update, err := tx.PrepareContext(ctx, "UPDATE "+table+" SET peak = ? WHERE address = ? AND anchorTimeMs = ? AND songID = ?")
+	if err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("error preparing statement: %w", err)
+	}
+	defer update.Close()
 
+	added := make(map[uint32]models.Couple, len(fingerprints))
 	for address, couple := range fingerprints {
-		if _, err := stmt.Exec(address, couple.AnchorTimeMs, couple.SongID); err != nil {
+		result, err := insert.ExecContext(ctx, address, couple.AnchorTimeMs, couple.SongID, couple.PeakCode())
+		if err != nil {
 			tx.Rollback()
-			return fmt.Errorf("error executing statement: %s", err)
+			return nil, fmt.Errorf("error executing statement: %w", err)
+		}
+		if n, err := result.RowsAffected(); err == nil && n > 0 {
+			added[address] = couple
+			continue
+		}
+		// The couple is stored already, replace its peak
+		if _, err := update.ExecContext(ctx, couple.PeakCode(), address, couple.AnchorTimeMs, couple.SongID); err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("error executing statement: %w", err)
 		}
 	}
 
-	return tx.Commit()
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return added, nil
 }
 
 func (db *SQLiteClient) GetCouples(addresses []uint32) (map[uint32][]models.Couple, error) {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
 	couples := make(map[uint32][]models.Couple)
 
 	for _, address := range addresses {
-		rows, err := db.db.Query("SELECT anchorTimeMs, songID FROM fingerprints WHERE address = ?", address)
+		rows, err := db.db.QueryContext(ctx, "SELECT anchorTimeMs, songID, peak FROM fingerprints WHERE address = ?", address)
 		if err != nil {
-			return nil, fmt.Errorf("error querying database: %s", err)
+			return nil, fmt.Errorf("error querying database: %w", err)
 		}
 
 		var docCouples []models.Couple
 		for rows.Next() {
 			var couple models.Couple
-			if err := rows.Scan(&couple.AnchorTimeMs, &couple.SongID); err != nil {
+			var peak uint16
+			if err := rows.Scan(&couple.AnchorTimeMs, &couple.SongID, &peak); err != nil {
 				rows.Close() // close before returning error
-				return nil, fmt.Errorf("error scanning row: %s", err)
+				return nil, fmt.Errorf("error scanning row: %w", err)
 			}
+			couple.SetPeakCode(peak)
 			docCouples = append(docCouples, couple)
 		}
 
@@ -129,32 +235,35 @@ func (db *SQLiteClient) GetCouples(addresses []uint32) (map[uint32][]models.Coup
 	return couples, nil
 }
 
-
 func (db *SQLiteClient) TotalSongs() (int, error) {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
 	var count int
-	err := db.db.QueryRow("SELECT COUNT(*) FROM songs").Scan(&count)
+	err := db.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM songs").Scan(&count)
 	if err != nil {
 		return 0, fmt.Errorf("error counting songs: %s", err)
 	}
 	return count, nil
 }
 
-func (db *SQLiteClient) RegisterSong(songTitle, songArtist, ytID string) (uint32, error) {
-	tx, err := db.db.Begin()
+func (db *SQLiteClient) RegisterSong(songTitle, songArtist, ytID string) (models.SongID, error) {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	tx, err := db.db.BeginTx(ctx, nil)
 	if err != nil {
 		return 0, fmt.Errorf("error starting transaction: %s", err)
 	}
 
-	stmt, err := tx.Prepare("INSERT INTO songs (id, title, artist, ytID, key) VALUES (?, ?, ?, ?, ?)")
+	stmt, err := tx.PrepareContext(ctx, "INSERT INTO songs (id, title, artist, ytID, key, ingestedAtMs) VALUES (?, ?, ?, ?, ?, ?)")
 	if err != nil {
 		tx.Rollback()
 		return 0, fmt.Errorf("error preparing statement: %s", err)
 	}
 	defer stmt.Close()
 
-	songID := utils.GenerateUniqueID()
+	songID := models.NewSongID()
 	songKey := utils.GenerateSongKey(songTitle, songArtist)
-	if _, err := stmt.Exec(songID, songTitle, songArtist, ytID, songKey); err != nil {
+	if _, err := stmt.ExecContext(ctx, songID, songTitle, songArtist, ytID, songKey, ingestionTime()); err != nil {
 		tx.Rollback()
 		if sqliteErr, ok := err.(sqlite3.Error); ok && sqliteErr.Code == sqlite3.ErrConstraint {
 			return 0, fmt.Errorf("song with ytID or key already exists: %v", err)
@@ -169,28 +278,32 @@ var sqlitefilterKeys = "id | ytID | key"
 
 // GetSong retrieves a song by filter key
 func (s *SQLiteClient) GetSong(filterKey string, value interface{}) (Song, bool, error) {
+	ctx, cancel := opContext(s.ctx)
+	defer cancel()
 
 	if !strings.Contains(sqlitefilterKeys, filterKey) {
 		return Song{}, false, fmt.Errorf("invalid filter key")
 	}
 
-	query := fmt.Sprintf("SELECT title, artist, ytID FROM songs WHERE %s = ?", filterKey)
+	query := fmt.Sprintf("SELECT title, artist, ytID, %s FROM songs WHERE %s = ?", songDetailColumns, filterKey)
 
-	row := s.db.QueryRow(query, value)
+	row := s.db.QueryRowContext(ctx, query, value)
 
 	var song Song
-	err := row.Scan(&song.Title, &song.Artist, &song.YouTubeID)
+	var ytID sql.NullString
+	err := row.Scan(append([]interface{}{&song.Title, &song.Artist, &ytID}, songDetailsDest(&song)...)...)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return Song{}, false, nil
 		}
 		return Song{}, false, fmt.Errorf("failed to retrieve song: %s", err)
 	}
+	song.YouTubeID = ytID.String
 
 	return song, true, nil
 }
 
-func (db *SQLiteClient) GetSongByID(songID uint32) (Song, bool, error) {
+func (db *SQLiteClient) GetSongByID(songID models.SongID) (Song, bool, error) {
 	return db.GetSong("id", songID)
 }
 
@@ -203,8 +316,10 @@ func (db *SQLiteClient) GetSongByKey(key string) (Song, bool, error) {
 }
 
 // DeleteSongByID deletes a song by ID
-func (db *SQLiteClient) DeleteSongByID(songID uint32) error {
-	_, err := db.db.Exec("DELETE FROM songs WHERE id = ?", songID)
+func (db *SQLiteClient) DeleteSongByID(songID models.SongID) error {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	_, err := db.db.ExecContext(ctx, "DELETE FROM songs WHERE id = ?", songID)
 	if err != nil {
 		return fmt.Errorf("failed to delete song: %v", err)
 	}
@@ -213,9 +328,315 @@ func (db *SQLiteClient) DeleteSongByID(songID uint32) error {
 
 // DeleteCollection deletes a collection (table) from the database
 func (db *SQLiteClient) DeleteCollection(collectionName string) error {
-	_, err := db.db.Exec(fmt.Sprintf("DROP TABLE IF EXISTS %s", collectionName))
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	_, err := db.db.ExecContext(ctx, fmt.Sprintf("DROP TABLE IF EXISTS %s", collectionName))
 	if err != nil {
 		return fmt.Errorf("error deleting collection: %v", err)
 	}
 	return nil
 }
+
+// ForEachSong calls fn for every song, in ID order
+func (db *SQLiteClient) ForEachSong(fn func(songID models.SongID, song Song) error) error {
+	ctx := bulkContext(db.ctx)
+	rows, err := db.db.QueryContext(ctx, "SELECT id, title, artist, ytID, "+songDetailColumns+" FROM songs ORDER BY id")
+	if err != nil {
+		return fmt.Errorf("error querying songs: %s", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var songID models.SongID
+		var song Song
+		var ytID sql.NullString
+		if err := rows.Scan(append([]interface{}{&songID, &song.Title, &song.Artist, &ytID}, songDetailsDest(&song)...)...); err != nil {
+			return fmt.Errorf("error scanning row: %s", err)
+		}
+		song.YouTubeID = ytID.String
+		if err := fn(songID, song); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// ListSongs lists the songs matching filter, in its order, skipping the
+// first offset of them. A limit of 0 lists them all.
+func (db *SQLiteClient) ListSongs(offset, limit int, filter SongFilter) ([]ListedSong, error) {
+	if err := checkSongList(offset, limit, filter); err != nil {
+		return nil, err
+	}
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	query := "SELECT id, title, artist, ytID, " + songDetailColumns + " FROM songs"
+	var args []interface{}
+	if filter.Artist != "" {
+		query += " WHERE LOWER(artist) LIKE ? ESCAPE '!'"
+		args = append(args, likeSubstring(filter.Artist))
+	}
+	query += songListOrder(offset, limit, filter, "LOWER", "ingestedAtMs")
+	return listSQLSongs(ctx, db.db, query, args...)
+}
+
+// ForEachFingerprint calls fn for every couple, in primary key order
+func (db *SQLiteClient) ForEachFingerprint(fn func(address uint32, couple models.Couple) error) error {
+	ctx := bulkContext(db.ctx)
+	rows, err := db.db.QueryContext(ctx, "SELECT address, anchorTimeMs, songID, peak FROM fingerprints ORDER BY address, anchorTimeMs, songID")
+	if err != nil {
+		return fmt.Errorf("error querying fingerprints: %s", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var address uint32
+		var couple models.Couple
+		var peak uint16
+		if err := rows.Scan(&address, &couple.AnchorTimeMs, &couple.SongID, &peak); err != nil {
+			return fmt.Errorf("error scanning row: %s", err)
+		}
+		couple.SetPeakCode(peak)
+		if err := fn(address, couple); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// StoreSong stores a song under the given ID, replacing any song with that ID
+func (db *SQLiteClient) StoreSong(songID models.SongID, song Song) error {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	return storeSQLiteSong(ctx, db.db, "songs", songID, song)
+}
+
+func storeSQLiteSong(ctx context.Context, db *sql.DB, table string, songID models.SongID, song Song) error {
+	_, err := db.ExecContext(ctx,
+		"INSERT OR REPLACE INTO "+table+" (id, title, artist, ytID, key, "+songDetailColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		append([]interface{}{songID, song.Title, song.Artist, song.YouTubeID, utils.GenerateSongKey(song.Title, song.Artist)}, songDetails(song)...)...,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to store song: %v", err)
+	}
+	return nil
+}
+
+// FingerprintSongIDs returns the distinct song IDs referenced by fingerprints
+func (db *SQLiteClient) FingerprintSongIDs() ([]models.SongID, error) {
+	ctx := bulkContext(db.ctx)
+	rows, err := db.db.QueryContext(ctx, "SELECT DISTINCT songID FROM fingerprints")
+	if err != nil {
+		return nil, fmt.Errorf("error querying song IDs: %s", err)
+	}
+	defer rows.Close()
+
+	var songIDs []models.SongID
+	for rows.Next() {
+		var songID models.SongID
+		if err := rows.Scan(&songID); err != nil {
+			return nil, fmt.Errorf("error scanning row: %s", err)
+		}
+		songIDs = append(songIDs, songID)
+	}
+
+	return songIDs, rows.Err()
+}
+
+// DeleteFingerprintsBySongID deletes all couples of a song
+func (db *SQLiteClient) DeleteFingerprintsBySongID(songID models.SongID) error {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	_, err := db.db.ExecContext(ctx, "DELETE FROM fingerprints WHERE songID = ?", songID)
+	if err != nil {
+		return fmt.Errorf("failed to delete fingerprints: %v", err)
+	}
+	return nil
+}
+
+// Compact rebuilds the database file to reclaim space left by deletions
+func (db *SQLiteClient) Compact() error {
+	ctx := bulkContext(db.ctx)
+	_, err := db.db.ExecContext(ctx, "VACUUM")
+	if err != nil {
+		return fmt.Errorf("failed to vacuum database: %v", err)
+	}
+	return nil
+}
+
+// Snapshot writes a consistent copy of the database into dir
+func (db *SQLiteClient) Snapshot(dir string) (string, error) {
+	ctx := bulkContext(db.ctx)
+	err := utils.CreateFolder(dir)
+	if err != nil {
+		return "", fmt.Errorf("failed to create snapshot dir: %v", err)
+	}
+
+	path := filepath.Join(dir, fmt.Sprintf("snapshot_%s.sqlite3", time.Now().UTC().Format("20060102T150405")))
+	_, err = db.db.ExecContext(ctx, "VACUUM INTO ?", path)
+	if err != nil {
+		return "", fmt.Errorf("failed to snapshot database: %v", err)
+	}
+
+	return path, nil
+}
+
+func (db *SQLiteClient) PutRecord(collection string, record Record) error {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	_, err := db.db.ExecContext(ctx,
+		"INSERT OR REPLACE INTO records (collection, id, clientID, createdAt, data) VALUES (?, ?, ?, ?, ?)",
+		collection, record.ID, record.ClientID, record.CreatedAt.UnixNano(), string(record.Data),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to store record: %v", err)
+	}
+	return nil
+}
+
+func (db *SQLiteClient) GetRecord(collection, id string) (Record, bool, error) {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	row := db.db.QueryRowContext(ctx,
+		"SELECT id, clientID, createdAt, data FROM records WHERE collection = ? AND id = ?",
+		collection, id,
+	)
+
+	record, err := scanRecord(row)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return Record{}, false, nil
+		}
+		return Record{}, false, fmt.Errorf("failed to retrieve record: %v", err)
+	}
+
+	return record, true, nil
+}
+
+func (db *SQLiteClient) ListRecords(collection string, filter RecordFilter) ([]Record, error) {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	query := "SELECT id, clientID, createdAt, data FROM records WHERE collection = ?"
+	args := []interface{}{collection}
+
+	if filter.ClientID != "" {
+		query += " AND clientID = ?"
+		args = append(args, filter.ClientID)
+	}
+	if !filter.Since.IsZero() {
+		query += " AND createdAt >= ?"
+		args = append(args, filter.Since.UnixNano())
+	}
+	if !filter.Until.IsZero() {
+		query += " AND createdAt < ?"
+		args = append(args, filter.Until.UnixNano())
+	}
+	query += " ORDER BY createdAt"
+	if filter.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, filter.Limit)
+	}
+
+	rows, err := db.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list records: %v", err)
+	}
+	defer rows.Close()
+
+	var records []Record
+	for rows.Next() {
+		record, err := scanRecord(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning row: %s", err)
+		}
+		records = append(records, record)
+	}
+
+	return records, rows.Err()
+}
+
+func (db *SQLiteClient) DeleteRecord(collection, id string) error {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	_, err := db.db.ExecContext(ctx, "DELETE FROM records WHERE collection = ? AND id = ?", collection, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete record: %v", err)
+	}
+	return nil
+}
+
+func scanRecord(row interface{ Scan(...interface{}) error }) (Record, error) {
+	var record Record
+	var createdAt int64
+	var data string
+
+	err := row.Scan(&record.ID, &record.ClientID, &createdAt, &data)
+	if err != nil {
+		return Record{}, err
+	}
+
+	record.CreatedAt = time.Unix(0, createdAt).UTC()
+	record.Data = []byte(data)
+	return record, nil
+}
+
+// sqliteStaging loads a catalog into shadow tables of the same database.
+type sqliteStaging struct {
+	db *sql.DB
+}
+
+func (db *SQLiteClient) stageCatalog() (StagedCatalog, error) {
+	ctx, cancel := opContext(db.ctx)
+	defer cancel()
+	for _, query := range []string{
+		"DROP TABLE IF EXISTS " + stagedSongs,
+		"DROP TABLE IF EXISTS " + stagedFingerprints,
+		fmt.Sprintf(sqliteSongsTable, stagedSongs),
+		fmt.Sprintf(sqliteFingerprintsTable, stagedFingerprints),
+	} {
+		if _, err := db.db.ExecContext(ctx, query); err != nil {
+			return nil, fmt.Errorf("error creating staging tables: %v", err)
+		}
+	}
+	return &sqliteStaging{db: db.db}, nil
+}
+
+func (s *sqliteStaging) StoreSong(songID models.SongID, song Song) error {
+	return storeSQLiteSong(context.Background(), s.db, stagedSongs, songID, song)
+}
+
+func (s *sqliteStaging) StoreFingerprints(fingerprints map[uint32]models.Couple) error {
+	_, err := storeSQLiteFingerprints(context.Background(), s.db, stagedFingerprints, fingerprints)
+	return err
+}
+
+// Promote swaps the tables in a transaction, so readers see the old tables
+// until it commits.
+func (s *sqliteStaging) Promote() error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %s", err)
+	}
+	for _, query := range []string{
+		"DROP TABLE songs",
+		"ALTER TABLE " + stagedSongs + " RENAME TO songs",
+		"DROP TABLE fingerprints",
+		"ALTER TABLE " + stagedFingerprints + " RENAME TO fingerprints",
+	} {
+		if _, err := tx.Exec(query); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("error promoting staged catalog: %v", err)
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStaging) Discard() error {
+	for _, table := range []string{stagedSongs, stagedFingerprints} {
+		if _, err := s.db.Exec("DROP TABLE IF EXISTS " + table); err != nil {
+			return fmt.Errorf("error dropping staging tables: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package db_test
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"song-recognition/db"
+	"song-recognition/db/storagetest"
+	"song-recognition/models"
+	"testing"
+)
+
+func TestSQLiteConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) db.DBClient {
+		client, err := db.NewSQLiteClient(filepath.Join(t.TempDir(), "db.sqlite3"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return client
+	})
+}
+
+func TestSQLiteWideSongIDs(t *testing.T) {
+	client, err := db.NewSQLiteClient(filepath.Join(t.TempDir(), "db.sqlite3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	songID := models.SongID(1<<52 + 3)
+	song := db.Song{Title: "Title", Artist: "Artist", YouTubeID: "ytid0000001"}
+	if err := client.StoreSong(songID, song); err != nil {
+		t.Fatalf("StoreSong: %v", err)
+	}
+	couple := models.Couple{AnchorTimeMs: 1500, SongID: songID}
+	if err := client.StoreFingerprints(map[uint32]models.Couple{7: couple}); err != nil {
+		t.Fatalf("StoreFingerprints: %v", err)
+	}
+
+	if got, exists, err := client.GetSongByID(songID); err != nil || !exists || got != song {
+		t.Errorf("GetSongByID = %+v, %v, %v; want %+v", got, exists, err, song)
+	}
+	couples, err := client.GetCouples([]uint32{7})
+	if err != nil || len(couples[7]) != 1 || couples[7][0] != couple {
+		t.Errorf("GetCouples = %v, %v; want [%v]", couples[7], err, couple)
+	}
+	songIDs, err := client.FingerprintSongIDs()
+	if err != nil || len(songIDs) != 1 || songIDs[0] != songID {
+		t.Errorf("FingerprintSongIDs = %v, %v; want [%d]", songIDs, err, songID)
+	}
+}
+
+func TestSongIDSchemes(t *testing.T) {
+	t.Setenv("SONG_ID_SCHEME", models.SongIDsUint64)
+	if _, err := db.NewDBClientFor("mysql", ""); err == nil {
+		t.Error("MySQL accepted 64-bit song IDs")
+	}
+	for range 100 {
+		if id := models.NewSongID(); id == 0 || id >= 1<<53 {
+			t.Fatalf("NewSongID() = %d, want an ID in [1, 2^53)", id)
+		}
+	}
+
+	t.Setenv("SONG_ID_SCHEME", models.SongIDsUUID)
+	if _, err := db.NewDBClientFor("clickhouse", ""); err == nil {
+		t.Error("ClickHouse accepted UUID song IDs")
+	}
+	for range 100 {
+		id := models.NewSongID()
+		if id == 0 || id >= 1<<63 {
+			t.Fatalf("NewSongID() = %d, want an ID in [1, 2^63)", id)
+		}
+		if parsed, err := models.ParseSongID(id.UUID()); err != nil || parsed != id {
+			t.Fatalf("ParseSongID(%q) = %d, %v; want %d", id.UUID(), parsed, err, id)
+		}
+	}
+	data, err := json.Marshal(map[models.SongID]models.SongID{1: 1 << 62})
+	if want := `{"00000000-0000-8000-8000-000000000001":"00000000-0000-8100-8000-000000000000"}`; err != nil || string(data) != want {
+		t.Errorf("json.Marshal = %s, %v; want %s", data, err, want)
+	}
+	var decoded struct{ A, B models.SongID }
+	if err := json.Unmarshal([]byte(`{"A":12,"B":"00000000-0000-8000-8000-00000000000c"}`), &decoded); err != nil || decoded.A != 12 || decoded.B != 12 {
+		t.Errorf("json.Unmarshal = %+v, %v; want both IDs 12, written in either form", decoded, err)
+	}
+
+	// Storage keeps the numbers, whatever the scheme
+	t.Setenv("SQLITE_PATH", filepath.Join(t.TempDir(), "db.sqlite3"))
+	client, err := db.NewDBClientFor("sqlite", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	songID, err := client.RegisterSong("Title", "Artist", "")
+	if err != nil {
+		t.Fatalf("RegisterSong: %v", err)
+	}
+	if _, exists, err := client.GetSongByID(songID); err != nil || !exists {
+		t.Errorf("GetSongByID(%d) = %v, %v; want the song", songID, exists, err)
+	}
+
+	t.Setenv("SONG_ID_SCHEME", "uint16")
+	if _, err := db.NewDBClientFor("sqlite", ""); err == nil {
+		t.Error("an unknown SONG_ID_SCHEME was accepted")
+	}
+}
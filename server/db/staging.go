@@ -0,0 +1,80 @@
+package db
+
+import (
+	"errors"
+	"song-recognition/models"
+)
+
+// Collections a catalog is loaded into before it replaces the live one.
+const (
+	stagedSongs        = "songs_staging"
+	stagedFingerprints = "fingerprints_staging"
+)
+
+// ErrStagingUnsupported is returned by StageCatalog for backends that can't
+// swap collections, such as Cassandra.
+var ErrStagingUnsupported = errors.New("staging a catalog isn't supported by this backend")
+
+// StagedCatalog is a catalog loaded into shadow collections while the live
+// ones keep serving, until it replaces them. Its methods may be called
+// concurrently.
+type StagedCatalog interface {
+	StoreSong(songID models.SongID, song Song) error
+	StoreFingerprints(fingerprints map[uint32]models.Couple) error
+	// Promote replaces the live songs and fingerprints with the staged ones.
+	// Readers see either catalog, never a mix of both, except on MongoDB and
+	// ClickHouse where songs are swapped just before fingerprints.
+	Promote() error
+	// Discard drops the staged collections.
+	Discard() error
+}
+
+// stager is implemented by the backends supporting StageCatalog.
+type stager interface {
+	// stageCatalog creates empty shadow collections, replacing those an
+	// interrupted import left behind.
+	stageCatalog() (StagedCatalog, error)
+}
+
+// StageCatalog starts loading a catalog next to the live one of client, to
+// replace it without downtime once loaded. Faults configured with DB_FAULTS
+// aren't injected into staged writes.
+func StageCatalog(client DBClient) (StagedCatalog, error) {
+	switch c := client.(type) {
+	case *versionedClient:
+		staged, err := StageCatalog(c.DBClient)
+		if err != nil {
+			return nil, err
+		}
+		return &versionedStaging{StagedCatalog: staged, client: c}, nil
+	case *cascadingClient:
+		return StageCatalog(c.DBClient)
+	case *statsClient:
+		staged, err := StageCatalog(c.DBClient)
+		if err != nil {
+			return nil, err
+		}
+		return &countingStaging{StagedCatalog: staged, client: c.DBClient, couples: make(map[models.SongID]int64), sketch: newAddressSketch()}, nil
+	case *faultyClient:
+		return StageCatalog(c.DBClient)
+	case *retryingClient:
+		return StageCatalog(c.DBClient)
+	case stager:
+		return c.stageCatalog()
+	}
+	return nil, ErrStagingUnsupported
+}
+
+// versionedStaging bumps the catalog version once the staged catalog is
+// promoted, so replicas and clients notice the change.
+type versionedStaging struct {
+	StagedCatalog
+	client *versionedClient
+}
+
+func (v *versionedStaging) Promote() error {
+	if err := v.StagedCatalog.Promote(); err != nil {
+		return err
+	}
+	return v.client.bump()
+}
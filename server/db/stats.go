@@ -0,0 +1,368 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"math/bits"
+	"song-recognition/models"
+	"song-recognition/utils"
+	"sync"
+	"time"
+)
+
+const (
+	catalogStatsID       = "stats" // in catalogCollection
+	songStatsCollection  = "fingerprint_stats"
+	addressSketchRegBits = 12
+)
+
+// CatalogStats counts the fingerprints of a catalog. They are kept up to date
+// as fingerprints are stored and deleted, so reading them doesn't scan the
+// catalog.
+type CatalogStats struct {
+	Couples int64 `json:"couples"`
+	Songs   int64 `json:"songs"` // songs with fingerprints
+	// Addresses estimates how many distinct addresses were written to since
+	// the stats were counted, within about 2%. Deleting fingerprints doesn't
+	// lower it.
+	Addresses int64     `json:"addresses"`
+	CountedAt time.Time `json:"countedAt"` // when the catalog was last scanned or emptied
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// CouplesPerSong returns the average number of couples of the songs with
+// fingerprints.
+func (s CatalogStats) CouplesPerSong() float64 {
+	if s.Songs == 0 {
+		return 0
+	}
+	return float64(s.Couples) / float64(s.Songs)
+}
+
+// statsRecord is how CatalogStats are stored, with the sketch the address
+// estimate is kept with.
+type statsRecord struct {
+	CatalogStats
+	Sketch addressSketch `json:"sketch"`
+}
+
+// songStats is how the couples of a song are stored.
+type songStats struct {
+	Couples int64 `json:"couples"`
+}
+
+// addressSketch is a HyperLogLog sketch of the addresses written to.
+type addressSketch []byte
+
+func newAddressSketch() addressSketch {
+	return make(addressSketch, 1<<addressSketchRegBits)
+}
+
+func (s addressSketch) add(address uint32) {
+	// splitmix64 spreads addresses over the whole hash
+	h := uint64(address) + 0x9e3779b97f4a7c15
+	h = (h ^ h>>30) * 0xbf58476d1ce4e5b9
+	h = (h ^ h>>27) * 0x94d049bb133111eb
+	h ^= h >> 31
+
+	register := h >> (64 - addressSketchRegBits)
+	rank := byte(bits.LeadingZeros64(h<<addressSketchRegBits|1<<(addressSketchRegBits-1))) + 1
+	if rank > s[register] {
+		s[register] = rank
+	}
+}
+
+func (s addressSketch) estimate() int64 {
+	m := float64(len(s))
+	var sum float64
+	var empty int
+	for _, rank := range s {
+		sum += math.Ldexp(1, -int(rank))
+		if rank == 0 {
+			empty++
+		}
+	}
+	estimate := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if estimate <= 2.5*m && empty > 0 {
+		estimate = m * math.Log(m/float64(empty)) // linear counting is closer for few addresses
+	}
+	return int64(math.Round(estimate))
+}
+
+// statsMu serializes the updates of the stats records, which read them
+// before writing them back. It isn't held while fingerprints are stored. Updates from other processes may still be lost; the
+// catalog-stats job counts them again.
+var statsMu sync.Mutex
+
+// ReadCatalogStats returns the stats of the fingerprints of a catalog. They
+// don't exist until the catalog is counted with CountCatalogStats, emptied,
+// or replaced through StageCatalog.
+func ReadCatalogStats(client DBClient) (CatalogStats, bool, error) {
+	stats, exists, err := readStatsRecord(client)
+	return stats.CatalogStats, exists, err
+}
+
+// ReadSongCouples returns how many couples a song has, and false for songs
+// without fingerprints or catalogs that weren't counted yet.
+func ReadSongCouples(client DBClient, songID models.SongID) (int64, bool, error) {
+	record, exists, err := client.GetRecord(songStatsCollection, fmt.Sprint(songID))
+	if err != nil || !exists {
+		return 0, false, err
+	}
+	var stats songStats
+	if err := json.Unmarshal(record.Data, &stats); err != nil {
+		return 0, false, fmt.Errorf("failed to unmarshal stats of song %d: %v", songID, err)
+	}
+	return stats.Couples, true, nil
+}
+
+func readStatsRecord(client DBClient) (statsRecord, bool, error) {
+	var stats statsRecord
+	record, exists, err := client.GetRecord(catalogCollection, catalogStatsID)
+	if err != nil || !exists {
+		return stats, false, err
+	}
+	if err := json.Unmarshal(record.Data, &stats); err != nil {
+		return stats, false, fmt.Errorf("failed to unmarshal catalog stats: %v", err)
+	}
+	if len(stats.Sketch) != 1<<addressSketchRegBits {
+		stats.Sketch = newAddressSketch()
+	}
+	return stats, true, nil
+}
+
+func writeStatsRecord(client DBClient, stats *statsRecord) error {
+	stats.Addresses = stats.Sketch.estimate()
+	stats.UpdatedAt = time.Now().UTC()
+	data, err := json.Marshal(stats)
+	if err != nil {
+		return fmt.Errorf("failed to marshal catalog stats: %v", err)
+	}
+	err = client.PutRecord(catalogCollection, Record{ID: catalogStatsID, CreatedAt: stats.UpdatedAt, Data: data})
+	if err != nil {
+		return fmt.Errorf("failed to store catalog stats: %v", err)
+	}
+	return nil
+}
+
+func writeSongCouples(client DBClient, songID models.SongID, couples int64) error {
+	data, err := json.Marshal(songStats{Couples: couples})
+	if err != nil {
+		return fmt.Errorf("failed to marshal stats of song %d: %v", songID, err)
+	}
+	return client.PutRecord(songStatsCollection, Record{ID: fmt.Sprint(songID), CreatedAt: time.Now().UTC(), Data: data})
+}
+
+// replaceStats replaces the stats of a catalog and of all its songs with
+// those counted from its fingerprints.
+func replaceStats(client DBClient, couples map[models.SongID]int64, sketch addressSketch) (CatalogStats, error) {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	stats := statsRecord{Sketch: sketch}
+	stats.CountedAt = time.Now().UTC()
+	for _, n := range couples {
+		stats.Couples += n
+		stats.Songs++
+	}
+
+	records, err := client.ListRecords(songStatsCollection, RecordFilter{})
+	if err != nil {
+		return stats.CatalogStats, err
+	}
+	for _, record := range records {
+		var songID models.SongID
+		if _, err := fmt.Sscan(record.ID, &songID); err == nil && couples[songID] > 0 {
+			continue
+		}
+		if err := client.DeleteRecord(songStatsCollection, record.ID); err != nil {
+			return stats.CatalogStats, err
+		}
+	}
+	for songID, n := range couples {
+		if err := writeSongCouples(client, songID, n); err != nil {
+			return stats.CatalogStats, err
+		}
+	}
+	err = writeStatsRecord(client, &stats)
+	return stats.CatalogStats, err
+}
+
+// CountCatalogStats reads every fingerprint of a catalog to count its stats
+// again, such as after upgrading or when updates were lost.
+func CountCatalogStats(client DBClient) (CatalogStats, error) {
+	couples := make(map[models.SongID]int64)
+	sketch := newAddressSketch()
+	err := client.ForEachFingerprint(func(address uint32, couple models.Couple) error {
+		couples[couple.SongID]++
+		sketch.add(address)
+		return nil
+	})
+	if err != nil {
+		return CatalogStats{}, fmt.Errorf("failed to read fingerprints: %v", err)
+	}
+	return replaceStats(client, couples, sketch)
+}
+
+// statsClient wraps a DBClient, updating the stats of the catalog as
+// fingerprints are stored and deleted.
+type statsClient struct {
+	DBClient
+}
+
+// withStats wraps a client so that it keeps the stats of the catalog, once
+// they were counted.
+func withStats(client DBClient) DBClient {
+	return &statsClient{DBClient: client}
+}
+
+func (s *statsClient) withContext(ctx context.Context) DBClient {
+	return &statsClient{DBClient: WithContext(ctx, s.DBClient)}
+}
+
+// warn logs that the stats couldn't be updated. Such failures aren't
+// returned, so that callers don't store the fingerprints again.
+func (s *statsClient) warn(err error) {
+	utils.GetLogger().Warn("failed to update catalog stats, count them again with the catalog-stats job",
+		slog.Any("error", err))
+}
+
+// fingerprintAdder is implemented by backends that can tell which of the
+// couples they store weren't stored already.
+type fingerprintAdder interface {
+	addFingerprints(fingerprints map[uint32]models.Couple) (map[uint32]models.Couple, error)
+}
+
+// StoreFingerprints counts the couples the backend added. Backends that can't
+// tell them apart from those stored again (MongoDB, PostgreSQL, MySQL,
+// ClickHouse and Cassandra) count every couple, so storing couples again
+// inflates their stats until the catalog-stats job counts them.
+func (s *statsClient) StoreFingerprints(fingerprints map[uint32]models.Couple) error {
+	added := fingerprints
+	if adder, ok := s.DBClient.(fingerprintAdder); ok {
+		var err error
+		if added, err = adder.addFingerprints(fingerprints); err != nil {
+			return err
+		}
+	} else if err := s.DBClient.StoreFingerprints(fingerprints); err != nil {
+		return err
+	}
+	if len(added) > 0 {
+		if err := s.count(added); err != nil {
+			s.warn(err)
+		}
+	}
+	return nil
+}
+
+func (s *statsClient) count(fingerprints map[uint32]models.Couple) error {
+	couples := make(map[models.SongID]int64)
+	for _, couple := range fingerprints {
+		couples[couple.SongID]++
+	}
+
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	stats, exists, err := readStatsRecord(s.DBClient)
+	if err != nil || !exists {
+		return err
+	}
+	for songID, n := range couples {
+		previous, exists, err := ReadSongCouples(s.DBClient, songID)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			stats.Songs++
+		}
+		if err := writeSongCouples(s.DBClient, songID, previous+n); err != nil {
+			return err
+		}
+	}
+	for address := range fingerprints {
+		stats.Sketch.add(address)
+	}
+	stats.Couples += int64(len(fingerprints))
+	return writeStatsRecord(s.DBClient, &stats)
+}
+
+func (s *statsClient) DeleteFingerprintsBySongID(songID models.SongID) error {
+	if err := s.DBClient.DeleteFingerprintsBySongID(songID); err != nil {
+		return err
+	}
+	if err := s.uncount(songID); err != nil {
+		s.warn(err)
+	}
+	return nil
+}
+
+func (s *statsClient) uncount(songID models.SongID) error {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	couples, exists, err := ReadSongCouples(s.DBClient, songID)
+	if err != nil || !exists {
+		return err
+	}
+	if err := s.DBClient.DeleteRecord(songStatsCollection, fmt.Sprint(songID)); err != nil {
+		return err
+	}
+	stats, exists, err := readStatsRecord(s.DBClient)
+	if err != nil || !exists {
+		return err
+	}
+	stats.Couples -= couples
+	stats.Songs--
+	return writeStatsRecord(s.DBClient, &stats)
+}
+
+// DeleteCollection resets the stats when all fingerprints are deleted.
+func (s *statsClient) DeleteCollection(collectionName string) error {
+	if err := s.DBClient.DeleteCollection(collectionName); err != nil {
+		return err
+	}
+	if collectionName != "fingerprints" {
+		return nil
+	}
+	if _, err := replaceStats(s.DBClient, nil, newAddressSketch()); err != nil {
+		s.warn(err)
+	}
+	return nil
+}
+
+// countingStaging counts the stats of a staged catalog, to replace those of
+// the live one once it is promoted.
+type countingStaging struct {
+	StagedCatalog
+	client DBClient
+
+	mu      sync.Mutex
+	couples map[models.SongID]int64
+	sketch  addressSketch
+}
+
+func (c *countingStaging) StoreFingerprints(fingerprints map[uint32]models.Couple) error {
+	if err := c.StagedCatalog.StoreFingerprints(fingerprints); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for address, couple := range fingerprints {
+		c.couples[couple.SongID]++
+		c.sketch.add(address)
+	}
+	return nil
+}
+
+func (c *countingStaging) Promote() error {
+	if err := c.StagedCatalog.Promote(); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := replaceStats(c.client, c.couples, c.sketch); err != nil {
+		return fmt.Errorf("failed to store the stats of the promoted catalog: %v", err)
+	}
+	return nil
+}
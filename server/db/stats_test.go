@@ -0,0 +1,144 @@
+package db_test
+
+import (
+	"path/filepath"
+	"song-recognition/db"
+	"song-recognition/models"
+	"testing"
+)
+
+func readStats(t *testing.T, client db.DBClient) db.CatalogStats {
+	t.Helper()
+	stats, exists, err := db.ReadCatalogStats(client)
+	if err != nil || !exists {
+		t.Fatalf("ReadCatalogStats returned %v, %v", exists, err)
+	}
+	return stats
+}
+
+func TestCatalogStats(t *testing.T) {
+	client := newMemory(t)
+	storeSongs(t, client, 1, 2)
+	if err := client.StoreFingerprints(map[uint32]models.Couple{7: {AnchorTimeMs: 10, SongID: 1}}); err != nil {
+		t.Fatalf("StoreFingerprints: %v", err)
+	}
+	if _, exists, err := db.ReadCatalogStats(client); err != nil || exists {
+		t.Fatalf("ReadCatalogStats returned %v, %v before the catalog was counted", exists, err)
+	}
+
+	if _, err := db.CountCatalogStats(client); err != nil {
+		t.Fatalf("CountCatalogStats: %v", err)
+	}
+	fingerprints := make(map[uint32]models.Couple)
+	for address := uint32(100); address < 20100; address++ {
+		fingerprints[address] = models.Couple{AnchorTimeMs: address, SongID: 2}
+	}
+	if err := client.StoreFingerprints(fingerprints); err != nil {
+		t.Fatalf("StoreFingerprints: %v", err)
+	}
+	if err := client.StoreFingerprints(map[uint32]models.Couple{8: {AnchorTimeMs: 20, SongID: 1}}); err != nil {
+		t.Fatalf("StoreFingerprints: %v", err)
+	}
+
+	stats := readStats(t, client)
+	if stats.Couples != 20002 || stats.Songs != 2 {
+		t.Errorf("stats count %d couples of %d songs, want 20002 of 2", stats.Couples, stats.Songs)
+	}
+	if stats.Addresses < 19500 || stats.Addresses > 20500 {
+		t.Errorf("stats estimate %d addresses, want about 20002", stats.Addresses)
+	}
+	if couples, exists, err := db.ReadSongCouples(client, 1); err != nil || !exists || couples != 2 {
+		t.Errorf("ReadSongCouples(1) = %d, %v, %v; want 2", couples, exists, err)
+	}
+
+	// Storing couples again replaces them
+	again := map[uint32]models.Couple{7: {AnchorTimeMs: 10, SongID: 1}, 8: {AnchorTimeMs: 20, SongID: 1}}
+	if err := client.StoreFingerprints(again); err != nil {
+		t.Fatalf("StoreFingerprints: %v", err)
+	}
+	if stats := readStats(t, client); stats.Couples != 20002 || stats.Songs != 2 {
+		t.Errorf("stats count %d couples of %d songs after storing couples again, want 20002 of 2", stats.Couples, stats.Songs)
+	}
+	if couples, exists, err := db.ReadSongCouples(client, 1); err != nil || !exists || couples != 2 {
+		t.Errorf("ReadSongCouples(1) = %d, %v, %v after storing couples again; want 2", couples, exists, err)
+	}
+
+	if err := client.DeleteSongByID(2); err != nil {
+		t.Fatalf("DeleteSongByID: %v", err)
+	}
+	stats = readStats(t, client)
+	if stats.Couples != 2 || stats.Songs != 1 {
+		t.Errorf("stats count %d couples of %d songs after deleting a song, want 2 of 1", stats.Couples, stats.Songs)
+	}
+	if _, exists, err := db.ReadSongCouples(client, 2); err != nil || exists {
+		t.Errorf("ReadSongCouples(2) returned %v, %v after deleting the song", exists, err)
+	}
+
+	counted, err := db.CountCatalogStats(client)
+	if err != nil {
+		t.Fatalf("CountCatalogStats: %v", err)
+	}
+	if counted.Couples != stats.Couples || counted.Songs != stats.Songs || counted.Addresses != 2 {
+		t.Errorf("CountCatalogStats = %+v, want %d couples of %d songs at 2 addresses", counted, stats.Couples, stats.Songs)
+	}
+
+	staged, err := db.StageCatalog(client)
+	if err != nil {
+		t.Fatalf("StageCatalog: %v", err)
+	}
+	if err := staged.StoreSong(3, db.Song{Title: "Staged", Artist: "Artist"}); err != nil {
+		t.Fatalf("StoreSong: %v", err)
+	}
+	if err := staged.StoreFingerprints(map[uint32]models.Couple{9: {AnchorTimeMs: 30, SongID: 3}}); err != nil {
+		t.Fatalf("StoreFingerprints: %v", err)
+	}
+	if err := staged.Promote(); err != nil {
+		t.Fatalf("Promote: %v", err)
+	}
+	if stats := readStats(t, client); stats.Couples != 1 || stats.Songs != 1 {
+		t.Errorf("stats count %d couples of %d songs after promoting a staged catalog, want 1 of 1", stats.Couples, stats.Songs)
+	}
+	if _, exists, err := db.ReadSongCouples(client, 1); err != nil || exists {
+		t.Errorf("ReadSongCouples(1) returned %v, %v after replacing the catalog", exists, err)
+	}
+}
+
+func TestCatalogStatsCountAddedCouples(t *testing.T) {
+	for _, dbType := range []string{"sqlite", "bolt"} {
+		t.Run(dbType, func(t *testing.T) {
+			dir := t.TempDir()
+			t.Setenv("SQLITE_PATH", filepath.Join(dir, "db.sqlite3"))
+			t.Setenv("BOLT_PATH", filepath.Join(dir, "db.bolt"))
+			client, err := db.NewDBClientFor(dbType, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			storeSongs(t, client, 1)
+			if _, err := db.CountCatalogStats(client); err != nil {
+				t.Fatalf("CountCatalogStats: %v", err)
+			}
+
+			first := map[uint32]models.Couple{7: {AnchorTimeMs: 10, SongID: 1}, 8: {AnchorTimeMs: 20, SongID: 1}}
+			if err := client.StoreFingerprints(first); err != nil {
+				t.Fatalf("StoreFingerprints: %v", err)
+			}
+			// One couple is stored again with another peak, one is new
+			second := map[uint32]models.Couple{8: {AnchorTimeMs: 20, Band: 5, Magnitude: 2, SongID: 1}, 9: {AnchorTimeMs: 30, SongID: 1}}
+			if err := client.StoreFingerprints(second); err != nil {
+				t.Fatalf("StoreFingerprints: %v", err)
+			}
+
+			if stats := readStats(t, client); stats.Couples != 3 || stats.Songs != 1 {
+				t.Errorf("stats count %d couples of %d songs, want 3 of 1", stats.Couples, stats.Songs)
+			}
+			couples, err := client.GetCouples([]uint32{8})
+			if err != nil {
+				t.Fatalf("GetCouples: %v", err)
+			}
+			if len(couples[8]) != 1 || couples[8][0].PeakCode() != second[8].PeakCode() {
+				t.Errorf("GetCouples(8) = %+v, want the couple stored last", couples[8])
+			}
+		})
+	}
+}
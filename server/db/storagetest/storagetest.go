@@ -0,0 +1,513 @@
+// Package storagetest checks that a db.DBClient implementation honours the
+// storage contract the rest of the server relies on.
+//
+// A backend's tests call Run with a factory returning an empty client:
+//
+//	func TestConformance(t *testing.T) {
+//		storagetest.Run(t, func(t *testing.T) db.DBClient {
+//			client, err := db.NewSQLiteClient(filepath.Join(t.TempDir(), "db.sqlite3"))
+//			if err != nil {
+//				t.Fatal(err)
+//			}
+//			return client
+//		})
+//	}
+package storagetest
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"song-recognition/db"
+	"song-recognition/models"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Factory returns a connected client to an empty database. Run closes it.
+type Factory func(t *testing.T) db.DBClient
+
+// largeBatch is the number of fingerprints stored by the large batch test,
+// more than a typical song.
+const largeBatch = 20000
+
+// Run runs the whole conformance suite, each test against a fresh client.
+func Run(t *testing.T, factory Factory) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, client db.DBClient)
+	}{
+		{"RegisterAndGetSong", testRegisterAndGetSong},
+		{"DuplicateSong", testDuplicateSong},
+		{"DeleteSong", testDeleteSong},
+		{"StoreAndGetCouples", testStoreAndGetCouples},
+		{"StoreFingerprintsIsIdempotent", testStoreFingerprintsIdempotent},
+		{"DeleteFingerprintsBySongID", testDeleteFingerprintsBySongID},
+		{"LargeBatch", testLargeBatch},
+		{"ConcurrentWrites", testConcurrentWrites},
+		{"StoreSongKeepsID", testStoreSong},
+		{"ForEachFingerprint", testForEachFingerprint},
+		{"ListSongs", testListSongs},
+		{"RecordUpsert", testRecordUpsert},
+		{"ListRecords", testListRecords},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := factory(t)
+			defer client.Close()
+			test.fn(t, client)
+		})
+	}
+}
+
+func registerSong(t *testing.T, client db.DBClient, title, artist, ytID string) models.SongID {
+	t.Helper()
+	songID, err := client.RegisterSong(title, artist, ytID)
+	if err != nil {
+		t.Fatalf("RegisterSong(%q, %q): %v", title, artist, err)
+	}
+	return songID
+}
+
+func storeFingerprints(t *testing.T, client db.DBClient, fingerprints map[uint32]models.Couple) {
+	t.Helper()
+	if err := client.StoreFingerprints(fingerprints); err != nil {
+		t.Fatalf("StoreFingerprints: %v", err)
+	}
+}
+
+// songFingerprints returns n fingerprints of a song with addresses starting
+// at base.
+func songFingerprints(songID models.SongID, base uint32, n int) map[uint32]models.Couple {
+	fingerprints := make(map[uint32]models.Couple, n)
+	for i := 0; i < n; i++ {
+		fingerprints[base+uint32(i)] = models.Couple{AnchorTimeMs: uint32(i * 10), SongID: songID}
+	}
+	return fingerprints
+}
+
+func addressesOf(fingerprints map[uint32]models.Couple) []uint32 {
+	addresses := make([]uint32, 0, len(fingerprints))
+	for address := range fingerprints {
+		addresses = append(addresses, address)
+	}
+	return addresses
+}
+
+func getCouples(t *testing.T, client db.DBClient, addresses []uint32) map[uint32][]models.Couple {
+	t.Helper()
+	couples, err := client.GetCouples(addresses)
+	if err != nil {
+		t.Fatalf("GetCouples: %v", err)
+	}
+	return couples
+}
+
+func testRegisterAndGetSong(t *testing.T, client db.DBClient) {
+	registeredFrom := time.Now().UnixMilli()
+	songID := registerSong(t, client, "Title", "Artist", "ytid0000001")
+	registeredUntil := time.Now().UnixMilli()
+
+	lookups := map[string]func() (db.Song, bool, error){
+		"GetSongByID":   func() (db.Song, bool, error) { return client.GetSongByID(songID) },
+		"GetSongByYTID": func() (db.Song, bool, error) { return client.GetSongByYTID("ytid0000001") },
+		"GetSongByKey":  func() (db.Song, bool, error) { return client.GetSongByKey("Title---Artist") },
+	}
+	for name, lookup := range lookups {
+		song, exists, err := lookup()
+		if err != nil || !exists {
+			t.Fatalf("%s: exists=%v err=%v", name, exists, err)
+		}
+		if song.IngestedAtMs < registeredFrom || song.IngestedAtMs > registeredUntil {
+			t.Errorf("%s: ingested at %d, want between %d and %d", name, song.IngestedAtMs, registeredFrom, registeredUntil)
+		}
+		song.IngestedAtMs = 0
+		want := db.Song{Title: "Title", Artist: "Artist", YouTubeID: "ytid0000001"}
+		if song != want {
+			t.Errorf("%s = %+v, want %+v", name, song, want)
+		}
+	}
+
+	if _, exists, err := client.GetSongByID(songID + 1); err != nil || exists {
+		t.Errorf("GetSongByID(unknown): exists=%v err=%v", exists, err)
+	}
+
+	total, err := client.TotalSongs()
+	if err != nil || total != 1 {
+		t.Errorf("TotalSongs = %d, %v; want 1", total, err)
+	}
+}
+
+func testDuplicateSong(t *testing.T, client db.DBClient) {
+	registerSong(t, client, "Title", "Artist", "ytid0000001")
+
+	if _, err := client.RegisterSong("Title", "Artist", "ytid0000002"); err == nil {
+		t.Error("registering a song with an existing title and artist succeeded")
+	}
+
+	total, err := client.TotalSongs()
+	if err != nil || total != 1 {
+		t.Errorf("TotalSongs = %d, %v; want 1", total, err)
+	}
+}
+
+func testDeleteSong(t *testing.T, client db.DBClient) {
+	songID := registerSong(t, client, "Title", "Artist", "ytid0000001")
+	otherID := registerSong(t, client, "Other", "Artist", "ytid0000002")
+
+	if err := client.DeleteSongByID(songID); err != nil {
+		t.Fatalf("DeleteSongByID: %v", err)
+	}
+
+	if _, exists, err := client.GetSongByID(songID); err != nil || exists {
+		t.Errorf("deleted song still exists: exists=%v err=%v", exists, err)
+	}
+	if _, exists, err := client.GetSongByID(otherID); err != nil || !exists {
+		t.Errorf("other song was deleted: exists=%v err=%v", exists, err)
+	}
+
+	// The song can be registered again once deleted
+	registerSong(t, client, "Title", "Artist", "ytid0000001")
+}
+
+func testStoreAndGetCouples(t *testing.T, client db.DBClient) {
+	songA := registerSong(t, client, "A", "Artist", "ytid000000a")
+	songB := registerSong(t, client, "B", "Artist", "ytid000000b")
+
+	storeFingerprints(t, client, map[uint32]models.Couple{
+		1: {AnchorTimeMs: 100, SongID: songA},
+		2: {AnchorTimeMs: 200, SongID: songA},
+	})
+	storeFingerprints(t, client, map[uint32]models.Couple{
+		1: {AnchorTimeMs: 300, Band: 3, Magnitude: 40, SongID: songB},
+	})
+
+	couples := getCouples(t, client, []uint32{1, 2, 3})
+
+	got := couples[1]
+	sort.Slice(got, func(i, j int) bool { return got[i].AnchorTimeMs < got[j].AnchorTimeMs })
+	// Version 1 and 2 couples round-trip side by side
+	want := []models.Couple{{AnchorTimeMs: 100, SongID: songA}, {AnchorTimeMs: 300, Band: 3, Magnitude: 40, SongID: songB}}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("couples of address 1 = %v, want %v", got, want)
+	}
+	if len(couples[2]) != 1 || couples[2][0] != (models.Couple{AnchorTimeMs: 200, SongID: songA}) {
+		t.Errorf("couples of address 2 = %v", couples[2])
+	}
+	if len(couples[3]) != 0 {
+		t.Errorf("unknown address has couples %v", couples[3])
+	}
+}
+
+func testStoreFingerprintsIdempotent(t *testing.T, client db.DBClient) {
+	songID := registerSong(t, client, "Title", "Artist", "ytid0000001")
+	fingerprints := songFingerprints(songID, 1000, 50)
+
+	storeFingerprints(t, client, fingerprints)
+	storeFingerprints(t, client, fingerprints)
+
+	couples := getCouples(t, client, addressesOf(fingerprints))
+	for address, couple := range fingerprints {
+		if len(couples[address]) != 1 || couples[address][0] != couple {
+			t.Fatalf("couples of address %d = %v, want [%v]", address, couples[address], couple)
+		}
+	}
+}
+
+func testDeleteFingerprintsBySongID(t *testing.T, client db.DBClient) {
+	songA := registerSong(t, client, "A", "Artist", "ytid000000a")
+	songB := registerSong(t, client, "B", "Artist", "ytid000000b")
+
+	fingerprintsA := songFingerprints(songA, 0, 100)
+	fingerprintsB := songFingerprints(songB, 50, 100) // shares addresses 50-99 with A
+	storeFingerprints(t, client, fingerprintsA)
+	storeFingerprints(t, client, fingerprintsB)
+
+	if err := client.DeleteFingerprintsBySongID(songA); err != nil {
+		t.Fatalf("DeleteFingerprintsBySongID: %v", err)
+	}
+
+	couples := getCouples(t, client, addressesOf(fingerprintsA))
+	for address, addressCouples := range couples {
+		for _, couple := range addressCouples {
+			if couple.SongID == songA {
+				t.Fatalf("address %d still has a couple of the deleted song", address)
+			}
+		}
+	}
+
+	couples = getCouples(t, client, addressesOf(fingerprintsB))
+	for address, couple := range fingerprintsB {
+		if len(couples[address]) != 1 || couples[address][0] != couple {
+			t.Fatalf("couples of address %d = %v, want [%v]", address, couples[address], couple)
+		}
+	}
+
+	songIDs, err := client.FingerprintSongIDs()
+	if err != nil {
+		t.Fatalf("FingerprintSongIDs: %v", err)
+	}
+	if len(songIDs) != 1 || songIDs[0] != songB {
+		t.Errorf("FingerprintSongIDs = %v, want [%d]", songIDs, songB)
+	}
+}
+
+func testLargeBatch(t *testing.T, client db.DBClient) {
+	songID := registerSong(t, client, "Title", "Artist", "ytid0000001")
+	fingerprints := songFingerprints(songID, 0, largeBatch)
+
+	storeFingerprints(t, client, fingerprints)
+
+	couples := getCouples(t, client, addressesOf(fingerprints))
+	if len(couples) != largeBatch {
+		t.Fatalf("got couples for %d addresses, want %d", len(couples), largeBatch)
+	}
+	for address, couple := range fingerprints {
+		if len(couples[address]) != 1 || couples[address][0] != couple {
+			t.Fatalf("couples of address %d = %v, want [%v]", address, couples[address], couple)
+		}
+	}
+}
+
+func testConcurrentWrites(t *testing.T, client db.DBClient) {
+	const workers = 8
+	const perSong = 500
+
+	songIDs := make([]models.SongID, workers)
+	errs := make([]error, workers)
+	var wg sync.WaitGroup
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+
+			songID, err := client.RegisterSong(fmt.Sprintf("Song %d", w), "Artist", fmt.Sprintf("ytid%07d", w))
+			if err != nil {
+				errs[w] = err
+				return
+			}
+			songIDs[w] = songID
+			// All workers write to the same addresses
+			errs[w] = client.StoreFingerprints(songFingerprints(songID, 0, perSong))
+		}(w)
+	}
+	wg.Wait()
+
+	for w, err := range errs {
+		if err != nil {
+			t.Fatalf("worker %d: %v", w, err)
+		}
+	}
+
+	total, err := client.TotalSongs()
+	if err != nil || total != workers {
+		t.Errorf("TotalSongs = %d, %v; want %d", total, err, workers)
+	}
+
+	couples := getCouples(t, client, addressesOf(songFingerprints(0, 0, perSong)))
+	for address, addressCouples := range couples {
+		if len(addressCouples) != workers {
+			t.Fatalf("address %d has %d couples, want %d", address, len(addressCouples), workers)
+		}
+	}
+}
+
+func testStoreSong(t *testing.T, client db.DBClient) {
+	song := db.Song{Title: "Title", Artist: "Artist", YouTubeID: "ytid0000001"}
+	if err := client.StoreSong(42, song); err != nil {
+		t.Fatalf("StoreSong: %v", err)
+	}
+	// Storing again replaces the song, details included
+	song.YouTubeID = "ytid0000002"
+	song.SongDetails = db.SongDetails{
+		Album:       "Album",
+		DurationMs:  215000,
+		ReleaseYear: 1999,
+		Genre:       "Genre",
+		CoverArtURL: "https://example.com/cover.jpg",
+	}
+	song.IngestedAtMs = 1700000000000
+	if err := client.StoreSong(42, song); err != nil {
+		t.Fatalf("StoreSong: %v", err)
+	}
+
+	got, exists, err := client.GetSongByID(42)
+	if err != nil || !exists || got != song {
+		t.Errorf("GetSongByID = %+v, %v, %v; want %+v", got, exists, err, song)
+	}
+	if _, exists, _ := client.GetSongByKey("Title---Artist"); !exists {
+		t.Error("stored song not found by key")
+	}
+
+	seen := map[models.SongID]db.Song{}
+	err = client.ForEachSong(func(songID models.SongID, song db.Song) error {
+		seen[songID] = song
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ForEachSong: %v", err)
+	}
+	if len(seen) != 1 || seen[42] != song {
+		t.Errorf("ForEachSong visited %v, want only song 42", seen)
+	}
+}
+
+func testListSongs(t *testing.T, client db.DBClient) {
+	songs := map[models.SongID]db.Song{
+		1: {Title: "Beta", Artist: "The Band", YouTubeID: "ytid0000001", IngestedAtMs: 3000},
+		2: {Title: "Alpha", Artist: "Solo Artist", YouTubeID: "ytid0000002", IngestedAtMs: 1000},
+		3: {Title: "Alpha", Artist: "Band of Others", YouTubeID: "ytid0000003", IngestedAtMs: 2000},
+		4: {Title: "Gamma", Artist: "100%_Band", YouTubeID: "ytid0000004"},
+	}
+	for songID, song := range songs {
+		if err := client.StoreSong(songID, song); err != nil {
+			t.Fatalf("StoreSong: %v", err)
+		}
+	}
+
+	cases := []struct {
+		offset, limit int
+		filter        db.SongFilter
+		want          []models.SongID
+	}{
+		{0, 0, db.SongFilter{}, []models.SongID{3, 2, 1, 4}},
+		{1, 2, db.SongFilter{}, []models.SongID{2, 1}},
+		{4, 0, db.SongFilter{}, nil},
+		{0, 0, db.SongFilter{Descending: true}, []models.SongID{4, 1, 2, 3}},
+		{0, 0, db.SongFilter{Artist: "BAND"}, []models.SongID{3, 1, 4}},
+		{0, 0, db.SongFilter{Artist: "%_b"}, []models.SongID{4}},
+		{0, 0, db.SongFilter{Artist: "nobody"}, nil},
+		{0, 0, db.SongFilter{OrderBy: db.SongsByIngestion}, []models.SongID{4, 2, 3, 1}},
+		{0, 2, db.SongFilter{OrderBy: db.SongsByIngestion, Descending: true}, []models.SongID{1, 3}},
+	}
+	for _, c := range cases {
+		listed, err := client.ListSongs(c.offset, c.limit, c.filter)
+		if err != nil {
+			t.Fatalf("ListSongs(%d, %d, %+v): %v", c.offset, c.limit, c.filter, err)
+		}
+		var got []models.SongID
+		for _, song := range listed {
+			if song.Song != songs[song.ID] {
+				t.Errorf("ListSongs listed %+v as song %d, want %+v", song.Song, song.ID, songs[song.ID])
+			}
+			got = append(got, song.ID)
+		}
+		if !slices.Equal(got, c.want) {
+			t.Errorf("ListSongs(%d, %d, %+v) = %v, want %v", c.offset, c.limit, c.filter, got, c.want)
+		}
+	}
+
+	if _, err := client.ListSongs(0, 0, db.SongFilter{OrderBy: "plays"}); err == nil {
+		t.Error("ListSongs ordered by an unknown order succeeded")
+	}
+}
+
+func testForEachFingerprint(t *testing.T, client db.DBClient) {
+	songA := registerSong(t, client, "A", "Artist", "ytid000000a")
+	songB := registerSong(t, client, "B", "Artist", "ytid000000b")
+	storeFingerprints(t, client, songFingerprints(songA, 0, 200))
+	storeFingerprints(t, client, songFingerprints(songB, 100, 200))
+
+	visit := func() []string {
+		var visited []string
+		err := client.ForEachFingerprint(func(address uint32, couple models.Couple) error {
+			visited = append(visited, fmt.Sprint(address, couple))
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("ForEachFingerprint: %v", err)
+		}
+		return visited
+	}
+
+	first, second := visit(), visit()
+	if len(first) != 400 {
+		t.Errorf("ForEachFingerprint visited %d couples, want 400", len(first))
+	}
+	if fmt.Sprint(first) != fmt.Sprint(second) {
+		t.Error("ForEachFingerprint order isn't stable")
+	}
+}
+
+func putRecord(t *testing.T, client db.DBClient, id, clientID string, createdAt time.Time, data string) {
+	t.Helper()
+	record := db.Record{ID: id, ClientID: clientID, CreatedAt: createdAt, Data: json.RawMessage(data)}
+	if err := client.PutRecord("storagetest", record); err != nil {
+		t.Fatalf("PutRecord(%q): %v", id, err)
+	}
+}
+
+func testRecordUpsert(t *testing.T, client db.DBClient) {
+	createdAt := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	putRecord(t, client, "a", "client", createdAt, `{"v":1}`)
+	putRecord(t, client, "a", "client", createdAt, `{"v":2}`)
+
+	record, exists, err := client.GetRecord("storagetest", "a")
+	if err != nil || !exists {
+		t.Fatalf("GetRecord: exists=%v err=%v", exists, err)
+	}
+	if string(record.Data) != `{"v":2}` || !record.CreatedAt.Equal(createdAt) || record.ClientID != "client" {
+		t.Errorf("GetRecord = %+v (data %s)", record, record.Data)
+	}
+
+	records, err := client.ListRecords("storagetest", db.RecordFilter{})
+	if err != nil || len(records) != 1 {
+		t.Errorf("ListRecords returned %d records, %v; want 1", len(records), err)
+	}
+
+	if err := client.DeleteRecord("storagetest", "a"); err != nil {
+		t.Fatalf("DeleteRecord: %v", err)
+	}
+	if _, exists, err := client.GetRecord("storagetest", "a"); err != nil || exists {
+		t.Errorf("deleted record still exists: exists=%v err=%v", exists, err)
+	}
+	if _, exists, err := client.GetRecord("other", "a"); err != nil || exists {
+		t.Errorf("record found in another collection: exists=%v err=%v", exists, err)
+	}
+}
+
+func testListRecords(t *testing.T, client db.DBClient) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 6; i++ {
+		clientID := "even"
+		if i%2 == 1 {
+			clientID = "odd"
+		}
+		// Stored out of order to check sorting
+		putRecord(t, client, fmt.Sprintf("r%d", 5-i), clientID, start.Add(time.Duration(5-i)*time.Hour), `{}`)
+	}
+
+	ids := func(filter db.RecordFilter) []string {
+		t.Helper()
+		records, err := client.ListRecords("storagetest", filter)
+		if err != nil {
+			t.Fatalf("ListRecords(%+v): %v", filter, err)
+		}
+		ids := []string{}
+		for _, record := range records {
+			ids = append(ids, record.ID)
+		}
+		return ids
+	}
+
+	cases := []struct {
+		filter db.RecordFilter
+		want   []string
+	}{
+		{db.RecordFilter{}, []string{"r0", "r1", "r2", "r3", "r4", "r5"}},
+		{db.RecordFilter{ClientID: "odd"}, []string{"r0", "r2", "r4"}},
+		{db.RecordFilter{Since: start.Add(2 * time.Hour)}, []string{"r2", "r3", "r4", "r5"}},
+		{db.RecordFilter{Until: start.Add(2 * time.Hour)}, []string{"r0", "r1"}},
+		{db.RecordFilter{Limit: 2}, []string{"r0", "r1"}},
+		{db.RecordFilter{ClientID: "even", Since: start.Add(time.Hour), Limit: 1}, []string{"r1"}},
+	}
+	for _, c := range cases {
+		if got := ids(c.filter); fmt.Sprint(got) != fmt.Sprint(c.want) {
+			t.Errorf("ListRecords(%+v) = %v, want %v", c.filter, got, c.want)
+		}
+	}
+}
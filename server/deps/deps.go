@@ -0,0 +1,256 @@
+// Package deps locates the external tools the server runs (ffmpeg, ffprobe
+// and yt-dlp) and checks their versions, so missing dependencies are
+// reported up front instead of as exec errors halfway through an ingestion.
+package deps
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"song-recognition/utils"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Tool is an external program the server depends on.
+type Tool struct {
+	Name        string   // executable name
+	EnvVar      string   // variable holding an explicit path
+	MinVersion  string   // minimum supported version
+	VersionArgs []string // arguments printing the version
+	UsedFor     string   // features that need the tool
+}
+
+var (
+	FFmpeg = Tool{
+		Name:        "ffmpeg",
+		EnvVar:      "FFMPEG_PATH",
+		MinVersion:  "4.0",
+		VersionArgs: []string{"-version"},
+		UsedFor:     "converting audio, tagging downloads",
+	}
+	FFprobe = Tool{
+		Name:        "ffprobe",
+		EnvVar:      "FFPROBE_PATH",
+		MinVersion:  "4.0",
+		VersionArgs: []string{"-version"},
+		UsedFor:     "reading audio metadata",
+	}
+	YtDlp = Tool{
+		Name:        "yt-dlp",
+		EnvVar:      "YTDLP_PATH",
+		MinVersion:  "2023.01.01",
+		VersionArgs: []string{"--version"},
+		UsedFor:     "downloading songs from YouTube",
+	}
+
+	All = []Tool{FFmpeg, FFprobe, YtDlp}
+)
+
+// Status is the result of looking up a tool.
+type Status struct {
+	Tool    Tool
+	Path    string
+	Version string
+	Err     error
+}
+
+// OK reports whether the tool was found with a supported version.
+func (s Status) OK() bool {
+	return s.Err == nil
+}
+
+var (
+	mu       sync.Mutex
+	resolved = map[string]Status{}
+)
+
+// commonDirs are install locations that are often missing from PATH, e.g.
+// when running as a service.
+func commonDirs() []string {
+	if runtime.GOOS == "windows" {
+		return []string{`C:\ffmpeg\bin`, `C:\Program Files\ffmpeg\bin`, filepath.Join(os.Getenv("LOCALAPPDATA"), "Microsoft", "WinGet", "Links")}
+	}
+
+	dirs := []string{"/usr/local/bin", "/usr/bin", "/opt/homebrew/bin", "/opt/local/bin", "/snap/bin"}
+	if home, err := os.UserHomeDir(); err == nil {
+		dirs = append(dirs, filepath.Join(home, ".local", "bin"))
+	}
+	return dirs
+}
+
+// find returns the path of the tool's executable: the configured path, then
+// PATH, then the common install locations.
+func find(tool Tool) (string, error) {
+	if configured := utils.GetEnv(tool.EnvVar); configured != "" {
+		path, err := exec.LookPath(configured)
+		if err != nil {
+			return "", fmt.Errorf("%s=%s is not executable: %v", tool.EnvVar, configured, err)
+		}
+		return path, nil
+	}
+
+	if path, err := exec.LookPath(tool.Name); err == nil {
+		return path, nil
+	}
+
+	name := tool.Name
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	for _, dir := range commonDirs() {
+		path := filepath.Join(dir, name)
+		if info, err := os.Stat(path); err == nil && !info.IsDir() {
+			return path, nil
+		}
+	}
+
+	return "", fmt.Errorf("not found in %s, PATH or common install locations", tool.EnvVar)
+}
+
+var versionPattern = regexp.MustCompile(`\d+(\.\d+)+`)
+
+// version runs the tool and extracts the first dotted version number from
+// its output. Development builds of ffmpeg (e.g. "N-112345-g...") have no
+// version number and are accepted as is.
+func version(tool Tool, path string) (string, error) {
+	output, err := exec.Command(path, tool.VersionArgs...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("failed to run %s %s: %v", path, strings.Join(tool.VersionArgs, " "), err)
+	}
+
+	firstLine, _, _ := strings.Cut(string(output), "\n")
+	if v := versionPattern.FindString(firstLine); v != "" {
+		return v, nil
+	}
+	return strings.TrimSpace(firstLine), nil
+}
+
+// compareVersions compares dotted version numbers, returning -1, 0 or 1.
+func compareVersions(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < max(len(as), len(bs)); i++ {
+		var x, y int
+		if i < len(as) {
+			x, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			y, _ = strconv.Atoi(bs[i])
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// Lookup finds a tool and checks its version. Results are cached. In pure-Go
+// mode every tool is reported as unavailable.
+func Lookup(tool Tool) Status {
+	if PureGo() {
+		return Status{Tool: tool, Err: &ErrRequiresExternalTool{Tool: tool, Feature: tool.UsedFor}}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if status, ok := resolved[tool.Name]; ok {
+		return status
+	}
+
+	status := Status{Tool: tool}
+	status.Path, status.Err = find(tool)
+	if status.Err == nil {
+		status.Version, status.Err = version(tool, status.Path)
+	}
+	if status.Err == nil && versionPattern.MatchString(status.Version) && compareVersions(status.Version, tool.MinVersion) < 0 {
+		status.Err = fmt.Errorf("version %s is older than the minimum supported %s", status.Version, tool.MinVersion)
+	}
+
+	resolved[tool.Name] = status
+	return status
+}
+
+// Path returns the executable to run for a tool, falling back to its bare
+// name so that exec reports the usual error if it can't be found.
+func Path(tool Tool) string {
+	if status := Lookup(tool); status.Path != "" {
+		return status.Path
+	}
+	return tool.Name
+}
+
+// Report holds the status of several tools.
+type Report []Status
+
+// Check looks up the given tools, or all of them if none are given.
+func Check(tools ...Tool) Report {
+	if len(tools) == 0 {
+		tools = All
+	}
+
+	report := make(Report, 0, len(tools))
+	for _, tool := range tools {
+		report = append(report, Lookup(tool))
+	}
+	return report
+}
+
+// Missing returns the tools that weren't found or are too old.
+func (r Report) Missing() Report {
+	var missing Report
+	for _, status := range r {
+		if !status.OK() {
+			missing = append(missing, status)
+		}
+	}
+	return missing
+}
+
+func (r Report) String() string {
+	var b strings.Builder
+	for _, status := range r {
+		if status.OK() {
+			fmt.Fprintf(&b, "  %-8s %s (%s)\n", status.Tool.Name, status.Version, status.Path)
+		} else {
+			fmt.Fprintf(&b, "  %-8s MISSING: %v\n           needed for %s; install it or set %s\n",
+				status.Tool.Name, status.Err, status.Tool.UsedFor, status.Tool.EnvVar)
+		}
+	}
+	return b.String()
+}
+
+// MissingError is returned by Require when tools are unavailable.
+type MissingError struct {
+	Report Report
+}
+
+func (e *MissingError) Error() string {
+	names := make([]string, len(e.Report))
+	for i, status := range e.Report {
+		names[i] = status.Tool.Name
+	}
+	return fmt.Sprintf("missing dependencies: %s\n%s", strings.Join(names, ", "), strings.TrimRight(e.Report.String(), "\n"))
+}
+
+// Require returns a *MissingError describing every unavailable tool, or an
+// *ErrRequiresExternalTool in pure-Go mode.
+func Require(tools ...Tool) error {
+	if PureGo() {
+		if len(tools) == 0 {
+			tools = All
+		}
+		return &ErrRequiresExternalTool{Tool: tools[0], Feature: tools[0].UsedFor}
+	}
+	if missing := Check(tools...).Missing(); len(missing) > 0 {
+		return &MissingError{Report: missing}
+	}
+	return nil
+}
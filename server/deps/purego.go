@@ -0,0 +1,39 @@
+package deps
+
+import (
+	"fmt"
+	"os/exec"
+	"song-recognition/utils"
+	"strconv"
+)
+
+// ErrRequiresExternalTool is returned in pure-Go mode by features that only
+// an external tool can provide.
+type ErrRequiresExternalTool struct {
+	Tool    Tool
+	Feature string
+}
+
+func (e *ErrRequiresExternalTool) Error() string {
+	return fmt.Sprintf("%s requires %s, which is disabled in pure-Go mode", e.Feature, e.Tool.Name)
+}
+
+// PureGo reports whether external tools are disabled, either because the
+// binary was built with the purego tag or because PURE_GO is set. Only the
+// built-in WAV decoder and resampler are used in this mode.
+func PureGo() bool {
+	if pureGoBuild {
+		return true
+	}
+	enabled, _ := strconv.ParseBool(utils.GetEnv("PURE_GO", "false"))
+	return enabled
+}
+
+// Command returns a command running the tool, or an *ErrRequiresExternalTool
+// describing the feature in pure-Go mode.
+func Command(tool Tool, feature string, args ...string) (*exec.Cmd, error) {
+	if PureGo() {
+		return nil, &ErrRequiresExternalTool{Tool: tool, Feature: feature}
+	}
+	return exec.Command(Path(tool), args...), nil
+}
@@ -0,0 +1,5 @@
+//go:build purego
+
+package deps
+
+const pureGoBuild = true
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"song-recognition/db"
+	"song-recognition/models"
+	"song-recognition/songmeta"
+	"strings"
+)
+
+// Steps of a reconciliation plan, which brings catalog b in line with a.
+const (
+	reconcileCopy          = "copy"          // store the song, its metadata and its fingerprints of a in b
+	reconcileDelete        = "delete"        // delete the song and its fingerprints from b
+	reconcileUpdate        = "update"        // store the song and its metadata of a in b
+	reconcileRefingerprint = "refingerprint" // replace the fingerprints of the song in b with those of a
+	reconcilePrune         = "prune"         // delete the fingerprints b has of a song it doesn't have
+)
+
+// catalogContents is what diff compares of a catalog.
+type catalogContents struct {
+	songs        map[models.SongID]db.Song
+	metadata     map[models.SongID]songmeta.Metadata
+	fingerprints map[models.SongID]db.FingerprintChecksum // of the couples of each song
+	couples      int64
+	// recorded is set when fingerprints holds the checksums recorded in the
+	// catalog, which songs may lack, rather than ones read from its couples.
+	recorded bool
+}
+
+// checksum returns the fingerprint checksum of a song, and whether it is
+// known.
+func (c catalogContents) checksum(songID models.SongID) (db.FingerprintChecksum, bool) {
+	checksum, ok := c.fingerprints[songID]
+	return checksum, ok || !c.recorded
+}
+
+type catalogSummary struct {
+	Backend      string `json:"backend"`
+	Songs        int    `json:"songs"`
+	Fingerprints int64  `json:"fingerprints"`
+}
+
+// songDifference is a song the two catalogs don't agree on.
+type songDifference struct {
+	SongID        models.SongID `json:"songId"`
+	Title         string        `json:"title"`
+	Artist        string        `json:"artist"`
+	InA           bool          `json:"inA"`
+	InB           bool          `json:"inB"`
+	FingerprintsA int64         `json:"fingerprintsA"`
+	FingerprintsB int64         `json:"fingerprintsB"`
+	Fields        []string      `json:"fields,omitempty"` // song and metadata fields with other values in b
+}
+
+type reconcileStep struct {
+	Action string        `json:"action"`
+	SongID models.SongID `json:"songId"`
+	Reason string        `json:"reason"`
+}
+
+type catalogDiff struct {
+	A           catalogSummary   `json:"a"`
+	B           catalogSummary   `json:"b"`
+	Differences []songDifference `json:"differences"`
+	Plan        []reconcileStep  `json:"plan"`
+	// Unchecked counts the songs of both catalogs whose fingerprints weren't
+	// compared, for lack of a recorded checksum in one of them.
+	Unchecked int `json:"unchecked"`
+}
+
+// diffCatalogs compares the songs, song metadata and fingerprints of two
+// catalogs, after a migration or a replication incident, and prints the
+// steps that would bring b in line with a. Fingerprints are compared by
+// checksum, read from the couples of the catalogs or, with --checksums, from
+// the checksums they recorded. Each catalog is configured like DB_TYPE would
+// be, with A_ and B_ prefixed variables taking precedence. It exits with
+// status 1 when the catalogs differ.
+func diffCatalogs(args []string) {
+	diffCmd := flag.NewFlagSet("diff", flag.ExitOnError)
+	a := diffCmd.String("a", "", "reference catalog, a backend optionally followed by its location (e.g. sqlite:db/old.sqlite3)")
+	b := diffCmd.String("b", "", "catalog compared to it")
+	checksums := diffCmd.Bool("checksums", false, "compare the fingerprint checksums recorded in the catalogs instead of reading their fingerprints")
+	asJSON := diffCmd.Bool("json", false, "print the differences and the plan as JSON")
+	diffCmd.Parse(args)
+
+	if *a == "" || *b == "" {
+		fmt.Println("Usage: main.go diff --a <backend[:location]> --b <backend[:location]> [--checksums] [--json]")
+		os.Exit(1)
+	}
+
+	contents := make([]catalogContents, 2)
+	for i, spec := range []string{*a, *b} {
+		name := []string{"a", "b"}[i]
+		client, err := openCatalog(spec, strings.ToUpper(name)+"_")
+		if err != nil {
+			yellow.Printf("Error connecting to %s: %v\n", name, err)
+			os.Exit(1)
+		}
+		if !*asJSON {
+			fmt.Printf("Reading %s (%s)...\n", name, spec)
+		}
+		contents[i], err = readCatalogContents(client, *checksums)
+		client.Close()
+		if err != nil {
+			yellow.Printf("Error reading %s: %v\n", name, err)
+			os.Exit(1)
+		}
+	}
+
+	diff := compareCatalogs(contents[0], contents[1])
+	diff.A.Backend, diff.B.Backend = *a, *b
+
+	if *asJSON {
+		data, _ := json.MarshalIndent(diff, "", "  ")
+		fmt.Println(string(data))
+	} else {
+		printCatalogDiff(diff)
+	}
+	if len(diff.Differences) > 0 {
+		os.Exit(1)
+	}
+}
+
+// openCatalog connects to the catalog spec names: a backend type, optionally
+// followed by a colon and its location, which is the file of sqlite and bolt
+// catalogs, the name of memory ones and the database name of the others
+// (e.g. mongo:seektune). Other settings are read from variables with the
+// given prefix, falling back to the usual ones.
+func openCatalog(spec, prefix string) (db.DBClient, error) {
+	dbType, location, found := strings.Cut(spec, ":")
+	if found {
+		key := "DB_NAME"
+		switch dbType {
+		case "sqlite":
+			key = "SQLITE_PATH"
+		case "bolt":
+			key = "BOLT_PATH"
+		case "memory":
+			key = "MEMORY_DB_NAME"
+		}
+		os.Setenv(prefix+key, location)
+	}
+	return db.NewDBClientFor(dbType, prefix)
+}
+
+// readCatalogContents reads the songs and song metadata of a catalog, and
+// the checksums it recorded if recorded is set, or else all its couples.
+func readCatalogContents(client db.DBClient, recorded bool) (catalogContents, error) {
+	contents := catalogContents{
+		songs:    make(map[models.SongID]db.Song),
+		recorded: recorded,
+	}
+	err := client.ForEachSong(func(songID models.SongID, song db.Song) error {
+		contents.songs[songID] = song
+		return nil
+	})
+	if err != nil {
+		return contents, fmt.Errorf("failed to read songs: %v", err)
+	}
+	contents.metadata, err = songmeta.All(client)
+	if err != nil {
+		return contents, fmt.Errorf("failed to read song metadata: %v", err)
+	}
+	if recorded {
+		contents.fingerprints, err = db.ReadFingerprintChecksums(client)
+	} else {
+		contents.fingerprints, err = db.ScanFingerprintChecksums(client)
+	}
+	if err != nil {
+		return contents, fmt.Errorf("failed to read fingerprint checksums: %v", err)
+	}
+	for _, checksum := range contents.fingerprints {
+		contents.couples += checksum.Couples
+	}
+	return contents, nil
+}
+
+// compareCatalogs lists the songs a and b don't agree on, in ID order, and
+// plans the steps bringing b in line with a. Fingerprints of songs neither
+// catalog has are only pruned from b.
+func compareCatalogs(a, b catalogContents) catalogDiff {
+	diff := catalogDiff{
+		A:           catalogSummary{Songs: len(a.songs), Fingerprints: a.couples},
+		B:           catalogSummary{Songs: len(b.songs), Fingerprints: b.couples},
+		Differences: []songDifference{},
+		Plan:        []reconcileStep{},
+	}
+
+	var songIDs []models.SongID
+	for _, contents := range []catalogContents{a, b} {
+		for songID := range contents.songs {
+			songIDs = append(songIDs, songID)
+		}
+		for songID := range contents.fingerprints {
+			songIDs = append(songIDs, songID)
+		}
+	}
+	slices.Sort(songIDs)
+	songIDs = slices.Compact(songIDs)
+
+	for _, songID := range songIDs {
+		songA, inA := a.songs[songID]
+		songB, inB := b.songs[songID]
+		checksumA, knownA := a.checksum(songID)
+		checksumB, knownB := b.checksum(songID)
+		d := songDifference{
+			SongID:        songID,
+			InA:           inA,
+			InB:           inB,
+			FingerprintsA: checksumA.Couples,
+			FingerprintsB: checksumB.Couples,
+		}
+		if inA && inB {
+			d.Fields = differentFields(songA, songB, a.metadata, b.metadata, songID)
+			if !knownA || !knownB {
+				diff.Unchecked++
+			}
+		}
+		fingerprintsDiffer := knownA && knownB && checksumA != checksumB
+		if inA == inB && len(d.Fields) == 0 && !fingerprintsDiffer {
+			continue
+		}
+		d.Title, d.Artist = songA.Title, songA.Artist
+		if !inA {
+			d.Title, d.Artist = songB.Title, songB.Artist
+		}
+		diff.Differences = append(diff.Differences, d)
+
+		step := func(action, reason string) {
+			diff.Plan = append(diff.Plan, reconcileStep{Action: action, SongID: songID, Reason: reason})
+		}
+		switch {
+		case inA && !inB:
+			step(reconcileCopy, "only in a")
+		case !inA && inB:
+			step(reconcileDelete, "only in b")
+		case !inA && d.FingerprintsB > 0:
+			step(reconcilePrune, "fingerprints of a song b doesn't have")
+		case inA:
+			switch len(d.Fields) {
+			case 0:
+			case 1:
+				step(reconcileUpdate, d.Fields[0]+" differs")
+			default:
+				step(reconcileUpdate, strings.Join(d.Fields, ", ")+" differ")
+			}
+			if d.FingerprintsA != d.FingerprintsB {
+				step(reconcileRefingerprint, fmt.Sprintf("a has %d fingerprints, b has %d", d.FingerprintsA, d.FingerprintsB))
+			} else if fingerprintsDiffer {
+				step(reconcileRefingerprint, fmt.Sprintf("fingerprints differ, with %d in each", d.FingerprintsA))
+			}
+		}
+	}
+	return diff
+}
+
+// differentFields names the fields of a song, and of its metadata, whose
+// values differ between the catalogs. Metadata recorded in one catalog only
+// counts as a difference, but the time it was recorded at doesn't.
+func differentFields(songA, songB db.Song, metadataA, metadataB map[models.SongID]songmeta.Metadata, songID models.SongID) []string {
+	var fields []string
+	add := func(name string, differs bool) {
+		if differs {
+			fields = append(fields, name)
+		}
+	}
+	add("title", songA.Title != songB.Title)
+	add("artist", songA.Artist != songB.Artist)
+	add("youtubeId", songA.YouTubeID != songB.YouTubeID)
+	add("details", songA.SongDetails != songB.SongDetails)
+
+	a, inA := metadataA[songID]
+	b, inB := metadataB[songID]
+	if inA != inB {
+		return append(fields, "metadata")
+	}
+	add("durationMs", a.DurationMs != b.DurationMs)
+	add("album", a.Album != b.Album)
+	add("genre", a.Genre != b.Genre)
+	add("year", a.Year != b.Year)
+	add("spotifyId", a.SpotifyID != b.SpotifyID)
+	add("isrc", a.ISRC != b.ISRC)
+	add("coverArtUrl", a.CoverArtURL != b.CoverArtURL)
+	return fields
+}
+
+func printCatalogDiff(diff catalogDiff) {
+	fmt.Printf("a (%s): %d songs, %d fingerprints\n", diff.A.Backend, diff.A.Songs, diff.A.Fingerprints)
+	fmt.Printf("b (%s): %d songs, %d fingerprints\n", diff.B.Backend, diff.B.Songs, diff.B.Fingerprints)
+	if diff.Unchecked > 0 {
+		fmt.Printf("The fingerprints of %d songs weren't compared, since one of the catalogs has no checksum recorded for them; run the checksums job on it, or diff without --checksums.\n", diff.Unchecked)
+	}
+	if len(diff.Differences) == 0 {
+		fmt.Println("\nThe catalogs match.")
+		return
+	}
+
+	songs := make(map[models.SongID]songDifference, len(diff.Differences))
+	for _, d := range diff.Differences {
+		songs[d.SongID] = d
+	}
+	fmt.Printf("\n%d songs differ. To bring b in line with a:\n", len(diff.Differences))
+	for _, step := range diff.Plan {
+		d := songs[step.SongID]
+		song := fmt.Sprintf("song %d", step.SongID)
+		if d.Title != "" {
+			song += fmt.Sprintf(" (%s by %s)", d.Title, d.Artist)
+		}
+		fmt.Printf("  %-13s %s: %s\n", step.Action, song, step.Reason)
+	}
+	if unplanned := len(diff.Differences) - countPlanned(diff.Plan); unplanned > 0 {
+		fmt.Printf("Fingerprints of %d songs neither catalog has are only in a, and need nothing in b.\n", unplanned)
+	}
+}
+
+// countPlanned returns the number of songs the plan has steps for.
+func countPlanned(plan []reconcileStep) int {
+	songs := make(map[models.SongID]bool)
+	for _, step := range plan {
+		songs[step.SongID] = true
+	}
+	return len(songs)
+}
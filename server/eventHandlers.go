@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"song-recognition/auth"
+	"song-recognition/events"
+	"song-recognition/shazam"
+	"song-recognition/utils"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mdobak/go-xerrors"
+)
+
+// eventsKeepAlive is how often idle event streams get a comment, so proxies
+// don't close them.
+const eventsKeepAlive = 15 * time.Second
+
+// maxStreamName bounds the names of streams recognitions are published on.
+const maxStreamName = 128
+
+var (
+	brokerOnce  sync.Once
+	matchBroker *events.Broker
+)
+
+// getMatchBroker returns the broker of match events, remembering the last
+// EVENTS_HISTORY events (default 256) for subscribers that reconnect.
+func getMatchBroker() *events.Broker {
+	brokerOnce.Do(func() {
+		matchBroker = events.NewBroker(eventsHistory())
+	})
+	return matchBroker
+}
+
+func eventsHistory() int {
+	history, err := strconv.Atoi(utils.GetEnv("EVENTS_HISTORY", "256"))
+	if err != nil || history < 1 {
+		return 256
+	}
+	return history
+}
+
+// matchEvent is the data of a "match" event.
+type matchEvent struct {
+	Recognized    bool           `json:"recognized"`
+	Matches       []shazam.Match `json:"matches"`
+	RecognitionID string         `json:"recognitionId,omitempty"`
+	// LoudnessLUFS is the loudness of the current track of monitored
+	// streams measuring it.
+	LoudnessLUFS *float64 `json:"loudnessLufs,omitempty"`
+	// AiringID groups the new songs of monitored streams recognised on
+	// several monitors at once, and SimulcastOf names the monitor that
+	// recognised the song first.
+	AiringID    string `json:"airingId,omitempty"`
+	SimulcastOf string `json:"simulcastOf,omitempty"`
+}
+
+// publishMatches notifies the subscribers of the topics of the outcome of a
+// recognition made by an API client ("" for unsigned ones).
+func publishMatches(ctx context.Context, topics []string, clientID string, matches []shazam.Match, recognized bool, recognitionID string) {
+	publishMatchEvent(ctx, topics, clientID, matchEvent{
+		Recognized:    recognized,
+		Matches:       matches,
+		RecognitionID: recognitionID,
+	})
+}
+
+// publishMatchEvent notifies the subscribers of the topics of a match event.
+func publishMatchEvent(ctx context.Context, topics []string, clientID string, event matchEvent) {
+	if len(event.Matches) > maxAPIMatches {
+		event.Matches = event.Matches[:maxAPIMatches]
+	}
+	if event.Matches == nil {
+		event.Matches = []shazam.Match{}
+	}
+
+	for _, topic := range topics {
+		err := getMatchBroker().Publish(topic, "match", clientID, event)
+		if err != nil {
+			logger := utils.GetLogger()
+			err := xerrors.New(err)
+			logger.ErrorContext(ctx, "failed to publish match event.", slog.Any("error", err))
+		}
+	}
+}
+
+// handleEvents streams match events as Server-Sent Events. Clients pick what
+// to follow with "session" (a socket session ID) and "stream" (a stream name
+// given with recognitions) parameters, either of which may be repeated.
+// Reconnecting clients get the events they missed since Last-Event-ID, as far
+// as they are remembered. Events of recognitions made by a signed client are
+// only sent to that client and to the clients of its tenant.
+func handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "streaming is not supported")
+		return
+	}
+
+	query := r.URL.Query()
+	var topics []string
+	for _, session := range query["session"] {
+		topics = append(topics, "session:"+session)
+	}
+	for _, stream := range query["stream"] {
+		topics = append(topics, "stream:"+stream)
+	}
+	if len(topics) == 0 {
+		writeError(w, http.StatusBadRequest, "at least one session or stream is required")
+		return
+	}
+
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = query.Get("lastEventId")
+	}
+	after, _ := strconv.ParseUint(lastEventID, 10, 64)
+
+	client, _ := auth.ClientFromContext(r.Context())
+	clients := auth.LoadClients()
+	visible := func(event events.Event) bool {
+		if event.ClientID == "" || event.ClientID == client.ID {
+			return true
+		}
+		tenant := clients[event.ClientID].Tenant
+		return tenant != "" && tenant == client.Tenant
+	}
+
+	eventStream, unsubscribe := getMatchBroker().Subscribe(topics, after)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventsKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case event, ok := <-eventStream:
+			if !ok {
+				return
+			}
+			if !visible(event) {
+				continue
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+			flusher.Flush()
+		}
+	}
+}
+
+// streamTopics returns the topics recognitions tagged with a stream name are
+// published on, or none if the name is empty.
+func streamTopics(stream string) []string {
+	if stream == "" {
+		return nil
+	}
+	return []string{"stream:" + stream}
+}
@@ -0,0 +1,129 @@
+// Package events fans match notifications out to subscribers, such as the
+// Server-Sent Events endpoint dashboards listen on. Recent events are kept so
+// subscribers that reconnect can catch up on what they missed.
+package events
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// subscriberBuffer is how many events a subscriber may lag behind before
+// newer events are dropped for it.
+const subscriberBuffer = 64
+
+// Event is a notification published on a topic, such as "session:<id>" or
+// "stream:<name>".
+type Event struct {
+	ID       uint64          `json:"id"`
+	Topic    string          `json:"topic"`
+	Type     string          `json:"type"`
+	Time     time.Time       `json:"time"`
+	ClientID string          `json:"-"` // API client the event is about, "" for unsigned ones
+	Data     json.RawMessage `json:"data"`
+}
+
+type subscriber struct {
+	topics map[string]bool
+	events chan Event
+}
+
+// Broker delivers published events to the subscribers of their topics.
+type Broker struct {
+	mu          sync.Mutex
+	nextID      uint64
+	recent      []Event // ring buffer of the last events
+	start       int
+	subscribers map[*subscriber]struct{}
+}
+
+// NewBroker returns a broker remembering the last history events.
+func NewBroker(history int) *Broker {
+	return &Broker{
+		recent:      make([]Event, 0, max(history, 1)),
+		subscribers: make(map[*subscriber]struct{}),
+	}
+}
+
+// Resize changes how many events the broker remembers, keeping the most
+// recent ones.
+func (b *Broker) Resize(history int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	size := max(history, 1)
+	recent := make([]Event, 0, size)
+	n := len(b.recent)
+	for i := max(n-size, 0); i < n; i++ {
+		recent = append(recent, b.recent[(b.start+i)%n])
+	}
+	b.recent, b.start = recent, 0
+}
+
+// Publish sends an event to the subscribers of its topic, assigning it an ID
+// and time. Subscribers too slow to keep up miss it.
+func (b *Broker) Publish(topic, eventType, clientID string, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.nextID++
+	event := Event{ID: b.nextID, Topic: topic, Type: eventType, Time: time.Now().UTC(), ClientID: clientID, Data: payload}
+	if len(b.recent) < cap(b.recent) {
+		b.recent = append(b.recent, event)
+	} else {
+		b.recent[b.start] = event
+		b.start = (b.start + 1) % len(b.recent)
+	}
+
+	for sub := range b.subscribers {
+		if !sub.topics[topic] {
+			continue
+		}
+		select {
+		case sub.events <- event:
+		default:
+		}
+	}
+	return nil
+}
+
+// Subscribe returns the events published on the topics from now on, preceded
+// by the remembered ones with an ID above after. The returned function ends
+// the subscription and closes the channel.
+func (b *Broker) Subscribe(topics []string, after uint64) (<-chan Event, func()) {
+	sub := &subscriber{topics: make(map[string]bool), events: make(chan Event, subscriberBuffer)}
+	for _, topic := range topics {
+		sub.topics[topic] = true
+	}
+
+	b.mu.Lock()
+	if after > 0 {
+		for i := range b.recent {
+			event := b.recent[(b.start+i)%len(b.recent)]
+			if event.ID > after && sub.topics[event.Topic] {
+				select {
+				case sub.events <- event:
+				default:
+				}
+			}
+		}
+	}
+	b.subscribers[sub] = struct{}{}
+	b.mu.Unlock()
+
+	var once sync.Once
+	return sub.events, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subscribers, sub)
+			b.mu.Unlock()
+			close(sub.events)
+		})
+	}
+}
@@ -0,0 +1,175 @@
+// Package exclusions keeps time ranges of songs out of matching, such as a
+// label jingle opening every upload of a channel. Audio shared by many songs
+// would otherwise align with all of them and cause systematic false matches.
+package exclusions
+
+import (
+	"encoding/json"
+	"fmt"
+	"song-recognition/cached"
+	"song-recognition/db"
+	"song-recognition/models"
+	"strconv"
+	"time"
+)
+
+const (
+	collection     = "song_exclusions"
+	reloadInterval = 30 * time.Second
+)
+
+// Range is a part of a song, in milliseconds from its start.
+type Range struct {
+	StartMs uint32 `json:"startMs"`
+	EndMs   uint32 `json:"endMs"`
+}
+
+// Rule excludes ranges of a song from matching.
+type Rule struct {
+	SongID models.SongID `json:"songId"`
+	Ranges []Range       `json:"ranges"`
+	Reason string        `json:"reason,omitempty"`
+}
+
+// Validate checks that the ranges of the rule are non-empty.
+func (r Rule) Validate() error {
+	if len(r.Ranges) == 0 {
+		return fmt.Errorf("rule needs at least one range")
+	}
+	for i, rng := range r.Ranges {
+		if rng.EndMs <= rng.StartMs {
+			return fmt.Errorf("range %d: endMs must be after startMs", i)
+		}
+	}
+	return nil
+}
+
+// Excludes reports whether a time of the song, in milliseconds, falls in one
+// of the excluded ranges.
+func (r Rule) Excludes(timeMs uint32) bool {
+	for _, rng := range r.Ranges {
+		if timeMs >= rng.StartMs && timeMs < rng.EndMs {
+			return true
+		}
+	}
+	return false
+}
+
+// Strip removes the couples anchored in the excluded ranges from the
+// fingerprint of the song.
+func (r Rule) Strip(fingerprint map[uint32]models.Couple) {
+	for address, couple := range fingerprint {
+		if r.Excludes(couple.AnchorTimeMs) {
+			delete(fingerprint, address)
+		}
+	}
+}
+
+// Rules holds the rule of every song with exclusions.
+type Rules map[models.SongID]Rule
+
+// Filter returns a function reporting whether a time of a song is excluded,
+// or nil when no song has exclusions.
+func Filter() func(songID models.SongID, timeMs uint32) bool {
+	rules := Current()
+	if len(rules) == 0 {
+		return nil
+	}
+	return func(songID models.SongID, timeMs uint32) bool {
+		rule, ok := rules[songID]
+		return ok && rule.Excludes(timeMs)
+	}
+}
+
+var cache = cached.New(reloadInterval, Load)
+
+// Current returns the rules, reloading them from the database at most every
+// 30 seconds so that rules set on other instances are picked up. If the
+// rules can't be loaded the previous ones are kept.
+func Current() Rules {
+	return cache.Get()
+}
+
+// Load reads every rule from the database.
+func Load() (Rules, error) {
+	rules := Rules{}
+
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		return rules, err
+	}
+	defer dbClient.Close()
+
+	records, err := dbClient.ListRecords(collection, db.RecordFilter{})
+	if err != nil {
+		return rules, err
+	}
+	for _, record := range records {
+		var rule Rule
+		if err := json.Unmarshal(record.Data, &rule); err != nil {
+			return rules, fmt.Errorf("failed to unmarshal exclusion rule %s: %v", record.ID, err)
+		}
+		rules[rule.SongID] = rule
+	}
+	return rules, nil
+}
+
+// Get returns the rule of a song, if it has one.
+func Get(songID models.SongID) (Rule, bool, error) {
+	var rule Rule
+
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		return rule, false, err
+	}
+	defer dbClient.Close()
+
+	record, exists, err := dbClient.GetRecord(collection, strconv.FormatUint(uint64(songID), 10))
+	if err != nil || !exists {
+		return rule, exists, err
+	}
+	if err := json.Unmarshal(record.Data, &rule); err != nil {
+		return rule, false, fmt.Errorf("failed to unmarshal exclusion rule %s: %v", record.ID, err)
+	}
+	return rule, true, nil
+}
+
+// SetRule creates or replaces the rule of a song.
+func SetRule(rule Rule) error {
+	data, err := json.Marshal(rule)
+	if err != nil {
+		return fmt.Errorf("failed to marshal exclusion rule: %v", err)
+	}
+
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		return err
+	}
+	defer dbClient.Close()
+
+	err = dbClient.PutRecord(collection, db.Record{
+		ID:        strconv.FormatUint(uint64(rule.SongID), 10),
+		CreatedAt: time.Now().UTC(),
+		Data:      data,
+	})
+	if err != nil {
+		return err
+	}
+	cache.Invalidate()
+	return nil
+}
+
+// DeleteRule lets every part of a song match again.
+func DeleteRule(songID models.SongID) error {
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		return err
+	}
+	defer dbClient.Close()
+
+	if err := dbClient.DeleteRecord(collection, strconv.FormatUint(uint64(songID), 10)); err != nil {
+		return err
+	}
+	cache.Invalidate()
+	return nil
+}
@@ -0,0 +1,330 @@
+package exclusions
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"song-recognition/db"
+	"song-recognition/models"
+	"song-recognition/utils"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	sharedAudioCollection = "shared_audio"
+	sharedAudioID         = "latest"
+
+	// segmentGap is the longest silence between common couples of a song that
+	// still belong to one segment of shared audio.
+	segmentGap = 2000
+)
+
+// SharedSegment is where shared audio sits in one song.
+type SharedSegment struct {
+	SongID  models.SongID `json:"songId"`
+	Title   string        `json:"title"`
+	Artist  string        `json:"artist"`
+	Range   Range         `json:"range"`
+	Couples int           `json:"couples"` // common couples in the range
+}
+
+// SharedAudio is audio found with the same timing in several songs, such as
+// a jingle, a sample or a recurring noise pattern.
+type SharedAudio struct {
+	ID       int             `json:"id"`
+	Segments []SharedSegment `json:"segments"`
+	Aligned  int             `json:"aligned"` // couples aligned with the first segment, at worst
+}
+
+// SharedAudioReport lists the shared audio found in the index.
+type SharedAudioReport struct {
+	Refreshed  time.Time     `json:"refreshed"`
+	MinSongs   int           `json:"minSongs"`
+	MinCouples int           `json:"minCouples"`
+	Shared     []SharedAudio `json:"shared"`
+}
+
+// segment is a stretch of a song rich in addresses common to many songs.
+type segment struct {
+	songID  models.SongID
+	start   uint32
+	end     uint32
+	couples map[uint32]uint32 // address -> anchor time
+}
+
+// FindSharedAudio looks for addresses found in at least minSongs songs, and
+// reports the stretches of songs where at least minCouples of them line up
+// with the same offsets in at least minSongs songs.
+func FindSharedAudio(ctx context.Context, client db.DBClient, minSongs, minCouples int) (SharedAudioReport, error) {
+	report := SharedAudioReport{Refreshed: time.Now().UTC(), MinSongs: minSongs, MinCouples: minCouples}
+
+	// Every song holds an address at most once, so couples count songs
+	counts := make(map[uint32]int)
+	err := client.ForEachFingerprint(func(address uint32, couple models.Couple) error {
+		counts[address]++
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+
+	perSong := make(map[models.SongID]map[uint32]uint32) // songID -> address -> anchor time
+	err = client.ForEachFingerprint(func(address uint32, couple models.Couple) error {
+		if counts[address] < minSongs {
+			return nil
+		}
+		if perSong[couple.SongID] == nil {
+			perSong[couple.SongID] = make(map[uint32]uint32)
+		}
+		perSong[couple.SongID][address] = couple.AnchorTimeMs
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+	clear(counts)
+
+	var segments []*segment
+	for songID, couples := range perSong {
+		segments = append(segments, splitSegments(songID, couples, minCouples)...)
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		if len(segments[i].couples) != len(segments[j].couples) {
+			return len(segments[i].couples) > len(segments[j].couples)
+		}
+		if segments[i].songID != segments[j].songID {
+			return segments[i].songID < segments[j].songID
+		}
+		return segments[i].start < segments[j].start
+	})
+
+	assigned := make([]bool, len(segments))
+	for i, seed := range segments {
+		if assigned[i] {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+
+		// Each other song joins with its segment aligning best with the seed
+		type candidate struct {
+			index   int
+			aligned []uint32
+		}
+		best := make(map[models.SongID]candidate)
+		for j := i + 1; j < len(segments); j++ {
+			if assigned[j] || segments[j].songID == seed.songID {
+				continue
+			}
+			aligned := alignedCouples(seed, segments[j])
+			if len(aligned) >= minCouples && len(aligned) > len(best[segments[j].songID].aligned) {
+				best[segments[j].songID] = candidate{j, aligned}
+			}
+		}
+		if len(best)+1 < minSongs {
+			continue
+		}
+
+		// Only the couples lining up with the seed are shared audio; the rest
+		// of the segments may be common for other reasons
+		group := []int{i}
+		worst := len(seed.couples)
+		seedAligned := make(map[uint32]int) // address -> segments aligned on it
+		var members []SharedSegment
+		for _, c := range best {
+			group = append(group, c.index)
+			worst = min(worst, len(c.aligned))
+
+			times := make([]uint32, 0, len(c.aligned))
+			for _, address := range c.aligned {
+				seedAligned[address]++
+				times = append(times, segments[c.index].couples[address])
+			}
+			members = append(members, sharedSegment(segments[c.index].songID, times))
+		}
+		sort.Slice(members, func(a, b int) bool { return members[a].SongID < members[b].SongID })
+
+		var seedTimes []uint32
+		for address, count := range seedAligned {
+			if 2*count >= len(members) {
+				seedTimes = append(seedTimes, seed.couples[address])
+			}
+		}
+		for _, j := range group {
+			assigned[j] = true
+		}
+		report.Shared = append(report.Shared, SharedAudio{
+			ID:       len(report.Shared) + 1,
+			Segments: append([]SharedSegment{sharedSegment(seed.songID, seedTimes)}, members...),
+			Aligned:  worst,
+		})
+	}
+
+	for i := range report.Shared {
+		for j := range report.Shared[i].Segments {
+			shared := &report.Shared[i].Segments[j]
+			if song, exists, err := client.GetSongByID(shared.SongID); err == nil && exists {
+				shared.Title, shared.Artist = song.Title, song.Artist
+			}
+		}
+	}
+	return report, nil
+}
+
+// splitSegments cuts the common couples of a song wherever they pause for
+// more than segmentGap, keeping the stretches of at least minCouples.
+func splitSegments(songID models.SongID, couples map[uint32]uint32, minCouples int) []*segment {
+	addresses := make([]uint32, 0, len(couples))
+	for address := range couples {
+		addresses = append(addresses, address)
+	}
+	slices.SortFunc(addresses, func(a, b uint32) int {
+		if c := cmp.Compare(couples[a], couples[b]); c != 0 {
+			return c
+		}
+		return cmp.Compare(a, b)
+	})
+
+	var segments []*segment
+	var current *segment
+	flush := func() {
+		if current != nil && len(current.couples) >= minCouples {
+			segments = append(segments, current)
+		}
+	}
+	for _, address := range addresses {
+		anchorTime := couples[address]
+		if current == nil || anchorTime-current.end > segmentGap {
+			flush()
+			current = &segment{songID: songID, start: anchorTime, couples: make(map[uint32]uint32)}
+		}
+		current.end = anchorTime
+		current.couples[address] = anchorTime
+	}
+	flush()
+	return segments
+}
+
+// alignedCouples returns the addresses of a found in b at the most common
+// offset between them, binned like match offsets.
+func alignedCouples(a, b *segment) []uint32 {
+	histogram := make(map[int64][]uint32)
+	var best int64
+	for address, timeA := range a.couples {
+		timeB, ok := b.couples[address]
+		if !ok {
+			continue
+		}
+		bucket := (int64(timeB) - int64(timeA)) / 100
+		histogram[bucket] = append(histogram[bucket], address)
+		if len(histogram[bucket]) > len(histogram[best]) {
+			best = bucket
+		}
+	}
+	return histogram[best]
+}
+
+// sharedSegment returns the segment of a song spanning the densest run of
+// the anchor times of its shared couples. Stray couples aligning by chance
+// away from the shared audio are left out.
+func sharedSegment(songID models.SongID, times []uint32) SharedSegment {
+	shared := SharedSegment{SongID: songID}
+	slices.Sort(times)
+	for start := 0; start < len(times); {
+		end := start + 1
+		for end < len(times) && times[end]-times[end-1] <= segmentGap {
+			end++
+		}
+		if end-start > shared.Couples {
+			shared.Couples = end - start
+			shared.Range = Range{StartMs: times[start], EndMs: times[end-1] + 1}
+		}
+		start = end
+	}
+	return shared
+}
+
+// RefreshSharedAudio looks for shared audio in the index and stores the
+// report. An address must be in SHARED_AUDIO_MIN_SONGS songs (default 5) to
+// be considered, and shared audio must align SHARED_AUDIO_MIN_COUPLES of them
+// (default 20) in that many songs.
+func RefreshSharedAudio(ctx context.Context) (SharedAudioReport, error) {
+	minSongs, err := strconv.Atoi(utils.GetEnv("SHARED_AUDIO_MIN_SONGS", "5"))
+	if err != nil || minSongs < 2 {
+		minSongs = 5
+	}
+	minCouples, err := strconv.Atoi(utils.GetEnv("SHARED_AUDIO_MIN_COUPLES", "20"))
+	if err != nil || minCouples < 1 {
+		minCouples = 20
+	}
+
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		return SharedAudioReport{}, err
+	}
+	defer dbClient.Close()
+
+	report, err := FindSharedAudio(ctx, dbClient, minSongs, minCouples)
+	if err != nil {
+		return report, err
+	}
+
+	data, err := json.Marshal(report)
+	if err != nil {
+		return report, fmt.Errorf("failed to marshal shared audio report: %v", err)
+	}
+	return report, dbClient.PutRecord(sharedAudioCollection, db.Record{
+		ID:        sharedAudioID,
+		CreatedAt: report.Refreshed,
+		Data:      data,
+	})
+}
+
+// GetSharedAudio returns the report stored by the last refresh.
+func GetSharedAudio() (SharedAudioReport, bool, error) {
+	var report SharedAudioReport
+
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		return report, false, err
+	}
+	defer dbClient.Close()
+
+	record, exists, err := dbClient.GetRecord(sharedAudioCollection, sharedAudioID)
+	if err != nil || !exists {
+		return report, exists, err
+	}
+	if err := json.Unmarshal(record.Data, &report); err != nil {
+		return report, false, fmt.Errorf("failed to unmarshal shared audio report: %v", err)
+	}
+	return report, true, nil
+}
+
+// ExcludeShared adds the ranges of shared audio to the exclusions of each
+// song it was found in, and returns the updated rules.
+func ExcludeShared(shared SharedAudio, reason string) ([]Rule, error) {
+	var rules []Rule
+	for _, segment := range shared.Segments {
+		rule, _, err := Get(segment.SongID)
+		if err != nil {
+			return rules, err
+		}
+		rule.SongID = segment.SongID
+		if !slices.Contains(rule.Ranges, segment.Range) {
+			rule.Ranges = append(rule.Ranges, segment.Range)
+		}
+		if rule.Reason == "" {
+			rule.Reason = reason
+		}
+		if err := SetRule(rule); err != nil {
+			return rules, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
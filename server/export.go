@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"song-recognition/db"
+	"song-recognition/utils"
+	"sync"
+)
+
+// exportCatalog writes the songs and fingerprints of the catalog to a folder
+// of checksummed chunks, compressed by parallel workers, and a manifest.
+func exportCatalog(args []string) {
+	exportCmd := flag.NewFlagSet("export", flag.ExitOnError)
+	out := exportCmd.String("out", "", "folder to export to")
+	archive := exportCmd.String("archive", "", "file to export to as a single archive, instead of a folder")
+	workers := exportCmd.Int("workers", runtime.NumCPU(), "chunks compressed at once")
+	chunkSize := exportCmd.Int("chunk-size", db.ExportCouplesPerChunk, "couples per chunk")
+	asJSON := exportCmd.Bool("json", false, "print progress as JSON lines")
+	exportCmd.Parse(args)
+
+	if (*out == "") == (*archive == "") {
+		fmt.Println("Usage: main.go export --out <dir> | --archive <file> [--workers <n>] [--chunk-size <couples>] [--json]")
+		os.Exit(1)
+	}
+	progress := newProgress("export", *asJSON)
+	fail := func(message string, err error) {
+		yellow.Println(message, err)
+		progress.finish(err)
+		os.Exit(1)
+	}
+
+	if *archive != "" {
+		exportArchive(*archive, progress, fail)
+		return
+	}
+
+	if _, err := os.Stat(filepath.Join(*out, db.ExportManifestFile)); err == nil {
+		fail("Error:", fmt.Errorf("%s already holds an export", *out))
+	}
+	if err := utils.CreateFolder(*out); err != nil {
+		fail("Error creating the export folder:", err)
+	}
+
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		fail("Error connecting to DB:", err)
+	}
+	defer dbClient.Close()
+
+	manifest, err := db.ExportCatalog(dbClient, *out, db.ExportOptions{
+		Workers:   max(*workers, 1),
+		ChunkSize: max(*chunkSize, 1),
+		Stage:     progress.startStage,
+		Written:   func(chunk db.ExportChunk) { progress.add(chunk.Rows) },
+	})
+	if err != nil {
+		fail("Error exporting the catalog:", err)
+	}
+
+	if !manifest.Consistent {
+		yellow.Printf("The catalog changed during the export (version %d to %d); export it again once ingestion is over for a consistent copy.\n",
+			manifest.CatalogVersion, manifest.EndCatalogVersion)
+	}
+	fmt.Printf("Exported %d songs and %d fingerprints in %d chunks to %s.\n", manifest.Songs, manifest.Fingerprints, len(manifest.Chunks), *out)
+	progress.finish(nil)
+}
+
+// forEachChunk runs fn on the chunks with up to workers at once, stopping at
+// the first error.
+func forEachChunk(chunks []db.ExportChunk, workers int, fn func(chunk db.ExportChunk) error) error {
+	pending := make(chan db.ExportChunk)
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	failed := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return firstErr != nil
+	}
+
+	for range min(workers, max(len(chunks), 1)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for chunk := range pending {
+				if err := fn(chunk); err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+	for _, chunk := range chunks {
+		if failed() {
+			break
+		}
+		pending <- chunk
+	}
+	close(pending)
+	wg.Wait()
+	return firstErr
+}
+
+// importCatalog loads an export into the catalog with parallel workers. With
+// --stage, it is loaded next to the live catalog, which keeps serving, and
+// replaces it at once when complete; otherwise it is merged into the live
+// catalog after every chunk was checked.
+func importCatalog(args []string) {
+	importCmd := flag.NewFlagSet("import", flag.ExitOnError)
+	in := importCmd.String("in", "", "folder of the export")
+	archive := importCmd.String("archive", "", "archive written by export --archive, instead of a folder")
+	workers := importCmd.Int("workers", runtime.NumCPU(), "chunks loaded at once")
+	stage := importCmd.Bool("stage", false, "load into shadow collections and switch to them once complete")
+	allowInconsistent := importCmd.Bool("allow-inconsistent", false, "import an export the catalog changed during")
+	asJSON := importCmd.Bool("json", false, "print progress as JSON lines")
+	importCmd.Parse(args)
+
+	if (*in == "") == (*archive == "") {
+		fmt.Println("Usage: main.go import --in <dir> | --archive <file> [--workers <n>] [--stage] [--allow-inconsistent] [--json]")
+		os.Exit(1)
+	}
+	progress := newProgress("import", *asJSON)
+	fail := func(message string, err error) {
+		yellow.Println(message, err)
+		progress.finish(err)
+		os.Exit(1)
+	}
+
+	if *archive != "" {
+		importArchive(*archive, *allowInconsistent, progress, fail)
+		return
+	}
+	*workers = max(*workers, 1)
+
+	manifest, err := db.ReadExportManifest(*in)
+	if err != nil {
+		fail("Error:", err)
+	}
+	if !manifest.Consistent && !*allowInconsistent {
+		fail("Error:", fmt.Errorf("the catalog changed while it was exported (version %d to %d); use --allow-inconsistent to import it anyway",
+			manifest.CatalogVersion, manifest.EndCatalogVersion))
+	}
+
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		fail("Error connecting to DB:", err)
+	}
+	defer dbClient.Close()
+
+	var target db.CatalogWriter = dbClient
+	var staged db.StagedCatalog
+	if *stage {
+		staged, err = db.StageCatalog(dbClient)
+		if err != nil {
+			fail("Error staging the catalog:", err)
+		}
+		target = staged
+	} else {
+		// Nothing is written unless the whole export is intact, since a
+		// partial import into the live catalog can't be undone
+		progress.startStage("verify", int64(len(manifest.Chunks)))
+		err := forEachChunk(manifest.Chunks, *workers, func(chunk db.ExportChunk) error {
+			_, err := db.ReadExportChunk(*in, chunk)
+			progress.item(chunk.File, err)
+			return err
+		})
+		if err != nil {
+			fail("Error verifying the export:", err)
+		}
+	}
+	abort := func(message string, err error) {
+		if staged != nil {
+			if err := staged.Discard(); err != nil {
+				yellow.Println("Error discarding the staged catalog:", err)
+			}
+		}
+		fail(message, err)
+	}
+
+	var songChunks, fingerprintChunks []db.ExportChunk
+	for _, chunk := range manifest.Chunks {
+		if chunk.Kind == db.ChunkSongs {
+			songChunks = append(songChunks, chunk)
+		} else {
+			fingerprintChunks = append(fingerprintChunks, chunk)
+		}
+	}
+
+	for _, part := range []struct {
+		stage  string
+		rows   int64
+		chunks []db.ExportChunk
+	}{
+		{db.ChunkSongs, manifest.Songs, songChunks},
+		{db.ChunkFingerprints, manifest.Fingerprints, fingerprintChunks},
+	} {
+		fmt.Printf("Importing %d %s from %d chunks...\n", part.rows, part.stage, len(part.chunks))
+		progress.startStage(part.stage, part.rows)
+		err := forEachChunk(part.chunks, *workers, func(chunk db.ExportChunk) error {
+			if err := db.LoadExportChunk(*in, chunk, manifest.Format, target); err != nil {
+				return err
+			}
+			progress.add(chunk.Rows)
+			return nil
+		})
+		if err != nil {
+			abort("Error importing the catalog:", err)
+		}
+	}
+
+	if staged != nil {
+		progress.startStage("promote", 0)
+		if err := staged.Promote(); err != nil {
+			abort("Error switching to the imported catalog:", err)
+		}
+		fmt.Println("Switched to the imported catalog.")
+	}
+
+	fmt.Println("Recording fingerprint checksums...")
+	progress.startStage("checksums", 0)
+	if _, err := db.RefreshFingerprintChecksums(dbClient); err != nil {
+		fail("Error recording fingerprint checksums:", err)
+	}
+	if staged == nil {
+		// Imported couples the catalog already had were counted twice, while
+		// staged catalogs were counted as they were loaded
+		fmt.Println("Counting catalog stats...")
+		progress.startStage("stats", 0)
+		if _, err := db.CountCatalogStats(dbClient); err != nil {
+			fail("Error counting catalog stats:", err)
+		}
+	}
+
+	songs, err := dbClient.TotalSongs()
+	if err != nil {
+		fail("Error counting songs:", err)
+	}
+	if int64(songs) < manifest.Songs {
+		err := fmt.Errorf("the catalog has %d songs after importing %d", songs, manifest.Songs)
+		fail("Error:", err)
+	}
+	fmt.Printf("Imported %d songs and %d fingerprints; the catalog has %d songs.\n", manifest.Songs, manifest.Fingerprints, songs)
+	printPendingMigrations(dbClient)
+	progress.finish(nil)
+}
+
+// exportArchive writes the catalog to a single archive file with
+// db.ExportAll. The file only appears once the archive is complete.
+func exportArchive(path string, progress *progress, fail func(message string, err error)) {
+	if _, err := os.Stat(path); err == nil {
+		fail("Error:", fmt.Errorf("%s already exists", path))
+	}
+	if dir := filepath.Dir(path); dir != "." {
+		if err := utils.CreateFolder(dir); err != nil {
+			fail("Error creating the export folder:", err)
+		}
+	}
+
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		fail("Error connecting to DB:", err)
+	}
+	defer dbClient.Close()
+
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		fail("Error creating the archive:", err)
+	}
+	defer os.Remove(tmp)
+
+	progress.startStage("archive", 0)
+	writer := bufio.NewWriter(file)
+	manifest, err := db.ExportAll(dbClient, writer)
+	if err == nil {
+		err = writer.Flush()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		fail("Error exporting the catalog:", err)
+	}
+
+	if !manifest.Consistent {
+		yellow.Printf("The catalog changed during the export (version %d to %d); export it again once ingestion is over for a consistent copy.\n",
+			manifest.CatalogVersion, manifest.EndCatalogVersion)
+	}
+	fmt.Printf("Exported %d songs and %d fingerprints to %s.\n", manifest.Songs, manifest.Fingerprints, path)
+	progress.finish(nil)
+}
+
+// importArchive loads an archive file written by exportArchive with
+// db.ImportAll, which replaces the catalog once the whole archive was read
+// on backends that can stage a catalog.
+func importArchive(path string, allowInconsistent bool, progress *progress, fail func(message string, err error)) {
+	file, err := os.Open(path)
+	if err != nil {
+		fail("Error opening the archive:", err)
+	}
+	defer file.Close()
+
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		fail("Error connecting to DB:", err)
+	}
+	defer dbClient.Close()
+
+	progress.startStage("archive", 0)
+	manifest, err := db.ImportAll(dbClient, bufio.NewReader(file), allowInconsistent)
+	if errors.Is(err, db.ErrInconsistentArchive) {
+		err = fmt.Errorf("%v; use --allow-inconsistent to import it anyway", err)
+	}
+	if err != nil {
+		fail("Error importing the catalog:", err)
+	}
+
+	progress.startStage("checksums", 0)
+	if _, err := db.RefreshFingerprintChecksums(dbClient); err != nil {
+		fail("Error recording fingerprint checksums:", err)
+	}
+
+	songs, err := dbClient.TotalSongs()
+	if err != nil {
+		fail("Error counting songs:", err)
+	}
+	fmt.Printf("Imported %d songs and %d fingerprints; the catalog has %d songs.\n", manifest.Songs, manifest.Fingerprints, songs)
+	printPendingMigrations(dbClient)
+	progress.finish(nil)
+}
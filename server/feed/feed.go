@@ -0,0 +1,436 @@
+// Package feed reads the track feeds label and aggregator pipelines deliver,
+// CSV or JSON lists of tracks with the URL of their audio, and keeps the
+// status of every row of an import while its tracks are ingested.
+package feed
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"regexp"
+	"song-recognition/db"
+	"song-recognition/models"
+	"song-recognition/utils"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const collection = "feed_imports"
+
+// Formats of feeds
+const (
+	FormatCSV  = "csv"
+	FormatJSON = "json"
+)
+
+// Statuses of the rows of an import
+const (
+	StatusQueued      = "queued"
+	StatusDownloading = "downloading"
+	StatusSaving      = "saving"
+	StatusSaved       = "saved"
+	StatusDuplicate   = "duplicate" // the catalog already has a song with the title and artist
+	StatusInvalid     = "invalid"   // the row lacks a field or has a malformed one
+	StatusFailed      = "failed"    // recorded as an ingestion failure, see Failure
+)
+
+// ErrNotFound is returned for imports that don't exist.
+var ErrNotFound = errors.New("feed import not found")
+
+var isrcPattern = regexp.MustCompile(`^[A-Z]{2}[A-Z0-9]{3}[0-9]{7}$`)
+
+// fields maps the normalized names feeds give their columns or keys to the
+// fields of a Track.
+var fields = map[string]string{
+	"title": "title", "tracktitle": "title", "track": "title", "trackname": "title", "name": "title",
+	"artist": "artist", "artists": "artist", "artistname": "artist",
+	"isrc":     "isrc",
+	"audiourl": "audioUrl", "audio": "audioUrl", "url": "audioUrl", "fileurl": "audioUrl", "downloadurl": "audioUrl",
+	"album": "album", "release": "album", "releasename": "album", "releasetitle": "album",
+	"coverarturl": "coverArtUrl", "coverart": "coverArtUrl", "coverurl": "coverArtUrl", "cover": "coverArtUrl",
+	"artworkurl": "coverArtUrl", "artwork": "coverArtUrl", "imageurl": "coverArtUrl", "image": "coverArtUrl",
+}
+
+// Track is a row of a feed.
+type Track struct {
+	Title       string `json:"title"`
+	Artist      string `json:"artist"`
+	ISRC        string `json:"isrc,omitempty"`
+	AudioURL    string `json:"audioUrl"`
+	Album       string `json:"album,omitempty"`
+	CoverArtURL string `json:"coverArtUrl,omitempty"`
+}
+
+// Validate checks the track has a title, an artist and an http or https
+// audio URL, and that its ISRC and cover art URL, if any, are well formed.
+// It returns the track with its ISRC normalized.
+func (t Track) Validate() (Track, error) {
+	t.Title, t.Artist = strings.TrimSpace(t.Title), strings.TrimSpace(t.Artist)
+	t.AudioURL, t.Album = strings.TrimSpace(t.AudioURL), strings.TrimSpace(t.Album)
+	t.CoverArtURL = strings.TrimSpace(t.CoverArtURL)
+	if t.Title == "" {
+		return t, fmt.Errorf("title is required")
+	}
+	if t.Artist == "" {
+		return t, fmt.Errorf("artist is required")
+	}
+	u, err := url.Parse(t.AudioURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return t, fmt.Errorf("audioUrl must be an http or https URL")
+	}
+	if t.CoverArtURL != "" {
+		u, err := url.Parse(t.CoverArtURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return t, fmt.Errorf("coverArtUrl must be an http or https URL")
+		}
+	}
+	if t.ISRC != "" {
+		isrc, err := NormalizeISRC(t.ISRC)
+		if err != nil {
+			return t, err
+		}
+		t.ISRC = isrc
+	}
+	return t, nil
+}
+
+// NormalizeISRC returns an ISRC such as "us-rc1-17-00001" in its compact
+// upper case form, "USRC11700001".
+func NormalizeISRC(isrc string) (string, error) {
+	normalized := strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(isrc))
+	if !isrcPattern.MatchString(normalized) {
+		return "", fmt.Errorf("isrc %q is not a 12 character ISRC", isrc)
+	}
+	return normalized, nil
+}
+
+// Row is a track of a feed as it was read, with the error of tracks that
+// lack a field or have a malformed one.
+type Row struct {
+	Track Track
+	Err   error
+}
+
+// Parse reads the tracks of a CSV or JSON feed. CSV feeds start with a
+// header naming their columns; JSON feeds are an array of tracks or an
+// object with a "tracks" array. Columns and keys are matched ignoring case,
+// spaces, '-' and '_', and common aliases such as "Track Title" or
+// "Release Name" are understood. Without a format, it is guessed from the
+// first character of the feed, and returned. Only malformed feeds fail; rows
+// missing fields are returned with an error so their status can be reported.
+func Parse(r io.Reader, format string) ([]Row, string, error) {
+	reader := bufio.NewReader(r)
+	if format == "" {
+		format = FormatCSV
+		for {
+			b, err := reader.ReadByte()
+			if err != nil {
+				break
+			}
+			// Skip blanks and byte order marks
+			if strings.IndexByte(" \t\r\n\xef\xbb\xbf", b) >= 0 {
+				continue
+			}
+			if b == '[' || b == '{' {
+				format = FormatJSON
+			}
+			reader.UnreadByte()
+			break
+		}
+	}
+
+	var rows []Row
+	var err error
+	switch format = strings.ToLower(format); format {
+	case FormatCSV:
+		rows, err = parseCSV(reader)
+	case FormatJSON:
+		rows, err = parseJSON(reader)
+	default:
+		err = fmt.Errorf("unknown feed format %q, expected csv or json", format)
+	}
+	return rows, format, err
+}
+
+func normalizeField(name string) string {
+	name = strings.TrimPrefix(strings.TrimSpace(name), "\ufeff")
+	return strings.ToLower(strings.NewReplacer(" ", "", "_", "", "-", "").Replace(name))
+}
+
+func parseCSV(r io.Reader) ([]Row, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the header of the feed: %v", err)
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		if field, ok := fields[normalizeField(name)]; ok {
+			if _, seen := columns[field]; !seen {
+				columns[field] = i
+			}
+		}
+	}
+	for _, field := range []string{"title", "artist", "audioUrl"} {
+		if _, ok := columns[field]; !ok {
+			return nil, fmt.Errorf("the feed has no %s column", field)
+		}
+	}
+
+	var rows []Row
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the feed: %v", err)
+		}
+		value := func(field string) string {
+			if i, ok := columns[field]; ok && i < len(record) {
+				return record[i]
+			}
+			return ""
+		}
+		rows = append(rows, validRow(Track{
+			Title:       value("title"),
+			Artist:      value("artist"),
+			ISRC:        value("isrc"),
+			AudioURL:    value("audioUrl"),
+			Album:       value("album"),
+			CoverArtURL: value("coverArtUrl"),
+		}))
+	}
+	return rows, nil
+}
+
+func parseJSON(r io.Reader) ([]Row, error) {
+	var raw json.RawMessage
+	if err := json.NewDecoder(r).Decode(&raw); err != nil {
+		return nil, fmt.Errorf("failed to read the feed: %v", err)
+	}
+	var items []map[string]interface{}
+	if err := json.Unmarshal(raw, &items); err != nil {
+		var wrapped struct {
+			Tracks []map[string]interface{} `json:"tracks"`
+		}
+		if err := json.Unmarshal(raw, &wrapped); err != nil || wrapped.Tracks == nil {
+			return nil, fmt.Errorf("the feed must be an array of tracks or an object with a tracks array")
+		}
+		items = wrapped.Tracks
+	}
+
+	rows := make([]Row, 0, len(items))
+	for _, item := range items {
+		// Keys are read in order so that aliases of a field resolve the same
+		// way every time
+		keys := make([]string, 0, len(item))
+		for key := range item {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		values := make(map[string]string)
+		for _, key := range keys {
+			field, ok := fields[normalizeField(key)]
+			if !ok {
+				continue
+			}
+			if _, seen := values[field]; !seen {
+				values[field] = jsonString(item[key])
+			}
+		}
+		rows = append(rows, validRow(Track{
+			Title:       values["title"],
+			Artist:      values["artist"],
+			ISRC:        values["isrc"],
+			AudioURL:    values["audioUrl"],
+			Album:       values["album"],
+			CoverArtURL: values["coverArtUrl"],
+		}))
+	}
+	return rows, nil
+}
+
+// jsonString returns a value of a JSON feed as text, joining lists such as
+// several artists with commas.
+func jsonString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case []interface{}:
+		parts := make([]string, 0, len(v))
+		for _, part := range v {
+			if s := jsonString(part); s != "" {
+				parts = append(parts, s)
+			}
+		}
+		return strings.Join(parts, ", ")
+	case map[string]interface{}:
+		// Such as {"name": "Artist"}
+		for _, key := range []string{"name", "title"} {
+			if s, ok := v[key].(string); ok {
+				return s
+			}
+		}
+	}
+	return ""
+}
+
+func validRow(track Track) Row {
+	track, err := track.Validate()
+	return Row{Track: track, Err: err}
+}
+
+// RowStatus is the progress of a row of an import.
+type RowStatus struct {
+	Row       int           `json:"row"` // 1 for the first track of the feed
+	Track     Track         `json:"track"`
+	Status    string        `json:"status"`
+	Error     string        `json:"error,omitempty"`
+	SongID    models.SongID `json:"songId,omitempty"`    // the song saved rows were saved as
+	FailureID string        `json:"failureId,omitempty"` // the ingestion failure of failed rows
+	UpdatedAt time.Time     `json:"updatedAt"`
+}
+
+// Done reports whether the row won't be processed further.
+func (s RowStatus) Done() bool {
+	switch s.Status {
+	case StatusQueued, StatusDownloading, StatusSaving:
+		return false
+	}
+	return true
+}
+
+// Import is a feed submitted for ingestion and the status of its rows.
+type Import struct {
+	ID         string         `json:"id"`
+	Source     string         `json:"source,omitempty"` // name of the feed, such as its file name
+	Format     string         `json:"format"`
+	Counts     map[string]int `json:"counts"` // rows by status
+	Rows       []RowStatus    `json:"rows,omitempty"`
+	CreatedAt  time.Time      `json:"createdAt"`
+	UpdatedAt  time.Time      `json:"updatedAt"`
+	FinishedAt time.Time      `json:"finishedAt,omitempty"`
+}
+
+// NewImport starts an import of the rows of a feed, queuing the valid ones.
+func NewImport(source, format string, rows []Row) Import {
+	now := time.Now().UTC()
+	imp := Import{
+		ID:        strconv.FormatUint(uint64(utils.GenerateUniqueID()), 10),
+		Source:    source,
+		Format:    format,
+		Rows:      make([]RowStatus, len(rows)),
+		CreatedAt: now,
+	}
+	for i, row := range rows {
+		status := RowStatus{Row: i + 1, Track: row.Track, Status: StatusQueued, UpdatedAt: now}
+		if row.Err != nil {
+			status.Status, status.Error = StatusInvalid, row.Err.Error()
+		}
+		imp.Rows[i] = status
+	}
+	imp.count()
+	return imp
+}
+
+// Finished reports whether every row of the import was processed.
+func (imp Import) Finished() bool {
+	return !imp.FinishedAt.IsZero()
+}
+
+// count tallies the rows by status, and marks the import finished once
+// they are all done.
+func (imp *Import) count() {
+	imp.Counts = make(map[string]int)
+	done := true
+	for _, row := range imp.Rows {
+		imp.Counts[row.Status]++
+		done = done && row.Done()
+	}
+	if done && imp.FinishedAt.IsZero() {
+		imp.FinishedAt = time.Now().UTC()
+	}
+}
+
+// SetStatus updates the status of the row at index i, and of the import.
+func (imp *Import) SetStatus(i int, status RowStatus) {
+	status.Row = i + 1
+	status.UpdatedAt = time.Now().UTC()
+	imp.Rows[i] = status
+	imp.count()
+}
+
+// Save stores an import and the status of its rows.
+func Save(imp Import) (Import, error) {
+	imp.UpdatedAt = time.Now().UTC()
+	data, err := json.Marshal(imp)
+	if err != nil {
+		return imp, fmt.Errorf("failed to marshal feed import: %v", err)
+	}
+
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		return imp, err
+	}
+	defer dbClient.Close()
+
+	return imp, dbClient.PutRecord(collection, db.Record{ID: imp.ID, CreatedAt: imp.CreatedAt, Data: data})
+}
+
+// Get returns an import and the status of its rows.
+func Get(id string) (Import, error) {
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		return Import{}, err
+	}
+	defer dbClient.Close()
+
+	record, exists, err := dbClient.GetRecord(collection, id)
+	if err != nil {
+		return Import{}, err
+	}
+	if !exists {
+		return Import{}, ErrNotFound
+	}
+	var imp Import
+	if err := json.Unmarshal(record.Data, &imp); err != nil {
+		return Import{}, fmt.Errorf("failed to unmarshal feed import %s: %v", id, err)
+	}
+	return imp, nil
+}
+
+// List returns every import, newest first.
+func List() ([]Import, error) {
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		return nil, err
+	}
+	defer dbClient.Close()
+
+	records, err := dbClient.ListRecords(collection, db.RecordFilter{})
+	if err != nil {
+		return nil, err
+	}
+	imports := make([]Import, 0, len(records))
+	for _, record := range records {
+		var imp Import
+		if err := json.Unmarshal(record.Data, &imp); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal feed import %s: %v", record.ID, err)
+		}
+		imports = append(imports, imp)
+	}
+	sort.SliceStable(imports, func(i, j int) bool { return imports[i].CreatedAt.After(imports[j].CreatedAt) })
+	return imports, nil
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"song-recognition/archive"
+	"song-recognition/feed"
+	"song-recognition/ingest"
+	"song-recognition/models"
+	"song-recognition/songmeta"
+	"song-recognition/spotify"
+	"song-recognition/utils"
+	"song-recognition/wav"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mdobak/go-xerrors"
+)
+
+// maxFeedSize is the largest feed accepted by the admin API.
+const maxFeedSize = 32 << 20
+
+var (
+	feedsOnce sync.Once
+	feedQueue chan string
+
+	feedClient = &http.Client{Timeout: 10 * time.Minute}
+
+	audioExtPattern = regexp.MustCompile(`^\.[a-z0-9]{1,5}$`)
+)
+
+// getFeedQueue returns the queue of the IDs of feed imports to process,
+// starting the worker that processes them, one import after another, on
+// first use.
+func getFeedQueue() chan<- string {
+	feedsOnce.Do(func() {
+		feedQueue = make(chan string, 64)
+		go func() {
+			for id := range feedQueue {
+				processFeedImport(context.Background(), id)
+			}
+		}()
+	})
+	return feedQueue
+}
+
+// enqueueFeedImport queues an import without waiting for the imports ahead
+// of it.
+func enqueueFeedImport(id string) {
+	queue := getFeedQueue()
+	go func() { queue <- id }()
+}
+
+// startFeeds resumes the imports that were still being processed when the
+// server stopped.
+func startFeeds() {
+	logger := utils.GetLogger()
+	imports, err := feed.List()
+	if err != nil {
+		err := xerrors.New(err)
+		logger.ErrorContext(context.Background(), "failed to list feed imports", slog.Any("error", err))
+		return
+	}
+	// Oldest first, as they were queued
+	for i := len(imports) - 1; i >= 0; i-- {
+		if !imports[i].Finished() {
+			enqueueFeedImport(imports[i].ID)
+		}
+	}
+}
+
+// feedWorkers returns how many rows of an import are ingested at once, from
+// FEED_WORKERS (default: half the CPUs).
+func feedWorkers() int {
+	workers, err := strconv.Atoi(utils.GetEnv("FEED_WORKERS"))
+	if err != nil || workers <= 0 {
+		workers = max(runtime.NumCPU()/2, 1)
+	}
+	return workers
+}
+
+// maxFeedDownload returns the largest audio file downloaded for a row of a
+// feed in bytes, from FEED_MAX_DOWNLOAD_MB (default 200).
+func maxFeedDownload() int64 {
+	maxDownload, err := strconv.ParseInt(utils.GetEnv("FEED_MAX_DOWNLOAD_MB", "200"), 10, 64)
+	if err != nil || maxDownload <= 0 {
+		maxDownload = 200
+	}
+	return maxDownload << 20
+}
+
+// processFeedImport ingests the queued rows of an import, saving the status
+// of every row as it changes. Rows an interrupted run left downloading or
+// saving are ingested again.
+func processFeedImport(ctx context.Context, id string) {
+	logger := utils.GetLogger()
+	imp, err := feed.Get(id)
+	if err != nil {
+		err := xerrors.New(err)
+		logger.ErrorContext(ctx, "failed to read feed import", slog.String("import", id), slog.Any("error", err))
+		return
+	}
+
+	var mu sync.Mutex
+	setStatus := func(i int, status feed.RowStatus) {
+		mu.Lock()
+		defer mu.Unlock()
+		imp.SetStatus(i, status)
+		saved, err := feed.Save(imp)
+		if err != nil {
+			err := xerrors.New(err)
+			logger.ErrorContext(ctx, "failed to save feed import", slog.String("import", id), slog.Any("error", err))
+			return
+		}
+		imp = saved
+	}
+
+	var pending []int
+	for i, row := range imp.Rows {
+		if !row.Done() {
+			pending = append(pending, i)
+		}
+	}
+	rows := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < min(feedWorkers(), len(pending)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range rows {
+				mu.Lock()
+				track := imp.Rows[i].Track
+				mu.Unlock()
+				status := feed.RowStatus{Track: track}
+
+				songID, err := ingestFeedTrack(ctx, track, func(stage string) {
+					status.Status = stage
+					setStatus(i, status)
+				})
+				switch {
+				case errors.Is(err, errDuplicateSong):
+					status.Status, status.Error = feed.StatusDuplicate, ""
+				case err != nil:
+					status.Status, status.Error = feed.StatusFailed, err.Error()
+					status.FailureID = ingest.FailureID(ingest.KindFeed, track.AudioURL)
+				default:
+					status.Status, status.SongID = feed.StatusSaved, songID
+				}
+				setStatus(i, status)
+			}
+		}()
+	}
+	for _, i := range pending {
+		rows <- i
+	}
+	close(rows)
+	wg.Wait()
+
+	// Imports without pending rows were finished by an earlier run
+	if len(pending) > 0 {
+		mu.Lock()
+		counts := imp.Counts
+		mu.Unlock()
+		logger.Info(fmt.Sprintf("Feed import %s finished: %d saved, %d duplicates, %d invalid, %d failed", id,
+			counts[feed.StatusSaved], counts[feed.StatusDuplicate], counts[feed.StatusInvalid], counts[feed.StatusFailed]))
+		if archive.Enabled() && counts[feed.StatusSaved] > 0 {
+			replayUnmatched()
+		}
+	}
+}
+
+var errDuplicateSong = errors.New("song already exists")
+
+// ingestFeedTrack ingests a track of a feed, recording it as an ingestion
+// failure if it fails, or resolving its previous failure if it succeeds.
+// Tracks already in the catalog return errDuplicateSong. stage is called as
+// the track starts being downloaded and saved.
+func ingestFeedTrack(ctx context.Context, track feed.Track, stage func(status string)) (models.SongID, error) {
+	logger := utils.GetLogger()
+	failureID := ingest.FailureID(ingest.KindFeed, track.AudioURL)
+
+	exists, err := spotify.SongKeyExists(utils.GenerateSongKey(track.Title, track.Artist))
+	if err == nil && exists {
+		return 0, errDuplicateSong
+	}
+
+	songID, err := saveFeedTrack(ctx, track, stage)
+	if err != nil {
+		failure := ingest.Failure{
+			Kind:        ingest.KindFeed,
+			Source:      track.AudioURL,
+			Title:       track.Title,
+			Artist:      track.Artist,
+			Album:       track.Album,
+			ISRC:        track.ISRC,
+			CoverArtURL: track.CoverArtURL,
+			Error:       err.Error(),
+		}
+		if err := ingest.RecordFailure(failure); err != nil {
+			err := xerrors.New(err)
+			logger.ErrorContext(ctx, "failed to record ingestion failure", slog.Any("error", err))
+		}
+		return 0, err
+	}
+
+	if err := ingest.ResolveFailure(failureID); err != nil {
+		err := xerrors.New(err)
+		logger.ErrorContext(ctx, "failed to resolve ingestion failure", slog.Any("error", err))
+	}
+	return songID, nil
+}
+
+// saveFeedTrack downloads the audio of a track of a feed to the tmp folder,
+// saves it with the details the feed gives and moves it to SONGS_DIR.
+func saveFeedTrack(ctx context.Context, track feed.Track, stage func(status string)) (models.SongID, error) {
+	if err := ingest.WaitForSpace(ctx, ingest.MaxPause(), SONGS_DIR); err != nil {
+		return 0, err
+	}
+
+	stage(feed.StatusDownloading)
+	if err := utils.CreateFolder(ingest.TmpDir); err != nil {
+		return 0, fmt.Errorf("failed to create tmp folder: %v", err)
+	}
+	dir, err := os.MkdirTemp(ingest.TmpDir, "feed_*")
+	if err != nil {
+		return 0, fmt.Errorf("failed to create download folder: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	fileName := spotify.SongFileName(track.Title, track.Artist)
+	filePath, err := downloadFeedAudio(ctx, track.AudioURL, filepath.Join(dir, fileName))
+	if err != nil {
+		return 0, err
+	}
+
+	stage(feed.StatusSaving)
+	// Converted here rather than while fingerprinting, which removes the
+	// download, so that the metadata of the song is read from the result
+	wavPath, err := wav.ConvertToWAV(filePath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to convert %s: %v", track.AudioURL, err)
+	}
+	details := songmeta.Metadata{Album: track.Album, ISRC: track.ISRC, CoverArtURL: track.CoverArtURL}
+	songID, err := spotify.SaveSongWithDetails(wavPath, track.Title, track.Artist, "", details)
+	if err != nil {
+		return 0, fmt.Errorf("failed to process or save song: %v", err)
+	}
+
+	if err := utils.MoveFile(wavPath, filepath.Join(SONGS_DIR, fileName+".wav")); err != nil {
+		return songID, fmt.Errorf("failed to move song to %s: %v", SONGS_DIR, err)
+	}
+	return songID, nil
+}
+
+// downloadFeedAudio downloads audio to basePath, adding the extension of the
+// URL or of the content type of the audio, and returns the path of the file.
+// Audio larger than FEED_MAX_DOWNLOAD_MB is refused.
+func downloadFeedAudio(ctx context.Context, audioURL, basePath string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, audioURL, nil)
+	if err != nil {
+		return "", fmt.Errorf("invalid audio URL: %v", err)
+	}
+	resp, err := feedClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to download %s: %v", audioURL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to download %s: %s", audioURL, resp.Status)
+	}
+	limit := maxFeedDownload()
+	if resp.ContentLength > limit {
+		return "", fmt.Errorf("%s is larger than %d MB", audioURL, limit>>20)
+	}
+
+	// Without a known extension, title dots would be taken for one
+	ext := ".audio"
+	if u, err := url.Parse(audioURL); err == nil && audioExtPattern.MatchString(strings.ToLower(path.Ext(u.Path))) {
+		ext = strings.ToLower(path.Ext(u.Path))
+	} else if exts, _ := mime.ExtensionsByType(resp.Header.Get("Content-Type")); len(exts) > 0 {
+		ext = exts[0]
+	}
+
+	filePath := basePath + ext
+	file, err := os.Create(filePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to create %s: %v", filePath, err)
+	}
+	written, err := io.Copy(file, io.LimitReader(resp.Body, limit+1))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to download %s: %v", audioURL, err)
+	}
+	if written > limit {
+		return "", fmt.Errorf("%s is larger than %d MB", audioURL, limit>>20)
+	}
+	return filePath, nil
+}
+
+// handleImportFeed queues the tracks of a CSV or JSON feed, sent as the
+// request body, for ingestion. The format is taken from the "format"
+// parameter or the content type, or guessed. It answers with the import,
+// whose rows are followed with GET /api/admin/feeds/{id}.
+func handleImportFeed(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxFeedSize)
+
+	format := strings.ToLower(r.URL.Query().Get("format"))
+	if format == "" {
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		switch mediaType {
+		case "text/csv":
+			format = feed.FormatCSV
+		case "application/json":
+			format = feed.FormatJSON
+		}
+	}
+
+	rows, format, err := feed.Parse(r.Body, format)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid feed: "+err.Error())
+		return
+	}
+	if len(rows) == 0 {
+		writeError(w, http.StatusBadRequest, "the feed has no tracks")
+		return
+	}
+
+	imp, err := feed.Save(feed.NewImport(r.URL.Query().Get("source"), format, rows))
+	if err != nil {
+		handleAdminError(w, r, "failed to save feed import", err)
+		return
+	}
+	enqueueFeedImport(imp.ID)
+	writeJSON(w, http.StatusAccepted, imp)
+}
+
+// handleListFeedImports lists the imports, newest first, with the counts of
+// their rows by status but without the rows.
+func handleListFeedImports(w http.ResponseWriter, r *http.Request) {
+	imports, err := feed.List()
+	if err != nil {
+		handleAdminError(w, r, "failed to list feed imports", err)
+		return
+	}
+	for i := range imports {
+		imports[i].Rows = nil
+	}
+	writeJSON(w, http.StatusOK, imports)
+}
+
+// handleGetFeedImport returns an import with the status of its rows, only
+// those with the given "status" if set.
+func handleGetFeedImport(w http.ResponseWriter, r *http.Request) {
+	imp, err := feed.Get(r.PathValue("id"))
+	if errors.Is(err, feed.ErrNotFound) {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		handleAdminError(w, r, "failed to read feed import", err)
+		return
+	}
+	if status := r.URL.Query().Get("status"); status != "" {
+		rows := []feed.RowStatus{}
+		for _, row := range imp.Rows {
+			if row.Status == status {
+				rows = append(rows, row)
+			}
+		}
+		imp.Rows = rows
+	}
+	writeJSON(w, http.StatusOK, imp)
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"song-recognition/shazam"
+	"testing"
+)
+
+func FuzzDecodeFingerprintRequest(f *testing.F) {
+	v := shazam.FingerprintVersion
+	f.Add([]byte(fmt.Sprintf(`{"version": %d, "fingerprint": [{"address": 638943422, "anchorTime": 714}]}`, v)))
+	f.Add([]byte(fmt.Sprintf(`{"version": %d, "fingerprint": [{"address": 1, "anchorTime": 2}, {"address": 1, "anchorTime": 3}], "thresholds": {"minAlignedCouples": 40, "minConfidence": 0.3}}`, v)))
+	f.Add([]byte(fmt.Sprintf(`{"version": %d, "params": {}, "fingerprint": []}`, v)))
+	f.Add([]byte(`{"version": 1, "fingerprint": [{"address": -1}]}`))
+	f.Add([]byte(`{} {}`))
+
+	f.Fuzz(func(t *testing.T, body []byte) {
+		req, fingerprint, err := decodeFingerprintRequest(body)
+		if err != nil {
+			return
+		}
+		if req.Version != v {
+			t.Fatalf("accepted version %d", req.Version)
+		}
+		if len(fingerprint) == 0 || len(fingerprint) > len(req.Fingerprint) {
+			t.Fatalf("%d addresses from %d entries", len(fingerprint), len(req.Fingerprint))
+		}
+	})
+}
@@ -0,0 +1,50 @@
+package history
+
+import (
+	"song-recognition/models"
+	"sort"
+)
+
+// ChartEntry is a song and how many times it was recognized.
+type ChartEntry struct {
+	SongID  models.SongID `json:"songId"`
+	Matches int           `json:"matches"`
+}
+
+// Chart ranks the songs matched in the rollups, most recognized first. Only
+// recognitions by the clients include selects are counted, or all of them if
+// include is nil. Songs visible reports as hidden are left out, unless
+// visible is nil.
+func Chart(rollups []Rollup, include func(clientID string) bool, visible func(songID models.SongID) bool) []ChartEntry {
+	counts := make(map[models.SongID]int)
+	for _, rollup := range rollups {
+		if include == nil {
+			for songID, count := range rollup.PerSong {
+				counts[songID] += count
+			}
+			continue
+		}
+		for clientID, songs := range rollup.PerClient {
+			if !include(clientID) {
+				continue
+			}
+			for songID, count := range songs {
+				counts[songID] += count
+			}
+		}
+	}
+
+	chart := make([]ChartEntry, 0, len(counts))
+	for songID, count := range counts {
+		if visible == nil || visible(songID) {
+			chart = append(chart, ChartEntry{SongID: songID, Matches: count})
+		}
+	}
+	sort.Slice(chart, func(i, j int) bool {
+		if chart[i].Matches != chart[j].Matches {
+			return chart[i].Matches > chart[j].Matches
+		}
+		return chart[i].SongID < chart[j].SongID
+	})
+	return chart
+}
@@ -0,0 +1,269 @@
+// Package history records the outcome of recognitions so they can be
+// labelled, analysed and used to calibrate confidences.
+package history
+
+import (
+	"encoding/json"
+	"fmt"
+	"song-recognition/db"
+	"song-recognition/models"
+	"song-recognition/utils"
+	"strconv"
+	"time"
+)
+
+const (
+	collection         = "recognition_history"
+	evidenceCollection = "recognition_evidence"
+)
+
+// Recognition is the outcome of a recognition request.
+type Recognition struct {
+	ID          string        `json:"id"`
+	Source      string        `json:"source"` // api, audio, socket, cli or monitor
+	ClientID    string        `json:"clientId,omitempty"`
+	CreatedAt   time.Time     `json:"createdAt"`
+	SongID      models.SongID `json:"songId,omitempty"` // best match, if any
+	Score       float64       `json:"score"`
+	RunnerUp    float64       `json:"runnerUp"`
+	Confidence  float64       `json:"confidence"`
+	Candidates  int           `json:"candidates"`
+	CatalogSize int           `json:"catalogSize"`
+	QuerySize   int           `json:"querySize"` // addresses in the query
+	Recognized  bool          `json:"recognized"`
+	Scorer      string        `json:"scorer,omitempty"` // scoring strategy the matches were ranked with
+
+	// Monitored streams record the monitor, and the airing grouping the song
+	// with the same song recognised on other monitors at the same time.
+	// Simulcast is set when another monitor recognised it first, so that the
+	// airing is only counted once.
+	Monitor   string `json:"monitor,omitempty"`
+	AiringID  string `json:"airingId,omitempty"`
+	Simulcast bool   `json:"simulcast,omitempty"`
+
+	// Correct is set once a client or operator confirms or rejects the
+	// best match. CorrectSongID optionally names the song that was playing.
+	Correct       *bool         `json:"correct,omitempty"`
+	CorrectSongID models.SongID `json:"correctSongId,omitempty"`
+	LabelledAt    time.Time     `json:"labelledAt,omitempty"`
+}
+
+// Enabled reports whether recognitions are recorded (RECOGNITION_HISTORY,
+// default true).
+func Enabled() bool {
+	ok, _ := strconv.ParseBool(utils.GetEnv("RECOGNITION_HISTORY", "true"))
+	return ok
+}
+
+// Evidence is what a recognition was matched from, kept to explain it later.
+type Evidence struct {
+	Fingerprint map[uint32]uint32 `json:"fingerprint"` // address -> anchor time in the query, in ms
+}
+
+// EvidenceEnabled reports whether the fingerprints of recorded recognitions
+// are kept as evidence (RECOGNITION_EVIDENCE, default true).
+func EvidenceEnabled() bool {
+	ok, _ := strconv.ParseBool(utils.GetEnv("RECOGNITION_EVIDENCE", "true"))
+	return ok
+}
+
+// SaveEvidence stores the evidence of a saved recognition. It is deleted
+// along with the recognition.
+func SaveEvidence(recognition Recognition, evidence Evidence) error {
+	data, err := json.Marshal(evidence)
+	if err != nil {
+		return fmt.Errorf("failed to marshal evidence: %v", err)
+	}
+
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		return err
+	}
+	defer dbClient.Close()
+
+	return dbClient.PutRecord(evidenceCollection, db.Record{
+		ID:        recognition.ID,
+		ClientID:  recognition.ClientID,
+		CreatedAt: recognition.CreatedAt,
+		Data:      data,
+	})
+}
+
+// GetEvidence returns the evidence of a recognition, if it was kept.
+func GetEvidence(id string) (Evidence, bool, error) {
+	var evidence Evidence
+
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		return evidence, false, err
+	}
+	defer dbClient.Close()
+
+	record, exists, err := dbClient.GetRecord(evidenceCollection, id)
+	if err != nil || !exists {
+		return evidence, exists, err
+	}
+	if err := json.Unmarshal(record.Data, &evidence); err != nil {
+		return evidence, false, fmt.Errorf("failed to unmarshal evidence of %s: %v", id, err)
+	}
+	return evidence, true, nil
+}
+
+// Save stores a recognition, assigning it an ID and filling in the catalog
+// size if unset.
+func Save(recognition Recognition) (Recognition, error) {
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		return recognition, err
+	}
+	defer dbClient.Close()
+
+	if recognition.CreatedAt.IsZero() {
+		recognition.CreatedAt = time.Now().UTC()
+	}
+	if recognition.CatalogSize == 0 {
+		recognition.CatalogSize, _ = dbClient.TotalSongs()
+	}
+	recognition.ID = fmt.Sprintf("%s_%d", recognition.CreatedAt.Format("20060102T150405"), utils.GenerateUniqueID())
+
+	return recognition, put(dbClient, recognition)
+}
+
+func put(dbClient db.DBClient, recognition Recognition) error {
+	data, err := json.Marshal(recognition)
+	if err != nil {
+		return fmt.Errorf("failed to marshal recognition: %v", err)
+	}
+
+	return dbClient.PutRecord(collection, db.Record{
+		ID:        recognition.ID,
+		ClientID:  recognition.ClientID,
+		CreatedAt: recognition.CreatedAt,
+		Data:      data,
+	})
+}
+
+// Get returns a recorded recognition.
+func Get(id string) (Recognition, bool, error) {
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		return Recognition{}, false, err
+	}
+	defer dbClient.Close()
+
+	return get(dbClient, id)
+}
+
+func get(dbClient db.DBClient, id string) (Recognition, bool, error) {
+	var recognition Recognition
+
+	record, exists, err := dbClient.GetRecord(collection, id)
+	if err != nil || !exists {
+		return recognition, exists, err
+	}
+	if err := json.Unmarshal(record.Data, &recognition); err != nil {
+		return recognition, false, fmt.Errorf("failed to unmarshal recognition %s: %v", id, err)
+	}
+	return recognition, true, nil
+}
+
+// Label records whether the best match of a recognition was correct.
+func Label(id string, correct bool, correctSongID models.SongID) (Recognition, error) {
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		return Recognition{}, err
+	}
+	defer dbClient.Close()
+
+	recognition, exists, err := get(dbClient, id)
+	if err != nil {
+		return recognition, err
+	}
+	if !exists {
+		return recognition, fmt.Errorf("recognition %s not found", id)
+	}
+
+	recognition.Correct = &correct
+	recognition.CorrectSongID = correctSongID
+	recognition.LabelledAt = time.Now().UTC()
+	return recognition, put(dbClient, recognition)
+}
+
+// List returns the recognitions selected by the filter, oldest first.
+func List(filter db.RecordFilter) ([]Recognition, error) {
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		return nil, err
+	}
+	defer dbClient.Close()
+
+	records, err := dbClient.ListRecords(collection, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	recognitions := make([]Recognition, 0, len(records))
+	for _, record := range records {
+		var recognition Recognition
+		if err := json.Unmarshal(record.Data, &recognition); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal recognition %s: %v", record.ID, err)
+		}
+		recognitions = append(recognitions, recognition)
+	}
+	return recognitions, nil
+}
+
+// RetentionPeriod returns how long recognitions are kept
+// (HISTORY_RETENTION_DAYS), or 0 if they are kept forever.
+func RetentionPeriod() time.Duration {
+	days, err := strconv.Atoi(utils.GetEnv("HISTORY_RETENTION_DAYS", "0"))
+	if err != nil || days <= 0 {
+		return 0
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// deleteRecords deletes the recognitions selected by the filter, and their
+// evidence, and returns how many were deleted.
+func deleteRecords(filter db.RecordFilter) (int, error) {
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		return 0, err
+	}
+	defer dbClient.Close()
+
+	evidence, err := dbClient.ListRecords(evidenceCollection, filter)
+	if err != nil {
+		return 0, err
+	}
+	for _, record := range evidence {
+		if err := dbClient.DeleteRecord(evidenceCollection, record.ID); err != nil {
+			return 0, fmt.Errorf("failed to delete evidence of %s: %v", record.ID, err)
+		}
+	}
+
+	records, err := dbClient.ListRecords(collection, filter)
+	if err != nil {
+		return 0, err
+	}
+
+	for i, record := range records {
+		if err := dbClient.DeleteRecord(collection, record.ID); err != nil {
+			return i, fmt.Errorf("failed to delete recognition %s: %v", record.ID, err)
+		}
+	}
+	return len(records), nil
+}
+
+// DeleteClientHistory deletes every recognition made by an API client.
+func DeleteClientHistory(clientID string) (int, error) {
+	if clientID == "" {
+		return 0, fmt.Errorf("client ID is required")
+	}
+	return deleteRecords(db.RecordFilter{ClientID: clientID})
+}
+
+// Purge deletes the recognitions made before a time, labelled or not.
+func Purge(before time.Time) (int, error) {
+	return deleteRecords(db.RecordFilter{Until: before})
+}
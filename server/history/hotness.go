@@ -0,0 +1,104 @@
+package history
+
+import (
+	"encoding/json"
+	"fmt"
+	"song-recognition/db"
+	"song-recognition/models"
+	"song-recognition/utils"
+	"strconv"
+	"time"
+)
+
+const (
+	hotnessCollection = "song_hotness"
+	hotnessID         = "latest"
+)
+
+// Hotness is how many times each song was recognized over a recent window,
+// with the size of the catalog they were counted against. Matching weighs
+// addresses by rarity relative to that catalog size.
+type Hotness struct {
+	Since       time.Time             `json:"since"`
+	Refreshed   time.Time             `json:"refreshed"`
+	Counts      map[models.SongID]int `json:"counts"`
+	CatalogSize int                   `json:"catalogSize"`
+}
+
+// HotnessWindow returns the period hotness is counted over, from
+// HOTNESS_WINDOW_DAYS (default 7).
+func HotnessWindow() time.Duration {
+	days, err := strconv.Atoi(utils.GetEnv("HOTNESS_WINDOW_DAYS", "7"))
+	if err != nil || days <= 0 {
+		days = 7
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// RefreshHotness counts the recognitions of each song over the hotness window,
+// airings simulcast on several monitored streams once, and stores the counts.
+func RefreshHotness() (Hotness, error) {
+	now := time.Now().UTC()
+	hotness := Hotness{
+		Since:     now.Add(-HotnessWindow()),
+		Refreshed: now,
+		Counts:    make(map[models.SongID]int),
+	}
+
+	recognitions, err := List(db.RecordFilter{Since: hotness.Since})
+	if err != nil {
+		return hotness, err
+	}
+	for _, recognition := range recognitions {
+		if recognition.Recognized && recognition.SongID != 0 && !recognition.Simulcast {
+			hotness.Counts[recognition.SongID]++
+		}
+	}
+
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		return hotness, err
+	}
+	defer dbClient.Close()
+
+	hotness.CatalogSize, err = dbClient.TotalSongs()
+	if err != nil {
+		return hotness, err
+	}
+
+	data, err := json.Marshal(hotness)
+	if err != nil {
+		return hotness, fmt.Errorf("failed to marshal hotness: %v", err)
+	}
+
+	return hotness, dbClient.PutRecord(hotnessCollection, db.Record{
+		ID:        hotnessID,
+		CreatedAt: now,
+		Data:      data,
+	})
+}
+
+// GetHotness returns the counts stored by the last refresh.
+func GetHotness() (Hotness, bool, error) {
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		return Hotness{}, false, err
+	}
+	defer dbClient.Close()
+
+	return ReadHotness(dbClient)
+}
+
+// ReadHotness is GetHotness with an open client.
+func ReadHotness(dbClient db.DBClient) (Hotness, bool, error) {
+	var hotness Hotness
+
+	record, exists, err := dbClient.GetRecord(hotnessCollection, hotnessID)
+	if err != nil || !exists {
+		return hotness, exists, err
+	}
+	if err := json.Unmarshal(record.Data, &hotness); err != nil {
+		return hotness, false, fmt.Errorf("failed to unmarshal hotness: %v", err)
+	}
+	return hotness, true, nil
+}
@@ -0,0 +1,220 @@
+package history
+
+import (
+	"encoding/json"
+	"fmt"
+	"song-recognition/db"
+	"song-recognition/models"
+	"time"
+)
+
+const (
+	rollupsCollection = "recognition_rollups"
+	dayLayout         = "2006-01-02"
+)
+
+// Rollup aggregates the recognitions of a day (UTC), so statistics can be
+// served without scanning the raw history. Rollups are kept when the history
+// they were computed from expires.
+type Rollup struct {
+	Day           string                `json:"day"`
+	Recognitions  int                   `json:"recognitions"`
+	Matches       int                   `json:"matches"`
+	NoMatchRate   float64               `json:"noMatchRate"`
+	AvgConfidence float64               `json:"avgConfidence"` // over matches
+	PerSong       map[models.SongID]int `json:"perSong"`       // matches per song
+	PerHour       [24]int               `json:"perHour"`       // recognitions per hour of the day
+
+	// PerClient splits the matches per song by the API client that made the
+	// recognitions; unsigned ones are under "".
+	PerClient map[string]map[models.SongID]int `json:"perClient,omitempty"`
+
+	// Simulcasts counts the songs recognised on monitored streams that
+	// another monitor had recognised at the same time, which are left out of
+	// every other count.
+	Simulcasts int `json:"simulcasts,omitempty"`
+
+	ConfidenceSum float64   `json:"confidenceSum"`
+	Refreshed     time.Time `json:"refreshed"`
+}
+
+// add counts a recognition in the rollup.
+func (r *Rollup) add(recognition Recognition) {
+	if recognition.Simulcast {
+		r.Simulcasts++
+		return
+	}
+	r.Recognitions++
+	r.PerHour[recognition.CreatedAt.UTC().Hour()]++
+	if recognition.Recognized {
+		r.Matches++
+		r.ConfidenceSum += recognition.Confidence
+		if recognition.SongID != 0 {
+			r.PerSong[recognition.SongID]++
+			r.addClientMatches(recognition.ClientID, recognition.SongID, 1)
+		}
+	}
+}
+
+func (r *Rollup) addClientMatches(clientID string, songID models.SongID, count int) {
+	if r.PerClient == nil {
+		r.PerClient = make(map[string]map[models.SongID]int)
+	}
+	if r.PerClient[clientID] == nil {
+		r.PerClient[clientID] = make(map[models.SongID]int)
+	}
+	r.PerClient[clientID][songID] += count
+}
+
+// merge adds the counts of another rollup to r.
+func (r *Rollup) merge(other Rollup) {
+	r.Recognitions += other.Recognitions
+	r.Matches += other.Matches
+	r.ConfidenceSum += other.ConfidenceSum
+	r.Simulcasts += other.Simulcasts
+	for songID, count := range other.PerSong {
+		r.PerSong[songID] += count
+	}
+	for hour, count := range other.PerHour {
+		r.PerHour[hour] += count
+	}
+	for clientID, songs := range other.PerClient {
+		for songID, count := range songs {
+			r.addClientMatches(clientID, songID, count)
+		}
+	}
+}
+
+// finish derives the rates and averages from the counts.
+func (r *Rollup) finish() {
+	r.NoMatchRate, r.AvgConfidence = 0, 0
+	if r.Recognitions > 0 {
+		r.NoMatchRate = float64(r.Recognitions-r.Matches) / float64(r.Recognitions)
+	}
+	if r.Matches > 0 {
+		r.AvgConfidence = r.ConfidenceSum / float64(r.Matches)
+	}
+}
+
+func dayStart(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// aggregateDay computes the rollup of the day starting at start.
+func aggregateDay(start time.Time) (Rollup, error) {
+	rollup := Rollup{
+		Day:       start.Format(dayLayout),
+		PerSong:   make(map[models.SongID]int),
+		Refreshed: time.Now().UTC(),
+	}
+
+	recognitions, err := List(db.RecordFilter{Since: start, Until: start.AddDate(0, 0, 1)})
+	if err != nil {
+		return rollup, err
+	}
+	for _, recognition := range recognitions {
+		rollup.add(recognition)
+	}
+	rollup.finish()
+	return rollup, nil
+}
+
+// RefreshRollups aggregates the days not rolled up yet, up to today, and
+// returns how many days were aggregated. The last rolled up day is
+// aggregated again, as it may have been incomplete.
+func RefreshRollups() (int, error) {
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		return 0, err
+	}
+	defer dbClient.Close()
+
+	var from time.Time
+	rollups, err := dbClient.ListRecords(rollupsCollection, db.RecordFilter{})
+	if err != nil {
+		return 0, err
+	}
+	if len(rollups) > 0 {
+		from = rollups[len(rollups)-1].CreatedAt
+	} else {
+		oldest, err := List(db.RecordFilter{Limit: 1})
+		if err != nil {
+			return 0, err
+		}
+		if len(oldest) == 0 {
+			return 0, nil
+		}
+		from = oldest[0].CreatedAt
+	}
+
+	today := dayStart(time.Now())
+	days := 0
+	for day := dayStart(from); !day.After(today); day = day.AddDate(0, 0, 1) {
+		rollup, err := aggregateDay(day)
+		if err != nil {
+			return days, fmt.Errorf("failed to aggregate %s: %v", day.Format(dayLayout), err)
+		}
+
+		data, err := json.Marshal(rollup)
+		if err != nil {
+			return days, fmt.Errorf("failed to marshal rollup: %v", err)
+		}
+		err = dbClient.PutRecord(rollupsCollection, db.Record{
+			ID:        rollup.Day,
+			CreatedAt: day,
+			Data:      data,
+		})
+		if err != nil {
+			return days, err
+		}
+		days++
+	}
+	return days, nil
+}
+
+// Rollups returns the daily rollups of the days from since until before
+// until, oldest first. Zero times leave the range open.
+func Rollups(since, until time.Time) ([]Rollup, error) {
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		return nil, err
+	}
+	defer dbClient.Close()
+
+	filter := db.RecordFilter{Until: until}
+	if !since.IsZero() {
+		filter.Since = dayStart(since)
+	}
+	records, err := dbClient.ListRecords(rollupsCollection, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	rollups := make([]Rollup, 0, len(records))
+	for _, record := range records {
+		var rollup Rollup
+		if err := json.Unmarshal(record.Data, &rollup); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal rollup %s: %v", record.ID, err)
+		}
+		rollups = append(rollups, rollup)
+	}
+	return rollups, nil
+}
+
+// Total sums daily rollups into one covering all their days, whose Day is
+// the first of them.
+func Total(rollups []Rollup) Rollup {
+	total := Rollup{PerSong: make(map[models.SongID]int)}
+	for _, rollup := range rollups {
+		if total.Day == "" {
+			total.Day = rollup.Day
+		}
+		total.merge(rollup)
+		if rollup.Refreshed.After(total.Refreshed) {
+			total.Refreshed = rollup.Refreshed
+		}
+	}
+	total.finish()
+	return total
+}
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"song-recognition/acl"
+	"song-recognition/archive"
+	"song-recognition/auth"
+	"song-recognition/calibration"
+	"song-recognition/db"
+	"song-recognition/history"
+	"song-recognition/models"
+	"song-recognition/shazam"
+	"song-recognition/utils"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mdobak/go-xerrors"
+)
+
+// recordRecognition stores the outcome of a recognition in the history, with
+// the fingerprint it was matched from as evidence when not nil, and returns
+// its ID, or "" when history is disabled or couldn't be written.
+func recordRecognition(ctx context.Context, source string, matches []shazam.Match, recognized bool, querySize int, fingerprint map[uint32]uint32) string {
+	return saveRecognition(ctx, newRecognition(ctx, source, matches, recognized, querySize), fingerprint)
+}
+
+// recordsEvidence reports whether recordRecognition keeps fingerprints, for
+// callers that have to compute them.
+func recordsEvidence() bool {
+	return history.Enabled() && history.EvidenceEnabled()
+}
+
+// newRecognition describes the outcome of a recognition for the history.
+func newRecognition(ctx context.Context, source string, matches []shazam.Match, recognized bool, querySize int) history.Recognition {
+	recognition := history.Recognition{
+		Source:     source,
+		Candidates: len(matches),
+		QuerySize:  querySize,
+		Recognized: recognized,
+		Scorer:     shazam.CurrentScorer().Name(),
+	}
+	if client, ok := auth.ClientFromContext(ctx); ok {
+		recognition.ClientID = client.ID
+	}
+	if len(matches) > 0 {
+		recognition.SongID = matches[0].SongID
+		recognition.Score = matches[0].Score
+		recognition.Confidence = matches[0].Confidence
+	}
+	if len(matches) > 1 {
+		recognition.RunnerUp = matches[1].Score
+	}
+	return recognition
+}
+
+// saveRecognition stores a recognition in the history, and its evidence if
+// fingerprint isn't nil, and returns its ID, or "" when history is disabled
+// or couldn't be written.
+func saveRecognition(ctx context.Context, recognition history.Recognition, fingerprint map[uint32]uint32) string {
+	if !history.Enabled() {
+		return ""
+	}
+	logger := utils.GetLogger()
+
+	recognition, err := history.Save(recognition)
+	if err != nil {
+		err := xerrors.New(err)
+		logger.ErrorContext(ctx, "failed to record recognition.", slog.Any("error", err))
+		return ""
+	}
+	if fingerprint != nil && history.EvidenceEnabled() {
+		if err := history.SaveEvidence(recognition, history.Evidence{Fingerprint: fingerprint}); err != nil {
+			err := xerrors.New(err)
+			logger.ErrorContext(ctx, "failed to record recognition evidence.", slog.Any("error", err))
+		}
+	}
+	return recognition.ID
+}
+
+// handleLabelRecognition records whether the best match of a recognition was
+// correct. Signed clients can only label their own recognitions.
+func handleLabelRecognition(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Correct       *bool         `json:"correct"`
+		CorrectSongID models.SongID `json:"correctSongId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Correct == nil {
+		writeError(w, http.StatusBadRequest, `body must be {"correct": true|false}`)
+		return
+	}
+
+	id := r.PathValue("id")
+	recognition, exists, err := history.Get(id)
+	if err != nil {
+		handleAdminError(w, r, "failed to get recognition", err)
+		return
+	}
+	client, _ := auth.ClientFromContext(r.Context())
+	if !exists || (recognition.ClientID != "" && recognition.ClientID != client.ID) {
+		writeError(w, http.StatusNotFound, "recognition not found")
+		return
+	}
+
+	recognition, err = history.Label(id, *req.Correct, req.CorrectSongID)
+	if err != nil {
+		handleAdminError(w, r, "failed to label recognition", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, recognition)
+}
+
+// handleExplainRecognition responds with the evidence for the best match of
+// a recognition, or the song named by the songId query parameter, from the
+// fingerprint kept with it: how the offsets of the couples they share are
+// spread, which pairs line up and over which stretches. With format=text it
+// is rendered for reading rather than as JSON.
+func handleExplainRecognition(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	recognition, exists, err := history.Get(id)
+	if err != nil {
+		handleAdminError(w, r, "failed to get recognition", err)
+		return
+	}
+	client, _ := auth.ClientFromContext(r.Context())
+	if !exists || (recognition.ClientID != "" && recognition.ClientID != client.ID) {
+		writeError(w, http.StatusNotFound, "recognition not found")
+		return
+	}
+
+	songID := recognition.SongID
+	if raw := r.URL.Query().Get("songId"); raw != "" {
+		parsed, err := models.ParseSongID(raw)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "songId must be a song ID")
+			return
+		}
+		songID = parsed
+	}
+	if songID == 0 {
+		writeError(w, http.StatusNotFound, "recognition has no match to explain; name one with songId")
+		return
+	}
+	if visible := acl.Filter(client); visible != nil && !visible(songID) {
+		writeError(w, http.StatusNotFound, "song not found")
+		return
+	}
+
+	evidence, exists, err := history.GetEvidence(id)
+	if err != nil {
+		handleAdminError(w, r, "failed to get recognition evidence", err)
+		return
+	}
+	if !exists {
+		writeError(w, http.StatusNotFound, "no evidence kept for this recognition")
+		return
+	}
+
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		handleAdminError(w, r, "failed to connect to database", err)
+		return
+	}
+	defer dbClient.Close()
+	dbClient = db.WithContext(r.Context(), dbClient)
+
+	song, exists, err := dbClient.GetSongByID(songID)
+	if err != nil {
+		handleAdminError(w, r, "failed to get song", err)
+		return
+	}
+	if !exists {
+		writeError(w, http.StatusNotFound, "song not found")
+		return
+	}
+	explanation, err := shazam.Explain(dbClient, evidence.Fingerprint, songID)
+	if err != nil {
+		handleAdminError(w, r, "failed to explain recognition", err)
+		return
+	}
+
+	if r.URL.Query().Get("format") == "text" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		writeExplanation(w, recognition, song, explanation)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"recognition": recognition,
+		"song":        map[string]interface{}{"id": songID, "title": song.Title, "artist": song.Artist},
+		"explanation": explanation,
+	})
+}
+
+// Limits of what writeExplanation lists.
+const (
+	explainedBins  = 15
+	explainedPairs = 20
+	explainedBar   = 40
+)
+
+// writeExplanation renders an explanation for reading: the fullest offset
+// bins as bars, the overlap regions and the first aligned pairs.
+func writeExplanation(w io.Writer, recognition history.Recognition, song db.Song, explanation shazam.Explanation) {
+	fmt.Fprintf(w, "Recognition %s (%s, %s)\n", recognition.ID, recognition.Source, recognition.CreatedAt.Format(time.RFC3339))
+	fmt.Fprintf(w, "Song %d: %s - %s\n", explanation.SongID, song.Artist, song.Title)
+	fmt.Fprintf(w, "%d query addresses, %d hits", explanation.QuerySize, explanation.Hits)
+	if explanation.Excluded > 0 {
+		fmt.Fprintf(w, " (%d more excluded)", explanation.Excluded)
+	}
+	fmt.Fprintf(w, ", %d aligned at %+dms, score %.2f\n", explanation.Aligned, explanation.AlignedOffsetMs, explanation.Score)
+	if explanation.Hits == 0 {
+		return
+	}
+
+	bins := append([]shazam.OffsetBin(nil), explanation.Histogram...)
+	sort.SliceStable(bins, func(i, j int) bool { return bins[i].Hits > bins[j].Hits })
+	bins = bins[:min(len(bins), explainedBins)]
+	sort.Slice(bins, func(i, j int) bool { return bins[i].OffsetMs < bins[j].OffsetMs })
+	peak := 0
+	for _, bin := range bins {
+		peak = max(peak, bin.Hits)
+	}
+	fmt.Fprintf(w, "\nOffset histogram (%d of %d bins)\n", len(bins), len(explanation.Histogram))
+	for _, bin := range bins {
+		bar := strings.Repeat("#", max(1, bin.Hits*explainedBar/peak))
+		fmt.Fprintf(w, "%+8dms %5d %s\n", bin.OffsetMs, bin.Hits, bar)
+	}
+
+	fmt.Fprintf(w, "\nOverlap regions\n")
+	for _, region := range explanation.Regions {
+		fmt.Fprintf(w, "query %s-%s  song %s-%s  %d pairs\n",
+			formatMs(region.QueryStartMs), formatMs(region.QueryEndMs),
+			formatMs(region.SongStartMs), formatMs(region.SongEndMs), region.Pairs)
+	}
+
+	fmt.Fprintf(w, "\nAligned pairs (%d of %d)\n", min(len(explanation.Pairs), explainedPairs), len(explanation.Pairs))
+	for _, pair := range explanation.Pairs[:min(len(explanation.Pairs), explainedPairs)] {
+		fmt.Fprintf(w, "address %08x  query %s  song %s  rarity %.2f  magnitude %.2f\n",
+			pair.Address, formatMs(pair.QueryMs), formatMs(pair.SongMs), pair.Rarity, pair.Magnitude)
+	}
+}
+
+// formatMs formats a time in a recording as minutes, seconds and
+// milliseconds.
+func formatMs(ms uint32) string {
+	return fmt.Sprintf("%d:%02d.%03d", ms/60000, ms/1000%60, ms%1000)
+}
+
+func handleFitCalibration(w http.ResponseWriter, r *http.Request) {
+	model, err := calibration.Refit()
+	if err != nil {
+		handleAdminError(w, r, "failed to fit calibration", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, model)
+}
+
+// handleDeleteClientHistory deletes the recognitions and archived clips of an
+// API client, e.g. when it asks for its data to be erased.
+func handleDeleteClientHistory(w http.ResponseWriter, r *http.Request) {
+	clientID := r.PathValue("id")
+
+	recognitions, err := history.DeleteClientHistory(clientID)
+	if err != nil {
+		handleAdminError(w, r, "failed to delete recognition history", err)
+		return
+	}
+	clips, err := archive.RemoveClient(clientID)
+	if err != nil {
+		handleAdminError(w, r, "failed to delete archived clips", err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"clientId": clientID, "recognitions": recognitions, "clips": clips})
+}
+
+// dayRange returns the range of days selected by the from and to query
+// parameters (YYYY-MM-DD, inclusive, default the last 30 days), as the start
+// of the first day and the end of the last one.
+func dayRange(r *http.Request) (time.Time, time.Time, error) {
+	to := time.Now().UTC()
+	if value := r.URL.Query().Get("to"); value != "" {
+		day, err := time.Parse("2006-01-02", value)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("to must be a day like 2006-01-02")
+		}
+		to = day
+	}
+	from := to.AddDate(0, 0, -29)
+	if value := r.URL.Query().Get("from"); value != "" {
+		day, err := time.Parse("2006-01-02", value)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("from must be a day like 2006-01-02")
+		}
+		from = day
+	}
+
+	from = time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, time.UTC)
+	until := time.Date(to.Year(), to.Month(), to.Day()+1, 0, 0, 0, 0, time.UTC)
+	if !from.Before(until) {
+		return time.Time{}, time.Time{}, fmt.Errorf("from must not be after to")
+	}
+	return from, until, nil
+}
+
+// handleStats serves the daily rollups of recognitions in a range of days
+// with their total.
+func handleStats(w http.ResponseWriter, r *http.Request) {
+	from, until, err := dayRange(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	rollups, err := history.Rollups(from, until)
+	if err != nil {
+		handleAdminError(w, r, "failed to read statistics", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"days": rollups, "total": history.Total(rollups)})
+}
+
+// chartEntry is a ranked song of a chart.
+type chartEntry struct {
+	Rank      int           `json:"rank"`
+	SongID    models.SongID `json:"songId"`
+	Title     string        `json:"title"`
+	Artist    string        `json:"artist"`
+	YouTubeID string        `json:"youtubeId,omitempty"`
+	Matches   int           `json:"matches"`
+}
+
+// handleCharts serves the most recognized songs in a range of days, computed
+// from the daily rollups. With "tenant", only recognitions by clients of that
+// tenant (or by the client with that ID) are counted; signed clients may
+// only ask for their own. Songs the caller can't see are left out.
+func handleCharts(w http.ResponseWriter, r *http.Request) {
+	from, until, err := dayRange(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	limit := 20
+	if value := r.URL.Query().Get("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > 100 {
+			writeError(w, http.StatusBadRequest, "limit must be between 1 and 100")
+			return
+		}
+	}
+
+	client, signed := auth.ClientFromContext(r.Context())
+	var include func(clientID string) bool
+	if tenant := r.URL.Query().Get("tenant"); tenant != "" {
+		if signed && tenant != client.ID && tenant != client.Tenant {
+			writeError(w, http.StatusForbidden, "clients may only chart their own tenant")
+			return
+		}
+		clients := auth.LoadClients()
+		include = func(clientID string) bool {
+			return clientID == tenant || (clients[clientID].Tenant != "" && clients[clientID].Tenant == tenant)
+		}
+	}
+
+	rollups, err := history.Rollups(from, until)
+	if err != nil {
+		handleAdminError(w, r, "failed to read statistics", err)
+		return
+	}
+	chart := history.Chart(rollups, include, acl.Filter(client))
+	if len(chart) > limit {
+		chart = chart[:limit]
+	}
+
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		handleAdminError(w, r, "error connecting to DB", err)
+		return
+	}
+	defer dbClient.Close()
+
+	songs := make([]chartEntry, 0, len(chart))
+	for _, entry := range chart {
+		song, exists, err := dbClient.GetSongByID(entry.SongID)
+		if err != nil {
+			handleAdminError(w, r, "failed to get song", err)
+			return
+		}
+		if !exists {
+			continue
+		}
+		songs = append(songs, chartEntry{
+			Rank:      len(songs) + 1,
+			SongID:    entry.SongID,
+			Title:     song.Title,
+			Artist:    song.Artist,
+			YouTubeID: song.YouTubeID,
+			Matches:   entry.Matches,
+		})
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"from":  from.Format("2006-01-02"),
+		"to":    until.AddDate(0, 0, -1).Format("2006-01-02"),
+		"songs": songs,
+	})
+}
+
+// purgeExpired deletes the recognitions and archived clips older than their
+// retention periods, and returns how many of each were deleted.
+func purgeExpired() (recognitions, clips int, err error) {
+	if period := history.RetentionPeriod(); period > 0 {
+		recognitions, err = history.Purge(time.Now().Add(-period))
+		if err != nil {
+			return recognitions, clips, fmt.Errorf("failed to purge recognition history: %v", err)
+		}
+	}
+	if period := archive.RetentionPeriod(); period > 0 {
+		clips, err = archive.Purge(time.Now().Add(-period))
+		if err != nil {
+			return recognitions, clips, fmt.Errorf("failed to purge archived clips: %v", err)
+		}
+	}
+	return recognitions, clips, nil
+}
+
+// startRetention purges expired data now and then every hour, if a
+// retention period is configured.
+func startRetention() {
+	if history.RetentionPeriod() == 0 && archive.RetentionPeriod() == 0 {
+		return
+	}
+
+	go func() {
+		logger := utils.GetLogger()
+		for {
+			recognitions, clips, err := purgeExpired()
+			if err != nil {
+				err := xerrors.New(err)
+				logger.ErrorContext(context.Background(), "failed to purge expired data.", slog.Any("error", err))
+			} else if recognitions > 0 || clips > 0 {
+				logger.Info(fmt.Sprintf("purged %d expired recognitions and %d archived clips", recognitions, clips))
+			}
+			time.Sleep(time.Hour)
+		}
+	}()
+}
+
+func handlePurgeExpired(w http.ResponseWriter, r *http.Request) {
+	recognitions, clips, err := purgeExpired()
+	if err != nil {
+		handleAdminError(w, r, "failed to purge expired data", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"recognitions": recognitions, "clips": clips})
+}
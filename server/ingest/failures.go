@@ -0,0 +1,116 @@
+package ingest
+
+import (
+	"encoding/json"
+	"fmt"
+	"song-recognition/db"
+	"time"
+)
+
+const failuresCollection = "ingestion_failures"
+
+// Kinds of ingestion failures
+const (
+	KindFile  = "file"  // a local file given to `save`
+	KindTrack = "track" // a Spotify track that failed to download or process
+	KindFeed  = "feed"  // a track of a feed, whose source is its audio URL
+)
+
+// Failure is a song that failed to be ingested and can be retried.
+type Failure struct {
+	ID          string    `json:"id"`
+	Kind        string    `json:"kind"`
+	Source      string    `json:"source"`
+	Title       string    `json:"title,omitempty"`
+	Artist      string    `json:"artist,omitempty"`
+	Album       string    `json:"album,omitempty"`
+	ISRC        string    `json:"isrc,omitempty"`
+	CoverArtURL string    `json:"coverArtUrl,omitempty"`
+	Duration    int       `json:"duration,omitempty"`
+	Force       bool      `json:"force,omitempty"`
+	Error       string    `json:"error"`
+	Attempts    int       `json:"attempts"`
+	FirstFailed time.Time `json:"firstFailed"`
+	LastFailed  time.Time `json:"lastFailed"`
+}
+
+// FailureID returns the ID under which failures of a source are recorded, so
+// repeated failures of the same song update a single entry.
+func FailureID(kind, source string) string {
+	return kind + ":" + source
+}
+
+// RecordFailure stores a failed ingestion, incrementing the attempt counter
+// if the source already failed before.
+func RecordFailure(failure Failure) error {
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		return err
+	}
+	defer dbClient.Close()
+
+	now := time.Now().UTC()
+	failure.ID = FailureID(failure.Kind, failure.Source)
+	failure.Attempts = 1
+	failure.FirstFailed = now
+	failure.LastFailed = now
+
+	record, exists, err := dbClient.GetRecord(failuresCollection, failure.ID)
+	if err != nil {
+		return err
+	}
+	if exists {
+		var previous Failure
+		if err := json.Unmarshal(record.Data, &previous); err == nil {
+			failure.Attempts = previous.Attempts + 1
+			failure.FirstFailed = previous.FirstFailed
+		}
+	}
+
+	data, err := json.Marshal(failure)
+	if err != nil {
+		return fmt.Errorf("failed to marshal failure: %v", err)
+	}
+
+	return dbClient.PutRecord(failuresCollection, db.Record{
+		ID:        failure.ID,
+		CreatedAt: failure.FirstFailed,
+		Data:      data,
+	})
+}
+
+// ListFailures returns all recorded ingestion failures, oldest first.
+func ListFailures() ([]Failure, error) {
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		return nil, err
+	}
+	defer dbClient.Close()
+
+	records, err := dbClient.ListRecords(failuresCollection, db.RecordFilter{})
+	if err != nil {
+		return nil, err
+	}
+
+	failures := make([]Failure, 0, len(records))
+	for _, record := range records {
+		var failure Failure
+		if err := json.Unmarshal(record.Data, &failure); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal failure %s: %v", record.ID, err)
+		}
+		failures = append(failures, failure)
+	}
+
+	return failures, nil
+}
+
+// ResolveFailure removes a failure once its source was ingested successfully.
+func ResolveFailure(id string) error {
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		return err
+	}
+	defer dbClient.Close()
+
+	return dbClient.DeleteRecord(failuresCollection, id)
+}
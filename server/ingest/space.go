@@ -0,0 +1,228 @@
+package ingest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"path/filepath"
+	"song-recognition/utils"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// TmpDir is the folder downloads and conversions are staged in.
+const TmpDir = "tmp"
+
+const mb = 1 << 20
+
+// ErrLowSpace is matched by the errors of ingestion jobs that didn't start
+// for lack of disk space.
+var ErrLowSpace = errors.New("not enough disk space")
+
+// SpaceError tells which folder is short of space.
+type SpaceError struct {
+	Path     string
+	Free     int64 // bytes available on the volume of Path
+	Required int64
+	// Set when the tmp folder went over its quota rather than the volume
+	// filling up
+	Quota int64
+	Used  int64
+}
+
+func (e *SpaceError) Error() string {
+	if e.Quota > 0 {
+		return fmt.Sprintf("%s uses %d MB, over its quota of %d MB", e.Path, e.Used/mb, e.Quota/mb)
+	}
+	return fmt.Sprintf("only %d MB free for %s, ingestion needs %d MB", e.Free/mb, e.Path, e.Required/mb)
+}
+
+func (e *SpaceError) Is(target error) bool {
+	return target == ErrLowSpace
+}
+
+// MaxPause returns how long ingestion waits for an unavailable database or
+// for disk space to be freed before giving up on a song, from
+// INGEST_MAX_PAUSE (default 1h, 0 waits forever).
+func MaxPause() time.Duration {
+	pause, err := time.ParseDuration(utils.GetEnv("INGEST_MAX_PAUSE", "1h"))
+	if err != nil || pause < 0 {
+		return time.Hour
+	}
+	return pause
+}
+
+// minFree returns the space that must be left on the volumes ingestion writes
+// to, from INGEST_MIN_FREE_MB (default 500).
+func minFree() int64 {
+	free, err := strconv.ParseInt(utils.GetEnv("INGEST_MIN_FREE_MB", "500"), 10, 64)
+	if err != nil || free < 0 {
+		return 500 * mb
+	}
+	return free * mb
+}
+
+// tmpQuota returns how much the tmp folder may hold, from TMP_QUOTA_MB
+// (default 0, no quota).
+func tmpQuota() int64 {
+	quota, err := strconv.ParseInt(utils.GetEnv("TMP_QUOTA_MB", "0"), 10, 64)
+	if err != nil || quota < 0 {
+		return 0
+	}
+	return quota * mb
+}
+
+// CheckSpace returns a *SpaceError if the volume of one of dirs, or of the
+// tmp folder, is short of INGEST_MIN_FREE_MB, or the tmp folder is over
+// TMP_QUOTA_MB. Folders whose free space can't be read are assumed to have
+// enough.
+func CheckSpace(dirs ...string) error {
+	required := minFree()
+	for _, dir := range append(dirs, TmpDir) {
+		free, err := freeSpace(dir)
+		if err == nil && free < required {
+			return &SpaceError{Path: dir, Free: free, Required: required}
+		}
+	}
+
+	if quota := tmpQuota(); quota > 0 {
+		if used := dirSize(TmpDir); used >= quota {
+			return &SpaceError{Path: TmpDir, Used: used, Quota: quota}
+		}
+	}
+	return nil
+}
+
+// dirSize returns the size of the files under dir.
+func dirSize(dir string) int64 {
+	var size int64
+	filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info, err := entry.Info(); err == nil && entry.Type().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// pause is the state of ingestion while it waits for space.
+var pause struct {
+	sync.Mutex
+	err     error
+	since   time.Time
+	waiting int
+}
+
+// WaitForSpace returns once dirs and the tmp folder have enough space, see
+// CheckSpace. Until then ingestion is paused: jobs wait, rechecking with a
+// backoff from five seconds up to a minute, and SpaceStatus reports why. It
+// gives up with the *SpaceError after maxWait, unless maxWait is 0, or when
+// ctx is done.
+func WaitForSpace(ctx context.Context, maxWait time.Duration, dirs ...string) error {
+	err := CheckSpace(dirs...)
+	if err == nil {
+		return nil
+	}
+
+	logger := utils.GetLogger()
+	pause.Lock()
+	if pause.err == nil {
+		pause.since = time.Now().UTC()
+		logger.Warn("Low disk space, pausing ingestion", slog.Any("error", err))
+	}
+	pause.err = err
+	pause.waiting++
+	pause.Unlock()
+
+	defer func() {
+		pause.Lock()
+		defer pause.Unlock()
+		pause.waiting--
+		if err == nil && pause.err != nil {
+			logger.Info("Disk space available again, resuming ingestion")
+		}
+		if err == nil || pause.waiting == 0 {
+			// The jobs that gave up were recorded as failures
+			pause.err = nil
+		}
+	}()
+
+	start := time.Now()
+	delay := 5 * time.Second
+	for {
+		if maxWait > 0 && time.Since(start)+delay > maxWait {
+			return fmt.Errorf("%w (still short of space after %v)", err, maxWait)
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w (%v)", err, ctx.Err())
+		case <-time.After(delay):
+		}
+		delay = min(2*delay, time.Minute)
+
+		if err = CheckSpace(dirs...); err == nil {
+			return nil
+		}
+		pause.Lock()
+		pause.err = err
+		pause.Unlock()
+	}
+}
+
+// Volume is the space left for a folder ingestion writes to.
+type Volume struct {
+	Path   string `json:"path"`
+	FreeMB int64  `json:"freeMB"`
+}
+
+// SpaceStatus tells whether ingestion is paused for lack of disk space.
+type SpaceStatus struct {
+	Paused     bool      `json:"paused"`
+	Reason     string    `json:"reason,omitempty"`
+	Since      time.Time `json:"since,omitempty"`
+	Waiting    int       `json:"waiting"` // jobs waiting for space
+	MinFreeMB  int64     `json:"minFreeMB"`
+	TmpQuotaMB int64     `json:"tmpQuotaMB,omitempty"`
+	TmpUsedMB  int64     `json:"tmpUsedMB"`
+	Volumes    []Volume  `json:"volumes"`
+	CheckedAt  time.Time `json:"checkedAt"`
+}
+
+// Status checks the space left for dirs and the tmp folder now, and returns
+// it along with the jobs waiting for space.
+func Status(dirs ...string) SpaceStatus {
+	status := SpaceStatus{
+		MinFreeMB:  minFree() / mb,
+		TmpQuotaMB: tmpQuota() / mb,
+		TmpUsedMB:  dirSize(TmpDir) / mb,
+		Volumes:    []Volume{},
+		CheckedAt:  time.Now().UTC(),
+	}
+	for _, dir := range append(dirs, TmpDir) {
+		if free, err := freeSpace(dir); err == nil {
+			status.Volumes = append(status.Volumes, Volume{Path: dir, FreeMB: free / mb})
+		}
+	}
+
+	err := CheckSpace(dirs...)
+	pause.Lock()
+	defer pause.Unlock()
+	status.Waiting = pause.waiting
+	if err == nil && pause.waiting > 0 {
+		// Jobs resume on their next check
+		err = pause.err
+	}
+	if err != nil {
+		status.Paused, status.Reason = true, err.Error()
+		if pause.err != nil {
+			status.Since = pause.since
+		}
+	}
+	return status
+}
@@ -0,0 +1,12 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package ingest
+
+import "errors"
+
+// freeSpace can't tell the space left on this platform, so only the tmp
+// quota is enforced.
+func freeSpace(path string) (int64, error) {
+	return 0, errors.ErrUnsupported
+}
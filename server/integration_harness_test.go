@@ -0,0 +1,380 @@
+//go:build integration
+
+package main
+
+// The integration tests run the whole pipeline, from ingestion to the HTTP
+// recognition API, against SQLite, bbolt, the in-memory backend and, in
+// Docker, MongoDB, PostgreSQL, MySQL, ClickHouse, Cassandra and SQLite with
+// its fingerprints in Redis. The Docker backends also run the conformance
+// suite of db/storagetest. Run them with:
+//
+//	go test -tags integration -run Integration .
+//
+// Without a Docker daemon only the first three are tested, unless
+// INTEGRATION_REQUIRE_DOCKER=true, in which case the run fails instead.
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"song-recognition/db"
+	"song-recognition/db/storagetest"
+	"testing"
+	"time"
+
+	"github.com/ory/dockertest/v3"
+	"github.com/ory/dockertest/v3/docker"
+)
+
+// integrationBackend is a database the integration tests run against.
+type integrationBackend struct {
+	Name   string
+	DBType string
+	Env    map[string]string // DB_* settings, applied for the duration of a test
+}
+
+// container describes how to start a backend in Docker and reach it.
+type container struct {
+	name    string
+	dbType  string
+	options dockertest.RunOptions
+	port    string // exposed port, e.g. "27017/tcp"
+	env     func(host, port string) map[string]string
+}
+
+// containers are the Docker backends.
+var containers = []container{
+	{
+		name:   "mongo",
+		dbType: "mongo",
+		options: dockertest.RunOptions{
+			Repository: "mongo",
+			Tag:        "7",
+			Env: []string{
+				"MONGO_INITDB_ROOT_USERNAME=seektune",
+				"MONGO_INITDB_ROOT_PASSWORD=seektune",
+			},
+		},
+		port: "27017/tcp",
+		env: func(host, port string) map[string]string {
+			return map[string]string{
+				"DB_HOST": host,
+				"DB_PORT": port,
+				"DB_USER": "seektune",
+				"DB_PASS": "seektune",
+				// The root user is defined in the admin database
+				"DB_NAME": "admin",
+			}
+		},
+	},
+	{
+		name:   "postgres",
+		dbType: "postgres",
+		options: dockertest.RunOptions{
+			Repository: "postgres",
+			Tag:        "16",
+			Env: []string{
+				"POSTGRES_USER=seektune",
+				"POSTGRES_PASSWORD=seektune",
+				"POSTGRES_DB=seektune",
+			},
+		},
+		port: "5432/tcp",
+		env: func(host, port string) map[string]string {
+			return map[string]string{
+				"DB_HOST": host,
+				"DB_PORT": port,
+				"DB_USER": "seektune",
+				"DB_PASS": "seektune",
+				"DB_NAME": "seektune",
+			}
+		},
+	},
+	{
+		name:   "mysql",
+		dbType: "mysql",
+		options: dockertest.RunOptions{
+			Repository: "mysql",
+			Tag:        "8.4",
+			Env: []string{
+				"MYSQL_ROOT_PASSWORD=seektune",
+				"MYSQL_USER=seektune",
+				"MYSQL_PASSWORD=seektune",
+				"MYSQL_DATABASE=seektune",
+			},
+		},
+		port: "3306/tcp",
+		env: func(host, port string) map[string]string {
+			return map[string]string{
+				"DB_HOST": host,
+				"DB_PORT": port,
+				"DB_USER": "seektune",
+				"DB_PASS": "seektune",
+				"DB_NAME": "seektune",
+			}
+		},
+	},
+	{
+		name:   "clickhouse",
+		dbType: "clickhouse",
+		options: dockertest.RunOptions{
+			Repository: "clickhouse/clickhouse-server",
+			Tag:        "24.8",
+			Env: []string{
+				"CLICKHOUSE_USER=seektune",
+				"CLICKHOUSE_PASSWORD=seektune",
+				"CLICKHOUSE_DB=seektune",
+			},
+		},
+		port: "9000/tcp",
+		env: func(host, port string) map[string]string {
+			return map[string]string{
+				"DB_HOST": host,
+				"DB_PORT": port,
+				"DB_USER": "seektune",
+				"DB_PASS": "seektune",
+				"DB_NAME": "seektune",
+			}
+		},
+	},
+	{
+		name:   "cassandra",
+		dbType: "cassandra",
+		options: dockertest.RunOptions{
+			Repository: "cassandra",
+			Tag:        "4.1",
+			// A small heap, as the default takes a quarter of the host's memory
+			Env: []string{
+				"MAX_HEAP_SIZE=512M",
+				"HEAP_NEWSIZE=128M",
+			},
+		},
+		port: "9042/tcp",
+		env: func(host, port string) map[string]string {
+			return map[string]string{
+				"DB_HOST": host,
+				"DB_PORT": port,
+				"DB_NAME": "seektune",
+			}
+		},
+	},
+	{
+		// Redis only keeps the fingerprints, the songs stay in SQLite. Its
+		// file is shared like the Redis server is, as it is emptied along
+		// with it.
+		name:   "redis",
+		dbType: "sqlite",
+		options: dockertest.RunOptions{
+			Repository: "redis",
+			Tag:        "7",
+		},
+		port: "6379/tcp",
+		env: func(host, port string) map[string]string {
+			return map[string]string{
+				"FINGERPRINT_STORE": "redis",
+				"REDIS_URL":         "redis://" + net.JoinHostPort(host, port),
+				"SQLITE_PATH":       filepath.Join(os.TempDir(), "seektune-redis.sqlite3"),
+			}
+		},
+	},
+}
+
+// containerTTL bounds how long a container outlives a crashed test run.
+const containerTTL = 10 * time.Minute
+
+var integrationBackends []integrationBackend
+
+func TestMain(m *testing.M) {
+	integrationBackends = []integrationBackend{{Name: "sqlite", DBType: "sqlite"}, {Name: "bolt", DBType: "bolt"}, {Name: "memory", DBType: "memory"}}
+
+	resources, err := startContainers()
+	if err != nil {
+		if os.Getenv("INTEGRATION_REQUIRE_DOCKER") == "true" {
+			log.Fatalf("starting containers: %v", err)
+		}
+		log.Printf("Docker backends skipped: %v", err)
+	}
+
+	code := m.Run()
+
+	for _, resource := range resources {
+		resource.pool.Purge(resource.resource)
+	}
+	os.Exit(code)
+}
+
+type startedContainer struct {
+	pool     *dockertest.Pool
+	resource *dockertest.Resource
+}
+
+// startContainers starts every Docker backend and waits until it accepts
+// connections, adding it to integrationBackends.
+func startContainers() ([]startedContainer, error) {
+	pool, err := dockertest.NewPool("")
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to Docker: %v", err)
+	}
+	if err := pool.Client.Ping(); err != nil {
+		return nil, fmt.Errorf("error connecting to Docker: %v", err)
+	}
+	// Cassandra takes a minute or two to accept connections
+	pool.MaxWait = 3 * time.Minute
+
+	var started []startedContainer
+	for _, c := range containers {
+		options := c.options
+		resource, err := pool.RunWithOptions(&options, func(config *docker.HostConfig) {
+			config.AutoRemove = true
+			config.RestartPolicy = docker.RestartPolicy{Name: "no"}
+		})
+		if err != nil {
+			return started, fmt.Errorf("error starting %s: %v", c.name, err)
+		}
+		started = append(started, startedContainer{pool, resource})
+		resource.Expire(uint(containerTTL.Seconds()))
+
+		host, port, err := net.SplitHostPort(resource.GetHostPort(c.port))
+		if err != nil {
+			return started, fmt.Errorf("error getting %s address: %v", c.name, err)
+		}
+		backend := integrationBackend{Name: c.name, DBType: c.dbType, Env: c.env(host, port)}
+
+		err = pool.Retry(func() error {
+			client, err := backend.connect()
+			if err != nil {
+				return err
+			}
+			defer client.Close()
+			_, err = client.TotalSongs()
+			return err
+		})
+		if err != nil {
+			return started, fmt.Errorf("error waiting for %s: %v", c.name, err)
+		}
+		integrationBackends = append(integrationBackends, backend)
+	}
+	return started, nil
+}
+
+// connect returns a client for the backend without changing the process
+// environment, using prefixed copies of its settings.
+func (b integrationBackend) connect() (db.DBClient, error) {
+	const prefix = "INTEGRATION_"
+	for key, value := range b.Env {
+		os.Setenv(prefix+key, value)
+	}
+	defer func() {
+		for key := range b.Env {
+			os.Unsetenv(prefix + key)
+		}
+	}()
+	return db.NewDBClientFor(b.DBType, prefix)
+}
+
+// use makes the backend the one the server talks to for the rest of the test,
+// in an empty catalog and a scratch working directory.
+func (b integrationBackend) use(t *testing.T) {
+	t.Helper()
+
+	dir := t.TempDir()
+	t.Chdir(dir)
+	t.Setenv("SQLITE_PATH", dir+"/db.sqlite3")
+	t.Setenv("BOLT_PATH", dir+"/db.bolt")
+	t.Setenv("MEMORY_DB_NAME", dir)
+	for key, value := range b.Env {
+		t.Setenv(key, value)
+	}
+
+	previous := db.DBtype
+	db.DBtype = b.DBType
+	t.Cleanup(func() { db.DBtype = previous })
+
+	client, err := db.NewDBClient()
+	if err != nil {
+		t.Fatalf("connecting to %s: %v", b.Name, err)
+	}
+	defer client.Close()
+	for _, collection := range []string{"fingerprints", "songs"} {
+		if err := client.DeleteCollection(collection); err != nil {
+			t.Fatalf("emptying %s: %v", b.Name, err)
+		}
+	}
+}
+
+// backendNamed returns the backend called name, skipping the test when it
+// wasn't started.
+func backendNamed(t *testing.T, name string) integrationBackend {
+	t.Helper()
+	for _, backend := range integrationBackends {
+		if backend.Name == name {
+			return backend
+		}
+	}
+	t.Skipf("%s wasn't started", name)
+	return integrationBackend{}
+}
+
+// conformance runs the storage conformance suite against the backend, each
+// test in a catalog emptied first.
+func (b integrationBackend) conformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) db.DBClient {
+		b.empty(t)
+		client, err := b.connect()
+		if err != nil {
+			t.Fatalf("connecting to %s: %v", b.Name, err)
+		}
+		return client
+	})
+}
+
+// empty deletes the songs, fingerprints and conformance records of the
+// backend. SQL backends create the tables dropped again as they connect.
+func (b integrationBackend) empty(t *testing.T) {
+	t.Helper()
+	client, err := b.connect()
+	if err != nil {
+		t.Fatalf("connecting to %s: %v", b.Name, err)
+	}
+	defer client.Close()
+	for _, collection := range []string{"fingerprints", "songs"} {
+		if err := client.DeleteCollection(collection); err != nil {
+			t.Fatalf("emptying %s: %v", b.Name, err)
+		}
+	}
+	records, err := client.ListRecords("storagetest", db.RecordFilter{})
+	if err != nil {
+		t.Fatalf("listing records of %s: %v", b.Name, err)
+	}
+	for _, record := range records {
+		if err := client.DeleteRecord("storagetest", record.ID); err != nil {
+			t.Fatalf("emptying %s: %v", b.Name, err)
+		}
+	}
+}
+
+func TestIntegrationMongoConformance(t *testing.T) {
+	backendNamed(t, "mongo").conformance(t)
+}
+
+func TestIntegrationPostgresConformance(t *testing.T) {
+	backendNamed(t, "postgres").conformance(t)
+}
+
+func TestIntegrationMySQLConformance(t *testing.T) {
+	backendNamed(t, "mysql").conformance(t)
+}
+
+func TestIntegrationClickHouseConformance(t *testing.T) {
+	backendNamed(t, "clickhouse").conformance(t)
+}
+
+func TestIntegrationCassandraConformance(t *testing.T) {
+	backendNamed(t, "cassandra").conformance(t)
+}
+
+func TestIntegrationRedisConformance(t *testing.T) {
+	backendNamed(t, "redis").conformance(t)
+}
@@ -0,0 +1,292 @@
+//go:build integration
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"song-recognition/acl"
+	"song-recognition/archive"
+	"song-recognition/db"
+	"song-recognition/models"
+	"song-recognition/shazam"
+	"song-recognition/spotify"
+	"song-recognition/testgen"
+	"testing"
+)
+
+const (
+	fixtureSongs   = 5
+	fixtureSeconds = 30
+)
+
+// writeFixture writes samples as a WAV file in dir.
+func writeFixture(t *testing.T, dir, name string, samples []float64) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := testgen.WriteWAV(path, samples, testgen.SampleRate); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// ingestCatalog saves the songs and returns their IDs by title.
+func ingestCatalog(t *testing.T, songs []testgen.Song) map[string]models.SongID {
+	t.Helper()
+	dir := t.TempDir()
+
+	for i, song := range songs {
+		path := writeFixture(t, dir, fmt.Sprintf("song%d.wav", i), song.Samples)
+		if err := spotify.ProcessAndSaveSong(path, song.Title, song.Artist, fmt.Sprintf("fixture-%d", i)); err != nil {
+			t.Fatalf("ingesting %s: %v", song.Title, err)
+		}
+	}
+
+	client, err := db.NewDBClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ids := make(map[string]models.SongID, len(songs))
+	err = client.ForEachSong(func(songID models.SongID, song db.Song) error {
+		ids[song.Title] = songID
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("listing songs: %v", err)
+	}
+	if len(ids) != len(songs) {
+		t.Fatalf("%d songs stored, want %d", len(ids), len(songs))
+	}
+	return ids
+}
+
+// listSongs gets a page of the library from the songs endpoint.
+func listSongs(t *testing.T, server *httptest.Server, query string) (page struct {
+	More  bool         `json:"more"`
+	Songs []listedSong `json:"songs"`
+}) {
+	t.Helper()
+	resp, err := http.Get(server.URL + "/api/songs?" + query)
+	if err != nil {
+		t.Fatalf("listing songs: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("listing songs: status %d", resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		t.Fatalf("decoding songs: %v", err)
+	}
+	return page
+}
+
+// postAudio posts a WAV file to the audio recognition endpoint.
+func postAudio(t *testing.T, server *httptest.Server, path string) *http.Response {
+	t.Helper()
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("audio", filepath.Base(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(data)
+	form.Close()
+
+	resp, err := http.Post(server.URL+"/api/recognize/audio", form.FormDataContentType(), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+// recognize posts a WAV file to the audio recognition endpoint and decodes
+// the response.
+func recognize(t *testing.T, server *httptest.Server, path string) audioRecognitionResponse {
+	t.Helper()
+
+	resp := postAudio(t, server, path)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("recognize: status %d", resp.StatusCode)
+	}
+
+	var response audioRecognitionResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+	return response
+}
+
+func TestIntegrationRecognition(t *testing.T) {
+	songs := testgen.Catalog(fixtureSongs, fixtureSeconds, testgen.SampleRate)
+
+	for _, backend := range integrationBackends {
+		t.Run(backend.Name, func(t *testing.T) {
+			backend.use(t)
+			ids := ingestCatalog(t, songs)
+
+			mux := http.NewServeMux()
+			registerAPIHandlers(mux)
+			server := httptest.NewServer(mux)
+			defer server.Close()
+
+			dir := t.TempDir()
+			for i, song := range songs {
+				offset := float64(3 + 4*i)
+				clip := testgen.Excerpt(song.Samples, testgen.SampleRate, offset, 8)
+				clip = testgen.MixNoise(clip, int64(100+i), 15)
+				path := writeFixture(t, dir, fmt.Sprintf("query%d.wav", i), clip)
+
+				response := recognize(t, server, path)
+				if !response.Recognized || len(response.Matches) == 0 {
+					t.Errorf("%s at %vs: not recognized", song.Title, offset)
+					continue
+				}
+				if got := response.Matches[0].SongID; got != ids[song.Title] {
+					t.Errorf("%s at %vs: matched song %d (%s), want %d", song.Title, offset, got, response.Matches[0].SongTitle, ids[song.Title])
+				}
+			}
+
+			// The library pages through every song, newest first
+			listed := map[models.SongID]bool{}
+			for offset, more := 0, true; more; offset += 2 {
+				page := listSongs(t, server, fmt.Sprintf("sort=ingested&order=desc&offset=%d&limit=2", offset))
+				for _, song := range page.Songs {
+					if song.SongID != ids[song.Title] || song.IngestedAt == nil {
+						t.Errorf("listed %+v, want song %d with its ingestion time", song, ids[song.Title])
+					}
+					listed[song.SongID] = true
+				}
+				more = page.More
+			}
+			if len(listed) != len(songs) {
+				t.Errorf("listed %d songs, want %d", len(listed), len(songs))
+			}
+		})
+	}
+}
+
+func TestIntegrationRecognitionStorageFaults(t *testing.T) {
+	backendNamed(t, "sqlite").use(t)
+	songs := testgen.Catalog(1, fixtureSeconds, testgen.SampleRate)
+	ingestCatalog(t, songs)
+
+	mux := http.NewServeMux()
+	registerAPIHandlers(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	clip := testgen.Excerpt(songs[0].Samples, testgen.SampleRate, 3, 8)
+	path := writeFixture(t, t.TempDir(), "query.wav", clip)
+
+	// The database passes the health check the request is admitted on, then
+	// goes down while the clip is matched: lookups fail and probes time out
+	if !db.Available() {
+		t.Fatal("database unavailable before injecting faults")
+	}
+	// Run after the faults are lifted, so later tests find it available
+	t.Cleanup(func() { db.Probe() })
+	t.Setenv("DB_FAULTS", "error_rate=1,ops=GetCouples")
+	t.Setenv("DB_RETRY_ATTEMPTS", "1")
+	t.Setenv("DB_PROBE_TIMEOUT", "1ns")
+
+	resp := postAudio(t, server, path)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("recognize with a failing database: status %d, want %d", resp.StatusCode, http.StatusServiceUnavailable)
+	}
+}
+
+func TestIntegrationReplayRespectsACL(t *testing.T) {
+	backendNamed(t, "sqlite").use(t)
+	songs := testgen.Catalog(1, fixtureSeconds, testgen.SampleRate)
+	songID := ingestCatalog(t, songs)[songs[0].Title]
+
+	notified := 0
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		notified++
+	}))
+	defer hook.Close()
+	t.Setenv("REPLAY_WEBHOOK_URL", hook.URL)
+	t.Setenv("ARCHIVE_DIR", t.TempDir())
+	t.Setenv("API_CLIENTS", "client:secret,other:secret")
+
+	clip := testgen.Excerpt(songs[0].Samples, testgen.SampleRate, 3, 8)
+	fingerprint, err := shazam.QueryFingerprint(clip, testgen.SampleRate, shazam.FanOut())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := archive.SaveUnmatched("audio", "client", fingerprint, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// The only song the clip matches is one the client may not see
+	if err := acl.SetSongRule(acl.SongRule{SongID: songID, Allowed: []string{"other"}}); err != nil {
+		t.Fatal(err)
+	}
+	replayUnmatched()
+	if notified != 0 {
+		t.Errorf("replay notified the client of a song hidden from it")
+	}
+	if clips, _ := archive.ListUnmatched(); len(clips) != 1 {
+		t.Errorf("%d clips archived after replay, want 1", len(clips))
+	}
+
+	// It is reported once the song is visible
+	if err := acl.DeleteSongRule(songID); err != nil {
+		t.Fatal(err)
+	}
+	replayUnmatched()
+	if notified != 1 {
+		t.Errorf("replay notified %d times once the song is visible, want 1", notified)
+	}
+}
+
+func TestIntegrationReplayUnmatchedAudio(t *testing.T) {
+	backendNamed(t, "sqlite").use(t)
+	song := testgen.Catalog(1, fixtureSeconds, testgen.SampleRate)[0]
+
+	notified := 0
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		notified++
+	}))
+	defer hook.Close()
+	t.Setenv("REPLAY_WEBHOOK_URL", hook.URL)
+	t.Setenv("ARCHIVE_UNMATCHED", "true")
+	t.Setenv("ARCHIVE_DIR", t.TempDir())
+
+	mux := http.NewServeMux()
+	registerAPIHandlers(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	// An excerpt of a song that isn't in the catalog yet is archived
+	clip := testgen.Excerpt(song.Samples, testgen.SampleRate, 3, 8)
+	if response := recognize(t, server, writeFixture(t, t.TempDir(), "query.wav", clip)); response.Recognized {
+		t.Fatal("song recognized before it was ingested")
+	}
+	clips, err := archive.ListUnmatched()
+	if err != nil || len(clips) != 1 || clips[0].Source != "audio" {
+		t.Fatalf("archived clips = %+v, %v; want the unmatched upload", clips, err)
+	}
+
+	// and reported once the song is
+	ingestCatalog(t, []testgen.Song{song})
+	replayUnmatched()
+	if notified != 1 {
+		t.Errorf("replay notified %d times, want 1", notified)
+	}
+}
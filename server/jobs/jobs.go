@@ -0,0 +1,342 @@
+// Package jobs runs recurring maintenance on cron schedules. Every run is
+// recorded in the database, so the history survives restarts and runs missed
+// while the server was down are caught up when it starts again. A job never
+// runs twice at once: a run coming due while the previous one is still going
+// is skipped.
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"song-recognition/db"
+	"song-recognition/utils"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mdobak/go-xerrors"
+)
+
+const runsCollection = "job_runs"
+
+// Run statuses
+const (
+	StatusRunning     = "running"
+	StatusSucceeded   = "succeeded"
+	StatusFailed      = "failed"
+	StatusInterrupted = "interrupted" // the server stopped during the run
+)
+
+// Run triggers
+const (
+	TriggerSchedule = "schedule"
+	TriggerCatchUp  = "catch-up" // due while the server was down
+	TriggerManual   = "manual"
+)
+
+// ErrRunning is returned when a job is started while it is already running.
+var ErrRunning = errors.New("job is already running")
+
+// Task does the work of a job and returns a short summary of what it did.
+type Task func(ctx context.Context) (string, error)
+
+// Run is one execution of a job.
+type Run struct {
+	ID       string    `json:"id"`
+	Job      string    `json:"job"`
+	Trigger  string    `json:"trigger"`
+	Host     string    `json:"host,omitempty"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished,omitempty"`
+	Status   string    `json:"status"`
+	Result   string    `json:"result,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// Status describes a job and its latest run.
+type Status struct {
+	Name     string    `json:"name"`
+	Schedule string    `json:"schedule,omitempty"` // empty for jobs only run on demand
+	Next     time.Time `json:"next,omitempty"`
+	Running  bool      `json:"running"`
+	LastRun  *Run      `json:"lastRun,omitempty"`
+}
+
+type job struct {
+	name     string
+	expr     string
+	schedule *Schedule
+	task     Task
+}
+
+// Scheduler runs registered jobs on their schedules or on demand.
+type Scheduler struct {
+	mu      sync.Mutex
+	jobs    map[string]*job
+	running map[string]bool
+}
+
+// NewScheduler returns a scheduler without jobs.
+func NewScheduler() *Scheduler {
+	return &Scheduler{jobs: make(map[string]*job), running: make(map[string]bool)}
+}
+
+// Add registers a job. An empty expr registers a job that only runs on
+// demand.
+func (s *Scheduler) Add(name, expr string, task Task) error {
+	j := &job{name: name, expr: strings.TrimSpace(expr), task: task}
+	if j.expr != "" {
+		schedule, err := ParseSchedule(j.expr)
+		if err != nil {
+			return fmt.Errorf("job %s: %v", name, err)
+		}
+		j.schedule = schedule
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs[name] = j
+	return nil
+}
+
+// Has reports whether a job is registered.
+func (s *Scheduler) Has(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.jobs[name]
+	return ok
+}
+
+// Start runs the scheduled jobs until ctx is done. Runs left unfinished by a
+// previous server are marked interrupted, and jobs that came due while no
+// server was running are run right away.
+func (s *Scheduler) Start(ctx context.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, j := range s.jobs {
+		if j.schedule != nil {
+			go s.loop(ctx, j)
+		}
+	}
+}
+
+func (s *Scheduler) loop(ctx context.Context, j *job) {
+	logger := utils.GetLogger()
+
+	last, exists, err := lastRun(j.name)
+	if err != nil {
+		err := xerrors.New(err)
+		logger.ErrorContext(ctx, "failed to read the last run of job "+j.name, slog.Any("error", err))
+	}
+	if exists && last.Status == StatusRunning {
+		last.Status = StatusInterrupted
+		if err := putRun(last); err != nil {
+			err := xerrors.New(err)
+			logger.ErrorContext(ctx, "failed to record interrupted run of job "+j.name, slog.Any("error", err))
+		}
+	}
+
+	trigger := TriggerSchedule
+	next := j.schedule.Next(time.Now())
+	if exists {
+		if due := j.schedule.Next(last.Started); !due.IsZero() && !due.After(time.Now()) {
+			next, trigger = time.Now(), TriggerCatchUp
+		}
+	}
+
+	for !next.IsZero() {
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		if _, err := s.Run(ctx, j.name, trigger); errors.Is(err, ErrRunning) {
+			logger.Info(fmt.Sprintf("skipped scheduled run of job %s: previous run still going", j.name))
+		}
+		trigger = TriggerSchedule
+		next = j.schedule.Next(time.Now())
+	}
+}
+
+// Run runs a job now and waits for it to finish. It returns ErrRunning
+// without running the job if it is already running.
+func (s *Scheduler) Run(ctx context.Context, name, trigger string) (Run, error) {
+	s.mu.Lock()
+	j, ok := s.jobs[name]
+	if !ok {
+		s.mu.Unlock()
+		return Run{}, fmt.Errorf("unknown job %q", name)
+	}
+	if s.running[name] {
+		s.mu.Unlock()
+		return Run{}, ErrRunning
+	}
+	s.running[name] = true
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.running, name)
+		s.mu.Unlock()
+	}()
+
+	logger := utils.GetLogger()
+	host, _ := os.Hostname()
+	run := Run{
+		ID:      fmt.Sprintf("%s_%s_%d", name, time.Now().UTC().Format("20060102T150405"), utils.GenerateUniqueID()),
+		Job:     name,
+		Trigger: trigger,
+		Host:    host,
+		Started: time.Now().UTC(),
+		Status:  StatusRunning,
+	}
+	if err := putRun(run); err != nil {
+		err := xerrors.New(err)
+		logger.ErrorContext(ctx, "failed to record run of job "+name, slog.Any("error", err))
+	}
+
+	result, err := j.task(ctx)
+	run.Finished = time.Now().UTC()
+	run.Result = result
+	run.Status = StatusSucceeded
+	if err != nil {
+		run.Status = StatusFailed
+		run.Error = err.Error()
+		err := xerrors.New(err)
+		logger.ErrorContext(ctx, "job "+name+" failed", slog.Any("error", err))
+	} else {
+		logger.Info(fmt.Sprintf("job %s finished in %v: %s", name, run.Finished.Sub(run.Started).Round(time.Millisecond), result))
+	}
+
+	if err := putRun(run); err != nil {
+		err := xerrors.New(err)
+		logger.ErrorContext(ctx, "failed to record run of job "+name, slog.Any("error", err))
+	}
+	if err := trimRuns(name); err != nil {
+		err := xerrors.New(err)
+		logger.ErrorContext(ctx, "failed to trim the run history of job "+name, slog.Any("error", err))
+	}
+
+	return run, nil
+}
+
+// Statuses returns the registered jobs by name with their next scheduled
+// time and latest run.
+func (s *Scheduler) Statuses() ([]Status, error) {
+	s.mu.Lock()
+	statuses := make([]Status, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		status := Status{Name: j.name, Schedule: j.expr, Running: s.running[j.name]}
+		if j.schedule != nil {
+			status.Next = j.schedule.Next(time.Now())
+		}
+		statuses = append(statuses, status)
+	}
+	s.mu.Unlock()
+
+	sort.Slice(statuses, func(i, k int) bool { return statuses[i].Name < statuses[k].Name })
+
+	for i := range statuses {
+		last, exists, err := lastRun(statuses[i].Name)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			statuses[i].LastRun = &last
+		}
+	}
+	return statuses, nil
+}
+
+// historySize returns how many runs are kept per job, from JOBS_HISTORY_SIZE
+// (default 50).
+func historySize() int {
+	size, err := strconv.Atoi(utils.GetEnv("JOBS_HISTORY_SIZE", "50"))
+	if err != nil || size < 1 {
+		return 50
+	}
+	return size
+}
+
+// The name of the job is stored as the client ID of its run records, so the
+// runs of a job can be listed without reading the others.
+func putRun(run Run) error {
+	data, err := json.Marshal(run)
+	if err != nil {
+		return fmt.Errorf("failed to marshal run: %v", err)
+	}
+
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		return err
+	}
+	defer dbClient.Close()
+
+	return dbClient.PutRecord(runsCollection, db.Record{
+		ID:        run.ID,
+		ClientID:  run.Job,
+		CreatedAt: run.Started,
+		Data:      data,
+	})
+}
+
+// Runs returns the recorded runs of a job, oldest first.
+func Runs(name string) ([]Run, error) {
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		return nil, err
+	}
+	defer dbClient.Close()
+
+	records, err := dbClient.ListRecords(runsCollection, db.RecordFilter{ClientID: name})
+	if err != nil {
+		return nil, err
+	}
+
+	runs := make([]Run, 0, len(records))
+	for _, record := range records {
+		var run Run
+		if err := json.Unmarshal(record.Data, &run); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal run %s: %v", record.ID, err)
+		}
+		runs = append(runs, run)
+	}
+	return runs, nil
+}
+
+func lastRun(name string) (Run, bool, error) {
+	runs, err := Runs(name)
+	if err != nil || len(runs) == 0 {
+		return Run{}, false, err
+	}
+	return runs[len(runs)-1], true, nil
+}
+
+// trimRuns deletes the oldest runs of a job beyond the history size.
+func trimRuns(name string) error {
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		return err
+	}
+	defer dbClient.Close()
+
+	records, err := dbClient.ListRecords(runsCollection, db.RecordFilter{ClientID: name})
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(records)-historySize(); i++ {
+		if err := dbClient.DeleteRecord(runsCollection, records[i].ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+// Package keyring reads the AES keys encrypted files are written with. Keys
+// are set as comma separated id:key pairs with base64 encoded 16, 24 or 32
+// byte AES keys. The first key encrypts new files and all of them decrypt,
+// so keys can be rotated by prepending a new one.
+package keyring
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"song-recognition/utils"
+	"strings"
+)
+
+// Keyring holds the keys files are encrypted with, by ID.
+type Keyring struct {
+	Active string // ID of the key new files are encrypted with
+	Keys   map[string][]byte
+}
+
+// Load reads the keys of name (e.g. "archive", used in errors) from the
+// environment variable keysVar or, if unset, from the file named by fileVar
+// (e.g. written by a KMS or secrets agent). It returns nil when neither is
+// set.
+func Load(name, keysVar, fileVar string) (*Keyring, error) {
+	spec := utils.GetEnv(keysVar)
+	if spec == "" {
+		if path := utils.GetEnv(fileVar); path != "" {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read %s key file: %v", name, err)
+			}
+			spec = strings.TrimSpace(string(data))
+		}
+	}
+	if spec == "" {
+		return nil, nil
+	}
+
+	ring := &Keyring{Keys: make(map[string][]byte)}
+	for _, pair := range strings.Split(spec, ",") {
+		id, encoded, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		if !ok || id == "" || len(id) > 255 {
+			return nil, fmt.Errorf("invalid %s key %q, expected id:base64key", name, id)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s key %s: %v", name, id, err)
+		}
+		if len(key) != 16 && len(key) != 24 && len(key) != 32 {
+			return nil, fmt.Errorf("%s key %s must be 16, 24 or 32 bytes, got %d", name, id, len(key))
+		}
+		if ring.Active == "" {
+			ring.Active = id
+		}
+		ring.Keys[id] = key
+	}
+	return ring, nil
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"runtime"
+	"song-recognition/db"
+	"song-recognition/priority"
+	"song-recognition/utils"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	errRecognitionBusy    = errors.New("too many recognition requests, try again later")
+	errStorageUnavailable = errors.New("the fingerprint database is unavailable, try again later")
+	errClientBusy         = errors.New("too many recognition requests from this client, try again later")
+	errRecognitionTimeout = errors.New("recognition took too long, try again later")
+)
+
+// recognitionLimiter bounds the number of recognitions running at once.
+// Requests beyond the limit wait in a bounded queue and are rejected when
+// the queue is full or their wait times out. Its scheduler is shared with
+// background work, which only gets the slots interactive requests leave.
+type recognitionLimiter struct {
+	scheduler *priority.Scheduler
+
+	mu        sync.Mutex
+	queued    int
+	queueSize int
+	timeout   time.Duration
+}
+
+// recognitionLimits holds the settings of a recognitionLimiter.
+type recognitionLimits struct {
+	maxInFlight   int
+	maxBackground int
+	queueSize     int
+	timeout       time.Duration
+}
+
+func newRecognitionLimiter(limits recognitionLimits) *recognitionLimiter {
+	return &recognitionLimiter{
+		scheduler: priority.NewScheduler(limits.maxInFlight, limits.maxBackground),
+		queueSize: limits.queueSize,
+		timeout:   limits.timeout,
+	}
+}
+
+var (
+	limiterOnce sync.Once
+	limiter     *recognitionLimiter
+)
+
+// getRecognitionLimiter returns the limiter configured by
+// RECOGNITION_MAX_IN_FLIGHT (default: number of CPUs), RECOGNITION_QUEUE_SIZE
+// (default: 4 per slot), RECOGNITION_QUEUE_TIMEOUT in seconds (default 10)
+// and BACKGROUND_MAX_IN_FLIGHT, the slots background work may use (default:
+// half of them).
+func getRecognitionLimiter() *recognitionLimiter {
+	limiterOnce.Do(func() {
+		limiter = newRecognitionLimiter(readRecognitionLimits())
+	})
+	return limiter
+}
+
+func readRecognitionLimits() recognitionLimits {
+	maxInFlight, err := strconv.Atoi(utils.GetEnv("RECOGNITION_MAX_IN_FLIGHT", strconv.Itoa(runtime.NumCPU())))
+	if err != nil || maxInFlight < 1 {
+		maxInFlight = runtime.NumCPU()
+	}
+
+	maxBackground, err := strconv.Atoi(utils.GetEnv("BACKGROUND_MAX_IN_FLIGHT", strconv.Itoa(max(maxInFlight/2, 1))))
+	if err != nil || maxBackground < 1 {
+		maxBackground = max(maxInFlight/2, 1)
+	}
+
+	queueSize, err := strconv.Atoi(utils.GetEnv("RECOGNITION_QUEUE_SIZE", strconv.Itoa(4*maxInFlight)))
+	if err != nil || queueSize < 0 {
+		queueSize = 4 * maxInFlight
+	}
+
+	timeout, err := strconv.Atoi(utils.GetEnv("RECOGNITION_QUEUE_TIMEOUT", "10"))
+	if err != nil || timeout < 0 {
+		timeout = 10
+	}
+
+	return recognitionLimits{
+		maxInFlight:   maxInFlight,
+		maxBackground: maxBackground,
+		queueSize:     queueSize,
+		timeout:       time.Duration(timeout) * time.Second,
+	}
+}
+
+// reload applies the current settings. Requests running or queued keep
+// their place.
+func (l *recognitionLimiter) reload() {
+	limits := readRecognitionLimits()
+	l.scheduler.Resize(limits.maxInFlight, limits.maxBackground)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.queueSize, l.timeout = limits.queueSize, limits.timeout
+}
+
+// enqueue takes a place in the queue if there is one left, and returns how
+// long to wait in it.
+func (l *recognitionLimiter) enqueue() (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.queued >= l.queueSize {
+		return 0, false
+	}
+	l.queued++
+	return l.timeout, true
+}
+
+func (l *recognitionLimiter) dequeue() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.queued--
+}
+
+// acquire takes a recognition slot, waiting in the queue if none is free.
+// The returned function releases the slot.
+func (l *recognitionLimiter) acquire(ctx context.Context) (func(), error) {
+	if release, ok := l.scheduler.TryAcquire(priority.Interactive); ok {
+		return release, nil
+	}
+
+	timeout, ok := l.enqueue()
+	if !ok {
+		return nil, errRecognitionBusy
+	}
+	defer l.dequeue()
+
+	waitCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	release, err := l.scheduler.Acquire(waitCtx, priority.Interactive)
+	if err != nil && ctx.Err() == nil {
+		return nil, errRecognitionBusy
+	}
+	return release, err
+}
+
+// clientLimiter bounds the number of recognitions a single client address
+// may have running or queued at once, so one client can't take every slot.
+type clientLimiter struct {
+	mu       sync.Mutex
+	max      int // 0 for no bound
+	inFlight map[string]int
+}
+
+var (
+	clientLimiterOnce sync.Once
+	clientLimiterInst *clientLimiter
+)
+
+// getClientLimiter returns the limiter configured by
+// RECOGNITION_MAX_PER_CLIENT (default 0, unbounded). Clients are told apart
+// by address, the one of their own behind TRUSTED_PROXIES.
+func getClientLimiter() *clientLimiter {
+	clientLimiterOnce.Do(func() {
+		clientLimiterInst = &clientLimiter{inFlight: make(map[string]int)}
+		clientLimiterInst.reload()
+	})
+	return clientLimiterInst
+}
+
+// reload applies the current setting. Clients above a lowered bound finish
+// what they are running.
+func (l *clientLimiter) reload() {
+	maxPerClient, err := strconv.Atoi(utils.GetEnv("RECOGNITION_MAX_PER_CLIENT", "0"))
+	if err != nil || maxPerClient < 0 {
+		maxPerClient = 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.max = maxPerClient
+}
+
+// acquire counts a recognition of a client, unless it already has as many as
+// allowed. The returned function ends it.
+func (l *clientLimiter) acquire(client string) (func(), bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.max > 0 && l.inFlight[client] >= l.max {
+		return nil, false
+	}
+	l.inFlight[client]++
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if l.inFlight[client]--; l.inFlight[client] == 0 {
+			delete(l.inFlight, client)
+		}
+	}, true
+}
+
+// recognitionTimeout returns how long a recognition may run once it got a
+// slot, from RECOGNITION_TIMEOUT (default 0, no limit).
+func recognitionTimeout() time.Duration {
+	timeout, err := time.ParseDuration(utils.GetEnv("RECOGNITION_TIMEOUT", "0"))
+	if err != nil || timeout < 0 {
+		return 0
+	}
+	return timeout
+}
+
+// writeRecognitionAbandoned answers a recognition abandoned because its
+// context is done with err: 504 Gateway Timeout past RECOGNITION_TIMEOUT,
+// nothing when the client has gone.
+func writeRecognitionAbandoned(w http.ResponseWriter, err error) {
+	if errors.Is(err, context.DeadlineExceeded) {
+		writeError(w, http.StatusGatewayTimeout, errRecognitionTimeout.Error())
+	}
+}
+
+// limitRecognitions rejects requests with 429 Too Many Requests once the
+// recognition limiter is saturated, or their client has too many running.
+// Requests that get a slot are given RECOGNITION_TIMEOUT to complete.
+func limitRecognitions(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		releaseClient, ok := getClientLimiter().acquire(clientIP(r))
+		if !ok {
+			w.Header().Set("Retry-After", "1")
+			writeError(w, http.StatusTooManyRequests, errClientBusy.Error())
+			return
+		}
+		defer releaseClient()
+
+		release, err := getRecognitionLimiter().acquire(r.Context())
+		if err != nil {
+			w.Header().Set("Retry-After", "1")
+			writeError(w, http.StatusTooManyRequests, errRecognitionBusy.Error())
+			return
+		}
+		defer release()
+
+		if timeout := recognitionTimeout(); timeout > 0 {
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+			r = r.WithContext(ctx)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// storageRetryAfter returns the delay suggested to clients while the
+// database is unreachable, from DB_RETRY_AFTER in seconds (default 30).
+func storageRetryAfter() int {
+	seconds, err := strconv.Atoi(utils.GetEnv("DB_RETRY_AFTER", "30"))
+	if err != nil || seconds < 1 {
+		return 30
+	}
+	return seconds
+}
+
+// writeStorageUnavailable answers 503 Service Unavailable with a Retry-After
+// header, for requests that can't be served without the database.
+func writeStorageUnavailable(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", strconv.Itoa(storageRetryAfter()))
+	writeError(w, http.StatusServiceUnavailable, errStorageUnavailable.Error())
+}
+
+// requireStorage rejects requests with 503 while the database is known to be
+// unreachable, before any audio is decoded or fingerprinted.
+func requireStorage(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !db.Available() {
+			writeStorageUnavailable(w)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
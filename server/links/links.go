@@ -0,0 +1,296 @@
+// Package links checks that the YouTube videos songs link to can still be
+// played, so apps can rely on them for playback. Dead or region blocked videos
+// are flagged, and other uploads of their songs can be looked for.
+package links
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"song-recognition/db"
+	"song-recognition/models"
+	"song-recognition/songmeta"
+	"song-recognition/spotify"
+	"song-recognition/utils"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mdobak/go-xerrors"
+)
+
+const checksCollection = "youtube_links"
+
+// Statuses of a link
+const (
+	StatusAvailable = "available"
+	StatusDead      = "dead"    // deleted, private or never processed
+	StatusBlocked   = "blocked" // can't be watched in some of YOUTUBE_REGIONS
+)
+
+// Replacement modes, set with YOUTUBE_REPLACEMENTS
+const (
+	ReplaceOff     = "off"
+	ReplaceSuggest = "suggest" // record another upload of the song
+	ReplaceApply   = "apply"   // also link the song to it
+)
+
+// Check is the outcome of the last check of the video a song links to.
+type Check struct {
+	SongID    models.SongID `json:"songId"`
+	YouTubeID string        `json:"ytId"`
+	Status    string        `json:"status"`
+	BlockedIn []string      `json:"blockedIn,omitempty"` // regions of YOUTUBE_REGIONS
+
+	Title   string `json:"title,omitempty"` // of the video
+	Channel string `json:"channel,omitempty"`
+	// PreviousTitle and PreviousChannel are what the video was called before
+	// it last changed, at ChangedAt.
+	PreviousTitle   string    `json:"previousTitle,omitempty"`
+	PreviousChannel string    `json:"previousChannel,omitempty"`
+	ChangedAt       time.Time `json:"changedAt,omitempty"`
+
+	// Replacement is another upload of the song, found while the link was
+	// dead or blocked. ReplacedID is the video the song linked to before
+	// it was applied.
+	Replacement string `json:"replacement,omitempty"`
+	ReplacedID  string `json:"replacedId,omitempty"`
+
+	UnavailableSince time.Time `json:"unavailableSince,omitempty"`
+	CheckedAt        time.Time `json:"checkedAt"`
+}
+
+// Report summarizes a pass over the links of the catalog.
+type Report struct {
+	Checked  int `json:"checked"`
+	Dead     int `json:"dead"`
+	Blocked  int `json:"blocked"`
+	Changed  int `json:"changed"`
+	Replaced int `json:"replaced"`
+	Failed   int `json:"failed"`
+}
+
+// Regions returns the regions videos must be watchable in (YOUTUBE_REGIONS,
+// comma separated ISO 3166-1 alpha-2 codes).
+func Regions() []string {
+	var regions []string
+	for _, region := range strings.Split(utils.GetEnv("YOUTUBE_REGIONS"), ",") {
+		if region = strings.ToUpper(strings.TrimSpace(region)); region != "" {
+			regions = append(regions, region)
+		}
+	}
+	return regions
+}
+
+// ReplacementMode returns what is done about dead or blocked links
+// (YOUTUBE_REPLACEMENTS).
+func ReplacementMode() string {
+	switch mode := utils.GetEnv("YOUTUBE_REPLACEMENTS", ReplaceOff); mode {
+	case ReplaceSuggest, ReplaceApply:
+		return mode
+	}
+	return ReplaceOff
+}
+
+// Refresh checks the videos every song links to.
+func Refresh(ctx context.Context) (Report, error) {
+	var report Report
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		return report, err
+	}
+	defer dbClient.Close()
+
+	songs := make(map[models.SongID]db.Song)
+	err = dbClient.ForEachSong(func(songID models.SongID, song db.Song) error {
+		if song.YouTubeID != "" {
+			songs[songID] = song
+		}
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+	songIDs := make([]models.SongID, 0, len(songs))
+	for songID := range songs {
+		songIDs = append(songIDs, songID)
+	}
+	sort.Slice(songIDs, func(i, j int) bool { return songIDs[i] < songIDs[j] })
+
+	logger := utils.GetLogger()
+	for _, songID := range songIDs {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+
+		check, err := CheckSong(ctx, dbClient, songID, songs[songID])
+		if err != nil {
+			report.Failed++
+			err := xerrors.New(err)
+			logger.ErrorContext(ctx, fmt.Sprintf("failed to check the YouTube link of song %d", songID), slog.Any("error", err))
+			continue
+		}
+		report.Checked++
+		switch check.Status {
+		case StatusDead:
+			report.Dead++
+		case StatusBlocked:
+			report.Blocked++
+		}
+		if check.ChangedAt.Equal(check.CheckedAt) {
+			report.Changed++
+		}
+		if check.YouTubeID != songs[songID].YouTubeID {
+			report.Replaced++
+		}
+	}
+	return report, nil
+}
+
+// CheckSong checks the video a song links to and records the outcome.
+func CheckSong(ctx context.Context, dbClient db.DBClient, songID models.SongID, song db.Song) (Check, error) {
+	previous, _, err := Get(dbClient, songID)
+	if err != nil {
+		return Check{}, err
+	}
+
+	check, err := checkVideo(ctx, song.YouTubeID)
+	if err != nil {
+		return check, err
+	}
+	check.SongID = songID
+
+	if previous.YouTubeID == check.YouTubeID {
+		check.PreviousTitle, check.PreviousChannel, check.ChangedAt = previous.PreviousTitle, previous.PreviousChannel, previous.ChangedAt
+		check.ReplacedID, check.UnavailableSince = previous.ReplacedID, previous.UnavailableSince
+		switch {
+		case check.Status == StatusDead:
+			// Keep telling what the video was
+			check.Title, check.Channel = previous.Title, previous.Channel
+		case previous.Title != "" && (check.Title != previous.Title || check.Channel != previous.Channel):
+			check.PreviousTitle, check.PreviousChannel, check.ChangedAt = previous.Title, previous.Channel, check.CheckedAt
+		}
+	}
+
+	if check.Status == StatusAvailable {
+		check.UnavailableSince = time.Time{}
+	} else {
+		if check.UnavailableSince.IsZero() {
+			check.UnavailableSince = check.CheckedAt
+		}
+		if mode := ReplacementMode(); mode != ReplaceOff {
+			check, err = replace(ctx, dbClient, check, song, mode == ReplaceApply)
+			if err != nil {
+				return check, err
+			}
+		}
+	}
+
+	return check, put(dbClient, check)
+}
+
+// checkVideo looks a video up and tells whether it can be played in the
+// configured regions.
+func checkVideo(ctx context.Context, ytID string) (Check, error) {
+	check := Check{YouTubeID: ytID, Status: StatusDead, CheckedAt: time.Now().UTC()}
+	video, exists, err := spotify.CheckVideo(ctx, ytID)
+	if err != nil || !exists || !video.Playable {
+		return check, err
+	}
+
+	check.Status, check.Title, check.Channel = StatusAvailable, video.Title, video.Channel
+	for _, region := range Regions() {
+		if video.BlockedIn(region) {
+			check.BlockedIn = append(check.BlockedIn, region)
+		}
+	}
+	if len(check.BlockedIn) > 0 {
+		check.Status = StatusBlocked
+	}
+	return check, nil
+}
+
+// replace looks for another upload of a song with a dead or blocked link,
+// of the same duration, and links the song to it if apply is set. Songs of
+// unknown duration are left alone.
+func replace(ctx context.Context, dbClient db.DBClient, check Check, song db.Song, apply bool) (Check, error) {
+	metadata, exists, err := songmeta.Get(dbClient, check.SongID)
+	if err != nil || !exists {
+		return check, err
+	}
+
+	candidate, err := spotify.GetYoutubeId(spotify.Track{
+		Title:    song.Title,
+		Artist:   song.Artist,
+		Duration: int(metadata.DurationMs / 1000),
+	})
+	if err != nil || candidate == "" || candidate == check.YouTubeID {
+		return check, nil
+	}
+	if _, used, err := dbClient.GetSongByYTID(candidate); err != nil || used {
+		return check, err
+	}
+	replacement, err := checkVideo(ctx, candidate)
+	if err != nil || replacement.Status != StatusAvailable {
+		return check, err
+	}
+
+	check.Replacement = candidate
+	if !apply {
+		return check, nil
+	}
+	song.YouTubeID = candidate
+	if err := dbClient.StoreSong(check.SongID, song); err != nil {
+		return check, fmt.Errorf("failed to link song %d to %s: %v", check.SongID, candidate, err)
+	}
+	replacement.SongID, replacement.ReplacedID = check.SongID, check.YouTubeID
+	return replacement, nil
+}
+
+// Get returns the last check of the link of a song.
+func Get(dbClient db.DBClient, songID models.SongID) (Check, bool, error) {
+	var check Check
+	record, exists, err := dbClient.GetRecord(checksCollection, fmt.Sprint(songID))
+	if err != nil || !exists {
+		return check, exists, err
+	}
+	if err := json.Unmarshal(record.Data, &check); err != nil {
+		return check, false, fmt.Errorf("failed to unmarshal link check of song %d: %v", songID, err)
+	}
+	return check, true, nil
+}
+
+// List returns the last checks of the links of every song, those with the
+// given status only if it isn't empty.
+func List(dbClient db.DBClient, status string) ([]Check, error) {
+	records, err := dbClient.ListRecords(checksCollection, db.RecordFilter{})
+	if err != nil {
+		return nil, err
+	}
+
+	checks := make([]Check, 0, len(records))
+	for _, record := range records {
+		var check Check
+		if err := json.Unmarshal(record.Data, &check); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal link check %s: %v", record.ID, err)
+		}
+		if status == "" || check.Status == status {
+			checks = append(checks, check)
+		}
+	}
+	sort.Slice(checks, func(i, j int) bool { return checks[i].SongID < checks[j].SongID })
+	return checks, nil
+}
+
+func put(dbClient db.DBClient, check Check) error {
+	data, err := json.Marshal(check)
+	if err != nil {
+		return fmt.Errorf("failed to marshal link check: %v", err)
+	}
+	return dbClient.PutRecord(checksCollection, db.Record{
+		ID:        fmt.Sprint(check.SongID),
+		CreatedAt: check.CheckedAt,
+		Data:      data,
+	})
+}
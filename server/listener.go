@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"song-recognition/utils"
+	"strconv"
+)
+
+// listenFDsStart is the first file descriptor systemd passes sockets on.
+const listenFDsStart = 3
+
+// listen returns the listener the server accepts connections on: the socket
+// systemd activated it with, else the Unix socket at socketPath, else the TCP
+// port.
+func listen(port, socketPath string) (net.Listener, error) {
+	listeners, err := systemdListeners()
+	if err != nil {
+		return nil, err
+	}
+	if len(listeners) > 0 {
+		for _, extra := range listeners[1:] {
+			log.Printf("ignoring extra socket passed by systemd: %v\n", extra.Addr())
+			extra.Close()
+		}
+		log.Printf("Using the socket passed by systemd: %v", listeners[0].Addr())
+		return listeners[0], nil
+	}
+
+	if socketPath != "" {
+		return listenUnix(socketPath)
+	}
+	return net.Listen("tcp", ":"+port)
+}
+
+// systemdListeners returns the sockets passed by systemd socket activation,
+// as described by LISTEN_PID and LISTEN_FDS, none if the server wasn't
+// activated by it.
+func systemdListeners() ([]net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count < 1 {
+		return nil, nil
+	}
+	// The sockets are duplicated close-on-exec below, keep processes the
+	// server runs from believing they were passed to them
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	listeners := make([]net.Listener, 0, count)
+	for fd := listenFDsStart; fd < listenFDsStart+count; fd++ {
+		file := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			for _, listener := range listeners {
+				listener.Close()
+			}
+			return nil, fmt.Errorf("failed to use the socket passed by systemd on fd %d: %v", fd, err)
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+// listenUnix listens on a Unix socket, replacing the one a previous run left
+// behind, and gives it the permissions of SERVER_SOCKET_MODE (default 0660)
+// so a web frontend in the server's group can connect.
+func listenUnix(path string) (net.Listener, error) {
+	mode, err := strconv.ParseUint(utils.GetEnv("SERVER_SOCKET_MODE", "0660"), 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SERVER_SOCKET_MODE: %v", err)
+	}
+
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode().Type() != fs.ModeSocket {
+			return nil, fmt.Errorf("%s exists and isn't a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove stale socket %s: %v", path, err)
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, fs.FileMode(mode)); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to set the permissions of %s: %v", path, err)
+	}
+	return listener, nil
+}
+
+// fromUnixSocket reports whether a request came in over a Unix socket, so
+// from a process on the same host such as a web frontend.
+func fromUnixSocket(r *http.Request) bool {
+	addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	return ok && addr.Network() == "unix"
+}
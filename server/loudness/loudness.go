@@ -0,0 +1,211 @@
+// Package loudness measures integrated loudness as specified by ITU-R
+// BS.1770-4 and EBU R 128: audio is K-weighted, its power measured over
+// 400 ms blocks overlapping by 75%, and blocks are gated at -70 LUFS and then
+// 10 LU below the loudness of the blocks left, so that silences and quiet
+// passages don't drag the measure down.
+package loudness
+
+import "math"
+
+const (
+	stepMs       = 100 // blocks start every step
+	stepsA       = 4   // 400 ms blocks
+	absoluteGate = -70 // LUFS
+	relativeGate = -10 // LU below the loudness of the blocks above the absolute gate
+
+	// Blocks are counted in bins of binWidth LU from absoluteGate up to
+	// maxLoudness, so meters run in constant memory however long they
+	// measure. Louder blocks fall in the last bin.
+	binWidth    = 0.1
+	maxLoudness = 10
+	bins        = int((maxLoudness - absoluteGate) / binWidth)
+)
+
+// biquad is a second-order IIR filter in direct form I.
+type biquad struct {
+	b0, b1, b2, a1, a2 float64
+	x1, x2, y1, y2     float64
+}
+
+func (f *biquad) process(x float64) float64 {
+	y := f.b0*x + f.b1*f.x1 + f.b2*f.x2 - f.a1*f.y1 - f.a2*f.y2
+	f.x2, f.x1 = f.x1, x
+	f.y2, f.y1 = f.y1, y
+	return y
+}
+
+// kWeighting returns the two stages of the K-weighting filter at a sample
+// rate: a high shelf modelling the head, and a high-pass filter. Their
+// coefficients are derived from the analog prototypes BS.1770 specifies at
+// 48 kHz, so that any sample rate is measured alike.
+func kWeighting(sampleRate int) (shelf, highPass biquad) {
+	fs := float64(sampleRate)
+
+	const (
+		shelfF0   = 1681.974450955533
+		shelfGain = 3.999843853973347 // dB
+		shelfQ    = 0.7071752369554196
+	)
+	k := math.Tan(math.Pi * shelfF0 / fs)
+	vh := math.Pow(10, shelfGain/20)
+	vb := math.Pow(vh, 0.4996667741545416)
+	a0 := 1 + k/shelfQ + k*k
+	shelf = biquad{
+		b0: (vh + vb*k/shelfQ + k*k) / a0,
+		b1: 2 * (k*k - vh) / a0,
+		b2: (vh - vb*k/shelfQ + k*k) / a0,
+		a1: 2 * (k*k - 1) / a0,
+		a2: (1 - k/shelfQ + k*k) / a0,
+	}
+
+	const (
+		highPassF0 = 38.13547087602444
+		highPassQ  = 0.5003270373238773
+	)
+	k = math.Tan(math.Pi * highPassF0 / fs)
+	a0 = 1 + k/highPassQ + k*k
+	highPass = biquad{
+		b0: 1,
+		b1: -2,
+		b2: 1,
+		a1: 2 * (k*k - 1) / a0,
+		a2: (1 - k/highPassQ + k*k) / a0,
+	}
+	return shelf, highPass
+}
+
+// Meter measures the integrated loudness of audio fed to it in any number
+// of pieces. Channels are weighted equally, as left, right and centre
+// channels are; surround channels aren't told apart.
+type Meter struct {
+	filters  [][2]biquad // per channel
+	stepSize int         // samples per step
+	position int         // samples into the current step
+	power    []float64   // per channel, of the current step
+	steps    [][]float64 // power of the last steps, per channel
+	counts   [bins]int
+	energies [bins]float64 // sum of the mean power of the blocks in each bin
+}
+
+// NewMeter returns a meter of audio with the given sample rate and number of
+// channels.
+func NewMeter(sampleRate, channels int) *Meter {
+	m := &Meter{
+		filters:  make([][2]biquad, channels),
+		stepSize: max(sampleRate*stepMs/1000, 1),
+		power:    make([]float64, channels),
+	}
+	for i := range m.filters {
+		shelf, highPass := kWeighting(sampleRate)
+		m.filters[i] = [2]biquad{shelf, highPass}
+	}
+	return m
+}
+
+// Add measures more audio, one slice of samples in [-1, 1] per channel.
+// Slices shorter than the first are padded with silence, and extra channels
+// are ignored.
+func (m *Meter) Add(channels [][]float64) {
+	if len(channels) == 0 {
+		return
+	}
+	for i := range channels[0] {
+		for c := range m.filters {
+			x := 0.0
+			if c < len(channels) && i < len(channels[c]) {
+				x = channels[c][i]
+			}
+			y := m.filters[c][1].process(m.filters[c][0].process(x))
+			m.power[c] += y * y
+		}
+
+		m.position++
+		if m.position == m.stepSize {
+			m.endStep()
+		}
+	}
+}
+
+// endStep closes the current step, and counts the block ending with it.
+func (m *Meter) endStep() {
+	step := make([]float64, len(m.power))
+	for c := range m.power {
+		step[c] = m.power[c] / float64(m.stepSize)
+		m.power[c] = 0
+	}
+	m.position = 0
+
+	m.steps = append(m.steps, step)
+	if len(m.steps) > stepsA {
+		m.steps = m.steps[1:]
+	}
+	if len(m.steps) < stepsA {
+		return
+	}
+
+	energy := 0.0
+	for _, step := range m.steps {
+		for _, power := range step {
+			energy += power
+		}
+	}
+	energy /= stepsA
+
+	loudness := blockLoudness(energy)
+	if loudness < absoluteGate {
+		return
+	}
+	bin := min(int((loudness-absoluteGate)/binWidth), bins-1)
+	m.counts[bin]++
+	m.energies[bin] += energy
+}
+
+// blockLoudness converts the summed mean power of the channels of a block to
+// LUFS.
+func blockLoudness(energy float64) float64 {
+	if energy <= 0 {
+		return math.Inf(-1)
+	}
+	return -0.691 + 10*math.Log10(energy)
+}
+
+// Integrated returns the integrated loudness of the audio measured so far, in
+// LUFS, or false while no block was loud enough to count.
+func (m *Meter) Integrated() (float64, bool) {
+	gated := func(from int) (float64, int) {
+		energy, count := 0.0, 0
+		for bin := from; bin < bins; bin++ {
+			energy += m.energies[bin]
+			count += m.counts[bin]
+		}
+		return energy, count
+	}
+
+	energy, count := gated(0)
+	if count == 0 {
+		return 0, false
+	}
+	threshold := blockLoudness(energy/float64(count)) + relativeGate
+	from := max(int(math.Ceil((threshold-absoluteGate)/binWidth)), 0)
+
+	energy, count = gated(from)
+	if count == 0 {
+		return 0, false
+	}
+	return blockLoudness(energy / float64(count)), true
+}
+
+// Reset forgets the audio measured so far, keeping the filters' state so that
+// measuring can go on seamlessly.
+func (m *Meter) Reset() {
+	m.counts = [bins]int{}
+	m.energies = [bins]float64{}
+}
+
+// Measure returns the integrated loudness of audio, one slice of samples per
+// channel, in LUFS, or false if it is too short or quiet to be measured.
+func Measure(channels [][]float64, sampleRate int) (float64, bool) {
+	meter := NewMeter(sampleRate, len(channels))
+	meter.Add(channels)
+	return meter.Integrated()
+}
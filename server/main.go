@@ -6,9 +6,11 @@ import (
 	"fmt"
 	"log/slog"
 	"os"
+	"song-recognition/deps"
+	"song-recognition/tracklist"
 	"song-recognition/utils"
+	"strings"
 
-	"github.com/joho/godotenv"
 	"github.com/mdobak/go-xerrors"
 )
 
@@ -31,16 +33,33 @@ func main() {
 	}
 
 	if len(os.Args) < 2 {
-		fmt.Println("Expected 'find', 'download', 'erase', 'save', or 'serve' subcommands")
+		fmt.Println("Expected 'find', 'tracklist', 'download', 'erase', 'save', 'serve', 'replay-unmatched', 'admin', 'migrate', 'diff', 'export', 'import', 'schema', 'backup', 'restore', 'verify-index', 'reindex-all', or 'shadow' subcommands")
 		fmt.Println("\nUsage examples:")
 		fmt.Println("  find <path_to_wav_file>")
+		fmt.Println("  tracklist [--format <json|cue|youtube|podcast>] <path_to_recording>")
 		fmt.Println("  download <spotify_url>")
 		fmt.Println("  erase [db | all]  (default: db)")
-		fmt.Println("  save [-f|--force] <path_to_file_or_dir>")
-		fmt.Println("  serve [-proto <http|https>] [-p <port>]")
+		fmt.Println("  save [-f|--force] [--json] <path_to_file_or_dir>")
+		fmt.Println("  serve [-proto <http|https>] [-p <port>] [-socket <path>]")
+		fmt.Println("  replay-unmatched")
+		fmt.Println("  admin <prune-orphans | compact | reindex --song <id> | snapshot | failures list | failures retry | calibrate | forget-client --id <id> | purge | exclusions list|set|delete | monitors list|add|pause|resume|delete|recordings|simulcasts>")
+		fmt.Println("  migrate --from <backend> --to <backend> [--state <file>] [--restart] [--json]")
+		fmt.Println("  diff --a <backend[:location]> --b <backend[:location]> [--checksums] [--json]")
+		fmt.Println("  export --out <dir> | --archive <file> [--workers <n>] [--chunk-size <couples>] [--json]")
+		fmt.Println("  import --in <dir> | --archive <file> [--workers <n>] [--stage] [--allow-inconsistent] [--json]")
+		fmt.Println("  schema <status | upgrade> [--json]")
+		fmt.Println("  backup [--list] [--json]")
+		fmt.Println("  restore --from s3://<bucket>/<path> [--allow-inconsistent] [--json]")
+		fmt.Println("  reindex-all [--json]")
+		fmt.Println("  shadow build [--json]")
+		fmt.Println("  verify-index [--sample <n>] [--song <id>] [--archive <dir>] [--json]")
 		os.Exit(1)
 	}
-	_ = godotenv.Load()
+	_, _ = loadEnvFile()
+	if err := applyLogLevel(); err != nil {
+		fmt.Println(err)
+	}
+	checkDeps(os.Args[1])
 
 	switch os.Args[1] {
 	case "find":
@@ -50,6 +69,15 @@ func main() {
 		}
 		filePath := os.Args[2]
 		find(filePath)
+	case "tracklist":
+		tracklistCmd := flag.NewFlagSet("tracklist", flag.ExitOnError)
+		format := tracklistCmd.String("format", "json", "output format: "+strings.Join(tracklist.Formats(), ", "))
+		tracklistCmd.Parse(os.Args[2:])
+		if tracklistCmd.NArg() < 1 {
+			fmt.Println("Usage: main.go tracklist [--format <json|cue|youtube|podcast>] <path_to_recording>")
+			os.Exit(1)
+		}
+		printTracklist(tracklistCmd.Arg(0), *format)
 	case "download":
 		if len(os.Args) < 3 {
 			fmt.Println("Usage: main.go download <spotify_url>")
@@ -61,8 +89,9 @@ func main() {
 		serveCmd := flag.NewFlagSet("serve", flag.ExitOnError)
 		protocol := serveCmd.String("proto", "http", "Protocol to use (http or https)")
 		port := serveCmd.String("p", "5000", "Port to use")
+		socketPath := serveCmd.String("socket", utils.GetEnv("SERVER_SOCKET"), "Unix socket to listen on instead of the port")
 		serveCmd.Parse(os.Args[2:])
-		serve(*protocol, *port)
+		serve(*protocol, *port, *socketPath)
 	case "erase":
 		// Default is to clear only database (db mode)
 		dbOnly := true
@@ -90,21 +119,96 @@ func main() {
 		indexCmd := flag.NewFlagSet("save", flag.ExitOnError)
 		force := indexCmd.Bool("force", false, "save song with or without YouTube ID")
 		indexCmd.BoolVar(force, "f", false, "save song with or without YouTube ID (shorthand)")
+		asJSON := indexCmd.Bool("json", false, "print progress as JSON lines")
 		indexCmd.Parse(os.Args[2:])
 		if indexCmd.NArg() < 1 {
-			fmt.Println("Usage: main.go save [-f|--force] <path_to_wav_file_or_dir>")
+			fmt.Println("Usage: main.go save [-f|--force] [--json] <path_to_wav_file_or_dir>")
 			os.Exit(1)
 		}
 		filePath := indexCmd.Arg(0)
-		save(filePath, *force)
+		save(filePath, *force, newProgress("save", *asJSON))
+	case "replay-unmatched":
+		replayUnmatched()
+	case "admin":
+		admin(os.Args[2:])
+	case "migrate":
+		migrate(os.Args[2:])
+	case "diff":
+		diffCatalogs(os.Args[2:])
+	case "export":
+		exportCatalog(os.Args[2:])
+	case "import":
+		importCatalog(os.Args[2:])
+	case "schema":
+		schemaCommand(os.Args[2:])
+	case "backup":
+		backupCatalog(os.Args[2:])
+	case "restore":
+		restoreCatalog(os.Args[2:])
+	case "verify-index":
+		verifyIndex(os.Args[2:])
+	case "reindex-all":
+		reindexAll(os.Args[2:])
+	case "shadow":
+		shadowIndex(os.Args[2:])
 	default:
-		fmt.Println("Expected 'find', 'download', 'erase', 'save', or 'serve' subcommands")
+		fmt.Println("Expected 'find', 'tracklist', 'download', 'erase', 'save', 'serve', 'replay-unmatched', 'admin', 'migrate', 'diff', 'export', 'import', 'schema', 'backup', 'restore', 'verify-index', 'reindex-all', or 'shadow' subcommands")
 		fmt.Println("\nUsage examples:")
 		fmt.Println("  find <path_to_wav_file>")
+		fmt.Println("  tracklist [--format <json|cue|youtube|podcast>] <path_to_recording>")
 		fmt.Println("  download <spotify_url>")
 		fmt.Println("  erase [db | all]  (default: db)")
-		fmt.Println("  save [-f|--force] <path_to_file_or_dir>")
-		fmt.Println("  serve [-proto <http|https>] [-p <port>]")
+		fmt.Println("  save [-f|--force] [--json] <path_to_file_or_dir>")
+		fmt.Println("  serve [-proto <http|https>] [-p <port>] [-socket <path>]")
+		fmt.Println("  replay-unmatched")
+		fmt.Println("  admin <prune-orphans | compact | reindex --song <id> | snapshot | failures list | failures retry | calibrate | forget-client --id <id> | purge | exclusions list|set|delete | monitors list|add|pause|resume|delete|recordings|simulcasts>")
+		fmt.Println("  migrate --from <backend> --to <backend> [--state <file>] [--restart] [--json]")
+		fmt.Println("  diff --a <backend[:location]> --b <backend[:location]> [--checksums] [--json]")
+		fmt.Println("  export --out <dir> | --archive <file> [--workers <n>] [--chunk-size <couples>] [--json]")
+		fmt.Println("  import --in <dir> | --archive <file> [--workers <n>] [--stage] [--allow-inconsistent] [--json]")
+		fmt.Println("  schema <status | upgrade> [--json]")
+		fmt.Println("  backup [--list] [--json]")
+		fmt.Println("  restore --from s3://<bucket>/<path> [--allow-inconsistent] [--json]")
+		fmt.Println("  reindex-all [--json]")
+		fmt.Println("  shadow build [--json]")
+		fmt.Println("  verify-index [--sample <n>] [--song <id>] [--archive <dir>] [--json]")
 		os.Exit(1)
 	}
 }
+
+// checkDeps reports missing external tools once, before a command starts.
+// Commands that can't work without them exit; serve only warns since
+// recognising fingerprints doesn't need them. In pure-Go mode only download
+// is refused, the other commands fall back to the built-in WAV support.
+func checkDeps(command string) {
+	if deps.PureGo() {
+		if command == "download" {
+			fmt.Println(&deps.ErrRequiresExternalTool{Tool: deps.YtDlp, Feature: "download"})
+			os.Exit(1)
+		}
+		return
+	}
+
+	var required []deps.Tool
+	switch command {
+	case "download", "serve":
+		required = deps.All
+	case "find", "tracklist", "save", "verify-index", "reindex-all", "shadow":
+		required = []deps.Tool{deps.FFmpeg, deps.FFprobe}
+	default:
+		return
+	}
+
+	err := deps.Require(required...)
+	if err == nil {
+		return
+	}
+
+	if command == "serve" {
+		logger := utils.GetLogger()
+		logger.Warn(err.Error())
+		return
+	}
+	fmt.Println(err)
+	os.Exit(1)
+}
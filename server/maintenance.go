@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"song-recognition/db"
+	"song-recognition/exclusions"
+	"song-recognition/history"
+	"song-recognition/jobs"
+	"song-recognition/links"
+	"song-recognition/priority"
+	"song-recognition/utils"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/mdobak/go-xerrors"
+)
+
+// maintenanceTasks are the jobs the scheduler knows about. They run on the
+// schedules given in MAINTENANCE_SCHEDULE, or on demand through the admin API.
+var maintenanceTasks = map[string]jobs.Task{
+	"prune-orphans": inBackgroundTask(func(ctx context.Context) (string, error) {
+		orphans, err := pruneOrphans()
+		return fmt.Sprintf("removed the fingerprints of %d orphan songs", len(orphans)), err
+	}),
+	"compact": inBackgroundTask(func(ctx context.Context) (string, error) {
+		return "compacted", compact()
+	}),
+	"hotness": inBackgroundTask(func(ctx context.Context) (string, error) {
+		hotness, err := history.RefreshHotness()
+		return fmt.Sprintf("counted recognitions of %d songs", len(hotness.Counts)), err
+	}),
+	"rollups": inBackgroundTask(func(ctx context.Context) (string, error) {
+		days, err := history.RefreshRollups()
+		return fmt.Sprintf("rolled up %d days of recognitions", days), err
+	}),
+	"snapshot": inBackgroundTask(func(ctx context.Context) (string, error) {
+		return snapshot()
+	}),
+	"backup": inBackgroundTask(func(ctx context.Context) (string, error) {
+		result, err := runBackup(ctx)
+		return fmt.Sprintf("backed up %d songs and %d fingerprints to %s, deleted %d old backups",
+			result.Manifest.Songs, result.Manifest.Fingerprints, result.Location, len(result.Deleted)), err
+	}),
+	// Songs are ingested as background work one by one
+	"retry-failures": func(ctx context.Context) (string, error) {
+		retried, succeeded, skipped, err := retryFailures("")
+		return fmt.Sprintf("%d of %d failed ingestions succeeded, %d skipped while their dependencies are down", succeeded, retried, skipped), err
+	},
+	"shared-audio": inBackgroundTask(func(ctx context.Context) (string, error) {
+		report, err := exclusions.RefreshSharedAudio(ctx)
+		return fmt.Sprintf("found %d shared audio patterns", len(report.Shared)), err
+	}),
+	"refresh-index": inBackgroundTask(func(ctx context.Context) (string, error) {
+		augmented, reindexed, failed, err := refreshIndex()
+		return fmt.Sprintf("augmented %d songs and reindexed %d, %d failed", augmented, reindexed, failed), err
+	}),
+	"backfill-metadata": inBackgroundTask(func(ctx context.Context) (string, error) {
+		backfill, err := backfillMetadata(ctx)
+		return fmt.Sprintf("backfilled %d of %d songs, %d without audio or YouTube details, %d failed",
+			backfill.Updated, backfill.Done, backfill.Unavailable, backfill.Failed), err
+	}),
+	"youtube-links": inBackgroundTask(func(ctx context.Context) (string, error) {
+		report, err := links.Refresh(ctx)
+		return fmt.Sprintf("checked %d links: %d dead, %d blocked, %d changed, %d replaced, %d failed",
+			report.Checked, report.Dead, report.Blocked, report.Changed, report.Replaced, report.Failed), err
+	}),
+	"checksums": inBackgroundTask(func(ctx context.Context) (string, error) {
+		recorded, err := refreshChecksums()
+		return fmt.Sprintf("recorded the fingerprint checksums of %d songs", recorded), err
+	}),
+	"catalog-stats": inBackgroundTask(func(ctx context.Context) (string, error) {
+		stats, err := countCatalogStats()
+		return fmt.Sprintf("counted %d couples of %d songs", stats.Couples, stats.Songs), err
+	}),
+	"purge": inBackgroundTask(func(ctx context.Context) (string, error) {
+		recognitions, clips, err := purgeExpired()
+		return fmt.Sprintf("purged %d recognitions and %d clips", recognitions, clips), err
+	}),
+}
+
+// inBackgroundTask runs a task as background work, like inBackground does for
+// admin requests.
+func inBackgroundTask(task jobs.Task) jobs.Task {
+	return func(ctx context.Context) (string, error) {
+		release, err := priority.Acquire(ctx, priority.Background)
+		if err != nil {
+			return "", err
+		}
+		defer release()
+
+		return task(ctx)
+	}
+}
+
+var (
+	maintenanceOnce sync.Once
+	maintenance     *jobs.Scheduler
+)
+
+// getMaintenance returns the scheduler of maintenance jobs, configured by
+// MAINTENANCE_SCHEDULE: semicolon separated job=cron entries such as
+// "prune-orphans=0 3 * * *; snapshot=@daily". Jobs without an entry only run
+// on demand.
+func getMaintenance() *jobs.Scheduler {
+	maintenanceOnce.Do(func() {
+		logger := utils.GetLogger()
+		ctx := context.Background()
+
+		schedules := make(map[string]string)
+		for _, entry := range strings.Split(utils.GetEnv("MAINTENANCE_SCHEDULE"), ";") {
+			if strings.TrimSpace(entry) == "" {
+				continue
+			}
+			name, expr, _ := strings.Cut(entry, "=")
+			name = strings.TrimSpace(name)
+			if _, ok := maintenanceTasks[name]; !ok {
+				err := xerrors.New(fmt.Errorf("unknown job %q", name))
+				logger.ErrorContext(ctx, "invalid MAINTENANCE_SCHEDULE entry", slog.Any("error", err))
+				continue
+			}
+			schedules[name] = expr
+		}
+
+		maintenance = jobs.NewScheduler()
+		for name, task := range maintenanceTasks {
+			if err := maintenance.Add(name, schedules[name], task); err != nil {
+				err := xerrors.New(err)
+				logger.ErrorContext(ctx, "invalid MAINTENANCE_SCHEDULE entry", slog.Any("error", err))
+				maintenance.Add(name, "", task)
+			}
+		}
+	})
+	return maintenance
+}
+
+// startMaintenance runs the scheduled maintenance jobs in the background.
+func startMaintenance() {
+	getMaintenance().Start(context.Background())
+}
+
+func handleListJobs(w http.ResponseWriter, r *http.Request) {
+	statuses, err := getMaintenance().Statuses()
+	if err != nil {
+		handleAdminError(w, r, "failed to list jobs", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, statuses)
+}
+
+func handleListJobRuns(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !getMaintenance().Has(name) {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("unknown job %q", name))
+		return
+	}
+
+	runs, err := jobs.Runs(name)
+	if err != nil {
+		handleAdminError(w, r, "failed to list runs", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, runs)
+}
+
+func handleRunJob(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !getMaintenance().Has(name) {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("unknown job %q", name))
+		return
+	}
+
+	run, err := getMaintenance().Run(r.Context(), name, jobs.TriggerManual)
+	if errors.Is(err, jobs.ErrRunning) {
+		writeError(w, http.StatusConflict, fmt.Sprintf("job %s is already running", name))
+		return
+	}
+	if err != nil {
+		handleAdminError(w, r, "failed to run job", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, run)
+}
+
+func handleGetHotness(w http.ResponseWriter, r *http.Request) {
+	hotness, exists, err := history.GetHotness()
+	if err != nil {
+		handleAdminError(w, r, "failed to read hotness", err)
+		return
+	}
+	if !exists {
+		writeError(w, http.StatusNotFound, "hotness hasn't been computed yet, run the hotness job")
+		return
+	}
+	writeJSON(w, http.StatusOK, hotness)
+}
+
+// handleListLinks lists the last checks of the YouTube links of songs,
+// optionally only those with a status (e.g. ?status=dead).
+func handleListLinks(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	switch status {
+	case "", links.StatusAvailable, links.StatusDead, links.StatusBlocked:
+	default:
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid status %q", status))
+		return
+	}
+
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		handleAdminError(w, r, "failed to list links", err)
+		return
+	}
+	defer dbClient.Close()
+
+	checks, err := links.List(dbClient, status)
+	if err != nil {
+		handleAdminError(w, r, "failed to list links", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, checks)
+}
+
+func handleGetSharedAudio(w http.ResponseWriter, r *http.Request) {
+	report, exists, err := exclusions.GetSharedAudio()
+	if err != nil {
+		handleAdminError(w, r, "failed to read shared audio report", err)
+		return
+	}
+	if !exists {
+		writeError(w, http.StatusNotFound, "shared audio hasn't been looked for yet, run the shared-audio job")
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+// handleExcludeSharedAudio excludes a pattern of the last shared audio report
+// from matching in every song it was found in.
+func handleExcludeSharedAudio(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid shared audio ID")
+		return
+	}
+
+	report, _, err := exclusions.GetSharedAudio()
+	if err != nil {
+		handleAdminError(w, r, "failed to read shared audio report", err)
+		return
+	}
+	for _, shared := range report.Shared {
+		if shared.ID != id {
+			continue
+		}
+		rules, err := exclusions.ExcludeShared(shared, fmt.Sprintf("shared audio %d", id))
+		if err != nil {
+			handleAdminError(w, r, "failed to save exclusions", err)
+			return
+		}
+		writeJSON(w, http.StatusOK, rules)
+		return
+	}
+	writeError(w, http.StatusNotFound, fmt.Sprintf("no shared audio %d in the last report", id))
+}
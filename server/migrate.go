@@ -0,0 +1,346 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"slices"
+	"song-recognition/db"
+	"song-recognition/models"
+	"sort"
+)
+
+const (
+	migrateBatchSize     = 5000
+	migrateSampleSize    = 500 // addresses spot-checked after migrating
+	migrateSongSamples   = 100 // songs spot-checked after migrating
+	migrateProgressEvery = 20
+)
+
+// migrationState is saved after every batch so an interrupted migration
+// resumes where it stopped. Writes are idempotent, so redoing the batch that
+// was in flight is harmless.
+type migrationState struct {
+	From         string `json:"from"`
+	To           string `json:"to"`
+	SongsDone    bool   `json:"songsDone"`
+	Songs        int    `json:"songs"`
+	Fingerprints int64  `json:"fingerprints"` // couples copied, in source order
+}
+
+func (s *migrationState) save(path string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func loadMigrationState(path, from, to string) (*migrationState, error) {
+	state := &migrationState{From: from, To: to}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("invalid state file %s: %v", path, err)
+	}
+	if state.From != from || state.To != to {
+		return nil, fmt.Errorf("state file %s belongs to a migration from %s to %s; use -restart to discard it", path, state.From, state.To)
+	}
+	return state, nil
+}
+
+// migrate copies songs and fingerprints between two storage backends. Each
+// backend is configured like DB_TYPE would be, with FROM_ and TO_ prefixed
+// variables (e.g. FROM_DB_HOST) taking precedence.
+func migrate(args []string) {
+	migrateCmd := flag.NewFlagSet("migrate", flag.ExitOnError)
+	from := migrateCmd.String("from", "", "source backend (sqlite, bolt, mongo, mysql, postgres, clickhouse, cassandra)")
+	to := migrateCmd.String("to", "", "target backend")
+	statePath := migrateCmd.String("state", "migrate_state.json", "file recording progress for resuming")
+	restart := migrateCmd.Bool("restart", false, "ignore previous progress")
+	asJSON := migrateCmd.Bool("json", false, "print progress as JSON lines")
+	migrateCmd.Parse(args)
+
+	if *from == "" || *to == "" {
+		fmt.Println("Usage: main.go migrate --from <backend> --to <backend> [--state <file>] [--restart] [--json]")
+		os.Exit(1)
+	}
+	progress := newProgress("migrate", *asJSON)
+
+	if *restart {
+		os.Remove(*statePath)
+	}
+	state, err := loadMigrationState(*statePath, *from, *to)
+	if err != nil {
+		yellow.Println("Error:", err)
+		progress.finish(err)
+		os.Exit(1)
+	}
+
+	source, err := db.NewDBClientFor(*from, "FROM_")
+	if err != nil {
+		yellow.Println("Error connecting to source:", err)
+		progress.finish(err)
+		os.Exit(1)
+	}
+	defer source.Close()
+
+	target, err := db.NewDBClientFor(*to, "TO_")
+	if err != nil {
+		yellow.Println("Error connecting to target:", err)
+		progress.finish(err)
+		os.Exit(1)
+	}
+	defer target.Close()
+
+	if err := migrateSongs(source, target, state, *statePath, progress); err != nil {
+		yellow.Println("Error migrating songs:", err)
+		progress.finish(err)
+		os.Exit(1)
+	}
+
+	sample, err := migrateFingerprints(source, target, state, *statePath, progress)
+	if err != nil {
+		yellow.Println("Error migrating fingerprints:", err)
+		fmt.Println("Run the same command again to resume.")
+		progress.finish(err)
+		os.Exit(1)
+	}
+
+	fmt.Println("Verifying...")
+	progress.startStage("verify", 0)
+	if err := verifyMigration(source, target, state, sample); err != nil {
+		yellow.Println("Verification failed:", err)
+		progress.finish(err)
+		os.Exit(1)
+	}
+
+	os.Remove(*statePath)
+	fmt.Printf("Migrated %d songs and %d fingerprints from %s to %s.\n", state.Songs, state.Fingerprints, *from, *to)
+	progress.finish(nil)
+}
+
+func migrateSongs(source, target db.DBClient, state *migrationState, statePath string, progress *progress) error {
+	if state.SongsDone {
+		return nil
+	}
+
+	total, err := source.TotalSongs()
+	if err != nil {
+		return err
+	}
+
+	state.Songs = 0
+	progress.startStage("songs", int64(total))
+	err = source.ForEachSong(func(songID models.SongID, song db.Song) error {
+		if err := target.StoreSong(songID, song); err != nil {
+			return err
+		}
+		state.Songs++
+		progress.add(1)
+		if state.Songs%migrateProgressEvery == 0 || state.Songs == total {
+			fmt.Printf("\rSongs: %d/%d", state.Songs, total)
+		}
+		return nil
+	})
+	fmt.Println()
+	if err != nil {
+		return err
+	}
+
+	state.SongsDone = true
+	return state.save(statePath)
+}
+
+// migrateFingerprints streams couples from source to target in batches,
+// skipping the ones copied by a previous run. It returns a random sample of
+// the addresses seen, for verification.
+func migrateFingerprints(source, target db.DBClient, state *migrationState, statePath string, progress *progress) ([]uint32, error) {
+	var (
+		seen    int64
+		batch   = make(map[uint32]models.Couple, migrateBatchSize)
+		sample  []uint32
+		batches int
+	)
+
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := target.StoreFingerprints(batch); err != nil {
+			return err
+		}
+		state.Fingerprints += int64(len(batch))
+		progress.add(int64(len(batch)))
+		clear(batch)
+
+		batches++
+		if batches%migrateProgressEvery == 0 {
+			fmt.Printf("\rFingerprints: %d", state.Fingerprints)
+		}
+		return state.save(statePath)
+	}
+
+	// The number of couples isn't known up front, so there is no ETA
+	progress.startStage("fingerprints", 0)
+	progress.add(state.Fingerprints)
+	err := source.ForEachFingerprint(func(address uint32, couple models.Couple) error {
+		seen++
+		if seen <= state.Fingerprints {
+			return nil
+		}
+
+		// Reservoir sampling of the copied addresses
+		copied := seen - state.Fingerprints
+		if len(sample) < migrateSampleSize {
+			sample = append(sample, address)
+		} else if i := rand.Int63n(copied); i < migrateSampleSize {
+			sample[i] = address
+		}
+
+		// A batch holds a single couple per address
+		if _, exists := batch[address]; exists || len(batch) >= migrateBatchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		batch[address] = couple
+		return nil
+	})
+	if err == nil {
+		err = flush()
+	}
+	fmt.Printf("\rFingerprints: %d\n", state.Fingerprints)
+
+	return sample, err
+}
+
+// verifyMigration compares song and couple counts, the fingerprints of every
+// song the source recorded a checksum for, and spot-checks a sample of songs
+// and addresses. Once verified, the checksums of the target are recorded.
+func verifyMigration(source, target db.DBClient, state *migrationState, sample []uint32) error {
+	sourceSongs, err := source.TotalSongs()
+	if err != nil {
+		return err
+	}
+	targetSongs, err := target.TotalSongs()
+	if err != nil {
+		return err
+	}
+	if sourceSongs != targetSongs {
+		return fmt.Errorf("source has %d songs but target has %d", sourceSongs, targetSongs)
+	}
+
+	targetChecksums, err := db.ScanFingerprintChecksums(target)
+	if err != nil {
+		return err
+	}
+	var targetFingerprints int64
+	for _, checksum := range targetChecksums {
+		targetFingerprints += checksum.Couples
+	}
+	if targetFingerprints != state.Fingerprints {
+		return fmt.Errorf("copied %d fingerprints but target has %d", state.Fingerprints, targetFingerprints)
+	}
+
+	// Checksums are compared without reading the fingerprints of the source
+	sourceChecksums, err := db.ReadFingerprintChecksums(source)
+	if err != nil {
+		return err
+	}
+	var diverged []models.SongID
+	for songID, want := range sourceChecksums {
+		if targetChecksums[songID] != want {
+			diverged = append(diverged, songID)
+		}
+	}
+	if len(diverged) > 0 {
+		slices.Sort(diverged)
+		songID := diverged[0]
+		return fmt.Errorf("fingerprints of %d songs differ, such as song %d: source checksum %v, target %v",
+			len(diverged), songID, sourceChecksums[songID], targetChecksums[songID])
+	}
+
+	var songIDs []models.SongID
+	err = source.ForEachSong(func(songID models.SongID, _ db.Song) error {
+		songIDs = append(songIDs, songID)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	rand.Shuffle(len(songIDs), func(i, j int) { songIDs[i], songIDs[j] = songIDs[j], songIDs[i] })
+	for _, songID := range songIDs[:min(len(songIDs), migrateSongSamples)] {
+		want, _, err := source.GetSongByID(songID)
+		if err != nil {
+			return err
+		}
+		got, exists, err := target.GetSongByID(songID)
+		if err != nil {
+			return err
+		}
+		if !exists || got != want {
+			return fmt.Errorf("song %d differs: source %+v, target %+v", songID, want, got)
+		}
+	}
+
+	want, err := source.GetCouples(sample)
+	if err != nil {
+		return err
+	}
+	got, err := target.GetCouples(sample)
+	if err != nil {
+		return err
+	}
+	for _, address := range sample {
+		if !sameCouples(want[address], got[address]) {
+			return fmt.Errorf("couples of address %d differ: source %v, target %v", address, want[address], got[address])
+		}
+	}
+
+	if _, err := db.RecordFingerprintChecksums(target, targetChecksums); err != nil {
+		return fmt.Errorf("failed to record fingerprint checksums: %v", err)
+	}
+	fmt.Printf("Counts match; checked the fingerprints of %d songs by checksum and spot-checked %d songs and %d addresses.\n",
+		len(sourceChecksums), min(len(songIDs), migrateSongSamples), len(sample))
+	return nil
+}
+
+func sameCouples(a, b []models.Couple) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	sorted := func(couples []models.Couple) []models.Couple {
+		couples = append([]models.Couple(nil), couples...)
+		sort.Slice(couples, func(i, j int) bool {
+			if couples[i].SongID != couples[j].SongID {
+				return couples[i].SongID < couples[j].SongID
+			}
+			return couples[i].AnchorTimeMs < couples[j].AnchorTimeMs
+		})
+		return couples
+	}
+
+	a, b = sorted(a), sorted(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
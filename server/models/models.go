@@ -1,8 +1,41 @@
 package models
 
+// Couple payload versions. Version 1 couples only hold the anchor time and
+// the song; version 2 couples also describe the anchor peak. Backends store
+// both, version 1 couples having a zero peak code.
+const (
+	CoupleV1 = 1
+	CoupleV2 = 2
+)
+
 type Couple struct {
 	AnchorTimeMs uint32
-	SongID       uint32
+	// Band is 1 + the index of the frequency band of the anchor peak, 0 in
+	// version 1 couples.
+	Band uint8
+	// Magnitude is how far the anchor peak rises above the average level of
+	// the band peaks of its frame, in half decibels.
+	Magnitude uint8
+	SongID    SongID
+}
+
+// Version returns the payload version of the couple.
+func (c Couple) Version() int {
+	if c.Band == 0 {
+		return CoupleV1
+	}
+	return CoupleV2
+}
+
+// PeakCode packs the peak details of the couple into the integer backends
+// store, 0 for version 1 couples.
+func (c Couple) PeakCode() uint16 {
+	return uint16(c.Band)<<8 | uint16(c.Magnitude)
+}
+
+// SetPeakCode sets the peak details of the couple from a PeakCode.
+func (c *Couple) SetPeakCode(code uint16) {
+	c.Band, c.Magnitude = uint8(code>>8), uint8(code)
 }
 
 type RecordData struct {
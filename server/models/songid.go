@@ -0,0 +1,166 @@
+package models
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"song-recognition/utils"
+	"strconv"
+	"strings"
+)
+
+// SongID identifies a song of the catalog. New IDs are drawn according to the
+// scheme set with SONG_ID_SCHEME, see NewSongID. Storage keeps the number;
+// in JSON, IDs are numbers, or UUID strings with the uuid scheme.
+type SongID uint64
+
+// String returns the decimal form of the ID, which storage keys records by.
+func (id SongID) String() string {
+	return strconv.FormatUint(uint64(id), 10)
+}
+
+// UUID returns the ID as a version 8 UUID, the layout reserved for custom
+// IDs. Its last 62 bits hold the low bits of the ID and the nibble after its
+// version the two high ones; the others are zero, apart from the variant.
+func (id SongID) UUID() string {
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[8:], uint64(id)&(1<<62-1))
+	b[6] = 0x80 | byte(id>>62)
+	b[8] |= 0x80
+	h := hex.EncodeToString(b[:])
+	return h[:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+}
+
+// ParseSongID parses the decimal or UUID form of a song ID.
+func ParseSongID(s string) (SongID, error) {
+	if len(s) == 36 {
+		return parseSongUUID(s)
+	}
+	id, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid song ID %q", s)
+	}
+	return SongID(id), nil
+}
+
+func parseSongUUID(s string) (SongID, error) {
+	invalid := fmt.Errorf("invalid song ID %q", s)
+	if s[8] != '-' || s[13] != '-' || s[18] != '-' || s[23] != '-' {
+		return 0, invalid
+	}
+	b, err := hex.DecodeString(strings.ReplaceAll(s, "-", ""))
+	if err != nil || b[6]&0xf0 != 0x80 || b[8]&0xc0 != 0x80 {
+		return 0, invalid
+	}
+	for _, c := range b[:6] {
+		if c != 0 {
+			return 0, invalid
+		}
+	}
+	if b[6]&0x0f > 3 || b[7] != 0 {
+		return 0, invalid
+	}
+	b[8] &^= 0xc0
+	return SongID(uint64(b[6]&0x0f)<<62 | binary.BigEndian.Uint64(b[8:])), nil
+}
+
+// MarshalJSON writes the ID as a number, or as a UUID with the uuid scheme.
+func (id SongID) MarshalJSON() ([]byte, error) {
+	if scheme, _ := SongIDScheme(); scheme == SongIDsUUID {
+		return json.Marshal(id.UUID())
+	}
+	return []byte(id.String()), nil
+}
+
+// UnmarshalJSON reads an ID written as a number or as a string of either
+// form, so data written under any scheme can be read.
+func (id *SongID) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+	s := string(data)
+	if len(data) > 0 && data[0] == '"' {
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+	}
+	parsed, err := ParseSongID(s)
+	if err != nil {
+		return err
+	}
+	*id = parsed
+	return nil
+}
+
+// MarshalText writes IDs used as JSON object keys the way MarshalJSON does.
+func (id SongID) MarshalText() ([]byte, error) {
+	if scheme, _ := SongIDScheme(); scheme == SongIDsUUID {
+		return []byte(id.UUID()), nil
+	}
+	return []byte(id.String()), nil
+}
+
+// UnmarshalText reads the decimal or UUID form of an ID.
+func (id *SongID) UnmarshalText(text []byte) error {
+	parsed, err := ParseSongID(string(text))
+	if err != nil {
+		return err
+	}
+	*id = parsed
+	return nil
+}
+
+// Song ID schemes
+const (
+	// SongIDsUint32 draws random 32-bit IDs, as catalogs always have.
+	SongIDsUint32 = "uint32"
+	// SongIDsUint64 draws random IDs below 2^53, which stay exact as JSON
+	// numbers in JavaScript clients, for catalogs growing past the point
+	// where 32-bit IDs collide.
+	SongIDsUint64 = "uint64"
+	// SongIDsUUID draws random 63-bit IDs, written as UUIDs in the API and
+	// JSON, for catalogs that are merged or whose clients treat IDs as
+	// opaque strings. They are still 63-bit integers: UUIDs that don't
+	// follow the layout of SongID.UUID aren't song IDs.
+	SongIDsUUID = "uuid"
+)
+
+// MaxSongID32 is the largest song ID of the uint32 scheme, and the largest
+// one the MySQL and ClickHouse schemas can store.
+const MaxSongID32 = 1<<32 - 1
+
+const maxSongID64 = 1<<53 - 1
+
+// maxSongIDUUID is the largest ID of the uuid scheme, which every backend
+// with 64-bit song IDs stores as a signed integer.
+const maxSongIDUUID = 1<<63 - 1
+
+// SongIDScheme returns the scheme new song IDs are drawn with, from
+// SONG_ID_SCHEME (default "uint32").
+func SongIDScheme() (string, error) {
+	switch scheme := utils.GetEnv("SONG_ID_SCHEME", SongIDsUint32); scheme {
+	case SongIDsUint32, "":
+		return SongIDsUint32, nil
+	case SongIDsUint64:
+		return SongIDsUint64, nil
+	case SongIDsUUID:
+		return SongIDsUUID, nil
+	default:
+		return "", fmt.Errorf("unsupported SONG_ID_SCHEME %q, expected %q, %q or %q", scheme, SongIDsUint32, SongIDsUint64, SongIDsUUID)
+	}
+}
+
+// NewSongID draws a random, non-zero ID for a new song. An invalid
+// SONG_ID_SCHEME falls back to the uint32 scheme; it is rejected when
+// connecting to the database.
+func NewSongID() SongID {
+	switch scheme, _ := SongIDScheme(); scheme {
+	case SongIDsUint64:
+		return SongID(rand.Int63n(maxSongID64) + 1)
+	case SongIDsUUID:
+		return SongID(rand.Int63n(maxSongIDUUID) + 1)
+	}
+	return SongID(rand.Int63n(MaxSongID32) + 1)
+}
@@ -0,0 +1,213 @@
+package monitor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"song-recognition/db"
+	"song-recognition/utils"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const collection = "monitors"
+
+// Sources of monitor configurations.
+const (
+	SourceAPI  = "api"  // managed through the admin API, stored in the database
+	SourceFile = "file" // listed in MONITORS_FILE
+)
+
+var (
+	// ErrNotFound is returned for monitors that aren't configured.
+	ErrNotFound = errors.New("monitor not found")
+	// ErrReadOnly is returned when changing a monitor listed in MONITORS_FILE.
+	ErrReadOnly = errors.New("monitor is defined in MONITORS_FILE")
+)
+
+var idPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// Config describes a stream to monitor.
+type Config struct {
+	ID              string    `json:"id"`
+	Name            string    `json:"name"`
+	URL             string    `json:"url"`
+	Stream          string    `json:"stream,omitempty"` // name matches are published under, the ID by default
+	Paused          bool      `json:"paused"`
+	AlertWebhookURL string    `json:"alertWebhookUrl,omitempty"` // notified of alerts, besides MONITOR_WEBHOOK_URL
+	Loudness        bool      `json:"loudness,omitempty"`        // measure the loudness of the stream and of each track
+	Record          bool      `json:"record,omitempty"`          // keep the stream in rotating files
+	Source          string    `json:"source"`
+	CreatedAt       time.Time `json:"createdAt"`
+	UpdatedAt       time.Time `json:"updatedAt"`
+}
+
+// StreamName returns the name the matches of the monitor are published
+// under.
+func (c Config) StreamName() string {
+	if c.Stream != "" {
+		return c.Stream
+	}
+	return c.ID
+}
+
+// Validate checks the ID and URLs of the monitor.
+func (c Config) Validate() error {
+	if !idPattern.MatchString(c.ID) {
+		return fmt.Errorf("id must be 1 to 64 letters, digits, '-' or '_'")
+	}
+	if c.ID == "simulcasts" {
+		return fmt.Errorf("id simulcasts is reserved")
+	}
+	u, err := url.Parse(c.URL)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("url must be an absolute stream URL")
+	}
+	if c.AlertWebhookURL != "" {
+		u, err := url.Parse(c.AlertWebhookURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("alertWebhookUrl must be an http or https URL")
+		}
+	}
+	if len(c.Stream) > 128 {
+		return fmt.Errorf("stream must be at most 128 characters")
+	}
+	return nil
+}
+
+// NewID returns an ID for a monitor created without one.
+func NewID() string {
+	return strconv.FormatUint(uint64(utils.GenerateUniqueID()), 10)
+}
+
+// fileConfigs reads the monitors listed in MONITORS_FILE, a JSON array of
+// configurations.
+func fileConfigs() ([]Config, error) {
+	path := utils.GetEnv("MONITORS_FILE")
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read MONITORS_FILE: %v", err)
+	}
+
+	var configs []Config
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, fmt.Errorf("failed to parse MONITORS_FILE: %v", err)
+	}
+	for i := range configs {
+		configs[i].Source = SourceFile
+		if err := configs[i].Validate(); err != nil {
+			return nil, fmt.Errorf("invalid monitor %q in MONITORS_FILE: %v", configs[i].ID, err)
+		}
+	}
+	return configs, nil
+}
+
+// List returns every configured monitor, sorted by ID. Monitors of
+// MONITORS_FILE take precedence over stored ones with the same ID.
+func List() ([]Config, error) {
+	configs, err := fileConfigs()
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool, len(configs))
+	for _, config := range configs {
+		seen[config.ID] = true
+	}
+
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		return nil, err
+	}
+	defer dbClient.Close()
+
+	records, err := dbClient.ListRecords(collection, db.RecordFilter{})
+	if err != nil {
+		return nil, err
+	}
+	for _, record := range records {
+		var config Config
+		if err := json.Unmarshal(record.Data, &config); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal monitor %s: %v", record.ID, err)
+		}
+		if !seen[config.ID] {
+			configs = append(configs, config)
+		}
+	}
+
+	sort.Slice(configs, func(i, j int) bool { return configs[i].ID < configs[j].ID })
+	return configs, nil
+}
+
+// Get returns the configuration of a monitor.
+func Get(id string) (Config, error) {
+	configs, err := List()
+	if err != nil {
+		return Config{}, err
+	}
+	for _, config := range configs {
+		if config.ID == id {
+			return config, nil
+		}
+	}
+	return Config{}, ErrNotFound
+}
+
+// Save stores the configuration of a monitor managed through the API,
+// creating it or replacing it.
+func Save(config Config) (Config, error) {
+	if err := config.Validate(); err != nil {
+		return config, err
+	}
+	existing, err := Get(config.ID)
+	switch {
+	case err == nil && existing.Source == SourceFile:
+		return config, ErrReadOnly
+	case err == nil:
+		config.CreatedAt = existing.CreatedAt
+	case errors.Is(err, ErrNotFound):
+		config.CreatedAt = time.Now().UTC()
+	default:
+		return config, err
+	}
+	config.Source = SourceAPI
+	config.UpdatedAt = time.Now().UTC()
+
+	data, err := json.Marshal(config)
+	if err != nil {
+		return config, fmt.Errorf("failed to marshal monitor: %v", err)
+	}
+
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		return config, err
+	}
+	defer dbClient.Close()
+
+	return config, dbClient.PutRecord(collection, db.Record{ID: config.ID, CreatedAt: config.CreatedAt, Data: data})
+}
+
+// Delete removes a monitor managed through the API.
+func Delete(id string) error {
+	existing, err := Get(id)
+	if err != nil {
+		return err
+	}
+	if existing.Source == SourceFile {
+		return ErrReadOnly
+	}
+
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		return err
+	}
+	defer dbClient.Close()
+
+	return dbClient.DeleteRecord(collection, id)
+}
@@ -0,0 +1,54 @@
+package monitor
+
+import (
+	"encoding/binary"
+	"math"
+	"time"
+)
+
+// minLevel is the level reported for digital silence, in dBFS.
+const minLevel = -120
+
+// level returns the RMS level of 16-bit little-endian PCM, in dBFS.
+func level(pcm []byte) float64 {
+	n := len(pcm) / 2
+	if n == 0 {
+		return minLevel
+	}
+	sum := 0.0
+	for i := 0; i < n; i++ {
+		sample := float64(int16(binary.LittleEndian.Uint16(pcm[2*i:]))) / 32768
+		sum += sample * sample
+	}
+	rms := math.Sqrt(sum / float64(n))
+	if rms == 0 {
+		return minLevel
+	}
+	return max(20*math.Log10(rms), minLevel)
+}
+
+// measure records the level of a stretch of audio that came in, lasting
+// length, and returns the event to alert about, if any: "monitor.dead_air"
+// once the stream stayed below the dead air threshold for long enough, and
+// "monitor.dead_air_ended" when it rises above it again.
+func (w *worker) measure(level float64, length time.Duration, settings healthSettings) string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.health.Level = level
+
+	if level >= settings.DeadAirThreshold {
+		w.quiet = 0
+		if w.health.DeadAir {
+			w.health.DeadAir = false
+			return "monitor.dead_air_ended"
+		}
+		return ""
+	}
+
+	w.quiet += length
+	if !w.health.DeadAir && w.quiet >= settings.DeadAirAfter {
+		w.health.DeadAir = true
+		return "monitor.dead_air"
+	}
+	return ""
+}
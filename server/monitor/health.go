@@ -0,0 +1,240 @@
+package monitor
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"song-recognition/utils"
+	"song-recognition/webhook"
+	"strconv"
+	"time"
+
+	"github.com/mdobak/go-xerrors"
+)
+
+// State is where a monitor stands with its stream.
+type State string
+
+const (
+	StateConnecting   State = "connecting"   // first connection to the stream
+	StateStreaming    State = "streaming"    // audio is coming in
+	StateStalled      State = "stalled"      // the stream stopped sending audio
+	StateReconnecting State = "reconnecting" // connecting again after the stream ended or stalled
+	StateFailed       State = "failed"       // too many connections in a row failed; still retrying
+)
+
+// States lists every state, in the order they are reported in.
+var States = []State{StateConnecting, StateStreaming, StateStalled, StateReconnecting, StateFailed}
+
+// Health describes the connection of a running monitor to its stream.
+type Health struct {
+	State       State     `json:"state"`
+	Since       time.Time `json:"since"` // when the monitor entered its state
+	StartedAt   time.Time `json:"startedAt"`
+	LastAudioAt time.Time `json:"lastAudioAt"` // zero until audio comes in
+	// Reconnects counts connections after the first one, and Failures the
+	// connections in a row that ended without any audio.
+	Reconnects int    `json:"reconnects"`
+	Failures   int    `json:"failures"`
+	LastError  string `json:"lastError,omitempty"`
+	// Silent is set once the silence alert was sent, until audio comes back.
+	Silent bool `json:"silent"`
+	// Level is the RMS level of the last audio that came in, in dBFS, and
+	// DeadAir is set while it stays below the dead air threshold.
+	Level   float64 `json:"levelDb"`
+	DeadAir bool    `json:"deadAir"`
+	// LoudnessLUFS is the integrated loudness of the stream since the monitor
+	// started, for monitors measuring loudness.
+	LoudnessLUFS *float64 `json:"loudnessLufs,omitempty"`
+}
+
+// healthSettings configure how monitors judge their streams.
+type healthSettings struct {
+	StallTimeout     time.Duration
+	SilenceAlert     time.Duration
+	FailureThreshold int
+	DeadAirThreshold float64 // in dBFS
+	DeadAirAfter     time.Duration
+	WebhookURL       string
+}
+
+// loadHealthSettings reads MONITOR_STALL_TIMEOUT (default 30s),
+// MONITOR_SILENCE_ALERT (default 5m), MONITOR_FAILURE_THRESHOLD (default 5),
+// MONITOR_DEAD_AIR_THRESHOLD (default -50 dBFS), MONITOR_DEAD_AIR_AFTER
+// (default 30s) and MONITOR_WEBHOOK_URL.
+func loadHealthSettings() healthSettings {
+	parse := func(key string, fallback time.Duration) time.Duration {
+		d, err := time.ParseDuration(utils.GetEnv(key, fallback.String()))
+		if err != nil || d <= 0 {
+			return fallback
+		}
+		return d
+	}
+
+	threshold, err := strconv.Atoi(utils.GetEnv("MONITOR_FAILURE_THRESHOLD", "5"))
+	if err != nil || threshold < 1 {
+		threshold = 5
+	}
+	deadAir, err := strconv.ParseFloat(utils.GetEnv("MONITOR_DEAD_AIR_THRESHOLD", "-50"), 64)
+	if err != nil || deadAir > 0 {
+		deadAir = -50
+	}
+	return healthSettings{
+		StallTimeout:     parse("MONITOR_STALL_TIMEOUT", 30*time.Second),
+		SilenceAlert:     parse("MONITOR_SILENCE_ALERT", 5*time.Minute),
+		FailureThreshold: threshold,
+		DeadAirThreshold: deadAir,
+		DeadAirAfter:     parse("MONITOR_DEAD_AIR_AFTER", 30*time.Second),
+		WebhookURL:       utils.GetEnv("MONITOR_WEBHOOK_URL"),
+	}
+}
+
+// retryBackoff returns how long to wait before reconnecting after failures
+// connections in a row without audio: retryDelay, doubling up to maxRetryDelay.
+func retryBackoff(failures int) time.Duration {
+	delay := retryDelay
+	for i := 1; i < failures && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, maxRetryDelay)
+}
+
+// setState moves the worker to a state. Failed monitors stay failed while
+// they reconnect, until audio comes in again.
+func (w *worker) setState(state State) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.health.State == state || (w.health.State == StateFailed && state == StateReconnecting) {
+		return
+	}
+	w.health.State = state
+	w.health.Since = time.Now().UTC()
+}
+
+// connecting records a connection attempt.
+func (w *worker) connecting() {
+	w.mu.Lock()
+	first := w.health.StartedAt.IsZero()
+	if first {
+		w.health.StartedAt = time.Now().UTC()
+	} else {
+		w.health.Reconnects++
+	}
+	w.mu.Unlock()
+
+	if first {
+		w.setState(StateConnecting)
+	} else {
+		w.setState(StateReconnecting)
+	}
+}
+
+// heard records audio coming in, and returns whether the stream was silent
+// long enough to have been alerted about.
+func (w *worker) heard() (wasSilent bool) {
+	w.mu.Lock()
+	w.health.LastAudioAt = time.Now().UTC()
+	w.health.Failures = 0
+	w.health.LastError = ""
+	wasSilent = w.health.Silent
+	w.health.Silent = false
+	streaming := w.health.State == StateStreaming
+	w.mu.Unlock()
+
+	if !streaming {
+		w.setState(StateStreaming)
+	}
+	return wasSilent
+}
+
+// disconnected records the end of a connection and returns the failures in a
+// row so far, marking the monitor failed once they reach threshold. Streams
+// that ended on their own are reconnecting from then on.
+func (w *worker) disconnected(err error, streamed bool, threshold int) int {
+	w.mu.Lock()
+	if err != nil {
+		w.health.LastError = err.Error()
+	}
+	if !streamed {
+		w.health.Failures++
+	}
+	failures := w.health.Failures
+	streaming := w.health.State == StateStreaming
+	w.mu.Unlock()
+
+	switch {
+	case failures >= threshold:
+		w.setState(StateFailed)
+	case streaming:
+		w.setState(StateReconnecting)
+	}
+	return failures
+}
+
+// silentFor returns how long the stream has gone without audio, counting
+// from the start of the monitor if it never had any, and whether the alert
+// was already sent.
+func (w *worker) silentFor() (time.Duration, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	last := w.health.LastAudioAt
+	if last.IsZero() {
+		last = w.health.StartedAt
+	}
+	if last.IsZero() {
+		return 0, w.health.Silent
+	}
+	return time.Since(last), w.health.Silent
+}
+
+// getHealth returns a copy of the health of the worker.
+func (w *worker) getHealth() Health {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.health
+}
+
+// alert posts a monitor event to MONITOR_WEBHOOK_URL and to the alert
+// webhook of the monitor.
+func alert(ctx context.Context, settings healthSettings, eventType string, config Config, health Health) {
+	data := map[string]interface{}{
+		"monitor": config.ID,
+		"name":    config.Name,
+		"stream":  config.StreamName(),
+		"health":  health,
+	}
+	urls := []string{settings.WebhookURL}
+	if config.AlertWebhookURL != settings.WebhookURL {
+		urls = append(urls, config.AlertWebhookURL)
+	}
+	for _, url := range urls {
+		if err := webhook.Send(url, eventType, data); err != nil {
+			logger := utils.GetLogger()
+			err := xerrors.New(err)
+			logger.ErrorContext(ctx, fmt.Sprintf("failed to send %s alert for monitor %s", eventType, config.ID), slog.Any("error", err))
+		}
+	}
+}
+
+// watch alerts when the stream of the worker goes without audio for the
+// silence alert period, until ctx is done.
+func (m *Manager) watch(ctx context.Context, w *worker, settings healthSettings) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		silence, alerted := w.silentFor()
+		if alerted || silence < settings.SilenceAlert {
+			continue
+		}
+		w.mu.Lock()
+		w.health.Silent = true
+		w.mu.Unlock()
+		alert(ctx, settings, "monitor.silent", w.getConfig(), w.getHealth())
+	}
+}
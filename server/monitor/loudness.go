@@ -0,0 +1,32 @@
+package monitor
+
+import "song-recognition/loudness"
+
+// measureLoudness adds a window of the stream to the loudness of the stream
+// and of the current track, starting a new track if newSong is set, and
+// returns the integrated loudness of the track so far. Streams are decoded
+// to mono, which is measured as played on both stereo channels: exactly for
+// programmes with the same audio on both, and lower for wide stereo.
+func (w *worker) measureLoudness(samples []float64, sampleRate int, newSong bool) *float64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.streamLoudness == nil {
+		w.streamLoudness = loudness.NewMeter(sampleRate, 2)
+		w.trackLoudness = loudness.NewMeter(sampleRate, 2)
+	}
+	if newSong {
+		w.trackLoudness.Reset()
+	}
+	dualMono := [][]float64{samples, samples}
+	w.streamLoudness.Add(dualMono)
+	w.trackLoudness.Add(dualMono)
+
+	if lufs, ok := w.streamLoudness.Integrated(); ok {
+		w.health.LoudnessLUFS = &lufs
+	}
+	if lufs, ok := w.trackLoudness.Integrated(); ok {
+		return &lufs
+	}
+	return nil
+}
@@ -0,0 +1,375 @@
+// Package monitor continuously recognises what plays on audio streams, such
+// as radio stations, for airplay logging and live dashboards. Monitors are
+// listed in MONITORS_FILE or managed at runtime through the admin API.
+package monitor
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"song-recognition/audio"
+	"song-recognition/deps"
+	"song-recognition/loudness"
+	"song-recognition/models"
+	"song-recognition/priority"
+	"song-recognition/shazam"
+	"song-recognition/utils"
+	"song-recognition/wav"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mdobak/go-xerrors"
+)
+
+const (
+	// reloadInterval is how often configurations are read again, so that
+	// changes made on other instances are picked up.
+	reloadInterval = 30 * time.Second
+	// retryDelay is how long a monitor waits before reconnecting to a stream
+	// that ended or failed, doubling with failures up to maxRetryDelay.
+	retryDelay    = 5 * time.Second
+	maxRetryDelay = 5 * time.Minute
+	// chunkMs is how much audio is read from a stream at a time.
+	chunkMs = 100
+)
+
+// Result is the outcome of recognising a window of a stream.
+type Result struct {
+	Matches    []shazam.Match
+	Recognized bool
+	// NewSong is set when a song is recognised that differs from the last
+	// one recognised on the stream.
+	NewSong bool
+	// TrackLoudnessLUFS is the integrated loudness of the stream since the
+	// last song recognised started, for monitors measuring loudness.
+	TrackLoudnessLUFS *float64
+	// Airing groups new songs with the same song recognised on other
+	// monitors at the same time, and Simulcast is set when another monitor
+	// recognised it first.
+	Airing    *Airing
+	Simulcast bool
+}
+
+// Listener is told what was recognised on a monitored stream.
+type Listener func(ctx context.Context, config Config, result Result)
+
+type worker struct {
+	mu     sync.Mutex
+	config Config
+	health Health
+	cancel context.CancelFunc
+	done   chan struct{}
+	// quiet is how much audio in a row was below the dead air threshold.
+	quiet time.Duration
+	// Loudness of the whole stream and of the current track, when measured
+	streamLoudness *loudness.Meter
+	trackLoudness  *loudness.Meter
+}
+
+func (w *worker) getConfig() Config {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.config
+}
+
+// Manager runs a worker per active monitor.
+type Manager struct {
+	mu         sync.Mutex
+	ctx        context.Context
+	workers    map[string]*worker
+	listener   Listener
+	simulcasts *simulcasts
+}
+
+// NewManager returns a manager reporting recognitions to listener.
+func NewManager(listener Listener) *Manager {
+	return &Manager{workers: make(map[string]*worker), listener: listener, simulcasts: newSimulcasts()}
+}
+
+// Start runs the configured monitors until ctx is done, reloading their
+// configurations periodically.
+func (m *Manager) Start(ctx context.Context) {
+	m.mu.Lock()
+	m.ctx = ctx
+	m.mu.Unlock()
+
+	logger := utils.GetLogger()
+	go m.prune(ctx)
+	go func() {
+		ticker := time.NewTicker(reloadInterval)
+		defer ticker.Stop()
+		for {
+			if err := m.Sync(); err != nil {
+				err := xerrors.New(err)
+				logger.ErrorContext(ctx, "failed to load monitors", slog.Any("error", err))
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Sync starts, stops or restarts workers to match the configurations.
+func (m *Manager) Sync() error {
+	m.mu.Lock()
+	started := m.ctx != nil
+	m.mu.Unlock()
+	if !started {
+		return nil
+	}
+
+	configs, err := List()
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	active := make(map[string]Config)
+	for _, config := range configs {
+		if !config.Paused {
+			active[config.ID] = config
+		}
+	}
+	for id, w := range m.workers {
+		current := w.getConfig()
+		if config, ok := active[id]; !ok || config.URL != current.URL || config.StreamName() != current.StreamName() ||
+			config.Record != current.Record {
+			w.cancel()
+			<-w.done
+			delete(m.workers, id)
+			m.simulcasts.forget(id)
+		}
+	}
+	for id, config := range active {
+		if w, ok := m.workers[id]; ok {
+			w.mu.Lock()
+			w.config = config
+			w.mu.Unlock()
+			continue
+		}
+		ctx, cancel := context.WithCancel(m.ctx)
+		w := &worker{config: config, cancel: cancel, done: make(chan struct{})}
+		m.workers[id] = w
+		go m.run(ctx, w)
+	}
+	return nil
+}
+
+// Health returns the health of a monitor, and whether it is running.
+func (m *Manager) Health(id string) (Health, bool) {
+	m.mu.Lock()
+	w, ok := m.workers[id]
+	m.mu.Unlock()
+	if !ok {
+		return Health{}, false
+	}
+	return w.getHealth(), true
+}
+
+// Healths returns the health of every running monitor by ID.
+func (m *Manager) Healths() map[string]Health {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	healths := make(map[string]Health, len(m.workers))
+	for id, w := range m.workers {
+		healths[id] = w.getHealth()
+	}
+	return healths
+}
+
+// run listens to the stream of a worker until its context is done,
+// reconnecting whenever the stream ends, fails or stalls.
+func (m *Manager) run(ctx context.Context, w *worker) {
+	defer close(w.done)
+	logger := utils.GetLogger()
+	settings := loadHealthSettings()
+	go m.watch(ctx, w, settings)
+
+	var lastSong models.SongID
+	for {
+		config := w.getConfig()
+		w.connecting()
+		streamed := false
+		heard := func(level float64, length time.Duration) {
+			streamed = true
+			if w.heard() {
+				go alert(ctx, settings, "monitor.restored", w.getConfig(), w.getHealth())
+			}
+			if event := w.measure(level, length, settings); event != "" {
+				go alert(ctx, settings, event, w.getConfig(), w.getHealth())
+			}
+		}
+		conn := connection{
+			URL:          config.URL,
+			StallTimeout: settings.StallTimeout,
+			Heard:        heard,
+			Stalled:      func() { w.setState(StateStalled) },
+		}
+		if config.Record {
+			output, err := recordingOutput(config.ID)
+			if err != nil {
+				err := xerrors.New(err)
+				logger.ErrorContext(ctx, fmt.Sprintf("monitor %s can't record its stream", config.ID), slog.Any("error", err))
+			}
+			conn.Record = output
+		}
+
+		err := conn.listen(ctx, func(samples []float64, sampleRate int) {
+			result, err := recognize(ctx, samples, sampleRate)
+			if err != nil {
+				if ctx.Err() == nil {
+					err := xerrors.New(err)
+					logger.ErrorContext(ctx, fmt.Sprintf("monitor %s failed to recognise audio", config.ID), slog.Any("error", err))
+				}
+				return
+			}
+			if result.Recognized && result.Matches[0].SongID != lastSong {
+				lastSong = result.Matches[0].SongID
+				result.NewSong = true
+				airing, simulcast := m.airing(config.ID, lastSong)
+				result.Airing, result.Simulcast = &airing, simulcast
+			}
+			config := w.getConfig()
+			if config.Loudness {
+				result.TrackLoudnessLUFS = w.measureLoudness(samples, sampleRate, result.NewSong)
+			}
+			m.listener(ctx, config, result)
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			err := xerrors.New(err)
+			logger.ErrorContext(ctx, fmt.Sprintf("monitor %s lost its stream", config.ID), slog.Any("error", err))
+		}
+		failures := w.disconnected(err, streamed, settings.FailureThreshold)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retryBackoff(failures)):
+		}
+	}
+}
+
+// windowLength returns the length of the windows of streams recognised at
+// once, from MONITOR_WINDOW (default 10s).
+func windowLength() time.Duration {
+	window, err := time.ParseDuration(utils.GetEnv("MONITOR_WINDOW", "10s"))
+	if err != nil || window < time.Second {
+		return 10 * time.Second
+	}
+	return window
+}
+
+// connection describes how to listen to a stream.
+type connection struct {
+	URL          string
+	StallTimeout time.Duration
+	// Heard is called with the level and length of the audio whenever it
+	// comes in, and Stalled when nothing came in for StallTimeout.
+	Heard   func(level float64, length time.Duration)
+	Stalled func()
+	// Record holds ffmpeg output options writing the stream to files too,
+	// if it is recorded.
+	Record []string
+}
+
+// listen decodes a stream with ffmpeg and hands it to fn window by window,
+// until the stream ends or ctx is done. A stream that sends nothing for the
+// stall timeout is dropped.
+func (c connection) listen(ctx context.Context, fn func(samples []float64, sampleRate int)) error {
+	format := audio.AnalysisFormat()
+	args := []string{
+		"-nostdin", "-loglevel", "error",
+		"-i", c.URL,
+		"-map", "0:a:0",
+		"-f", "s16le", "-acodec", "pcm_s16le",
+		"-ac", "1",
+		"-ar", fmt.Sprint(format.SampleRate),
+		"pipe:1",
+	}
+	cmd, err := deps.Command(deps.FFmpeg, "monitoring streams", append(args, c.Record...)...)
+	if err != nil {
+		return err
+	}
+	// Recordings are named after their start in UTC
+	cmd.Env = append(os.Environ(), "TZ=UTC")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start ffmpeg: %v", err)
+	}
+	stop := context.AfterFunc(ctx, func() { cmd.Process.Kill() })
+	defer stop()
+
+	// ffmpeg may hang on a stream that stopped sending without closing
+	var stall atomic.Bool
+	watchdog := time.AfterFunc(c.StallTimeout, func() {
+		stall.Store(true)
+		c.Stalled()
+		cmd.Process.Kill()
+	})
+	defer watchdog.Stop()
+
+	chunk := make([]byte, 2*int(audio.MsToFrames(chunkMs, format.SampleRate)))
+	windowSize := 2 * int(audio.MsToFrames(windowLength().Milliseconds(), format.SampleRate))
+	window := make([]byte, 0, windowSize+len(chunk))
+	for {
+		n, err := io.ReadFull(stdout, chunk)
+		if n > 0 && !stall.Load() {
+			watchdog.Reset(c.StallTimeout)
+			c.Heard(level(chunk[:n]), time.Duration(n/2)*time.Second/time.Duration(format.SampleRate))
+		}
+		if err != nil {
+			cmd.Wait()
+			switch {
+			case stall.Load():
+				return fmt.Errorf("stream stalled for %s", c.StallTimeout)
+			case err == io.EOF || err == io.ErrUnexpectedEOF:
+				return fmt.Errorf("stream ended")
+			}
+			return err
+		}
+
+		window = append(window, chunk...)
+		if len(window) < windowSize {
+			continue
+		}
+		samples, err := wav.WavBytesToSamples(window)
+		if err != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+			return err
+		}
+		fn(samples, format.SampleRate)
+		window = window[:0]
+	}
+}
+
+// recognize matches a window of a stream, as background work so monitors
+// don't hold interactive recognitions up.
+func recognize(ctx context.Context, samples []float64, sampleRate int) (Result, error) {
+	release, err := priority.Acquire(ctx, priority.Background)
+	if err != nil {
+		return Result{}, err
+	}
+	defer release()
+
+	matches, _, err := shazam.FindMatches(samples, sampleRate)
+	if err != nil {
+		return Result{}, err
+	}
+	seconds := float64(len(samples)) / float64(sampleRate)
+	return Result{Matches: matches, Recognized: shazam.IsRecognized(matches, seconds)}, nil
+}
@@ -0,0 +1,216 @@
+package monitor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"song-recognition/utils"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mdobak/go-xerrors"
+)
+
+const (
+	// recordingExt is the extension of recordings. Matroska holds whatever
+	// codec the stream uses, so streams are recorded without re-encoding.
+	recordingExt = ".mka"
+	// recordingLayout names recordings after the UTC time they start at.
+	recordingLayout = "20060102T150405Z"
+	// pruneInterval is how often recordings past their retention are deleted.
+	pruneInterval = time.Hour
+)
+
+// ErrRecordingNotFound is returned for recordings that don't exist.
+var ErrRecordingNotFound = errors.New("recording not found")
+
+// Recording is a file a monitored stream was recorded to.
+type Recording struct {
+	Name      string    `json:"name"`
+	StartedAt time.Time `json:"startedAt"`
+	UpdatedAt time.Time `json:"updatedAt"` // when audio was last written
+	Size      int64     `json:"size"`
+}
+
+// recordingSettings configure where and how long streams are recorded.
+type recordingSettings struct {
+	Dir       string
+	Segment   time.Duration
+	Retention time.Duration
+	MaxBytes  int64 // per monitor, 0 for no limit
+}
+
+// loadRecordingSettings reads MONITOR_RECORDINGS_DIR (default "recordings"),
+// MONITOR_RECORDING_SEGMENT (default 1h), MONITOR_RECORDING_RETENTION
+// (default 168h) and MONITOR_RECORDING_MAX_MB (default 0, no limit).
+func loadRecordingSettings() recordingSettings {
+	parse := func(key string, fallback time.Duration) time.Duration {
+		d, err := time.ParseDuration(utils.GetEnv(key, fallback.String()))
+		if err != nil || d <= 0 {
+			return fallback
+		}
+		return d
+	}
+
+	maxMB, err := strconv.ParseInt(utils.GetEnv("MONITOR_RECORDING_MAX_MB", "0"), 10, 64)
+	if err != nil || maxMB < 0 {
+		maxMB = 0
+	}
+	return recordingSettings{
+		Dir:       utils.GetEnv("MONITOR_RECORDINGS_DIR", "recordings"),
+		Segment:   parse("MONITOR_RECORDING_SEGMENT", time.Hour),
+		Retention: parse("MONITOR_RECORDING_RETENTION", 7*24*time.Hour),
+		MaxBytes:  maxMB << 20,
+	}
+}
+
+// recordingOutput returns the ffmpeg output options recording the stream of
+// a monitor, without re-encoding it, to files starting at every multiple of
+// the segment length on the clock.
+func recordingOutput(id string) ([]string, error) {
+	settings := loadRecordingSettings()
+	dir := filepath.Join(settings.Dir, id)
+	if err := utils.CreateFolder(dir); err != nil {
+		return nil, fmt.Errorf("failed to create recordings folder: %v", err)
+	}
+
+	return []string{
+		"-map", "0:a:0",
+		"-c:a", "copy",
+		"-f", "segment",
+		"-segment_format", "matroska",
+		"-segment_time", fmt.Sprint(int(settings.Segment.Seconds())),
+		"-segment_atclocktime", "1",
+		"-reset_timestamps", "1",
+		"-strftime", "1",
+		filepath.Join(dir, "%Y%m%dT%H%M%SZ"+recordingExt),
+	}, nil
+}
+
+// ListRecordings returns the recordings of a monitor, oldest first.
+func ListRecordings(id string) ([]Recording, error) {
+	entries, err := os.ReadDir(filepath.Join(loadRecordingSettings().Dir, id))
+	if errors.Is(err, os.ErrNotExist) {
+		return []Recording{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list recordings: %v", err)
+	}
+
+	recordings := []Recording{}
+	for _, entry := range entries {
+		startedAt, ok := recordingStart(entry.Name())
+		if !ok || entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue // deleted meanwhile
+		}
+		recordings = append(recordings, Recording{
+			Name:      entry.Name(),
+			StartedAt: startedAt,
+			UpdatedAt: info.ModTime().UTC(),
+			Size:      info.Size(),
+		})
+	}
+	sort.Slice(recordings, func(i, j int) bool { return recordings[i].StartedAt.Before(recordings[j].StartedAt) })
+	return recordings, nil
+}
+
+// RecordingPath returns the path of a recording of a monitor.
+func RecordingPath(id, name string) (string, error) {
+	if _, ok := recordingStart(name); !ok || filepath.Base(name) != name || !idPattern.MatchString(id) {
+		return "", ErrRecordingNotFound
+	}
+	path := filepath.Join(loadRecordingSettings().Dir, id, name)
+	if _, err := os.Stat(path); err != nil {
+		return "", ErrRecordingNotFound
+	}
+	return path, nil
+}
+
+// recordingStart returns the start of a recording from its name.
+func recordingStart(name string) (time.Time, bool) {
+	if !strings.HasSuffix(name, recordingExt) {
+		return time.Time{}, false
+	}
+	startedAt, err := time.Parse(recordingLayout, strings.TrimSuffix(name, recordingExt))
+	return startedAt, err == nil
+}
+
+// pruneRecordings deletes the recordings of every monitor, including deleted
+// ones, that are past the retention period, and then the oldest of each
+// monitor while they take more than the size limit. The recording being
+// written is always kept.
+func pruneRecordings() (int, error) {
+	settings := loadRecordingSettings()
+	entries, err := os.ReadDir(settings.Dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to list recordings: %v", err)
+	}
+
+	deleted := 0
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		recordings, err := ListRecordings(entry.Name())
+		if err != nil {
+			return deleted, err
+		}
+
+		var total int64
+		for _, recording := range recordings {
+			total += recording.Size
+		}
+		cutoff := time.Now().Add(-settings.Retention)
+		for i, recording := range recordings {
+			if i == len(recordings)-1 {
+				break
+			}
+			expired := recording.UpdatedAt.Before(cutoff)
+			tooBig := settings.MaxBytes > 0 && total > settings.MaxBytes
+			if !expired && !tooBig {
+				break
+			}
+			if err := os.Remove(filepath.Join(settings.Dir, entry.Name(), recording.Name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return deleted, fmt.Errorf("failed to delete recording: %v", err)
+			}
+			total -= recording.Size
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// prune deletes recordings past their retention now and then every
+// pruneInterval, until ctx is done.
+func (m *Manager) prune(ctx context.Context) {
+	logger := utils.GetLogger()
+	ticker := time.NewTicker(pruneInterval)
+	defer ticker.Stop()
+	for {
+		deleted, err := pruneRecordings()
+		if err != nil {
+			err := xerrors.New(err)
+			logger.ErrorContext(ctx, "failed to prune monitor recordings", slog.Any("error", err))
+		} else if deleted > 0 {
+			logger.Info(fmt.Sprintf("deleted %d monitor recordings past their retention", deleted))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package monitor
+
+import (
+	"fmt"
+	"slices"
+	"song-recognition/models"
+	"song-recognition/utils"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Airing is a song recognised on one or more monitored streams at the same
+// time. Streams simulcasting the same feed report each song once per
+// stream; the airings group those reports so they are counted once.
+type Airing struct {
+	ID      string        `json:"id"`
+	SongID  models.SongID `json:"songId"`
+	Monitor string        `json:"monitor"` // the first monitor the song was recognised on
+	At      time.Time     `json:"at"`
+}
+
+// Simulcast is how often two monitors recognised the same songs at the same
+// time.
+type Simulcast struct {
+	Monitors [2]string `json:"monitors"`
+	Shared   int       `json:"shared"` // songs recognised on both at once
+	// Songs counts the songs recognised on each monitor since it started.
+	Songs  [2]int    `json:"songs"`
+	LastAt time.Time `json:"lastAt"`
+	// Simulcast is set once enough of the songs of the quieter of the two
+	// monitors were shared for them to carry the same feed.
+	Simulcast bool `json:"simulcast"`
+}
+
+// simulcastSettings configure how airings are grouped across monitors.
+type simulcastSettings struct {
+	Window    time.Duration
+	MinShared int
+	MinRatio  float64
+}
+
+// loadSimulcastSettings reads MONITOR_SIMULCAST_WINDOW (default 30s),
+// MONITOR_SIMULCAST_MIN_SHARED (default 3) and MONITOR_SIMULCAST_MIN_RATIO
+// (default 0.8).
+func loadSimulcastSettings() simulcastSettings {
+	window, err := time.ParseDuration(utils.GetEnv("MONITOR_SIMULCAST_WINDOW", "30s"))
+	if err != nil || window < 0 {
+		window = 30 * time.Second
+	}
+	minShared, err := strconv.Atoi(utils.GetEnv("MONITOR_SIMULCAST_MIN_SHARED", "3"))
+	if err != nil || minShared < 1 {
+		minShared = 3
+	}
+	minRatio, err := strconv.ParseFloat(utils.GetEnv("MONITOR_SIMULCAST_MIN_RATIO", "0.8"), 64)
+	if err != nil || minRatio < 0 || minRatio > 1 {
+		minRatio = 0.8
+	}
+	return simulcastSettings{Window: window, MinShared: minShared, MinRatio: minRatio}
+}
+
+// simulcasts correlates the new songs of every monitor of a manager.
+type simulcasts struct {
+	mu      sync.Mutex
+	airings []Airing                // recent airings, oldest first
+	heard   map[string][]string     // monitors each recent airing was recognised on
+	songs   map[string]int          // songs recognised per monitor
+	pairs   map[[2]string]Simulcast // by monitor IDs, in order
+}
+
+func newSimulcasts() *simulcasts {
+	return &simulcasts{
+		heard: make(map[string][]string),
+		songs: make(map[string]int),
+		pairs: make(map[[2]string]Simulcast),
+	}
+}
+
+// add records a new song recognised on a monitor. It returns the airing the
+// song belongs to, and whether another monitor recognised it first within
+// the window, in which case it is a repeat of that airing.
+func (s *simulcasts) add(monitorID string, songID models.SongID, at time.Time, window time.Duration) (Airing, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.songs[monitorID]++
+
+	kept := s.airings[:0]
+	for _, airing := range s.airings {
+		if at.Sub(airing.At) <= window {
+			kept = append(kept, airing)
+		} else {
+			delete(s.heard, airing.ID)
+		}
+	}
+	s.airings = kept
+
+	for _, airing := range s.airings {
+		if airing.SongID != songID || slices.Contains(s.heard[airing.ID], monitorID) {
+			continue
+		}
+		for _, other := range s.heard[airing.ID] {
+			pair := pairKey(monitorID, other)
+			link := s.pairs[pair]
+			link.Monitors = pair
+			link.Shared++
+			link.LastAt = at.UTC()
+			s.pairs[pair] = link
+		}
+		s.heard[airing.ID] = append(s.heard[airing.ID], monitorID)
+		return airing, true
+	}
+
+	airing := Airing{
+		ID:      fmt.Sprintf("%s_%d", at.UTC().Format("20060102T150405"), utils.GenerateUniqueID()),
+		SongID:  songID,
+		Monitor: monitorID,
+		At:      at.UTC(),
+	}
+	s.airings = append(s.airings, airing)
+	s.heard[airing.ID] = []string{monitorID}
+	return airing, false
+}
+
+// list returns the pairs of monitors that shared songs, most shared first.
+func (s *simulcasts) list(settings simulcastSettings) []Simulcast {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]Simulcast, 0, len(s.pairs))
+	for pair, link := range s.pairs {
+		link.Songs = [2]int{s.songs[pair[0]], s.songs[pair[1]]}
+		if quieter := min(link.Songs[0], link.Songs[1]); quieter > 0 {
+			link.Simulcast = link.Shared >= settings.MinShared && float64(link.Shared)/float64(quieter) >= settings.MinRatio
+		}
+		list = append(list, link)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Shared != list[j].Shared {
+			return list[i].Shared > list[j].Shared
+		}
+		return list[i].Monitors[0]+"/"+list[i].Monitors[1] < list[j].Monitors[0]+"/"+list[j].Monitors[1]
+	})
+	return list
+}
+
+// forget drops the counts of a monitor that stopped.
+func (s *simulcasts) forget(monitorID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.songs, monitorID)
+	for pair := range s.pairs {
+		if pair[0] == monitorID || pair[1] == monitorID {
+			delete(s.pairs, pair)
+		}
+	}
+}
+
+func pairKey(a, b string) [2]string {
+	if a > b {
+		a, b = b, a
+	}
+	return [2]string{a, b}
+}
+
+// airing groups a new song recognised on a monitor with the same song
+// recognised on other monitors within the simulcast window.
+func (m *Manager) airing(monitorID string, songID models.SongID) (Airing, bool) {
+	return m.simulcasts.add(monitorID, songID, time.Now(), loadSimulcastSettings().Window)
+}
+
+// Simulcasts returns the pairs of running monitors that recognised the same
+// songs at the same time, flagging those that simulcast the same feed.
+func (m *Manager) Simulcasts() []Simulcast {
+	return m.simulcasts.list(loadSimulcastSettings())
+}
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"song-recognition/breaker"
+	"song-recognition/ingest"
+	"song-recognition/monitor"
+	"song-recognition/shadow"
+	"song-recognition/utils"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/mdobak/go-xerrors"
+)
+
+var (
+	monitorsOnce sync.Once
+	monitors     *monitor.Manager
+)
+
+// getMonitors returns the manager of stream monitors, which publishes every
+// recognised window on the stream of the monitor and records each new song
+// in the history, marking songs another monitor recognised at the same time
+// as simulcasts.
+func getMonitors() *monitor.Manager {
+	monitorsOnce.Do(func() {
+		monitors = monitor.NewManager(func(ctx context.Context, config monitor.Config, result monitor.Result) {
+			recognitionID := ""
+			if result.NewSong {
+				recognition := newRecognition(ctx, "monitor", result.Matches, result.Recognized, 0)
+				recognition.Monitor = config.ID
+				if result.Airing != nil {
+					recognition.AiringID, recognition.Simulcast = result.Airing.ID, result.Simulcast
+				}
+				recognitionID = saveRecognition(ctx, recognition, nil)
+			}
+			event := matchEvent{
+				Recognized:    result.Recognized,
+				Matches:       result.Matches,
+				RecognitionID: recognitionID,
+				LoudnessLUFS:  result.TrackLoudnessLUFS,
+			}
+			if result.Airing != nil {
+				event.AiringID = result.Airing.ID
+				if result.Simulcast {
+					event.SimulcastOf = result.Airing.Monitor
+				}
+			}
+			publishMatchEvent(ctx, streamTopics(config.StreamName()), "", event)
+		})
+	})
+	return monitors
+}
+
+// startMonitors runs the configured stream monitors, unless MONITORS_ENABLED
+// is false.
+func startMonitors() {
+	if utils.GetEnv("MONITORS_ENABLED", "true") == "false" {
+		return
+	}
+	getMonitors().Start(context.Background())
+}
+
+// monitorStatus is a monitor as listed by the admin API, with the health of
+// its connection while it runs.
+type monitorStatus struct {
+	monitor.Config
+	Running bool            `json:"running"`
+	Health  *monitor.Health `json:"health,omitempty"`
+}
+
+func getMonitorStatus(config monitor.Config) monitorStatus {
+	status := monitorStatus{Config: config}
+	if health, running := getMonitors().Health(config.ID); running {
+		status.Running, status.Health = true, &health
+	}
+	return status
+}
+
+// syncMonitors applies a configuration change to the running monitors. The
+// change is stored either way, so failures are only logged.
+func syncMonitors(ctx context.Context) {
+	if err := getMonitors().Sync(); err != nil {
+		logger := utils.GetLogger()
+		err := xerrors.New(err)
+		logger.ErrorContext(ctx, "failed to apply monitor changes.", slog.Any("error", err))
+	}
+}
+
+// handleMonitorError answers requests about monitors that failed.
+func handleMonitorError(w http.ResponseWriter, r *http.Request, msg string, err error) {
+	switch {
+	case errors.Is(err, monitor.ErrNotFound):
+		writeError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, monitor.ErrReadOnly):
+		writeError(w, http.StatusConflict, err.Error()+", edit the file instead")
+	default:
+		handleAdminError(w, r, msg, err)
+	}
+}
+
+func handleListMonitors(w http.ResponseWriter, r *http.Request) {
+	configs, err := monitor.List()
+	if err != nil {
+		handleAdminError(w, r, "failed to list monitors", err)
+		return
+	}
+	statuses := make([]monitorStatus, 0, len(configs))
+	for _, config := range configs {
+		statuses = append(statuses, getMonitorStatus(config))
+	}
+	writeJSON(w, http.StatusOK, statuses)
+}
+
+func handleGetMonitor(w http.ResponseWriter, r *http.Request) {
+	config, err := monitor.Get(r.PathValue("id"))
+	if err != nil {
+		handleMonitorError(w, r, "failed to read monitor", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, getMonitorStatus(config))
+}
+
+// handleCreateMonitor adds a monitor, with a generated ID unless one is
+// given.
+func handleCreateMonitor(w http.ResponseWriter, r *http.Request) {
+	var config monitor.Config
+	if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body: "+err.Error())
+		return
+	}
+	if config.ID == "" {
+		config.ID = monitor.NewID()
+	}
+	if err := config.Validate(); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if _, err := monitor.Get(config.ID); err == nil {
+		writeError(w, http.StatusConflict, "monitor "+config.ID+" already exists")
+		return
+	} else if !errors.Is(err, monitor.ErrNotFound) {
+		handleAdminError(w, r, "failed to read monitor", err)
+		return
+	}
+
+	config, err := monitor.Save(config)
+	if err != nil {
+		handleMonitorError(w, r, "failed to save monitor", err)
+		return
+	}
+	syncMonitors(r.Context())
+	writeJSON(w, http.StatusCreated, config)
+}
+
+// handleUpdateMonitor replaces the configuration of a monitor.
+func handleUpdateMonitor(w http.ResponseWriter, r *http.Request) {
+	var config monitor.Config
+	if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body: "+err.Error())
+		return
+	}
+	config.ID = r.PathValue("id")
+	if err := config.Validate(); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if _, err := monitor.Get(config.ID); err != nil {
+		handleMonitorError(w, r, "failed to read monitor", err)
+		return
+	}
+
+	config, err := monitor.Save(config)
+	if err != nil {
+		handleMonitorError(w, r, "failed to save monitor", err)
+		return
+	}
+	syncMonitors(r.Context())
+	writeJSON(w, http.StatusOK, config)
+}
+
+// handlePauseMonitor returns a handler stopping or resuming a monitor.
+func handlePauseMonitor(paused bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		config, err := monitor.Get(r.PathValue("id"))
+		if err != nil {
+			handleMonitorError(w, r, "failed to read monitor", err)
+			return
+		}
+		config.Paused = paused
+
+		config, err = monitor.Save(config)
+		if err != nil {
+			handleMonitorError(w, r, "failed to save monitor", err)
+			return
+		}
+		syncMonitors(r.Context())
+		writeJSON(w, http.StatusOK, config)
+	}
+}
+
+func handleDeleteMonitor(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if err := monitor.Delete(id); err != nil {
+		handleMonitorError(w, r, "failed to delete monitor", err)
+		return
+	}
+	syncMonitors(r.Context())
+	writeJSON(w, http.StatusOK, map[string]interface{}{"id": id, "status": "deleted"})
+}
+
+// handleListRecordings lists the files the stream of a monitor was recorded
+// to, including those of deleted monitors still within their retention.
+func handleListRecordings(w http.ResponseWriter, r *http.Request) {
+	recordings, err := monitor.ListRecordings(r.PathValue("id"))
+	if err != nil {
+		handleAdminError(w, r, "failed to list recordings", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, recordings)
+}
+
+// handleGetRecording serves a recording, with range requests so that players
+// can seek to a disputed airplay.
+func handleGetRecording(w http.ResponseWriter, r *http.Request) {
+	path, err := monitor.RecordingPath(r.PathValue("id"), r.PathValue("name"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "audio/x-matroska")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", r.PathValue("id")+"-"+r.PathValue("name")))
+	http.ServeFile(w, r, path)
+}
+
+// handleListSimulcasts lists the pairs of running monitors that recognised
+// the same songs at the same time.
+func handleListSimulcasts(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, getMonitors().Simulcasts())
+}
+
+// handleMetrics exposes the health of running monitors in the Prometheus
+// text format.
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	healths := getMonitors().Healths()
+	ids := make([]string, 0, len(healths))
+	for id := range healths {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var b strings.Builder
+	b.WriteString("# HELP seektune_monitor_state Current state of a running stream monitor.\n")
+	b.WriteString("# TYPE seektune_monitor_state gauge\n")
+	for _, id := range ids {
+		for _, state := range monitor.States {
+			value := 0
+			if healths[id].State == state {
+				value = 1
+			}
+			fmt.Fprintf(&b, "seektune_monitor_state{monitor=%q,state=%q} %d\n", id, state, value)
+		}
+	}
+	b.WriteString("# HELP seektune_monitor_reconnects_total Reconnections of a stream monitor since it started.\n")
+	b.WriteString("# TYPE seektune_monitor_reconnects_total counter\n")
+	for _, id := range ids {
+		fmt.Fprintf(&b, "seektune_monitor_reconnects_total{monitor=%q} %d\n", id, healths[id].Reconnects)
+	}
+	b.WriteString("# HELP seektune_monitor_failures Connections in a row that ended without audio.\n")
+	b.WriteString("# TYPE seektune_monitor_failures gauge\n")
+	for _, id := range ids {
+		fmt.Fprintf(&b, "seektune_monitor_failures{monitor=%q} %d\n", id, healths[id].Failures)
+	}
+	b.WriteString("# HELP seektune_monitor_last_audio_timestamp_seconds When audio last came in from the stream.\n")
+	b.WriteString("# TYPE seektune_monitor_last_audio_timestamp_seconds gauge\n")
+	for _, id := range ids {
+		var last float64
+		if at := healths[id].LastAudioAt; !at.IsZero() {
+			last = float64(at.UnixMilli()) / 1000
+		}
+		fmt.Fprintf(&b, "seektune_monitor_last_audio_timestamp_seconds{monitor=%q} %g\n", id, last)
+	}
+	b.WriteString("# HELP seektune_monitor_silent Whether the stream went silent long enough to alert.\n")
+	b.WriteString("# TYPE seektune_monitor_silent gauge\n")
+	for _, id := range ids {
+		silent := 0
+		if healths[id].Silent {
+			silent = 1
+		}
+		fmt.Fprintf(&b, "seektune_monitor_silent{monitor=%q} %d\n", id, silent)
+	}
+
+	b.WriteString("# HELP seektune_monitor_level_dbfs RMS level of the audio last received from the stream.\n")
+	b.WriteString("# TYPE seektune_monitor_level_dbfs gauge\n")
+	for _, id := range ids {
+		fmt.Fprintf(&b, "seektune_monitor_level_dbfs{monitor=%q} %g\n", id, healths[id].Level)
+	}
+	b.WriteString("# HELP seektune_monitor_dead_air Whether the stream is carrying dead air.\n")
+	b.WriteString("# TYPE seektune_monitor_dead_air gauge\n")
+	for _, id := range ids {
+		deadAir := 0
+		if healths[id].DeadAir {
+			deadAir = 1
+		}
+		fmt.Fprintf(&b, "seektune_monitor_dead_air{monitor=%q} %d\n", id, deadAir)
+	}
+
+	b.WriteString("# HELP seektune_monitor_loudness_lufs Integrated loudness of the stream since the monitor started.\n")
+	b.WriteString("# TYPE seektune_monitor_loudness_lufs gauge\n")
+	for _, id := range ids {
+		if lufs := healths[id].LoudnessLUFS; lufs != nil {
+			fmt.Fprintf(&b, "seektune_monitor_loudness_lufs{monitor=%q} %g\n", id, *lufs)
+		}
+	}
+
+	writeDependencyMetrics(&b)
+	writeDiskSpaceMetrics(&b)
+	writeShadowMetrics(&b)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write([]byte(b.String()))
+}
+
+// writeDependencyMetrics writes the calls made to external dependencies and
+// the state of their circuit breakers.
+func writeDependencyMetrics(b *strings.Builder) {
+	dependencies := breaker.All()
+	b.WriteString("# HELP seektune_dependency_calls_total Calls made to an external dependency.\n")
+	b.WriteString("# TYPE seektune_dependency_calls_total counter\n")
+	for _, d := range dependencies {
+		fmt.Fprintf(b, "seektune_dependency_calls_total{dependency=%q} %d\n", d.Dependency, d.Calls)
+	}
+	b.WriteString("# HELP seektune_dependency_failures_total Calls to an external dependency that failed.\n")
+	b.WriteString("# TYPE seektune_dependency_failures_total counter\n")
+	for _, d := range dependencies {
+		fmt.Fprintf(b, "seektune_dependency_failures_total{dependency=%q} %d\n", d.Dependency, d.Failures)
+	}
+	b.WriteString("# HELP seektune_dependency_rejected_total Calls not made because the circuit breaker was open.\n")
+	b.WriteString("# TYPE seektune_dependency_rejected_total counter\n")
+	for _, d := range dependencies {
+		fmt.Fprintf(b, "seektune_dependency_rejected_total{dependency=%q} %d\n", d.Dependency, d.Rejected)
+	}
+	b.WriteString("# HELP seektune_dependency_breaker_state Current state of the circuit breaker of an external dependency.\n")
+	b.WriteString("# TYPE seektune_dependency_breaker_state gauge\n")
+	for _, d := range dependencies {
+		for _, state := range []string{breaker.StateClosed, breaker.StateOpen, breaker.StateHalfOpen} {
+			value := 0
+			if d.State == state {
+				value = 1
+			}
+			fmt.Fprintf(b, "seektune_dependency_breaker_state{dependency=%q,state=%q} %d\n", d.Dependency, state, value)
+		}
+	}
+}
+
+// writeDiskSpaceMetrics writes the space left for ingestion and whether it is
+// paused for lack of it.
+func writeDiskSpaceMetrics(b *strings.Builder) {
+	status := ingest.Status(SONGS_DIR)
+	paused := 0
+	if status.Paused {
+		paused = 1
+	}
+	b.WriteString("# HELP seektune_ingestion_paused Whether ingestion is paused for lack of disk space.\n")
+	b.WriteString("# TYPE seektune_ingestion_paused gauge\n")
+	fmt.Fprintf(b, "seektune_ingestion_paused %d\n", paused)
+	b.WriteString("# HELP seektune_ingestion_waiting Ingestion jobs waiting for disk space.\n")
+	b.WriteString("# TYPE seektune_ingestion_waiting gauge\n")
+	fmt.Fprintf(b, "seektune_ingestion_waiting %d\n", status.Waiting)
+	b.WriteString("# HELP seektune_ingestion_free_megabytes Space left on the volume of a folder ingestion writes to.\n")
+	b.WriteString("# TYPE seektune_ingestion_free_megabytes gauge\n")
+	for _, volume := range status.Volumes {
+		fmt.Fprintf(b, "seektune_ingestion_free_megabytes{path=%q} %d\n", volume.Path, volume.FreeMB)
+	}
+	b.WriteString("# HELP seektune_ingestion_tmp_used_megabytes Space used by the files staged in the tmp folder.\n")
+	b.WriteString("# TYPE seektune_ingestion_tmp_used_megabytes gauge\n")
+	fmt.Fprintf(b, "seektune_ingestion_tmp_used_megabytes %d\n", status.TmpUsedMB)
+}
+
+// writeShadowMetrics writes how the queries compared with the shadow index
+// fared on both indexes, when one is configured.
+func writeShadowMetrics(b *strings.Builder) {
+	if !shadow.Enabled() {
+		return
+	}
+	stats := shadow.CurrentStats()
+	b.WriteString("# HELP seektune_shadow_queries_total Queries compared with the shadow index, by where they came from and how the results compared.\n")
+	b.WriteString("# TYPE seektune_shadow_queries_total counter\n")
+	sources := make([]string, 0, len(stats.BySource))
+	for source := range stats.BySource {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+	for _, source := range sources {
+		for _, outcome := range shadow.Outcomes {
+			fmt.Fprintf(b, "seektune_shadow_queries_total{source=%q,outcome=%q} %d\n", source, outcome, stats.BySource[source][outcome])
+		}
+	}
+	b.WriteString("# HELP seektune_shadow_skipped_total Queries not mirrored because too many mirrored ones were running.\n")
+	b.WriteString("# TYPE seektune_shadow_skipped_total counter\n")
+	fmt.Fprintf(b, "seektune_shadow_skipped_total %d\n", stats.Skipped)
+	b.WriteString("# HELP seektune_shadow_errors_total Comparisons with the shadow index that failed.\n")
+	b.WriteString("# TYPE seektune_shadow_errors_total counter\n")
+	fmt.Fprintf(b, "seektune_shadow_errors_total %d\n", stats.Errors)
+	b.WriteString("# HELP seektune_shadow_agreement_ratio Share of the compared queries both indexes recognised the same song in, or neither recognised any.\n")
+	b.WriteString("# TYPE seektune_shadow_agreement_ratio gauge\n")
+	fmt.Fprintf(b, "seektune_shadow_agreement_ratio %g\n", stats.Agreement)
+	b.WriteString("# HELP seektune_shadow_top_match_agreement_ratio Share of the compared queries whose best matches are the same song on both indexes.\n")
+	b.WriteString("# TYPE seektune_shadow_top_match_agreement_ratio gauge\n")
+	fmt.Fprintf(b, "seektune_shadow_top_match_agreement_ratio %g\n", stats.TopMatchAgreement)
+
+	indexes := []struct {
+		name  string
+		stats shadow.IndexStats
+	}{{"live", stats.Live}, {"shadow", stats.Shadow}}
+	b.WriteString("# HELP seektune_shadow_recognized_total Compared queries recognised, by index.\n")
+	b.WriteString("# TYPE seektune_shadow_recognized_total counter\n")
+	for _, index := range indexes {
+		fmt.Fprintf(b, "seektune_shadow_recognized_total{index=%q} %d\n", index.name, index.stats.Recognized)
+	}
+	b.WriteString("# HELP seektune_shadow_score_sum Scores of the best matches of the compared queries, by index.\n")
+	b.WriteString("# TYPE seektune_shadow_score_sum counter\n")
+	for _, index := range indexes {
+		fmt.Fprintf(b, "seektune_shadow_score_sum{index=%q} %g\n", index.name, index.stats.ScoreSum)
+	}
+	b.WriteString("# HELP seektune_shadow_confidence_sum Confidences of the best matches of the compared queries, by index.\n")
+	b.WriteString("# TYPE seektune_shadow_confidence_sum counter\n")
+	for _, index := range indexes {
+		fmt.Fprintf(b, "seektune_shadow_confidence_sum{index=%q} %g\n", index.name, index.stats.ConfidenceSum)
+	}
+	b.WriteString("# HELP seektune_shadow_search_seconds_total Search time of the compared queries, by index.\n")
+	b.WriteString("# TYPE seektune_shadow_search_seconds_total counter\n")
+	for _, index := range indexes {
+		fmt.Fprintf(b, "seektune_shadow_search_seconds_total{index=%q} %g\n", index.name, index.stats.Seconds)
+	}
+}
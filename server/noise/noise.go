@@ -0,0 +1,100 @@
+// Package noise keeps the noise profile of API clients recording in noisy
+// places, such as a kiosk in a venue, so that the ambient noise is subtracted
+// from their queries before they are matched.
+package noise
+
+import (
+	"encoding/json"
+	"fmt"
+	"song-recognition/cached"
+	"song-recognition/db"
+	"song-recognition/shazam"
+	"time"
+)
+
+const (
+	collection     = "noise_profiles"
+	reloadInterval = 30 * time.Second
+)
+
+// Profile is the noise profile of a client.
+type Profile struct {
+	ClientID   string              `json:"clientId"`
+	DurationMs int64               `json:"durationMs"` // length of the recording it was learnt from
+	UpdatedAt  time.Time           `json:"updatedAt"`
+	Noise      shazam.NoiseProfile `json:"noise"`
+}
+
+var cache = cached.New(reloadInterval, Load)
+
+// For returns the noise profile of a client, reloading the profiles from the
+// database at most every 30 seconds so that profiles registered on other
+// instances are picked up. If they can't be loaded the previous ones are
+// kept. Unsigned requests come from the zero client, which has none.
+func For(clientID string) (Profile, bool) {
+	if clientID == "" {
+		return Profile{}, false
+	}
+	profile, ok := cache.Get()[clientID]
+	return profile, ok
+}
+
+// Load reads every profile from the database.
+func Load() (map[string]Profile, error) {
+	profiles := make(map[string]Profile)
+
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		return profiles, err
+	}
+	defer dbClient.Close()
+
+	records, err := dbClient.ListRecords(collection, db.RecordFilter{})
+	if err != nil {
+		return profiles, err
+	}
+	for _, record := range records {
+		var profile Profile
+		if err := json.Unmarshal(record.Data, &profile); err != nil {
+			return profiles, fmt.Errorf("failed to unmarshal noise profile %s: %v", record.ID, err)
+		}
+		profiles[profile.ClientID] = profile
+	}
+	return profiles, nil
+}
+
+// Set creates or replaces the noise profile of a client.
+func Set(profile Profile) error {
+	data, err := json.Marshal(profile)
+	if err != nil {
+		return fmt.Errorf("failed to marshal noise profile: %v", err)
+	}
+
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		return err
+	}
+	defer dbClient.Close()
+
+	if err := dbClient.PutRecord(collection, db.Record{ID: profile.ClientID, CreatedAt: profile.UpdatedAt, Data: data}); err != nil {
+		return err
+	}
+	cache.Invalidate()
+	return nil
+}
+
+// Delete removes the noise profile of a client, whose queries are matched as
+// recorded again.
+func Delete(clientID string) error {
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		return err
+	}
+	defer dbClient.Close()
+
+	if err := dbClient.DeleteRecord(collection, clientID); err != nil {
+		return err
+	}
+	cache.Invalidate()
+	return nil
+}
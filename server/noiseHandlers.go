@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"song-recognition/audio"
+	"song-recognition/auth"
+	"song-recognition/noise"
+	"song-recognition/shazam"
+	"song-recognition/utils"
+	"song-recognition/wav"
+	"strconv"
+	"time"
+
+	"github.com/mdobak/go-xerrors"
+)
+
+// The leading segment of a recording noise is estimated from, in
+// milliseconds.
+const (
+	defaultNoiseLeadMs = 1000
+	minNoiseLeadMs     = 1000
+	maxNoiseLeadMs     = 10000
+)
+
+// noiseReduction resolves the noise reduction settings of an audio query,
+// normalised by checkAudioUpload, into the context it is matched under. By
+// default the registered noise profile of the client is subtracted, if it
+// has one. The noise is estimated from the profile when there is one, or
+// else from the leading noiseLeadMs of the recording, unless noiseSource
+// picks either; denoise picks the method, or turns noise reduction off. It
+// returns the method and source used, both empty when the query isn't
+// denoised, or an error for the client.
+func noiseReduction(ctx context.Context, r *http.Request, clientID string, samples []float64, sampleRate int) (context.Context, string, string, error) {
+	method, source := r.FormValue("denoise"), r.FormValue("noiseSource")
+	profile, registered := noise.For(clientID)
+	if method == "auto" {
+		if !registered && source == "auto" {
+			return ctx, "", "", nil
+		}
+		method = shazam.NoiseSubtraction
+	}
+	if method == "off" {
+		return ctx, "", "", nil
+	}
+
+	if source == "auto" {
+		source = "leading"
+		if registered {
+			source = "profile"
+		}
+	}
+	if source == "profile" {
+		if !registered {
+			return ctx, "", "", fmt.Errorf("no noise profile registered, use noiseSource=leading or PUT /api/noise-profile")
+		}
+		return shazam.WithNoiseReduction(ctx, profile.Noise, method), method, source, nil
+	}
+
+	leadMs, _ := strconv.ParseInt(r.FormValue("noiseLeadMs"), 10, 64)
+	leading, err := shazam.LeadingNoiseProfile(samples, sampleRate, leadMs)
+	if err != nil {
+		return ctx, "", "", fmt.Errorf("failed to estimate noise: %v", err)
+	}
+	return shazam.WithNoiseReduction(ctx, leading, method), method, source, nil
+}
+
+// noiseProfileSummary describes a noise profile without its spectrum.
+func noiseProfileSummary(profile noise.Profile) map[string]interface{} {
+	return map[string]interface{}{
+		"clientId":   profile.ClientID,
+		"durationMs": profile.DurationMs,
+		"frames":     profile.Noise.Frames,
+		"updatedAt":  profile.UpdatedAt,
+	}
+}
+
+// handleSetNoiseProfile learns the noise profile of the signing client from
+// a recording of its ambient noise, sent as the "audio" field of a multipart
+// form, replacing the one it had. The noise is subtracted from the client's
+// audio queries from then on.
+func handleSetNoiseProfile(w http.ResponseWriter, r *http.Request) {
+	logger := utils.GetLogger()
+	ctx := r.Context()
+
+	client, ok := auth.ClientFromContext(ctx)
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "noise profiles belong to signed clients")
+		return
+	}
+
+	file, header, err := r.FormFile("audio")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "missing audio file: "+err.Error())
+		return
+	}
+	defer file.Close()
+
+	if err := utils.CreateFolder("tmp"); err != nil {
+		err := xerrors.New(err)
+		logger.ErrorContext(ctx, "failed to create tmp folder.", slog.Any("error", err))
+		writeError(w, http.StatusInternalServerError, "failed to store upload")
+		return
+	}
+	upload, err := os.CreateTemp("tmp", "noise_*"+filepath.Ext(header.Filename))
+	if err != nil {
+		err := xerrors.New(err)
+		logger.ErrorContext(ctx, "failed to store upload.", slog.Any("error", err))
+		writeError(w, http.StatusInternalServerError, "failed to store upload")
+		return
+	}
+	defer os.Remove(upload.Name())
+	_, err = io.Copy(upload, file)
+	upload.Close()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "failed to read upload: "+err.Error())
+		return
+	}
+
+	wavFilePath, err := wav.ConvertToWAV(upload.Name())
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, "failed to decode audio: "+err.Error())
+		return
+	}
+	defer os.Remove(wavFilePath)
+
+	wavInfo, err := wav.ReadWavInfo(wavFilePath)
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, "failed to decode audio: "+err.Error())
+		return
+	}
+	samples := wavInfo.LeftChannelSamples
+	if wavInfo.Channels == 2 {
+		samples = audio.Mix([][]float64{wavInfo.LeftChannelSamples, wavInfo.RightChannelSamples})
+	}
+
+	learnt, err := shazam.LearnNoiseProfile(samples, wavInfo.SampleRate)
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	profile := noise.Profile{
+		ClientID:   client.ID,
+		DurationMs: audio.FramesToMs(int64(len(samples)), wavInfo.SampleRate),
+		UpdatedAt:  time.Now().UTC(),
+		Noise:      learnt,
+	}
+	if err := noise.Set(profile); err != nil {
+		handleAdminError(w, r, "failed to store noise profile", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, noiseProfileSummary(profile))
+}
+
+// handleGetNoiseProfile describes the noise profile of the signing client.
+func handleGetNoiseProfile(w http.ResponseWriter, r *http.Request) {
+	client, _ := auth.ClientFromContext(r.Context())
+	profile, ok := noise.For(client.ID)
+	if !ok {
+		writeError(w, http.StatusNotFound, "no noise profile")
+		return
+	}
+	writeJSON(w, http.StatusOK, noiseProfileSummary(profile))
+}
+
+// handleDeleteNoiseProfile removes the noise profile of the signing client.
+func handleDeleteNoiseProfile(w http.ResponseWriter, r *http.Request) {
+	client, ok := auth.ClientFromContext(r.Context())
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "noise profiles belong to signed clients")
+		return
+	}
+	if err := noise.Delete(client.ID); err != nil {
+		handleAdminError(w, r, "failed to delete noise profile", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"clientId": client.ID, "status": "deleted"})
+}
@@ -0,0 +1,40 @@
+package opus
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func FuzzDecode(f *testing.F) {
+	tiny, err := os.ReadFile("testdata/tiny.ogg")
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(tiny)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		samples, info, err := Decoder{}.Decode(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		if len(samples) != info.Channels {
+			t.Fatalf("%d channels decoded, %d reported", len(samples), info.Channels)
+		}
+		for _, channel := range samples {
+			if len(channel) != len(samples[0]) {
+				t.Fatal("channels have different lengths")
+			}
+		}
+	})
+}
+
+func FuzzParseTags(f *testing.F) {
+	f.Add([]byte("OpusTags\x06\x00\x00\x00vendor\x02\x00\x00\x00\x0b\x00\x00\x00TITLE=Title\x0c\x00\x00\x00ARTIST=Alias"))
+	f.Add([]byte("OpusTags\xff\xff\xff\xff"))
+	f.Add([]byte("OpusTags\x00\x00\x00\x00\xff\xff\xff\xff"))
+
+	f.Fuzz(func(t *testing.T, packet []byte) {
+		parseTags(packet)
+	})
+}
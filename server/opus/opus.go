@@ -0,0 +1,160 @@
+// Package opus decodes Ogg Opus files, the format of WhatsApp and Telegram
+// voice notes and of most browser recordings saved as .ogg or .opus.
+// Importing it registers the decoder with the audio package.
+package opus
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"song-recognition/audio"
+	"strings"
+
+	pionopus "github.com/pion/opus"
+	"github.com/pion/opus/pkg/oggreader"
+)
+
+// sampleRate is the rate Opus always decodes at. Packets hold frames of 2.5
+// to 60 ms at this rate, up to 120 ms per packet.
+const (
+	sampleRate       = 48000
+	maxPacketSamples = sampleRate * 120 / 1000
+)
+
+func init() {
+	audio.Register("opus", Decoder{})
+}
+
+// Decoder implements audio.Decoder for Ogg Opus.
+type Decoder struct{}
+
+// CanDecode recognises an Ogg stream whose first packet is an Opus header.
+func (Decoder) CanDecode(header []byte) bool {
+	if len(header) < 27 || string(header[0:4]) != "OggS" {
+		return false
+	}
+	start := 27 + int(header[26]) // after the page's segment table
+	return len(header) >= start+8 && string(header[start:start+8]) == "OpusHead"
+}
+
+// Decode decodes a mono or stereo Ogg Opus stream at 48 kHz. The encoder
+// delay (pre-skip) is dropped and the output gain of the header applied.
+func (Decoder) Decode(r io.Reader) (audio.Samples, audio.Info, error) {
+	var info audio.Info
+
+	ogg, header, err := oggreader.NewWith(r)
+	if err != nil {
+		return nil, info, fmt.Errorf("invalid Ogg Opus stream: %v", err)
+	}
+	if header.Channels == 0 || header.Channels > 2 {
+		return nil, info, fmt.Errorf("unsupported Opus channel count %d (only mono/stereo)", header.Channels)
+	}
+	channels := int(header.Channels)
+
+	decoder, err := pionopus.NewDecoderWithOutput(sampleRate, channels)
+	if err != nil {
+		return nil, info, err
+	}
+
+	samples := make(audio.Samples, channels)
+	tags := map[string]string{}
+	buf := make([]float32, maxPacketSamples*channels)
+	var granule uint64
+	for {
+		packet, page, err := ogg.ParseNextPacket()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, info, fmt.Errorf("failed to read Ogg page: %v", err)
+		}
+		if strings.HasPrefix(string(packet), "OpusTags") {
+			tags = parseTags(packet)
+			continue
+		}
+
+		n, err := decoder.DecodeToFloat32(packet, buf)
+		if err != nil {
+			return nil, info, fmt.Errorf("failed to decode Opus packet: %v", err)
+		}
+		for i := 0; i < n; i++ {
+			for c := range samples {
+				samples[c] = append(samples[c], float64(buf[i*channels+c]))
+			}
+		}
+		granule = page.GranulePosition
+	}
+
+	// The granule position of the last page gives the exact length, which
+	// excludes the padding of the last frame
+	for c := range samples {
+		if granule > 0 && granule < uint64(len(samples[c])) {
+			samples[c] = samples[c][:granule]
+		}
+		samples[c] = samples[c][min(int(header.PreSkip), len(samples[c])):]
+	}
+
+	if header.OutputGain != 0 {
+		// Q7.8 decibels
+		gain := math.Pow(10, float64(int16(header.OutputGain))/(20*256))
+		for _, channel := range samples {
+			for i := range channel {
+				channel[i] *= gain
+			}
+		}
+	}
+
+	info = audio.Info{
+		Codec:    "opus",
+		Format:   audio.Format{SampleRate: sampleRate, Channels: channels},
+		Duration: audio.FramesToSeconds(len(samples[0]), sampleRate),
+		Tags:     tags,
+	}
+	return samples, info, nil
+}
+
+// parseTags reads the Vorbis comments of an OpusTags packet, keyed by lower
+// case field name as ffprobe reports them. Truncated packets give the tags
+// read before the end.
+func parseTags(packet []byte) map[string]string {
+	tags := make(map[string]string)
+
+	data, ok := bytes.CutPrefix(packet, []byte("OpusTags"))
+	if !ok {
+		return tags
+	}
+	next := func() ([]byte, bool) {
+		if len(data) < 4 {
+			return nil, false
+		}
+		size := int(binary.LittleEndian.Uint32(data))
+		if size > len(data)-4 {
+			return nil, false
+		}
+		field := data[4 : 4+size]
+		data = data[4+size:]
+		return field, true
+	}
+
+	if _, ok := next(); !ok { // vendor string
+		return tags
+	}
+	if len(data) < 4 {
+		return tags
+	}
+	count := int(binary.LittleEndian.Uint32(data))
+	data = data[4:]
+	for i := 0; i < count; i++ {
+		field, ok := next()
+		if !ok {
+			break
+		}
+		if name, value, ok := strings.Cut(string(field), "="); ok {
+			tags[strings.ToLower(name)] = value
+		}
+	}
+	return tags
+}
@@ -0,0 +1,115 @@
+// Package playback adds links playing matched songs from the matched
+// position to recognition results, so apps can offer to play a song from
+// where it was recognized. Deployments choose the providers linked to.
+package playback
+
+import (
+	"fmt"
+	"song-recognition/db"
+	"song-recognition/links"
+	"song-recognition/shazam"
+	"song-recognition/songmeta"
+	"song-recognition/utils"
+	"strconv"
+	"strings"
+)
+
+// Providers
+const (
+	YouTube = "youtube"
+	Spotify = "spotify"
+)
+
+// defaultTemplates are the links of providers, in which {id} is replaced
+// with the ID of the song with the provider, {seconds} and {ms} with the
+// position in the song and {position} with it as m:ss.
+var defaultTemplates = map[string]string{
+	YouTube: "https://www.youtube.com/watch?v={id}&t={seconds}s",
+	Spotify: "spotify:track:{id}#{position}",
+}
+
+// Providers returns the providers linked to (PLAYBACK_LINKS, comma
+// separated, "none" for none).
+func Providers() []string {
+	var providers []string
+	for _, provider := range strings.Split(utils.GetEnv("PLAYBACK_LINKS", YouTube), ",") {
+		provider = strings.ToLower(strings.TrimSpace(provider))
+		if _, ok := defaultTemplates[provider]; ok {
+			providers = append(providers, provider)
+		}
+	}
+	return providers
+}
+
+// template returns the link of a provider, PLAYBACK_<PROVIDER>_URL if set.
+func template(provider string) string {
+	return utils.GetEnv("PLAYBACK_"+strings.ToUpper(provider)+"_URL", defaultTemplates[provider])
+}
+
+// Link returns the link playing a song from offsetMs with a provider.
+func Link(provider, id string, offsetMs uint32) string {
+	seconds := offsetMs / 1000
+	return strings.NewReplacer(
+		"{id}", id,
+		"{seconds}", strconv.FormatUint(uint64(seconds), 10),
+		"{ms}", strconv.FormatUint(uint64(offsetMs), 10),
+		"{position}", fmt.Sprintf("%d:%02d", seconds/60, seconds%60),
+	).Replace(template(provider))
+}
+
+// Enrich adds playback links to matches, from the position they matched
+// at. YouTube links last found dead by the youtube-links job are left out,
+// and Spotify ones need the Spotify ID recorded when the song was downloaded.
+func Enrich(matches []shazam.Match) error {
+	providers := Providers()
+	if len(matches) == 0 || len(providers) == 0 {
+		return nil
+	}
+
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		return err
+	}
+	defer dbClient.Close()
+
+	for i := range matches {
+		match := &matches[i]
+		match.Playback = nil
+		for _, provider := range providers {
+			id, err := providerID(dbClient, provider, *match)
+			if err != nil {
+				return err
+			}
+			if id != "" {
+				match.Playback = append(match.Playback, shazam.PlaybackLink{
+					Provider: provider,
+					URL:      Link(provider, id, match.Timestamp),
+				})
+			}
+		}
+	}
+	return nil
+}
+
+// providerID returns the ID of a matched song with a provider, empty if it
+// has none that can be played.
+func providerID(dbClient db.DBClient, provider string, match shazam.Match) (string, error) {
+	switch provider {
+	case YouTube:
+		if match.YouTubeID == "" {
+			return "", nil
+		}
+		check, exists, err := links.Get(dbClient, match.SongID)
+		if err != nil {
+			return "", err
+		}
+		if exists && check.YouTubeID == match.YouTubeID && check.Status == links.StatusDead {
+			return "", nil
+		}
+		return match.YouTubeID, nil
+	case Spotify:
+		metadata, _, err := songmeta.Get(dbClient, match.SongID)
+		return metadata.SpotifyID, err
+	}
+	return "", nil
+}
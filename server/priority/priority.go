@@ -0,0 +1,170 @@
+// Package priority shares the server's recognition workers, and the database
+// connections they use, between interactive requests and background work.
+// Interactive requests are always admitted first and background work may only
+// use part of the capacity, so maintenance running alongside doesn't make
+// users wait.
+package priority
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// Class is the priority of a unit of work.
+type Class int
+
+const (
+	// Interactive work has a user waiting for it, such as a recognition
+	// request.
+	Interactive Class = iota
+	// Background work is batch recognition, archive replays, ingestion and
+	// index maintenance.
+	Background
+)
+
+func (c Class) String() string {
+	if c == Background {
+		return "background"
+	}
+	return "interactive"
+}
+
+// Scheduler admits units of work up to a capacity, serving waiting
+// interactive work before background work.
+type Scheduler struct {
+	mu              sync.Mutex
+	capacity        int
+	backgroundLimit int
+	running         [2]int
+	waiting         [2][]chan struct{}
+}
+
+// NewScheduler returns a scheduler running up to capacity units of work at
+// once, of which at most backgroundLimit background ones.
+func NewScheduler(capacity, backgroundLimit int) *Scheduler {
+	capacity = max(capacity, 1)
+	return &Scheduler{capacity: capacity, backgroundLimit: min(max(backgroundLimit, 1), capacity)}
+}
+
+// Resize changes the capacity of the scheduler. Work already running
+// carries on; new work is admitted within the new capacity.
+func (s *Scheduler) Resize(capacity, backgroundLimit int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.capacity = max(capacity, 1)
+	s.backgroundLimit = min(max(backgroundLimit, 1), s.capacity)
+	s.dispatch()
+}
+
+// admits reports whether a unit of work of the class can start now. Callers
+// hold the lock.
+func (s *Scheduler) admits(class Class) bool {
+	if s.running[Interactive]+s.running[Background] >= s.capacity {
+		return false
+	}
+	if class == Background {
+		return s.running[Background] < s.backgroundLimit && len(s.waiting[Interactive]) == 0
+	}
+	return true
+}
+
+// TryAcquire starts a unit of work of the class if it can start right away.
+// The returned function must be called when the work is over.
+func (s *Scheduler) TryAcquire(class Class) (func(), bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.waiting[class]) > 0 || !s.admits(class) {
+		return nil, false
+	}
+	s.running[class]++
+	return s.releaser(class), true
+}
+
+// Acquire waits until a unit of work of the class may start, or ctx is done.
+// The returned function must be called when the work is over.
+func (s *Scheduler) Acquire(ctx context.Context, class Class) (func(), error) {
+	s.mu.Lock()
+	if len(s.waiting[class]) == 0 && s.admits(class) {
+		s.running[class]++
+		s.mu.Unlock()
+		return s.releaser(class), nil
+	}
+	ready := make(chan struct{})
+	s.waiting[class] = append(s.waiting[class], ready)
+	s.mu.Unlock()
+
+	select {
+	case <-ready:
+		return s.releaser(class), nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for i, waiter := range s.waiting[class] {
+			if waiter == ready {
+				s.waiting[class] = append(s.waiting[class][:i], s.waiting[class][i+1:]...)
+				// Others may have been held back by this waiter
+				s.dispatch()
+				return nil, ctx.Err()
+			}
+		}
+		// Admitted meanwhile
+		s.running[class]--
+		s.dispatch()
+		return nil, ctx.Err()
+	}
+}
+
+func (s *Scheduler) releaser(class Class) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.mu.Lock()
+			s.running[class]--
+			s.dispatch()
+			s.mu.Unlock()
+		})
+	}
+}
+
+// dispatch starts waiting work while there is room, interactive first.
+// Callers hold the lock.
+func (s *Scheduler) dispatch() {
+	for _, class := range []Class{Interactive, Background} {
+		for len(s.waiting[class]) > 0 && s.admits(class) {
+			s.running[class]++
+			close(s.waiting[class][0])
+			s.waiting[class] = s.waiting[class][1:]
+		}
+	}
+}
+
+// Running returns the number of units of work of the class running.
+func (s *Scheduler) Running(class Class) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.running[class]
+}
+
+var defaultScheduler atomic.Pointer[Scheduler]
+
+// SetDefault makes s the scheduler used by Acquire. The server sets one up;
+// command line tools don't, so they run unthrottled.
+func SetDefault(s *Scheduler) {
+	defaultScheduler.Store(s)
+}
+
+// Default returns the scheduler set by SetDefault, or nil.
+func Default() *Scheduler {
+	return defaultScheduler.Load()
+}
+
+// Acquire waits for the default scheduler to admit a unit of work of the
+// class. Without a default scheduler it returns immediately.
+func Acquire(ctx context.Context, class Class) (func(), error) {
+	s := Default()
+	if s == nil {
+		return func() {}, nil
+	}
+	return s.Acquire(ctx, class)
+}
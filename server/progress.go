@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+// progressEmitEvery is how often progress events are written while a stage
+// advances; stages starting and ending, items and errors are always written.
+const progressEmitEvery = time.Second
+
+// Kinds of progress events
+const (
+	progressStage    = "stage"    // a stage started
+	progressAdvance  = "progress" // counts moved on
+	progressItem     = "item"     // a file or song was processed, or failed
+	progressFinished = "done"     // the command ended, with Error if it failed
+)
+
+// progressEvent is a line written by bulk commands run with --json.
+type progressEvent struct {
+	Time      time.Time `json:"time"`
+	Command   string    `json:"command"`
+	Event     string    `json:"event"`
+	Stage     string    `json:"stage,omitempty"`
+	Done      int64     `json:"done"`
+	Failed    int64     `json:"failed"`
+	Total     int64     `json:"total,omitempty"` // unknown if 0
+	ElapsedMs int64     `json:"elapsedMs"`       // since the stage started
+	ETAMs     *int64    `json:"etaMs,omitempty"` // set once the total is known and work was done
+	Item      string    `json:"item,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// progress counts the work of a bulk command through its stages and, with
+// --json, writes it to stdout as JSON lines for wrappers and CI to parse.
+type progress struct {
+	command string
+	out     io.Writer // nil without --json
+
+	mu      sync.Mutex
+	stage   string
+	total   int64
+	done    int64
+	failed  int64
+	started time.Time
+	emitted time.Time
+}
+
+// newProgress returns the progress of a command. With asJSON, stdout is kept
+// for the events and everything else the command prints, logs included, goes
+// to stderr.
+func newProgress(command string, asJSON bool) *progress {
+	p := &progress{command: command, started: time.Now()}
+	if asJSON {
+		p.out = os.Stdout
+		os.Stdout = os.Stderr
+		color.Output = os.Stderr
+	}
+	return p
+}
+
+// startStage starts counting a stage of total units of work, 0 if unknown.
+func (p *progress) startStage(stage string, total int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stage, p.total, p.done, p.failed = stage, total, 0, 0
+	p.started = time.Now()
+	p.emit(progressStage, "", nil)
+}
+
+// add counts units of work done in the current stage.
+func (p *progress) add(done int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done += done
+	if time.Since(p.emitted) >= progressEmitEvery || p.total > 0 && p.done >= p.total {
+		p.emit(progressAdvance, "", nil)
+	}
+}
+
+// item counts a unit of work of the current stage, failed if err isn't nil.
+func (p *progress) item(name string, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done++
+	if err != nil {
+		p.failed++
+	}
+	p.emit(progressItem, name, err)
+}
+
+// finish reports the end of the command, which failed if err isn't nil.
+func (p *progress) finish(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.emit(progressFinished, "", err)
+}
+
+// emit writes an event of the current counts. Callers hold the lock.
+func (p *progress) emit(event, item string, err error) {
+	p.emitted = time.Now()
+	if p.out == nil {
+		return
+	}
+
+	elapsed := time.Since(p.started)
+	line := progressEvent{
+		Time:      p.emitted.UTC(),
+		Command:   p.command,
+		Event:     event,
+		Stage:     p.stage,
+		Done:      p.done,
+		Failed:    p.failed,
+		Total:     p.total,
+		ElapsedMs: elapsed.Milliseconds(),
+		Item:      item,
+	}
+	if p.total > 0 && p.done > 0 && event != progressFinished {
+		eta := int64(float64(elapsed.Milliseconds()) / float64(p.done) * float64(max(p.total-p.done, 0)))
+		line.ETAMs = &eta
+	}
+	if err != nil {
+		line.Error = err.Error()
+	}
+
+	data, _ := json.Marshal(line)
+	p.out.Write(append(data, '\n'))
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"song-recognition/utils"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	defaultCORSHeaders = "Content-Type, Authorization, X-Client-ID, X-Timestamp, X-Nonce, X-Signature"
+	corsMethods        = "GET, POST, PUT, DELETE, OPTIONS"
+	corsExposedHeaders = "Retry-After"
+)
+
+// corsConfig is who browsers may let call the server from another origin.
+type corsConfig struct {
+	anyOrigin bool
+	origins   []string // lower case scheme://host[:port]
+	headers   string
+	maxAge    string
+}
+
+// corsSettings caches the CORS configuration, cleared by reloadProxySettings.
+var corsSettings atomic.Pointer[corsConfig]
+
+// getCORSConfig returns the settings of CORS_ALLOWED_ORIGINS (comma
+// separated origins, "*" for any, the default), CORS_ALLOWED_HEADERS and
+// CORS_MAX_AGE in seconds (default 600).
+func getCORSConfig() *corsConfig {
+	if config := corsSettings.Load(); config != nil {
+		return config
+	}
+
+	config := &corsConfig{headers: utils.GetEnv("CORS_ALLOWED_HEADERS", defaultCORSHeaders)}
+	for _, origin := range strings.Split(utils.GetEnv("CORS_ALLOWED_ORIGINS", "*"), ",") {
+		origin = strings.ToLower(strings.TrimRight(strings.TrimSpace(origin), "/"))
+		switch origin {
+		case "":
+		case "*":
+			config.anyOrigin = true
+		default:
+			config.origins = append(config.origins, origin)
+		}
+	}
+
+	maxAge, err := strconv.Atoi(utils.GetEnv("CORS_MAX_AGE", "600"))
+	if err != nil || maxAge < 0 {
+		maxAge = 600
+	}
+	config.maxAge = strconv.Itoa(maxAge)
+
+	corsSettings.Store(config)
+	return config
+}
+
+// allowOrigin reports whether a request may come from its Origin. Requests
+// without one aren't from browsers, and pages served by the server itself are
+// always allowed, including behind a proxy terminating TLS.
+func allowOrigin(r *http.Request) bool {
+	origin := strings.ToLower(r.Header.Get("Origin"))
+	if origin == "" || origin == strings.ToLower(requestScheme(r)+"://"+r.Host) {
+		return true
+	}
+	config := getCORSConfig()
+	return config.anyOrigin || slices.Contains(config.origins, origin)
+}
+
+// withCORS adds the CORS headers to responses to allowed origins and answers
+// their preflight requests.
+func withCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Origin")
+		allowed := allowOrigin(r)
+		if allowed {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Expose-Headers", corsExposedHeaders)
+		}
+
+		if r.Method != http.MethodOptions || r.Header.Get("Access-Control-Request-Method") == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !allowed {
+			writeError(w, http.StatusForbidden, "origin not allowed")
+			return
+		}
+		config := getCORSConfig()
+		w.Header().Set("Access-Control-Allow-Methods", corsMethods)
+		w.Header().Set("Access-Control-Allow-Headers", config.headers)
+		w.Header().Set("Access-Control-Max-Age", config.maxAge)
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// trustedProxies caches the parsed TRUSTED_PROXIES, cleared by
+// reloadProxySettings.
+var trustedProxies atomic.Pointer[[]netip.Prefix]
+
+// getTrustedProxies returns the proxies whose X-Forwarded-For and
+// X-Forwarded-Proto headers are believed, from TRUSTED_PROXIES (comma
+// separated addresses or CIDR ranges). Without it the headers are ignored,
+// as anyone could send them.
+func getTrustedProxies() []netip.Prefix {
+	if prefixes := trustedProxies.Load(); prefixes != nil {
+		return *prefixes
+	}
+
+	prefixes := []netip.Prefix{}
+	for _, value := range strings.Split(utils.GetEnv("TRUSTED_PROXIES"), ",") {
+		if value = strings.TrimSpace(value); value == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(value)
+			if addrErr != nil {
+				log.Printf("invalid TRUSTED_PROXIES entry %q: %v\n", value, err)
+				continue
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+
+	trustedProxies.Store(&prefixes)
+	return prefixes
+}
+
+// reloadProxySettings makes the next requests read the CORS and trusted proxy
+// settings again.
+func reloadProxySettings() {
+	corsSettings.Store(nil)
+	trustedProxies.Store(nil)
+}
+
+func trustedProxy(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range getTrustedProxies() {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+type schemeKey struct{}
+
+// requestScheme returns the scheme clients used to reach the server, which
+// is the one given by a trusted proxy in front of it.
+func requestScheme(r *http.Request) string {
+	if scheme, ok := r.Context().Value(schemeKey{}).(string); ok {
+		return scheme
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// clientIP returns the address of the client of a request, as seen by the
+// first trusted proxy it went through.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// withForwardedHeaders replaces the remote address and scheme of requests
+// relayed by trusted proxies, or by a frontend over the Unix socket, with the
+// ones of their client, so rate limits apply per client rather than per
+// proxy. X-Forwarded-For is read from the right, skipping the proxies, since
+// clients may send one of their own.
+func withForwardedHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fromProxy := fromUnixSocket(r)
+		var client netip.Addr
+		if peer, err := netip.ParseAddrPort(r.RemoteAddr); err == nil {
+			client = peer.Addr().Unmap()
+			fromProxy = fromProxy || trustedProxy(client)
+		}
+		if !fromProxy {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+		for i := len(forwarded) - 1; i >= 0 && (!client.IsValid() || trustedProxy(client)); i-- {
+			addr, err := netip.ParseAddr(strings.TrimSpace(forwarded[i]))
+			if err != nil {
+				break
+			}
+			client = addr.Unmap()
+		}
+
+		r = r.Clone(r.Context())
+		if client.IsValid() {
+			r.RemoteAddr = netip.AddrPortFrom(client, 0).String()
+		}
+		proto := strings.ToLower(strings.TrimSpace(strings.Split(r.Header.Get("X-Forwarded-Proto"), ",")[0]))
+		if proto == "http" || proto == "https" {
+			r = r.WithContext(context.WithValue(r.Context(), schemeKey{}, proto))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"song-recognition/utils"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/joho/godotenv"
+	"github.com/mdobak/go-xerrors"
+)
+
+// envFile tracks the variables set from the .env file, so it can be read
+// again without overriding those set in the environment of the process.
+var envFile struct {
+	sync.Mutex
+	fixed  map[string]bool   // set in the environment the server started with
+	loaded map[string]string // set from the file
+}
+
+// loadEnvFile sets the variables of the .env file that aren't set in the
+// environment. Called again, it applies the changes made to the file since
+// and returns the names of the variables that changed.
+func loadEnvFile() ([]string, error) {
+	envFile.Lock()
+	defer envFile.Unlock()
+
+	if envFile.fixed == nil {
+		envFile.fixed = make(map[string]bool)
+		for _, entry := range os.Environ() {
+			key, _, _ := strings.Cut(entry, "=")
+			envFile.fixed[key] = true
+		}
+	}
+
+	values, err := godotenv.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read .env: %v", err)
+	}
+
+	var changed []string
+	loaded := make(map[string]string, len(values))
+	for key, value := range values {
+		if envFile.fixed[key] {
+			continue
+		}
+		loaded[key] = value
+		if previous, ok := envFile.loaded[key]; !ok || previous != value {
+			os.Setenv(key, value)
+			changed = append(changed, key)
+		}
+	}
+	for key := range envFile.loaded {
+		if _, ok := loaded[key]; !ok {
+			os.Unsetenv(key)
+			changed = append(changed, key)
+		}
+	}
+	envFile.loaded = loaded
+
+	sort.Strings(changed)
+	return changed, nil
+}
+
+// applyLogLevel sets the level of the logs from LOG_LEVEL: debug, info (the
+// default), warn or error.
+func applyLogLevel() error {
+	if err := utils.SetLogLevel(utils.GetEnv("LOG_LEVEL", "info")); err != nil {
+		return fmt.Errorf("LOG_LEVEL: %v", err)
+	}
+	return nil
+}
+
+// reloadResult describes a reload of the configuration. Only the names of
+// the variables that changed are given, as values may be secrets.
+type reloadResult struct {
+	Changed    []string  `json:"changed"`
+	Errors     []string  `json:"errors,omitempty"`
+	ReloadedAt time.Time `json:"reloadedAt"`
+}
+
+var reloadMu sync.Mutex
+
+// reloadConfig reads the .env file again and applies the settings that can
+// change while the server runs: thresholds and other settings read as they
+// are used, recognition limits, CORS and trusted proxies, the events history,
+// the log level and MONITORS_FILE. Settings of the database, the listener,
+// TLS and MAINTENANCE_SCHEDULE need a restart. Live recognition sessions
+// carry on.
+func reloadConfig(ctx context.Context) reloadResult {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	result := reloadResult{Changed: []string{}, ReloadedAt: time.Now().UTC()}
+	changed, err := loadEnvFile()
+	if err != nil {
+		// Settings of the environment may still have been changed by hand
+		result.Errors = append(result.Errors, err.Error())
+	}
+	if changed != nil {
+		result.Changed = changed
+	}
+
+	if err := applyLogLevel(); err != nil {
+		result.Errors = append(result.Errors, err.Error())
+	}
+	getRecognitionLimiter().reload()
+	getClientLimiter().reload()
+	reloadProxySettings()
+	getMatchBroker().Resize(eventsHistory())
+	if err := getMonitors().Sync(); err != nil {
+		result.Errors = append(result.Errors, fmt.Sprintf("failed to sync monitors: %v", err))
+	}
+
+	logger := utils.GetLogger()
+	for _, message := range result.Errors {
+		err := xerrors.New(message)
+		logger.ErrorContext(ctx, "failed to reload configuration.", slog.Any("error", err))
+	}
+	logger.Info(fmt.Sprintf("Reloaded configuration, %d settings changed", len(result.Changed)), slog.Any("changed", result.Changed))
+	return result
+}
+
+// reloadOnSignal reloads the configuration whenever the server gets SIGHUP.
+func reloadOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			log.Println("SIGHUP received, reloading configuration")
+			reloadConfig(context.Background())
+		}
+	}()
+}
+
+func handleReload(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, reloadConfig(r.Context()))
+}
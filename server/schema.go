@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"song-recognition/db"
+	"song-recognition/utils"
+	"strconv"
+
+	"github.com/mdobak/go-xerrors"
+)
+
+// schemaStatus tells which schema version the catalog is at and which
+// migrations it still needs.
+type schemaStatus struct {
+	Version int            `json:"version"`
+	Latest  int            `json:"latest"`
+	Pending []db.Migration `json:"pending"`
+}
+
+func readSchemaStatus(dbClient db.DBClient) (schemaStatus, error) {
+	status := schemaStatus{Latest: db.LatestSchemaVersion(), Pending: []db.Migration{}}
+	var err error
+	status.Version, err = db.CurrentSchemaVersion(dbClient)
+	if err != nil {
+		return status, err
+	}
+	pending, err := db.PendingMigrations(dbClient)
+	if pending != nil {
+		status.Pending = pending
+	}
+	return status, err
+}
+
+// schemaCommand shows the schema version of the catalog, or upgrades it.
+func schemaCommand(args []string) {
+	usage := func() {
+		fmt.Println("Usage: main.go schema <status | upgrade> [--json]")
+		os.Exit(1)
+	}
+	if len(args) < 1 {
+		usage()
+	}
+	schemaCmd := flag.NewFlagSet("schema", flag.ExitOnError)
+	asJSON := schemaCmd.Bool("json", false, "print progress as JSON lines")
+	schemaCmd.Parse(args[1:])
+
+	switch args[0] {
+	case "status":
+		dbClient, err := db.NewDBClient()
+		if err != nil {
+			yellow.Println("Error connecting to DB:", err)
+			os.Exit(1)
+		}
+		defer dbClient.Close()
+
+		status, err := readSchemaStatus(dbClient)
+		if err != nil {
+			yellow.Println("Error reading the schema version:", err)
+			os.Exit(1)
+		}
+		if *asJSON {
+			json.NewEncoder(os.Stdout).Encode(status)
+			return
+		}
+		fmt.Printf("Schema version %d, latest %d.\n", status.Version, status.Latest)
+		for _, migration := range status.Pending {
+			fmt.Printf("  pending %d: %s\n", migration.Version, migration.Description)
+		}
+	case "upgrade":
+		upgradeSchema(*asJSON)
+	default:
+		usage()
+	}
+}
+
+// upgradeSchema applies the pending migrations of the catalog.
+func upgradeSchema(asJSON bool) {
+	progress := newProgress("schema", asJSON)
+	fail := func(message string, err error) {
+		yellow.Println(message, err)
+		progress.finish(err)
+		os.Exit(1)
+	}
+
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		fail("Error connecting to DB:", err)
+	}
+	defer dbClient.Close()
+
+	applied, err := db.UpgradeSchema(dbClient, func(migration db.Migration) {
+		fmt.Printf("Migrating to schema version %d: %s...\n", migration.Version, migration.Description)
+		progress.startStage(fmt.Sprintf("migration-%d", migration.Version), 0)
+	})
+	if err != nil {
+		fail("Error upgrading the schema:", err)
+	}
+	fmt.Printf("Applied %d migrations; the catalog is at schema version %d.\n", len(applied), db.LatestSchemaVersion())
+	progress.finish(nil)
+}
+
+// printPendingMigrations tells when a catalog loaded from an archive, which
+// takes the schema version of the archive, needs `schema upgrade`.
+func printPendingMigrations(dbClient db.DBClient) {
+	pending, err := db.PendingMigrations(dbClient)
+	if err == nil && len(pending) > 0 {
+		fmt.Printf("The catalog is at schema version %d; run `schema upgrade` to apply the %d migrations it needs.\n", pending[0].Version-1, len(pending))
+	}
+}
+
+// checkSchema refuses to serve catalogs of a newer schema, and stamps new
+// catalogs with the latest one. Older catalogs are upgraded when
+// SCHEMA_AUTO_UPGRADE is true, before serving; otherwise the server warns
+// that `schema upgrade` should be run.
+func checkSchema() {
+	logger := utils.GetLogger()
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		logger.Warn("Couldn't check the catalog schema", slog.Any("error", xerrors.New(err)))
+		return
+	}
+	defer dbClient.Close()
+
+	pending, err := db.PendingMigrations(dbClient)
+	if errors.Is(err, db.ErrSchemaNewer) {
+		log.Fatalf("Refusing to serve: %v", err)
+	}
+	if err != nil {
+		logger.Warn("Couldn't check the catalog schema", slog.Any("error", xerrors.New(err)))
+		return
+	}
+	autoUpgrade, _ := strconv.ParseBool(utils.GetEnv("SCHEMA_AUTO_UPGRADE", "false"))
+	if len(pending) > 0 && !autoUpgrade {
+		logger.Warn(fmt.Sprintf("The catalog needs %d schema migrations, run `schema upgrade`", len(pending)))
+		return
+	}
+
+	_, err = db.UpgradeSchema(dbClient, func(migration db.Migration) {
+		logger.Info(fmt.Sprintf("Migrating to schema version %d: %s", migration.Version, migration.Description))
+	})
+	if err != nil {
+		log.Fatalf("Failed to upgrade the catalog schema: %v", err)
+	}
+}
+
+// handleGetSchema serves the schema version of the catalog and its pending
+// migrations.
+func handleGetSchema(w http.ResponseWriter, r *http.Request) {
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		handleAdminError(w, r, "error connecting to DB", err)
+		return
+	}
+	defer dbClient.Close()
+
+	status, err := readSchemaStatus(dbClient)
+	if err != nil && !errors.Is(err, db.ErrSchemaNewer) {
+		handleAdminError(w, r, "failed to read the schema version", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
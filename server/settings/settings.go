@@ -0,0 +1,167 @@
+// Package settings keeps the defaults of API clients in the database, so
+// that they apply to every request of a client without it sending them.
+package settings
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"song-recognition/archive"
+	"song-recognition/cached"
+	"song-recognition/db"
+	"song-recognition/shazam"
+	"song-recognition/timefmt"
+	"time"
+)
+
+const (
+	collection     = "client_settings"
+	reloadInterval = 30 * time.Second
+)
+
+// Settings are the defaults of an API client. Requests setting a value
+// themselves take precedence, and unset fields keep the server's.
+type Settings struct {
+	ClientID   string                    `json:"clientId"`
+	Thresholds shazam.ThresholdOverrides `json:"thresholds"`
+	// Locale formats the times of responses to requests without a locale,
+	// rather than their Accept-Language header.
+	Locale string `json:"locale,omitempty"`
+	// WebhookURL is notified when archived clips of the client match, rather
+	// than REPLAY_WEBHOOK_URL.
+	WebhookURL string `json:"webhookUrl,omitempty"`
+	// ArchiveUnmatched overrides ARCHIVE_UNMATCHED for the client.
+	ArchiveUnmatched *bool     `json:"archiveUnmatched,omitempty"`
+	UpdatedAt        time.Time `json:"updatedAt"`
+}
+
+// Validate checks settings before they are saved.
+func (s Settings) Validate() error {
+	if s.ClientID == "" {
+		return fmt.Errorf("clientId is required")
+	}
+	for name, value := range map[string]*float64{
+		"minAlignedCouples":   s.Thresholds.MinAlignedCouples,
+		"minAlignedPerSecond": s.Thresholds.MinAlignedPerSecond,
+		"minConfidence":       s.Thresholds.MinConfidence,
+	} {
+		if value != nil && *value < 0 {
+			return fmt.Errorf("thresholds.%s must not be negative", name)
+		}
+	}
+	if s.Locale != "" && !timefmt.ValidLocale(s.Locale) {
+		return fmt.Errorf("locale must be a language tag such as en-US, got %q", s.Locale)
+	}
+	if s.WebhookURL != "" {
+		u, err := url.Parse(s.WebhookURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("webhookUrl must be an http or https URL")
+		}
+	}
+	return nil
+}
+
+// Archives reports whether the unmatched queries of the client are archived.
+func (s Settings) Archives() bool {
+	if s.ArchiveUnmatched != nil {
+		return *s.ArchiveUnmatched
+	}
+	return archive.Enabled()
+}
+
+var cache = cached.New(reloadInterval, Load)
+
+// For returns the settings of a client, reloading them from the database at
+// most every 30 seconds so that changes made on other instances are picked
+// up. Clients without settings, such as the zero client of unsigned
+// requests, get empty ones. If the settings can't be loaded the previous
+// ones are kept.
+func For(clientID string) Settings {
+	if clientID == "" {
+		return Settings{}
+	}
+	if settings, ok := cache.Get()[clientID]; ok {
+		return settings
+	}
+	return Settings{ClientID: clientID}
+}
+
+// Load reads the settings of every client from the database, keyed by
+// client ID.
+func Load() (map[string]Settings, error) {
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		return nil, err
+	}
+	defer dbClient.Close()
+
+	records, err := dbClient.ListRecords(collection, db.RecordFilter{})
+	if err != nil {
+		return nil, err
+	}
+	settings := make(map[string]Settings, len(records))
+	for _, record := range records {
+		var s Settings
+		if err := json.Unmarshal(record.Data, &s); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal settings of client %s: %v", record.ID, err)
+		}
+		settings[s.ClientID] = s
+	}
+	return settings, nil
+}
+
+// Get reads the settings of a client from the database.
+func Get(clientID string) (Settings, bool, error) {
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		return Settings{}, false, err
+	}
+	defer dbClient.Close()
+
+	record, exists, err := dbClient.GetRecord(collection, clientID)
+	if err != nil || !exists {
+		return Settings{}, false, err
+	}
+	var s Settings
+	if err := json.Unmarshal(record.Data, &s); err != nil {
+		return Settings{}, false, fmt.Errorf("failed to unmarshal settings of client %s: %v", clientID, err)
+	}
+	return s, true, nil
+}
+
+// Save creates or replaces the settings of a client.
+func Save(s Settings) (Settings, error) {
+	s.UpdatedAt = time.Now().UTC()
+	data, err := json.Marshal(s)
+	if err != nil {
+		return s, fmt.Errorf("failed to marshal settings: %v", err)
+	}
+
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		return s, err
+	}
+	defer dbClient.Close()
+
+	err = dbClient.PutRecord(collection, db.Record{ID: s.ClientID, ClientID: s.ClientID, CreatedAt: s.UpdatedAt, Data: data})
+	if err != nil {
+		return s, err
+	}
+	cache.Invalidate()
+	return s, nil
+}
+
+// Delete removes the settings of a client, which gets the server's again.
+func Delete(clientID string) error {
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		return err
+	}
+	defer dbClient.Close()
+
+	if err := dbClient.DeleteRecord(collection, clientID); err != nil {
+		return err
+	}
+	cache.Invalidate()
+	return nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"song-recognition/settings"
+)
+
+func handleListClientSettings(w http.ResponseWriter, r *http.Request) {
+	all, err := settings.Load()
+	if err != nil {
+		handleAdminError(w, r, "failed to load client settings", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, all)
+}
+
+func handleGetClientSettings(w http.ResponseWriter, r *http.Request) {
+	clientSettings, exists, err := settings.Get(r.PathValue("id"))
+	if err != nil {
+		handleAdminError(w, r, "failed to read client settings", err)
+		return
+	}
+	if !exists {
+		writeError(w, http.StatusNotFound, "client has no settings")
+		return
+	}
+	writeJSON(w, http.StatusOK, clientSettings)
+}
+
+// handleSetClientSettings replaces the settings of an API client, applied to
+// its requests from then on, within 30 seconds on other instances.
+func handleSetClientSettings(w http.ResponseWriter, r *http.Request) {
+	var clientSettings settings.Settings
+	if err := json.NewDecoder(r.Body).Decode(&clientSettings); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body: "+err.Error())
+		return
+	}
+	clientSettings.ClientID = r.PathValue("id")
+	if err := clientSettings.Validate(); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	clientSettings, err := settings.Save(clientSettings)
+	if err != nil {
+		handleAdminError(w, r, "failed to save client settings", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, clientSettings)
+}
+
+func handleDeleteClientSettings(w http.ResponseWriter, r *http.Request) {
+	clientID := r.PathValue("id")
+	if err := settings.Delete(clientID); err != nil {
+		handleAdminError(w, r, "failed to delete client settings", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"clientId": clientID, "status": "deleted"})
+}
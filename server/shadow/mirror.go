@@ -0,0 +1,347 @@
+package shadow
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"song-recognition/models"
+	"song-recognition/priority"
+	"song-recognition/shazam"
+	"song-recognition/utils"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// maxInFlight is how many mirrored queries may run at once; queries
+	// beyond it aren't mirrored, so a slow shadow index can't pile them up.
+	maxInFlight = 4
+	// recentKept is how many of the latest differing comparisons are kept.
+	recentKept = 20
+	// debugMatches is how many matches of the shadow index debug responses
+	// carry.
+	debugMatches = 5
+)
+
+// Outcomes of comparing the results of a query on both indexes
+const (
+	OutcomeAgree      = "agree"       // both recognised the same song
+	OutcomeDisagree   = "disagree"    // both recognised a song, not the same
+	OutcomeLiveOnly   = "live-only"   // only the live index recognised a song
+	OutcomeShadowOnly = "shadow-only" // only the shadow index recognised a song
+	OutcomeNeither    = "neither"     // neither recognised a song
+)
+
+// Outcomes lists the outcomes of comparisons.
+var Outcomes = []string{OutcomeAgree, OutcomeDisagree, OutcomeLiveOnly, OutcomeShadowOnly, OutcomeNeither}
+
+// Query is a recognition query the live index answered.
+type Query struct {
+	Source string // where the query came from, e.g. api, audio or socket
+	// The audio of the query, fingerprinted again with the shadow parameters,
+	// or, when the client fingerprinted it, the fingerprint it sent, which is
+	// mirrored as is
+	Samples     []float64
+	SampleRate  int
+	Fingerprint map[uint32]uint32
+	Visible     func(songID models.SongID) bool
+	Thresholds  shazam.Thresholds
+	Matches     []shazam.Match // found in the live index
+	Duration    time.Duration  // of the live search
+}
+
+// Result is how an index answered a query.
+type Result struct {
+	Recognized bool          `json:"recognized"`
+	SongID     models.SongID `json:"songId,omitempty"` // of the best match
+	Score      float64       `json:"score"`
+	Confidence float64       `json:"confidence"`
+	DurationMs int64         `json:"durationMs"`
+	// The best matches of the shadow index, in debug responses
+	Matches []shazam.Match `json:"matches,omitempty"`
+}
+
+// Comparison is how the results of a query on both indexes compare.
+type Comparison struct {
+	Time    time.Time `json:"time"`
+	Source  string    `json:"source"`
+	Outcome string    `json:"outcome"`
+	// Agree is set when both indexes recognised the same song, or neither
+	// recognised any
+	Agree bool `json:"agree"`
+	// SameTopMatch is set when the best matches are the same song, whether
+	// recognised or not
+	SameTopMatch bool `json:"sameTopMatch"`
+	// Differences between the best matches, shadow minus live
+	ScoreDelta      float64 `json:"scoreDelta"`
+	ConfidenceDelta float64 `json:"confidenceDelta"`
+	Live            Result  `json:"live"`
+	Shadow          Result  `json:"shadow"`
+}
+
+// IndexStats sum up how an index answered the compared queries.
+type IndexStats struct {
+	Recognized     uint64  `json:"recognized"`
+	MeanScore      float64 `json:"meanScore"`      // of the best matches
+	MeanConfidence float64 `json:"meanConfidence"` // of the best matches
+	ScoreSum       float64 `json:"scoreSum"`
+	ConfidenceSum  float64 `json:"confidenceSum"`
+	Seconds        float64 `json:"seconds"` // searching
+}
+
+// Stats describe the queries compared since the server started.
+type Stats struct {
+	Enabled        bool              `json:"enabled"`
+	Params         string            `json:"params"` // hash of the shadow parameters
+	FanOut         int               `json:"fanOut"`
+	LiveFanOut     int               `json:"liveFanOut"`
+	MirrorRate     float64           `json:"mirrorRate"`
+	DebugResponses bool              `json:"debugResponses"`
+	Compared       uint64            `json:"compared"` // mirrored queries and debug requests
+	Skipped        uint64            `json:"skipped"`  // not mirrored with too many in flight
+	Errors         uint64            `json:"errors"`
+	Outcomes       map[string]uint64 `json:"outcomes"`
+	// Outcomes by where the queries came from
+	BySource map[string]map[string]uint64 `json:"bySource"`
+	// Share of the compared queries both indexes answered alike
+	Agreement float64 `json:"agreement"`
+	// Share of the compared queries whose best matches are the same song
+	TopMatchAgreement float64    `json:"topMatchAgreement"`
+	Live              IndexStats `json:"live"`
+	Shadow            IndexStats `json:"shadow"`
+	// The latest comparisons with differing outcomes, newest first
+	Recent []Comparison `json:"recent"`
+}
+
+var inFlight atomic.Int32
+
+// indexTotals add up the results of an index.
+type indexTotals struct {
+	recognized                 uint64
+	score, confidence, seconds float64
+}
+
+func (t *indexTotals) add(result Result) {
+	if result.Recognized {
+		t.recognized++
+	}
+	t.score += result.Score
+	t.confidence += result.Confidence
+	t.seconds += float64(result.DurationMs) / 1000
+}
+
+func (t indexTotals) stats(compared uint64) IndexStats {
+	stats := IndexStats{Recognized: t.recognized, ScoreSum: t.score, ConfidenceSum: t.confidence, Seconds: t.seconds}
+	if compared > 0 {
+		stats.MeanScore, stats.MeanConfidence = t.score/float64(compared), t.confidence/float64(compared)
+	}
+	return stats
+}
+
+var stats = struct {
+	sync.Mutex
+	skipped, errors uint64
+	outcomes        map[string]map[string]uint64 // source -> outcome -> queries
+	sameTopMatch    uint64
+	live, shadow    indexTotals
+	recent          []Comparison
+}{outcomes: make(map[string]map[string]uint64)}
+
+// mirrorRate returns the share of queries mirrored to the shadow index, from
+// SHADOW_MIRROR_RATE (default 0, between 0 and 1).
+func mirrorRate() float64 {
+	rate, err := strconv.ParseFloat(utils.GetEnv("SHADOW_MIRROR_RATE", "0"), 64)
+	if err != nil || rate < 0 {
+		return 0
+	}
+	return min(rate, 1)
+}
+
+// DebugResponses reports whether requests asking for debug information get
+// the results of the shadow index along with those of the live one, from
+// SHADOW_DEBUG_RESPONSES (default false). They need a shadow index.
+func DebugResponses() bool {
+	enabled, _ := strconv.ParseBool(utils.GetEnv("SHADOW_DEBUG_RESPONSES", "false"))
+	return enabled && Enabled()
+}
+
+// Mirror runs a share SHADOW_MIRROR_RATE of the queries answered by the live
+// index against the shadow index too, in the background at a background
+// priority, and records how the results compare. It returns at once; the
+// samples and fingerprint of query must not be modified afterwards.
+func Mirror(query Query) {
+	if !Enabled() {
+		return
+	}
+	if rate := mirrorRate(); rate == 0 || rand.Float64() >= rate {
+		return
+	}
+	if inFlight.Add(1) > maxInFlight {
+		inFlight.Add(-1)
+		stats.Lock()
+		stats.skipped++
+		stats.Unlock()
+		return
+	}
+
+	query.Matches = append([]shazam.Match(nil), query.Matches...)
+	go func() {
+		defer inFlight.Add(-1)
+		release, err := priority.Acquire(context.Background(), priority.Background)
+		if err != nil {
+			record(Comparison{}, err)
+			return
+		}
+		defer release()
+		comparison, err := compare(query)
+		record(comparison, err)
+	}()
+}
+
+// Compare matches a query answered by the live index against the shadow
+// index right away, for a debug response, and records how the results
+// compare as Mirror does. The comparison carries the best matches of the
+// shadow index.
+func Compare(query Query) (Comparison, error) {
+	comparison, err := compare(query)
+	record(comparison, err)
+	return comparison, err
+}
+
+func compare(query Query) (Comparison, error) {
+	start := time.Now()
+	fingerprint := query.Fingerprint
+	querySeconds := shazam.QuerySeconds(fingerprint)
+	if fingerprint == nil {
+		var err error
+		fingerprint, err = shazam.QueryFingerprint(query.Samples, query.SampleRate, FanOut())
+		if err != nil {
+			return Comparison{}, err
+		}
+		querySeconds = float64(len(query.Samples)) / float64(query.SampleRate)
+	}
+
+	client, err := NewClient()
+	if err != nil {
+		return Comparison{}, err
+	}
+	defer client.Close()
+
+	matches, err := shazam.FindMatchesIn(client, fingerprint, query.Visible)
+	if err != nil {
+		return Comparison{}, err
+	}
+
+	live := result(query.Matches, query.Thresholds.Accepts(query.Matches, querySeconds), query.Duration)
+	shadow := result(matches, query.Thresholds.Accepts(matches, querySeconds), time.Since(start))
+	shadow.Matches = matches[:min(len(matches), debugMatches)]
+	comparison := Comparison{
+		Time:            time.Now().UTC(),
+		Source:          query.Source,
+		SameTopMatch:    live.SongID != 0 && live.SongID == shadow.SongID,
+		ScoreDelta:      shadow.Score - live.Score,
+		ConfidenceDelta: shadow.Confidence - live.Confidence,
+		Live:            live,
+		Shadow:          shadow,
+	}
+	switch {
+	case live.Recognized && shadow.Recognized && comparison.SameTopMatch:
+		comparison.Outcome = OutcomeAgree
+	case live.Recognized && shadow.Recognized:
+		comparison.Outcome = OutcomeDisagree
+	case live.Recognized:
+		comparison.Outcome = OutcomeLiveOnly
+	case shadow.Recognized:
+		comparison.Outcome = OutcomeShadowOnly
+	default:
+		comparison.Outcome = OutcomeNeither
+	}
+	comparison.Agree = comparison.Outcome == OutcomeAgree || comparison.Outcome == OutcomeNeither
+	return comparison, nil
+}
+
+func result(matches []shazam.Match, recognized bool, duration time.Duration) Result {
+	result := Result{Recognized: recognized, DurationMs: duration.Milliseconds()}
+	if len(matches) > 0 {
+		result.SongID, result.Score, result.Confidence = matches[0].SongID, matches[0].Score, matches[0].Confidence
+	}
+	return result
+}
+
+func record(comparison Comparison, err error) {
+	logger := utils.GetLogger()
+	stats.Lock()
+	defer stats.Unlock()
+
+	if err != nil {
+		stats.errors++
+		logger.Warn("Failed to compare a query with the shadow index", slog.Any("error", err))
+		return
+	}
+
+	// Only debug responses carry the matches
+	comparison.Shadow.Matches = nil
+	if stats.outcomes[comparison.Source] == nil {
+		stats.outcomes[comparison.Source] = make(map[string]uint64)
+	}
+	stats.outcomes[comparison.Source][comparison.Outcome]++
+	if comparison.SameTopMatch {
+		stats.sameTopMatch++
+	}
+	stats.live.add(comparison.Live)
+	stats.shadow.add(comparison.Shadow)
+
+	attrs := []any{
+		slog.String("source", comparison.Source),
+		slog.String("outcome", comparison.Outcome),
+		slog.Any("live", comparison.Live),
+		slog.Any("shadow", comparison.Shadow),
+	}
+	if comparison.Agree {
+		logger.Debug("Shadow index agrees with the live one", attrs...)
+		return
+	}
+	logger.Info(fmt.Sprintf("Shadow index differs from the live one (%s)", comparison.Outcome), attrs...)
+	stats.recent = append([]Comparison{comparison}, stats.recent[:min(len(stats.recent), recentKept-1)]...)
+}
+
+// CurrentStats returns the settings of the shadow index and how the compared
+// queries fared on both indexes.
+func CurrentStats() Stats {
+	stats.Lock()
+	defer stats.Unlock()
+
+	current := Stats{
+		Enabled:        Enabled(),
+		Params:         Params().Hash(),
+		FanOut:         FanOut(),
+		LiveFanOut:     shazam.FanOut(),
+		MirrorRate:     mirrorRate(),
+		DebugResponses: DebugResponses(),
+		Skipped:        stats.skipped,
+		Errors:         stats.errors,
+		Outcomes:       make(map[string]uint64, len(Outcomes)),
+		BySource:       make(map[string]map[string]uint64, len(stats.outcomes)),
+		Recent:         append([]Comparison{}, stats.recent...),
+	}
+	for _, outcome := range Outcomes {
+		current.Outcomes[outcome] = 0
+	}
+	for source, outcomes := range stats.outcomes {
+		current.BySource[source] = make(map[string]uint64, len(Outcomes))
+		for _, outcome := range Outcomes {
+			current.BySource[source][outcome] = outcomes[outcome]
+			current.Outcomes[outcome] += outcomes[outcome]
+			current.Compared += outcomes[outcome]
+		}
+	}
+	if current.Compared > 0 {
+		current.Agreement = float64(current.Outcomes[OutcomeAgree]+current.Outcomes[OutcomeNeither]) / float64(current.Compared)
+		current.TopMatchAgreement = float64(stats.sameTopMatch) / float64(current.Compared)
+	}
+	current.Live, current.Shadow = stats.live.stats(current.Compared), stats.shadow.stats(current.Compared)
+	return current
+}
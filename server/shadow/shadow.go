@@ -0,0 +1,123 @@
+// Package shadow maintains a second "shadow" index, built with experimental
+// fingerprint parameters in a catalog of its own, and mirrors recognition
+// queries to it so that parameter changes can be validated on production
+// traffic before the live index is rebuilt with them.
+package shadow
+
+import (
+	"errors"
+	"fmt"
+	"song-recognition/db"
+	"song-recognition/exclusions"
+	"song-recognition/models"
+	"song-recognition/shazam"
+	"song-recognition/utils"
+	"strconv"
+)
+
+// ErrDisabled is returned when no shadow index is configured.
+var ErrDisabled = errors.New("no shadow index is configured, set SHADOW_DB_TYPE")
+
+// Enabled reports whether a shadow index is configured, with SHADOW_DB_TYPE.
+func Enabled() bool {
+	return utils.GetEnv("SHADOW_DB_TYPE") != ""
+}
+
+// FanOut returns how many of the peaks following an anchor it is paired with
+// in the shadow index, from SHADOW_FINGERPRINT_FAN_OUT (default: the fan-out
+// of the live index).
+func FanOut() int {
+	fanOut, err := strconv.Atoi(utils.GetEnv("SHADOW_FINGERPRINT_FAN_OUT"))
+	if err != nil || fanOut < 1 {
+		return shazam.FanOut()
+	}
+	return min(fanOut, shazam.MaxFanOut)
+}
+
+// Params returns the parameters the shadow index is built with.
+func Params() shazam.FingerprintParams {
+	params := shazam.CurrentParams()
+	params.TargetZoneSize = FanOut()
+	return params
+}
+
+// NewClient connects to the shadow catalog, a backend of type SHADOW_DB_TYPE
+// configured with the usual variables, SHADOW_ prefixed ones (e.g.
+// SHADOW_SQLITE_PATH or SHADOW_DB_NAME) taking precedence. It refuses to use
+// the live catalog.
+func NewClient() (db.DBClient, error) {
+	dbType := utils.GetEnv("SHADOW_DB_TYPE")
+	if dbType == "" {
+		return nil, ErrDisabled
+	}
+
+	key, fallback := "DB_NAME", ""
+	switch dbType {
+	case "sqlite":
+		key, fallback = "SQLITE_PATH", "db/db.sqlite3"
+	case "bolt":
+		key, fallback = "BOLT_PATH", "db/db.bolt"
+	case "memory":
+		key, fallback = "MEMORY_DB_NAME", "default"
+	}
+	shadowEnv := func(key, fallback string) string {
+		if value := utils.GetEnv("SHADOW_" + key); value != "" {
+			return value
+		}
+		return utils.GetEnv(key, fallback)
+	}
+	if dbType == db.DBtype && shadowEnv("DB_HOST", "") == utils.GetEnv("DB_HOST") && shadowEnv(key, fallback) == utils.GetEnv(key, fallback) {
+		return nil, fmt.Errorf("the shadow index needs a catalog of its own, set SHADOW_%s", key)
+	}
+	return db.NewDBClientFor(dbType, "SHADOW_")
+}
+
+// Index fingerprints the audio of a song of the live catalog with the shadow
+// parameters and stores it in the shadow index under the same ID, replacing
+// what it had for the song. Couples in the excluded ranges of the song aren't
+// stored. It returns the number of fingerprints stored.
+func Index(songID models.SongID, song db.Song, songFilePath string) (int, error) {
+	client, err := NewClient()
+	if err != nil {
+		return 0, err
+	}
+	defer client.Close()
+
+	fingerprint, err := shazam.FingerprintAudioFanOut(songFilePath, songID, FanOut())
+	if err != nil {
+		return 0, err
+	}
+
+	rule, excluded, err := exclusions.Get(songID)
+	if err != nil {
+		return 0, err
+	}
+	if excluded {
+		rule.Strip(fingerprint)
+	}
+
+	if err := client.DeleteFingerprintsBySongID(songID); err != nil {
+		return 0, err
+	}
+	if err := client.StoreSong(songID, song); err != nil {
+		return 0, err
+	}
+	if err := client.StoreFingerprints(fingerprint); err != nil {
+		return 0, err
+	}
+	if err := db.RecordFingerprintChecksum(client, songID, db.ChecksumFingerprints(fingerprint)[songID]); err != nil {
+		return 0, err
+	}
+	return len(fingerprint), nil
+}
+
+// Remove deletes a song and its fingerprints from the shadow index.
+func Remove(songID models.SongID) error {
+	client, err := NewClient()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	return client.DeleteSongByID(songID)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"song-recognition/db"
+	"song-recognition/models"
+	"song-recognition/shadow"
+	"strconv"
+)
+
+// shadowIndex manages the shadow index. build fingerprints every song of the
+// live catalog with the shadow parameters, from its audio in SONGS_DIR, and
+// removes the songs the live catalog no longer has.
+func shadowIndex(args []string) {
+	if len(args) < 1 || args[0] != "build" {
+		fmt.Println("Usage: main.go shadow build [--json]")
+		os.Exit(1)
+	}
+	buildCmd := flag.NewFlagSet("shadow build", flag.ExitOnError)
+	asJSON := buildCmd.Bool("json", false, "print progress as JSON lines")
+	buildCmd.Parse(args[1:])
+	progress := newProgress("shadow-build", *asJSON)
+	fail := func(message string, err error) {
+		yellow.Println(message, err)
+		progress.finish(err)
+		os.Exit(1)
+	}
+
+	shadowClient, err := shadow.NewClient()
+	if err != nil {
+		fail("Error connecting to the shadow index:", err)
+	}
+	defer shadowClient.Close()
+
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		fail("Error connecting to DB:", err)
+	}
+	songs := make(map[models.SongID]db.Song)
+	err = dbClient.ForEachSong(func(songID models.SongID, song db.Song) error {
+		songs[songID] = song
+		return nil
+	})
+	dbClient.Close()
+	if err != nil {
+		fail("Error listing songs:", err)
+	}
+	songIDs, err := sampleSongs(shadowClient, 0)
+	if err != nil {
+		fail("Error listing the songs of the shadow index:", err)
+	}
+
+	progress.startStage("remove", 0)
+	removed := 0
+	for _, songID := range songIDs {
+		if _, ok := songs[songID]; ok {
+			continue
+		}
+		err := shadow.Remove(songID)
+		progress.item(strconv.FormatUint(uint64(songID), 10), err)
+		if err != nil {
+			fail("Error removing a song from the shadow index:", err)
+		}
+		removed++
+	}
+
+	fmt.Printf("Building the shadow index with fan-out %d (parameters %s)...\n", shadow.FanOut(), shadow.Params().Hash())
+	progress.startStage("index", int64(len(songs)))
+	failed := 0
+	for i, songID := range slices.Sorted(maps.Keys(songs)) {
+		fingerprints, err := indexShadowSong(songID, songs[songID])
+		progress.item(strconv.FormatUint(uint64(songID), 10), err)
+		if err != nil {
+			failed++
+			fmt.Printf("[%d/%d] song %d: %v\n", i+1, len(songs), songID, err)
+			continue
+		}
+		fmt.Printf("[%d/%d] song %d: %d fingerprints\n", i+1, len(songs), songID, fingerprints)
+	}
+
+	fmt.Printf("\nIndexed %d songs in the shadow index, %d failed, %d removed.\n", len(songs)-failed, failed, removed)
+	if failed > 0 {
+		err := fmt.Errorf("failed to index %d songs", failed)
+		progress.finish(err)
+		os.Exit(1)
+	}
+	progress.finish(nil)
+}
+
+func indexShadowSong(songID models.SongID, song db.Song) (int, error) {
+	songPath, err := findSongFile(song)
+	if err != nil {
+		return 0, err
+	}
+	return shadow.Index(songID, song, songPath)
+}
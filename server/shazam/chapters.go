@@ -0,0 +1,195 @@
+//go:build !js && !wasm
+// +build !js,!wasm
+
+package shazam
+
+import (
+	"math"
+	"song-recognition/audio"
+	"song-recognition/models"
+	"sort"
+)
+
+const (
+	// energyFrameMs is the hop of the loudness envelope track changes are
+	// looked for in.
+	energyFrameMs = 50
+	// changeContextMs is how much audio on each side of a point is compared
+	// to tell whether the track changes there.
+	changeContextMs = 5000
+	// minChangeDB is the least change in loudness, or dip below the
+	// surroundings, that counts as a possible track change.
+	minChangeDB = 6
+	// minChangeGapMs keeps track changes apart, as tracks last longer.
+	minChangeGapMs = 20000
+)
+
+// TrackChange is a point of a recording where the track likely changes: the
+// loudness shifts, or dips as in a gap or a mix between tracks.
+type TrackChange struct {
+	AtMs     int64   `json:"atMs"`
+	Strength float64 `json:"strength"` // in dB
+}
+
+// TrackChanges looks for the points of a recording where the track likely
+// changes, from its loudness envelope.
+func TrackChanges(samples []float64, sampleRate int) []TrackChange {
+	frameSize := int(audio.MsToFrames(energyFrameMs, sampleRate))
+	if frameSize <= 0 || len(samples) < frameSize {
+		return nil
+	}
+
+	// Loudness of each frame, in dB
+	loudness := make([]float64, len(samples)/frameSize)
+	for i := range loudness {
+		sum := 0.0
+		for _, sample := range samples[i*frameSize : (i+1)*frameSize] {
+			sum += sample * sample
+		}
+		loudness[i] = 10 * math.Log10(sum/float64(frameSize)+1e-10)
+	}
+
+	// Prefix sums give the mean loudness of any stretch
+	prefix := make([]float64, len(loudness)+1)
+	for i, value := range loudness {
+		prefix[i+1] = prefix[i] + value
+	}
+	mean := func(from, to int) float64 {
+		from, to = max(from, 0), min(to, len(loudness))
+		if to <= from {
+			return math.NaN()
+		}
+		return (prefix[to] - prefix[from]) / float64(to-from)
+	}
+
+	side := changeContextMs / energyFrameMs
+	local := max(1000/energyFrameMs, 1) // a second around the point
+	strengths := make([]float64, len(loudness))
+	for i := side; i+side <= len(loudness); i++ {
+		before, after := mean(i-side, i), mean(i, i+side)
+		here := mean(i-local/2, i+local/2+1)
+		shift := math.Abs(after - before)
+		dip := (before+after)/2 - here
+		strengths[i] = max(shift, dip)
+	}
+
+	// Strongest points first, each ruling out weaker ones close to it
+	candidates := make([]int, 0)
+	for i, strength := range strengths {
+		if strength >= minChangeDB {
+			candidates = append(candidates, i)
+		}
+	}
+	sort.Slice(candidates, func(a, b int) bool { return strengths[candidates[a]] > strengths[candidates[b]] })
+
+	gap := minChangeGapMs / energyFrameMs
+	var changes []TrackChange
+	for _, i := range candidates {
+		tooClose := false
+		for _, change := range changes {
+			if abs64(change.AtMs/energyFrameMs-int64(i)) < int64(gap) {
+				tooClose = true
+				break
+			}
+		}
+		if !tooClose {
+			changes = append(changes, TrackChange{AtMs: int64(i) * energyFrameMs, Strength: strengths[i]})
+		}
+	}
+	sort.Slice(changes, func(a, b int) bool { return changes[a].AtMs < changes[b].AtMs })
+	return changes
+}
+
+func abs64(x int64) int64 {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// Chapter is a stretch of a recording where one identified track plays.
+type Chapter struct {
+	StartMs    int64         `json:"startMs"`
+	EndMs      int64         `json:"endMs"`
+	Start      string        `json:"start,omitempty"` // StartMs formatted for people
+	End        string        `json:"end,omitempty"`
+	SongID     models.SongID `json:"songId"`
+	SongTitle  string        `json:"songTitle"`
+	SongArtist string        `json:"songArtist"`
+	YouTubeID  string        `json:"youtubeId,omitempty"`
+	Score      float64       `json:"score"`      // best score over the segments
+	Confidence float64       `json:"confidence"` // best confidence over the segments
+	Segments   int           `json:"segments"`   // recognised segments the track was found in
+	// LoudnessLUFS is the integrated loudness of the chapter, when measured.
+	LoudnessLUFS *float64 `json:"loudnessLufs,omitempty"`
+}
+
+// Chapters lists the identified tracks of a recording of durationMs from its
+// recognised segments, in order. Consecutive segments matching the same song
+// make one chapter, even across a segment that wasn't recognised. Since
+// segments overlap, the boundary between two chapters is placed at the
+// strongest track change near the middle of their overlap or gap, if any.
+func Chapters(segments []Segment, changes []TrackChange, durationMs int64) []Chapter {
+	var chapters []Chapter
+	var lastEnd int64 // of the last segment of the current chapter
+	for _, segment := range segments {
+		if !segment.Recognized || len(segment.Matches) == 0 {
+			continue
+		}
+		match := segment.Matches[0]
+
+		if n := len(chapters); n > 0 && chapters[n-1].SongID == match.SongID &&
+			segment.StartMs <= lastEnd+(segment.EndMs-segment.StartMs) {
+			chapter := &chapters[n-1]
+			chapter.Segments++
+			chapter.Score = max(chapter.Score, match.Score)
+			chapter.Confidence = max(chapter.Confidence, match.Confidence)
+			lastEnd = segment.EndMs
+			continue
+		}
+
+		chapters = append(chapters, Chapter{
+			StartMs:    segment.StartMs,
+			SongID:     match.SongID,
+			SongTitle:  match.SongTitle,
+			SongArtist: match.SongArtist,
+			YouTubeID:  match.YouTubeID,
+			Score:      match.Score,
+			Confidence: match.Confidence,
+			Segments:   1,
+		})
+		if n := len(chapters); n > 1 {
+			// Provisionally, the previous chapter lasts until its last segment
+			chapters[n-2].EndMs = lastEnd
+		}
+		lastEnd = segment.EndMs
+	}
+	if len(chapters) == 0 {
+		return nil
+	}
+	chapters[len(chapters)-1].EndMs = min(lastEnd, durationMs)
+
+	for i := 1; i < len(chapters); i++ {
+		previousEnd, start := chapters[i-1].EndMs, chapters[i].StartMs
+		low, high := min(previousEnd, start), max(previousEnd, start)
+		slack := max((high-low)/2, changeContextMs)
+		boundary := snapToChange(changes, low-slack, high+slack, (low+high)/2)
+		chapters[i-1].EndMs, chapters[i].StartMs = boundary, boundary
+	}
+	if first := &chapters[0]; first.StartMs > 0 {
+		first.StartMs = snapToChange(changes, first.StartMs-(first.EndMs-first.StartMs)/4, first.StartMs+1, first.StartMs)
+	}
+	return chapters
+}
+
+// snapToChange returns the strongest track change between from and to, or
+// fallback if there is none.
+func snapToChange(changes []TrackChange, from, to, fallback int64) int64 {
+	best, strength := fallback, 0.0
+	for _, change := range changes {
+		if change.AtMs >= from && change.AtMs <= to && change.Strength > strength {
+			best, strength = change.AtMs, change.Strength
+		}
+	}
+	return best
+}
@@ -0,0 +1,130 @@
+//go:build !js && !wasm
+// +build !js,!wasm
+
+package shazam
+
+import (
+	"context"
+	"song-recognition/audio"
+	"song-recognition/db"
+	"song-recognition/models"
+	"song-recognition/utils"
+	"sort"
+	"strconv"
+)
+
+// Channels a segment of a stereo recording can be matched on, see
+// Segment.Channel.
+const (
+	ChannelMix   = "mix"
+	ChannelLeft  = "left"
+	ChannelRight = "right"
+)
+
+// DualChannelQueries reports whether stereo recordings are matched channel by
+// channel by default, from DUAL_CHANNEL_QUERIES (default false).
+func DualChannelQueries() bool {
+	dual, err := strconv.ParseBool(utils.GetEnv("DUAL_CHANNEL_QUERIES", "false"))
+	return err == nil && dual
+}
+
+// FindDualChannelSegmentMatches is FindSegmentMatches for a stereo recording
+// whose left and right channels are matched on their own as well as mixed.
+// The matches of every segment fuse the three: each song scores as on the
+// channel it scored best on, so a channel degraded by noise (e.g. a phone
+// recording next to one speaker) can't drag the match down, and confidence
+// is recomputed over the fused ranking. Segment.Channel names the channel of
+// the top match. It does three times the matching work of a mono query.
+func FindDualChannelSegmentMatches(ctx context.Context, left, right []float64, sampleRate int, thresholds Thresholds, visible func(songID models.SongID) bool) ([]Segment, error) {
+	names := []string{ChannelMix, ChannelLeft, ChannelRight}
+	signals := [][]float64{audio.Mix([][]float64{left, right}), left, right}
+
+	// Resample once rather than per segment
+	format := audio.AnalysisFormat()
+	for i := range signals {
+		signals[i] = format.Conform([][]float64{signals[i]}, sampleRate)[0]
+	}
+	sampleRate = format.SampleRate
+	n := min(len(signals[1]), len(signals[2]))
+
+	client, err := db.NewDBClient()
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+	client = db.WithContext(ctx, client)
+
+	var segments []Segment
+	for _, window := range loadSegmenting().windows(n, sampleRate) {
+		byChannel := make([][]Match, len(signals))
+		querySizes := make([]int, len(signals))
+		for c, signal := range signals {
+			sampleFingerprint, err := queryFingerprint(signal[window[0]:window[1]], sampleRate, FanOut(), noiseReductionFrom(ctx))
+			if err != nil {
+				return nil, err
+			}
+			querySizes[c] = len(sampleFingerprint)
+
+			byChannel[c], err = FindMatchesIn(client, sampleFingerprint, visible)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		matches, channel := fuseChannelMatches(byChannel)
+		setConfidence(client, matches, querySizes[channel])
+
+		segment := Segment{
+			StartMs:    audio.FramesToMs(int64(window[0]), sampleRate),
+			EndMs:      audio.FramesToMs(int64(window[1]), sampleRate),
+			Matches:    matches,
+			Recognized: thresholds.Accepts(matches, float64(window[1]-window[0])/float64(sampleRate)),
+		}
+		if len(matches) > 0 {
+			segment.Channel = names[channel]
+		}
+		segments = append(segments, segment)
+	}
+	return segments, nil
+}
+
+// fuseChannelMatches merges the matches of a segment on several channels,
+// keeping the best scoring match of every song, and returns them sorted with
+// the index of the channel the top one came from. Confidences are cleared,
+// as they were computed against the runner-ups of a single channel.
+func fuseChannelMatches(byChannel [][]Match) ([]Match, int) {
+	type fused struct {
+		match   Match
+		channel int
+	}
+
+	var all []fused
+	index := make(map[models.SongID]int)
+	for c, matches := range byChannel {
+		for _, match := range matches {
+			match.Confidence = 0
+			i, seen := index[match.SongID]
+			if !seen {
+				index[match.SongID] = len(all)
+				all = append(all, fused{match, c})
+				continue
+			}
+			if match.Score > all[i].match.Score {
+				all[i] = fused{match, c}
+			}
+		}
+	}
+
+	if len(all) == 0 {
+		return nil, 0
+	}
+	sort.SliceStable(all, func(i, j int) bool {
+		return all[i].match.Score > all[j].match.Score
+	})
+
+	matches := make([]Match, len(all))
+	for i := range all {
+		matches[i] = all[i].match
+	}
+	return matches, all[0].channel
+}
@@ -0,0 +1,75 @@
+//go:build !js && !wasm
+// +build !js,!wasm
+
+package shazam
+
+import (
+	"math"
+	"song-recognition/models"
+	"song-recognition/utils"
+	"strconv"
+)
+
+// minEarlyExitChunk is the smallest number of addresses fetched per chunk;
+// short queries are scored in one go.
+const minEarlyExitChunk = 256
+
+// earlyExit decides when incremental scoring can stop because one song
+// clearly dominates the others.
+type earlyExit struct {
+	Chunks   int     // number of chunks the query is split into, 1 disables early exit
+	MinLead  float64 // minimum lead of the best song over the runner-up, in standard deviations
+	MinScore float64 // minimum score of the best song
+}
+
+// loadEarlyExit reads EARLY_EXIT_CHUNKS (default 4) and EARLY_EXIT_MIN_LEAD
+// (default 6). The best song must also reach MIN_MATCH_SCORE.
+func loadEarlyExit() earlyExit {
+	chunks, err := strconv.Atoi(utils.GetEnv("EARLY_EXIT_CHUNKS", "4"))
+	if err != nil || chunks < 1 {
+		chunks = 1
+	}
+
+	minLead, err := strconv.ParseFloat(utils.GetEnv("EARLY_EXIT_MIN_LEAD", "6"), 64)
+	if err != nil || minLead <= 0 {
+		minLead = 6
+	}
+
+	return earlyExit{
+		Chunks:   chunks,
+		MinLead:  minLead,
+		MinScore: DefaultThresholds().MinAlignedCouples,
+	}
+}
+
+// chunkSize returns the number of addresses to fetch per chunk.
+func (e earlyExit) chunkSize(addresses int) int {
+	if e.Chunks <= 1 || addresses <= minEarlyExitChunk {
+		return max(addresses, 1)
+	}
+	return max((addresses+e.Chunks-1)/e.Chunks, minEarlyExitChunk)
+}
+
+// dominates reports whether the best score is far enough above the runner-up
+// that the remaining couples can't change the outcome. Aligned counts of
+// non-matching songs are roughly Poisson distributed, so the runner-up's score
+// estimates both the background mean and its variance.
+func (e earlyExit) dominates(scores map[models.SongID]float64) bool {
+	if e.Chunks <= 1 {
+		return false
+	}
+
+	best, runnerUp := 0.0, 0.0
+	for _, score := range scores {
+		if score > best {
+			best, runnerUp = score, best
+		} else if score > runnerUp {
+			runnerUp = score
+		}
+	}
+
+	if best < e.MinScore {
+		return false
+	}
+	return (best-runnerUp)/math.Sqrt(runnerUp+1) >= e.MinLead
+}
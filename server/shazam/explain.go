@@ -0,0 +1,164 @@
+//go:build !js && !wasm
+// +build !js,!wasm
+
+package shazam
+
+import (
+	"context"
+	"song-recognition/db"
+	"song-recognition/exclusions"
+	"song-recognition/models"
+	"sort"
+)
+
+// regionGapMs is the longest stretch of a query without aligned hits inside
+// an overlap region.
+const regionGapMs = 1000
+
+// Explanation is the evidence for matching a query to a song: the offsets
+// between the anchor times of the couples they share, and where they line
+// up.
+type Explanation struct {
+	SongID    models.SongID `json:"songId"`
+	Score     float64       `json:"score"`     // as the current scorer scores the hits now
+	QuerySize int           `json:"querySize"` // addresses in the query
+	Hits      int           `json:"hits"`      // couples of the song at addresses of the query
+	// Excluded counts the hits in excluded ranges of the song, which aren't
+	// scored.
+	Excluded int `json:"excluded,omitempty"`
+	// Histogram counts the hits of every 100ms offset bin, as they are
+	// binned for scoring, in offset order.
+	Histogram []OffsetBin `json:"histogram"`
+	// AlignedOffsetMs is the offset of the song over the query most hits
+	// agree on, and Aligned the hits within a bin of it, listed in Pairs by
+	// query time.
+	AlignedOffsetMs int64           `json:"alignedOffsetMs"`
+	Aligned         int             `json:"aligned"`
+	Pairs           []AnchorPair    `json:"pairs"`
+	Regions         []OverlapRegion `json:"regions"`
+}
+
+// OffsetBin is a bin of the offset histogram of an Explanation.
+type OffsetBin struct {
+	OffsetMs int64 `json:"offsetMs"` // start of the bin
+	Hits     int   `json:"hits"`
+}
+
+// AnchorPair is a couple of the query matched with one of the song.
+type AnchorPair struct {
+	Address   uint32  `json:"address"`
+	QueryMs   uint32  `json:"queryMs"`
+	SongMs    uint32  `json:"songMs"`
+	Rarity    float64 `json:"rarity"`
+	Magnitude float64 `json:"magnitude"`
+}
+
+// OverlapRegion is a stretch of the query lined up with the song, where
+// aligned hits are at most regionGapMs apart.
+type OverlapRegion struct {
+	QueryStartMs uint32 `json:"queryStartMs"`
+	QueryEndMs   uint32 `json:"queryEndMs"`
+	SongStartMs  uint32 `json:"songStartMs"`
+	SongEndMs    uint32 `json:"songEndMs"`
+	Pairs        int    `json:"pairs"`
+}
+
+// FingerprintQuery is QueryFingerprint as FindSegmentMatches runs it under
+// ctx, denoised as set with WithNoiseReduction.
+func FingerprintQuery(ctx context.Context, audioSample []float64, sampleRate int) (map[uint32]uint32, error) {
+	return queryFingerprint(audioSample, sampleRate, FanOut(), noiseReductionFrom(ctx))
+}
+
+// Explain matches a query fingerprint against a song of the catalog of
+// client, as FindMatchesIn does, and returns the evidence for it. The
+// catalog may have changed since the query was matched.
+func Explain(client db.DBClient, sampleFingerprint map[uint32]uint32, songID models.SongID) (Explanation, error) {
+	explanation := Explanation{SongID: songID, QuerySize: len(sampleFingerprint), Histogram: []OffsetBin{}, Pairs: []AnchorPair{}, Regions: []OverlapRegion{}}
+
+	addresses := make([]uint32, 0, len(sampleFingerprint))
+	for address := range sampleFingerprint {
+		addresses = append(addresses, address)
+	}
+	couples, err := client.GetCouples(addresses)
+	if err != nil {
+		return explanation, err
+	}
+
+	excluded := exclusions.Filter()
+	catalogSongs := catalogSize(client)
+	seenSongs := make(map[models.SongID]struct{})
+	var hits []Hit
+	var pairs []AnchorPair
+	for address, addressCouples := range couples {
+		addressRarity := rarity(distinctSongs(addressCouples, seenSongs), catalogSongs)
+		for _, couple := range addressCouples {
+			if couple.SongID != songID {
+				continue
+			}
+			if excluded != nil && excluded(couple.SongID, couple.AnchorTimeMs) {
+				explanation.Excluded++
+				continue
+			}
+			hit := Hit{
+				SampleTime: sampleFingerprint[address],
+				SongTime:   couple.AnchorTimeMs,
+				Rarity:     addressRarity,
+				Magnitude:  magnitudeWeight(couple),
+			}
+			hits = append(hits, hit)
+			pairs = append(pairs, AnchorPair{Address: address, QueryMs: hit.SampleTime, SongMs: hit.SongTime, Rarity: hit.Rarity, Magnitude: hit.Magnitude})
+		}
+	}
+	explanation.Hits = len(hits)
+	if len(hits) == 0 {
+		return explanation, nil
+	}
+	explanation.Score = CurrentScorer().Score(hits)
+
+	bins := map[int32]int{}
+	for _, hit := range hits {
+		bins[offsetBucket([2]uint32{hit.SampleTime, hit.SongTime})]++
+	}
+	peak := int32(0)
+	for bin, count := range bins {
+		explanation.Histogram = append(explanation.Histogram, OffsetBin{OffsetMs: int64(bin) * 100, Hits: count})
+		if count > bins[peak] || count == bins[peak] && bin < peak {
+			peak = bin
+		}
+	}
+	sort.Slice(explanation.Histogram, func(i, j int) bool { return explanation.Histogram[i].OffsetMs < explanation.Histogram[j].OffsetMs })
+	explanation.AlignedOffsetMs = int64(peak) * 100
+
+	// Offsets straddling a bin boundary land in either bin
+	for _, pair := range pairs {
+		if bin := offsetBucket([2]uint32{pair.QueryMs, pair.SongMs}); bin >= peak-1 && bin <= peak+1 {
+			explanation.Pairs = append(explanation.Pairs, pair)
+		}
+	}
+	sort.Slice(explanation.Pairs, func(i, j int) bool {
+		a, b := explanation.Pairs[i], explanation.Pairs[j]
+		return a.QueryMs < b.QueryMs || a.QueryMs == b.QueryMs && a.Address < b.Address
+	})
+	explanation.Aligned = len(explanation.Pairs)
+	explanation.Regions = overlapRegions(explanation.Pairs)
+	return explanation, nil
+}
+
+// overlapRegions groups aligned pairs, sorted by query time, into regions.
+func overlapRegions(pairs []AnchorPair) []OverlapRegion {
+	regions := []OverlapRegion{}
+	for i, pair := range pairs {
+		if i == 0 || pair.QueryMs-pairs[i-1].QueryMs > regionGapMs {
+			regions = append(regions, OverlapRegion{
+				QueryStartMs: pair.QueryMs, QueryEndMs: pair.QueryMs,
+				SongStartMs: pair.SongMs, SongEndMs: pair.SongMs,
+			})
+		}
+		region := &regions[len(regions)-1]
+		region.QueryEndMs = pair.QueryMs
+		region.SongStartMs = min(region.SongStartMs, pair.SongMs)
+		region.SongEndMs = max(region.SongEndMs, pair.SongMs)
+		region.Pairs++
+	}
+	return regions
+}
@@ -1,26 +1,111 @@
 package shazam
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"math"
+	"song-recognition/audio"
 	"song-recognition/models"
 	"song-recognition/utils"
-	"song-recognition/wav"
+	"strconv"
 )
 
 const (
 	maxFreqBits    = 9
 	maxDeltaBits   = 14
 	targetZoneSize = 5
+
+	// defaultFanOut is how many of the peaks following an anchor it is paired
+	// with, unless FINGERPRINT_FAN_OUT says otherwise.
+	defaultFanOut = 5
+	// MaxFanOut is the largest fan-out fingerprints can be generated with.
+	MaxFanOut = 20
 )
 
+// FanOut returns how many of the peaks following an anchor it is paired
+// with, from FINGERPRINT_FAN_OUT (default 5, at most 20). A larger fan-out
+// stores more couples per song, so short or noisy clips align more of them.
+func FanOut() int {
+	fanOut, err := strconv.Atoi(utils.GetEnv("FINGERPRINT_FAN_OUT", strconv.Itoa(defaultFanOut)))
+	if err != nil || fanOut < 1 {
+		return defaultFanOut
+	}
+	return min(fanOut, MaxFanOut)
+}
+
+// FingerprintVersion identifies the fingerprinting algorithm. Bump it whenever
+// a change makes new fingerprints incompatible with the ones already stored.
+//
+// Version 2 times peaks by their position in the audio instead of spreading
+// the spectrogram frames over its duration.
+const FingerprintVersion = 2
+
+// FingerprintParams describes how fingerprints are generated, so clients that
+// fingerprint audio themselves can check they are compatible with the server.
+type FingerprintParams struct {
+	Version        int     `json:"version"`
+	SampleRate     int     `json:"sampleRate"`
+	DSPRatio       int     `json:"dspRatio"`
+	WindowSize     int     `json:"windowSize"`
+	HopSize        int     `json:"hopSize"`
+	MaxFreq        float64 `json:"maxFreq"`
+	MaxFreqBits    int     `json:"maxFreqBits"`
+	MaxDeltaBits   int     `json:"maxDeltaBits"`
+	TargetZoneSize int     `json:"targetZoneSize"`
+}
+
+// CurrentParams returns the parameters used by this build.
+func CurrentParams() FingerprintParams {
+	return FingerprintParams{
+		Version:        FingerprintVersion,
+		SampleRate:     audio.AnalysisFormat().SampleRate,
+		DSPRatio:       dspRatio,
+		WindowSize:     windowSize,
+		HopSize:        hopSize,
+		MaxFreq:        maxFreq,
+		MaxFreqBits:    maxFreqBits,
+		MaxDeltaBits:   maxDeltaBits,
+		TargetZoneSize: FanOut(),
+	}
+}
+
+// Hash identifies the parameters, to tell which songs were indexed with
+// other ones.
+func (p FingerprintParams) Hash() string {
+	data, _ := json.Marshal(p)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
+}
+
+// Extends reports whether p only pairs anchors with more peaks than old.
+// Fingerprints made with old are then a subset of those made with p: songs
+// indexed with old can be augmented with the couples they miss, and queries
+// fingerprinted with old still match songs indexed with p.
+func (p FingerprintParams) Extends(old FingerprintParams) bool {
+	if p.TargetZoneSize <= old.TargetZoneSize {
+		return false
+	}
+	old.TargetZoneSize = p.TargetZoneSize
+	return p == old
+}
+
 // Fingerprint generates fingerprints from a list of peaks and stores them in an array.
 // Each fingerprint consists of an address and a couple.
-// The address is a hash. The couple contains the anchor time and the song ID.
-func Fingerprint(peaks []Peak, songID uint32) map[uint32]models.Couple {
+// The address is a hash. The couple contains the anchor time, the song ID and
+// the band and magnitude of the anchor peak (a version 2 couple).
+func Fingerprint(peaks []Peak, songID models.SongID) map[uint32]models.Couple {
+	return fingerprintFanOut(peaks, songID, FanOut())
+}
+
+// fingerprintFanOut fingerprints peaks, pairing every anchor with the fanOut
+// peaks following it.
+func fingerprintFanOut(peaks []Peak, songID models.SongID, fanOut int) map[uint32]models.Couple {
 	fingerprints := map[uint32]models.Couple{}
 
 	for i, anchor := range peaks {
-		for j := i + 1; j < len(peaks) && j <= i+targetZoneSize; j++ {
+		for j := i + 1; j < len(peaks) && j <= i+fanOut; j++ {
 			target := peaks[j]
 
 			address := createAddress(anchor, target)
@@ -28,6 +113,8 @@ func Fingerprint(peaks []Peak, songID uint32) map[uint32]models.Couple {
 
 			fingerprints[address] = models.Couple{
 				AnchorTimeMs: anchorTimeMs,
+				Band:         uint8(anchor.Band + 1),
+				Magnitude:    uint8(min(math.Round(anchor.Level*2), math.MaxUint8)),
 				SongID:       songID,
 			}
 		}
@@ -36,6 +123,56 @@ func Fingerprint(peaks []Peak, songID uint32) map[uint32]models.Couple {
 	return fingerprints
 }
 
+// FingerprintSamples generates fingerprints for PCM samples normalised to
+// [-1, 1], at any sample rate. Stereo samples are expected to be interleaved.
+func FingerprintSamples(samples []float64, sampleRate, channels int, songID models.SongID) (map[uint32]models.Couple, error) {
+	if sampleRate <= 0 {
+		return nil, fmt.Errorf("invalid sample rate: %d", sampleRate)
+	}
+
+	var channelSamples [][]float64
+	switch channels {
+	case 1:
+		channelSamples = [][]float64{samples}
+	case 2:
+		left := make([]float64, 0, len(samples)/2)
+		right := make([]float64, 0, len(samples)/2)
+		for i := 0; i+1 < len(samples); i += 2 {
+			left = append(left, samples[i])
+			right = append(right, samples[i+1])
+		}
+		channelSamples = [][]float64{left, right}
+	default:
+		return nil, fmt.Errorf("unsupported channel count: %d", channels)
+	}
+
+	return fingerprintChannels(channelSamples, sampleRate, func(peaks []Peak) map[uint32]models.Couple {
+		return Fingerprint(peaks, songID)
+	})
+}
+
+// fingerprintChannels converts audio to the analysis format and
+// fingerprints the peaks of each of its channels with fingerprint, merging
+// the results. Mono audio isn't upmixed since both channels would yield the
+// same fingerprints.
+func fingerprintChannels(channels [][]float64, sampleRate int, fingerprint func(peaks []Peak) map[uint32]models.Couple) (map[uint32]models.Couple, error) {
+	format := audio.AnalysisFormat()
+	format.Channels = min(format.Channels, len(channels))
+
+	couples := make(map[uint32]models.Couple)
+	for _, channel := range format.Conform(channels, sampleRate) {
+		spectro, err := Spectrogram(channel, format.SampleRate)
+		if err != nil {
+			return nil, fmt.Errorf("error creating spectrogram: %v", err)
+		}
+
+		peaks := ExtractPeaks(spectro, format.SampleRate)
+		utils.ExtendMap(couples, fingerprint(peaks))
+	}
+
+	return couples, nil
+}
+
 // createAddress generates a unique address for a pair of anchor and target points.
 // The address is a 32-bit integer where certain bits represent the frequency of
 // the anchor and target points, and other bits represent the time difference (delta time)
@@ -56,37 +193,3 @@ func createAddress(anchor, target Peak) uint32 {
 
 	return address
 }
-
-func FingerprintAudio(songFilePath string, songID uint32) (map[uint32]models.Couple, error) {
-	wavFilePath, err := wav.ConvertToWAV(songFilePath)
-	if err != nil {
-		return nil, fmt.Errorf("error converting input file to WAV: %v", err)
-	}
-
-	wavInfo, err := wav.ReadWavInfo(wavFilePath)
-	if err != nil {
-		return nil, fmt.Errorf("error reading WAV info: %v", err)
-	}
-
-	fingerprint := make(map[uint32]models.Couple)
-
-	spectro, err := Spectrogram(wavInfo.LeftChannelSamples, wavInfo.SampleRate)
-	if err != nil {
-		return nil, fmt.Errorf("error creating spectrogram: %v", err)
-	}
-
-	peaks := ExtractPeaks(spectro, wavInfo.Duration, wavInfo.SampleRate)
-	utils.ExtendMap(fingerprint, Fingerprint(peaks, songID))
-
-	if wavInfo.Channels == 2 {
-		spectro, err = Spectrogram(wavInfo.RightChannelSamples, wavInfo.SampleRate)
-		if err != nil {
-			return nil, fmt.Errorf("error creating spectrogram for right channel: %v", err)
-		}
-
-		peaks = ExtractPeaks(spectro, wavInfo.Duration, wavInfo.SampleRate)
-		utils.ExtendMap(fingerprint, Fingerprint(peaks, songID))
-	}
-
-	return fingerprint, nil
-}
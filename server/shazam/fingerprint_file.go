@@ -0,0 +1,88 @@
+//go:build !js && !wasm
+// +build !js,!wasm
+
+package shazam
+
+import (
+	"fmt"
+	"song-recognition/models"
+	"song-recognition/wav"
+)
+
+// FingerprintAudio converts an audio file to WAV and generates its fingerprints.
+func FingerprintAudio(songFilePath string, songID models.SongID) (map[uint32]models.Couple, error) {
+	wavFilePath, err := wav.ConvertToWAV(songFilePath)
+	if err != nil {
+		return nil, fmt.Errorf("error converting input file to WAV: %v", err)
+	}
+
+	return FingerprintWAV(wavFilePath, songID)
+}
+
+// FingerprintAudioFanOut is FingerprintAudio pairing every anchor with the
+// fanOut peaks following it, rather than FanOut, as a shadow index may.
+func FingerprintAudioFanOut(songFilePath string, songID models.SongID, fanOut int) (map[uint32]models.Couple, error) {
+	wavFilePath, err := wav.ConvertToWAV(songFilePath)
+	if err != nil {
+		return nil, fmt.Errorf("error converting input file to WAV: %v", err)
+	}
+
+	return fingerprintWAV(wavFilePath, songID, fanOut)
+}
+
+// FingerprintWAV generates fingerprints for a PCM WAV file, converting it to
+// the analysis format first. Stereo files are fingerprinted per channel and
+// the results merged.
+func FingerprintWAV(wavFilePath string, songID models.SongID) (map[uint32]models.Couple, error) {
+	return fingerprintWAV(wavFilePath, songID, FanOut())
+}
+
+func fingerprintWAV(wavFilePath string, songID models.SongID, fanOut int) (map[uint32]models.Couple, error) {
+	wavInfo, err := wav.ReadWavInfo(wavFilePath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading WAV info: %v", err)
+	}
+
+	channels := [][]float64{wavInfo.LeftChannelSamples}
+	if wavInfo.Channels == 2 {
+		channels = append(channels, wavInfo.RightChannelSamples)
+	}
+
+	return fingerprintChannels(channels, wavInfo.SampleRate, func(peaks []Peak) map[uint32]models.Couple {
+		return fingerprintFanOut(peaks, songID, fanOut)
+	})
+}
+
+// AugmentAudio returns the couples fingerprinting an audio file with the
+// current parameters adds to those it had with old, which the current ones
+// must extend (see FingerprintParams.Extends).
+func AugmentAudio(songFilePath string, songID models.SongID, old FingerprintParams) (map[uint32]models.Couple, error) {
+	if !CurrentParams().Extends(old) {
+		return nil, fmt.Errorf("fingerprint parameters %s don't extend %s", CurrentParams().Hash(), old.Hash())
+	}
+
+	wavFilePath, err := wav.ConvertToWAV(songFilePath)
+	if err != nil {
+		return nil, fmt.Errorf("error converting input file to WAV: %v", err)
+	}
+	wavInfo, err := wav.ReadWavInfo(wavFilePath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading WAV info: %v", err)
+	}
+
+	channels := [][]float64{wavInfo.LeftChannelSamples}
+	if wavInfo.Channels == 2 {
+		channels = append(channels, wavInfo.RightChannelSamples)
+	}
+
+	return fingerprintChannels(channels, wavInfo.SampleRate, func(peaks []Peak) map[uint32]models.Couple {
+		indexed := fingerprintFanOut(peaks, songID, old.TargetZoneSize)
+		added := make(map[uint32]models.Couple)
+		for address, couple := range Fingerprint(peaks, songID) {
+			if existing, ok := indexed[address]; !ok || existing != couple {
+				added[address] = couple
+			}
+		}
+		return added
+	})
+}
@@ -0,0 +1,71 @@
+//go:build !js && !wasm
+// +build !js,!wasm
+
+package shazam
+
+import (
+	"encoding/json"
+	"fmt"
+	"song-recognition/db"
+	"song-recognition/models"
+	"time"
+)
+
+const indexConfigsCollection = "index_configs"
+
+// IndexConfig records the fingerprint parameters a song was indexed with, so
+// that songs indexed before the parameters changed can be found and brought
+// up to date.
+type IndexConfig struct {
+	SongID    models.SongID     `json:"songId"`
+	Hash      string            `json:"hash"`
+	Params    FingerprintParams `json:"params"`
+	IndexedAt time.Time         `json:"indexedAt"`
+}
+
+// Current reports whether the song was indexed with the current parameters.
+func (c IndexConfig) Current() bool {
+	return c.Hash == CurrentParams().Hash()
+}
+
+// RecordIndexConfig records that a song was just indexed with the current
+// parameters.
+func RecordIndexConfig(dbClient db.DBClient, songID models.SongID) error {
+	config := IndexConfig{
+		SongID:    songID,
+		Params:    CurrentParams(),
+		IndexedAt: time.Now().UTC(),
+	}
+	config.Hash = config.Params.Hash()
+
+	data, err := json.Marshal(config)
+	if err != nil {
+		return fmt.Errorf("failed to marshal index config: %v", err)
+	}
+	return dbClient.PutRecord(indexConfigsCollection, db.Record{
+		ID:        fmt.Sprint(songID),
+		CreatedAt: config.IndexedAt,
+		Data:      data,
+	})
+}
+
+// ReadIndexConfig returns the parameters a song was indexed with. Songs
+// indexed before they were recorded are assumed to have been indexed with
+// the default fan-out and otherwise current parameters.
+func ReadIndexConfig(dbClient db.DBClient, songID models.SongID) (IndexConfig, error) {
+	record, exists, err := dbClient.GetRecord(indexConfigsCollection, fmt.Sprint(songID))
+	if err != nil {
+		return IndexConfig{}, err
+	}
+	if !exists {
+		params := CurrentParams()
+		params.TargetZoneSize = defaultFanOut
+		return IndexConfig{SongID: songID, Hash: params.Hash(), Params: params}, nil
+	}
+
+	var config IndexConfig
+	if err := json.Unmarshal(record.Data, &config); err != nil {
+		return config, fmt.Errorf("failed to unmarshal index config of song %d: %v", songID, err)
+	}
+	return config, nil
+}
@@ -0,0 +1,193 @@
+package shazam
+
+import (
+	"context"
+	"fmt"
+	"song-recognition/audio"
+)
+
+const (
+	// minNoiseSeconds is the least ambient audio a noise profile is learnt
+	// from, so that it averages out more than a passing sound.
+	minNoiseSeconds = 1.0
+	// noiseOverSubtraction scales the noise profile before it is subtracted,
+	// as the noise of a single frame often rises above its average.
+	noiseOverSubtraction = 2.0
+	// spectralFloor is the share of its magnitude every bin keeps, so that
+	// bins dominated by noise fade out rather than vanish.
+	spectralFloor = 0.02
+	// wienerSmoothing weighs the signal to noise ratio a Wiener filter
+	// carries over from the previous frame against that of the current one,
+	// which keeps isolated noisy bins from flickering into peaks.
+	wienerSmoothing = 0.98
+)
+
+// Noise reduction methods.
+const (
+	// NoiseSubtraction subtracts the scaled noise spectrum from every frame.
+	NoiseSubtraction = "subtract"
+	// NoiseWiener attenuates every bin by its estimated signal to noise
+	// ratio, which leaves fewer spurious peaks behind than subtraction in
+	// fluctuating noise.
+	NoiseWiener = "wiener"
+)
+
+// ValidNoiseReduction reports whether method is a noise reduction method.
+func ValidNoiseReduction(method string) bool {
+	return method == NoiseSubtraction || method == NoiseWiener
+}
+
+// NoiseProfile is the average magnitude spectrum of the ambient noise where a
+// client records its queries, such as a kiosk in a noisy venue. It is
+// subtracted from the spectrograms of the client's queries before their
+// peaks are picked, so that the noise doesn't take the place of the music in
+// the fingerprint.
+type NoiseProfile struct {
+	Magnitudes []float64 `json:"magnitudes"` // average magnitude of every spectrogram bin
+	Frames     int       `json:"frames"`     // spectrogram frames it was averaged over
+	SampleRate int       `json:"sampleRate"` // analysis sample rate it was learnt at
+}
+
+// LearnNoiseProfile averages the spectrum of a recording of ambient noise,
+// converted to the analysis format first. The recording must last at least
+// a second.
+func LearnNoiseProfile(samples []float64, sampleRate int) (NoiseProfile, error) {
+	if audio.FramesToSeconds(len(samples), sampleRate) < minNoiseSeconds {
+		return NoiseProfile{}, fmt.Errorf("noise recordings must last at least %gs", minNoiseSeconds)
+	}
+
+	format := audio.AnalysisFormat()
+	samples = format.Conform([][]float64{samples}, sampleRate)[0]
+
+	spectrogram, err := Spectrogram(samples, format.SampleRate)
+	if err != nil {
+		return NoiseProfile{}, fmt.Errorf("failed to get spectrogram of noise: %v", err)
+	}
+	if len(spectrogram) == 0 {
+		return NoiseProfile{}, fmt.Errorf("noise recording is too short")
+	}
+
+	profile := NoiseProfile{
+		Magnitudes: make([]float64, len(spectrogram[0])),
+		Frames:     len(spectrogram),
+		SampleRate: format.SampleRate,
+	}
+	for _, frame := range spectrogram {
+		for bin, magnitude := range frame {
+			profile.Magnitudes[bin] += magnitude
+		}
+	}
+	for bin := range profile.Magnitudes {
+		profile.Magnitudes[bin] /= float64(len(spectrogram))
+	}
+	return profile, nil
+}
+
+// Subtract removes the noise from a spectrogram computed at sampleRate, in
+// place. It reports false, leaving the spectrogram as it is, when the
+// profile was learnt at another sample rate or with another frame size.
+func (p NoiseProfile) Subtract(spectrogram [][]float64, sampleRate int) bool {
+	if !p.fits(spectrogram, sampleRate) {
+		return false
+	}
+
+	for _, frame := range spectrogram {
+		for bin, magnitude := range frame {
+			frame[bin] = max(magnitude-noiseOverSubtraction*p.Magnitudes[bin], spectralFloor*magnitude)
+		}
+	}
+	return true
+}
+
+// LeadingNoiseProfile learns a noise profile from the first leadMs of a
+// recording, for queries starting with ambient noise before the music can be
+// heard.
+func LeadingNoiseProfile(samples []float64, sampleRate int, leadMs int64) (NoiseProfile, error) {
+	lead := min(audio.MsToFrames(leadMs, sampleRate), int64(len(samples)))
+	return LearnNoiseProfile(samples[:lead], sampleRate)
+}
+
+// Wiener filters the noise out of a spectrogram computed at sampleRate, in
+// place, estimating the signal to noise ratio of every bin from the previous
+// frame and the current one (the decision directed approach). Like Subtract,
+// it reports false, leaving the spectrogram as it is, when the profile
+// doesn't fit it.
+func (p NoiseProfile) Wiener(spectrogram [][]float64, sampleRate int) bool {
+	if !p.fits(spectrogram, sampleRate) {
+		return false
+	}
+
+	previous := make([]float64, len(p.Magnitudes)) // filtered power of the previous frame
+	for _, frame := range spectrogram {
+		for bin, magnitude := range frame {
+			noisePower := p.Magnitudes[bin] * p.Magnitudes[bin]
+			if noisePower == 0 {
+				previous[bin] = magnitude * magnitude
+				continue
+			}
+			posterior := magnitude * magnitude / noisePower
+			prior := wienerSmoothing*previous[bin]/noisePower + (1-wienerSmoothing)*max(posterior-1, 0)
+			gain := max(prior/(prior+1), spectralFloor)
+			frame[bin] = gain * magnitude
+			previous[bin] = frame[bin] * frame[bin]
+		}
+	}
+	return true
+}
+
+// Reduce removes the noise from a spectrogram with method, as Subtract or
+// Wiener do.
+func (p NoiseProfile) Reduce(method string, spectrogram [][]float64, sampleRate int) bool {
+	if method == NoiseWiener {
+		return p.Wiener(spectrogram, sampleRate)
+	}
+	return p.Subtract(spectrogram, sampleRate)
+}
+
+// fits reports whether the profile was learnt at sampleRate with the frame
+// size of spectrogram.
+func (p NoiseProfile) fits(spectrogram [][]float64, sampleRate int) bool {
+	if p.SampleRate != sampleRate {
+		return false
+	}
+	for _, frame := range spectrogram {
+		if len(frame) != len(p.Magnitudes) {
+			return false
+		}
+	}
+	return true
+}
+
+// noiseReduction is how the queries of a context are denoised.
+type noiseReduction struct {
+	profile NoiseProfile
+	method  string
+}
+
+func (n *noiseReduction) apply(spectrogram [][]float64, sampleRate int) {
+	n.profile.Reduce(n.method, spectrogram, sampleRate)
+}
+
+type noiseReductionKey struct{}
+
+// WithNoiseProfile returns a context under which the audio matched by
+// FindSegmentMatches and FindDualChannelSegmentMatches is denoised with
+// profile, by subtraction.
+func WithNoiseProfile(ctx context.Context, profile NoiseProfile) context.Context {
+	return WithNoiseReduction(ctx, profile, NoiseSubtraction)
+}
+
+// WithNoiseReduction is WithNoiseProfile denoising with method, one of
+// NoiseSubtraction and NoiseWiener.
+func WithNoiseReduction(ctx context.Context, profile NoiseProfile, method string) context.Context {
+	return context.WithValue(ctx, noiseReductionKey{}, noiseReduction{profile, method})
+}
+
+// noiseReductionFrom returns how the queries of ctx are denoised, if they
+// are.
+func noiseReductionFrom(ctx context.Context) *noiseReduction {
+	if reduction, ok := ctx.Value(noiseReductionKey{}).(noiseReduction); ok {
+		return &reduction
+	}
+	return nil
+}
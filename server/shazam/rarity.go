@@ -0,0 +1,67 @@
+//go:build !js && !wasm
+// +build !js,!wasm
+
+package shazam
+
+import (
+	"math"
+	"song-recognition/db"
+	"song-recognition/history"
+	"song-recognition/models"
+	"sync"
+	"time"
+)
+
+// catalogReloadInterval is how often the catalog size used for rarity
+// weights is read again.
+const catalogReloadInterval = time.Minute
+
+var catalog struct {
+	sync.Mutex
+	size   int
+	loaded time.Time
+}
+
+// catalogSize returns the number of songs addresses are weighed against: the
+// size recorded by the last hotness refresh or, before the first one, the
+// number of songs in the database. It is reloaded at most once a minute.
+func catalogSize(client db.DBClient) int {
+	catalog.Lock()
+	defer catalog.Unlock()
+
+	if time.Since(catalog.loaded) < catalogReloadInterval {
+		return catalog.size
+	}
+	catalog.loaded = time.Now()
+
+	if hotness, ok, err := history.ReadHotness(client); err == nil && ok && hotness.CatalogSize > 0 {
+		catalog.size = hotness.CatalogSize
+		return catalog.size
+	}
+	if total, err := client.TotalSongs(); err == nil {
+		catalog.size = total
+	}
+	return catalog.size
+}
+
+// rarity returns the IDF weight of an address found in songs of a catalog:
+// 1 when a single song has it, falling towards 0 as more of the catalog
+// shares it. Weights can't be told apart in catalogs of one song.
+func rarity(songs, catalogSize int) float64 {
+	if catalogSize < 2 || songs < 1 {
+		return 1
+	}
+	songs = min(songs, catalogSize)
+	n := float64(catalogSize)
+	return math.Log1p(n/float64(songs)) / math.Log1p(n)
+}
+
+// distinctSongs returns the number of songs among couples, using seen as an
+// empty scratch set.
+func distinctSongs(couples []models.Couple, seen map[models.SongID]struct{}) int {
+	defer clear(seen)
+	for _, couple := range couples {
+		seen[couple.SongID] = struct{}{}
+	}
+	return len(seen)
+}
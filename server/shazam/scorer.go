@@ -0,0 +1,171 @@
+//go:build !js && !wasm
+// +build !js,!wasm
+
+package shazam
+
+import (
+	"fmt"
+	"slices"
+	"song-recognition/models"
+	"song-recognition/utils"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Hit is a couple of a candidate song sharing an address with the query.
+type Hit struct {
+	SampleTime uint32  // anchor time in the query, in ms
+	SongTime   uint32  // anchor time in the song, in ms
+	Rarity     float64 // IDF weight of the address, see rarity
+	Magnitude  float64 // weight of the anchor peak in the song, see magnitudeWeight
+}
+
+// magnitudeWeight weighs a couple of a song by the magnitude of its anchor
+// peak: peaks standing 12 dB or more above their frame count 1, weaker ones
+// down to 0.25, since they are the first to drown in noise. Version 1
+// couples, which don't record magnitudes, count 1.
+func magnitudeWeight(couple models.Couple) float64 {
+	if couple.Version() < models.CoupleV2 {
+		return 1
+	}
+	level := float64(couple.Magnitude) / 2
+	return min(1, 0.25+0.75*level/12)
+}
+
+// Scorer scores a candidate song from its hits. Scores are only compared
+// between the candidates of one query, and songs are ranked by them; the
+// acceptance thresholds apply to the score of the best one.
+type Scorer interface {
+	Name() string
+	Score(hits []Hit) float64
+}
+
+var scorers = struct {
+	sync.RWMutex
+	byName map[string]Scorer
+}{byName: map[string]Scorer{
+	"histogram": histogramScorer{},
+	"rarity":    rarityScorer{},
+	"coherence": coherenceScorer{},
+	"magnitude": magnitudeScorer{},
+}}
+
+// RegisterScorer makes a scorer selectable by its name with SCORER, so new
+// scoring approaches can be compared without changing the matcher.
+func RegisterScorer(scorer Scorer) {
+	scorers.Lock()
+	defer scorers.Unlock()
+	scorers.byName[scorer.Name()] = scorer
+}
+
+// ScorerByName returns a registered scorer.
+func ScorerByName(name string) (Scorer, error) {
+	scorers.RLock()
+	defer scorers.RUnlock()
+	scorer, ok := scorers.byName[name]
+	if !ok {
+		names := make([]string, 0, len(scorers.byName))
+		for name := range scorers.byName {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown scorer %q (available: %s)", name, strings.Join(names, ", "))
+	}
+	return scorer, nil
+}
+
+// CurrentScorer returns the scorer selected by SCORER (default histogram).
+// Unknown names fall back to the default.
+func CurrentScorer() Scorer {
+	scorer, err := ScorerByName(utils.GetEnv("SCORER", "histogram"))
+	if err != nil {
+		return histogramScorer{}
+	}
+	return scorer
+}
+
+// offsetHistograms are reused across candidates, since a query scores many.
+var offsetHistograms = sync.Pool{New: func() any { return make(map[int32]float64, 256) }}
+
+// bestOffset returns the offset bucket holding the largest total weight of
+// hits, and that weight.
+func bestOffset(hits []Hit, weight func(Hit) float64) (int32, float64) {
+	histogram := offsetHistograms.Get().(map[int32]float64)
+	defer func() {
+		clear(histogram)
+		offsetHistograms.Put(histogram)
+	}()
+
+	var best int32
+	maxWeight := 0.0
+	for _, hit := range hits {
+		bucket := offsetBucket([2]uint32{hit.SampleTime, hit.SongTime})
+		histogram[bucket] += weight(hit)
+		if histogram[bucket] > maxWeight {
+			best, maxWeight = bucket, histogram[bucket]
+		}
+	}
+	return best, maxWeight
+}
+
+// histogramScorer is the classic score: the number of hits in the largest
+// bin of the histogram of time offsets between query and song.
+type histogramScorer struct{}
+
+func (histogramScorer) Name() string { return "histogram" }
+
+func (histogramScorer) Score(hits []Hit) float64 {
+	_, count := bestOffset(hits, func(Hit) float64 { return 1 })
+	return count
+}
+
+// rarityScorer is the histogram score with hits weighted by the IDF of their
+// address: a hit counts 1 when its address is unique to the song and less
+// the more of the catalog shares it, as common addresses say little about
+// which song is playing. In large catalogs, common addresses pile up chance
+// alignments for the wrong songs.
+type rarityScorer struct{}
+
+func (rarityScorer) Name() string { return "rarity" }
+
+func (rarityScorer) Score(hits []Hit) float64 {
+	_, weight := bestOffset(hits, func(hit Hit) float64 { return hit.Rarity })
+	return weight
+}
+
+// magnitudeScorer is the histogram score with hits weighted by the
+// magnitude of their anchor peak in the song, so that matches resting on
+// strong peaks outrank those resting on faint ones, which noise forges more
+// easily.
+type magnitudeScorer struct{}
+
+func (magnitudeScorer) Name() string { return "magnitude" }
+
+func (magnitudeScorer) Score(hits []Hit) float64 {
+	_, weight := bestOffset(hits, func(hit Hit) float64 { return hit.Magnitude })
+	return weight
+}
+
+// coherenceScorer counts the distinct query times aligned with the song
+// around the best offset. Repeated passages make one query time hit several
+// song times at the same offset, which inflates the histogram score; here
+// every moment of the query counts once, and hits straddling two offset bins
+// aren't split between them.
+type coherenceScorer struct{}
+
+func (coherenceScorer) Name() string { return "coherence" }
+
+func (coherenceScorer) Score(hits []Hit) float64 {
+	best, _ := bestOffset(hits, func(Hit) float64 { return 1 })
+
+	var times []uint32
+	for _, hit := range hits {
+		bucket := offsetBucket([2]uint32{hit.SampleTime, hit.SongTime})
+		if bucket >= best-1 && bucket <= best+1 {
+			times = append(times, hit.SampleTime)
+		}
+	}
+	slices.Sort(times)
+	return float64(len(slices.Compact(times)))
+}
@@ -0,0 +1,136 @@
+//go:build !js && !wasm
+// +build !js,!wasm
+
+package shazam
+
+import (
+	"context"
+	"song-recognition/audio"
+	"song-recognition/db"
+	"song-recognition/models"
+	"song-recognition/utils"
+	"time"
+)
+
+// Segment is the result of matching one window of a long recording.
+type Segment struct {
+	StartMs    int64   `json:"startMs"`
+	EndMs      int64   `json:"endMs"`
+	Start      string  `json:"start,omitempty"` // StartMs formatted for people
+	End        string  `json:"end,omitempty"`
+	Matches    []Match `json:"matches"`
+	Recognized bool    `json:"recognized"`
+	// Channel is the channel of a stereo recording the top match was found
+	// on, when its channels were matched on their own.
+	Channel string `json:"channel,omitempty"`
+	// LoudnessLUFS is the integrated loudness of the segment, when measured.
+	LoudnessLUFS *float64 `json:"loudnessLufs,omitempty"`
+}
+
+// segmenting controls how long recordings are split before matching, so that
+// a song playing for part of the recording isn't drowned out by the rest.
+type segmenting struct {
+	MinDuration time.Duration // recordings up to this long are matched whole
+	Length      time.Duration // length of each segment
+	Hop         time.Duration // distance between segment starts
+}
+
+// loadSegmenting reads SEGMENT_MIN_DURATION (default 30s), SEGMENT_LENGTH
+// (default 15s) and SEGMENT_HOP (default 10s).
+func loadSegmenting() segmenting {
+	parse := func(key string, fallback time.Duration) time.Duration {
+		d, err := time.ParseDuration(utils.GetEnv(key, fallback.String()))
+		if err != nil || d <= 0 {
+			return fallback
+		}
+		return d
+	}
+
+	s := segmenting{
+		MinDuration: parse("SEGMENT_MIN_DURATION", 30*time.Second),
+		Length:      parse("SEGMENT_LENGTH", 15*time.Second),
+		Hop:         parse("SEGMENT_HOP", 10*time.Second),
+	}
+	s.MinDuration = max(s.MinDuration, s.Length)
+	return s
+}
+
+// windows returns the sample ranges to match for a recording of n samples.
+// The last window is aligned to the end of the recording so that no audio is
+// left out.
+func (s segmenting) windows(n, sampleRate int) [][2]int {
+	toSamples := func(d time.Duration) int { return int(audio.MsToFrames(d.Milliseconds(), sampleRate)) }
+
+	length, hop := toSamples(s.Length), max(toSamples(s.Hop), 1)
+	if n <= toSamples(s.MinDuration) || length <= 0 {
+		return [][2]int{{0, n}}
+	}
+
+	var windows [][2]int
+	start := 0
+	for ; start+length <= n; start += hop {
+		windows = append(windows, [2]int{start, start + length})
+	}
+	if last := windows[len(windows)-1]; last[1] < n {
+		windows = append(windows, [2]int{n - length, n})
+	}
+	return windows
+}
+
+// FindSegmentMatches matches a recording in overlapping segments when it is
+// longer than SEGMENT_MIN_DURATION, and as a single segment otherwise. Each
+// segment is accepted or rejected with the given thresholds. Only songs for
+// which visible returns true are matched; a nil visible allows every song.
+// Matching stops, with an error, once ctx is done or the catalog can't be
+// read.
+func FindSegmentMatches(ctx context.Context, samples []float64, sampleRate int, thresholds Thresholds, visible func(songID models.SongID) bool) ([]Segment, error) {
+	// Resample once rather than per segment
+	format := audio.AnalysisFormat()
+	samples, sampleRate = format.Conform([][]float64{samples}, sampleRate)[0], format.SampleRate
+
+	client, err := db.NewDBClient()
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+	client = db.WithContext(ctx, client)
+
+	var segments []Segment
+	for _, window := range loadSegmenting().windows(len(samples), sampleRate) {
+		sampleFingerprint, err := queryFingerprint(samples[window[0]:window[1]], sampleRate, FanOut(), noiseReductionFrom(ctx))
+		if err != nil {
+			return nil, err
+		}
+
+		matches, err := FindMatchesIn(client, sampleFingerprint, visible)
+		if err != nil {
+			return nil, err
+		}
+
+		segments = append(segments, Segment{
+			StartMs:    audio.FramesToMs(int64(window[0]), sampleRate),
+			EndMs:      audio.FramesToMs(int64(window[1]), sampleRate),
+			Matches:    matches,
+			Recognized: thresholds.Accepts(matches, float64(window[1]-window[0])/float64(sampleRate)),
+		})
+	}
+	return segments, nil
+}
+
+// BestSegment returns the segment whose top match scores highest, preferring
+// recognised segments.
+func BestSegment(segments []Segment) Segment {
+	best := segments[0]
+	for _, segment := range segments[1:] {
+		if segment.Recognized != best.Recognized {
+			if segment.Recognized {
+				best = segment
+			}
+			continue
+		}
+		if len(segment.Matches) > 0 && (len(best.Matches) == 0 || segment.Matches[0].Score > best.Matches[0].Score) {
+			best = segment
+		}
+	}
+	return best
+}
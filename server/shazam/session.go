@@ -0,0 +1,250 @@
+//go:build !js && !wasm
+// +build !js,!wasm
+
+package shazam
+
+import (
+	"context"
+	"math"
+	"song-recognition/db"
+	"song-recognition/exclusions"
+	"song-recognition/models"
+	"song-recognition/utils"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Session accumulates the fingerprints of a live recording. Each window of
+// audio added to it only looks up addresses the session hasn't seen and only
+// rescores the songs it hits, so results are refined incrementally instead
+// of matching the whole recording again.
+type Session struct {
+	mu         sync.Mutex
+	couples    map[uint32][]models.Couple // address -> couples from the database
+	rarities   map[uint32]float64         // address -> IDF weight
+	seen       map[[2]uint32]struct{}     // (address, sample time) pairs already scored
+	hits       map[models.SongID][]Hit    // songID -> hits so far
+	scores     map[models.SongID]float64  // songID -> score of its hits
+	timestamps map[models.SongID]uint32   // songID -> earliest timestamp
+	span       [2]uint32                  // earliest and latest sample times
+	songs      map[models.SongID]db.Song
+	visible    func(songID models.SongID) bool
+	lastUsed   atomic.Int64 // unix nanoseconds, readable while Add runs
+	progress   [2]float64   // seconds heard and progress at the last advice
+	advised    bool         // whether progress was set
+	strikes    int          // advices in a row that saw no match coming
+}
+
+// NewSession returns an empty live recognition session matching the songs
+// for which visible returns true, or every song if it is nil.
+func NewSession(visible func(songID models.SongID) bool) *Session {
+	s := &Session{
+		visible:    visible,
+		couples:    make(map[uint32][]models.Couple),
+		rarities:   make(map[uint32]float64),
+		seen:       make(map[[2]uint32]struct{}),
+		hits:       make(map[models.SongID][]Hit),
+		scores:     make(map[models.SongID]float64),
+		timestamps: make(map[models.SongID]uint32),
+		songs:      make(map[models.SongID]db.Song),
+	}
+	s.lastUsed.Store(time.Now().UnixNano())
+	return s
+}
+
+// Seconds returns the length of the recording heard so far, as the span of
+// its anchor times.
+func (s *Session) Seconds() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return float64(s.span[1]-s.span[0]) / 1000
+}
+
+// LastUsed returns when fingerprints were last added to the session.
+func (s *Session) LastUsed() time.Time {
+	return time.Unix(0, s.lastUsed.Load())
+}
+
+// Add scores the fingerprint of a new window of audio, whose anchor times
+// must be relative to the start of the session, and returns the matches for
+// everything heard so far. Lookups are abandoned once ctx is done.
+func (s *Session) Add(ctx context.Context, sampleFingerprint map[uint32]uint32) ([]Match, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastUsed.Store(time.Now().UnixNano())
+
+	client, err := db.NewDBClient()
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+	client = db.WithContext(ctx, client)
+
+	var unknown []uint32
+	for address := range sampleFingerprint {
+		if _, ok := s.couples[address]; !ok {
+			unknown = append(unknown, address)
+		}
+	}
+	if len(unknown) > 0 {
+		found, err := client.GetCouples(unknown)
+		if err != nil {
+			return nil, err
+		}
+		catalogSongs := catalogSize(client)
+		seenSongs := make(map[models.SongID]struct{})
+		for _, address := range unknown {
+			// Cache misses too, so they aren't looked up again
+			s.couples[address] = found[address]
+			s.rarities[address] = rarity(distinctSongs(found[address], seenSongs), catalogSongs)
+		}
+	}
+
+	excluded := exclusions.Filter()
+	touched := make(map[models.SongID]struct{})
+	for address, sampleTime := range sampleFingerprint {
+		if len(s.seen) == 0 {
+			s.span = [2]uint32{sampleTime, sampleTime}
+		}
+		s.span = [2]uint32{min(s.span[0], sampleTime), max(s.span[1], sampleTime)}
+
+		key := [2]uint32{address, sampleTime}
+		if _, ok := s.seen[key]; ok {
+			continue
+		}
+		s.seen[key] = struct{}{}
+
+		for _, couple := range s.couples[address] {
+			if s.visible != nil && !s.visible(couple.SongID) {
+				continue
+			}
+			if excluded != nil && excluded(couple.SongID, couple.AnchorTimeMs) {
+				continue
+			}
+			s.hits[couple.SongID] = append(s.hits[couple.SongID], Hit{
+				SampleTime: sampleTime,
+				SongTime:   couple.AnchorTimeMs,
+				Rarity:     s.rarities[address],
+				Magnitude:  magnitudeWeight(couple),
+			})
+			touched[couple.SongID] = struct{}{}
+
+			if existingTime, ok := s.timestamps[couple.SongID]; !ok || couple.AnchorTimeMs < existingTime {
+				s.timestamps[couple.SongID] = couple.AnchorTimeMs
+			}
+		}
+	}
+
+	scorer := CurrentScorer()
+	for songID := range touched {
+		s.scores[songID] = scorer.Score(s.hits[songID])
+	}
+
+	return rankMatches(client, s.scores, s.timestamps, len(s.couples), s.songs), nil
+}
+
+// Listening advice actions
+const (
+	ListenContinue = "continue" // send another window of the usual length
+	ListenExtend   = "extend"   // a match is building up, send a longer window
+	ListenStop     = "stop"     // stop listening, see Reason
+)
+
+// Reasons to stop listening
+const (
+	StopRecognized = "recognized" // the best match meets the thresholds
+	StopNoMatch    = "no-match"   // no match is building up fast enough to make it
+	StopMaxLength  = "max-length" // the session reached LIVE_MAX_SECONDS
+)
+
+// ListenAdvice tells a live client whether to keep listening, and for how
+// long, so that it doesn't record and send audio for a fixed length whatever
+// the results.
+type ListenAdvice struct {
+	Action string `json:"action"`
+	Reason string `json:"reason,omitempty"`
+	// NextWindowMs is how much audio to send next, when listening goes on.
+	NextWindowMs uint32 `json:"nextWindowMs,omitempty"`
+	// Progress is the score of the best match over the score it needs, 1 or
+	// more once recognized.
+	Progress float64 `json:"progress"`
+}
+
+// listenParams returns the window length live clients are advised to send
+// by default, LIVE_WINDOW_MS (default 3000), and how long sessions listen at
+// least and at most, LIVE_MIN_SECONDS (default 6) and LIVE_MAX_SECONDS
+// (default 30).
+func listenParams() (window uint32, minSeconds, maxSeconds float64) {
+	window = 3000
+	if ms, err := strconv.ParseUint(utils.GetEnv("LIVE_WINDOW_MS"), 10, 32); err == nil && ms > 0 {
+		window = uint32(ms)
+	}
+	minSeconds = envFloat("LIVE_MIN_SECONDS", 6)
+	maxSeconds = envFloat("LIVE_MAX_SECONDS", 30)
+	if maxSeconds <= 0 {
+		maxSeconds = 30
+	}
+	return window, min(minSeconds, maxSeconds), maxSeconds
+}
+
+// Advise tells the client of the session what to do after the window whose
+// matches Add returned. Listening stops as soon as the best match meets the
+// thresholds; while it is climbing towards them, the next window is extended
+// to the audio it should take to get there at the rate it climbed since the
+// last advice, up to 4 windows. After LIVE_MIN_SECONDS, listening stops
+// early when two windows in a row show that, at that rate, no match would
+// make it before LIVE_MAX_SECONDS.
+func (s *Session) Advise(matches []Match, thresholds Thresholds) ListenAdvice {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	window, minSeconds, maxSeconds := listenParams()
+	seconds := float64(s.span[1]-s.span[0]) / 1000
+
+	progress := 0.0
+	if len(matches) > 0 {
+		if minScore := thresholds.MinScore(seconds); minScore > 0 {
+			progress = matches[0].Score / minScore
+		} else {
+			progress = 1
+		}
+	}
+	advice := ListenAdvice{Action: ListenContinue, NextWindowMs: window, Progress: progress}
+
+	first := !s.advised
+	rate := 0.0 // progress per second of audio
+	if last := s.progress; !first && seconds > last[0] {
+		rate = (progress - last[1]) / (seconds - last[0])
+	}
+	s.progress, s.advised = [2]float64{seconds, progress}, true
+
+	switch {
+	case thresholds.Accepts(matches, seconds):
+		return ListenAdvice{Action: ListenStop, Reason: StopRecognized, Progress: progress}
+	case seconds >= maxSeconds:
+		return ListenAdvice{Action: ListenStop, Reason: StopMaxLength, Progress: progress}
+	}
+
+	if first {
+		return advice
+	}
+	remaining := maxSeconds - seconds
+	if rate <= 0 || progress+rate*remaining < 1 {
+		s.strikes++
+		if seconds >= minSeconds && s.strikes >= 2 {
+			return ListenAdvice{Action: ListenStop, Reason: StopNoMatch, Progress: progress}
+		}
+		return advice
+	}
+	s.strikes = 0
+
+	// Climbing: ask for the audio it should take to reach the thresholds, up
+	// to 4 windows
+	needed := math.Round(min((1-progress)/rate, remaining, 4*float64(window)/1000) * 1000)
+	if needed > float64(window) {
+		advice.Action, advice.NextWindowMs = ListenExtend, uint32(needed)
+	}
+	return advice
+}
@@ -4,48 +4,136 @@
 package shazam
 
 import (
+	"context"
 	"fmt"
+	"runtime"
+	"song-recognition/audio"
+	"song-recognition/calibration"
 	"song-recognition/db"
+	"song-recognition/exclusions"
+	"song-recognition/models"
 	"song-recognition/utils"
 	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Match struct {
-	SongID     uint32
+	SongID     models.SongID
 	SongTitle  string
 	SongArtist string
 	YouTubeID  string
 	Timestamp  uint32
 	Score      float64
+	Confidence float64
+	// Position is Timestamp formatted for people (e.g. 1:23), unless the
+	// request suppressed formatted times.
+	Position string `json:",omitempty"`
+	// Details of the song, when they are known
+	Album       string `json:",omitempty"`
+	DurationMs  int64  `json:",omitempty"`
+	ReleaseYear int    `json:",omitempty"`
+	Genre       string `json:",omitempty"`
+	CoverArtURL string `json:",omitempty"`
+	// Playback links play the song from Timestamp, when the server adds
+	// them (see PLAYBACK_LINKS).
+	Playback []PlaybackLink `json:",omitempty"`
+}
+
+// PlaybackLink opens a song at a position with a playback provider.
+type PlaybackLink struct {
+	Provider string
+	URL      string
+}
+
+// IsRecognized reports whether the best of the (sorted) matches of a query
+// lasting querySeconds is strong enough for the query to count as recognised
+// with the default thresholds.
+func IsRecognized(matches []Match, querySeconds float64) bool {
+	return DefaultThresholds().Accepts(matches, querySeconds)
 }
 
 // FindMatches analyzes the audio sample to find matching songs in the database.
-func FindMatches(audioSample []float64, audioDuration float64, sampleRate int) ([]Match, time.Duration, error) {
+// The sample is resampled to the analysis format first.
+func FindMatches(audioSample []float64, sampleRate int) ([]Match, time.Duration, error) {
+	return findMatches(context.Background(), audioSample, sampleRate, nil)
+}
+
+func findMatches(ctx context.Context, audioSample []float64, sampleRate int, visible func(songID models.SongID) bool) ([]Match, time.Duration, error) {
 	startTime := time.Now()
 
-	spectrogram, err := Spectrogram(audioSample, sampleRate)
+	sampleFingerprint, err := queryFingerprint(audioSample, sampleRate, FanOut(), noiseReductionFrom(ctx))
 	if err != nil {
-		return nil, time.Since(startTime), fmt.Errorf("failed to get spectrogram of samples: %v", err)
+		return nil, time.Since(startTime), err
 	}
 
-	peaks := ExtractPeaks(spectrogram, audioDuration, sampleRate)
-	// peaks := ExtractPeaksLMX(spectrogram, true)
-	sampleFingerprint := Fingerprint(peaks, utils.GenerateUniqueID())
+	matches, _, err := FindVisibleMatchesFGP(ctx, sampleFingerprint, visible)
+	if err != nil && ctx.Err() != nil {
+		return nil, time.Since(startTime), ctx.Err()
+	}
 
-	sampleFingerprintMap := make(map[uint32]uint32)
-	for address, couple := range sampleFingerprint {
-		sampleFingerprintMap[address] = couple.AnchorTimeMs
+	return matches, time.Since(startTime), err
+}
+
+// QueryFingerprint fingerprints a mono query, pairing every anchor with the
+// fanOut peaks following it, and maps its addresses to their anchor times.
+// The sample is resampled to the analysis format first.
+func QueryFingerprint(audioSample []float64, sampleRate, fanOut int) (map[uint32]uint32, error) {
+	return queryFingerprint(audioSample, sampleRate, fanOut, nil)
+}
+
+// queryFingerprint is QueryFingerprint reducing noise, when not nil, in the
+// spectrogram of the query before picking its peaks.
+func queryFingerprint(audioSample []float64, sampleRate, fanOut int, noise *noiseReduction) (map[uint32]uint32, error) {
+	format := audio.AnalysisFormat()
+	audioSample = format.Conform([][]float64{audioSample}, sampleRate)[0]
+
+	spectrogram, err := Spectrogram(audioSample, format.SampleRate)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get spectrogram of samples: %v", err)
+	}
+	if noise != nil {
+		noise.apply(spectrogram, format.SampleRate)
 	}
 
-	matches, _, _ := FindMatchesFGP(sampleFingerprintMap)
+	peaks := ExtractPeaks(spectrogram, format.SampleRate)
+	// peaks := ExtractPeaksLMX(spectrogram, true)
 
-	return matches, time.Since(startTime), nil
+	sampleFingerprint := make(map[uint32]uint32)
+	for address, couple := range fingerprintFanOut(peaks, 0, fanOut) {
+		sampleFingerprint[address] = couple.AnchorTimeMs
+	}
+	return sampleFingerprint, nil
 }
 
 // FindMatchesFGP uses the sample fingerprint to find matching songs in the database.
 func FindMatchesFGP(sampleFingerprint map[uint32]uint32) ([]Match, time.Duration, error) {
+	return FindVisibleMatchesFGP(context.Background(), sampleFingerprint, nil)
+}
+
+// FindVisibleMatchesFGP is FindMatchesFGP restricted to the songs for which
+// visible returns true. Other songs are dropped before scoring, so they can't
+// be matched, nor affect the confidence of the visible ones. A nil visible
+// allows every song. Couples in excluded ranges of songs are ignored. The
+// search is abandoned, with an error, once ctx is done.
+func FindVisibleMatchesFGP(ctx context.Context, sampleFingerprint map[uint32]uint32, visible func(songID models.SongID) bool) ([]Match, time.Duration, error) {
 	startTime := time.Now()
+
+	client, err := db.NewDBClient()
+	if err != nil {
+		return nil, time.Since(startTime), err
+	}
+	defer client.Close()
+	client = db.WithContext(ctx, client)
+
+	matches, err := FindMatchesIn(client, sampleFingerprint, visible)
+	return matches, time.Since(startTime), err
+}
+
+// FindMatchesIn is FindVisibleMatchesFGP against the catalog of client, such
+// as a shadow index.
+func FindMatchesIn(client db.DBClient, sampleFingerprint map[uint32]uint32, visible func(songID models.SongID) bool) ([]Match, error) {
 	logger := utils.GetLogger()
 
 	addresses := make([]uint32, 0, len(sampleFingerprint))
@@ -53,57 +141,106 @@ func FindMatchesFGP(sampleFingerprint map[uint32]uint32) ([]Match, time.Duration
 		addresses = append(addresses, address)
 	}
 
-	db, err := db.NewDBClient()
-	if err != nil {
-		return nil, time.Since(startTime), err
-	}
-	defer db.Close()
-
-	m, err := db.GetCouples(addresses)
-	if err != nil {
-		return nil, time.Since(startTime), err
-	}
+	matches := map[models.SongID][]Hit{}              // songID -> hits
+	timestamps := map[models.SongID]uint32{}          // songID -> earliest timestamp
+	targetZones := map[models.SongID]map[uint32]int{} // songID -> timestamp -> count
+	var scores map[models.SongID]float64
+	scorer := CurrentScorer()
+	excluded := exclusions.Filter()
+
+	// Addresses come out of a map in random order, so every chunk is an
+	// unbiased sample of the query and the leader can be judged early.
+	early := loadEarlyExit()
+	catalogSongs := catalogSize(client)
+	seenSongs := make(map[models.SongID]struct{})
+	chunkSize := early.chunkSize(len(addresses))
+	for start := 0; start < len(addresses); start += chunkSize {
+		end := min(start+chunkSize, len(addresses))
+
+		m, err := client.GetCouples(addresses[start:end])
+		if err != nil {
+			return nil, err
+		}
 
-	matches := map[uint32][][2]uint32{}        // songID -> [(sampleTime, dbTime)]
-	timestamps := map[uint32]uint32{}          // songID -> earliest timestamp
-	targetZones := map[uint32]map[uint32]int{} // songID -> timestamp -> count
+		for address, couples := range m {
+			addressRarity := rarity(distinctSongs(couples, seenSongs), catalogSongs)
+			for _, couple := range couples {
+				if visible != nil && !visible(couple.SongID) {
+					continue
+				}
+				if excluded != nil && excluded(couple.SongID, couple.AnchorTimeMs) {
+					continue
+				}
+				matches[couple.SongID] = append(matches[couple.SongID], Hit{
+					SampleTime: sampleFingerprint[address],
+					SongTime:   couple.AnchorTimeMs,
+					Rarity:     addressRarity,
+					Magnitude:  magnitudeWeight(couple),
+				})
+
+				if existingTime, ok := timestamps[couple.SongID]; !ok || couple.AnchorTimeMs < existingTime {
+					timestamps[couple.SongID] = couple.AnchorTimeMs
+				}
+
+				if _, ok := targetZones[couple.SongID]; !ok {
+					targetZones[couple.SongID] = make(map[uint32]int)
+				}
+				targetZones[couple.SongID][couple.AnchorTimeMs]++
+			}
+		}
 
-	for address, couples := range m {
-		for _, couple := range couples {
-			matches[couple.SongID] = append(
-				matches[couple.SongID],
-				[2]uint32{sampleFingerprint[address], couple.AnchorTimeMs},
-			)
+		// matches = filterMatches(10, matches, targetZones)
 
-			if existingTime, ok := timestamps[couple.SongID]; !ok || couple.AnchorTimeMs < existingTime {
-				timestamps[couple.SongID] = couple.AnchorTimeMs
-			}
+		scores = scoreCandidates(scorer, matches)
 
-			if _, ok := targetZones[couple.SongID]; !ok {
-				targetZones[couple.SongID] = make(map[uint32]int)
-			}
-			targetZones[couple.SongID][couple.AnchorTimeMs]++
+		if end < len(addresses) && early.dominates(scores) {
+			logger.Debug(fmt.Sprintf("early exit after scoring %d of %d addresses", end, len(addresses)))
+			break
 		}
 	}
 
-	// matches = filterMatches(10, matches, targetZones)
+	return rankMatches(client, scores, timestamps, len(addresses), nil), nil
+}
 
-	scores := analyzeRelativeTiming(matches)
+// rankMatches looks up the scored songs and returns them as matches sorted by
+// score, for a query of querySize addresses. Songs found in cache aren't
+// looked up again; a non-nil cache is filled with the ones that are.
+func rankMatches(client db.DBClient, scores map[models.SongID]float64, timestamps map[models.SongID]uint32, querySize int, cache map[models.SongID]db.Song) []Match {
+	logger := utils.GetLogger()
 
 	var matchList []Match
-
 	for songID, points := range scores {
-		song, songExists, err := db.GetSongByID(songID)
-		if !songExists {
-			logger.Info(fmt.Sprintf("song with ID (%v) doesn't exist", songID))
-			continue
-		}
-		if err != nil {
-			logger.Info(fmt.Sprintf("failed to get song by ID (%v): %v", songID, err))
-			continue
+		song, cached := cache[songID]
+		if !cached {
+			var songExists bool
+			var err error
+			song, songExists, err = client.GetSongByID(songID)
+			if !songExists {
+				logger.Info(fmt.Sprintf("song with ID (%v) doesn't exist", songID))
+				continue
+			}
+			if err != nil {
+				logger.Info(fmt.Sprintf("failed to get song by ID (%v): %v", songID, err))
+				continue
+			}
+			if cache != nil {
+				cache[songID] = song
+			}
 		}
 
-		match := Match{songID, song.Title, song.Artist, song.YouTubeID, timestamps[songID], points}
+		match := Match{
+			SongID:      songID,
+			SongTitle:   song.Title,
+			SongArtist:  song.Artist,
+			YouTubeID:   song.YouTubeID,
+			Timestamp:   timestamps[songID],
+			Score:       points,
+			Album:       song.Album,
+			DurationMs:  song.DurationMs,
+			ReleaseYear: song.ReleaseYear,
+			Genre:       song.Genre,
+			CoverArtURL: song.CoverArtURL,
+		}
 		matchList = append(matchList, match)
 	}
 
@@ -111,15 +248,49 @@ func FindMatchesFGP(sampleFingerprint map[uint32]uint32) ([]Match, time.Duration
 		return matchList[i].Score > matchList[j].Score
 	})
 
-	return matchList, time.Since(startTime), nil
+	setConfidence(client, matchList, querySize)
+
+	return matchList
+}
+
+// setConfidence sets the confidence of the best match. Once a calibration
+// model has been fitted it is the probability that the match is correct;
+// until then it is the relative margin over the runner-up: 1 when nothing
+// else matched, 0 on a tie. Other matches get no confidence since a better
+// candidate exists.
+func setConfidence(client db.DBClient, matches []Match, querySize int) {
+	if len(matches) == 0 || matches[0].Score <= 0 {
+		return
+	}
+
+	runnerUp := 0.0
+	if len(matches) > 1 {
+		runnerUp = matches[1].Score
+	}
+	matches[0].Confidence = (matches[0].Score - runnerUp) / matches[0].Score
+
+	model, ok := calibration.Current(client)
+	if !ok {
+		return
+	}
+	catalogSize, err := client.TotalSongs()
+	if err != nil {
+		return
+	}
+	matches[0].Confidence = model.Probability(calibration.Features{
+		Score:       matches[0].Score,
+		RunnerUp:    runnerUp,
+		QuerySize:   querySize,
+		CatalogSize: catalogSize,
+	})
 }
 
 // filterMatches filters out matches that don't have enough
 // target zones to meet the specified threshold
 func filterMatches(
 	threshold int,
-	matches map[uint32][][2]uint32,
-	targetZones map[uint32]map[uint32]int) map[uint32][][2]uint32 {
+	matches map[models.SongID][][2]uint32,
+	targetZones map[models.SongID]map[uint32]int) map[models.SongID][][2]uint32 {
 
 	// Filter out non target zones.
 	// When a target zone has less than `targetZoneSize` anchor times, it is not considered a target zone.
@@ -131,7 +302,7 @@ func filterMatches(
 		}
 	}
 
-	filteredMatches := map[uint32][][2]uint32{}
+	filteredMatches := map[models.SongID][][2]uint32{}
 	for songID, zones := range targetZones {
 		if len(zones) >= threshold {
 			filteredMatches[songID] = matches[songID]
@@ -141,33 +312,56 @@ func filterMatches(
 	return filteredMatches
 }
 
-// analyzeRelativeTiming calculates a score for each song based on the
-// consistency of time offsets between the sample and database.
-func analyzeRelativeTiming(matches map[uint32][][2]uint32) map[uint32]float64 {
-	scores := make(map[uint32]float64)
-
-	for songID, times := range matches {
-		offsetCounts := make(map[int32]int)
+// minParallelCandidates is the number of candidate songs below which scoring
+// isn't worth spreading over multiple goroutines.
+const minParallelCandidates = 64
 
-		for _, timePair := range times {
-			sampleTime := int32(timePair[0])
-			dbTime := int32(timePair[1])
-			offset := dbTime - sampleTime
+// scoreCandidates scores each candidate song from its hits.
+// Candidates are scored concurrently by a pool of workers.
+func scoreCandidates(scorer Scorer, matches map[models.SongID][]Hit) map[models.SongID]float64 {
+	songIDs := make([]models.SongID, 0, len(matches))
+	for songID := range matches {
+		songIDs = append(songIDs, songID)
+	}
 
-			// Bin offsets in 100ms buckets to allow for small timing variations
-			offsetBucket := offset / 100
-			offsetCounts[offsetBucket]++
-		}
+	workers := runtime.NumCPU()
+	if len(songIDs) < minParallelCandidates || workers < 2 {
+		workers = 1
+	}
+	if workers > len(songIDs) {
+		workers = len(songIDs)
+	}
 
-		maxCount := 0
-		for _, count := range offsetCounts {
-			if count > maxCount {
-				maxCount = count
+	results := make([]float64, len(songIDs))
+	var next atomic.Int64
+	var wg sync.WaitGroup
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for {
+				i := int(next.Add(1) - 1)
+				if i >= len(songIDs) {
+					return
+				}
+				results[i] = scorer.Score(matches[songIDs[i]])
 			}
-		}
+		}()
+	}
+	wg.Wait()
 
-		scores[songID] = float64(maxCount)
+	scores := make(map[models.SongID]float64, len(songIDs))
+	for i, songID := range songIDs {
+		scores[songID] = results[i]
 	}
 
 	return scores
 }
+
+// offsetBucket bins the offset between a sample and database time in 100ms
+// buckets to allow for small timing variations.
+func offsetBucket(timePair [2]uint32) int32 {
+	return (int32(timePair[1]) - int32(timePair[0])) / 100
+}
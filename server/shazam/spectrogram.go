@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"math"
 	"math/cmplx"
+	"song-recognition/audio"
 )
 
 const (
@@ -121,12 +122,15 @@ func Downsample(input []float64, originalSampleRate, targetSampleRate int) ([]fl
 
 // Peak represents a significant point in the spectrogram.
 type Peak struct {
-	Freq float64 // Frequency in Hz
-	Time float64 // Time in seconds
+	Freq  float64 // Frequency in Hz
+	Time  float64 // Time in seconds
+	Band  int     // Index of the frequency band the peak was picked in
+	Level float64 // Decibels above the average of the band peaks of its frame
 }
 
 // ExtractPeaks analyzes a spectrogram and extracts significant peaks in the frequency domain over time.
-func ExtractPeaks(spectrogram [][]float64, audioDuration float64, sampleRate int) []Peak {
+// Peaks are timed at the start of their STFT frame in the audio at sampleRate.
+func ExtractPeaks(spectrogram [][]float64, sampleRate int) []Peak {
 	if len(spectrogram) < 1 {
 		return []Peak{}
 	}
@@ -141,7 +145,6 @@ func ExtractPeaks(spectrogram [][]float64, audioDuration float64, sampleRate int
 	}
 
 	var peaks []Peak
-	frameDuration := audioDuration / float64(len(spectrogram))
 
 	// Calculate frequency resolution (Hz per bin)
 	effectiveSampleRate := float64(sampleRate) / float64(dspRatio)
@@ -180,10 +183,12 @@ func ExtractPeaks(spectrogram [][]float64, audioDuration float64, sampleRate int
 		// Add peaks that exceed the average magnitude
 		for i, value := range maxMags {
 			if value > avg {
-				peakTime := float64(frameIdx) * frameDuration
+				peakTime := audio.FramesToSeconds(frameIdx*hopSize*dspRatio, sampleRate)
 				peakFreq := float64(freqIndices[i]) * freqResolution
 
-				peaks = append(peaks, Peak{Time: peakTime, Freq: peakFreq})
+				level := 20 * math.Log10(value/avg)
+
+				peaks = append(peaks, Peak{Time: peakTime, Freq: peakFreq, Band: i, Level: level})
 			}
 		}
 	}
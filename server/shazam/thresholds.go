@@ -0,0 +1,129 @@
+//go:build !js && !wasm
+// +build !js,!wasm
+
+package shazam
+
+import (
+	"math"
+	"song-recognition/utils"
+	"strconv"
+	"strings"
+)
+
+// Thresholds decide whether the best match of a query is accepted. The best
+// song needs at least MinAlignedCouples aligned couples, and at least
+// MinAlignedPerSecond per second of query audio, so that one setting suits
+// both short and long clips.
+type Thresholds struct {
+	MinAlignedCouples   float64 `json:"minAlignedCouples"`
+	MinAlignedPerSecond float64 `json:"minAlignedPerSecond"`
+	MinConfidence       float64 `json:"minConfidence"`
+}
+
+// ThresholdOverrides are optional per-client or per-request changes to the
+// default thresholds. Nil fields keep the current value.
+type ThresholdOverrides struct {
+	MinAlignedCouples   *float64 `json:"minAlignedCouples,omitempty"`
+	MinAlignedPerSecond *float64 `json:"minAlignedPerSecond,omitempty"`
+	MinConfidence       *float64 `json:"minConfidence,omitempty"`
+}
+
+func envFloat(key string, fallback float64) float64 {
+	value, err := strconv.ParseFloat(utils.GetEnv(key), 64)
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+// envBounds parses a "min,max" pair. Missing or invalid bounds are open.
+func envBounds(key string, min, max float64) (float64, float64) {
+	lower, upper, ok := strings.Cut(utils.GetEnv(key), ",")
+	if !ok {
+		return min, max
+	}
+	if value, err := strconv.ParseFloat(strings.TrimSpace(lower), 64); err == nil {
+		min = value
+	}
+	if value, err := strconv.ParseFloat(strings.TrimSpace(upper), 64); err == nil {
+		max = value
+	}
+	return min, max
+}
+
+// DefaultThresholds returns the thresholds configured through MIN_MATCH_SCORE
+// (minimum aligned couples), MIN_MATCH_SCORE_PER_SECOND (minimum aligned
+// couples per second of query, default 0) and MIN_MATCH_CONFIDENCE.
+func DefaultThresholds() Thresholds {
+	return Thresholds{
+		MinAlignedCouples:   envFloat("MIN_MATCH_SCORE", 20),
+		MinAlignedPerSecond: envFloat("MIN_MATCH_SCORE_PER_SECOND", 0),
+		MinConfidence:       envFloat("MIN_MATCH_CONFIDENCE", 0),
+	}
+}
+
+// Apply returns the thresholds with the overrides applied.
+func (t Thresholds) Apply(o ThresholdOverrides) Thresholds {
+	if o.MinAlignedCouples != nil {
+		t.MinAlignedCouples = *o.MinAlignedCouples
+	}
+	if o.MinAlignedPerSecond != nil {
+		t.MinAlignedPerSecond = *o.MinAlignedPerSecond
+	}
+	if o.MinConfidence != nil {
+		t.MinConfidence = *o.MinConfidence
+	}
+	return t
+}
+
+// Clamp keeps overridden thresholds within the bounds set by the operator in
+// MIN_MATCH_SCORE_BOUNDS, MIN_MATCH_SCORE_PER_SECOND_BOUNDS and
+// MIN_MATCH_CONFIDENCE_BOUNDS ("min,max").
+func (t Thresholds) Clamp() Thresholds {
+	minCouples, maxCouples := envBounds("MIN_MATCH_SCORE_BOUNDS", 0, math.Inf(1))
+	minPerSecond, maxPerSecond := envBounds("MIN_MATCH_SCORE_PER_SECOND_BOUNDS", 0, math.Inf(1))
+	minConfidence, maxConfidence := envBounds("MIN_MATCH_CONFIDENCE_BOUNDS", 0, 1)
+
+	t.MinAlignedCouples = clamp(t.MinAlignedCouples, minCouples, maxCouples)
+	t.MinAlignedPerSecond = clamp(t.MinAlignedPerSecond, minPerSecond, maxPerSecond)
+	t.MinConfidence = clamp(t.MinConfidence, minConfidence, maxConfidence)
+	return t
+}
+
+func clamp(value, min, max float64) float64 {
+	if value < min {
+		return min
+	}
+	if value > max {
+		return max
+	}
+	return value
+}
+
+// MinScore returns the score the best match of a query lasting querySeconds
+// needs.
+func (t Thresholds) MinScore(querySeconds float64) float64 {
+	return max(t.MinAlignedCouples, t.MinAlignedPerSecond*querySeconds)
+}
+
+// Accepts reports whether the best of the (sorted) matches of a query lasting
+// querySeconds meets the thresholds.
+func (t Thresholds) Accepts(matches []Match, querySeconds float64) bool {
+	if len(matches) == 0 {
+		return false
+	}
+	return matches[0].Score >= t.MinScore(querySeconds) && matches[0].Confidence >= t.MinConfidence
+}
+
+// QuerySeconds estimates the length of the audio a fingerprint was computed
+// from, as the span of its anchor times.
+func QuerySeconds(fingerprint map[uint32]uint32) float64 {
+	if len(fingerprint) == 0 {
+		return 0
+	}
+	first, last := uint32(math.MaxUint32), uint32(0)
+	for _, anchorTime := range fingerprint {
+		first, last = min(first, anchorTime), max(last, anchorTime)
+	}
+	return float64(last-first) / 1000
+}
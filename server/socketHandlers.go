@@ -6,13 +6,20 @@ import (
 	"encoding/json"
 	"fmt"
 	"log/slog"
+	"song-recognition/acl"
+	"song-recognition/archive"
+	"song-recognition/auth"
 	"song-recognition/db"
+	"song-recognition/ingest"
 	"song-recognition/models"
+	"song-recognition/shadow"
 	"song-recognition/shazam"
 	"song-recognition/spotify"
 	"song-recognition/utils"
+	"song-recognition/validate"
 	"song-recognition/wav"
 	"strings"
+	"sync"
 	"time"
 
 	socketio "github.com/googollee/go-socket.io"
@@ -58,6 +65,11 @@ func handleSongDownload(socket socketio.Conn, spotifyURL string) {
 	logger := utils.GetLogger()
 	ctx := context.Background()
 
+	if err := ingest.CheckSpace(SONGS_DIR); err != nil {
+		statusMsg := fmt.Sprintf("Downloads are paused until disk space is freed: %v", err)
+		socket.Emit("downloadStatus", downloadStatus("info", statusMsg))
+	}
+
 	// Handle album download
 	if strings.Contains(spotifyURL, "album") {
 		tracksInAlbum, err := spotify.AlbumInfo(spotifyURL)
@@ -136,7 +148,9 @@ func handleSongDownload(socket socketio.Conn, spotifyURL string) {
 		// check if track already exist
 		db, err := db.NewDBClient()
 		if err != nil {
-			fmt.Errorf("Log - error connecting to DB: %d", err)
+			err := xerrors.New(err)
+			logger.ErrorContext(ctx, "error connecting to DB", slog.Any("error", err))
+			return
 		}
 		defer db.Close()
 
@@ -176,6 +190,10 @@ func handleSongDownload(socket socketio.Conn, spotifyURL string) {
 			socket.Emit("downloadStatus", downloadStatus("success", statusMsg))
 		}
 	}
+
+	if archive.Enabled() {
+		go replayUnmatched()
+	}
 }
 
 // handleNewRecording saves new recorded audio snippet to a WAV file.
@@ -189,6 +207,10 @@ func handleNewRecording(socket socketio.Conn, recordData string) {
 		logger.ErrorContext(ctx, "Failed to unmarshal record data.", slog.Any("error", err))
 		return
 	}
+	if err := validate.Recording(recData).Err(); err != nil {
+		logger.WarnContext(ctx, "Rejected invalid recording.", slog.Any("error", err))
+		return
+	}
 
 	err := utils.CreateFolder("recordings")
 	if err != nil {
@@ -220,8 +242,21 @@ func handleNewFingerprint(socket socketio.Conn, fingerprintData string) {
 	logger := utils.GetLogger()
 	ctx := context.Background()
 
+	// Live clients send consecutive windows of a recording with live set,
+	// offsetMs being the start of the window within the recording. Their
+	// results are refined from one window to the next until reset is set.
 	var data struct {
 		Fingerprint map[uint32]uint32 `json:"fingerprint"`
+		Live        bool              `json:"live"`
+		OffsetMs    uint32            `json:"offsetMs"`
+		Reset       bool              `json:"reset"`
+		Stream      string            `json:"stream"` // also publishes matches to this stream's subscribers
+		// MinCatalogVersion rejects the fingerprint when the catalog is older
+		MinCatalogVersion int64 `json:"minCatalogVersion"`
+		// Formatted set to false leaves out the positions formatted for
+		// people, which follow Locale or the Accept-Language header.
+		Formatted *bool  `json:"formatted"`
+		Locale    string `json:"locale"`
 	}
 	if err := json.Unmarshal([]byte(fingerprintData), &data); err != nil {
 		err := xerrors.New(err)
@@ -229,16 +264,93 @@ func handleNewFingerprint(socket socketio.Conn, fingerprintData string) {
 		return
 	}
 
-	matches, _, err := shazam.FindMatchesFGP(data.Fingerprint)
+	if !db.Available() {
+		socket.Emit("recognitionUnavailable", errStorageUnavailable.Error())
+		return
+	}
+	catalog, err := readCatalog()
+	if err != nil {
+		socket.Emit("recognitionUnavailable", errStorageUnavailable.Error())
+		return
+	}
+	if catalog.Version < data.MinCatalogVersion {
+		socket.Emit("catalogStale", fmt.Sprintf("catalog version %d is older than the requested %d", catalog.Version, data.MinCatalogVersion))
+		return
+	}
+
+	release, err := getRecognitionLimiter().acquire(ctx)
+	if err != nil {
+		socket.Emit("recognitionBusy", err.Error())
+		return
+	}
+	var matches []shazam.Match
+	var advice *shazam.ListenAdvice
+	querySeconds := shazam.QuerySeconds(data.Fingerprint)
+	if data.Live {
+		if data.Reset {
+			liveSessions.end(socket.ID())
+		}
+		for address, anchorTime := range data.Fingerprint {
+			data.Fingerprint[address] = anchorTime + data.OffsetMs
+		}
+		session := liveSessions.get(socket.ID())
+		matches, err = session.Add(ctx, data.Fingerprint)
+		querySeconds = session.Seconds()
+		if err == nil {
+			listen := session.Advise(matches, shazam.DefaultThresholds())
+			advice = &listen
+		}
+	} else {
+		// Sockets are unsigned, so only unrestricted songs are matched
+		var searchDuration time.Duration
+		matches, searchDuration, err = shazam.FindVisibleMatchesFGP(ctx, data.Fingerprint, acl.Filter(auth.Client{}))
+		if err == nil {
+			shadow.Mirror(shadow.Query{
+				Source:      "socket",
+				Fingerprint: data.Fingerprint,
+				Visible:     acl.Filter(auth.Client{}),
+				Thresholds:  shazam.DefaultThresholds(),
+				Matches:     matches,
+				Duration:    searchDuration,
+			})
+		}
+	}
+	release()
+	if err != nil && db.Probe() != nil {
+		socket.Emit("recognitionUnavailable", errStorageUnavailable.Error())
+		return
+	}
 	if err != nil {
 		err := xerrors.New(err)
 		logger.ErrorContext(ctx, "failed to get matches.", slog.Any("error", err))
 	}
 
-	jsonData, err := json.Marshal(matches)
+	recognized := shazam.IsRecognized(matches, querySeconds)
+	if err == nil && !data.Live && !recognized && archive.Enabled() {
+		if _, err := archive.SaveUnmatched("socket", "", data.Fingerprint, ""); err != nil {
+			err := xerrors.New(err)
+			logger.ErrorContext(ctx, "failed to archive unmatched clip.", slog.Any("error", err))
+		}
+	}
+
+	recognitionID := ""
+	if err == nil && !data.Live {
+		recognitionID = recordRecognition(ctx, "socket", matches, recognized, len(data.Fingerprint), data.Fingerprint)
+		if recognitionID != "" {
+			socket.Emit("recognitionId", recognitionID)
+		}
+	}
+	if err == nil && len(data.Stream) <= maxStreamName {
+		topics := append([]string{"session:" + socket.ID()}, streamTopics(data.Stream)...)
+		publishMatches(ctx, topics, "", matches, recognized, recognitionID)
+	}
+
 	if len(matches) > 10 {
-		jsonData, _ = json.Marshal(matches[:10])
+		matches = matches[:10]
 	}
+	addPlaybackLinks(ctx, matches)
+	formatMatchTimes(timeFormatter(socket.RemoteHeader(), data.Formatted == nil || *data.Formatted, data.Locale), matches)
+	jsonData, err := json.Marshal(matches)
 
 	if err != nil {
 		err := xerrors.New(err)
@@ -246,5 +358,52 @@ func handleNewFingerprint(socket socketio.Conn, fingerprintData string) {
 		return
 	}
 
+	if catalogData, err := json.Marshal(catalog); err == nil {
+		socket.Emit("catalog", string(catalogData))
+	}
 	socket.Emit("matches", string(jsonData))
+	if advice != nil {
+		if adviceData, err := json.Marshal(advice); err == nil {
+			socket.Emit("listen", string(adviceData))
+		}
+	}
+}
+
+// liveSessions holds the live recognition session of each socket.
+var liveSessions = &sessionRegistry{sessions: make(map[string]*shazam.Session)}
+
+type sessionRegistry struct {
+	mu       sync.Mutex
+	sessions map[string]*shazam.Session
+}
+
+// get returns the socket's session, starting one if needed. Sessions idle
+// for longer than LIVE_SESSION_TTL (default 5m) are dropped.
+func (r *sessionRegistry) get(socketID string) *shazam.Session {
+	ttl, err := time.ParseDuration(utils.GetEnv("LIVE_SESSION_TTL", "5m"))
+	if err != nil || ttl <= 0 {
+		ttl = 5 * time.Minute
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for id, session := range r.sessions {
+		if time.Since(session.LastUsed()) > ttl {
+			delete(r.sessions, id)
+		}
+	}
+
+	session, ok := r.sessions[socketID]
+	if !ok {
+		session = shazam.NewSession(acl.Filter(auth.Client{}))
+		r.sessions[socketID] = session
+	}
+	return session
+}
+
+func (r *sessionRegistry) end(socketID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.sessions, socketID)
 }
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"net/http"
+	"song-recognition/acl"
+	"song-recognition/auth"
+	"song-recognition/db"
+	"song-recognition/models"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultSongPage = 50
+	maxSongPage     = 200
+	// songListBatch is how many songs are read at a time while skipping the
+	// songs a client may not see
+	songListBatch = 500
+)
+
+type listedSong struct {
+	SongID      models.SongID `json:"songId"`
+	Title       string        `json:"title"`
+	Artist      string        `json:"artist"`
+	YouTubeID   string        `json:"youtubeId,omitempty"`
+	Album       string        `json:"album,omitempty"`
+	DurationMs  int64         `json:"durationMs,omitempty"`
+	ReleaseYear int           `json:"releaseYear,omitempty"`
+	Genre       string        `json:"genre,omitempty"`
+	CoverArtURL string        `json:"coverArtUrl,omitempty"`
+	IngestedAt  *time.Time    `json:"ingestedAt,omitempty"`
+}
+
+// listVisibleSongs lists the songs matching filter the way ListSongs does,
+// leaving out those visible reports a client may not see. A nil visible
+// shows every song.
+func listVisibleSongs(dbClient db.DBClient, offset, limit int, filter db.SongFilter, visible func(songID models.SongID) bool) ([]db.ListedSong, error) {
+	if visible == nil {
+		return dbClient.ListSongs(offset, limit, filter)
+	}
+	var songs []db.ListedSong
+	for start := 0; ; start += songListBatch {
+		batch, err := dbClient.ListSongs(start, songListBatch, filter)
+		if err != nil {
+			return nil, err
+		}
+		for _, song := range batch {
+			if !visible(song.ID) {
+				continue
+			}
+			if offset > 0 {
+				offset--
+				continue
+			}
+			if songs = append(songs, song); len(songs) == limit {
+				return songs, nil
+			}
+		}
+		if len(batch) < songListBatch {
+			return songs, nil
+		}
+	}
+}
+
+// handleListSongs serves a page of the songs of the library the client may
+// see, with "offset" and "limit" (default 50, at most 200), those whose
+// artist contains "artist", ignoring case, ordered by "sort" (title or
+// ingested) in "order" (asc or desc).
+func handleListSongs(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	offset, limit := 0, defaultSongPage
+	var err error
+	if value := query.Get("offset"); value != "" {
+		offset, err = strconv.Atoi(value)
+		if err != nil || offset < 0 {
+			writeError(w, http.StatusBadRequest, "offset must be 0 or more")
+			return
+		}
+	}
+	if value := query.Get("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxSongPage {
+			writeError(w, http.StatusBadRequest, "limit must be between 1 and "+strconv.Itoa(maxSongPage))
+			return
+		}
+	}
+
+	filter := db.SongFilter{Artist: query.Get("artist"), OrderBy: db.SongsByTitle}
+	switch query.Get("sort") {
+	case "", "title":
+	case "ingested":
+		filter.OrderBy = db.SongsByIngestion
+	default:
+		writeError(w, http.StatusBadRequest, "sort must be title or ingested")
+		return
+	}
+	switch query.Get("order") {
+	case "", "asc":
+	case "desc":
+		filter.Descending = true
+	default:
+		writeError(w, http.StatusBadRequest, "order must be asc or desc")
+		return
+	}
+
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		handleAdminError(w, r, "error connecting to DB", err)
+		return
+	}
+	defer dbClient.Close()
+
+	// One more song than asked tells whether there are more
+	client, _ := auth.ClientFromContext(r.Context())
+	listed, err := listVisibleSongs(db.WithContext(r.Context(), dbClient), offset, limit+1, filter, acl.Filter(client))
+	if err != nil {
+		handleAdminError(w, r, "failed to list songs", err)
+		return
+	}
+	more := len(listed) > limit
+	if more {
+		listed = listed[:limit]
+	}
+
+	songs := make([]listedSong, 0, len(listed))
+	for _, song := range listed {
+		entry := listedSong{
+			SongID:      song.ID,
+			Title:       song.Title,
+			Artist:      song.Artist,
+			YouTubeID:   song.YouTubeID,
+			Album:       song.Album,
+			DurationMs:  song.DurationMs,
+			ReleaseYear: song.ReleaseYear,
+			Genre:       song.Genre,
+			CoverArtURL: song.CoverArtURL,
+		}
+		if song.IngestedAtMs > 0 {
+			ingestedAt := time.UnixMilli(song.IngestedAtMs).UTC()
+			entry.IngestedAt = &ingestedAt
+		}
+		songs = append(songs, entry)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"offset": offset,
+		"limit":  limit,
+		"more":   more,
+		"songs":  songs,
+	})
+}
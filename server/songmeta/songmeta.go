@@ -0,0 +1,218 @@
+// Package songmeta stores details of songs beyond their title and artist,
+// such as their duration, read from their audio when they are ingested. Songs
+// ingested before it was recorded get it from the backfill-metadata job. The
+// album, duration, release year, genre and cover art are also stored in the
+// song itself, as db.SongDetails, so that they come with it.
+package songmeta
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"song-recognition/db"
+	"song-recognition/models"
+	"song-recognition/wav"
+	"strconv"
+	"time"
+)
+
+const (
+	metadataCollection = "song_metadata"
+	backfillCollection = "backfills"
+	backfillID         = "metadata"
+)
+
+// Sources of metadata
+const (
+	SourceFile    = "file"    // read from the audio of the song
+	SourceYouTube = "youtube" // looked up with the YouTube Data API
+)
+
+// Metadata describes a song beyond its title and artist.
+type Metadata struct {
+	SongID      models.SongID `json:"songId"`
+	DurationMs  int64         `json:"durationMs"`
+	Album       string        `json:"album,omitempty"`
+	Genre       string        `json:"genre,omitempty"`
+	Year        int           `json:"year,omitempty"`
+	CoverArtURL string        `json:"coverArtUrl,omitempty"`
+	SpotifyID   string        `json:"spotifyId,omitempty"` // of songs downloaded from Spotify
+	ISRC        string        `json:"isrc,omitempty"`      // of songs ingested from feeds
+	Source      string        `json:"source"`
+	UpdatedAt   time.Time     `json:"updatedAt"`
+}
+
+// SongDetails returns the details stored in the song the metadata describes.
+func (m Metadata) SongDetails() db.SongDetails {
+	return db.SongDetails{
+		Album:       m.Album,
+		DurationMs:  m.DurationMs,
+		ReleaseYear: m.Year,
+		Genre:       m.Genre,
+		CoverArtURL: m.CoverArtURL,
+	}
+}
+
+// Get returns the metadata recorded for a song.
+func Get(dbClient db.DBClient, songID models.SongID) (Metadata, bool, error) {
+	var metadata Metadata
+	record, exists, err := dbClient.GetRecord(metadataCollection, fmt.Sprint(songID))
+	if err != nil || !exists {
+		return metadata, exists, err
+	}
+	if err := json.Unmarshal(record.Data, &metadata); err != nil {
+		return metadata, false, fmt.Errorf("failed to unmarshal metadata of song %d: %v", songID, err)
+	}
+	return metadata, true, nil
+}
+
+// Put records the metadata of a song, replacing what was recorded before,
+// and stores its details in the song.
+func Put(dbClient db.DBClient, metadata Metadata) error {
+	metadata.UpdatedAt = time.Now().UTC()
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return fmt.Errorf("failed to marshal song metadata: %v", err)
+	}
+	err = dbClient.PutRecord(metadataCollection, db.Record{
+		ID:        fmt.Sprint(metadata.SongID),
+		CreatedAt: metadata.UpdatedAt,
+		Data:      data,
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := db.SetSongDetails(dbClient, metadata.SongID, metadata.SongDetails()); err != nil {
+		return fmt.Errorf("failed to store the details of song %d: %v", metadata.SongID, err)
+	}
+	return nil
+}
+
+// All returns the metadata recorded for every song, keyed by song ID.
+func All(dbClient db.DBClient) (map[models.SongID]Metadata, error) {
+	records, err := dbClient.ListRecords(metadataCollection, db.RecordFilter{})
+	if err != nil {
+		return nil, err
+	}
+	all := make(map[models.SongID]Metadata, len(records))
+	for _, record := range records {
+		var metadata Metadata
+		if err := json.Unmarshal(record.Data, &metadata); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal metadata of song %s: %v", record.ID, err)
+		}
+		all[metadata.SongID] = metadata
+	}
+	return all, nil
+}
+
+// With returns the metadata with the fields set in details replacing its
+// own, such as the album a feed gives a song over the tags of its audio.
+func (m Metadata) With(details Metadata) Metadata {
+	if details.Album != "" {
+		m.Album = details.Album
+	}
+	if details.Genre != "" {
+		m.Genre = details.Genre
+	}
+	if details.Year != 0 {
+		m.Year = details.Year
+	}
+	if details.CoverArtURL != "" {
+		m.CoverArtURL = details.CoverArtURL
+	}
+	if details.SpotifyID != "" {
+		m.SpotifyID = details.SpotifyID
+	}
+	if details.ISRC != "" {
+		m.ISRC = details.ISRC
+	}
+	return m
+}
+
+// FromFile reads the duration and tags of the audio of a song.
+func FromFile(songID models.SongID, path string) (Metadata, error) {
+	info, err := wav.GetMetadata(path)
+	if err != nil {
+		return Metadata{}, fmt.Errorf("failed to read metadata of %s: %v", path, err)
+	}
+
+	duration, err := strconv.ParseFloat(info.Format.Duration, 64)
+	if err != nil {
+		stream, _ := info.AudioStream()
+		duration, err = strconv.ParseFloat(stream.Duration, 64)
+	}
+	if err != nil || duration <= 0 {
+		return Metadata{}, fmt.Errorf("no duration in the metadata of %s", path)
+	}
+
+	tags := info.Format.Tags
+	return Metadata{
+		SongID:     songID,
+		DurationMs: int64(math.Round(duration * 1000)),
+		Album:      tags["album"],
+		Genre:      tags["genre"],
+		Year:       ParseYear(tags["date"]),
+		Source:     SourceFile,
+	}, nil
+}
+
+// ParseYear returns the year a date such as "2019" or "2019-05-03" starts
+// with, or 0.
+func ParseYear(date string) int {
+	if len(date) < 4 {
+		return 0
+	}
+	year, err := strconv.Atoi(date[:4])
+	if err != nil || year <= 0 {
+		return 0
+	}
+	return year
+}
+
+// Backfill is the progress of a pass of the backfill-metadata job over the
+// songs without metadata. It is saved as the pass goes, so an interrupted
+// pass resumes after the last song it handled.
+type Backfill struct {
+	Cursor      models.SongID `json:"cursor"` // ID of the last song handled, songs are handled in ID order
+	Total       int           `json:"total"`  // songs without metadata when the pass started
+	Done        int           `json:"done"`
+	Updated     int           `json:"updated"`
+	Unavailable int           `json:"unavailable"` // neither audio nor YouTube details were found
+	Failed      int           `json:"failed"`
+	StartedAt   time.Time     `json:"startedAt"`
+	UpdatedAt   time.Time     `json:"updatedAt"`
+	FinishedAt  time.Time     `json:"finishedAt,omitempty"`
+}
+
+// Finished reports whether the pass went over every song.
+func (b Backfill) Finished() bool {
+	return !b.FinishedAt.IsZero()
+}
+
+// ReadBackfill returns the progress of the last backfill pass, zero if none
+// ran yet.
+func ReadBackfill(dbClient db.DBClient) (Backfill, error) {
+	var backfill Backfill
+	record, exists, err := dbClient.GetRecord(backfillCollection, backfillID)
+	if err != nil || !exists {
+		return backfill, err
+	}
+	if err := json.Unmarshal(record.Data, &backfill); err != nil {
+		return backfill, fmt.Errorf("failed to unmarshal metadata backfill: %v", err)
+	}
+	return backfill, nil
+}
+
+// SaveBackfill records the progress of a backfill pass.
+func SaveBackfill(dbClient db.DBClient, backfill Backfill) error {
+	backfill.UpdatedAt = time.Now().UTC()
+	data, err := json.Marshal(backfill)
+	if err != nil {
+		return fmt.Errorf("failed to marshal metadata backfill: %v", err)
+	}
+	return dbClient.PutRecord(backfillCollection, db.Record{
+		ID:        backfillID,
+		CreatedAt: backfill.StartedAt,
+		Data:      data,
+	})
+}
@@ -5,12 +5,18 @@ import (
 	"fmt"
 	"log/slog"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"runtime"
 	"song-recognition/db"
+	"song-recognition/deps"
+	"song-recognition/ingest"
+	"song-recognition/models"
+	"song-recognition/priority"
+	"song-recognition/shadow"
 	"song-recognition/shazam"
+	"song-recognition/songmeta"
 	"song-recognition/utils"
+	"song-recognition/validate"
 	"strings"
 	"sync"
 	"time"
@@ -76,6 +82,33 @@ func DlAlbum(url, savePath string) (int, error) {
 	return totalTracksDownloaded, nil
 }
 
+// DlTracks downloads and saves the given tracks. It is used to retry tracks
+// that failed to be ingested.
+func DlTracks(tracks []Track, savePath string) (int, error) {
+	return dlTrack(tracks, savePath)
+}
+
+func recordTrackFailure(track Track, err error) {
+	if err == nil {
+		err = fmt.Errorf("no YouTube ID found")
+	}
+
+	failure := ingest.Failure{
+		Kind:        ingest.KindTrack,
+		Source:      utils.GenerateSongKey(track.Title, track.Artist),
+		Title:       track.Title,
+		Artist:      track.Artist,
+		Album:       track.Album,
+		Duration:    track.Duration,
+		CoverArtURL: track.CoverArtURL,
+		Error:       err.Error(),
+	}
+	if err := ingest.RecordFailure(failure); err != nil {
+		logger := utils.GetLogger()
+		logger.Error("Failed to record ingestion failure", slog.Any("error", err))
+	}
+}
+
 func dlTrack(tracks []Track, path string) (int, error) {
 	var wg sync.WaitGroup
 	var downloadedTracks []string
@@ -108,6 +141,7 @@ func dlTrack(tracks []Track, path string) (int, error) {
 				Artists:  track.Artists,
 				Duration: track.Duration,
 				Title:    track.Title,
+				ID:       track.ID,
 			}
 
 			// check if song exists
@@ -126,6 +160,15 @@ func dlTrack(tracks []Track, path string) (int, error) {
 			if ytID == "" || err != nil {
 				logMessage := fmt.Sprintf("'%s' by '%s' could not be downloaded", trackCopy.Title, trackCopy.Artist)
 				logger.ErrorContext(ctx, logMessage, slog.Any("error", xerrors.New(err)))
+				recordTrackFailure(track, err)
+				return
+			}
+
+			// Wait for space rather than failing halfway through the download
+			if err := ingest.WaitForSpace(ctx, ingest.MaxPause(), path); err != nil {
+				logMessage := fmt.Sprintf("'%s' by '%s' could not be downloaded", trackCopy.Title, trackCopy.Artist)
+				logger.ErrorContext(ctx, logMessage, slog.Any("error", xerrors.New(err)))
+				recordTrackFailure(track, err)
 				return
 			}
 
@@ -137,16 +180,23 @@ func dlTrack(tracks []Track, path string) (int, error) {
 			if err != nil {
 				logMessage := fmt.Sprintf("'%s' by '%s' could not be downloaded", trackCopy.Title, trackCopy.Artist)
 				logger.ErrorContext(ctx, logMessage, slog.Any("error", xerrors.New(err)))
+				recordTrackFailure(track, err)
 				return
 			}
 
-			err = ProcessAndSaveSong(filePath, trackCopy.Title, trackCopy.Artist, ytID)
+			_, err = saveSong(filePath, trackCopy.Title, trackCopy.Artist, ytID, songmeta.Metadata{Album: trackCopy.Album, SpotifyID: trackCopy.ID, CoverArtURL: trackCopy.CoverArtURL})
 			if err != nil {
 				logMessage := fmt.Sprintf("Failed to process song ('%s' by '%s')", trackCopy.Title, trackCopy.Artist)
 				logger.ErrorContext(ctx, logMessage, slog.Any("error", xerrors.New(err)))
+				recordTrackFailure(track, err)
 				return
 			}
 
+			failureID := ingest.FailureID(ingest.KindTrack, utils.GenerateSongKey(track.Title, track.Artist))
+			if err := ingest.ResolveFailure(failureID); err != nil {
+				logger.ErrorContext(ctx, "Failed to resolve ingestion failure", slog.Any("error", xerrors.New(err)))
+			}
+
 			wavFilePath := filepath.Join(path, fileName+".wav")
 
 			if err := addTags(wavFilePath, *trackCopy); err != nil {
@@ -191,8 +241,7 @@ func addTags(file string, track Track) error {
 	}
 
 	// FFmpeg command to add metadata tags
-	cmd := exec.Command(
-		"ffmpeg",
+	cmd, err := deps.Command(deps.FFmpeg, "tagging downloads",
 		"-i", file, // Input file path
 		"-c", "copy",
 		"-metadata", fmt.Sprintf("album_artist=%s", track.Artist),
@@ -201,6 +250,9 @@ func addTags(file string, track Track) error {
 		"-metadata", fmt.Sprintf("album=%s", track.Album),
 		tempFile, // Output file path (temporary)
 	)
+	if err != nil {
+		return err
+	}
 
 	out, err := cmd.CombinedOutput()
 	if err != nil {
@@ -217,37 +269,130 @@ func addTags(file string, track Track) error {
 	return nil
 }
 
+// ProcessAndSaveSong fingerprints a song and saves it. If the database is
+// unreachable, ingestion pauses until it answers again and the song is
+// retried, instead of failing.
 func ProcessAndSaveSong(songFilePath, songTitle, songArtist, ytID string) error {
+	_, err := saveSong(songFilePath, songTitle, songArtist, ytID, songmeta.Metadata{})
+	return err
+}
+
+// SaveSongWithDetails is ProcessAndSaveSong for songs known from elsewhere
+// than their audio, such as the rows of a feed, and returns the ID of the
+// song. The details are recorded with its metadata, over its tags.
+func SaveSongWithDetails(songFilePath, songTitle, songArtist, ytID string, details songmeta.Metadata) (models.SongID, error) {
+	return saveSong(songFilePath, songTitle, songArtist, ytID, details)
+}
+
+// saveSong is SaveSongWithDetails, which songs downloaded from Spotify use to
+// record their Spotify ID.
+func saveSong(songFilePath, songTitle, songArtist, ytID string, details songmeta.Metadata) (models.SongID, error) {
+	logger := utils.GetLogger()
+	if err := validate.Song(songTitle, songArtist).Err(); err != nil {
+		return 0, fmt.Errorf("invalid song: %v", err)
+	}
+
+	for {
+		songID, err := processAndSaveSong(songFilePath, songTitle, songArtist, ytID, details)
+		if err == nil || db.Probe() == nil {
+			return songID, err
+		}
+
+		logger.Warn(fmt.Sprintf("Database unavailable, pausing ingestion of %v by %v", songTitle, songArtist), slog.Any("error", err))
+		if !db.WaitAvailable(ingest.MaxPause()) {
+			return 0, fmt.Errorf("%v (database still unavailable after %v)", err, ingest.MaxPause())
+		}
+		logger.Info(fmt.Sprintf("Database available again, resuming ingestion of %v by %v", songTitle, songArtist))
+
+		// Undo what the failed attempt managed to store before retrying
+		if songID != 0 {
+			if err := removeSong(songID); err != nil {
+				return 0, fmt.Errorf("error removing partially saved song: %v", err)
+			}
+		}
+	}
+}
+
+// processAndSaveSong registers, fingerprints and stores a song, and returns
+// its ID. On failure it returns the ID of the song if it was registered and
+// couldn't be removed.
+func processAndSaveSong(songFilePath, songTitle, songArtist, ytID string, details songmeta.Metadata) (models.SongID, error) {
 	logger := utils.GetLogger()
 	dbclient, err := db.NewDBClient()
 	if err != nil {
 		logger.Error("Failed to create DB client", slog.Any("error", err))
-		return err
+		return 0, err
 	}
 	defer dbclient.Close()
 
+	// Ingestion yields to interactive recognitions
+	release, err := priority.Acquire(context.Background(), priority.Background)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+
 	songID, err := dbclient.RegisterSong(songTitle, songArtist, ytID)
 	if err != nil {
 		logger.Error("Failed to register song", slog.Any("error", err))
-		return fmt.Errorf("error registering song '%s' by '%s': %v", songTitle, songArtist, err)
+		return 0, fmt.Errorf("error registering song '%s' by '%s': %v", songTitle, songArtist, err)
 	}
 
 	fingerprint, err := shazam.FingerprintAudio(songFilePath, songID)
 	if err != nil {
-		dbclient.DeleteSongByID(songID)
+		if dbclient.DeleteSongByID(songID) == nil {
+			songID = 0
+		}
 		logger.Error("Failed to create fingerprint", slog.String("wavFilePath", songFilePath))
-		return fmt.Errorf("error generating fingerprint for %s by %s", songTitle, songArtist)
+		return songID, fmt.Errorf("error generating fingerprint for %s by %s", songTitle, songArtist)
 	}
 
 	err = dbclient.StoreFingerprints(fingerprint)
 	if err != nil {
-		dbclient.DeleteSongByID(songID)
+		if dbclient.DeleteSongByID(songID) == nil {
+			songID = 0
+		}
 		logger.Error("Failed to store fingerprints", slog.Any("error", err))
-		return fmt.Errorf("error storing fingerprint: %v", err)
+		return songID, fmt.Errorf("error storing fingerprint: %v", err)
+	}
+	if err := shazam.RecordIndexConfig(dbclient, songID); err != nil {
+		logger.Error("Failed to record the fingerprint parameters of the song", slog.Any("error", err))
+	}
+	if err := db.RecordFingerprintChecksum(dbclient, songID, db.ChecksumFingerprints(fingerprint)[songID]); err != nil {
+		logger.Error("Failed to record the fingerprint checksum of the song", slog.Any("error", err))
+	}
+	metadata, err := songmeta.FromFile(songID, songFilePath)
+	if err == nil {
+		err = songmeta.Put(dbclient, metadata.With(details))
+	}
+	if err != nil {
+		logger.Error("Failed to record the metadata of the song", slog.Any("error", err))
+	}
+	if shadow.Enabled() {
+		song := db.Song{Title: songTitle, Artist: songArtist, YouTubeID: ytID}
+		if _, err := shadow.Index(songID, song, songFilePath); err != nil {
+			logger.Error("Failed to add the song to the shadow index", slog.Any("error", err))
+		}
 	}
 
 	logger.Info(fmt.Sprintf("Fingerprint for %v by %v saved in DB successfully", songTitle, songArtist))
-	return nil
+	return songID, nil
+}
+
+// removeSong deletes a song, which deletes its fingerprints too.
+func removeSong(songID models.SongID) error {
+	dbclient, err := db.NewDBClient()
+	if err != nil {
+		return err
+	}
+	defer dbclient.Close()
+
+	if shadow.Enabled() {
+		if err := shadow.Remove(songID); err != nil {
+			return err
+		}
+	}
+	return dbclient.DeleteSongByID(songID)
 }
 
 func getYTID(trackCopy *Track) (string, error) {
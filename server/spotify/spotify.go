@@ -13,6 +13,7 @@ import (
 	"strings"
 	"time"
 	"os"
+	"song-recognition/breaker"
 	"song-recognition/utils"
 
 	"github.com/tidwall/gjson"
@@ -27,6 +28,22 @@ type Track struct {
 	Title, Artist, Album string
 	Artists              []string
 	Duration             int
+	ID                   string // on Spotify, empty if unknown
+	CoverArtURL          string // of the album on Spotify, empty if unknown
+}
+
+// spotifyImage is an image of an album, in the Web API.
+type spotifyImage struct {
+	URL string `json:"url"`
+}
+
+// coverArtURL returns the URL of the first image of an album, which the Web
+// API lists largest first.
+func coverArtURL(images []spotifyImage) string {
+	if len(images) == 0 {
+		return ""
+	}
+	return images[0].URL
 }
 
 const (
@@ -152,18 +169,30 @@ func request(endpoint string) (int, string, error) {
 	}
 	req.Header.Add("Authorization", "Bearer "+bearer)
 
-	resp, err := (&http.Client{}).Do(req)
-	if err != nil {
-		return 0, "", fmt.Errorf("error on getting response: %w", err)
-	}
-	defer resp.Body.Close()
+	var statusCode int
+	var body []byte
+	err = breaker.Do(breaker.Spotify, func() error {
+		resp, err := (&http.Client{}).Do(req)
+		if err != nil {
+			return fmt.Errorf("error on getting response: %w", err)
+		}
+		defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
+		body, err = io.ReadAll(resp.Body)
+		if err != nil {
+			return fmt.Errorf("error on reading response: %w", err)
+		}
+		statusCode = resp.StatusCode
+		if statusCode >= http.StatusInternalServerError || statusCode == http.StatusTooManyRequests {
+			return fmt.Errorf("spotify answered %s", resp.Status)
+		}
+		return nil
+	})
 	if err != nil {
-		return 0, "", fmt.Errorf("error on reading response: %w", err)
+		return 0, "", err
 	}
 
-	return resp.StatusCode, string(body), nil
+	return statusCode, string(body), nil
 }
 
 func getID(url string) string {
@@ -198,7 +227,8 @@ func TrackInfo(url string) (*Track, error) {
 		Name     string `json:"name"`
 		Duration int    `json:"duration_ms"`
 		Album    struct {
-			Name string `json:"name"`
+			Name   string         `json:"name"`
+			Images []spotifyImage `json:"images"`
 		} `json:"album"`
 		Artists []struct {
 			Name string `json:"name"`
@@ -214,11 +244,13 @@ func TrackInfo(url string) (*Track, error) {
 	}
 
 	return (&Track{
-		Title:    result.Name,
-		Artist:   allArtists[0],
-		Artists:  allArtists,
-		Album:    result.Album.Name,
-		Duration: result.Duration / 1000,
+		Title:       result.Name,
+		Artist:      allArtists[0],
+		Artists:     allArtists,
+		Album:       result.Album.Name,
+		Duration:    result.Duration / 1000,
+		ID:          id,
+		CoverArtURL: coverArtURL(result.Album.Images),
 	}).buildTrack(), nil
 }
 
@@ -251,7 +283,8 @@ func PlaylistInfo(url string) ([]Track, error) {
 					Name     string `json:"name"`
 					Duration int    `json:"duration_ms"`
 					Album    struct {
-						Name string `json:"name"`
+						Name   string         `json:"name"`
+						Images []spotifyImage `json:"images"`
 					} `json:"album"`
 					Artists []struct {
 						Name string `json:"name"`
@@ -271,11 +304,12 @@ func PlaylistInfo(url string) ([]Track, error) {
 				artists = append(artists, a.Name)
 			}
 			allTracks = append(allTracks, *(&Track{
-				Title:    track.Name,
-				Artist:   artists[0],
-				Artists:  artists,
-				Duration: track.Duration / 1000,
-				Album:    track.Album.Name,
+				Title:       track.Name,
+				Artist:      artists[0],
+				Artists:     artists,
+				Duration:    track.Duration / 1000,
+				Album:       track.Album.Name,
+				CoverArtURL: coverArtURL(track.Album.Images),
 			}).buildTrack())
 		}
 
@@ -400,11 +434,13 @@ func jsonList(resourceType, id string, offset, limit int64) (string, error) {
 
 func (t *Track) buildTrack() *Track {
 	track := &Track{
-		Title:    t.Title,
-		Artist:   t.Artist,
-		Artists:  t.Artists,
-		Duration: t.Duration,
-		Album:    t.Album,
+		Title:       t.Title,
+		Artist:      t.Artist,
+		Artists:     t.Artists,
+		Duration:    t.Duration,
+		Album:       t.Album,
+		ID:          t.ID,
+		CoverArtURL: t.CoverArtURL,
 	}
 
 	return track
@@ -421,6 +457,8 @@ func proccessItems(jsonResponse, resourceType string) []Track {
 	artistName := map[bool]string{true: "itemV2.data.artists.items.0.profile.name", false: "track.artists.items.0.profile.name"}[resourceType == "playlist"]
 	albumName := map[bool]string{true: "itemV2.data.albumOfTrack.name", false: "data.albumUnion.name"}[resourceType == "playlist"]
 	duration := map[bool]string{true: "itemV2.data.trackDuration.totalMilliseconds", false: "track.duration.totalMilliseconds"}[resourceType == "playlist"]
+	uri := map[bool]string{true: "itemV2.data.uri", false: "track.uri"}[resourceType == "playlist"]
+	coverArt := map[bool]string{true: "itemV2.data.albumOfTrack.coverArt.sources.0.url", false: "data.albumUnion.coverArt.sources.0.url"}[resourceType == "playlist"]
 
 	var tracks []Track
 	items := gjson.Get(jsonResponse, itemList).Array()
@@ -429,10 +467,12 @@ func proccessItems(jsonResponse, resourceType string) []Track {
 		durationInSeconds := int(item.Get(duration).Int()) / 1000
 
 		track := &Track{
-			Title:    item.Get(songTitle).String(),
-			Artist:   item.Get(artistName).String(),
-			Duration: durationInSeconds,
-			Album:    map[bool]string{true: item.Get(albumName).String(), false: gjson.Get(jsonResponse, albumName).String()}[resourceType == "playlist"],
+			Title:       item.Get(songTitle).String(),
+			Artist:      item.Get(artistName).String(),
+			Duration:    durationInSeconds,
+			Album:       map[bool]string{true: item.Get(albumName).String(), false: gjson.Get(jsonResponse, albumName).String()}[resourceType == "playlist"],
+			ID:          strings.TrimPrefix(item.Get(uri).String(), "spotify:track:"),
+			CoverArtURL: map[bool]string{true: item.Get(coverArt).String(), false: gjson.Get(jsonResponse, coverArt).String()}[resourceType == "playlist"],
 		}
 		tracks = append(tracks, *track.buildTrack())
 	}
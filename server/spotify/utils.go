@@ -5,10 +5,10 @@ import (
 	"io/ioutil"
 	"net/url"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"runtime"
 	"song-recognition/db"
+	"song-recognition/deps"
 	"strings"
 )
 
@@ -69,6 +69,13 @@ func YtIDExists(ytID string) (bool, error) {
 	return songExits, nil
 }
 
+// SongFileName returns the name, without extension, the audio of a song is
+// saved under in SONGS_DIR.
+func SongFileName(title, artist string) string {
+	title, artist = correctFilename(title, artist)
+	return fmt.Sprintf("%s - %s", title, artist)
+}
+
 /* fixes some invalid file names (windows is the capricious one) */
 func correctFilename(title, artist string) (string, string) {
 	if runtime.GOOS == "windows" {
@@ -91,7 +98,10 @@ func convertStereoToMono(stereoFilePath string) ([]byte, error) {
 	defer os.Remove(monoFilePath)
 
 	// Check the number of channels in the stereo audio
-	cmd := exec.Command("ffprobe", "-v", "error", "-show_entries", "stream=channels", "-of", "default=noprint_wrappers=1:nokey=1", stereoFilePath)
+	cmd, err := deps.Command(deps.FFprobe, "counting channels", "-v", "error", "-show_entries", "stream=channels", "-of", "default=noprint_wrappers=1:nokey=1", stereoFilePath)
+	if err != nil {
+		return nil, err
+	}
 	output, err := cmd.CombinedOutput()
 	if err != nil {
 		return nil, fmt.Errorf("error getting number of channels: %v, %v", err, string(output))
@@ -105,8 +115,11 @@ func convertStereoToMono(stereoFilePath string) ([]byte, error) {
 
 	if channels != "1" {
 		// Convert stereo to mono and downsample by 44100/2
-		cmd = exec.Command("ffmpeg", "-i", stereoFilePath, "-af", "pan=mono|c0=c0", monoFilePath)
+		cmd, err = deps.Command(deps.FFmpeg, "converting stereo to mono", "-i", stereoFilePath, "-af", "pan=mono|c0=c0", monoFilePath)
 		// cmd = exec.Command("ffmpeg", "-i", stereoFilePath, "-af", "pan=mono|c0=c0", "-ar", "22050", monoFilePath)
+		if err != nil {
+			return nil, err
+		}
 		if err := cmd.Run(); err != nil {
 			return nil, fmt.Errorf("error converting stereo to mono: %v", err)
 		}
@@ -6,19 +6,25 @@ import (
 	"log"
 	"log/slog"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"song-recognition/breaker"
+	"song-recognition/deps"
 	"song-recognition/utils"
 
+	"encoding/json"
 	"errors"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/buger/jsonparser"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/option"
 	"google.golang.org/api/youtube/v3"
 )
@@ -52,6 +58,160 @@ func getYoutubeIdWithAPI(spTrack Track) (string, error) {
 	return "", nil
 }
 
+// ErrNoYouTubeAPIKey is returned by lookups needing the YouTube Data API
+// when YOUTUBE_API_KEY isn't set.
+var ErrNoYouTubeAPIKey = errors.New("YOUTUBE_API_KEY is not set")
+
+// Video describes a YouTube video as reported by the YouTube Data API.
+type Video struct {
+	ID        string
+	Title     string
+	Channel   string
+	Duration  time.Duration
+	Published time.Time
+	Playable  bool     // public or unlisted, and processed
+	Blocked   []string // regions the video can't be watched in
+	Allowed   []string // when not empty, the only regions it can be watched in
+	Thumbnail string   // URL of its largest thumbnail
+}
+
+// BlockedIn reports whether the video can't be watched in a region, given as
+// an ISO 3166-1 alpha-2 code.
+func (v Video) BlockedIn(region string) bool {
+	if len(v.Allowed) > 0 && !slices.Contains(v.Allowed, region) {
+		return true
+	}
+	return slices.Contains(v.Blocked, region)
+}
+
+// GetVideo looks a video up with the YouTube Data API, returning false if it
+// doesn't exist or isn't public.
+func GetVideo(ctx context.Context, ytID string) (Video, bool, error) {
+	key := utils.GetEnv("YOUTUBE_API_KEY", developerKey)
+	if key == "" {
+		return Video{}, false, ErrNoYouTubeAPIKey
+	}
+	service, err := youtube.NewService(ctx, option.WithAPIKey(key))
+	if err != nil {
+		return Video{}, false, fmt.Errorf("failed to create YouTube client: %v", err)
+	}
+
+	var response *youtube.VideoListResponse
+	err = breaker.Do(breaker.YouTube, func() error {
+		response, err = service.Videos.List([]string{"snippet", "contentDetails", "status"}).Id(ytID).Context(ctx).Do()
+		var apiErr *googleapi.Error
+		if errors.As(err, &apiErr) && (apiErr.Code == http.StatusBadRequest || apiErr.Code == http.StatusNotFound) {
+			return breaker.Ignore(err)
+		}
+		return err
+	})
+	if err != nil {
+		return Video{}, false, fmt.Errorf("failed to look up YouTube video %s: %v", ytID, err)
+	}
+	if len(response.Items) == 0 {
+		return Video{}, false, nil
+	}
+
+	item := response.Items[0]
+	video := Video{ID: item.Id}
+	if item.Snippet != nil {
+		video.Title, video.Channel = item.Snippet.Title, item.Snippet.ChannelTitle
+		video.Published, _ = time.Parse(time.RFC3339, item.Snippet.PublishedAt)
+		if thumbnails := item.Snippet.Thumbnails; thumbnails != nil {
+			for _, thumbnail := range []*youtube.Thumbnail{thumbnails.Maxres, thumbnails.Standard, thumbnails.High, thumbnails.Medium, thumbnails.Default} {
+				if thumbnail != nil && thumbnail.Url != "" {
+					video.Thumbnail = thumbnail.Url
+					break
+				}
+			}
+		}
+	}
+	if item.ContentDetails != nil {
+		video.Duration = parseISODuration(item.ContentDetails.Duration)
+		if restriction := item.ContentDetails.RegionRestriction; restriction != nil {
+			video.Blocked, video.Allowed = restriction.Blocked, restriction.Allowed
+		}
+	}
+	if item.Status != nil {
+		video.Playable = item.Status.PrivacyStatus != "private" && item.Status.UploadStatus == "processed"
+	}
+	return video, true, nil
+}
+
+// oEmbedURL answers the title and channel of public videos without an API
+// key.
+const oEmbedURL = "https://www.youtube.com/oembed"
+
+// CheckVideo looks a video up like GetVideo, or with YouTube's oEmbed
+// endpoint when YOUTUBE_API_KEY isn't set. oEmbed only tells whether the
+// video can be played, its title and its channel.
+func CheckVideo(ctx context.Context, ytID string) (Video, bool, error) {
+	video, exists, err := GetVideo(ctx, ytID)
+	if !errors.Is(err, ErrNoYouTubeAPIKey) {
+		return video, exists, err
+	}
+
+	query := url.Values{}
+	query.Set("url", "https://www.youtube.com/watch?v="+ytID)
+	query.Set("format", "json")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, oEmbedURL+"?"+query.Encode(), nil)
+	if err != nil {
+		return Video{}, false, err
+	}
+	var resp *http.Response
+	err = breaker.Do(breaker.YouTube, func() error {
+		resp, err = httpClient.Do(req)
+		if err != nil {
+			return fmt.Errorf("failed to look up YouTube video %s: %v", ytID, err)
+		}
+		if resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusTooManyRequests {
+			resp.Body.Close()
+			return fmt.Errorf("failed to look up YouTube video %s: %s", ytID, resp.Status)
+		}
+		return nil
+	})
+	if err != nil {
+		return Video{}, false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized, http.StatusForbidden: // private, or not embeddable
+		return Video{ID: ytID}, true, nil
+	case http.StatusNotFound, http.StatusBadRequest:
+		return Video{}, false, nil
+	default:
+		return Video{}, false, fmt.Errorf("failed to look up YouTube video %s: %s", ytID, resp.Status)
+	}
+
+	var details struct {
+		Title  string `json:"title"`
+		Author string `json:"author_name"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&details); err != nil {
+		return Video{}, false, fmt.Errorf("failed to decode YouTube video %s: %v", ytID, err)
+	}
+	return Video{ID: ytID, Title: details.Title, Channel: details.Author, Playable: true}, true, nil
+}
+
+var isoDurationPattern = regexp.MustCompile(`^P(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+)S)?)?$`)
+
+// parseISODuration parses the ISO 8601 durations of the YouTube Data API,
+// such as PT3M45S, returning 0 for others.
+func parseISODuration(value string) time.Duration {
+	parts := isoDurationPattern.FindStringSubmatch(value)
+	if parts == nil {
+		return 0
+	}
+	var duration time.Duration
+	for i, unit := range []time.Duration{24 * time.Hour, time.Hour, time.Minute, time.Second} {
+		n, _ := strconv.Atoi(parts[i+1])
+		duration += time.Duration(n) * unit
+	}
+	return duration
+}
+
 var httpClient = &http.Client{}
 var durationMatchThreshold = 5
 
@@ -115,7 +275,16 @@ func getContent(data []byte, index int) []byte {
 	return contents
 }
 
+// ytSearch searches YouTube, unless it has been failing.
 func ytSearch(searchTerm string, limit int) (results []*SearchResult, err error) {
+	err = breaker.Do(breaker.YouTube, func() error {
+		results, err = searchYouTube(searchTerm, limit)
+		return err
+	})
+	return results, err
+}
+
+func searchYouTube(searchTerm string, limit int) (results []*SearchResult, err error) {
 	ytSearchUrl := fmt.Sprintf(
 		"https://www.youtube.com/results?search_query=%s", url.QueryEscape(searchTerm),
 	)
@@ -231,26 +400,46 @@ func downloadYTaudio(videoURL, outputFilePath string) (string, error) {
 		return "", errors.New("output directory does not exist or is not a directory")
 	}
 
-	_, err := exec.LookPath("yt-dlp")
-	if err != nil {
-		logger.Error("yt-dlp not found in PATH", slog.Any("error", err))
-		return "", errors.New("yt-dlp is not installed or not in PATH")
+	if err := deps.Require(deps.YtDlp); err != nil {
+		logger.Error("yt-dlp is unavailable", slog.Any("error", err))
+		return "", err
 	}
 
 	audioFmt := "wav"
-	cmd := exec.Command(
-		"yt-dlp",
+	cmd, err := deps.Command(deps.YtDlp, "downloading from YouTube",
 		"-f", "bestaudio",
 		"--extract-audio",
 		"--audio-format", audioFmt,
 		"-o", outputFilePath,
 		videoURL,
 	)
+	if err != nil {
+		return "", err
+	}
 
-	output, err := cmd.CombinedOutput()
+	err = breaker.Do(breaker.YtDlp, func() error {
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			logger.Error("yt-dlp command failed", slog.String("output", string(output)), slog.Any("error", err))
+			if videoUnavailable(string(output)) {
+				return breaker.Ignore(err)
+			}
+		}
+		return err
+	})
 	if err != nil {
-		logger.Error("yt-dlp command failed", slog.String("output", string(output)), slog.Any("error", err))
 		return "", err
 	}
 	return outputFilePath + "." + audioFmt, nil
 }
+
+// videoUnavailable reports whether yt-dlp failed because of the video
+// itself rather than YouTube or yt-dlp being down.
+func videoUnavailable(output string) bool {
+	for _, reason := range []string{"Video unavailable", "Private video", "This video is not available", "Sign in to confirm your age"} {
+		if strings.Contains(output, reason) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,61 @@
+// Package timefmt formats offsets and durations for people, as m:ss or
+// h:mm:ss, so client apps don't each have to format the milliseconds of
+// results.
+package timefmt
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// periodSeparated lists the languages separating hours, minutes and seconds
+// with a period rather than a colon.
+var periodSeparated = map[string]bool{
+	"da": true,
+	"fi": true,
+}
+
+var localePattern = regexp.MustCompile(`^[A-Za-z]{2,3}(-[A-Za-z0-9]{1,8})*$`)
+
+// Formatter formats times for a locale.
+type Formatter struct {
+	separator string
+}
+
+// ForLocale returns the formatter of a locale, a language tag such as
+// "en-US" or "fi". Unknown and empty locales get colons.
+func ForLocale(locale string) Formatter {
+	language, _, _ := strings.Cut(strings.ToLower(locale), "-")
+	if periodSeparated[language] {
+		return Formatter{separator: "."}
+	}
+	return Formatter{separator: ":"}
+}
+
+// ValidLocale reports whether locale looks like a language tag.
+func ValidLocale(locale string) bool {
+	return localePattern.MatchString(locale)
+}
+
+// PreferredLocale returns the first language of an Accept-Language header,
+// or an empty string.
+func PreferredLocale(acceptLanguage string) string {
+	first, _, _ := strings.Cut(acceptLanguage, ",")
+	locale, _, _ := strings.Cut(first, ";")
+	locale = strings.TrimSpace(locale)
+	if !ValidLocale(locale) {
+		return ""
+	}
+	return locale
+}
+
+// Format writes a time in milliseconds as m:ss, or h:mm:ss from an hour on,
+// rounded down to the second.
+func (f Formatter) Format(ms int64) string {
+	seconds := max(ms, 0) / 1000
+	if seconds >= 3600 {
+		return fmt.Sprintf("%d%s%02d%s%02d", seconds/3600, f.separator, seconds/60%60, f.separator, seconds%60)
+	}
+	return fmt.Sprintf("%d%s%02d", seconds/60, f.separator, seconds%60)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"song-recognition/utils"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const (
+	defaultCertKey  = "/etc/letsencrypt/live/localport.online/privkey.pem"
+	defaultCertFile = "/etc/letsencrypt/live/localport.online/fullchain.pem"
+)
+
+// serverTLS returns the TLS configuration of the HTTPS server, and the
+// handler the plain HTTP listener of TLS_HTTP_PORT should serve, if any.
+//
+// With TLS_AUTOCERT_DOMAINS (comma separated), certificates for those domains
+// are obtained from Let's Encrypt, or the ACME directory of
+// TLS_AUTOCERT_DIRECTORY, and renewed automatically. They are kept in
+// TLS_AUTOCERT_CACHE (default "certs") so restarts don't request new ones.
+// Otherwise the certificate of CERT_FILE and CERT_KEY is used, and read again
+// when the files change, as they do when certbot renews it.
+func serverTLS() (*tls.Config, http.Handler, error) {
+	var domains []string
+	for _, domain := range strings.Split(utils.GetEnv("TLS_AUTOCERT_DOMAINS"), ",") {
+		if domain = strings.TrimSpace(domain); domain != "" {
+			domains = append(domains, domain)
+		}
+	}
+
+	if len(domains) == 0 {
+		certs, err := newCertReloader(utils.GetEnv("CERT_FILE", defaultCertFile), utils.GetEnv("CERT_KEY", defaultCertKey))
+		if err != nil {
+			return nil, nil, err
+		}
+		config := &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: certs.getCertificate,
+		}
+		return config, http.HandlerFunc(redirectToHTTPS), nil
+	}
+
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(domains...),
+		Cache:      autocert.DirCache(utils.GetEnv("TLS_AUTOCERT_CACHE", "certs")),
+		Email:      utils.GetEnv("TLS_AUTOCERT_EMAIL"),
+	}
+	if directory := utils.GetEnv("TLS_AUTOCERT_DIRECTORY"); directory != "" {
+		manager.Client = &acme.Client{DirectoryURL: directory}
+	}
+	config := manager.TLSConfig()
+	config.MinVersion = tls.VersionTLS12
+	// Answers HTTP-01 challenges, in case TLS-ALPN-01 ones can't reach the
+	// server, and redirects everything else
+	return config, manager.HTTPHandler(http.HandlerFunc(redirectToHTTPS)), nil
+}
+
+// redirectToHTTPS sends plain HTTP clients to the same URL over HTTPS, on
+// the port of the HTTPS server.
+func redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	if port := utils.GetEnv("TLS_PUBLIC_PORT", "443"); port != "443" {
+		host = net.JoinHostPort(host, port)
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+}
+
+// serveHTTPRedirects serves handler over plain HTTP on TLS_HTTP_PORT, when
+// set, next to the HTTPS server.
+func serveHTTPRedirects(handler http.Handler) {
+	port := utils.GetEnv("TLS_HTTP_PORT")
+	if port == "" {
+		return
+	}
+
+	server := &http.Server{
+		Addr:              ":" + port,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		log.Printf("Redirecting HTTP on port %v to HTTPS", port)
+		if err := server.ListenAndServe(); err != nil {
+			log.Fatalf("HTTP redirect server ListenAndServe: %v", err)
+		}
+	}()
+}
+
+// certReloader serves a certificate from files, reading them again once
+// they are modified.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("missing CERT_FILE or CERT_KEY")
+	}
+	reloader := &certReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := reloader.load(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+func (c *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert, err := c.load()
+	if err != nil && cert != nil {
+		// Keep serving the previous certificate while the files are being replaced
+		log.Printf("failed to reload certificate, keeping the previous one: %v\n", err)
+		return cert, nil
+	}
+	return cert, err
+}
+
+// load returns the certificate, read again if its files changed since it
+// was last read.
+func (c *certReloader) load() (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	modTime, err := c.lastModified()
+	if err != nil {
+		return c.cert, err
+	}
+	if c.cert != nil && !modTime.After(c.modTime) {
+		return c.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return c.cert, fmt.Errorf("failed to load certificate %s: %v", c.certFile, err)
+	}
+	c.cert, c.modTime = &cert, modTime
+	return c.cert, nil
+}
+
+func (c *certReloader) lastModified() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return latest, fmt.Errorf("failed to read certificate: %v", err)
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
@@ -0,0 +1,182 @@
+// Package tracklist renders the chapters identified in a long recording,
+// such as a DJ set, in formats tracklists are pasted as.
+package tracklist
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"song-recognition/shazam"
+	"sort"
+	"strings"
+)
+
+// Tracklist is what was identified in a recording.
+type Tracklist struct {
+	Title      string           `json:"title,omitempty"`
+	File       string           `json:"file,omitempty"` // name of the recording
+	DurationMs int64            `json:"durationMs"`
+	Chapters   []shazam.Chapter `json:"chapters"`
+}
+
+// Exporter renders a tracklist in some format.
+type Exporter struct {
+	ContentType string
+	Write       func(w io.Writer, tracklist Tracklist) error
+}
+
+var exporters = map[string]Exporter{
+	"json":    {ContentType: "application/json", Write: writeJSON},
+	"cue":     {ContentType: "application/x-cue; charset=utf-8", Write: writeCUE},
+	"youtube": {ContentType: "text/plain; charset=utf-8", Write: writeYouTube},
+	"podcast": {ContentType: "application/json+chapters", Write: writePodcast},
+}
+
+// Formats returns the names of the formats tracklists can be exported as.
+func Formats() []string {
+	names := make([]string, 0, len(exporters))
+	for name := range exporters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Lookup returns the exporter of a format.
+func Lookup(format string) (Exporter, error) {
+	exporter, ok := exporters[format]
+	if !ok {
+		return Exporter{}, fmt.Errorf("unknown format %q (available: %s)", format, strings.Join(Formats(), ", "))
+	}
+	return exporter, nil
+}
+
+func writeJSON(w io.Writer, tracklist Tracklist) error {
+	if tracklist.Chapters == nil {
+		tracklist.Chapters = []shazam.Chapter{}
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(tracklist)
+}
+
+// cueFileTypes are the CUE file types of recordings by extension; the rest
+// are declared as MP3, which players treat as any compressed audio.
+var cueFileTypes = map[string]string{
+	".wav":  "WAVE",
+	".aif":  "AIFF",
+	".aiff": "AIFF",
+}
+
+// writeCUE renders the tracklist as a CUE sheet with a track per chapter.
+func writeCUE(w io.Writer, tracklist Tracklist) error {
+	var b strings.Builder
+	if tracklist.Title != "" {
+		fmt.Fprintf(&b, "TITLE %s\n", cueQuote(tracklist.Title))
+	}
+	file := tracklist.File
+	if file == "" {
+		file = "recording.wav"
+	}
+	fileType, ok := cueFileTypes[strings.ToLower(filepath.Ext(file))]
+	if !ok {
+		fileType = "MP3"
+	}
+	fmt.Fprintf(&b, "FILE %s %s\n", cueQuote(filepath.Base(file)), fileType)
+
+	for i, chapter := range tracklist.Chapters {
+		fmt.Fprintf(&b, "  TRACK %02d AUDIO\n", i+1)
+		fmt.Fprintf(&b, "    TITLE %s\n", cueQuote(chapter.SongTitle))
+		fmt.Fprintf(&b, "    PERFORMER %s\n", cueQuote(chapter.SongArtist))
+		fmt.Fprintf(&b, "    INDEX 01 %s\n", cueTime(chapter.StartMs))
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// cueQuote quotes a CUE string. The format has no escapes, so double quotes
+// become single ones.
+func cueQuote(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, "'") + `"`
+}
+
+// cueTime formats a time as CUE mm:ss:ff, with 75 frames per second.
+func cueTime(ms int64) string {
+	frames := ms * 75 / 1000
+	return fmt.Sprintf("%02d:%02d:%02d", frames/75/60, frames/75%60, frames%75)
+}
+
+// chapterTitle is how a chapter is named where titles are free text.
+func chapterTitle(chapter shazam.Chapter) string {
+	if chapter.SongArtist == "" {
+		return chapter.SongTitle
+	}
+	return chapter.SongArtist + " - " + chapter.SongTitle
+}
+
+// writeYouTube renders the tracklist as YouTube chapters, to paste in a video
+// description. YouTube requires the first chapter to start at 0:00, so audio
+// before the first identified track becomes an "Intro" chapter.
+func writeYouTube(w io.Writer, tracklist Tracklist) error {
+	hours := tracklist.DurationMs >= 3600*1000
+	var b strings.Builder
+	if len(tracklist.Chapters) > 0 && tracklist.Chapters[0].StartMs >= 1000 {
+		fmt.Fprintf(&b, "%s Intro\n", youTubeTime(0, hours))
+	}
+	for i, chapter := range tracklist.Chapters {
+		start := chapter.StartMs
+		if i == 0 && start < 1000 {
+			start = 0
+		}
+		fmt.Fprintf(&b, "%s %s\n", youTubeTime(start, hours), chapterTitle(chapter))
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// youTubeTime formats a time as m:ss, or h:mm:ss in videos of an hour or
+// more.
+func youTubeTime(ms int64, hours bool) string {
+	seconds := ms / 1000
+	if hours {
+		return fmt.Sprintf("%d:%02d:%02d", seconds/3600, seconds/60%60, seconds%60)
+	}
+	return fmt.Sprintf("%d:%02d", seconds/60, seconds%60)
+}
+
+// podcastChapters is the JSON chapters format of Podcasting 2.0
+// (podcast:chapters), with times in seconds.
+type podcastChapters struct {
+	Version  string           `json:"version"`
+	Title    string           `json:"title,omitempty"`
+	Chapters []podcastChapter `json:"chapters"`
+}
+
+type podcastChapter struct {
+	StartTime float64 `json:"startTime"`
+	EndTime   float64 `json:"endTime,omitempty"`
+	Title     string  `json:"title"`
+	URL       string  `json:"url,omitempty"`
+}
+
+func writePodcast(w io.Writer, tracklist Tracklist) error {
+	chapters := podcastChapters{Version: "1.2.0", Title: tracklist.Title, Chapters: []podcastChapter{}}
+	for _, chapter := range tracklist.Chapters {
+		podcast := podcastChapter{
+			StartTime: float64(chapter.StartMs) / 1000,
+			EndTime:   float64(chapter.EndMs) / 1000,
+			Title:     chapterTitle(chapter),
+		}
+		if chapter.YouTubeID != "" {
+			podcast.URL = "https://www.youtube.com/watch?v=" + chapter.YouTubeID
+		}
+		chapters.Chapters = append(chapters.Chapters, podcast)
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(chapters)
+}
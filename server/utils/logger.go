@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"fmt"
 	"log/slog"
 	"os"
 	"path/filepath"
@@ -73,8 +74,24 @@ func fmtErr(err error) slog.Value {
 	return slog.GroupValue(groupValues...)
 }
 
+// logLevel is the level of every logger, so changing it applies to those
+// already handed out.
+var logLevel = new(slog.LevelVar)
+
+// SetLogLevel sets the level below which records are dropped: debug, info,
+// warn or error.
+func SetLogLevel(level string) error {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("invalid log level %q: %v", level, err)
+	}
+	logLevel.Set(l)
+	return nil
+}
+
 func GetLogger() *slog.Logger {
 	h := slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
+		Level:       logLevel,
 		ReplaceAttr: replaceAttr,
 	})
 
@@ -0,0 +1,144 @@
+// Package validate checks requests before they reach the DSP code, so bad
+// inputs are rejected up front with the offending fields named instead of
+// failing deep inside decoding or fingerprinting.
+package validate
+
+import (
+	"fmt"
+	"mime"
+	"song-recognition/audio"
+	"song-recognition/models"
+	"song-recognition/utils"
+	"strconv"
+	"strings"
+)
+
+// FieldError is a problem with one field of a request.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// Errors are the field errors of a request, in the order they were found.
+type Errors []FieldError
+
+// Add records a problem with a field.
+func (e *Errors) Add(field, format string, args ...any) {
+	*e = append(*e, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+func (e Errors) Error() string {
+	messages := make([]string, len(e))
+	for i, fieldError := range e {
+		messages[i] = fieldError.Field + ": " + fieldError.Message
+	}
+	return strings.Join(messages, "; ")
+}
+
+// Err returns the errors as an error, or nil if there are none.
+func (e Errors) Err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+// MaxClipSeconds returns the longest recording accepted for recognition,
+// from RECOGNIZE_MAX_CLIP_SECONDS (default 600).
+func MaxClipSeconds() float64 {
+	seconds, err := strconv.ParseFloat(utils.GetEnv("RECOGNIZE_MAX_CLIP_SECONDS", "600"), 64)
+	if err != nil || seconds <= 0 {
+		return 600
+	}
+	return seconds
+}
+
+// SampleRateBounds returns the range of accepted sample rates, from
+// RECOGNIZE_SAMPLE_RATE_BOUNDS ("min,max", default 8000 to 192000 Hz).
+func SampleRateBounds() (int, int) {
+	minRate, maxRate := 8000, 192000
+	lower, upper, ok := strings.Cut(utils.GetEnv("RECOGNIZE_SAMPLE_RATE_BOUNDS"), ",")
+	if ok {
+		if value, err := strconv.Atoi(strings.TrimSpace(lower)); err == nil && value > 0 {
+			minRate = value
+		}
+		if value, err := strconv.Atoi(strings.TrimSpace(upper)); err == nil && value > 0 {
+			maxRate = value
+		}
+	}
+	return minRate, min(maxRate, audio.MaxSampleRate)
+}
+
+// audioTypes are the media types accepted for audio uploads besides audio/*:
+// video containers, whose soundtrack is extracted, and unlabelled files whose
+// format is sniffed when decoded.
+var audioTypes = map[string]bool{
+	"application/ogg":          true,
+	"application/octet-stream": true,
+	"video/ogg":                true,
+	"video/webm":               true,
+	"video/mp4":                true,
+	"video/x-matroska":         true,
+	"video/quicktime":          true,
+}
+
+// AudioContentType returns the media type of an uploaded audio file, without
+// parameters and in lower case, and whether it is accepted. Files sent
+// without a type are treated as application/octet-stream.
+func AudioContentType(contentType string) (string, bool) {
+	if strings.TrimSpace(contentType) == "" {
+		return "application/octet-stream", true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return strings.ToLower(contentType), false
+	}
+	return mediaType, strings.HasPrefix(mediaType, "audio/") || audioTypes[mediaType]
+}
+
+// Audio checks the sample rate and length of the audio given in field.
+func Audio(errs *Errors, field string, sampleRate int, duration float64) {
+	if minRate, maxRate := SampleRateBounds(); sampleRate < minRate || sampleRate > maxRate {
+		errs.Add(field, "sample rate %d Hz is outside %d to %d Hz", sampleRate, minRate, maxRate)
+	}
+	if duration <= 0 {
+		errs.Add(field, "is empty")
+	} else if maxSeconds := MaxClipSeconds(); duration > maxSeconds {
+		errs.Add(field, "%.1fs long, the limit is %gs", duration, maxSeconds)
+	}
+}
+
+// Recording checks a raw recording sent over the socket.
+func Recording(rec models.RecordData) Errors {
+	var errs Errors
+	if rec.Audio == "" {
+		errs.Add("audio", "is required")
+	}
+	switch rec.SampleSize {
+	case 8, 16, 24, 32:
+	default:
+		errs.Add("sampleSize", "must be 8, 16, 24 or 32 bits, got %d", rec.SampleSize)
+	}
+	if minRate, maxRate := SampleRateBounds(); rec.SampleRate < minRate || rec.SampleRate > maxRate {
+		errs.Add("sampleRate", "must be between %d and %d Hz, got %d", minRate, maxRate, rec.SampleRate)
+	}
+	if rec.Channels < 1 || rec.Channels > 2 {
+		errs.Add("channels", "must be 1 or 2, got %d", rec.Channels)
+	}
+	if maxSeconds := MaxClipSeconds(); rec.Duration > maxSeconds {
+		errs.Add("duration", "must be at most %gs, got %.1fs", maxSeconds, rec.Duration)
+	}
+	return errs
+}
+
+// Song checks the fields required to ingest a song.
+func Song(title, artist string) Errors {
+	var errs Errors
+	if strings.TrimSpace(title) == "" {
+		errs.Add("title", "is required")
+	}
+	if strings.TrimSpace(artist) == "" {
+		errs.Add("artist", "is required")
+	}
+	return errs
+}
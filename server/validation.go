@@ -0,0 +1,209 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"song-recognition/shazam"
+	"song-recognition/timefmt"
+	"song-recognition/tracklist"
+	"song-recognition/validate"
+	"strconv"
+	"strings"
+)
+
+// maxMultipartMemory is how much of a multipart form is kept in memory, the
+// rest being spooled to temporary files.
+const maxMultipartMemory = 32 << 20
+
+// writeValidationError reports the invalid fields of a request.
+func writeValidationError(w http.ResponseWriter, errs validate.Errors) {
+	writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+		"error":  "invalid request: " + errs.Error(),
+		"fields": errs,
+	})
+}
+
+// validateRequest is middleware rejecting requests in which check finds
+// invalid fields with a 400 listing them. check may also normalise the
+// request for the handler.
+func validateRequest(check func(r *http.Request) validate.Errors, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if errs := check(r); len(errs) > 0 {
+			writeValidationError(w, errs)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// checkJSONRequest requires a JSON body. Requests without a content type are
+// taken to be JSON.
+func checkJSONRequest(r *http.Request) validate.Errors {
+	var errs validate.Errors
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		return nil
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType != "application/json" {
+		errs.Add("Content-Type", "must be application/json, got %q", contentType)
+	}
+	return errs
+}
+
+// checkAudioUpload requires a multipart form with an audio or video file of
+// an accepted type, and normalises the recognition mode, the chapter format,
+// the loudness flag and the noise reduction settings. Files sent as "video"
+// are handled as the "audio" field.
+func checkAudioUpload(r *http.Request) validate.Errors {
+	var errs validate.Errors
+
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/form-data" {
+		errs.Add("Content-Type", "must be multipart/form-data, got %q", r.Header.Get("Content-Type"))
+		return errs
+	}
+	if err := r.ParseMultipartForm(maxMultipartMemory); err != nil {
+		errs.Add("body", "invalid multipart form: %v", err)
+		return errs
+	}
+
+	files := r.MultipartForm.File["audio"]
+	if len(files) == 0 && len(r.MultipartForm.File["video"]) > 0 {
+		files = r.MultipartForm.File["video"]
+		r.MultipartForm.File["audio"] = files
+	}
+	if len(files) == 0 {
+		errs.Add("audio", "is required")
+	} else if contentType, ok := validate.AudioContentType(files[0].Header.Get("Content-Type")); !ok {
+		errs.Add("audio", "unsupported content type %q", contentType)
+	}
+
+	mode := strings.ToLower(strings.TrimSpace(r.FormValue("mode")))
+	switch mode {
+	case "":
+		mode = "best"
+	case "best", "timeline", "chapters":
+	default:
+		errs.Add("mode", "must be best, timeline or chapters, got %q", mode)
+	}
+	r.Form.Set("mode", mode)
+
+	format := strings.ToLower(strings.TrimSpace(r.FormValue("format")))
+	if format == "" {
+		format = "json"
+	}
+	if _, err := tracklist.Lookup(format); err != nil {
+		errs.Add("format", "%v", err)
+	}
+	r.Form.Set("format", format)
+
+	loudness := strings.TrimSpace(r.FormValue("loudness"))
+	if loudness == "" {
+		loudness = "false"
+	}
+	measureLoudness, err := strconv.ParseBool(loudness)
+	if err != nil {
+		errs.Add("loudness", "must be true or false, got %q", loudness)
+	}
+	r.Form.Set("loudness", strconv.FormatBool(measureLoudness))
+
+	channels := strings.ToLower(strings.TrimSpace(r.FormValue("channels")))
+	switch channels {
+	case "":
+		channels = "mix"
+		if shazam.DualChannelQueries() {
+			channels = "dual"
+		}
+	case "mix", "dual":
+	default:
+		errs.Add("channels", "must be mix or dual, got %q", channels)
+	}
+	r.Form.Set("channels", channels)
+
+	denoise := strings.ToLower(strings.TrimSpace(r.FormValue("denoise")))
+	switch {
+	case denoise == "":
+		denoise = "auto"
+	case denoise == "auto", denoise == "off", shazam.ValidNoiseReduction(denoise):
+	default:
+		errs.Add("denoise", "must be auto, off, %s or %s, got %q", shazam.NoiseSubtraction, shazam.NoiseWiener, denoise)
+	}
+	r.Form.Set("denoise", denoise)
+
+	noiseSource := strings.ToLower(strings.TrimSpace(r.FormValue("noiseSource")))
+	switch noiseSource {
+	case "":
+		noiseSource = "auto"
+	case "auto", "profile", "leading":
+	default:
+		errs.Add("noiseSource", "must be auto, profile or leading, got %q", noiseSource)
+	}
+	r.Form.Set("noiseSource", noiseSource)
+
+	noiseLead := strings.TrimSpace(r.FormValue("noiseLeadMs"))
+	if noiseLead == "" {
+		noiseLead = strconv.Itoa(defaultNoiseLeadMs)
+	}
+	if leadMs, err := strconv.Atoi(noiseLead); err != nil || leadMs < minNoiseLeadMs || leadMs > maxNoiseLeadMs {
+		errs.Add("noiseLeadMs", "must be an integer from %d to %d, got %q", minNoiseLeadMs, maxNoiseLeadMs, noiseLead)
+	}
+	r.Form.Set("noiseLeadMs", noiseLead)
+
+	debug := strings.TrimSpace(r.FormValue("debug"))
+	if debug == "" {
+		debug = "false"
+	}
+	withDebug, err := strconv.ParseBool(debug)
+	if err != nil {
+		errs.Add("debug", "must be true or false, got %q", debug)
+	}
+	r.Form.Set("debug", strconv.FormatBool(withDebug))
+
+	if len(r.FormValue("stream")) > maxStreamName {
+		errs.Add("stream", "must be at most %d characters", maxStreamName)
+	}
+
+	formatted := strings.TrimSpace(r.FormValue("formatted"))
+	if formatted == "" {
+		formatted = "true"
+	}
+	formatTimes, err := strconv.ParseBool(formatted)
+	if err != nil {
+		errs.Add("formatted", "must be true or false, got %q", formatted)
+	}
+	r.Form.Set("formatted", strconv.FormatBool(formatTimes))
+
+	if locale := r.FormValue("locale"); locale != "" && !timefmt.ValidLocale(locale) {
+		errs.Add("locale", "must be a language tag such as en-US, got %q", locale)
+	}
+
+	minVersion := strings.TrimSpace(r.FormValue("minCatalogVersion"))
+	if minVersion != "" {
+		if version, err := strconv.ParseInt(minVersion, 10, 64); err != nil || version < 0 {
+			errs.Add("minCatalogVersion", "must be a non-negative integer, got %q", minVersion)
+		}
+	}
+	r.Form.Set("minCatalogVersion", minVersion)
+
+	return errs
+}
+
+// checkAudioFormat checks the format and length of an uploaded recording
+// from its metadata, before it is decoded.
+func checkAudioFormat(sampleRate, duration string) validate.Errors {
+	var errs validate.Errors
+	rate, err := strconv.Atoi(sampleRate)
+	if err != nil {
+		errs.Add("audio", "unknown sample rate")
+	}
+	seconds, err := strconv.ParseFloat(duration, 64)
+	if err != nil {
+		errs.Add("audio", "unknown duration")
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	validate.Audio(&errs, "audio", rate, seconds)
+	return errs
+}
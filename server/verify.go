@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"song-recognition/db"
+	"song-recognition/exclusions"
+	"song-recognition/models"
+	"song-recognition/shazam"
+	"sort"
+)
+
+const (
+	// verifyDriftBelow is the share of the couples of a song that must be
+	// found unchanged in the index for differences to be taken for damage
+	// rather than for the song having been indexed by another algorithm
+	// version or with other parameters.
+	verifyDriftBelow = 0.5
+	// verifyBatchSize is how many addresses are looked up at once.
+	verifyBatchSize = 1000
+)
+
+// Outcomes of the verification of a song.
+const (
+	verifyOK         = "ok"
+	verifyCorrupt    = "corrupt"     // some couples are missing or moved
+	verifyDrift      = "drift"       // most couples differ: indexed with other settings
+	verifyStale      = "stale"       // recorded as indexed with other fingerprint parameters
+	verifyNotIndexed = "not_indexed" // no couple of the song is in the index
+	verifyNoAudio    = "no_audio"    // the audio of the song wasn't found
+	verifyFailed     = "failed"
+)
+
+// songVerification compares the couples of a song in the index with those
+// generated again from its audio.
+type songVerification struct {
+	SongID   models.SongID `json:"songId"`
+	Title    string        `json:"title"`
+	Artist   string        `json:"artist"`
+	Status   string        `json:"status"`
+	Expected int           `json:"expected"` // couples generated from the audio
+	Matched  int           `json:"matched"`  // found in the index as generated
+	Moved    int           `json:"moved"`    // found at another anchor time
+	Missing  int           `json:"missing"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// verifyIndex re-fingerprints a sample of songs from their audio in
+// SONGS_DIR, or in an archive folder of copies, and checks that the index
+// holds the same couples. It exits with status 1 when a song is corrupt or
+// was indexed with another fingerprint version or parameters.
+func verifyIndex(args []string) {
+	verifyCmd := flag.NewFlagSet("verify-index", flag.ExitOnError)
+	sample := verifyCmd.Int("sample", 20, "number of songs checked at random, 0 for all")
+	songID := verifyCmd.Uint64("song", 0, "check only this song")
+	archiveDir := verifyCmd.String("archive", "", "folder holding copies of the audio missing from "+SONGS_DIR)
+	asJSON := verifyCmd.Bool("json", false, "print the report as JSON")
+	verifyCmd.Parse(args)
+
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		yellow.Println("Error connecting to DB:", err)
+		os.Exit(1)
+	}
+	defer dbClient.Close()
+
+	songIDs := []models.SongID{models.SongID(*songID)}
+	if *songID == 0 {
+		songIDs, err = sampleSongs(dbClient, *sample)
+		if err != nil {
+			yellow.Println("Error listing songs:", err)
+			os.Exit(1)
+		}
+	}
+
+	report := make([]songVerification, 0, len(songIDs))
+	counts := make(map[string]int)
+	for i, id := range songIDs {
+		result := verifySong(dbClient, id, *archiveDir)
+		report = append(report, result)
+		counts[result.Status]++
+		if !*asJSON {
+			fmt.Printf("[%d/%d] %s\n", i+1, len(songIDs), describeVerification(result))
+		}
+	}
+
+	if *asJSON {
+		data, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Println(string(data))
+	} else {
+		fmt.Printf("\nChecked %d songs: %d ok, %d corrupt, %d drifted, %d stale, %d not indexed, %d without audio, %d failed.\n",
+			len(report), counts[verifyOK], counts[verifyCorrupt], counts[verifyDrift], counts[verifyStale], counts[verifyNotIndexed], counts[verifyNoAudio], counts[verifyFailed])
+		if counts[verifyCorrupt]+counts[verifyDrift]+counts[verifyNotIndexed] > 0 {
+			fmt.Println("Reindex the affected songs with 'admin reindex --song <id>'.")
+		}
+		if counts[verifyStale] > 0 {
+			fmt.Println("Bring stale songs up to date with 'admin jobs run refresh-index'.")
+		}
+	}
+	if counts[verifyCorrupt]+counts[verifyDrift]+counts[verifyNotIndexed] > 0 {
+		os.Exit(1)
+	}
+}
+
+// sampleSongs returns the IDs of size songs picked at random, or of every
+// song if size is 0, in ascending order.
+func sampleSongs(dbClient db.DBClient, size int) ([]models.SongID, error) {
+	var songIDs []models.SongID
+	err := dbClient.ForEachSong(func(songID models.SongID, _ db.Song) error {
+		songIDs = append(songIDs, songID)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if size > 0 && size < len(songIDs) {
+		rand.Shuffle(len(songIDs), func(i, j int) { songIDs[i], songIDs[j] = songIDs[j], songIDs[i] })
+		songIDs = songIDs[:size]
+	}
+	sort.Slice(songIDs, func(i, j int) bool { return songIDs[i] < songIDs[j] })
+	return songIDs, nil
+}
+
+// verifySong compares the couples of a song in the index with those
+// generated from its audio, leaving out its excluded ranges as reindexing
+// does.
+func verifySong(dbClient db.DBClient, songID models.SongID, archiveDir string) songVerification {
+	result := songVerification{SongID: songID}
+	fail := func(status string, err error) songVerification {
+		result.Status, result.Error = status, err.Error()
+		return result
+	}
+
+	song, exists, err := dbClient.GetSongByID(songID)
+	if err != nil {
+		return fail(verifyFailed, err)
+	}
+	if !exists {
+		return fail(verifyFailed, fmt.Errorf("song with ID (%v) doesn't exist", songID))
+	}
+	result.Title, result.Artist = song.Title, song.Artist
+
+	config, err := shazam.ReadIndexConfig(dbClient, songID)
+	if err != nil {
+		return fail(verifyFailed, err)
+	}
+	if !config.Current() {
+		return fail(verifyStale, fmt.Errorf("indexed with fingerprint parameters %s, now %s", config.Hash, shazam.CurrentParams().Hash()))
+	}
+
+	songPath, err := findSongFile(song)
+	if err != nil && archiveDir != "" {
+		songPath, err = findSongFileIn(archiveDir, song)
+	}
+	if err != nil {
+		return fail(verifyNoAudio, err)
+	}
+
+	fingerprint, err := shazam.FingerprintAudio(songPath, songID)
+	if err != nil {
+		return fail(verifyFailed, err)
+	}
+	rule, excluded, err := exclusions.Get(songID)
+	if err != nil {
+		return fail(verifyFailed, err)
+	}
+	if excluded {
+		rule.Strip(fingerprint)
+	}
+	result.Expected = len(fingerprint)
+
+	addresses := make([]uint32, 0, len(fingerprint))
+	for address := range fingerprint {
+		addresses = append(addresses, address)
+	}
+	for start := 0; start < len(addresses); start += verifyBatchSize {
+		batch := addresses[start:min(start+verifyBatchSize, len(addresses))]
+		stored, err := dbClient.GetCouples(batch)
+		if err != nil {
+			return fail(verifyFailed, err)
+		}
+		for _, address := range batch {
+			want := fingerprint[address]
+			found, moved := false, false
+			for _, couple := range stored[address] {
+				if couple.SongID != songID {
+					continue
+				}
+				if couple.AnchorTimeMs == want.AnchorTimeMs {
+					found = true
+					break
+				}
+				moved = true
+			}
+			switch {
+			case found:
+				result.Matched++
+			case moved:
+				result.Moved++
+			default:
+				result.Missing++
+			}
+		}
+	}
+
+	switch {
+	case result.Matched == result.Expected:
+		result.Status = verifyOK
+	case result.Matched == 0 && result.Moved == 0:
+		result.Status = verifyNotIndexed
+	case float64(result.Matched) < verifyDriftBelow*float64(result.Expected):
+		result.Status = verifyDrift
+	default:
+		result.Status = verifyCorrupt
+	}
+	return result
+}
+
+func describeVerification(result songVerification) string {
+	name := fmt.Sprintf("%d '%s' by '%s'", result.SongID, result.Title, result.Artist)
+	switch result.Status {
+	case verifyOK:
+		return fmt.Sprintf("%s: ok (%d couples)", name, result.Expected)
+	case verifyNoAudio, verifyFailed, verifyStale:
+		return yellow.Sprintf("%s: %s: %s", name, result.Status, result.Error)
+	case verifyDrift:
+		return yellow.Sprintf("%s: drift, only %d of %d couples match; indexed with another fingerprint version or parameters?", name, result.Matched, result.Expected)
+	case verifyNotIndexed:
+		return yellow.Sprintf("%s: none of its %d couples are indexed", name, result.Expected)
+	}
+	return yellow.Sprintf("%s: corrupt, %d of %d couples missing and %d moved", name, result.Missing, result.Expected, result.Moved)
+}
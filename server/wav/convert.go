@@ -3,32 +3,45 @@ package wav
 import (
 	"fmt"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"song-recognition/audio"
+	"song-recognition/breaker"
+	"song-recognition/deps"
 	"song-recognition/utils"
 	"strconv"
 	"strings"
 )
 
-// ConvertToWAV converts an input audio file to WAV format with specified channels.
+// decodeNatively reports whether a file is decoded by a registered decoder
+// rather than ffmpeg. Files a decoder recognises are, unless NATIVE_DECODING
+// is false outside of pure-Go mode.
+func decodeNatively(filePath string) bool {
+	if _, ok := audio.Sniff(filePath); !ok {
+		return false
+	}
+	if deps.PureGo() {
+		return true
+	}
+	native, err := strconv.ParseBool(utils.GetEnv("NATIVE_DECODING", "true"))
+	return err != nil || native
+}
+
+// ConvertToWAV converts an input audio file to a WAV file in the analysis
+// format. In pure-Go mode only formats with a registered decoder are
+// supported.
 func ConvertToWAV(inputFilePath string) (wavFilePath string, err error) {
 	_, err = os.Stat(inputFilePath)
 	if err != nil {
 		return "", fmt.Errorf("input file does not exist: %v", err)
 	}
 
-	to_stereoStr := utils.GetEnv("FINGERPRINT_STEREO", "false")
-	to_stereo, err := strconv.ParseBool(to_stereoStr)
-	if err != nil {
-		return "", fmt.Errorf("failed to convert env variable (%s) to bool: %v", "FINGERPRINT_STEREO", err)
-	}
-
-	channels := 1
-	if to_stereo {
-		channels = 2
-	}
+	format := audio.AnalysisFormat()
+	native := decodeNatively(inputFilePath)
 
 	fileExt := filepath.Ext(inputFilePath)
+	if deps.PureGo() && !native {
+		return "", &deps.ErrRequiresExternalTool{Tool: deps.FFmpeg, Feature: "converting " + fileExt + " files"}
+	}
 	if fileExt != ".wav" {
 		defer os.Remove(inputFilePath)
 	}
@@ -40,19 +53,13 @@ func ConvertToWAV(inputFilePath string) (wavFilePath string, err error) {
 	tmpFile := filepath.Join(filepath.Dir(outputFile), "tmp_"+filepath.Base(outputFile))
 	defer os.Remove(tmpFile)
 
-	cmd := exec.Command(
-		"ffmpeg",
-		"-y",
-		"-i", inputFilePath,
-		"-c", "pcm_s16le",
-		"-ar", "44100",
-		"-ac", fmt.Sprint(channels),
-		tmpFile,
-	)
-
-	output, err := cmd.CombinedOutput()
+	if native {
+		err = convertNative(inputFilePath, tmpFile, format)
+	} else {
+		err = convertFFmpeg(inputFilePath, tmpFile, format)
+	}
 	if err != nil {
-		return "", fmt.Errorf("failed to convert to WAV: %v, output %v", err, string(output))
+		return "", err
 	}
 
 	// Rename the temporary file to the output file
@@ -64,30 +71,64 @@ func ConvertToWAV(inputFilePath string) (wavFilePath string, err error) {
 	return outputFile, nil
 }
 
-// ReformatWAV converts a given WAV file to the specified number of channels,
-// either mono (1 channel) or stereo (2 channels).
+// ReformatWAV converts a given WAV file to the analysis format with the
+// specified number of channels, either mono (1 channel) or stereo (2 channels).
 func ReformatWAV(inputFilePath string, channels int) (reformatedFilePath string, errr error) {
 	if channels < 1 || channels > 2 {
 		channels = 1
 	}
+	format := audio.AnalysisFormat()
+	format.Channels = channels
 
 	fileExt := filepath.Ext(inputFilePath)
 	outputFile := strings.TrimSuffix(inputFilePath, fileExt) + "rfm.wav"
 
-	cmd := exec.Command(
-		"ffmpeg",
+	var err error
+	if decodeNatively(inputFilePath) {
+		err = convertNative(inputFilePath, outputFile, format)
+	} else {
+		err = convertFFmpeg(inputFilePath, outputFile, format)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return outputFile, nil
+}
+
+// convertFFmpeg converts anything ffmpeg reads to PCM in the given format.
+// Only the first audio track is kept, so video files give their soundtrack.
+func convertFFmpeg(inputFilePath, outputFilePath string, format audio.Format) error {
+	cmd, err := deps.Command(deps.FFmpeg, "converting audio",
 		"-y",
 		"-i", inputFilePath,
-		"-c", "pcm_s16le",
-		"-ar", "44100",
-		"-ac", fmt.Sprint(channels),
-		outputFile,
+		"-map", "0:a:0",
+		"-c", fmt.Sprintf("pcm_s%dle", format.BitDepth),
+		"-ar", fmt.Sprint(format.SampleRate),
+		"-ac", fmt.Sprint(format.Channels),
+		outputFilePath,
 	)
+	if err != nil {
+		return err
+	}
 
-	output, err := cmd.CombinedOutput()
+	return breaker.Do(breaker.FFmpeg, func() error {
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			return breaker.IgnoreExitStatus(fmt.Errorf("failed to convert to WAV: %w, output %v", err, string(output)))
+		}
+		return nil
+	})
+}
+
+// convertNative does what convertFFmpeg does for the formats of the
+// registered decoders, using them and the built-in resampler.
+func convertNative(inputFilePath, outputFilePath string, format audio.Format) error {
+	samples, info, err := audio.DecodeFile(inputFilePath)
 	if err != nil {
-		return "", fmt.Errorf("failed to convert to WAV: %v, output %v", err, string(output))
+		return err
 	}
 
-	return outputFile, nil
+	out := format.Conform(samples, info.SampleRate)
+	return WriteWavFile(outputFilePath, EncodePCM(out, format.BitDepth), format.SampleRate, format.Channels, format.BitDepth)
 }
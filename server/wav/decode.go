@@ -0,0 +1,257 @@
+package wav
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"song-recognition/audio"
+	"strings"
+)
+
+const (
+	formatPCM        = 1
+	formatIEEEFloat  = 3
+	formatExtensible = 0xFFFE
+)
+
+// PCM is decoded audio with samples in [-1, 1], one slice per channel.
+type PCM struct {
+	SampleRate    int
+	BitsPerSample int
+	Channels      [][]float64
+}
+
+// Duration returns the length of the audio in seconds.
+func (p *PCM) Duration() float64 {
+	if len(p.Channels) == 0 {
+		return 0
+	}
+	return audio.FramesToSeconds(len(p.Channels[0]), p.SampleRate)
+}
+
+type riffChunk struct {
+	ID   string
+	Data []byte
+}
+
+// riffChunks splits the body of a RIFF/WAVE file into its chunks.
+func riffChunks(data []byte) ([]riffChunk, error) {
+	if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WAVE" {
+		return nil, errors.New("not a RIFF/WAVE file")
+	}
+
+	var chunks []riffChunk
+	for offset := 12; offset+8 <= len(data); {
+		id := string(data[offset : offset+4])
+		size := int64(binary.LittleEndian.Uint32(data[offset+4 : offset+8]))
+		start := offset + 8
+		// Streamed files may declare a larger data chunk than was written
+		end := int(min(int64(start)+size, int64(len(data))))
+		chunks = append(chunks, riffChunk{ID: id, Data: data[start:end]})
+		offset = end + int(size%2) // chunks are padded to an even size
+	}
+	return chunks, nil
+}
+
+// DecodeWAV decodes a WAV file holding integer PCM (8, 16, 24 or 32 bits) or
+// IEEE float samples, with any number of channels.
+func DecodeWAV(data []byte) (*PCM, error) {
+	chunks, err := riffChunks(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var format, samples []byte
+	for _, chunk := range chunks {
+		switch chunk.ID {
+		case "fmt ":
+			format = chunk.Data
+		case "data":
+			samples = chunk.Data
+		}
+	}
+	if len(format) < 16 {
+		return nil, errors.New("missing or invalid fmt chunk")
+	}
+	if samples == nil {
+		return nil, errors.New("missing data chunk")
+	}
+
+	audioFormat := binary.LittleEndian.Uint16(format[0:2])
+	channels := int(binary.LittleEndian.Uint16(format[2:4]))
+	sampleRate := int(binary.LittleEndian.Uint32(format[4:8]))
+	bitsPerSample := int(binary.LittleEndian.Uint16(format[14:16]))
+	if audioFormat == formatExtensible && len(format) >= 26 {
+		// The actual format is the first two bytes of the sub-format GUID
+		audioFormat = binary.LittleEndian.Uint16(format[24:26])
+	}
+
+	if channels == 0 || sampleRate <= 0 || sampleRate > audio.MaxSampleRate {
+		return nil, fmt.Errorf("invalid format: %d channels at %d Hz", channels, sampleRate)
+	}
+
+	var decode func([]byte) float64
+	switch {
+	case audioFormat == formatPCM && bitsPerSample == 8:
+		decode = func(b []byte) float64 { return (float64(b[0]) - 128) / 128 }
+	case audioFormat == formatPCM && bitsPerSample == 16:
+		decode = func(b []byte) float64 { return float64(int16(binary.LittleEndian.Uint16(b))) / (1 << 15) }
+	case audioFormat == formatPCM && bitsPerSample == 24:
+		decode = func(b []byte) float64 {
+			return float64(int32(uint32(b[0])<<8|uint32(b[1])<<16|uint32(b[2])<<24)>>8) / (1 << 23)
+		}
+	case audioFormat == formatPCM && bitsPerSample == 32:
+		decode = func(b []byte) float64 { return float64(int32(binary.LittleEndian.Uint32(b))) / (1 << 31) }
+	case audioFormat == formatIEEEFloat && bitsPerSample == 32:
+		decode = func(b []byte) float64 { return float64(math.Float32frombits(binary.LittleEndian.Uint32(b))) }
+	case audioFormat == formatIEEEFloat && bitsPerSample == 64:
+		decode = func(b []byte) float64 { return math.Float64frombits(binary.LittleEndian.Uint64(b)) }
+	default:
+		return nil, fmt.Errorf("unsupported WAV encoding (format %d, %d bits)", audioFormat, bitsPerSample)
+	}
+
+	bytesPerSample := bitsPerSample / 8
+	frameSize := bytesPerSample * channels
+	frames := len(samples) / frameSize
+
+	pcm := &PCM{SampleRate: sampleRate, BitsPerSample: bitsPerSample, Channels: make([][]float64, channels)}
+	for c := range pcm.Channels {
+		pcm.Channels[c] = make([]float64, frames)
+	}
+	for i := 0; i < frames; i++ {
+		frame := samples[i*frameSize:]
+		for c := 0; c < channels; c++ {
+			pcm.Channels[c][i] = decode(frame[c*bytesPerSample:])
+		}
+	}
+
+	return pcm, nil
+}
+
+// EncodePCM interleaves the channels into little-endian integer PCM of the
+// given bit depth (16, 24 or 32), clipping samples outside [-1, 1].
+func EncodePCM(channels [][]float64, bitDepth int) []byte {
+	if len(channels) == 0 {
+		return nil
+	}
+
+	bytesPerSample := bitDepth / 8
+	scale := float64(int64(1)<<(bitDepth-1) - 1)
+	frames := len(channels[0])
+	out := make([]byte, 0, frames*len(channels)*bytesPerSample)
+	for i := 0; i < frames; i++ {
+		for _, channel := range channels {
+			s := int32(math.Round(math.Max(-1, math.Min(1, channel[i])) * scale))
+			for b := 0; b < bytesPerSample; b++ {
+				out = append(out, byte(s>>(8*b)))
+			}
+		}
+	}
+	return out
+}
+
+// infoTags maps RIFF INFO chunk IDs to the tag names ffprobe reports.
+var infoTags = map[string]string{
+	"INAM": "title",
+	"IART": "artist",
+	"IPRD": "album",
+	"IGNR": "genre",
+	"ICRD": "date",
+	"ICMT": "comment",
+	"ITRK": "track",
+}
+
+// readInfoTags returns the tags of the LIST/INFO chunks of a WAV file.
+func readInfoTags(data []byte) map[string]string {
+	tags := make(map[string]string)
+	chunks, _ := riffChunks(data)
+	for _, chunk := range chunks {
+		if chunk.ID != "LIST" || len(chunk.Data) < 4 || string(chunk.Data[:4]) != "INFO" {
+			continue
+		}
+		list := append([]byte("RIFF\x00\x00\x00\x00WAVE"), chunk.Data[4:]...)
+		entries, _ := riffChunks(list)
+		for _, entry := range entries {
+			if name, ok := infoTags[entry.ID]; ok {
+				tags[name] = strings.TrimRight(string(entry.Data), "\x00")
+			}
+		}
+	}
+	return tags
+}
+
+// readWAVMetadata fills in what GetMetadata reports for a WAV file without
+// running ffprobe: the stream format, duration and LIST/INFO tags.
+func readWAVMetadata(filePath string) (FFmpegMetadata, error) {
+	var metadata FFmpegMetadata
+
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return metadata, err
+	}
+	pcm, err := DecodeWAV(data)
+	if err != nil {
+		return metadata, err
+	}
+	tags := readInfoTags(data)
+
+	duration := fmt.Sprintf("%f", pcm.Duration())
+	metadata.Streams = []FFmpegStream{{
+		CodecName:     fmt.Sprintf("pcm_s%dle", pcm.BitsPerSample),
+		CodecType:     "audio",
+		SampleRate:    fmt.Sprint(pcm.SampleRate),
+		Channels:      len(pcm.Channels),
+		BitsPerSample: pcm.BitsPerSample,
+		Duration:      duration,
+		Tags:          map[string]string{},
+	}}
+	metadata.Format.FormFilename = filePath
+	metadata.Format.NbatName = "wav"
+	metadata.Format.Streams = 1
+	metadata.Format.Duration = duration
+	metadata.Format.Size = fmt.Sprint(len(data))
+	metadata.Format.Tags = tags
+
+	return metadata, nil
+}
+
+// readDecodedMetadata fills in what GetMetadata reports for a file in any
+// format with a registered decoder.
+func readDecodedMetadata(filePath string) (FFmpegMetadata, error) {
+	var metadata FFmpegMetadata
+
+	_, info, err := audio.DecodeFile(filePath)
+	if err != nil {
+		return metadata, err
+	}
+	stat, err := os.Stat(filePath)
+	if err != nil {
+		return metadata, err
+	}
+
+	tags := info.Tags
+	if tags == nil {
+		tags = make(map[string]string)
+	}
+
+	duration := fmt.Sprintf("%f", info.Duration)
+	metadata.Streams = []FFmpegStream{{
+		CodecName:     info.Codec,
+		CodecType:     "audio",
+		SampleRate:    fmt.Sprint(info.SampleRate),
+		Channels:      info.Channels,
+		BitsPerSample: info.BitDepth,
+		Duration:      duration,
+		Tags:          map[string]string{},
+	}}
+	metadata.Format.FormFilename = filePath
+	metadata.Format.NbatName = info.Codec
+	metadata.Format.Streams = 1
+	metadata.Format.Duration = duration
+	metadata.Format.Size = fmt.Sprint(stat.Size())
+	metadata.Format.Tags = tags
+
+	return metadata, nil
+}
@@ -0,0 +1,39 @@
+package wav
+
+import (
+	"io"
+	"song-recognition/audio"
+
+	// Formats decoded without ffmpeg
+	_ "song-recognition/aiff"
+	_ "song-recognition/opus"
+)
+
+func init() {
+	audio.Register("wav", wavDecoder{})
+}
+
+// wavDecoder plugs DecodeWAV into the audio decoder registry.
+type wavDecoder struct{}
+
+func (wavDecoder) CanDecode(header []byte) bool {
+	return len(header) >= 12 && string(header[0:4]) == "RIFF" && string(header[8:12]) == "WAVE"
+}
+
+func (wavDecoder) Decode(r io.Reader) (audio.Samples, audio.Info, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, audio.Info{}, err
+	}
+
+	pcm, err := DecodeWAV(data)
+	if err != nil {
+		return nil, audio.Info{}, err
+	}
+
+	info := audio.Info{
+		Format:   audio.Format{SampleRate: pcm.SampleRate, Channels: len(pcm.Channels), BitDepth: pcm.BitsPerSample},
+		Duration: pcm.Duration(),
+	}
+	return audio.Samples(pcm.Channels), info, nil
+}
@@ -0,0 +1,69 @@
+package wav
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// wavFile returns a WAV file of the given format with a LIST/INFO chunk.
+func wavFile(audioFormat, channels, sampleRate, bits int, data []byte) []byte {
+	var b bytes.Buffer
+	chunk := func(id string, body []byte) {
+		b.WriteString(id)
+		binary.Write(&b, binary.LittleEndian, uint32(len(body)))
+		b.Write(body)
+		if len(body)%2 == 1 {
+			b.WriteByte(0)
+		}
+	}
+
+	format := make([]byte, 16)
+	binary.LittleEndian.PutUint16(format[0:], uint16(audioFormat))
+	binary.LittleEndian.PutUint16(format[2:], uint16(channels))
+	binary.LittleEndian.PutUint32(format[4:], uint32(sampleRate))
+	binary.LittleEndian.PutUint32(format[8:], uint32(sampleRate*channels*bits/8))
+	binary.LittleEndian.PutUint16(format[12:], uint16(channels*bits/8))
+	binary.LittleEndian.PutUint16(format[14:], uint16(bits))
+
+	b.WriteString("RIFF\x00\x00\x00\x00WAVE")
+	chunk("fmt ", format)
+	chunk("LIST", []byte("INFOINAM\x05\x00\x00\x00Title\x00IART\x06\x00\x00\x00Artist"))
+	chunk("data", data)
+
+	file := b.Bytes()
+	binary.LittleEndian.PutUint32(file[4:], uint32(len(file)-8))
+	return file
+}
+
+func FuzzDecodeWAV(f *testing.F) {
+	samples := EncodePCM([][]float64{{0, 0.5, -0.5, 1}, {1, -1, 0.25, 0}}, 16)
+	f.Add(wavFile(formatPCM, 2, 44100, 16, samples))
+	f.Add(wavFile(formatPCM, 1, 8000, 8, []byte{0, 128, 255}))
+	f.Add(wavFile(formatPCM, 1, 48000, 24, EncodePCM([][]float64{{0.1, -0.1}}, 24)))
+	f.Add(wavFile(formatIEEEFloat, 1, 48000, 32, make([]byte, 16)))
+	f.Add(wavFile(formatIEEEFloat, 2, 96000, 64, make([]byte, 32)))
+	f.Add(wavFile(formatExtensible, 1, 44100, 16, samples))
+	f.Add([]byte("RIFF\xff\xff\xff\xffWAVEdata\xff\xff\xff\xff"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		pcm, err := DecodeWAV(data)
+		tags := readInfoTags(data)
+		if err != nil {
+			return
+		}
+		if len(pcm.Channels) == 0 || pcm.SampleRate <= 0 {
+			t.Fatalf("decoded %d channels at %d Hz without error", len(pcm.Channels), pcm.SampleRate)
+		}
+		for _, channel := range pcm.Channels {
+			if len(channel) != len(pcm.Channels[0]) {
+				t.Fatal("channels have different lengths")
+			}
+		}
+		for name := range tags {
+			if name == "" {
+				t.Fatal("empty tag name")
+			}
+		}
+	})
+}
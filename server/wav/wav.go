@@ -11,7 +11,10 @@ import (
 	"io/ioutil"
 	"log/slog"
 	"os"
-	"os/exec"
+	"path/filepath"
+	"song-recognition/audio"
+	"song-recognition/breaker"
+	"song-recognition/deps"
 	"song-recognition/models"
 	"song-recognition/utils"
 	"strings"
@@ -38,15 +41,16 @@ type WavHeader struct {
 }
 
 func writeWavHeader(f *os.File, data []byte, sampleRate int, channels int, bitsPerSample int) error {
+	format := audio.Format{SampleRate: sampleRate, Channels: channels, BitDepth: bitsPerSample}
+
 	// Validate input
-	if len(data)%channels != 0 {
-		return errors.New("data size not divisible by channels")
+	if len(data)%format.FrameSize() != 0 {
+		return errors.New("data size is not a whole number of frames")
 	}
 
 	// Calculate derived values
 	subchunk1Size := uint32(16) // Assuming PCM format
-	bytesPerSample := bitsPerSample / 8
-	blockAlign := uint16(channels * bytesPerSample)
+	blockAlign := uint16(format.FrameSize())
 	subchunk2Size := uint32(len(data))
 
 	// Build WAV header
@@ -59,7 +63,7 @@ func writeWavHeader(f *os.File, data []byte, sampleRate int, channels int, bitsP
 		AudioFormat:   uint16(1), // PCM format
 		NumChannels:   uint16(channels),
 		SampleRate:    uint32(sampleRate),
-		BytesPerSec:   uint32(sampleRate * channels * bytesPerSample),
+		BytesPerSec:   uint32(sampleRate * format.FrameSize()),
 		BlockAlign:    blockAlign,
 		BitsPerSample: uint16(bitsPerSample),
 		Subchunk2ID:   [4]byte{'d', 'a', 't', 'a'},
@@ -103,74 +107,39 @@ type WavInfo struct {
 	RightChannelSamples []float64
 }
 
-// ReadWavInfo reads a 16-bit PCM WAV file and returns its metadata and audio samples.
-// Supports mono and stereo files. Note that it only supports 16-bit PCM format.
+// ReadWavInfo reads a PCM WAV file and returns its metadata and audio samples.
+// Supports mono and stereo files in any encoding DecodeWAV handles.
 func ReadWavInfo(filename string) (*WavInfo, error) {
 	data, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return nil, err
 	}
-	if len(data) < 44 {
-		return nil, errors.New("invalid WAV file size (too small)")
-	}
 
-	// Parse PCM header to extract metadata
-	// https://en.wikipedia.org/wiki/WAV#WAV_file_header
-	var header WavHeader
-	if err := binary.Read(bytes.NewReader(data[:44]), binary.LittleEndian, &header); err != nil {
+	pcm, err := DecodeWAV(data)
+	if err != nil {
 		return nil, err
 	}
-	if string(header.ChunkID[:]) != "RIFF" ||
-		string(header.Format[:]) != "WAVE" ||
-		header.AudioFormat != 1 {
-		return nil, errors.New("invalid WAV header format")
+	if len(pcm.Channels) > 2 {
+		return nil, errors.New("unsupported channel count (only mono/stereo)")
 	}
 
 	info := &WavInfo{
-		Channels:   int(header.NumChannels),
-		SampleRate: int(header.SampleRate),
-		Data:       data[44:],
+		Channels:           len(pcm.Channels),
+		SampleRate:         pcm.SampleRate,
+		Duration:           pcm.Duration(),
+		LeftChannelSamples: pcm.Channels[0],
 	}
-
-	if header.BitsPerSample != 16 {
-		return nil, errors.New("unsupported bits‑per‑sample (expect 16‑bit PCM)")
+	if len(pcm.Channels) == 2 {
+		info.RightChannelSamples = pcm.Channels[1]
 	}
 
-	sampleCount := len(info.Data) / 2
-	int16Buf := make([]int16, sampleCount)
-	if err := binary.Read(bytes.NewReader(info.Data), binary.LittleEndian, int16Buf); err != nil {
-		return nil, err
-	}
-
-	const scale = 1.0 / 32768.0 // 16‑bit normalisation factor
-
-	switch header.NumChannels {
-	case 1:
-		left := make([]float64, sampleCount)
-		for i, s := range int16Buf {
-			left[i] = float64(s) * scale
+	chunks, _ := riffChunks(data)
+	for _, chunk := range chunks {
+		if chunk.ID == "data" {
+			info.Data = chunk.Data
 		}
-		info.LeftChannelSamples = left
-
-	case 2:
-		frameCount := sampleCount / 2
-		left := make([]float64, frameCount)
-		right := make([]float64, frameCount)
-		for i := 0; i < frameCount; i++ {
-			left[i] = float64(int16Buf[2*i]) * scale
-			right[i] = float64(int16Buf[2*i+1]) * scale
-		}
-		info.LeftChannelSamples = left
-		info.RightChannelSamples = right
-
-	default:
-		return nil, errors.New("unsupported channel count (only mono/stereo)")
 	}
 
-	// Compute audio duration in seconds
-	info.Duration = float64(sampleCount) /
-		(float64(header.NumChannels) * float64(header.SampleRate))
-
 	return info, nil
 }
 
@@ -194,24 +163,27 @@ func WavBytesToSamples(input []byte) ([]float64, error) {
 	return output, nil
 }
 
+// FFmpegStream describes a stream in the metadata returned by ffprobe.
+type FFmpegStream struct {
+	Index         int               `json:"index"`
+	CodecName     string            `json:"codec_name"`
+	CodecLongName string            `json:"codec_long_name"`
+	CodecType     string            `json:"codec_type"`
+	SampleFmt     string            `json:"sample_fmt"`
+	SampleRate    string            `json:"sample_rate"`
+	Channels      int               `json:"channels"`
+	ChannelLayout string            `json:"channel_layout"`
+	BitsPerSample int               `json:"bits_per_sample"`
+	Duration      string            `json:"duration"`
+	BitRate       string            `json:"bit_rate"`
+	Disposition   map[string]int    `json:"disposition"`
+	Tags          map[string]string `json:"tags"`
+}
+
 // FFmpegMetadata represents the metadata structure returned by ffprobe.
 type FFmpegMetadata struct {
-	Streams []struct {
-		Index         int               `json:"index"`
-		CodecName     string            `json:"codec_name"`
-		CodecLongName string            `json:"codec_long_name"`
-		CodecType     string            `json:"codec_type"`
-		SampleFmt     string            `json:"sample_fmt"`
-		SampleRate    string            `json:"sample_rate"`
-		Channels      int               `json:"channels"`
-		ChannelLayout string            `json:"channel_layout"`
-		BitsPerSample int               `json:"bits_per_sample"`
-		Duration      string            `json:"duration"`
-		BitRate       string            `json:"bit_rate"`
-		Disposition   map[string]int    `json:"disposition"`
-		Tags          map[string]string `json:"tags"`
-	} `json:"streams"`
-	Format struct {
+	Streams []FFmpegStream `json:"streams"`
+	Format  struct {
 		Streams        int               `json:"nb_streams"`
 		FormFilename   string            `json:"filename"`
 		NbatName       string            `json:"format_name"`
@@ -224,14 +196,28 @@ type FFmpegMetadata struct {
 	} `json:"format"`
 }
 
-// GetMetadata retrieves metadata from a file using ffprobe.
+// GetMetadata retrieves metadata from a file using ffprobe. Files that
+// ConvertToWAV decodes natively are read with the registered decoders instead.
 func GetMetadata(filePath string) (FFmpegMetadata, error) {
 	var metadata FFmpegMetadata
 
-	cmd := exec.Command("ffprobe", "-v", "quiet", "-print_format", "json", "-show_format", "-show_streams", filePath)
+	if decodeNatively(filePath) {
+		if strings.EqualFold(filepath.Ext(filePath), ".wav") {
+			return readWAVMetadata(filePath)
+		}
+		return readDecodedMetadata(filePath)
+	}
+
+	cmd, err := deps.Command(deps.FFprobe, "reading metadata of "+filepath.Base(filePath),
+		"-v", "quiet", "-print_format", "json", "-show_format", "-show_streams", filePath)
+	if err != nil {
+		return metadata, err
+	}
 	var out bytes.Buffer
 	cmd.Stdout = &out
-	err := cmd.Run()
+	err = breaker.Do(breaker.FFmpeg, func() error {
+		return breaker.IgnoreExitStatus(cmd.Run())
+	})
 	if err != nil {
 		return metadata, err
 	}
@@ -245,13 +231,36 @@ func GetMetadata(filePath string) (FFmpegMetadata, error) {
 	for k, v := range metadata.Format.Tags {
 		metadata.Format.Tags[strings.ToLower(k)] = v
 	}
-	for k, v := range metadata.Streams[0].Tags {
-		metadata.Streams[0].Tags[strings.ToLower(k)] = v
+	for _, stream := range metadata.Streams {
+		for k, v := range stream.Tags {
+			stream.Tags[strings.ToLower(k)] = v
+		}
 	}
 
 	return metadata, nil
 }
 
+// AudioStream returns the first audio stream of the file, the one that is
+// decoded. Video files may list their video stream first.
+func (m FFmpegMetadata) AudioStream() (FFmpegStream, bool) {
+	for _, stream := range m.Streams {
+		if stream.CodecType == "audio" {
+			return stream, true
+		}
+	}
+	return FFmpegStream{}, false
+}
+
+// HasVideo reports whether the file holds a video track, cover art aside.
+func (m FFmpegMetadata) HasVideo() bool {
+	for _, stream := range m.Streams {
+		if stream.CodecType == "video" && stream.Disposition["attached_pic"] == 0 {
+			return true
+		}
+	}
+	return false
+}
+
 func ProcessRecording(recData *models.RecordData, saveRecording bool) ([]float64, error) {
 	decodedAudioData, err := base64.StdEncoding.DecodeString(recData.Audio)
 	if err != nil {
@@ -275,8 +284,11 @@ func ProcessRecording(recData *models.RecordData, saveRecording bool) ([]float64
 		return nil, err
 	}
 
-	wavInfo, _ := ReadWavInfo(reformatedWavFile)
-	samples, _ := WavBytesToSamples(wavInfo.Data)
+	wavInfo, err := ReadWavInfo(reformatedWavFile)
+	if err != nil {
+		return nil, err
+	}
+	samples := wavInfo.LeftChannelSamples
 
 	if saveRecording {
 		logger := utils.GetLogger()
@@ -0,0 +1,43 @@
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+var client = &http.Client{Timeout: 10 * time.Second}
+
+// Event is the JSON body posted to webhook endpoints.
+type Event struct {
+	Type      string      `json:"type"`
+	Timestamp time.Time   `json:"timestamp"`
+	Data      interface{} `json:"data"`
+}
+
+// Send posts an event of the given type to url. An empty url is a no-op so
+// callers don't need to check whether a webhook is configured.
+func Send(url, eventType string, data interface{}) error {
+	if url == "" {
+		return nil
+	}
+
+	body, err := json.Marshal(Event{Type: eventType, Timestamp: time.Now().UTC(), Data: data})
+	if err != nil {
+		return fmt.Errorf("failed to marshal webhook event: %v", err)
+	}
+
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to send webhook: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+
+	return nil
+}
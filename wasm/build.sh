@@ -7,6 +7,16 @@ echo "Building WASM module..."
 export GOOS=js
 export GOARCH=wasm
 
+# The fingerprinting core must stay free of process execution and database
+# drivers, otherwise the module either fails at runtime in the browser or
+# balloons in size.
+FORBIDDEN_DEPS=$(go list -deps . | grep -E '^os/exec$|^go\.mongodb\.org/|^github\.com/mattn/go-sqlite3$|^song-recognition/(db|wav|spotify)$')
+if [ -n "$FORBIDDEN_DEPS" ]; then
+    echo "x WASM build pulls in unsupported packages:"
+    echo "$FORBIDDEN_DEPS"
+    exit 1
+fi
+
 go build -o fingerprint.wasm wasm_main.go
 
 if [ $? -eq 0 ]; then
@@ -1,6 +1,6 @@
 module wasm-fingerprint
 
-go 1.23.0
+go 1.24.0
 
 toolchain go1.24.3
 
@@ -8,7 +8,7 @@ require song-recognition v0.0.0-00010101000000-000000000000
 
 require (
 	github.com/golang/snappy v0.0.4 // indirect
-	github.com/klauspost/compress v1.17.6 // indirect
+	github.com/klauspost/compress v1.17.7 // indirect
 	github.com/mattn/go-sqlite3 v1.14.22 // indirect
 	github.com/mdobak/go-xerrors v0.3.1 // indirect
 	github.com/montanaflynn/stats v0.7.1 // indirect
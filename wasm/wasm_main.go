@@ -6,13 +6,12 @@ package main
 import (
 	"song-recognition/models"
 	"song-recognition/shazam"
-	"song-recognition/utils"
 	"syscall/js"
 )
 
 // generateFingerprint takes audio data from the frontend and generates fingerprints
 // Arguments: [audioArray, sampleRate, channels]
-// Returns: { error: number, data: fingerprintArray or error message }
+// Returns: { error: number, data: fingerprintArray or error message, version: number }
 func generateFingerprint(this js.Value, args []js.Value) interface{} {
 	if len(args) < 3 {
 		return js.ValueOf(map[string]interface{}{
@@ -44,47 +43,12 @@ func generateFingerprint(this js.Value, args []js.Value) interface{} {
 		audioData[i] = inputArray.Index(i).Float()
 	}
 
-	fingerprint := make(map[uint32]models.Couple)
-	var leftChannel, rightChannel []float64
-
-	if channels == 1 {
-		leftChannel = audioData
-		spectrogram, err := shazam.Spectrogram(audioData, sampleRate)
-		if err != nil {
-			return js.ValueOf(map[string]interface{}{
-				"error": 3,
-				"data":  "Error generating spectrogram: " + err.Error(),
-			})
-		}
-		peaks := shazam.ExtractPeaks(spectrogram, float64(len(audioData))/float64(sampleRate), sampleRate)
-		fingerprint = shazam.Fingerprint(peaks, utils.GenerateUniqueID())
-	} else {
-		for i := 0; i < len(audioData); i += 2 {
-			leftChannel = append(leftChannel, audioData[i])
-			rightChannel = append(rightChannel, audioData[i+1])
-		}
-
-		// LEFT
-		spectrogram, err := shazam.Spectrogram(leftChannel, sampleRate)
-		if err != nil {
-			return js.ValueOf(map[string]interface{}{
-				"error": 3,
-				"data":  "Error generating spectrogram: " + err.Error(),
-			})
-		}
-		peaks := shazam.ExtractPeaks(spectrogram, float64(len(leftChannel))/float64(sampleRate), sampleRate)
-		utils.ExtendMap(fingerprint, shazam.Fingerprint(peaks, utils.GenerateUniqueID()))
-
-		// RIGHT
-		spectrogram, err = shazam.Spectrogram(rightChannel, sampleRate)
-		if err != nil {
-			return js.ValueOf(map[string]interface{}{
-				"error": 3,
-				"data":  "Error generating spectrogram: " + err.Error(),
-			})
-		}
-		peaks = shazam.ExtractPeaks(spectrogram, float64(len(rightChannel))/float64(sampleRate), sampleRate)
-		utils.ExtendMap(fingerprint, shazam.Fingerprint(peaks, utils.GenerateUniqueID()))
+	fingerprint, err := shazam.FingerprintSamples(audioData, sampleRate, channels, models.NewSongID())
+	if err != nil {
+		return js.ValueOf(map[string]interface{}{
+			"error": 3,
+			"data":  "Error generating fingerprint: " + err.Error(),
+		})
 	}
 
 	fingerprintArray := []interface{}{}
@@ -97,8 +61,9 @@ func generateFingerprint(this js.Value, args []js.Value) interface{} {
 	}
 
 	return js.ValueOf(map[string]interface{}{
-		"error": 0,
-		"data":  fingerprintArray,
+		"error":   0,
+		"data":    fingerprintArray,
+		"version": shazam.FingerprintVersion,
 	})
 }
 